@@ -0,0 +1,282 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alert pages someone when capture fails silently:  when a thread
+// drops too many packets, or stops producing index files.  Alerts are sent
+// to a webhook or given to a command, when they start firing and when they
+// resolve.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	v = base.V // verbose logging
+
+	alertsSent    = stats.S.Get("alerts_sent")
+	alertFailures = stats.S.Get("alert_failures")
+)
+
+// Names of alerts.
+const (
+	Drops      = "drops"       // A thread dropped too many packets.
+	StaleIndex = "stale_index" // A thread hasn't produced an index file.
+)
+
+// Alert is what's sent when an alert starts firing, or resolves.
+type Alert struct {
+	Name    string
+	Host    string // The sensor, as its hostname.
+	Thread  int
+	Firing  bool // False once it's resolved.
+	Message string
+	Time    time.Time
+}
+
+// Notifier sends alerts somewhere they'll be seen.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// Notifiers sends each alert to every one of its notifiers.
+type Notifiers []Notifier
+
+// Notify implements Notifier, returning the first error.
+func (n Notifiers) Notify(ctx context.Context, a Alert) (err error) {
+	for _, notifier := range n {
+		if e := notifier.Notify(ctx, a); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// webhook POSTs alerts as JSON to a URL.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook returns a Notifier POSTing each alert as JSON to url, with c.
+func NewWebhook(url string, c *http.Client) Notifier {
+	return &webhook{url: url, client: c}
+}
+
+func (w *webhook) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("alert webhook failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("alert webhook returned %v: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// command runs a command for each alert.
+type command struct {
+	path string
+	args []string
+}
+
+// NewCommand returns a Notifier which runs a command for each alert, giving
+// it the alert as JSON on stdin.  The command is split on spaces.
+func NewCommand(cmd string) (Notifier, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return nil, errors.New("empty alert command")
+	}
+	return &command{fields[0], fields[1:]}, nil
+}
+
+func (c *command) Notify(ctx context.Context, a Alert) error {
+	in, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(in), &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("alert command %q failed: %v: %s", c.path, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// Sample is what a thread had captured, and when its newest file was
+// started, at the time a Monitor checked it.
+type Sample struct {
+	Thread  int
+	Packets int64 // Since stenotype started, so they reset when it restarts.
+	Drops   int64 // Likewise.
+	// Newest is when the thread's newest file was started, or zero if it
+	// has none.
+	Newest time.Time
+}
+
+// Limits are what a Monitor alerts on.  Zero limits aren't checked.
+type Limits struct {
+	// DropWindow is how far back drops are counted.
+	DropWindow time.Duration
+	// MaxDrops is how many packets a thread may drop within DropWindow.
+	MaxDrops int64
+	// MaxDropPercent is the percentage of its packets a thread may drop
+	// within DropWindow.
+	MaxDropPercent float64
+	// MaxIndexAge is how long a thread may go without a new file.
+	MaxIndexAge time.Duration
+}
+
+// counts is a thread's packets and drops at a time, adding up those counted
+// before stenotype restarted.
+type counts struct {
+	at             time.Time
+	packets, drops int64
+}
+
+// threadState is what a Monitor knows of a thread.
+type threadState struct {
+	last    Sample   // As last checked.
+	history []counts // Within DropWindow, oldest first.
+	firing  map[string]bool
+}
+
+// Monitor checks samples of each thread against its limits, notifying when
+// alerts start firing and when they resolve.  It's not safe for concurrent
+// use.
+type Monitor struct {
+	limits  Limits
+	n       Notifier
+	host    string
+	started time.Time
+	threads map[int]*threadState
+}
+
+// NewMonitor returns a Monitor of l, notifying n.  Threads without files are
+// considered stale from now.
+func NewMonitor(l Limits, n Notifier) *Monitor {
+	host, _ := os.Hostname()
+	return &Monitor{limits: l, n: n, host: host, started: time.Now(), threads: map[int]*threadState{}}
+}
+
+// add records s at now, returning the packets and drops within the window.
+func (t *threadState) add(s Sample, now time.Time, window time.Duration) (packets, drops int64) {
+	c := counts{at: now}
+	if n := len(t.history); n > 0 {
+		c = t.history[n-1]
+		c.at = now
+		// Counters going backwards means stenotype restarted, starting them
+		// from zero.
+		if s.Packets < t.last.Packets || s.Drops < t.last.Drops {
+			c.packets += s.Packets
+			c.drops += s.Drops
+		} else {
+			c.packets += s.Packets - t.last.Packets
+			c.drops += s.Drops - t.last.Drops
+		}
+	}
+	t.last = s
+	t.history = append(t.history, c)
+	// Keep the oldest sample at least window old, so the window's covered.
+	drop := 0
+	for drop+1 < len(t.history) && now.Sub(t.history[drop+1].at) >= window {
+		drop++
+	}
+	t.history = t.history[drop:]
+	first := t.history[0]
+	return c.packets - first.packets, c.drops - first.drops
+}
+
+// Check checks samples taken at now, notifying of the alerts that started
+// firing or resolved since the last check.  It returns the first error
+// notifying.
+func (m *Monitor) Check(ctx context.Context, now time.Time, samples []Sample) (err error) {
+	for _, s := range samples {
+		t := m.threads[s.Thread]
+		if t == nil {
+			t = &threadState{firing: map[string]bool{}}
+			m.threads[s.Thread] = t
+		}
+		packets, drops := t.add(s, now, m.limits.DropWindow)
+		if m.limits.MaxDrops > 0 || m.limits.MaxDropPercent > 0 {
+			pct := 0.0
+			if packets+drops > 0 {
+				pct = float64(drops) * 100 / float64(packets+drops)
+			}
+			firing := (m.limits.MaxDrops > 0 && drops > m.limits.MaxDrops) ||
+				(m.limits.MaxDropPercent > 0 && pct > m.limits.MaxDropPercent)
+			msg := fmt.Sprintf("thread %d dropped %d packets (%.2f%%) in the last %v", s.Thread, drops, pct, m.limits.DropWindow)
+			if e := m.update(ctx, t, Drops, s.Thread, firing, msg, now); err == nil {
+				err = e
+			}
+		}
+		if m.limits.MaxIndexAge > 0 {
+			newest, msg := s.Newest, ""
+			if newest.IsZero() {
+				newest = m.started
+				msg = fmt.Sprintf("thread %d has had no files for %v", s.Thread, now.Sub(newest).Truncate(time.Second))
+			} else {
+				msg = fmt.Sprintf("thread %d's newest file started %v ago", s.Thread, now.Sub(newest).Truncate(time.Second))
+			}
+			if e := m.update(ctx, t, StaleIndex, s.Thread, now.Sub(newest) > m.limits.MaxIndexAge, msg, now); err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// update notifies if the named alert of a thread has started firing or
+// resolved.  If notifying fails, it's retried at the next check.
+func (m *Monitor) update(ctx context.Context, t *threadState, name string, thread int, firing bool, msg string, now time.Time) error {
+	if t.firing[name] == firing {
+		return nil
+	}
+	a := Alert{Name: name, Host: m.host, Thread: thread, Firing: firing, Message: msg, Time: now}
+	if err := m.n.Notify(ctx, a); err != nil {
+		alertFailures.Increment()
+		return err
+	}
+	alertsSent.Increment()
+	v(1, "sent alert %+v", a)
+	t.firing[name] = firing
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type fakeNotifier struct {
+	alerts []Alert
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, a Alert) error {
+	f.alerts = append(f.alerts, a)
+	return nil
+}
+
+// firing returns the names of the alerts notified, prefixed with "+" if
+// they started firing and "-" if they resolved, and clears them.
+func (f *fakeNotifier) firing() []string {
+	var out []string
+	for _, a := range f.alerts {
+		if a.Firing {
+			out = append(out, "+"+a.Name)
+		} else {
+			out = append(out, "-"+a.Name)
+		}
+	}
+	f.alerts = nil
+	return out
+}
+
+func TestMonitorDrops(t *testing.T) {
+	n := &fakeNotifier{}
+	m := NewMonitor(Limits{DropWindow: 5 * time.Minute, MaxDrops: 100, MaxDropPercent: 1}, n)
+	ctx := context.Background()
+	start := time.Unix(1500000000, 0)
+	for _, test := range []struct {
+		minutes        int
+		packets, drops int64
+		want           string
+	}{
+		{0, 0, 0, ""},
+		{1, 1000000, 50, ""},
+		{2, 2000000, 150, "+drops"},   // 150 dropped in the window.
+		{3, 3000000, 150, ""},         // Still 150 in the window.
+		{7, 7000000, 150, "-drops"},   // The drops aged out.
+		{8, 100, 200, "+drops"},       // stenotype restarted, then dropped 200.
+		{14, 10000000, 200, "-drops"}, // Quiet since.
+	} {
+		now := start.Add(time.Duration(test.minutes) * time.Minute)
+		if err := m.Check(ctx, now, []Sample{{Thread: 0, Packets: test.packets, Drops: test.drops, Newest: now}}); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if f := n.firing(); len(f) > 0 {
+			got = f[0]
+		}
+		if got != test.want {
+			t.Errorf("minute %d: got alert %q, want %q", test.minutes, got, test.want)
+		}
+	}
+}
+
+func TestMonitorStaleIndex(t *testing.T) {
+	n := &fakeNotifier{}
+	m := NewMonitor(Limits{MaxIndexAge: 10 * time.Minute}, n)
+	ctx := context.Background()
+	now := m.started
+	for _, test := range []struct {
+		after  time.Duration
+		newest time.Duration // Ago, or 0 for no files.
+		want   []string
+	}{
+		{time.Minute, 0, nil},
+		{15 * time.Minute, 0, []string{"+stale_index"}},
+		{16 * time.Minute, 11 * time.Minute, nil},
+		{17 * time.Minute, time.Minute, []string{"-stale_index"}},
+	} {
+		at := now.Add(test.after)
+		s := Sample{Thread: 3}
+		if test.newest > 0 {
+			s.Newest = at.Add(-test.newest)
+		}
+		if err := m.Check(ctx, at, []Sample{s}); err != nil {
+			t.Fatal(err)
+		}
+		if got := n.firing(); len(got) != len(test.want) || (len(got) > 0 && got[0] != test.want[0]) {
+			t.Errorf("after %v: got alerts %v, want %v", test.after, got, test.want)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+	want := Alert{Name: Drops, Host: "sensor", Thread: 1, Firing: true, Message: "dropped", Time: time.Unix(1500000000, 0).UTC()}
+	if err := NewWebhook(srv.URL, srv.Client()).Notify(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("webhook got %+v, want %+v", got, want)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "alert.json")
+	n, err := NewCommand("tee " + out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Alert{Name: StaleIndex, Thread: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var got Alert
+	if data, err := ioutil.ReadFile(out); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != StaleIndex || got.Thread != 2 {
+		t.Errorf("command got %+v", got)
+	}
+	if n, err := NewCommand("false"); err != nil {
+		t.Fatal(err)
+	} else if err := n.Notify(context.Background(), Alert{}); err == nil {
+		t.Errorf("failing command succeeded")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive keeps packet files that stenographer ages out in an object
+// store, like S3 or GCS, instead of deleting them, and looks up packets in
+// them, so old packets remain queryable, if slowly.  Files are compressed with
+// zstd when uploaded, and recorded in a Catalog.
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+)
+
+var (
+	v = base.V // verbose logging
+
+	filesArchived   = stats.S.Get("archive_files_uploaded")
+	bytesArchived   = stats.S.Get("archive_bytes_uploaded")
+	archiveFailures = stats.S.Get("archive_upload_failures")
+	filesFetched    = stats.S.Get("archive_files_fetched")
+	fetchFailures   = stats.S.Get("archive_fetch_failures")
+)
+
+// Archive uploads packet files and their indexes to a Store, and looks up
+// packets in those it has.
+type Archive struct {
+	store    Store
+	catalog  *Catalog
+	cacheDir string
+	fc       *filecache.Cache
+}
+
+// New returns an Archive keeping files in store, recorded in catalog.  Files
+// are fetched into cacheDir to be queried, then removed.
+func New(store Store, catalog *Catalog, cacheDir string, fc *filecache.Cache) *Archive {
+	return &Archive{store: store, catalog: catalog, cacheDir: cacheDir, fc: fc}
+}
+
+// key returns the key a file of a thread is stored under.  suffix is ".pkt"
+// for the packet file, or ".idx" and then any IP shard suffix for its index.
+func key(thread int, name, suffix string) string {
+	return fmt.Sprintf("thread%d/%s%s.zst", thread, name, suffix)
+}
+
+// Archived returns whether the named file of a thread has been archived.
+func (a *Archive) Archived(thread int, name string) bool {
+	ok, err := a.catalog.Has(thread, name)
+	if err != nil {
+		v(1, "could not check archive catalog for %q: %v", name, err)
+	}
+	return ok
+}
+
+// Archive uploads the named packet file of a thread, at packetPath, and its
+// index and IP shards, at indexPaths, then records it in the catalog.  The
+// index must be first.
+func (a *Archive) Archive(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error {
+	micros, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return fmt.Errorf("can't archive %q, its name isn't a time: %v", name, err)
+	}
+	e := Entry{Thread: thread, Name: name, Start: time.Unix(0, micros*1000)}
+	n, err := a.put(ctx, key(thread, name, ".pkt"), packetPath)
+	if err != nil {
+		archiveFailures.Increment()
+		return err
+	}
+	e.Bytes += n
+	for i, path := range indexPaths {
+		suffix := ".idx"
+		if i > 0 {
+			shard := strings.TrimPrefix(path, indexPaths[0])
+			e.Shards = append(e.Shards, shard)
+			suffix += shard
+		}
+		n, err := a.put(ctx, key(thread, name, suffix), path)
+		if err != nil {
+			archiveFailures.Increment()
+			return err
+		}
+		e.Bytes += n
+	}
+	e.Archived = time.Now()
+	if err := a.catalog.Add(e); err != nil {
+		archiveFailures.Increment()
+		return fmt.Errorf("could not record %q in archive catalog: %v", name, err)
+	}
+	filesArchived.Increment()
+	bytesArchived.IncrementBy(e.Bytes)
+	v(1, "archived thread %d file %q, %d bytes", thread, name, e.Bytes)
+	return nil
+}
+
+// put uploads the file at path, compressed, returning its uncompressed size.
+func (a *Archive) put(ctx context.Context, key, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	var n int64
+	go func() {
+		z, err := zstd.NewWriter(pw)
+		if err == nil {
+			n, err = io.Copy(z, f)
+			if cerr := z.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	err = a.store.Put(ctx, key, pr)
+	pr.CloseWithError(err) // Stops the compressor if the upload failed.
+	if err != nil {
+		return 0, fmt.Errorf("could not upload %q to %q: %v", path, key, err)
+	}
+	return n, nil
+}
+
+// fetch downloads and decompresses what's stored under key to path.
+func (a *Archive) fetch(ctx context.Context, key, path string) error {
+	r, err := a.store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not fetch %q: %v", key, err)
+	}
+	defer r.Close()
+	z, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, z); err != nil {
+		f.Close()
+		return fmt.Errorf("could not fetch %q: %v", key, err)
+	}
+	return f.Close()
+}
+
+// open fetches an archived file and its index, returning it opened, and a
+// function removing the fetched files once it's closed.
+func (a *Archive) open(ctx context.Context, e Entry) (_ *blockfile.BlockFile, remove func(), err error) {
+	// Blockfiles find their indexes by replacing PKT with IDX in their paths.
+	packetDir := filepath.Join(a.cacheDir, "PKT"+strconv.Itoa(e.Thread))
+	indexDir := indexfile.IndexPathFromBlockfilePath(packetDir)
+	packetPath, indexPath := filepath.Join(packetDir, e.Name), filepath.Join(indexDir, e.Name)
+	paths := []string{packetPath, indexPath}
+	remove = func() {
+		for _, p := range paths {
+			os.Remove(p)
+		}
+	}
+	defer func() {
+		if err != nil {
+			remove()
+		}
+	}()
+	for _, dir := range []string{packetDir, indexDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := a.fetch(ctx, key(e.Thread, e.Name, ".pkt"), packetPath); err != nil {
+		return nil, nil, err
+	}
+	if err := a.fetch(ctx, key(e.Thread, e.Name, ".idx"), indexPath); err != nil {
+		return nil, nil, err
+	}
+	for _, shard := range e.Shards {
+		paths = append(paths, indexPath+shard)
+		if err := a.fetch(ctx, key(e.Thread, e.Name, ".idx"+shard), indexPath+shard); err != nil {
+			return nil, nil, err
+		}
+	}
+	bf, err := blockfile.NewBlockFile(packetPath, a.fc)
+	if err != nil {
+		return nil, nil, err
+	}
+	filesFetched.Increment()
+	return bf, remove, nil
+}
+
+// Lookup looks up packets matching q in a thread's archived files created
+// before the given time, usually that of the thread's oldest file still on
+// disk.  Archived files are only searched if q has a start time, since every
+// file searched must be fetched.  Files are fetched and searched one at a
+// time, so packets come out in the order the thread captured them.
+func (a *Archive) Lookup(ctx context.Context, thread int, q query.Query, before time.Time) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	// Files are selected like the thread selects its own.
+	start, stop := q.GetTimeSpan(time.Time{}, time.Time{})
+	if start.IsZero() {
+		out.Close(nil)
+		return out
+	}
+	if !before.IsZero() && (stop.IsZero() || !stop.Before(before)) {
+		stop = before.Add(-time.Nanosecond)
+	}
+	entries, err := a.catalog.Entries(thread, start, stop)
+	if err != nil {
+		out.Close(fmt.Errorf("could not read archive catalog: %v", err))
+		return out
+	}
+	go func() {
+		for _, e := range entries {
+			if err := a.lookupIn(ctx, e, q, out); err != nil {
+				if ctx.Err() == nil {
+					fetchFailures.Increment()
+					err = fmt.Errorf("archived file %q of thread %d: %v", e.Name, thread, err)
+				}
+				out.Close(err)
+				return
+			}
+		}
+		out.Close(nil)
+	}()
+	return out
+}
+
+// lookupIn sends the packets in an archived file matching q to out.
+func (a *Archive) lookupIn(ctx context.Context, e Entry, q query.Query, out *base.PacketChan) error {
+	v(1, "fetching archived file %q of thread %d", e.Name, e.Thread)
+	bf, remove, err := a.open(ctx, e)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	defer bf.Close()
+	packets := base.NewPacketChan(100)
+	go bf.Lookup(ctx, q, packets)
+	for p := range packets.Receive() {
+		select {
+		case out.C <- p:
+		case <-ctx.Done():
+			packets.Discard()
+			<-packets.Done()
+			return ctx.Err()
+		}
+	}
+	return packets.Err()
+}
+
+// Oldest returns when a thread's oldest archived file was created, or the
+// zero time if it has none.
+func (a *Archive) Oldest(thread int) time.Time {
+	t, err := a.catalog.Oldest(thread)
+	if err != nil {
+		v(1, "could not read archive catalog: %v", err)
+	}
+	return t
+}
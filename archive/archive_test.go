@@ -0,0 +1,145 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/query"
+	"../query"
+	"golang.org/x/net/context"
+)
+
+func TestNewStore(t *testing.T) {
+	for _, test := range []struct {
+		url string
+		ok  bool
+	}{
+		{"s3://bucket/prefix", true},
+		{"gs://bucket", true},
+		{"file:///var/archive", true},
+		{"s3:///prefix", false},
+		{"file://", false},
+		{"http://bucket", false},
+	} {
+		if _, err := NewStore(test.url, ""); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v, want ok %v", test.url, err, test.ok)
+		}
+	}
+}
+
+// testArchive returns an Archive in a temporary directory, and the directory
+// holding copies of the test data's dhcp and vlan files, named as created at
+// 1h and 2h after the epoch.
+func testArchive(t *testing.T) (*Archive, string) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"PKT0", "IDX0", "store"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for src, dst := range map[string]string{"dhcp": "3600000000", "vlan": "7200000000"} {
+		for _, d := range []string{"PKT0", "IDX0"} {
+			if err := exec.Command("cp", filepath.Join("..", "testdata", d, src), filepath.Join(dir, d, dst)).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	catalog, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(dirStore(filepath.Join(dir, "store")), catalog, filepath.Join(dir, "cache"), filecache.NewCache(10)), dir
+}
+
+func timestamps(t *testing.T, c *base.PacketChan) []time.Time {
+	var out []time.Time
+	for p := range c.Receive() {
+		out = append(out, p.Timestamp)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestArchiveLookup(t *testing.T) {
+	a, dir := testArchive(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	for _, name := range []string{"3600000000", "7200000000"} {
+		if a.Archived(0, name) {
+			t.Errorf("%q archived before it was", name)
+		}
+		index := filepath.Join(dir, "IDX0", name)
+		if err := a.Archive(ctx, 0, name, filepath.Join(dir, "PKT0", name), []string{index}); err != nil {
+			t.Fatal(err)
+		}
+		if !a.Archived(0, name) {
+			t.Errorf("%q not archived", name)
+		}
+	}
+	if got, want := a.Oldest(0), time.Unix(3600, 0); !got.Equal(want) {
+		t.Errorf("got oldest %v, want %v", got, want)
+	}
+	q, err := query.NewQuery("after 1970-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archive should return what the original files do.
+	var want []time.Time
+	for _, name := range []string{"3600000000", "7200000000"} {
+		bf, err := blockfile.NewBlockFile(filepath.Join(dir, "PKT0", name), filecache.NewCache(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := base.NewPacketChan(100)
+		go bf.Lookup(ctx, q, c)
+		want = append(want, timestamps(t, c)...)
+		bf.Close()
+	}
+	if got := timestamps(t, a.Lookup(ctx, 0, q, time.Time{})); len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d packets, want %d", len(got), len(want))
+	}
+	// Files still on disk aren't searched.
+	dhcp := want[:len(timestamps(t, a.Lookup(ctx, 0, q, time.Unix(7200, 0))))]
+	if len(dhcp) == 0 || len(dhcp) == len(want) {
+		t.Errorf("got %d packets before the second file, of %d", len(dhcp), len(want))
+	}
+	// Nor are archives searched at all without a start time.
+	all, err := query.NewQuery("udp or tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := timestamps(t, a.Lookup(ctx, 0, all, time.Time{})); len(got) != 0 {
+		t.Errorf("got %d packets without a start time", len(got))
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "cache", "*", "*")); len(files) != 0 {
+		t.Errorf("fetched files not removed: %v", files)
+	}
+}
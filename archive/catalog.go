@@ -0,0 +1,133 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the "sqlite3" driver
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS files (
+  thread         INTEGER NOT NULL,
+  name           TEXT NOT NULL,
+  start_nanos    INTEGER NOT NULL,
+  bytes          INTEGER NOT NULL,
+  shards         TEXT NOT NULL,
+  archived_nanos INTEGER NOT NULL,
+  PRIMARY KEY (thread, name)
+);
+CREATE INDEX IF NOT EXISTS files_start ON files (thread, start_nanos);
+`
+
+// Entry is the catalog's record of an archived file.
+type Entry struct {
+	Thread   int
+	Name     string    // The packet file's name.
+	Start    time.Time // When the file was created.
+	Bytes    int64     // Of the packet file and its index, before compression.
+	Shards   []string  // Suffixes of the index's IP shard files, like ".ip3".
+	Archived time.Time
+}
+
+// Catalog is a SQLite-backed record of the files in an archive, so they can
+// be found without listing the Store.
+type Catalog struct {
+	db *sql.DB
+}
+
+// OpenCatalog opens the named SQLite database, creating it if necessary.
+func OpenCatalog(filename string) (*Catalog, error) {
+	v(1, "opening archive catalog %q", filename)
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive catalog %q: %v", filename, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create archive catalog schema in %q: %v", filename, err)
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Add records that a file's been archived, replacing any previous record of
+// it.
+func (c *Catalog) Add(e Entry) error {
+	_, err := c.db.Exec(
+		"INSERT OR REPLACE INTO files (thread, name, start_nanos, bytes, shards, archived_nanos) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Thread, e.Name, e.Start.UnixNano(), e.Bytes, strings.Join(e.Shards, ","), e.Archived.UnixNano())
+	return err
+}
+
+// Has returns whether the named file of a thread has been archived.
+func (c *Catalog) Has(thread int, name string) (bool, error) {
+	var n int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM files WHERE thread = ? AND name = ?", thread, name).Scan(&n)
+	return n > 0, err
+}
+
+// Entries returns a thread's archived files created in [start, stop], oldest
+// first.  Zero times leave that end open.
+func (c *Catalog) Entries(thread int, start, stop time.Time) ([]Entry, error) {
+	q := "SELECT thread, name, start_nanos, bytes, shards, archived_nanos FROM files WHERE thread = ?"
+	args := []interface{}{thread}
+	if !start.IsZero() {
+		q += " AND start_nanos >= ?"
+		args = append(args, start.UnixNano())
+	}
+	if !stop.IsZero() {
+		q += " AND start_nanos <= ?"
+		args = append(args, stop.UnixNano())
+	}
+	rows, err := c.db.Query(q+" ORDER BY start_nanos, name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Entry
+	for rows.Next() {
+		var e Entry
+		var start, archived int64
+		var shards string
+		if err := rows.Scan(&e.Thread, &e.Name, &start, &e.Bytes, &shards, &archived); err != nil {
+			return nil, err
+		}
+		e.Start, e.Archived = time.Unix(0, start), time.Unix(0, archived)
+		if shards != "" {
+			e.Shards = strings.Split(shards, ",")
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Oldest returns when a thread's oldest archived file was created, or the
+// zero time if it has none.
+func (c *Catalog) Oldest(thread int) (time.Time, error) {
+	var start sql.NullInt64
+	if err := c.db.QueryRow("SELECT MIN(start_nanos) FROM files WHERE thread = ?", thread).Scan(&start); err != nil || !start.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(0, start.Int64), nil
+}
+
+// Close closes the database.
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
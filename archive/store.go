@@ -0,0 +1,153 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/net/context"
+)
+
+// Store is where archived files are kept.
+type Store interface {
+	// Put stores what's read from r under key, replacing anything already
+	// there.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns what's stored under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// uploadPartBytes is the size of the parts objects are uploaded in, which are
+// each buffered in memory.
+const uploadPartBytes = 64 << 20
+
+// NewStore returns the Store at rawURL, which is "s3://BUCKET/PREFIX",
+// "gs://BUCKET/PREFIX" or "file:///DIRECTORY".  Buckets are accessed with the
+// credentials in the usual AWS environment variables, credentials file or
+// instance role; for GCS these must be HMAC keys.  endpoint, like
+// "minio.example.com:9000", overrides S3's or GCS's, for other S3-compatible
+// stores.
+func NewStore(rawURL, endpoint string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive URL %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("archive URL %q has no directory", rawURL)
+		}
+		return dirStore(u.Path), nil
+	case "s3", "gs":
+	default:
+		return nil, fmt.Errorf("archive URL %q isn't s3://, gs:// or file://", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("archive URL %q has no bucket", rawURL)
+	}
+	secure := true
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+		if u.Scheme == "gs" {
+			endpoint = "storage.googleapis.com"
+		}
+	} else if e, err := url.Parse(endpoint); err == nil && e.Host != "" {
+		endpoint, secure = e.Host, e.Scheme != "http"
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create client for %q: %v", rawURL, err)
+	}
+	return &bucketStore{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// bucketStore keeps files in an S3-compatible bucket.
+type bucketStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (b *bucketStore) object(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return b.prefix + "/" + key
+}
+
+// Put implements Store.
+func (b *bucketStore) Put(ctx context.Context, key string, r io.Reader) error {
+	_, err := b.client.PutObject(ctx, b.bucket, b.object(key), r, -1, minio.PutObjectOptions{PartSize: uploadPartBytes})
+	return err
+}
+
+// Get implements Store.
+func (b *bucketStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, b.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject doesn't fail until the object's read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// dirStore keeps files in a local directory, like a mounted network share.
+type dirStore string
+
+// Put implements Store.
+func (d dirStore) Put(ctx context.Context, key string, r io.Reader) error {
+	path := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a hidden file first, so a partial upload is never read.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".archive")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Get implements Store.
+func (d dirStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(key)))
+}
@@ -0,0 +1,246 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit keeps a tamper-evident, append-only log of every packet
+// retrieval, for chain-of-custody purposes.  Each entry is a line of JSON
+// holding the hash of the entry before it, so removing, reordering or editing
+// any entry breaks the chain from that point on, which Verify detects.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+var v = base.V // verbose logging
+
+// Record describes a single packet retrieval, or a change made through the
+// API.
+type Record struct {
+	Time    time.Time // When the retrieval finished.
+	QueryID int64     // As listed by /queries and Jobs while it ran.
+	API     string    // The HTTP path or gRPC method it was made through.
+	Client  string    // Who made it: their certificate's CN or token subject, or else their address.
+	Query   string
+	Packets int64  // Packets returned.
+	Bytes   int64  // Bytes of response sent.
+	SHA256  string `json:",omitempty"` // Hex SHA-256 of the response, if it has one.
+	Err     string `json:",omitempty"` // Empty if the retrieval succeeded.
+	// Action is set for changes made through the API rather than
+	// retrievals, like "release_hold".
+	Action string `json:",omitempty"`
+}
+
+// entry is a Record as written to the log, chained to the entry before it.
+type entry struct {
+	Record
+	Prev string // Hash of the previous entry, or "" for the first.
+	Hash string // Hex SHA-256 of this entry's JSON, with Hash itself empty.
+}
+
+// hash returns the hash an entry should have.
+func (e entry) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log is an audit log file.  Once it's over its maximum size, it's rotated:
+// renamed with a timestamp suffix, and replaced by a new file whose chain
+// continues from the last entry of the old one.
+type Log struct {
+	mu       sync.Mutex
+	name     string
+	maxBytes int64
+	f        *os.File
+	size     int64
+	last     string // Hash of the last entry written.
+	remote   *syslog.Writer
+}
+
+// Open opens the named audit log for appending, creating it if necessary.
+// If maxBytes is positive, the file is rotated once it's that large.  If
+// remote is a URL like "udp://loghost:514", each entry is also sent there
+// over syslog.  If the existing log's chain is broken, that's logged as an
+// alert, and new entries chain on from its last entry.
+func Open(filename string, maxBytes int64, remote string) (*Log, error) {
+	v(1, "opening audit log %q", filename)
+	l := &Log{name: filename, maxBytes: maxBytes}
+	if r, err := os.Open(filename); err == nil {
+		l.last, _, err = Verify(r, "")
+		r.Close()
+		if err != nil {
+			log.Printf("ALERT: audit log %q has been tampered with: %v", filename, err)
+			if l.last, err = lastHash(filename); err != nil {
+				return nil, fmt.Errorf("could not read audit log %q: %v", filename, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read audit log %q: %v", filename, err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if remote != "" {
+		u, err := url.Parse(remote)
+		if err != nil || u.Host == "" {
+			l.f.Close()
+			return nil, fmt.Errorf("invalid audit syslog address %q", remote)
+		}
+		if l.remote, err = syslog.Dial(u.Scheme, u.Host, syslog.LOG_AUTH|syslog.LOG_NOTICE, "stenographer-audit"); err != nil {
+			l.f.Close()
+			return nil, fmt.Errorf("could not connect to audit syslog %q: %v", remote, err)
+		}
+	}
+	return l, nil
+}
+
+// lastHash returns the Hash of the last entry in the named file, whether or
+// not it's valid, or "" if there's none.
+func lastHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	last := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e entry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Hash != "" {
+			last = e.Hash
+		}
+	}
+	return last, scanner.Err()
+}
+
+// open opens l's file for appending.
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit log %q: %v", l.name, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not stat audit log %q: %v", l.name, err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotate renames l's file aside and starts a new one.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", l.name, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	v(1, "rotating audit log %q to %q", l.name, rotated)
+	if err := os.Rename(l.name, rotated); err != nil {
+		return fmt.Errorf("could not rotate audit log %q: %v", l.name, err)
+	}
+	return l.open()
+}
+
+// Add appends a record to the log, and syncs it to disk before returning.
+// Failing to send it to the remote syslog is logged, but not returned.
+func (l *Log) Add(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := entry{Record: r, Prev: l.last}
+	var err error
+	if e.Hash, err = e.hash(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write audit log %q: %v", l.name, err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("could not sync audit log %q: %v", l.name, err)
+	}
+	l.last = e.Hash
+	if l.remote != nil {
+		if err := l.remote.Notice(string(line)); err != nil {
+			log.Printf("could not send audit log entry to syslog: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.remote != nil {
+		l.remote.Close()
+	}
+	return l.f.Close()
+}
+
+// Verify checks the chain of the audit log entries read from r, the first
+// of which must follow the entry hashed prev.  If prev is "", the first
+// entry is trusted to start the chain, so a rotated file can be verified on
+// its own, or chained from the last hash of the file before it.  It returns
+// the hash of the last entry and the number of entries read.
+func Verify(r io.Reader, prev string) (last string, n int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	last = prev
+	for scanner.Scan() {
+		n++
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return last, n, fmt.Errorf("entry %d is invalid: %v", n, err)
+		}
+		if (n > 1 || prev != "") && e.Prev != last {
+			return last, n, fmt.Errorf("entry %d doesn't follow the entry before it", n)
+		}
+		if want, err := e.hash(); err != nil {
+			return last, n, err
+		} else if e.Hash != want {
+			return last, n, fmt.Errorf("entry %d has been modified", n)
+		}
+		last = e.Hash
+	}
+	return last, n, scanner.Err()
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addRecords(t *testing.T, l *Log, n int) {
+	for i := 0; i < n; i++ {
+		if err := l.Add(Record{
+			Time:    time.Date(2015, 1, 2, 3, 4, i, 0, time.UTC),
+			QueryID: int64(i),
+			API:     "/query",
+			Client:  "alice",
+			Query:   "port 80",
+			Packets: 10,
+			Bytes:   1000,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	name := filepath.Join(d, "audit.log")
+	l, err := Open(name, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRecords(t, l, 2)
+	l.Close()
+	// Reopening continues the chain.
+	if l, err = Open(name, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	addRecords(t, l, 2)
+	l.Close()
+
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, n, err := Verify(bytes.NewReader(contents), ""); err != nil || n != 4 {
+		t.Fatalf("verified %d entries with error %v, want 4", n, err)
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	for _, test := range []struct {
+		desc, log string
+	}{
+		{"modified", strings.Replace(string(contents), `"Packets":10`, `"Packets":11`, 1)},
+		{"removed", lines[0] + lines[2] + lines[3]},
+		{"reordered", lines[0] + lines[2] + lines[1] + lines[3]},
+	} {
+		if _, _, err := Verify(strings.NewReader(test.log), ""); err == nil {
+			t.Errorf("%s log verified", test.desc)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	d, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	name := filepath.Join(d, "audit.log")
+	l, err := Open(name, 500, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRecords(t, l, 5)
+	l.Close()
+	files, err := filepath.Glob(name + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("log wasn't rotated: %v", files)
+	}
+	// The chain continues across files, oldest first.
+	prev, total := "", 0
+	for _, file := range append(files[1:], files[0]) {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		prev, n, err = Verify(f, prev)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", file, err)
+		}
+		total += n
+	}
+	if total != 5 {
+		t.Errorf("got %d entries, want 5", total)
+	}
+}
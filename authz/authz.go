@@ -0,0 +1,264 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authz decides what each client may query, based on the certificate
+// or bearer token it authenticated with, according to a JSON policy file.
+// The file is reread whenever it changes, so policies can be updated without
+// restarting.
+//
+// A policy file looks like:
+//
+//	{"Rules": [
+//	  {"OU": "soc"},
+//	  {"CN": "contractor", "Subnets": ["10.1.0.0/16"], "VLANs": [20], "MaxTimeRange": "168h"},
+//	  {"OU": "noc", "FlowsOnly": true},
+//	  {"OU": "blue-team", "Filter": "vlan 30 or net 10.30.0.0/16"}
+//	]}
+//
+// The first rule matching a client applies.  Clients matching no rule may run
+// no queries at all.
+package authz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+var v = base.V // verbose logging
+
+// ErrDenied is returned for clients no rule allows to query.
+var ErrDenied = errors.New("not authorized to query")
+
+// Rule grants the clients whose certificates or tokens match it the right to query,
+// possibly limited to some of the packets.
+type Rule struct {
+	// CN is the common name certificates, or the subject bearer tokens, must
+	// have.  If empty, any matches.
+	CN string `json:",omitempty"`
+	// OU is an organizational unit certificates, or a group bearer tokens,
+	// must have.  If empty, any matches.
+	OU string `json:",omitempty"`
+	// Subnets, if set, limits queries to packets to or from these CIDRs.
+	Subnets []string `json:",omitempty"`
+	// VLANs, if set, limits queries to packets on these VLANs.
+	VLANs []int `json:",omitempty"`
+	// MaxTimeRange, if set, limits queries to packets captured this long
+	// (e.g. "168h") before the query was run.
+	MaxTimeRange string `json:",omitempty"`
+	// Filter, if set, is a query every query the client runs is limited to,
+	// like "vlan 20 or net 10.20.0.0/16", for scoping a team to its own
+	// traffic on a shared sensor.  It can't use post-filters, sampling or
+	// bidir, and any hostsets it uses are read when the policy's loaded.
+	Filter string `json:",omitempty"`
+	// FlowsOnly limits clients to flow metadata, from /flows, without ever
+	// seeing packets.
+	FlowsOnly bool `json:",omitempty"`
+}
+
+// Policy is the contents of a policy file.
+type Policy struct {
+	Rules []Rule
+}
+
+// matches returns whether a client with the given name and groups matches r.
+func (r Rule) matches(name string, groups []string) bool {
+	if r.CN != "" && r.CN != name {
+		return false
+	}
+	if r.OU == "" {
+		return true
+	}
+	for _, g := range groups {
+		if g == r.OU {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant is what a single client is allowed to query.  A nil Grant allows
+// everything.
+type Grant struct {
+	restrict string      // Query packets must also match, without the time limit.
+	filter   query.Query // The rule's Filter, if any.
+	maxAge   time.Duration
+	// FlowsOnly is set if the client may only get flow metadata.
+	FlowsOnly bool
+}
+
+// newGrant checks r, and returns the grant it gives.
+func newGrant(r Rule) (*Grant, error) {
+	g := &Grant{FlowsOnly: r.FlowsOnly}
+	var clauses []string
+	if len(r.Subnets) > 0 {
+		var nets []string
+		for _, s := range r.Subnets {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid subnet %q", s)
+			}
+			nets = append(nets, "net "+n.String())
+		}
+		clauses = append(clauses, "("+strings.Join(nets, " or ")+")")
+	}
+	if len(r.VLANs) > 0 {
+		var vlans []string
+		for _, vlan := range r.VLANs {
+			if vlan < 0 || vlan >= 4096 {
+				return nil, fmt.Errorf("invalid VLAN %d", vlan)
+			}
+			vlans = append(vlans, fmt.Sprintf("vlan %d", vlan))
+		}
+		clauses = append(clauses, "("+strings.Join(vlans, " or ")+")")
+	}
+	g.restrict = strings.Join(clauses, " and ")
+	if g.restrict != "" {
+		if _, err := query.NewQuery(g.restrict); err != nil {
+			return nil, err
+		}
+	}
+	if r.Filter != "" {
+		q, err := query.NewQuery(r.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", r.Filter, err)
+		}
+		if !query.Plain(q) {
+			return nil, fmt.Errorf("filter %q can't use post-filters, sampling or bidir", r.Filter)
+		}
+		g.filter = q
+	}
+	if r.MaxTimeRange != "" {
+		d, err := time.ParseDuration(r.MaxTimeRange)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid max time range %q", r.MaxTimeRange)
+		}
+		g.maxAge = d
+	}
+	return g, nil
+}
+
+// Restrict returns q, limited to the packets the grant allows the client to
+// see if it's run at now.
+func (g *Grant) Restrict(q query.Query, now time.Time) query.Query {
+	if g == nil {
+		return q
+	}
+	if g.filter != nil {
+		q = query.Restrict(q, g.filter)
+	}
+	restrict := g.restrict
+	if g.maxAge > 0 {
+		// Round up to the second, so the limit's never exceeded.
+		after := now.Add(-g.maxAge).Truncate(time.Second).Add(time.Second)
+		if restrict != "" {
+			restrict += " and "
+		}
+		restrict += "after " + after.UTC().Format(time.RFC3339)
+	}
+	if restrict == "" {
+		return q
+	}
+	to, err := query.NewQuery(restrict)
+	if err != nil {
+		// Every part was checked by newGrant.
+		panic(fmt.Sprintf("invalid restriction %q: %v", restrict, err))
+	}
+	return query.Restrict(q, to)
+}
+
+// Unrestricted returns whether the grant allows querying every packet, which
+// clients must have to change what's captured.
+func (g *Grant) Unrestricted() bool {
+	return g == nil || (g.restrict == "" && g.filter == nil && g.maxAge == 0 && !g.FlowsOnly)
+}
+
+// Authorizer authorizes clients according to a policy file.
+type Authorizer struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time // Of the policy in effect.
+	badTime time.Time // Of the last policy that couldn't be loaded.
+	rules   []Rule
+	grants  []*Grant
+}
+
+// New returns an Authorizer following the policy file at path, which must
+// exist and be valid.
+func New(path string) (*Authorizer, error) {
+	a := &Authorizer{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload rereads the policy file if it's changed.  a.mu must be held, or a
+// not yet shared.
+func (a *Authorizer) reload() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("could not stat authorization policy: %v", err)
+	}
+	if fi.ModTime().Equal(a.modTime) || fi.ModTime().Equal(a.badTime) {
+		return nil
+	}
+	a.badTime = fi.ModTime()
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("could not read authorization policy: %v", err)
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("could not parse authorization policy %q: %v", a.path, err)
+	}
+	grants := make([]*Grant, len(p.Rules))
+	for i, r := range p.Rules {
+		if grants[i], err = newGrant(r); err != nil {
+			return fmt.Errorf("invalid rule %d in authorization policy %q: %v", i, a.path, err)
+		}
+	}
+	v(1, "loaded %d authorization rules from %q", len(p.Rules), a.path)
+	a.modTime, a.badTime, a.rules, a.grants = fi.ModTime(), time.Time{}, p.Rules, grants
+	return nil
+}
+
+// Authorize returns what a client may query, or ErrDenied.  Its name and
+// groups are its certificate's CN and OUs, or its bearer token's subject and
+// groups.  If the policy file's changed but can't be loaded, that's logged
+// once, and the last policy that could be stays in effect.
+func (a *Authorizer) Authorize(name string, groups []string) (*Grant, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reload(); err != nil {
+		log.Printf("keeping previous authorization policy: %v", err)
+	}
+	for i, r := range a.rules {
+		if r.matches(name, groups) {
+			return a.grants[i], nil
+		}
+	}
+	return nil, ErrDenied
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+func writePolicy(t *testing.T, path, policy string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	d, err := ioutil.TempDir("", "authz_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "policy.json")
+	start := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	writePolicy(t, path, `{"Rules": [
+	  {"OU": "soc"},
+	  {"CN": "contractor", "Subnets": ["10.1.2.3/16"], "VLANs": [20, 21], "MaxTimeRange": "1h"},
+	  {"OU": "noc", "FlowsOnly": true},
+	  {"OU": "blue", "Filter": "vlan 30 or net 10.30.0.0/16", "MaxTimeRange": "1h"}
+	]}`, start)
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := query.NewQuery("port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name         string
+		groups       []string
+		want         string // Restricted query, or "" if denied.
+		flowsOnly    bool
+		unrestricted bool
+	}{
+		{"alice", []string{"eng", "soc"}, "port 80", false, true},
+		{"contractor", nil, "(port 80 and ((host 10.1.0.0-10.1.255.255 and (vlan 20 or vlan 21)) and after 2018-01-01T11:00:01Z))", false, false},
+		{"bob", []string{"noc"}, "port 80", true, false},
+		{"carol", []string{"blue"}, "((port 80 and (vlan 30 or host 10.30.0.0-10.30.255.255)) and after 2018-01-01T11:00:01Z)", false, false},
+		{"mallory", []string{"eng"}, "", false, false},
+		{"", nil, "", false, false},
+	} {
+		who := test.name
+		g, err := a.Authorize(test.name, test.groups)
+		if test.want == "" {
+			if err != ErrDenied {
+				t.Errorf("%v: got %v, want denied", who, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: %v", who, err)
+			continue
+		}
+		if got := g.Restrict(q, now).String(); got != test.want {
+			t.Errorf("%v: got query %q, want %q", who, got, test.want)
+		}
+		if g.FlowsOnly != test.flowsOnly {
+			t.Errorf("%v: got flows only %v, want %v", who, g.FlowsOnly, test.flowsOnly)
+		}
+		if g.Unrestricted() != test.unrestricted {
+			t.Errorf("%v: got unrestricted %v, want %v", who, g.Unrestricted(), test.unrestricted)
+		}
+	}
+
+	// Changes are picked up, but invalid policies are ignored.
+	writePolicy(t, path, `{"Rules": [{"OU": "eng"}]}`, start.Add(time.Second))
+	if _, err := a.Authorize("mallory", []string{"eng"}); err != nil {
+		t.Errorf("new policy not loaded: %v", err)
+	}
+	for i, policy := range []string{
+		`{"Rules": [{"Subnets": ["bogus"]}]}`,
+		`{"Rules": [{"Filter": "port 80 and payload \"x\""}]}`,
+	} {
+		writePolicy(t, path, policy, start.Add(time.Duration(i+2)*time.Second))
+		if _, err := a.Authorize("mallory", []string{"eng"}); err != nil {
+			t.Errorf("invalid policy %s loaded: %v", policy, err)
+		}
+	}
+}
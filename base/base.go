@@ -38,9 +38,7 @@ var VerboseLogging = flag.Int("v", -1, "log many verbose logs")
 
 // V provides verbose logging which can be turned on/off with the -v flag.
 func V(level int, fmt string, args ...interface{}) {
-	if *VerboseLogging >= level {
-		log.Printf(fmt, args...)
-	}
+	VContext(context.Background(), level, fmt, args...)
 }
 
 // Packet is a single packet with its metadata.
@@ -49,6 +47,15 @@ type Packet struct {
 	gopacket.CaptureInfo        // Metadata about when/how the packet was captured
 }
 
+// Truncate cuts the packet's data down to its first snaplen bytes, if it's
+// longer.  Its Length stays the length of the packet on the wire.
+func (p *Packet) Truncate(snaplen int) {
+	if len(p.Data) > snaplen {
+		p.Data = p.Data[:snaplen]
+		p.CaptureLength = snaplen
+	}
+}
+
 // PacketChan provides an async method for passing multiple ordered packets
 // between goroutines.
 type PacketChan struct {
@@ -211,6 +218,71 @@ func MergePacketChans(ctx context.Context, in []*PacketChan) *PacketChan {
 	return out
 }
 
+// MergeWindowPacketChans merges packet chans taken from in, each sorted by
+// time, into a single chan sorted by time.  At most window of them are
+// merged at once:  another is taken from in whenever one runs out, so its
+// packets must be no older than those already sent, as with the files of a
+// single thread.  Callers can read the chans being merged concurrently,
+// while still sending packets in order.
+func MergeWindowPacketChans(ctx context.Context, in <-chan *PacketChan, window int) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		var h packetHeap
+		var chans []*PacketChan
+		defer func() {
+			for _, c := range chans {
+				c.Discard()
+			}
+		}()
+		// next receives the next packet from chans[i], pushing it onto h.
+		next := func(i int) error {
+			select {
+			case pkt := <-chans[i].Receive():
+				if pkt != nil {
+					heap.Push(&h, indexedPacket{Packet: pkt, i: i})
+				}
+				return chans[i].Err()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		for open := true; ; {
+			for open && h.Len() < window {
+				var c *PacketChan
+				select {
+				case c, open = <-in:
+				case <-ctx.Done():
+					out.Close(ctx.Err())
+					return
+				}
+				if open {
+					chans = append(chans, c)
+					if err := next(len(chans) - 1); err != nil {
+						out.Close(err)
+						return
+					}
+				}
+			}
+			if h.Len() == 0 {
+				break
+			}
+			p := heap.Pop(&h).(indexedPacket)
+			if err := next(p.i); err != nil {
+				out.Close(err)
+				return
+			}
+			select {
+			case out.c <- p.Packet:
+			case <-ctx.Done():
+				out.Close(ctx.Err())
+				return
+			}
+		}
+		out.Close(ctx.Err())
+	}()
+	return out
+}
+
 // Positions detail the offsets of packets within a blockfile.
 type Positions []int64
 
@@ -302,15 +374,55 @@ func PathDiskFreePercentage(path string) (int, error) {
 	return int(100 * stat.Bavail / stat.Blocks), nil
 }
 
-// snapLen is the max packet size we'll return in pcap files to users.
-const snapLen = 65536
+// PathDiskFreeBytes returns the number of bytes available to unprivileged
+// users on the disk holding the given path.
+func PathDiskFreeBytes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// PathDiskTotalBytes returns the size in bytes of the disk holding the given
+// path.
+func PathDiskTotalBytes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// SnapLen is the max packet size we'll return in pcap files to users.
+const SnapLen = 65536
 
 // PacketsToFile writes all packets from 'in' to 'out', writing out all packets
 // in a valid PCAP file format.
 func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
+	return PacketsToFileSnapLen(in, out, limit, SnapLen)
+}
+
+// PacketsToFileSnapLen is like PacketsToFile, but only writes the first
+// snaplen bytes of each packet.  Packet record headers still give each
+// packet's original length.
+func PacketsToFileSnapLen(in *PacketChan, out io.Writer, limit Limit, snaplen int) error {
+	_, err := PacketsToFileCount(in, out, limit, snaplen)
+	return err
+}
+
+// PacketsToFileCount is like PacketsToFileSnapLen, but also returns how many
+// packets were written.
+func PacketsToFileCount(in *PacketChan, out io.Writer, limit Limit, snaplen int) (int64, error) {
+	return PacketsToFileWatch(in, out, limit, snaplen, nil)
+}
+
+// PacketsToFileWatch is like PacketsToFileCount, but calls wrote, if it's
+// set, with each packet once it's been written.
+func PacketsToFileWatch(in *PacketChan, out io.Writer, limit Limit, snaplen int, wrote func(*Packet)) (int64, error) {
 	w := pcapgo.NewWriter(out)
-	w.WriteFileHeader(snapLen, layers.LinkTypeEthernet)
-	count := 0
+	w.WriteFileHeader(uint32(snaplen), layers.LinkTypeEthernet)
+	var count int64
 	defer in.Discard()
 	defer func() {
 		V(1, "wrote %d packets of %d input packets", count, len(in.C))
@@ -318,24 +430,25 @@ func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
 	const pcapHeaderSize = 16 // same for file header and per-packet header
 	// If someone REALLY wants an empty pcap file, we'll give it to them :P
 	if limit.ShouldStopAfter(Limit{Bytes: pcapHeaderSize}) {
-		return nil
+		return 0, nil
 	}
 	for p := range in.Receive() {
-		if len(p.Data) > snapLen {
-			p.Data = p.Data[:snapLen]
-		}
+		p.Truncate(snaplen)
 		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
 			// This can happen if our pipe is broken, and we don't want to blow stack
 			// traces all over our users when that happens, so Error/Exit instead of
 			// Fatal.
-			return fmt.Errorf("error writing packet: %v", err)
+			return count, fmt.Errorf("error writing packet: %v", err)
 		}
 		count++
+		if wrote != nil {
+			wrote(p)
+		}
 		if limit.ShouldStopAfter(Limit{Bytes: int64(len(p.Data) + pcapHeaderSize), Packets: 1}) {
-			return nil
+			return count, nil
 		}
 	}
-	return in.Err()
+	return count, in.Err()
 }
 
 // ContextDone returns true if a context is complete.
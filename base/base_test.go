@@ -16,7 +16,12 @@ package base
 
 import (
 	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -92,6 +97,31 @@ func TestMergePacketChans(t *testing.T) {
 	comparePacketChans(t, want, got)
 }
 
+func TestMergeWindowPacketChans(t *testing.T) {
+	packets := testPacketData(t)
+	inputs := make(chan *PacketChan, 3)
+	one := NewPacketChan(100)
+	two := NewPacketChan(100)
+	three := NewPacketChan(100)
+	one.Send(packets[0])
+	one.Send(packets[2])
+	two.Send(packets[1])
+	one.Close(nil)
+	two.Close(nil)
+	three.Close(nil)
+	inputs <- one
+	inputs <- three
+	inputs <- two
+	close(inputs)
+	got := MergeWindowPacketChans(ctx, inputs, 2)
+	want := NewPacketChan(100)
+	want.Send(packets[0])
+	want.Send(packets[1])
+	want.Send(packets[2])
+	want.Close(nil)
+	comparePacketChans(t, want, got)
+}
+
 func TestUnion(t *testing.T) {
 	for _, test := range []struct {
 		a, b, want Positions
@@ -171,6 +201,26 @@ func TestPacketsToFile(t *testing.T) {
 	}
 }
 
+func TestPacketsToFileSnapLen(t *testing.T) {
+	var out bytes.Buffer
+	packets := testPacketData(t)
+	pc := NewPacketChan(100)
+	pc.Send(packets[0])
+	pc.Close(nil)
+	want := []byte{
+		0xd4, 0xc3, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x7b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
+		0x01, 0x02,
+	}
+	PacketsToFileSnapLen(pc, &out, Limit{}, 2)
+	if got := out.Bytes(); !bytes.Equal(want, got) {
+		t.Errorf("wrong packets:\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
 func TestContextDone(t *testing.T) {
 	ctx := NewContext(0)
 	if ContextDone(ctx) {
@@ -186,3 +236,52 @@ func TestContextDone(t *testing.T) {
 		t.Fatal("should have timed out by now")
 	}
 }
+
+func TestLogf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+	ctx := WithLogAttrs(WithLogAttrs(context.Background(), "query_id", 12), "file", "/tmp/1")
+	Logf(ctx, "found %d", 3)
+	if got, want := buf.String(), "found 3 query_id=12 file=\"/tmp/1\"\n"; got != want {
+		t.Errorf("plain log line:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	buf.Reset()
+	def := slog.Default()
+	defer func() {
+		slog.SetDefault(def)
+		structuredLogging = false
+	}()
+	if err := SetLogFormat("json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	Logf(ctx, "found %d", 3)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%q isn't JSON: %v", buf.String(), err)
+	}
+	if got["msg"] != "found 3" || got["query_id"] != float64(12) || got["file"] != "/tmp/1" {
+		t.Errorf("wrong JSON log line %v", got)
+	}
+	if err := SetLogFormat("xml", &buf); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("want error for unknown format, got %v", err)
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	defer SetVerbosity(*VerboseLogging)
+	SetVerbosity(3)
+	if got := Verbosity(); got != 3 {
+		t.Errorf("verbosity %d after setting it to 3", got)
+	}
+	SetVerbosity(*VerboseLogging)
+	if got := Verbosity(); got != *VerboseLogging {
+		t.Errorf("verbosity %d after resetting it, want -v's %d", got, *VerboseLogging)
+	}
+}
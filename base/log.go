@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// verbosity, unless it's noVerbosity, overrides the -v flag.  It's accessed
+// atomically, since it may be changed while logging.
+var verbosity int64 = noVerbosity
+
+const noVerbosity = -1 << 31
+
+// SetVerbosity overrides the -v flag's verbose logging level.
+func SetVerbosity(level int) {
+	atomic.StoreInt64(&verbosity, int64(level))
+}
+
+// Verbosity returns the verbose logging level, as set by SetVerbosity or else
+// the -v flag.
+func Verbosity() int {
+	if l := atomic.LoadInt64(&verbosity); l != noVerbosity {
+		return int(l)
+	}
+	return *VerboseLogging
+}
+
+// structuredLogging is set once SetLogFormat installs a slog handler.
+var structuredLogging bool
+
+// SetLogFormat sends every log line, including those logged with the log
+// package, to w as structured records: one JSON object per line for "json",
+// or key=value pairs for "text".  With "", logs are left as log.Printf
+// writes them.
+func SetLogFormat(format string, w io.Writer) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch format {
+	case "":
+		return nil
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	structuredLogging = true
+	return nil
+}
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a copy of ctx whose log lines, written with VContext
+// or Logf, carry the given key/value pairs, like "query_id", 12, on top of
+// any ctx already carries.
+func WithLogAttrs(ctx context.Context, keyvals ...interface{}) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]interface{})
+	all := make([]interface{}, 0, len(attrs)+len(keyvals))
+	return context.WithValue(ctx, logAttrsKey{}, append(append(all, attrs...), keyvals...))
+}
+
+// VContext is V for work done on behalf of ctx, tagging the line with the
+// attributes attached to ctx by WithLogAttrs.
+func VContext(ctx context.Context, level int, format string, args ...interface{}) {
+	if Verbosity() >= level {
+		logf(ctx, slog.LevelDebug, []interface{}{"v", level}, format, args...)
+	}
+}
+
+// Logf logs unconditionally, like log.Printf, tagging the line with the
+// attributes attached to ctx by WithLogAttrs.
+func Logf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, slog.LevelInfo, nil, format, args...)
+}
+
+func logf(ctx context.Context, level slog.Level, extra []interface{}, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	var attrs []interface{}
+	if ctx != nil {
+		attrs, _ = ctx.Value(logAttrsKey{}).([]interface{})
+	}
+	if structuredLogging {
+		slog.Default().Log(ctx, level, msg, append(extra, attrs...)...)
+		return
+	}
+	if len(attrs) == 0 {
+		log.Print(msg)
+		return
+	}
+	// Without a structured handler, append the attributes as slog's text
+	// handler would, so lines stay greppable by query ID.
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if s, ok := attrs[i+1].(string); ok {
+			fmt.Fprintf(&b, " %v=%q", attrs[i], s)
+		} else {
+			fmt.Fprintf(&b, " %v=%v", attrs[i], attrs[i+1])
+		}
+	}
+	log.Print(b.String())
+}
@@ -20,17 +20,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
 	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/indexfile"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
 	//"github.com/google/stenographer/query"
         "../query"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -39,6 +48,7 @@ import "C"
 
 var (
 	v                = base.V // Verbose logging
+	tracer           = otel.Tracer("github.com/google/stenographer/blockfile")
 	packetReadNanos  = stats.S.Get("packet_read_nanos")
 	packetScanNanos  = stats.S.Get("packet_scan_nanos")
 	packetsRead      = stats.S.Get("packets_read")
@@ -51,33 +61,70 @@ var (
 type BlockFile struct {
 	name string
 	f    *filecache.CachedFile
+	// r reads packets from f, decompressing them if the file is compressed.
+	r    io.ReaderAt
 	i    *indexfile.IndexFile
 	mu   sync.RWMutex // Stops Close() from invalidating a file before a current query is done with it.
 	done chan struct{}
-	size int64
+	size int64 // On disk.
+	// dataSize is the size of the file's packet data, which is larger than
+	// size if the file is compressed.
+	dataSize   int64
+	compressed bool
+	encrypted  bool
+	// indexModTime is when the index was written, to tell cached lookups in
+	// it apart from those in an older file with the same name.
+	indexModTime time.Time
 }
 
 // NewBlockFile opens up a named block file (and its index), returning a handle
 // which can be used to look up packets.
 func NewBlockFile(filename string, fc *filecache.Cache) (*BlockFile, error) {
 	v(1, "Blockfile opening: %q", filename)
-	i, err := indexfile.NewIndexFile(indexfile.IndexPathFromBlockfilePath(filename), fc)
-	if err != nil {
+	indexPath := indexfile.IndexPathFromBlockfilePath(filename)
+	i, err := indexfile.NewIndexFile(indexPath, fc)
+	if indexfile.IsCorrupt(err) {
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("could not open index for %q: %v", filename, err)
 	}
+	var indexModTime time.Time
+	if fi, err := os.Stat(indexPath); err == nil {
+		indexModTime = fi.ModTime()
+	}
 	f := fc.Open(filename)
 	s, err := f.Stat()
 	if err != nil {
 		f.Close()
+		i.Close()
 		return nil, fmt.Errorf("could not stat file %q: %v", filename, err)
 	}
-	return &BlockFile{
-		f:    f,
-		i:    i,
-		name: filename,
-		done: make(chan struct{}),
-		size: s.Size(),
-	}, nil
+	r, dataSize, err := packetReader(f, s.Size())
+	_, compressed := r.(*compressedReader)
+	var encrypted bool
+	if err == nil {
+		encrypted, err = encrypt.IsEncrypted(f)
+	}
+	if err != nil {
+		f.Close()
+		i.Close()
+		return nil, fmt.Errorf("could not read file %q: %v", filename, err)
+	}
+	b := &BlockFile{
+		f:          f,
+		r:          r,
+		i:          i,
+		name:       filename,
+		done:       make(chan struct{}),
+		size:       s.Size(),
+		dataSize:   dataSize,
+		compressed: compressed,
+		encrypted:  encrypted && i.Encrypted(),
+
+		indexModTime: indexModTime,
+	}
+	i.SetPacketLengths(b.packetLength)
+	return b, nil
 }
 
 // Name returns the name of the file underlying this blockfile.
@@ -85,33 +132,57 @@ func (b *BlockFile) Name() string {
 	return b.name
 }
 
-// Size returns the size of the blockfile in bytes.
+// Size returns the size of the blockfile on disk in bytes.
 func (b *BlockFile) Size() int64 {
 	return b.size
 }
 
+// Compressed returns whether the blockfile is compressed on disk.
+func (b *BlockFile) Compressed() bool {
+	return b.compressed
+}
+
+// Encrypted returns whether the blockfile and its index are both encrypted
+// on disk.
+func (b *BlockFile) Encrypted() bool {
+	return b.encrypted
+}
+
 // readPacket reads a single packet from the file at the given position.
 // It updates the passed in CaptureInfo with information on the packet.
 func (b *BlockFile) readPacket(pos int64, ci *gopacket.CaptureInfo) ([]byte, error) {
-	// 28 bytes actually isn't the entire packet header, but it's all the fields
-	// that we care about.
 	packetsRead.Increment()
 	defer packetReadNanos.NanoTimer()()
-	var dataBuf [28]byte
-	_, err := b.f.ReadAt(dataBuf[:], pos)
+	hdr := make([]byte, packetHeaderBytes)
+	_, err := b.r.ReadAt(hdr, pos)
 	if err != nil {
 		return nil, err
 	}
-	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&dataBuf[0]))
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&hdr[0]))
 	*ci = gopacket.CaptureInfo{
 		Timestamp:     time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)),
 		Length:        int(pkt.tp_len),
 		CaptureLength: int(pkt.tp_snaplen),
 	}
+	if ci.CaptureLength > blockSize {
+		return nil, &corruptPacketError{pos, fmt.Sprintf("bad packet header, capture length %d", ci.CaptureLength)}
+	}
 	out := make([]byte, ci.CaptureLength)
-	pos += int64(pkt.tp_mac)
-	_, err = b.f.ReadAt(out, pos)
-	return out, err
+	if _, err = b.r.ReadAt(out, pos+int64(pkt.tp_mac)); err != nil {
+		return nil, err
+	}
+	return out, checkPacket(pos, hdr, out)
+}
+
+// packetLength reads the length on the wire of the packet at the given
+// position, without reading the packet itself.
+func (b *BlockFile) packetLength(pos int64) (int, error) {
+	hdr := make([]byte, packetHeaderBytes)
+	if _, err := b.r.ReadAt(hdr, pos); err != nil {
+		return 0, err
+	}
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&hdr[0]))
+	return int(pkt.tp_len), nil
 }
 
 // Close cleans up this blockfile.
@@ -127,13 +198,15 @@ func (b *BlockFile) Close() (err error) {
 	if e := b.f.Close(); e != nil {
 		err = e
 	}
-	b.i, b.f = nil, nil
+	b.i, b.f, b.r = nil, nil, nil
+	cache.invalidate(b.name)
 	return
 }
 
 // allPacketsIter implements Iter.
 type allPacketsIter struct {
-	*BlockFile
+	name             string // For logging skipped packets.
+	f                io.ReaderAt
 	blockData        []byte
 	block            *C.struct_tpacket_hdr_v1
 	pkt              *C.struct_tpacket3_hdr
@@ -146,38 +219,75 @@ type allPacketsIter struct {
 
 func (a *allPacketsIter) Next() bool {
 	defer packetScanNanos.NanoTimer()()
-	if a.err != nil || a.done {
-		return false
-	}
-	for a.block == nil || a.blockPacketsRead == int(a.block.num_pkts) {
-		packetBlocksRead.Increment()
-		a.blockData = make([]byte, 1<<20)
-		_, err := a.f.ReadAt(a.blockData[:], a.blockOffset)
-		if err == io.EOF {
-			a.done = true
-			return false
-		} else if err != nil {
-			a.err = fmt.Errorf("could not read block at %v: %v", a.blockOffset, err)
+	for a.err == nil && !a.done {
+		if a.block == nil || a.blockPacketsRead == int(a.block.num_pkts) {
+			a.readBlock()
+			continue
+		}
+		a.blockPacketsRead++
+		if a.pkt == nil {
+			a.packetOffset = int(a.block.offset_to_first_pkt)
+		} else if a.pkt.tp_next_offset != 0 {
+			a.packetOffset += int(a.pkt.tp_next_offset)
+		} else {
+			a.err = errors.New("block format currently not supported")
 			return false
 		}
-		baseHdr := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&a.blockData[0]))
-		a.block = (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&baseHdr.hdr[0]))
-		a.blockOffset += 1 << 20
-		a.blockPacketsRead = 0
-		a.pkt = nil
-	}
-	a.blockPacketsRead++
-	if a.pkt == nil {
-		a.packetOffset = int(a.block.offset_to_first_pkt)
-	} else if a.pkt.tp_next_offset != 0 {
-		a.packetOffset += int(a.pkt.tp_next_offset)
-	} else {
-		a.err = errors.New("block format currently not supported")
-		return false
+		if err := a.checkPacket(); err != nil {
+			if !skipCorrupt(a.name, err) {
+				a.err = err
+				return false
+			}
+			// If the packet's header can't be trusted to find the next one, skip
+			// the rest of its block.
+			if a.pkt == nil || a.pkt.tp_next_offset == 0 {
+				a.blockPacketsRead = int(a.block.num_pkts)
+			}
+			continue
+		}
+		packetsScanned.Increment()
+		return true
+	}
+	return false
+}
+
+// readBlock reads the next block of the file.
+func (a *allPacketsIter) readBlock() {
+	packetBlocksRead.Increment()
+	a.blockData = make([]byte, blockSize)
+	_, err := a.f.ReadAt(a.blockData[:], a.blockOffset)
+	if err == io.EOF {
+		a.done = true
+		return
+	} else if err != nil {
+		a.err = fmt.Errorf("could not read block at %v: %v", a.blockOffset, err)
+		return
+	}
+	baseHdr := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&a.blockData[0]))
+	a.block = (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&baseHdr.hdr[0]))
+	a.blockOffset += blockSize
+	a.blockPacketsRead = 0
+	a.pkt = nil
+}
+
+// checkPacket sets a.pkt to the packet at a.packetOffset, returning a
+// corruptPacketError if it fails its checksum.  If its header is too garbled
+// to read the packet at all, a.pkt is left nil.
+func (a *allPacketsIter) checkPacket() error {
+	pos := a.Position()
+	a.pkt = nil
+	if a.packetOffset < 0 || a.packetOffset+packetHeaderBytes > len(a.blockData) {
+		return &corruptPacketError{pos, "packet header outside its block"}
+	}
+	hdr := a.blockData[a.packetOffset : a.packetOffset+packetHeaderBytes]
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&hdr[0]))
+	start := a.packetOffset + int(pkt.tp_mac)
+	end := start + int(pkt.tp_snaplen)
+	if end > len(a.blockData) {
+		return &corruptPacketError{pos, "packet data outside its block"}
 	}
-	a.pkt = (*C.struct_tpacket3_hdr)(unsafe.Pointer(&a.blockData[a.packetOffset]))
-	packetsScanned.Increment()
-	return true
+	a.pkt = pkt
+	return checkPacket(pos, hdr, a.blockData[start:end])
 }
 
 func (a *allPacketsIter) Packet() *base.Packet {
@@ -190,10 +300,96 @@ func (a *allPacketsIter) Packet() *base.Packet {
 	return p
 }
 
+// Position returns the position of the current packet in the file, as used
+// by the index.
+func (a *allPacketsIter) Position() int64 {
+	return a.blockOffset - blockSize + int64(a.packetOffset)
+}
+
 func (a *allPacketsIter) Err() error {
 	return a.err
 }
 
+// ScanPackets calls fn with the position and contents of each packet in the
+// named blockfile, in order, stopping at the first error fn returns.  Unlike
+// NewBlockFile, it doesn't need the file's index.
+func ScanPackets(filename string, fn func(pos int64, p *base.Packet) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, _, err := packetReader(f, s.Size())
+	if err != nil {
+		return err
+	}
+	pkts := &allPacketsIter{name: filename, f: r}
+	for pkts.Next() {
+		if err := fn(pkts.Position(), pkts.Packet()); err != nil {
+			return err
+		}
+	}
+	return pkts.Err()
+}
+
+// blockWritten returns whether stenotype has written the block at off in f.
+// Blocks past the last it's written are missing, or if it preallocated the
+// file (--preallocate_file_mb), zeroed and so still marked as owned by the
+// kernel.
+func blockWritten(f io.ReaderAt, off int64) (bool, error) {
+	var desc C.struct_tpacket_block_desc
+	hdr := (*[unsafe.Sizeof(desc)]byte)(unsafe.Pointer(&desc))[:]
+	if _, err := f.ReadAt(hdr, off); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not read block at %v: %v", off, err)
+	}
+	block := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	return block.block_status != C.TP_STATUS_KERNEL, nil
+}
+
+// UnwrittenBlock returns the offset of the first block at or after off in f,
+// a blockfile stenotype is writing, that it hasn't written yet.
+func UnwrittenBlock(f io.ReaderAt, off int64) (int64, error) {
+	for {
+		if written, err := blockWritten(f, off); err != nil || !written {
+			return off, err
+		}
+		off += blockSize
+	}
+}
+
+// ScanBlock is ScanPackets for the single block at off in f, a blockfile
+// stenotype may still be writing.  It returns the offset of the next block,
+// or off without calling fn if that block hasn't been written yet.
+func ScanBlock(name string, f io.ReaderAt, off int64, fn func(pos int64, p *base.Packet) error) (int64, error) {
+	if written, err := blockWritten(f, off); err != nil || !written {
+		return off, err
+	}
+	var positions []int64
+	var packets []*base.Packet
+	pkts := &allPacketsIter{name: name, f: io.NewSectionReader(f, 0, off+blockSize), blockOffset: off}
+	for pkts.Next() {
+		positions = append(positions, pkts.Position())
+		packets = append(packets, pkts.Packet())
+	}
+	if err := pkts.Err(); err != nil {
+		return off, err
+	} else if pkts.blockOffset != off+blockSize {
+		return off, nil // The block's header is written, but not all its data.
+	}
+	for i, p := range packets {
+		if err := fn(positions[i], p); err != nil {
+			return off, err
+		}
+	}
+	return off + blockSize, nil
+}
+
 // AllPackets returns a packet channel to which all packets in the blockfile are
 // sent.
 func (b *BlockFile) AllPackets() *base.PacketChan {
@@ -201,7 +397,7 @@ func (b *BlockFile) AllPackets() *base.PacketChan {
 	c := base.NewPacketChan(100)
 	go func() {
 		defer b.mu.RUnlock()
-		pkts := &allPacketsIter{BlockFile: b}
+		pkts := &allPacketsIter{name: b.name, f: b.r}
 		for pkts.Next() {
 			c.Send(pkts.Packet())
 		}
@@ -212,7 +408,14 @@ func (b *BlockFile) AllPackets() *base.PacketChan {
 
 // Positions returns the positions in the blockfile of all packets matched by
 // the passed-in query.
-func (b *BlockFile) Positions(ctx context.Context, q query.Query) (base.Positions, error) {
+func (b *BlockFile) Positions(ctx context.Context, q query.Query) (_ base.Positions, err error) {
+	ctx, span := tracer.Start(ctx, "index_lookup", trace.WithAttributes(attribute.String("file", b.name)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.positionsLocked(ctx, q)
@@ -225,7 +428,22 @@ func (b *BlockFile) positionsLocked(ctx context.Context, q query.Query) (base.Po
 		// If we're closed, just return nothing.
 		return nil, nil
 	}
-	return q.LookupIn(ctx, b.i)
+	if !b.i.HasKeys(q.RequiredIndexes()...) {
+		base.VContext(base.WithLogAttrs(ctx, "file", b.name), 2, "Blockfile has no index keys %v needs, skipping", q)
+		return base.NoPositions, nil
+	}
+	if PositionsCacheBytes <= 0 {
+		return q.LookupIn(ctx, b.i)
+	}
+	key := newPositionsKey(query.CacheKey(q), b.name, b.indexModTime)
+	if pos, ok := cache.get(key); ok {
+		return pos, nil
+	}
+	pos, err := q.LookupIn(ctx, b.i)
+	if err == nil && ctx.Err() == nil {
+		cache.put(key, pos)
+	}
+	return pos, err
 }
 
 // Lookup returns all packets in the blockfile matched by the passed-in query.
@@ -233,55 +451,84 @@ func (b *BlockFile) Lookup(ctx context.Context, q query.Query, out *base.PacketC
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	var ci gopacket.CaptureInfo
-	v(2, "Blockfile %q looking up query %q", b.name, q.String())
-	start := time.Now()
+	base.VContext(base.WithLogAttrs(ctx, "file", b.name), 2, "Blockfile looking up query %q", q.String())
 	positions, err := b.positionsLocked(ctx, q)
 	if err != nil {
 		out.Close(fmt.Errorf("index lookup failure: %v", err))
 		return
 	}
+	b.readPositionsLocked(ctx, positions, out)
+}
+
+// ReadPositions returns the packets at the given positions, as previously
+// returned by Positions.  If the blockfile has been closed since, it returns
+// nothing.
+func (b *BlockFile) ReadPositions(ctx context.Context, positions base.Positions, out *base.PacketChan) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil || b.f == nil {
+		out.Close(nil)
+		return
+	}
+	b.readPositionsLocked(ctx, positions, out)
+}
+
+// readPositionsLocked sends the packets at the given positions to out, then
+// closes it.  b.mu must be locked.
+func (b *BlockFile) readPositionsLocked(ctx context.Context, positions base.Positions, out *base.PacketChan) {
+	_, span := tracer.Start(ctx, "blockfile_read", trace.WithAttributes(
+		attribute.String("file", b.name),
+		attribute.Bool("all_packets", positions.IsAllPositions()),
+		attribute.Int("positions", len(positions))))
+	defer span.End()
+	logCtx := base.WithLogAttrs(ctx, "file", b.name)
+	var ci gopacket.CaptureInfo
+	start := time.Now()
 	if positions.IsAllPositions() {
-		v(2, "Blockfile %q reading all packets", b.name)
-		iter := &allPacketsIter{BlockFile: b}
+		base.VContext(logCtx, 2, "Blockfile reading all packets")
+		iter := &allPacketsIter{name: b.name, f: b.r}
 	all_packets_loop:
 		for iter.Next() {
 			select {
 			case <-ctx.Done():
-				v(2, "Blockfile %q canceling packet read", b.name)
+				base.VContext(logCtx, 2, "Blockfile canceling packet read")
 				break all_packets_loop
 			case <-b.done:
-				v(2, "Blockfile %q closing, breaking out of query", b.name)
+				base.VContext(logCtx, 2, "Blockfile closing, breaking out of query")
 				break all_packets_loop
 			case out.C <- iter.Packet():
 			}
 		}
 		if iter.Err() != nil {
+			span.SetStatus(codes.Error, iter.Err().Error())
 			out.Close(fmt.Errorf("error reading all packets from %q: %v", b.name, iter.Err()))
 			return
 		}
 	} else {
-		v(2, "Blockfile %q reading %v packets", b.name, len(positions))
+		base.VContext(logCtx, 2, "Blockfile reading %v packets", len(positions))
 	query_packets_loop:
 		for _, pos := range positions {
 			buffer, err := b.readPacket(pos, &ci)
-			if err != nil {
-				v(2, "Blockfile %q error reading packet: %v", b.name, err)
+			if skipCorrupt(b.name, err) {
+				continue
+			} else if err != nil {
+				base.VContext(logCtx, 2, "Blockfile error reading packet: %v", err)
+				span.SetStatus(codes.Error, err.Error())
 				out.Close(fmt.Errorf("error reading packets from %q @ %v: %v", b.name, pos, err))
 				return
 			}
 			select {
 			case <-ctx.Done():
-				v(2, "Blockfile %q canceling packet read", b.name)
+				base.VContext(logCtx, 2, "Blockfile canceling packet read")
 				break query_packets_loop
 			case <-b.done:
-				v(2, "Blockfile %q closing, breaking out of query", b.name)
+				base.VContext(logCtx, 2, "Blockfile closing, breaking out of query")
 				break query_packets_loop
 			case out.C <- &base.Packet{Data: buffer, CaptureInfo: ci}:
 			}
 		}
 	}
-	v(2, "Blockfile %q finished reading all packets in %v", b.name, time.Since(start))
+	base.VContext(logCtx, 2, "Blockfile finished reading all packets in %v", time.Since(start))
 	out.Close(ctx.Err())
 }
 
@@ -292,3 +539,21 @@ func (b *BlockFile) DumpIndex(out io.Writer, start, finish []byte) {
 	defer b.mu.RUnlock()
 	b.i.Dump(out, start, finish)
 }
+
+// VerifyIndex checks the blockfile's index for corruption, returning an
+// indexfile.CorruptError if it's damaged.
+func (b *BlockFile) VerifyIndex(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return nil // Closed.
+	}
+	return b.i.Verify(ctx, b.dataSize)
+}
+
+// IndexStats summarizes the blockfile's index.
+func (b *BlockFile) IndexStats() (*indexfile.Stats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.i.Stats()
+}
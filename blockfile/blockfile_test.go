@@ -15,14 +15,22 @@
 package blockfile
 
 import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	"golang.org/x/net/context"
 
+	"github.com/google/gopacket"
 	"github.com/google/stenographer/base"
 	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/query"
+	//"github.com/google/stenographer/query"
+	"../query"
 )
 
 var ctx = context.Background()
@@ -61,3 +69,158 @@ func TestPositions(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketLength(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	for _, pos := range []int64{1048624, 1049024, 1049448, 1049848} {
+		var ci gopacket.CaptureInfo
+		if _, err := blk.readPacket(pos, &ci); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := blk.packetLength(pos); err != nil || got != ci.Length {
+			t.Errorf("packet at %d: got length %v %v, want %v", pos, got, err, ci.Length)
+		}
+	}
+}
+
+func TestPositionsCache(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	q, err := query.NewQuery("port 67 or port 68")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := blk.Positions(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := positionsCacheHits.Value()
+	if got, err := blk.Positions(ctx, q); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("cached positions %v, want %v", got, want)
+	}
+	if got := positionsCacheHits.Value() - hits; got != 1 {
+		t.Errorf("got %d cache hits, want 1", got)
+	}
+	key := newPositionsKey(query.CacheKey(q), blk.Name(), blk.indexModTime)
+	blk.Close()
+	if _, ok := cache.get(key); ok {
+		t.Errorf("lookup still cached after file was closed")
+	}
+}
+
+func TestPositionsCacheEviction(t *testing.T) {
+	defer func(old int64) { PositionsCacheBytes = old }(PositionsCacheBytes)
+	c := &positionsCache{lru: list.New(), entries: map[positionsKey]*list.Element{}}
+	pos := make(base.Positions, 100)
+	PositionsCacheBytes = 3 * entryBytes(&positionsEntry{positionsKey{"q0", "f", 0}, pos})
+	for i := 0; i < 4; i++ {
+		c.put(positionsKey{fmt.Sprintf("q%d", i), "f", 0}, pos)
+		if i == 1 {
+			c.get(positionsKey{"q0", "f", 0}) // Make q1 the least recently used.
+		}
+	}
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := c.get(positionsKey{fmt.Sprintf("q%d", i), "f", 0}); ok != want {
+			t.Errorf("q%d cached: %v, want %v", i, ok, want)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stamp the packets with checksums, as stenotype does.
+	var positions base.Positions
+	var dataStarts []int64
+	if err := ScanPackets(filename, func(pos int64, p *base.Packet) error {
+		hdr := data[pos : pos+int64(packetHeaderBytes)]
+		start := pos + int64(binary.LittleEndian.Uint16(hdr[macOffset:]))
+		binary.LittleEndian.PutUint32(hdr[checksumOffset+4:], packetChecksumMagic)
+		sum, _ := packetChecksum(hdr, data[start:start+int64(len(p.Data))])
+		binary.LittleEndian.PutUint32(hdr[checksumOffset:], sum)
+		positions, dataStarts = append(positions, pos), append(dataStarts, start)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data[dataStarts[1]+10] ^= 0xff
+
+	dir, err := ioutil.TempDir("", "checksum_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := ioutil.ReadFile("../testdata/IDX0/dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range map[string][]byte{"PKT0/dhcp": data, "IDX0/dhcp": index} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk := testBlockFile(t, filepath.Join(dir, "PKT0/dhcp"))
+	defer blk.Close()
+	readPositions := func(positions base.Positions) (int, error) {
+		c := base.NewPacketChan(100)
+		go blk.ReadPositions(ctx, positions, c)
+		n := 0
+		for range c.Receive() {
+			n++
+		}
+		return n, c.Err()
+	}
+
+	if n, err := readPositions(base.AllPositions); err == nil || n != 1 {
+		t.Errorf("reading all packets got %d packets, error %v; want 1 packet, then an error", n, err)
+	}
+	if _, err := readPositions(positions[:3]); err == nil {
+		t.Errorf("reading a corrupt packet succeeded")
+	}
+
+	defer SetSkipCorrupt(false)
+	SetSkipCorrupt(true)
+	skipped := packetsCorruptSkipped.Value()
+	if n, err := readPositions(base.AllPositions); err != nil || n != len(positions)-1 {
+		t.Errorf("reading all packets got %d packets, error %v; want %d", n, err, len(positions)-1)
+	}
+	if n, err := readPositions(positions[:3]); err != nil || n != 2 {
+		t.Errorf("reading 3 packets got %d packets, error %v; want 2", n, err)
+	}
+	if got := packetsCorruptSkipped.Value() - skipped; got != 2 {
+		t.Errorf("skipped %d corrupt packets, want 2", got)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := blk.Positions(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := base.NewPacketChan(100)
+	go blk.ReadPositions(ctx, pos, c)
+	var want int64
+	for p := range c.Receive() {
+		want += int64(len(p.Data) + pcapRecordHeaderBytes)
+	}
+	packets, bytes := blk.Estimate(pos)
+	if packets != len(pos) || bytes < want*9/10 || bytes > want*11/10 {
+		t.Errorf("estimated %d packets in %d bytes, want %d in about %d", packets, bytes, len(pos), want)
+	}
+	if packets, bytes := blk.Estimate(base.AllPositions); packets >= 0 || bytes != blk.Size() {
+		t.Errorf("estimated all packets as %d packets in %d bytes, want an unknown number in %d", packets, bytes, blk.Size())
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// PositionsCacheBytes limits how much memory is used to cache the results of
+// index lookups, so repeated queries (from dashboards, or an analyst refining
+// a search) don't reread the same index blocks.  If <= 0, nothing is cached.
+var PositionsCacheBytes int64 = 64 << 20
+
+var (
+	positionsCacheHits      = stats.S.Get("positions_cache_hits")
+	positionsCacheMisses    = stats.S.Get("positions_cache_misses")
+	positionsCacheEvictions = stats.S.Get("positions_cache_evictions")
+	positionsCacheSize      = stats.S.Get("positions_cache_bytes")
+)
+
+// positionsKey identifies a lookup.  Queries are keyed by query.CacheKey,
+// which has relative times already resolved.
+type positionsKey struct {
+	query   string
+	file    string
+	modTime int64 // Of the index file, in case it's replaced.
+}
+
+type positionsEntry struct {
+	key positionsKey
+	pos base.Positions
+}
+
+// positionsCache is an LRU cache of index lookup results.
+type positionsCache struct {
+	mu      sync.Mutex
+	lru     *list.List // Of *positionsEntry, most recently used first.
+	entries map[positionsKey]*list.Element
+	bytes   int64
+}
+
+var cache = &positionsCache{lru: list.New(), entries: map[positionsKey]*list.Element{}}
+
+func newPositionsKey(query, file string, modTime time.Time) positionsKey {
+	return positionsKey{query, file, modTime.UnixNano()}
+}
+
+func entryBytes(e *positionsEntry) int64 {
+	return int64(len(e.pos))*8 + int64(len(e.key.query)+len(e.key.file)) + 64
+}
+
+func (c *positionsCache) get(key positionsKey) (base.Positions, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		positionsCacheHits.Increment()
+		return elem.Value.(*positionsEntry).pos, true
+	}
+	positionsCacheMisses.Increment()
+	return nil, false
+}
+
+func (c *positionsCache) put(key positionsKey, pos base.Positions) {
+	e := &positionsEntry{key, pos}
+	size := entryBytes(e)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > PositionsCacheBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.bytes > PositionsCacheBytes {
+		c.removeLocked(c.lru.Back())
+		positionsCacheEvictions.Increment()
+	}
+	positionsCacheSize.Set(c.bytes)
+}
+
+// invalidate drops all cached lookups in the given file.
+func (c *positionsCache) invalidate(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*positionsEntry).key.file == file {
+			c.removeLocked(elem)
+		}
+		elem = next
+	}
+	positionsCacheSize.Set(c.bytes)
+}
+
+func (c *positionsCache) removeLocked(elem *list.Element) {
+	e := c.lru.Remove(elem).(*positionsEntry)
+	delete(c.entries, e.key)
+	c.bytes -= entryBytes(e)
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"unsafe"
+
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// skipCorruptPackets is 1 if reads skip corrupt packets.  It's accessed
+// atomically, since it may be changed while reading.
+var skipCorruptPackets int32
+
+// SetSkipCorrupt sets whether reads skip packets which fail their checksums or
+// whose headers are garbled, rather than failing the whole read.  Skipped
+// packets are counted in the packets_corrupt_skipped stat.
+func SetSkipCorrupt(skip bool) {
+	var v int32
+	if skip {
+		v = 1
+	}
+	atomic.StoreInt32(&skipCorruptPackets, v)
+}
+
+var packetsCorruptSkipped = stats.S.Get("packets_corrupt_skipped")
+
+// Stenotype stamps each packet with a checksum, in the padding at the end of
+// its tpacket3_hdr:  a CRC32C of the header's tp_next_offset through tp_len,
+// its tp_mac, and the packet data, followed by packetChecksumMagic.  Packets
+// written before stenotype checksummed them have zeroed padding, and aren't
+// checked.
+const packetChecksumMagic = 0x31435243 // "CRC1"
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	packetHeaderBytes = int(unsafe.Sizeof(C.struct_tpacket3_hdr{}))
+	statusOffset      = int(unsafe.Offsetof(C.struct_tpacket3_hdr{}.tp_status))
+	macOffset         = int(unsafe.Offsetof(C.struct_tpacket3_hdr{}.tp_mac))
+	checksumOffset    = int(unsafe.Offsetof(C.struct_tpacket3_hdr{}.tp_padding))
+)
+
+// corruptPacketError is returned for packets which fail their checksums, or
+// whose headers are garbled.
+type corruptPacketError struct {
+	pos    int64
+	reason string
+}
+
+func (c *corruptPacketError) Error() string {
+	return fmt.Sprintf("corrupt packet @ %v: %s", c.pos, c.reason)
+}
+
+// skipCorrupt returns whether err is a corrupt packet that should be skipped,
+// counting it if so.
+func skipCorrupt(name string, err error) bool {
+	if _, ok := err.(*corruptPacketError); !ok || atomic.LoadInt32(&skipCorruptPackets) == 0 {
+		return false
+	}
+	packetsCorruptSkipped.Increment()
+	v(1, "Blockfile %q skipping %v", name, err)
+	return true
+}
+
+// packetChecksum returns the checksum a packet's header (a tpacket3_hdr) and
+// data should have, and whether the packet was stamped with one at all.
+func packetChecksum(hdr, data []byte) (sum uint32, stamped bool) {
+	if binary.LittleEndian.Uint32(hdr[checksumOffset+4:]) != packetChecksumMagic {
+		return 0, false
+	}
+	sum = crc32.Update(0, castagnoli, hdr[:statusOffset])
+	sum = crc32.Update(sum, castagnoli, hdr[macOffset:macOffset+2])
+	return crc32.Update(sum, castagnoli, data), true
+}
+
+// checkPacket returns a corruptPacketError if the packet at pos, with the
+// given header and data, doesn't match its checksum.
+func checkPacket(pos int64, hdr, data []byte) error {
+	sum, stamped := packetChecksum(hdr, data)
+	if want := binary.LittleEndian.Uint32(hdr[checksumOffset:]); stamped && sum != want {
+		return &corruptPacketError{pos, fmt.Sprintf("checksum %08x, want %08x", sum, want)}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// Sealed blockfiles may be compressed at rest.  Since stenotype writes
+// packets in blocks of blockSize bytes, and no packet spans two blocks, each
+// block is compressed separately, so reading a packet only means
+// decompressing the block it's in.  Positions in the index stay the same:
+// they're offsets into the uncompressed file.
+//
+// A compressed file is laid out as:
+//
+//	header:   compressedMagic, codec ID (1 byte), 7 reserved bytes
+//	blocks:   each block, compressed
+//	offsets:  the offset of each compressed block, then of the end of the
+//	          last one, as big endian uint64s
+//	trailer:  the uncompressed size, then the number of blocks, as big
+//	          endian uint64s
+//
+// Blocks which don't get any smaller are stored as is, which readers tell
+// from their compressed length being their uncompressed length.
+
+const blockSize = 1 << 20
+
+// EncryptChunkBytes is the size of the chunks blockfiles are encrypted in,
+// which is their block size, so reading a packet decrypts a single chunk.
+const EncryptChunkBytes = blockSize
+
+var compressedMagic = []byte("STENOZ\x00\x01")
+
+const (
+	compressedHeaderBytes  = 16
+	compressedTrailerBytes = 16
+)
+
+var (
+	blocksDecompressed = stats.S.Get("blockfile_blocks_decompressed")
+	decompressNanos    = stats.S.Get("blockfile_decompress_nanos")
+)
+
+// Codec is a compression algorithm usable for blockfiles.
+type Codec struct {
+	// ID is stored in compressed files, to pick the codec to read them with.
+	// It must never change once files have been written with it.
+	ID   byte
+	Name string
+	// Compress appends src, compressed, to dst.
+	Compress func(dst, src []byte) []byte
+	// Decompress decompresses src into dst, which is exactly the uncompressed
+	// length.
+	Decompress func(dst, src []byte) error
+}
+
+var codecs = map[byte]*Codec{}
+
+// RegisterCodec adds a codec blockfiles can be compressed with.  It panics if
+// the codec's ID is already registered, or is 0.
+func RegisterCodec(c Codec) {
+	if c.ID == 0 {
+		panic("codec ID 0 is reserved")
+	}
+	if old, ok := codecs[c.ID]; ok {
+		panic(fmt.Sprintf("codec ID %d registered as both %q and %q", c.ID, old.Name, c.Name))
+	}
+	codecs[c.ID] = &c
+}
+
+// CodecByName returns the registered codec with the given name.
+func CodecByName(name string) (*Codec, error) {
+	for _, c := range codecs {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown blockfile codec %q, want one of %q", name, names)
+}
+
+func init() {
+	RegisterCodec(Codec{ID: 1, Name: "lz4", Compress: lz4Compress, Decompress: lz4Decompress})
+}
+
+// compressedReader reads the uncompressed contents of a compressed file.  It
+// keeps the last block it decompressed, since packets are mostly read in
+// order.
+type compressedReader struct {
+	f       io.ReaderAt
+	codec   *Codec
+	size    int64   // Uncompressed.
+	offsets []int64 // Of each compressed block, and the end of the last.
+
+	mu     sync.Mutex
+	cached int64 // Index of the block in buf, or -1.
+	buf    []byte
+	raw    []byte
+}
+
+// isCompressed returns whether the file in f is compressed.
+func isCompressed(f io.ReaderAt) (bool, error) {
+	var magic [8]byte
+	if _, err := f.ReadAt(magic[:], 0); err == io.EOF {
+		return false, nil // Too short to be compressed.
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic[:], compressedMagic), nil
+}
+
+// newCompressedReader reads the header and offsets of a compressed file of
+// the given size.
+func newCompressedReader(f io.ReaderAt, size int64) (*compressedReader, error) {
+	var header [compressedHeaderBytes]byte
+	var trailer [compressedTrailerBytes]byte
+	if size < compressedHeaderBytes+compressedTrailerBytes {
+		return nil, fmt.Errorf("compressed file too short")
+	}
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadAt(trailer[:], size-compressedTrailerBytes); err != nil {
+		return nil, err
+	}
+	codec := codecs[header[len(compressedMagic)]]
+	if codec == nil {
+		return nil, fmt.Errorf("unknown codec %d", header[len(compressedMagic)])
+	}
+	c := &compressedReader{f: f, codec: codec, size: int64(binary.BigEndian.Uint64(trailer[:])), cached: -1}
+	blocks := binary.BigEndian.Uint64(trailer[8:])
+	if blocks != uint64((c.size+blockSize-1)/blockSize) || (blocks+1)*8 > uint64(size) {
+		return nil, fmt.Errorf("bad compressed file trailer")
+	}
+	raw := make([]byte, (blocks+1)*8)
+	if _, err := f.ReadAt(raw, size-compressedTrailerBytes-int64(len(raw))); err != nil {
+		return nil, err
+	}
+	c.offsets = make([]int64, blocks+1)
+	for i := range c.offsets {
+		c.offsets[i] = int64(binary.BigEndian.Uint64(raw[i*8:]))
+		if i > 0 && c.offsets[i] < c.offsets[i-1] {
+			return nil, fmt.Errorf("bad compressed block offsets")
+		}
+	}
+	return c, nil
+}
+
+// blockLocked makes c.buf the uncompressed contents of block n.  c.mu must be
+// held.
+func (c *compressedReader) blockLocked(n int64) error {
+	if c.cached == n {
+		return nil
+	}
+	defer decompressNanos.NanoTimer()()
+	blocksDecompressed.Increment()
+	c.cached = -1
+	length := c.size - n*blockSize
+	if length > blockSize {
+		length = blockSize
+	}
+	start, end := c.offsets[n], c.offsets[n+1]
+	if int64(cap(c.raw)) < end-start {
+		c.raw = make([]byte, end-start)
+	}
+	c.raw = c.raw[:end-start]
+	if _, err := c.f.ReadAt(c.raw, start); err != nil {
+		return fmt.Errorf("reading compressed block %d: %v", n, err)
+	}
+	if c.buf == nil {
+		c.buf = make([]byte, blockSize)
+	}
+	c.buf = c.buf[:length]
+	if end-start == length {
+		copy(c.buf, c.raw) // Stored uncompressed.
+	} else if err := c.codec.Decompress(c.buf, c.raw); err != nil {
+		return fmt.Errorf("decompressing block %d: %v", n, err)
+	}
+	c.cached = n
+	return nil
+}
+
+// ReadAt reads from the uncompressed file, like os.File.ReadAt.
+func (c *compressedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n < len(p) {
+		if off >= c.size {
+			return n, io.EOF
+		}
+		if err := c.blockLocked(off / blockSize); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], c.buf[off%blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// packetReader returns a reader of the packets in the file f of the given
+// size, decrypting and decompressing them if necessary, and their size.
+func packetReader(f io.ReaderAt, size int64) (io.ReaderAt, int64, error) {
+	f, size, err := encrypt.MaybeDecrypt(f, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if compressed, err := isCompressed(f); err != nil {
+		return nil, 0, err
+	} else if !compressed {
+		return f, size, nil
+	}
+	c, err := newCompressedReader(f, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c, c.size, nil
+}
+
+// CompressFile writes a compressed copy of the blockfile src to dst, which
+// it creates.  If src is encrypted, so is dst.  To keep from starving capture
+// and queries, it sleeps between blocks so it uses at most the given fraction
+// of a CPU, if that's between 0 and 1.
+func CompressFile(src, dst string, codec *Codec, cpu float64) (returnedErr error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	in, inSize, err := encrypt.MaybeDecrypt(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if compressed, err := isCompressed(in); err != nil {
+		return err
+	} else if compressed {
+		return fmt.Errorf("%q is already compressed", src)
+	}
+	file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); returnedErr == nil {
+			returnedErr = err
+		}
+	}()
+	var out io.Writer = file
+	var encrypted *encrypt.Writer
+	if in != io.ReaderAt(f) {
+		if encrypted, err = encrypt.NewWriter(file, blockSize); err != nil {
+			return err
+		}
+		out = encrypted
+	}
+	header := make([]byte, compressedHeaderBytes)
+	copy(header, compressedMagic)
+	header[len(compressedMagic)] = codec.ID
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	offsets := []int64{compressedHeaderBytes}
+	var size int64
+	block := make([]byte, blockSize)
+	var compressed []byte
+	for size < inSize {
+		n, err := in.ReadAt(block, size)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		start := time.Now()
+		compressed = codec.Compress(compressed[:0], block[:n])
+		if len(compressed) >= n {
+			compressed = append(compressed[:0], block[:n]...)
+		}
+		if cpu > 0 && cpu < 1 {
+			time.Sleep(time.Duration(float64(time.Since(start)) * (1 - cpu) / cpu))
+		}
+		if _, err := out.Write(compressed); err != nil {
+			return err
+		}
+		size += int64(n)
+		offsets = append(offsets, offsets[len(offsets)-1]+int64(len(compressed)))
+	}
+	tail := make([]byte, 0, len(offsets)*8+compressedTrailerBytes)
+	var buf [8]byte
+	for _, v := range append(offsets, size, int64(len(offsets)-1)) {
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		tail = append(tail, buf[:]...)
+	}
+	if _, err := out.Write(tail); err != nil {
+		return err
+	}
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
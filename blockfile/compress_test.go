@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+func TestLZ4(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	long := bytes.Repeat([]byte("stenographer "), 10000)
+	mixed := append(append([]byte{}, random[:5000]...), long[:50000]...)
+	mixed = append(mixed, random[:5000]...) // A match 55000 bytes back.
+	for _, src := range [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		random,
+		long,
+		mixed,
+		make([]byte, blockSize),
+	} {
+		compressed := lz4Compress(nil, src)
+		got := make([]byte, len(src))
+		if err := lz4Decompress(got, compressed); err != nil {
+			t.Errorf("decompressing %d bytes: %v", len(src), err)
+		} else if !bytes.Equal(got, src) {
+			t.Errorf("decompressing %d bytes: got different bytes back", len(src))
+		}
+	}
+	if err := lz4Decompress(make([]byte, 10), lz4Compress(nil, long)[:20]); err == nil {
+		t.Errorf("decompressing truncated block succeeded")
+	}
+}
+
+func allPackets(t *testing.T, blk *BlockFile) []*base.Packet {
+	var out []*base.Packet
+	c := blk.AllPackets()
+	for p := range c.Receive() {
+		out = append(out, p)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressedBlockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := ioutil.ReadFile("../testdata/IDX0/dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "IDX0/dhcp"), index, 0600); err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "PKT0/dhcp")
+	codec, err := CodecByName("lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompressFile(filename, compressed, codec, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompressFile(compressed, compressed+".again", codec, 0); err == nil {
+		t.Errorf("compressed an already compressed file")
+	}
+
+	want := testBlockFile(t, filename)
+	defer want.Close()
+	got := testBlockFile(t, compressed)
+	defer got.Close()
+	if want.Compressed() || !got.Compressed() {
+		t.Fatalf("got compressed %v, %v, want false, true", want.Compressed(), got.Compressed())
+	}
+	if got.Size() >= want.Size() {
+		t.Errorf("compressed size %d, not smaller than %d", got.Size(), want.Size())
+	}
+	if err := got.VerifyIndex(ctx); err != nil {
+		t.Errorf("verifying index: %v", err)
+	}
+	if w, g := allPackets(t, want), allPackets(t, got); !reflect.DeepEqual(w, g) {
+		t.Errorf("got %d packets from compressed file, want %d", len(g), len(w))
+	}
+
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [2][]*base.Packet
+	for i, blk := range []*BlockFile{want, got} {
+		c := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, c)
+		for p := range c.Receive() {
+			packets[i] = append(packets[i], p)
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(packets[0]) == 0 || !reflect.DeepEqual(packets[0], packets[1]) {
+		t.Errorf("got %d packets from compressed file lookup, want %d", len(packets[1]), len(packets[0]))
+	}
+}
+
+func TestEncryptedBlockFile(t *testing.T) {
+	defer func(old encrypt.KeyWrapper) { encrypt.Keys = old }(encrypt.Keys)
+	var err error
+	if encrypt.Keys, err = encrypt.NewMasterKey(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "encrypt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encrypt.EncryptFile("../testdata/IDX0/dhcp", filepath.Join(dir, "IDX0/dhcp"), indexfile.EncryptChunkBytes); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "PKT0/dhcp")
+	if err := encrypt.EncryptFile(filename, encrypted, EncryptChunkBytes); err != nil {
+		t.Fatal(err)
+	}
+	// Compressing an encrypted file leaves it encrypted.
+	codec, err := CodecByName("lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := filepath.Join(dir, "PKT0/both")
+	if err := CompressFile(encrypted, both, codec, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "IDX0/dhcp"), filepath.Join(dir, "IDX0/both")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := testBlockFile(t, filename)
+	defer want.Close()
+	wantPackets := allPackets(t, want)
+	for _, name := range []string{encrypted, both} {
+		got := testBlockFile(t, name)
+		defer got.Close()
+		if !got.Encrypted() || got.Compressed() != (name == both) {
+			t.Errorf("%q: got encrypted %v, compressed %v", name, got.Encrypted(), got.Compressed())
+		}
+		if err := got.VerifyIndex(ctx); err != nil {
+			t.Errorf("%q: verifying index: %v", name, err)
+		}
+		if g := allPackets(t, got); !reflect.DeepEqual(wantPackets, g) {
+			t.Errorf("%q: got %d packets, want %d", name, len(g), len(wantPackets))
+		}
+		q, err := query.NewQuery("port 67")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := got.Positions(ctx, q); err != nil || len(pos) != 4 {
+			t.Errorf("%q: got positions %v, %v", name, pos, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"github.com/google/stenographer/base"
+)
+
+const (
+	// recordOverheadBytes is how far into its record each packet's data
+	// starts, past its tpacket3_hdr and sockaddr_ll, for Ethernet packets.
+	recordOverheadBytes = 82
+	// pcapRecordHeaderBytes is the size of each packet's header in a pcap.
+	pcapRecordHeaderBytes = 16
+	// defaultRecordBytes is the record size assumed when there's nothing to
+	// estimate it from, a little under that of a full 1500 byte MTU packet.
+	defaultRecordBytes = 1024
+)
+
+// Estimate estimates how many packets reading the given positions returns,
+// and how many bytes of pcap they make, using only the positions and the
+// file's index.  Each packet's record is assumed to run until the next
+// position in the same block (which is exact when consecutive packets are
+// read), but no longer than the average record in the file.  Other records
+// are assumed to be the average size of those.  If positions is all of the
+// file's packets, packets is the count the index recorded, or -1 if it
+// recorded none.
+func (b *BlockFile) Estimate(positions base.Positions) (packets int, bytes int64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	total := -1
+	if b.i != nil {
+		if times := b.i.Times(); times != nil && len(times.Minutes) > 0 {
+			total = 0
+			for _, n := range times.Minutes {
+				total += int(n)
+			}
+		}
+	}
+	if positions.IsAllPositions() {
+		if total < 0 {
+			return -1, b.dataSize
+		}
+		bytes = b.dataSize - int64(total)*(recordOverheadBytes-pcapRecordHeaderBytes)
+		if bytes < 0 {
+			bytes = 0
+		}
+		return total, bytes
+	}
+	maxRecord := int64(-1)
+	if total > 0 {
+		maxRecord = b.dataSize / int64(total)
+	}
+	// Records followed by another position in their block give a better idea
+	// of the size of those that aren't than the file's average, which counts
+	// the unused ends of blocks stenotype flushed before they filled.
+	var bounded, boundedBytes int64
+	sizes := make([]int64, len(positions))
+	for i, pos := range positions {
+		if i+1 < len(positions) && positions[i+1]/blockSize == pos/blockSize {
+			sizes[i] = positions[i+1] - pos
+			if maxRecord > 0 && sizes[i] > maxRecord {
+				sizes[i] = maxRecord
+			}
+			bounded++
+			boundedBytes += sizes[i]
+		}
+	}
+	unbounded := int64(defaultRecordBytes)
+	if bounded > 0 {
+		unbounded = boundedBytes / bounded
+	} else if maxRecord > 0 && maxRecord < unbounded {
+		unbounded = maxRecord
+	}
+	for _, size := range sizes {
+		if size == 0 {
+			size = unbounded
+		}
+		if size -= recordOverheadBytes; size < 0 {
+			size = 0
+		}
+		bytes += size + pcapRecordHeaderBytes
+	}
+	return len(positions), bytes
+}
@@ -0,0 +1,173 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This is the LZ4 block format, as described in
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.  Blocks are
+// compressed independently, without the LZ4 frame format around them, since
+// the compressed file format records their lengths itself.
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // The last 5 bytes of a block are always literals.
+	lz4MatchLimit   = 12 // The last match must start 12 bytes before the end.
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+var errLZ4Corrupt = errors.New("corrupt lz4 block")
+
+func lz4Hash(seq uint32) uint32 {
+	return (seq * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4AppendLength appends the remainder of a length too long for its 4 bits
+// of a sequence's token.
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4AppendSequence appends literals, followed by a match of the given length
+// and offset.  A match length of 0 means there's no match, which is only
+// allowed at the end of a block.
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	token := len(literals)
+	if token > 15 {
+		token = 15
+	}
+	token <<= 4
+	if matchLen > 0 {
+		if m := matchLen - lz4MinMatch; m < 15 {
+			token |= m
+		} else {
+			token |= 15
+		}
+	}
+	dst = append(dst, byte(token))
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if m := matchLen - lz4MinMatch; m >= 15 {
+		dst = lz4AppendLength(dst, m-15)
+	}
+	return dst
+}
+
+// lz4Compress appends src compressed as an LZ4 block to dst.  It's a simple
+// greedy compressor, trading some ratio for speed.
+func lz4Compress(dst, src []byte) []byte {
+	if len(src) <= lz4MatchLimit {
+		return lz4AppendSequence(dst, src, 0, 0)
+	}
+	var table [1 << lz4HashLog]int32 // Position+1 of the last sequence with each hash.
+	anchor := 0                      // Start of literals not yet written.
+	for i := 0; i < len(src)-lz4MatchLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4ReadLength reads the remainder of a length from src at i, returning the
+// full length and the new i.
+func lz4ReadLength(src []byte, i, n int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, errLZ4Corrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
+
+// lz4Decompress decompresses an LZ4 block from src into dst, which must be
+// exactly the uncompressed length.
+func lz4Decompress(dst, src []byte) error {
+	d := 0
+	for i := 0; i < len(src); {
+		token := int(src[i])
+		i++
+		lit := token >> 4
+		var err error
+		if lit == 15 {
+			if lit, i, err = lz4ReadLength(src, i, lit); err != nil {
+				return err
+			}
+		}
+		if i+lit > len(src) || d+lit > len(dst) {
+			return errLZ4Corrupt
+		}
+		d += copy(dst[d:], src[i:i+lit])
+		i += lit
+		if i == len(src) {
+			break // The last sequence has no match.
+		}
+		if i+2 > len(src) {
+			return errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		n := token & 15
+		if n == 15 {
+			if n, i, err = lz4ReadLength(src, i, n); err != nil {
+				return err
+			}
+		}
+		n += lz4MinMatch
+		if offset == 0 || offset > d || d+n > len(dst) {
+			return errLZ4Corrupt
+		}
+		// Matches may overlap what they're copying, so copy a byte at a time.
+		for ref := d - offset; n > 0; n-- {
+			dst[d] = dst[ref]
+			d++
+			ref++
+		}
+	}
+	if d != len(dst) {
+		return errLZ4Corrupt
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/google/gopacket"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// Packets are laid out in blocks just as the kernel hands them to stenotype.
+var (
+	blockHeaderBytes = align(int(unsafe.Sizeof(C.struct_tpacket_block_desc{})))
+	// packetDataOffset is the tp_mac of each packet written:  its data
+	// follows its header.
+	packetDataOffset = align(packetHeaderBytes)
+	// MaxPacketBytes is the most packet data a Writer can put in a block.
+	MaxPacketBytes = blockSize - blockHeaderBytes - packetDataOffset
+)
+
+// align rounds n up to TPACKET_ALIGNMENT.
+func align(n int) int {
+	return (n + C.TPACKET_ALIGNMENT - 1) &^ (C.TPACKET_ALIGNMENT - 1)
+}
+
+// Writer writes packets to a new blockfile, in the format stenotype writes,
+// so packets captured by other tools can be indexed and served like its own.
+type Writer struct {
+	f       *os.File
+	block   []byte
+	offset  int // Where the next packet goes in block.
+	last    int // Offset of the last packet in block.
+	packets int // In block.
+	seq     uint64
+	size    int64
+}
+
+// NewWriter creates the blockfile filename, which must not already exist.
+func NewWriter(filename string) (*Writer, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f, block: make([]byte, blockSize)}
+	w.reset()
+	return w, nil
+}
+
+// reset starts an empty block.
+func (w *Writer) reset() {
+	for i := range w.block {
+		w.block[i] = 0
+	}
+	w.offset, w.last, w.packets = blockHeaderBytes, 0, 0
+}
+
+// Size returns the bytes written to the file so far, not counting the block
+// still being filled.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// WritePacket adds a packet to the file.  Packets with more than
+// MaxPacketBytes of data are truncated, as if captured with a smaller snaplen.
+func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if len(data) > ci.CaptureLength {
+		data = data[:ci.CaptureLength]
+	}
+	if len(data) > MaxPacketBytes {
+		data = data[:MaxPacketBytes]
+	}
+	length := ci.Length
+	if length < len(data) {
+		length = len(data)
+	}
+	size := align(packetDataOffset + len(data))
+	if w.offset+size > blockSize {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	hdr := w.block[w.offset : w.offset+packetHeaderBytes]
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&hdr[0]))
+	pkt.tp_next_offset = C.__u32(size)
+	pkt.tp_sec = C.__u32(ci.Timestamp.Unix())
+	pkt.tp_nsec = C.__u32(ci.Timestamp.Nanosecond())
+	pkt.tp_snaplen = C.__u32(len(data))
+	pkt.tp_len = C.__u32(length)
+	pkt.tp_status = C.TP_STATUS_USER
+	pkt.tp_mac = C.__u16(packetDataOffset)
+	pkt.tp_net = C.__u16(packetDataOffset + 14) // After the ethernet header.
+	copy(w.block[w.offset+packetDataOffset:], data)
+	w.stamp(w.offset)
+	w.last = w.offset
+	w.offset += size
+	w.packets++
+	return nil
+}
+
+// stamp sets the checksum of the packet at offset in the block, as stenotype
+// does.
+func (w *Writer) stamp(offset int) {
+	hdr := w.block[offset : offset+packetHeaderBytes]
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&hdr[0]))
+	data := w.block[offset+packetDataOffset : offset+packetDataOffset+int(pkt.tp_snaplen)]
+	binary.LittleEndian.PutUint32(hdr[checksumOffset+4:], packetChecksumMagic)
+	sum, _ := packetChecksum(hdr, data)
+	binary.LittleEndian.PutUint32(hdr[checksumOffset:], sum)
+}
+
+// tpacketTS sets a block header timestamp to that of the packet at offset.
+func (w *Writer) tpacketTS(ts *C.struct_tpacket_bd_ts, offset int) {
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&w.block[offset]))
+	ts.ts_sec = pkt.tp_sec
+	binary.LittleEndian.PutUint32((*[8]byte)(unsafe.Pointer(ts))[4:], uint32(pkt.tp_nsec))
+}
+
+// flush writes out the block being filled, if it has any packets.
+func (w *Writer) flush() error {
+	if w.packets == 0 {
+		return nil
+	}
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&w.block[0]))
+	desc.version = C.TPACKET_V3
+	block := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	w.seq++
+	block.block_status = C.TP_STATUS_USER
+	block.num_pkts = C.__u32(w.packets)
+	block.offset_to_first_pkt = C.__u32(blockHeaderBytes)
+	block.blk_len = C.__u32(w.offset)
+	block.seq_num = C.__u64(w.seq)
+	w.tpacketTS(&block.ts_first_pkt, blockHeaderBytes)
+	w.tpacketTS(&block.ts_last_pkt, w.last)
+	// Like the kernel, end the block's packets with a zero tp_next_offset,
+	// which the checksum covers.
+	(*C.struct_tpacket3_hdr)(unsafe.Pointer(&w.block[w.last])).tp_next_offset = 0
+	w.stamp(w.last)
+	if _, err := w.f.Write(w.block); err != nil {
+		return fmt.Errorf("could not write block: %v", err)
+	}
+	w.size += blockSize
+	w.reset()
+	return nil
+}
+
+// Close writes out any packets not yet written, and closes the file.
+func (w *Writer) Close() error {
+	err := w.flush()
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
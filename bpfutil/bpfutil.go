@@ -0,0 +1,197 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bpfutil compiles and runs classic BPF filters, using the same hex
+// encoding stenotype's --filter flag accepts.
+package bpfutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/bpf"
+)
+
+var v = base.V // verbose logging
+
+// tcpdumpPaths are searched, in order, for a tcpdump binary to compile filters.
+var tcpdumpPaths = []string{"tcpdump", "/usr/sbin/tcpdump", "/usr/local/sbin/tcpdump", "/sbin/tcpdump"}
+
+// Filter is a compiled BPF program.
+type Filter struct {
+	raw []bpf.RawInstruction
+	vm  *bpf.VM
+}
+
+func newFilter(raw []bpf.RawInstruction) (*Filter, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty BPF program")
+	}
+	insts, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, fmt.Errorf("BPF program contains unsupported instructions")
+	}
+	vm, err := bpf.NewVM(insts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BPF program: %v", err)
+	}
+	return &Filter{raw: raw, vm: vm}, nil
+}
+
+// Compile compiles a human-readable BPF expression for packets captured on
+// the given interface, by running 'tcpdump -ddd'.  tcpdump must be able to
+// open the interface to learn its link type.
+func Compile(iface, expr string) (*Filter, error) {
+	return runTcpdump(expr, "-i", iface)
+}
+
+// emptyEthernetPcap is a pcap file header with no packets, for link type
+// Ethernet.
+var emptyEthernetPcap = []byte{
+	0xd4, 0xc3, 0xb2, 0xa1, // magic
+	2, 0, 4, 0, // version 2.4
+	0, 0, 0, 0, // timezone
+	0, 0, 0, 0, // timestamp accuracy
+	0xff, 0xff, 0, 0, // snaplen
+	1, 0, 0, 0, // link type Ethernet
+}
+
+// CompileEthernet compiles a human-readable BPF expression for Ethernet
+// packets, like those stenotype captures.  Unlike Compile, it doesn't need
+// permission to open an interface:  tcpdump learns the link type from an
+// empty pcap file instead.
+func CompileEthernet(expr string) (*Filter, error) {
+	f, err := ioutil.TempFile("", "bpfutil")
+	if err != nil {
+		return nil, fmt.Errorf("could not create pcap file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(emptyEthernetPcap)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not write pcap file: %v", err)
+	}
+	return runTcpdump(expr, "-r", f.Name())
+}
+
+// runTcpdump compiles expr with tcpdump, passing it the given arguments to
+// tell it where packets come from.  Expressions often come from clients, so
+// they're kept from being read as flags.
+func runTcpdump(expr string, args ...string) (*Filter, error) {
+	if strings.HasPrefix(strings.TrimSpace(expr), "-") {
+		return nil, fmt.Errorf("invalid BPF %q: can't start with '-'", expr)
+	}
+	var tcpdump string
+	for _, p := range tcpdumpPaths {
+		if path, err := exec.LookPath(p); err == nil {
+			tcpdump = path
+			break
+		}
+	}
+	if tcpdump == "" {
+		return nil, fmt.Errorf("could not find tcpdump to compile BPF")
+	}
+	v(1, "compiling BPF %q with %q %v", expr, tcpdump, args)
+	var stderr bytes.Buffer
+	cmd := exec.Command(tcpdump, append(args, "-ddd", "--", expr)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not compile BPF %q: %v: %s", expr, err, strings.TrimSpace(stderr.String()))
+	}
+	return parseDecimal(out)
+}
+
+// parseDecimal parses 'tcpdump -ddd' output:  an instruction count, then one
+// line per instruction with its code, jt, jf, and k in decimal.
+func parseDecimal(in []byte) (*Filter, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("missing BPF instruction count")
+	}
+	var raw []bpf.RawInstruction
+	for scanner.Scan() {
+		var cols [4]uint64
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != len(cols) {
+			return nil, fmt.Errorf("bad BPF instruction %q", scanner.Text())
+		}
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad BPF instruction %q: %v", scanner.Text(), err)
+			}
+			cols[i] = n
+		}
+		raw = append(raw, bpf.RawInstruction{Op: uint16(cols[0]), Jt: uint8(cols[1]), Jf: uint8(cols[2]), K: uint32(cols[3])})
+	}
+	return newFilter(raw)
+}
+
+// FromHex decodes a filter from the hex format used by stenotype's --filter
+// flag and generated by compile_bpf.sh.
+func FromHex(h string) (*Filter, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(h))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex BPF: %v", err)
+	}
+	if len(b)%8 != 0 {
+		return nil, fmt.Errorf("hex BPF length %d not a multiple of 8 bytes", len(b))
+	}
+	raw := make([]bpf.RawInstruction, len(b)/8)
+	for i := range raw {
+		inst := b[i*8 : i*8+8]
+		raw[i] = bpf.RawInstruction{
+			Op: binary.BigEndian.Uint16(inst[0:2]),
+			Jt: inst[2],
+			Jf: inst[3],
+			K:  binary.BigEndian.Uint32(inst[4:8]),
+		}
+	}
+	return newFilter(raw)
+}
+
+// Hex returns the filter in the format accepted by stenotype's --filter flag.
+func (f *Filter) Hex() string {
+	b := make([]byte, len(f.raw)*8)
+	for i, inst := range f.raw {
+		binary.BigEndian.PutUint16(b[i*8:], inst.Op)
+		b[i*8+2] = inst.Jt
+		b[i*8+3] = inst.Jf
+		binary.BigEndian.PutUint32(b[i*8+4:], inst.K)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Len returns the number of instructions in the filter.
+func (f *Filter) Len() int {
+	return len(f.raw)
+}
+
+// Matches returns true if the filter would keep a packet with the given data.
+func (f *Filter) Matches(data []byte) bool {
+	n, err := f.vm.Run(data)
+	return err == nil && n > 0
+}
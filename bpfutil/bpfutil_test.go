@@ -0,0 +1,129 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpfutil
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// ipv4Only is 'tcpdump -ddd ip' on an ethernet interface, hex encoded.
+const ipv4Only = "002800000000000c" + "0015000100000800" + "000600000000ffff" + "0006000000000000"
+
+func ethernet(ethertype uint16) []byte {
+	pkt := make([]byte, 34)
+	pkt[12] = byte(ethertype >> 8)
+	pkt[13] = byte(ethertype)
+	return pkt
+}
+
+func TestHexRoundTrip(t *testing.T) {
+	f, err := FromHex(ipv4Only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Hex(); got != ipv4Only {
+		t.Errorf("hex round trip failed.\nwant: %v\n got: %v", ipv4Only, got)
+	}
+	if f.Len() != 4 {
+		t.Errorf("wrong length, want 4 got %v", f.Len())
+	}
+}
+
+func TestMatches(t *testing.T) {
+	f, err := FromHex(ipv4Only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Matches(ethernet(0x0800)) {
+		t.Errorf("IPv4 packet not matched")
+	}
+	if f.Matches(ethernet(0x86dd)) {
+		t.Errorf("IPv6 packet matched")
+	}
+	if f.Matches([]byte{1, 2}) {
+		t.Errorf("truncated packet matched")
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	f, err := parseDecimal([]byte("4\n40 0 0 12\n21 0 1 2048\n6 0 0 65535\n6 0 0 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Hex(); got != ipv4Only {
+		t.Errorf("wrong filter.\nwant: %v\n got: %v", ipv4Only, got)
+	}
+}
+
+func TestInvalidFilters(t *testing.T) {
+	for _, h := range []string{"", "zz", "0028000000", "0006000000000000ff"} {
+		if _, err := FromHex(h); err == nil {
+			t.Errorf("decoded invalid filter %q", h)
+		}
+	}
+}
+
+func TestCompileEthernet(t *testing.T) {
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		t.Skip("tcpdump not installed")
+	}
+	f, err := CompileEthernet("ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Hex(); got != ipv4Only {
+		t.Errorf("compiled filter mismatch.\nwant: %v\n got: %v", ipv4Only, got)
+	}
+}
+
+func TestTcpdumpArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpfutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A fake tcpdump records its arguments, and prints a filter.
+	args := filepath.Join(dir, "args")
+	script := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > " + args + "\nprintf '4\\n40 0 0 12\\n21 0 1 2048\\n6 0 0 65535\\n6 0 0 0\\n'\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "tcpdump"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old []string) { tcpdumpPaths = old }(tcpdumpPaths)
+	tcpdumpPaths = []string{filepath.Join(dir, "tcpdump")}
+
+	if _, err := Compile("eth0", "ip"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-i\neth0\n-ddd\n--\nip\n"; string(got) != want {
+		t.Errorf("tcpdump got args %q, want %q", got, want)
+	}
+	for _, expr := range []string{"-w /tmp/x", " --version", "\t-r/etc/passwd ip"} {
+		os.Remove(args)
+		if _, err := CompileEthernet(expr); err == nil {
+			t.Errorf("compiled %q", expr)
+		}
+		if _, err := os.Stat(args); err == nil {
+			t.Errorf("ran tcpdump for %q", expr)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig is how to obtain a server certificate from an ACME CA, like
+// Let's Encrypt, instead of reading it from a file.
+type ACMEConfig struct {
+	Domains      []string // The server's names, which the certificate's for.
+	Email        string   // Given to the CA as a contact, if set.
+	DirectoryURL string   // Of the CA.  Let's Encrypt's if empty.
+	CacheDir     string   // Where account keys and certificates are kept.
+}
+
+// ACMETLSConfig returns a TLS config serving certificates obtained, and
+// renewed, as c says, which verifies clients like ca's.  The CA's HTTP-01
+// challenges are answered by the returned handler, which must be served on
+// port 80.  TLS-ALPN-01 challenges aren't answered:  the CA can't present a
+// client certificate, which every connection must.
+func ACMETLSConfig(c ACMEConfig, ca *Reloader) (*tls.Config, http.Handler) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.CacheDir),
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	tlsConfig := ca.TLSConfig()
+	tlsConfig.GetCertificate = m.GetCertificate
+	return tlsConfig, m.HTTPHandler(http.NotFoundHandler())
+}
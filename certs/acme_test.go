@@ -0,0 +1,76 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMETLSConfig(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	r, cleanup := testFiles(t, ca, newCert(t, "stenographer", ca, x509.ExtKeyUsageServerAuth))
+	defer cleanup()
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	tlsConfig, challenges := ACMETLSConfig(ACMEConfig{Domains: []string{"steno.example.com"}, CacheDir: cacheDir}, r)
+
+	// Clients must still have certificates, so TLS-ALPN-01 challenges can't
+	// be answered, and aren't offered.
+	if tlsConfig.ClientAuth != tls.RequireAnyClientCert || tlsConfig.VerifyPeerCertificate == nil {
+		t.Errorf("got ClientAuth %v, want clients verified like the CA's", tlsConfig.ClientAuth)
+	}
+	for _, proto := range tlsConfig.NextProtos {
+		if proto == acme.ALPNProto {
+			t.Errorf("got NextProtos %q, want no %q", tlsConfig.NextProtos, acme.ALPNProto)
+		}
+	}
+	if tlsConfig.GetConfigForClient != nil {
+		t.Error("got GetConfigForClient, which could skip verifying clients")
+	}
+
+	// A pending HTTP-01 challenge's token, as autocert caches it.
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "tok3n+http-01"), []byte("tok3n.thumbprint"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		host, path string
+		want       int
+		body       string
+	}{
+		{"steno.example.com", "/.well-known/acme-challenge/tok3n", http.StatusOK, "tok3n.thumbprint"},
+		{"steno.example.com", "/.well-known/acme-challenge/other", http.StatusNotFound, ""},
+		{"other.example.com", "/.well-known/acme-challenge/tok3n", http.StatusForbidden, ""},
+		{"steno.example.com", "/query", http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		w := httptest.NewRecorder()
+		challenges.ServeHTTP(w, req)
+		if w.Code != test.want || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("%v%v: got %v %q, want %v %q", test.host, test.path, w.Code, w.Body.String(), test.want, test.body)
+		}
+	}
+}
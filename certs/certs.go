@@ -14,7 +14,9 @@
 
 // Package certs provides helper libraries for generating self-signed
 // certificates, which we use locally for authorizing users to read
-// packet data.
+// packet data.  Servers may instead get their certificates from an ACME CA,
+// like Let's Encrypt, or use SPIFFE SVIDs from a workload API for both
+// their own and their clients' certificates.
 package certs
 
 import (
@@ -23,24 +25,187 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // ClientVerifyingTLSConfig returns a TLS config which verifies that clients
 // have a certificate signed by the CA certificate in the certFile.
 func ClientVerifyingTLSConfig(certFile string) (*tls.Config, error) {
-	// Test cert file
+	cas, err := readCA(certFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  cas,
+	}, nil
+}
+
+// readCA returns a pool holding the CA certificate in certFile.
+func readCA(certFile string) (*x509.CertPool, error) {
 	var cert *x509.Certificate
 	if certBytes, err := ioutil.ReadFile(certFile); err != nil {
 		return nil, fmt.Errorf("could not read cert file: %v", err)
 	} else if block, _ := pem.Decode(certBytes); block == nil {
-		return nil, fmt.Errorf("could not get cert pem block: %v", err)
+		return nil, fmt.Errorf("could not get cert pem block from %q", certFile)
 	} else if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
 		return nil, fmt.Errorf("could not parse cert: %v", err)
 	}
 	cas := x509.NewCertPool()
 	cas.AddCert(cert)
+	return cas, nil
+}
+
+// Name returns the name a client certificate identifies:  its common name,
+// or for SPIFFE SVIDs, which usually have none, their SPIFFE ID.
+func Name(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// Reloader holds a server's certificate and the CA certificate its clients'
+// certificates must be signed by, rereading them from their files when
+// reloaded, so they can be rotated without restarting the server.
+type Reloader struct {
+	caFile, certFile, keyFile string
+
+	mu   sync.Mutex
+	cas  *x509.CertPool
+	cert *tls.Certificate
+}
+
+// NewReloader returns a Reloader for the given files, which must exist and be
+// valid.  If certFile is empty, only the CA certificate is loaded, and the
+// server certificate must come from elsewhere, like ACMETLSConfig.
+func NewReloader(caFile, certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{caFile: caFile, certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload rereads the certificates.  If any can't be loaded, the ones already
+// loaded stay in use.
+func (r *Reloader) Reload() error {
+	cas, err := readCA(r.caFile)
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load server cert: %v", err)
+		}
+		cert = &c
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cas, r.cert = cas, cert
+	return nil
+}
+
+// TLSConfig returns a TLS config serving the current server certificate,
+// which requires clients to have a certificate signed by the current CA
+// certificate.  To make client certificates optional, set its ClientAuth to
+// tls.RequestClientCert:  those that are given are still verified.
+func (r *Reloader) TLSConfig() *tls.Config {
 	return &tls.Config{
-		ClientAuth: tls.RequireAndVerifyClientCert,
-		ClientCAs:  cas,
-	}, nil
+		// Clients are verified by verifyClient rather than against a fixed
+		// ClientCAs pool, which couldn't be replaced once serving.
+		ClientAuth:            tls.RequireAnyClientCert,
+		GetCertificate:        r.getCertificate,
+		VerifyPeerCertificate: r.verifyClient,
+	}
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// verifyClient verifies the certificate chain a client sent, if any, against
+// the current CA certificate.
+func (r *Reloader) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil // Whether one's required is up to ClientAuth.
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("could not parse client cert: %v", err)
+		}
+		certs[i] = cert
+	}
+	r.mu.Lock()
+	opts := x509.VerifyOptions{
+		Roots:         r.cas,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	r.mu.Unlock()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// Watch reloads the certificates whenever the directories holding them
+// change, until the returned function is called.  Failed reloads are logged.
+func (r *Reloader) Watch() (stop func(), err error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not watch certs: %v", err)
+	}
+	// Directories are watched rather than the files themselves, since
+	// rotation often replaces files by renaming new ones over them.
+	dirs := map[string]bool{}
+	for _, f := range []string{r.caFile, r.certFile, r.keyFile} {
+		if f != "" {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("could not watch %q: %v", dir, err)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if err := r.Reload(); err != nil {
+					// Likely partway through rotation:  the next event will retry.
+					log.Printf("keeping previous certs: %v", err)
+				} else {
+					log.Printf("reloaded certs")
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("cert watch error: %v", err)
+			}
+		}
+	}()
+	return func() { w.Close() }, nil
 }
@@ -0,0 +1,290 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert returns a certificate for cn with the given usage, signed by
+// parent, or self-signed if parent is nil.  CAs have no usage.
+func newCert(t *testing.T, cn string, parent *testCert, usage ...x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  usage,
+	}
+	if len(usage) == 0 {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// tlsCert returns c as a tls.Certificate.
+func (c *testCert) tlsCert() *tls.Certificate {
+	return &tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// write writes c's certificate, and its key if keyFile isn't empty, as PEM.
+// Files are replaced by renaming new ones over them, as rotation often does.
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	writePEM(t, certFile, "CERTIFICATE", c.cert.Raw)
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	}
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client with cert, or none if it's nil, to a server
+// with config, and returns the name in the certificate the server presented
+// and the server's error, if any.  The client trusts roots.
+func handshake(t *testing.T, config *tls.Config, cert *tls.Certificate, roots *x509.CertPool) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- tls.Server(conn, config).Handshake()
+	}()
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "stenographer"}
+	if cert != nil {
+		clientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	var name string
+	if err == nil {
+		defer conn.Close()
+		name = conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	return name, <-serverErr
+}
+
+// testFiles writes ca and server's certificates into a new directory, and
+// returns a Reloader for them and a function cleaning up after it.
+func testFiles(t *testing.T, ca, server *testCert) (*Reloader, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile := filepath.Join(dir, "ca_cert.pem"), filepath.Join(dir, "server_cert.pem"), filepath.Join(dir, "server_key.pem")
+	ca.write(t, caFile, "")
+	server.write(t, certFile, keyFile)
+	r, err := NewReloader(caFile, certFile, keyFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func TestReloaderVerifiesClients(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	server := newCert(t, "stenographer", ca, x509.ExtKeyUsageServerAuth)
+	r, cleanup := testFiles(t, ca, server)
+	defer cleanup()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	otherCA := newCert(t, "other ca", nil)
+	for _, test := range []struct {
+		desc   string
+		client *testCert
+		ok     bool
+	}{
+		{"signed by CA", newCert(t, "analyst", ca, x509.ExtKeyUsageClientAuth), true},
+		{"self-signed", newCert(t, "analyst", nil, x509.ExtKeyUsageClientAuth), false},
+		{"signed by another CA", newCert(t, "analyst", otherCA, x509.ExtKeyUsageClientAuth), false},
+		{"not for clients", newCert(t, "analyst", ca, x509.ExtKeyUsageServerAuth), false},
+		{"none", nil, false},
+	} {
+		var cert *tls.Certificate
+		if test.client != nil {
+			cert = test.client.tlsCert()
+		}
+		name, err := handshake(t, r.TLSConfig(), cert, roots)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: got error %v, want success %v", test.desc, err, test.ok)
+		}
+		if test.ok && name != "stenographer" {
+			t.Errorf("%v: server presented %q, want stenographer", test.desc, name)
+		}
+	}
+
+	// With client certificates optional, those given are still verified.
+	config := r.TLSConfig()
+	config.ClientAuth = tls.RequestClientCert
+	if _, err := handshake(t, config, nil, roots); err != nil {
+		t.Errorf("optional certificate not given: got %v", err)
+	}
+	if _, err := handshake(t, config, newCert(t, "analyst", nil, x509.ExtKeyUsageClientAuth).tlsCert(), roots); err == nil {
+		t.Errorf("optional certificate self-signed: got success")
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	r, cleanup := testFiles(t, ca, newCert(t, "stenographer", ca, x509.ExtKeyUsageServerAuth))
+	defer cleanup()
+	config := r.TLSConfig() // Serving continues with the same config.
+	client := newCert(t, "analyst", ca, x509.ExtKeyUsageClientAuth).tlsCert()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	newCA := newCert(t, "new ca", nil)
+	newServer := newCert(t, "stenographer", newCA, x509.ExtKeyUsageServerAuth)
+	newClient := newCert(t, "analyst", newCA, x509.ExtKeyUsageClientAuth).tlsCert()
+	newRoots := x509.NewCertPool()
+	newRoots.AddCert(newCA.cert)
+
+	// Failed reloads keep the old certificates.
+	if err := ioutil.WriteFile(r.caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("reloading bad CA certificate succeeded")
+	}
+	newCA.write(t, r.caFile, "")
+	newServer.write(t, r.certFile, "") // Doesn't match the old key.
+	if err := r.Reload(); err == nil {
+		t.Error("reloading mismatched server key succeeded")
+	}
+	if _, err := handshake(t, config, client, roots); err != nil {
+		t.Errorf("after failed reloads, old client got %v", err)
+	}
+	if _, err := handshake(t, config, newClient, roots); err == nil {
+		t.Error("after failed reloads, new client got success")
+	}
+
+	newServer.write(t, r.certFile, r.keyFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, config, client, newRoots); err == nil {
+		t.Error("after reload, old client got success")
+	}
+	if _, err := handshake(t, config, newClient, newRoots); err != nil {
+		t.Errorf("after reload, new client got %v", err)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	r, cleanup := testFiles(t, ca, newCert(t, "stenographer", ca, x509.ExtKeyUsageServerAuth))
+	defer cleanup()
+	stop, err := r.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	newCA := newCert(t, "new ca", nil)
+	newClient := newCert(t, "analyst", newCA, x509.ExtKeyUsageClientAuth).tlsCert()
+	newRoots := x509.NewCertPool()
+	newRoots.AddCert(newCA.cert)
+	newCert(t, "stenographer", newCA, x509.ExtKeyUsageServerAuth).write(t, r.certFile, r.keyFile)
+	newCA.write(t, r.caFile, "")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := handshake(t, r.TLSConfig(), newClient, newRoots)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated certificates not reloaded: %v", err)
+		}
+	}
+}
+
+func TestNewReloaderNeedsFiles(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	r, cleanup := testFiles(t, ca, newCert(t, "stenographer", ca, x509.ExtKeyUsageServerAuth))
+	defer cleanup()
+	for _, files := range [][3]string{
+		{filepath.Join(filepath.Dir(r.caFile), "missing.pem"), r.certFile, r.keyFile},
+		{r.caFile, r.certFile, filepath.Join(filepath.Dir(r.caFile), "missing.pem")},
+		{r.certFile, r.caFile, r.keyFile}, // The CA certificate has no key.
+	} {
+		if _, err := NewReloader(files[0], files[1], files[2]); err == nil {
+			t.Errorf("NewReloader(%q) succeeded", files)
+		}
+	}
+	// The server certificate may come from elsewhere.
+	if _, err := NewReloader(r.caFile, "", ""); err != nil {
+		t.Errorf("NewReloader without server certificate got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/net/context"
+)
+
+// SPIFFESource serves a workload's X.509 SVID, from the SPIFFE workload API,
+// as its server certificate, and verifies that clients have SVIDs too.  SVIDs
+// are rotated by the workload API, so are never reread from files.
+type SPIFFESource struct {
+	source       *workloadapi.X509Source
+	trustDomains map[spiffeid.TrustDomain]bool
+}
+
+// NewSPIFFESource returns a SPIFFESource getting SVIDs and trust bundles from
+// the workload API at addr, like "unix:///run/spire/sockets/agent.sock",
+// which accepts clients in the given trust domains, or the server's own if
+// there are none.
+func NewSPIFFESource(ctx context.Context, addr string, trustDomains []string) (*SPIFFESource, error) {
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+	if err != nil {
+		return nil, fmt.Errorf("could not get SVID from SPIFFE workload API %q: %v", addr, err)
+	}
+	s := &SPIFFESource{source: source, trustDomains: map[spiffeid.TrustDomain]bool{}}
+	for _, name := range trustDomains {
+		td, err := spiffeid.TrustDomainFromString(name)
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("invalid SPIFFE trust domain %q: %v", name, err)
+		}
+		s.trustDomains[td] = true
+	}
+	if len(s.trustDomains) == 0 {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("could not get SVID: %v", err)
+		}
+		s.trustDomains[svid.ID.TrustDomain()] = true
+	}
+	return s, nil
+}
+
+// authorize accepts clients whose SVIDs are in one of s's trust domains.
+func (s *SPIFFESource) authorize(id spiffeid.ID, _ [][]*x509.Certificate) error {
+	if !s.trustDomains[id.TrustDomain()] {
+		return fmt.Errorf("SPIFFE ID %q is not in an accepted trust domain", id)
+	}
+	return nil
+}
+
+// TLSConfig returns a TLS config serving the current SVID, which requires
+// clients to have SVIDs from the accepted trust domains.  As with a
+// Reloader's, setting its ClientAuth to tls.RequestClientCert makes them
+// optional.
+func (s *SPIFFESource) TLSConfig() *tls.Config {
+	tlsConfig := tlsconfig.MTLSServerConfig(s.source, s.source, s.authorize)
+	verify := tlsConfig.VerifyPeerCertificate
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil // Whether one's required is up to ClientAuth.
+		}
+		return verify(rawCerts, chains)
+	}
+	return tlsConfig
+}
+
+// Close stops watching the workload API for new SVIDs.
+func (s *SPIFFESource) Close() error {
+	return s.source.Close()
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package communityid computes Community IDs, the flow hashes Zeek, Suricata
+// and other tools log to tie their records of a flow together, as
+// specified at https://github.com/corelight/community-id-spec.
+package communityid
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IP protocols the ID includes ports, or their ICMP equivalents, for.
+const (
+	icmp   = 1
+	tcp    = 6
+	udp    = 17
+	icmpv6 = 58
+	sctp   = 132
+)
+
+// Flow is the 5-tuple a Community ID hashes.
+type Flow struct {
+	SrcIP, DstIP net.IP
+	Proto        uint8
+	// SrcPort and DstPort are the ICMP type and code, for ICMP and ICMPv6.
+	// They're ignored for protocols without ports.
+	SrcPort, DstPort uint16
+}
+
+// icmpCounterparts map ICMP and ICMPv6 request and reply types to each other,
+// so both directions of an exchange share an ID.
+var icmpCounterparts = map[uint8]map[uint16]uint16{
+	icmp: {
+		8: 0, 0: 8, // Echo
+		13: 14, 14: 13, // Timestamp
+		15: 16, 16: 15, // Information
+		10: 9, 9: 10, // Router solicitation and advertisement
+		17: 18, 18: 17, // Address mask
+	},
+	icmpv6: {
+		128: 129, 129: 128, // Echo
+		133: 134, 134: 133, // Router solicitation and advertisement
+		135: 136, 136: 135, // Neighbor solicitation and advertisement
+		130: 131, 131: 130, // Multicast listener query and report
+		139: 140, 140: 139, // Node information query and response
+		144: 145, 145: 144, // Home agent address discovery
+	},
+}
+
+// ID returns f's version 1 Community ID with the given seed (usually 0), like
+// "1:LQU9qZlK+B5F3KDmev6m5PMibrg=".  It's the same for both directions of
+// the flow.
+func (f Flow) ID(seed uint16) string {
+	src, dst := f.SrcIP.To4(), f.DstIP.To4()
+	if src == nil || dst == nil {
+		src, dst = f.SrcIP.To16(), f.DstIP.To16()
+	}
+	sport, dport := f.SrcPort, f.DstPort
+	hasPorts, oneWay := false, false
+	switch f.Proto {
+	case tcp, udp, sctp:
+		hasPorts = true
+	case icmp, icmpv6:
+		hasPorts = true
+		if reply, ok := icmpCounterparts[f.Proto][sport]; ok {
+			dport = reply
+		} else {
+			oneWay = true
+		}
+	}
+	// Flows are hashed from their lower endpoint, so both directions match.
+	// One-way ICMP messages aren't, since they have no reverse direction.
+	if c := bytes.Compare(src, dst); !oneWay && (c > 0 || c == 0 && sport > dport) {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write(src)
+	h.Write(dst)
+	h.Write([]byte{f.Proto, 0})
+	if hasPorts {
+		binary.Write(h, binary.BigEndian, []uint16{sport, dport})
+	}
+	return "1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// FromPacket returns the flow of an Ethernet frame, or false if it isn't IP,
+// or is a fragment missing the ports its protocol needs.  Tunneled packets'
+// flows are those of their outer headers.
+func FromPacket(data []byte) (Flow, bool) {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	var f Flow
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		f = Flow{SrcIP: ip.SrcIP, DstIP: ip.DstIP, Proto: uint8(ip.Protocol)}
+	case *layers.IPv6:
+		f = Flow{SrcIP: ip.SrcIP, DstIP: ip.DstIP, Proto: uint8(ip.NextHeader)}
+	default:
+		return Flow{}, false
+	}
+	// The protocol is the first layer after the network layer's own
+	// (including any IPv6 extension headers).
+	afterIP := false
+	for _, layer := range pkt.Layers() {
+		if layer == pkt.NetworkLayer() {
+			afterIP = true
+			continue
+		}
+		if !afterIP {
+			continue
+		}
+		switch l := layer.(type) {
+		case *layers.IPv6HopByHop:
+			f.Proto = uint8(l.NextHeader)
+			continue
+		case *layers.IPv6Routing:
+			f.Proto = uint8(l.NextHeader)
+			continue
+		case *layers.IPv6Destination:
+			f.Proto = uint8(l.NextHeader)
+			continue
+		case *layers.IPv6Fragment:
+			f.Proto = uint8(l.NextHeader)
+			continue
+		case *layers.TCP:
+			f.Proto, f.SrcPort, f.DstPort = tcp, uint16(l.SrcPort), uint16(l.DstPort)
+			return f, true
+		case *layers.UDP:
+			f.Proto, f.SrcPort, f.DstPort = udp, uint16(l.SrcPort), uint16(l.DstPort)
+			return f, true
+		case *layers.SCTP:
+			f.Proto, f.SrcPort, f.DstPort = sctp, uint16(l.SrcPort), uint16(l.DstPort)
+			return f, true
+		case *layers.ICMPv4:
+			f.Proto, f.SrcPort, f.DstPort = icmp, uint16(l.TypeCode.Type()), uint16(l.TypeCode.Code())
+			return f, true
+		case *layers.ICMPv6:
+			f.Proto, f.SrcPort, f.DstPort = icmpv6, uint16(l.TypeCode.Type()), uint16(l.TypeCode.Code())
+			return f, true
+		}
+		break
+	}
+	switch f.Proto {
+	case tcp, udp, sctp, icmp, icmpv6:
+		return Flow{}, false // A fragment after the first, or truncated.
+	}
+	return f, true
+}
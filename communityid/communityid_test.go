@@ -0,0 +1,63 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package communityid
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestID(t *testing.T) {
+	for _, test := range []struct {
+		flow Flow
+		seed uint16
+		want string
+	}{
+		// From the Community ID spec's baseline.
+		{Flow{net.ParseIP("128.232.110.120"), net.ParseIP("66.35.250.204"), tcp, 34855, 80}, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{Flow{net.ParseIP("66.35.250.204"), net.ParseIP("128.232.110.120"), tcp, 80, 34855}, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{Flow{net.ParseIP("128.232.110.120"), net.ParseIP("66.35.250.204"), tcp, 34855, 80}, 1, "1:3V71V58M3Ksw/yuFALMcW0LAHvc="},
+		{Flow{net.ParseIP("192.168.0.89"), net.ParseIP("192.168.0.1"), icmp, 8, 0}, 0, "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		{Flow{net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.89"), icmp, 0, 0}, 0, "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		{Flow{net.ParseIP("fe80::200:86ff:fe05:80da"), net.ParseIP("fe80::260:97ff:fe07:69ea"), icmpv6, 135, 0}, 0, "1:dGHyGvjMfljg6Bppwm3bg0LO8TY="},
+		{Flow{net.ParseIP("fe80::260:97ff:fe07:69ea"), net.ParseIP("fe80::200:86ff:fe05:80da"), icmpv6, 136, 0}, 0, "1:dGHyGvjMfljg6Bppwm3bg0LO8TY="},
+	} {
+		if got := test.flow.ID(test.seed); got != test.want {
+			t.Errorf("%+v seed %d: got %q, want %q", test.flow, test.seed, got, test.want)
+		}
+	}
+}
+
+func TestFromPacket(t *testing.T) {
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{128, 232, 110, 120}, DstIP: net.IP{66, 35, 250, 204}}
+	tcpLayer := &layers.TCP{SrcPort: 34855, DstPort: 80}
+	tcpLayer.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		ip, tcpLayer, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := FromPacket(buf.Bytes())
+	if !ok || f.ID(0) != "1:LQU9qZlK+B5F3KDmev6m5PMibrg=" {
+		t.Errorf("got %+v, %v", f, ok)
+	}
+	if _, ok := FromPacket([]byte{1, 2, 3}); ok {
+		t.Error("got a flow for garbage")
+	}
+}
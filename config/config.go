@@ -18,10 +18,16 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/google/stenographer/base"
 )
@@ -45,6 +51,62 @@ type ThreadConfig struct {
 	IndexDirectory     string
 	DiskFreePercentage int `json:",omitempty"`
 	MaxDirectoryFiles  int `json:",omitempty"`
+	// Interface is the network interface this thread captures packets from,
+	// and 'iface' queries match.  Defaults to Config.Interface.  Threads on
+	// each interface are run by their own stenotype.
+	Interface string `json:",omitempty"`
+	// MaxAge deletes files older than this duration, like "720h".
+	MaxAge string `json:",omitempty"`
+	// MaxBytes deletes the oldest files once this thread's packet files take
+	// more than this many bytes.
+	MaxBytes int64 `json:",omitempty"`
+	// MinFreeBytes deletes the oldest files when fewer than this many bytes
+	// are free on the packets disk, like DiskFreePercentage.
+	MinFreeBytes int64 `json:",omitempty"`
+	// PinnedWindows are times, like "Mon-Fri 08:00-18:00" in local time,
+	// during which files aren't deleted for MaxAge or MaxBytes.  Files are
+	// still deleted when the disk runs low or MaxDirectoryFiles is reached.
+	PinnedWindows []string `json:",omitempty"`
+	// Queue is the NIC RX queue this thread reads with CaptureBackend
+	// "afxdp".  Defaults to the thread's position among its interface's
+	// threads.
+	Queue *int `json:",omitempty"`
+	// CPU is the CPU stenotype pins this thread to.  By default, thread N
+	// is pinned to CPU N, or with CaptureBackend "afxdp" to a CPU on the
+	// NUMA node of its interface's NIC.
+	CPU *int `json:",omitempty"`
+	// ExtraDirectories are more packet and index directories for this
+	// thread, usually on other disks.  Each time stenotype starts, the
+	// thread writes to whichever of its directories Placement prefers, and
+	// it serves and ages out files from all of them.  They can be added and
+	// removed by reloading the config; files in removed ones are moved to
+	// the others.
+	ExtraDirectories []ThreadDirectories `json:",omitempty"`
+	// Placement picks the directory new files are written to:
+	// "free_space" (the default) for the one with the most free bytes, or
+	// "latency" for the one which writes fastest.
+	Placement string `json:",omitempty"`
+}
+
+// ThreadDirectories is a packets directory, and the index directory for its
+// files.
+type ThreadDirectories struct {
+	PacketsDirectory string
+	IndexDirectory   string
+}
+
+// Directories returns all the directories the thread writes to:  its
+// PacketsDirectory and IndexDirectory, then its ExtraDirectories.
+func (t ThreadConfig) Directories() []ThreadDirectories {
+	return append([]ThreadDirectories{{t.PacketsDirectory, t.IndexDirectory}}, t.ExtraDirectories...)
+}
+
+// APIToken is a static bearer token clients may authenticate with instead of
+// a client certificate.  Only its hash is kept in the configuration.
+type APIToken struct {
+	Subject string   // Who the token identifies, as a certificate's CN would.
+	Groups  []string `json:",omitempty"` // Matched by authorization rules' OUs.
+	SHA256  string   // Hex SHA-256 of the token.
 }
 
 // Config is a json-decoded configuration for running stenographer.
@@ -57,21 +119,312 @@ type Config struct {
 	Host          string // Location to listen.
 	CertPath      string // Directory where client and server certs are stored.
 	MaxOpenFiles  int    // Max number of file descriptors opened at once
+	// QueryStatsPath is a SQLite database to record query statistics in.  If
+	// empty, query statistics aren't recorded.
+	QueryStatsPath string `json:",omitempty"`
+	// AuditLogPath is an append-only, tamper-evident log recording every packet
+	// retrieval.  If empty, retrievals aren't audited.
+	AuditLogPath string `json:",omitempty"`
+	// AuditLogMaxMB rotates the audit log once it's this large.  If 0, it's
+	// never rotated.
+	AuditLogMaxMB int64 `json:",omitempty"`
+	// AuditSyslog is a URL like "udp://loghost:514" of a syslog server each
+	// audit log entry is also sent to.  Needs AuditLogPath.
+	AuditSyslog string `json:",omitempty"`
+	// AuthzPolicyPath is a JSON file of rules limiting what each client,
+	// identified by its certificate's CN and OUs or its token's subject and
+	// groups, may query.  It's reread
+	// whenever it changes.  If empty, every client may query everything.
+	AuthzPolicyPath string `json:",omitempty"`
+	// APITokens lets clients without certificates authenticate with these
+	// bearer tokens.
+	APITokens []APIToken `json:",omitempty"`
+	// OIDCIssuer lets clients without certificates authenticate with ID tokens
+	// from this OpenID Connect issuer, like "https://accounts.example.com",
+	// issued to OIDCClientID.
+	OIDCIssuer   string `json:",omitempty"`
+	OIDCClientID string `json:",omitempty"`
+	// FederatorNames are the certificate names (see certs.Name) of stenofed
+	// servers, which query on behalf of their own clients.  Their requests
+	// must name the client in Steno-Client and Steno-Client-Groups headers
+	// (or gRPC metadata), and are authorized and audited as that client's.
+	// Bearer tokens are never treated as federators.
+	FederatorNames []string `json:",omitempty"`
+	// ACMEDomains, if set, has the server certificate obtained from an ACME
+	// CA for these names, instead of read from CertPath.  Clients are still
+	// verified against CertPath's CA certificate.
+	ACMEDomains []string `json:",omitempty"`
+	// ACMEEmail is given to the ACME CA as a contact.
+	ACMEEmail string `json:",omitempty"`
+	// ACMEDirectoryURL is the ACME CA's directory.  Let's Encrypt's if empty.
+	ACMEDirectoryURL string `json:",omitempty"`
+	// ACMEChallengeAddr is where the ACME CA's HTTP-01 challenges are
+	// answered, like ":80".  Required with ACMEDomains, since they're the only
+	// challenges answered.
+	ACMEChallengeAddr string `json:",omitempty"`
+	// SPIFFEWorkloadAPI, if set, is the SPIFFE workload API address, like
+	// "unix:///run/spire/sockets/agent.sock", the server gets its certificate
+	// (an X.509 SVID) from instead of CertPath.  Clients must then have SVIDs
+	// in SPIFFETrustDomains, or the server's own trust domain if it's empty.
+	SPIFFEWorkloadAPI  string   `json:",omitempty"`
+	SPIFFETrustDomains []string `json:",omitempty"`
+	// RetentionTarget is the minimum duration (e.g. "168h") of packets each
+	// thread is expected to retain.  If empty, retention isn't monitored.
+	RetentionTarget string `json:",omitempty"`
+	// HostSetDirectory holds the IP list files usable in 'hostset NAME'
+	// queries.  If empty, hostset queries are disabled.
+	HostSetDirectory string `json:",omitempty"`
+	// SavedQueriesPath is a JSON file of named queries usable as 'query NAME'.
+	// If empty, saved queries are disabled.
+	SavedQueriesPath string `json:",omitempty"`
+	// ReadOnly makes this stenographer a query-only replica of another one
+	// writing to the same thread directories (e.g. on shared storage).  It
+	// doesn't run stenotype or delete files.
+	ReadOnly bool `json:",omitempty"`
+	// MaxPayloadScanBytes limits how many payload bytes a single query's
+	// payload clauses may scan.  Defaults to 1GB.
+	MaxPayloadScanBytes int64 `json:",omitempty"`
+	// MaxRegexpPacketBytes limits how many bytes of each packet's payload
+	// 'payloadre' clauses scan.  Defaults to 64KB.
+	MaxRegexpPacketBytes int `json:",omitempty"`
+	// IndexLookupConcurrency is how many index files each thread looks up a
+	// query in at once.  Defaults to 10.
+	IndexLookupConcurrency int `json:",omitempty"`
+	// ParallelBlockfileReads is how many blockfiles each thread reads a
+	// query's packets from at once.  Defaults to 1, reading one at a time.
+	ParallelBlockfileReads int `json:",omitempty"`
+	// ReorderBufferPackets is how many packets each thread holds back to sort
+	// its query results by time.  Defaults to 1000, and -1 turns sorting off.
+	ReorderBufferPackets int `json:",omitempty"`
+	// IndexLookupCacheBytes limits the memory used to cache index lookup
+	// results.  Defaults to 64MB, and -1 disables the cache.
+	IndexLookupCacheBytes int64 `json:",omitempty"`
+	// MmapIndexes reads index files through memory mappings, rather than a
+	// read syscall per block.
+	MmapIndexes bool `json:",omitempty"`
+	// MmapIndexMaxBytes is the size of the largest index file to map; larger
+	// ones are read normally.  Defaults to 4GB.
+	MmapIndexMaxBytes int64 `json:",omitempty"`
+	// IndexBlockCacheBytes is how much memory to spend caching blocks read
+	// from index files, shared by all threads.  Defaults to 0, disabling it.
+	IndexBlockCacheBytes int64 `json:",omitempty"`
+	// RebuildMissingIndexes makes stenographer rebuild the indexes of packet
+	// files which don't have one, rather than deleting them.
+	RebuildMissingIndexes bool `json:",omitempty"`
+	// VerifyIndexesOnOpen checks each index for corruption before serving
+	// queries from it.
+	VerifyIndexesOnOpen bool `json:",omitempty"`
+	// IndexVerifyInterval is how often (e.g. "24h") to check every index for
+	// corruption in the background.  If empty, indexes aren't rechecked.
+	IndexVerifyInterval string `json:",omitempty"`
+	// RollupAge is how old (e.g. "24h") packets must be before their indexes
+	// are merged into rollup indexes.  If empty, no rollups are written.
+	RollupAge string `json:",omitempty"`
+	// RollupPeriod is how much time (e.g. "1h" or "24h") each rollup index
+	// covers.  Defaults to an hour.
+	RollupPeriod string `json:",omitempty"`
+	// CompressAge is how old (e.g. "6h") packets must be before their files
+	// are compressed.  If empty, files aren't compressed.
+	CompressAge string `json:",omitempty"`
+	// CompressCodec is the codec files are compressed with.  Defaults to
+	// "lz4".
+	CompressCodec string `json:",omitempty"`
+	// CompressCPUPercent is how much of a CPU compression may use.  Defaults
+	// to 25.
+	CompressCPUPercent int `json:",omitempty"`
+	// EncryptionKeyFile holds a hex encoded AES master key.  If set, packet
+	// and index files are encrypted once stenotype finishes writing them.
+	EncryptionKeyFile string `json:",omitempty"`
+	// EncryptionKeyCommand is a command which wraps and unwraps files' keys,
+	// usually with a KMS, as an alternative to EncryptionKeyFile.
+	EncryptionKeyCommand string `json:",omitempty"`
+	// ArchiveURL, if set, is where files are archived before they're deleted
+	// to free disk space, so old packets remain queryable:  "s3://BUCKET/PREFIX",
+	// "gs://BUCKET/PREFIX" or "file:///DIRECTORY".
+	ArchiveURL string `json:",omitempty"`
+	// ArchiveEndpoint overrides S3's or GCS's endpoint, like
+	// "https://minio.example.com:9000", for other S3-compatible stores.
+	ArchiveEndpoint string `json:",omitempty"`
+	// ArchiveCatalogPath is a SQLite database recording the archived files.
+	// Required with ArchiveURL.
+	ArchiveCatalogPath string `json:",omitempty"`
+	// ReplicateTo is the base URL of a Standby stenographer, like
+	// "https://standby.example.com:1234", which each thread's files are copied
+	// to once written, authenticating with the client certificate in
+	// CertPath.
+	ReplicateTo string `json:",omitempty"`
+	// Standby makes this stenographer a standby which others replicate their
+	// files to with ReplicateTo, rather than one capturing packets.  It
+	// serves queries and ages out files like any other.
+	Standby bool `json:",omitempty"`
+	// HoldDirectory is where the packets of queries placed on legal hold are
+	// preserved.  If empty, the /holds API is disabled.
+	HoldDirectory string `json:",omitempty"`
+	// MaxHoldBytes is the most bytes of packets a hold preserves.  Defaults
+	// to 10GB.
+	MaxHoldBytes int64 `json:",omitempty"`
+	// SkipCorruptPackets makes queries skip packets which fail their
+	// checksums, rather than failing partway through their responses.
+	SkipCorruptPackets bool `json:",omitempty"`
+	// QueryStallTimeout is how long (e.g. "30s") a client may stop reading a
+	// query's response before the query is canceled, freeing the files it
+	// reads.  Defaults to one minute.
+	QueryStallTimeout string `json:",omitempty"`
+	// PivotPad is how long (e.g. "5m") before an alert's flow, or a Zeek
+	// connection, started, and after the alert or the connection's end,
+	// /pivot returns packets from.  Defaults to one minute.
+	PivotPad string `json:",omitempty"`
+	// ShutdownTimeout is how long (e.g. "1m") in-flight queries may take to
+	// finish when stenographer's stopped, before they're canceled.  Defaults
+	// to 30 seconds.
+	ShutdownTimeout string `json:",omitempty"`
+	// RPCPort is the port the gRPC API is served on, with the same
+	// certificates as the HTTP API.  If 0, it isn't served.
+	RPCPort int `json:",omitempty"`
+	// TraceExporter sends OpenTelemetry traces of each query to "otlp" (an
+	// OTLP/gRPC collector at TraceEndpoint) or "stdout".  If empty, queries
+	// aren't traced.
+	TraceExporter string `json:",omitempty"`
+	// TraceEndpoint is the URL of the OTLP collector, like
+	// "http://localhost:4317".  If empty, the OTEL_EXPORTER_OTLP_* environment
+	// variables are used.
+	TraceEndpoint string `json:",omitempty"`
+	// LogFormat writes logs as structured records, tagged with the query,
+	// client, and file each line's about: "json" for one JSON object per
+	// line, or "text" for key=value pairs.  If empty, logs are plain text.
+	LogFormat string `json:",omitempty"`
+	// LogVerbosity, if set, overrides the -v flag's verbose logging level.
+	LogVerbosity *int `json:",omitempty"`
+	// CaptureFilter is a tcpdump expression, like "not host 192.0.2.1",
+	// limiting which packets stenotype writes.  It's compiled for Interface
+	// and passed as stenotype's --filter flag, which Flags then can't set.
+	// Changing it restarts stenotype, without restarting stenographer.
+	CaptureFilter string `json:",omitempty"`
+	// CaptureBackend is how stenotype reads packets:  "afpacket" (the
+	// default), or "afxdp" for AF_XDP sockets reading each thread's NIC RX
+	// queue, for fast links where AF_PACKET drops packets.
+	CaptureBackend string `json:",omitempty"`
+	// CrashLogPath is a file a report of each stenotype crash is appended to,
+	// as a line of JSON with its last output.  Crashes are always logged.
+	CrashLogPath string `json:",omitempty"`
+	// MaxCaptureDowntime fails /readyz once stenotype has been down for
+	// longer than this (e.g. "2m"), so queries go to other sensors.  If
+	// empty, /readyz doesn't check it.
+	MaxCaptureDowntime string `json:",omitempty"`
+	// Alerts pages someone when capture fails silently.
+	Alerts *AlertConfig `json:",omitempty"`
+}
+
+// AlertConfig configures alerts on threads dropping packets or no longer
+// producing files.  Alerts are sent when they start firing and when they
+// resolve, to Webhook, Command or both.
+type AlertConfig struct {
+	// Webhook is a URL each alert is POSTed to as JSON.
+	Webhook string `json:",omitempty"`
+	// Command is run for each alert, with the alert as JSON on stdin.  It's
+	// split on spaces.
+	Command string `json:",omitempty"`
+	// DropWindow is how far back (e.g. "5m") a thread's dropped packets are
+	// counted.  Defaults to 5 minutes.
+	DropWindow string `json:",omitempty"`
+	// MaxDrops alerts when a thread drops more than this many packets within
+	// DropWindow.
+	MaxDrops int64 `json:",omitempty"`
+	// MaxDropPercent alerts when a thread drops more than this percentage of
+	// its packets within DropWindow.
+	MaxDropPercent float64 `json:",omitempty"`
+	// MaxIndexAge alerts when a thread's newest file is older than this
+	// (e.g. "10m").
+	MaxIndexAge string `json:",omitempty"`
+}
+
+// FilterFlag returns whether Flags sets stenotype's --filter flag.
+func (c Config) FilterFlag() bool {
+	return c.hasFlag("--filter")
+}
+
+// hasFlag returns whether Flags sets the stenotype flag name.
+func (c Config) hasFlag(name string) bool {
+	for _, f := range c.Flags {
+		if f == name || strings.HasPrefix(f, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// ThreadInterface returns the network interface thread n captures from.
+func (c Config) ThreadInterface(n int) string {
+	if iface := c.Threads[n].Interface; iface != "" {
+		return iface
+	}
+	return c.Interface
 }
 
-// ReadConfigFile reads in the given JSON encoded configuration file and returns
-// the Config object associated with the decoded configuration data.
+// ThreadQueue returns the NIC RX queue thread n reads with CaptureBackend
+// "afxdp".
+func (c Config) ThreadQueue(n int) int {
+	if q := c.Threads[n].Queue; q != nil {
+		return *q
+	}
+	queue := 0
+	for i := 0; i < n; i++ {
+		if c.ThreadInterface(i) == c.ThreadInterface(n) {
+			queue++
+		}
+	}
+	return queue
+}
+
+// Captures returns whether stenographer runs stenotype to capture packets,
+// rather than serving files another writes (ReadOnly) or replicates to it
+// (Standby).
+func (c Config) Captures() bool {
+	return !c.ReadOnly && !c.Standby
+}
+
+// Interfaces returns the network interfaces the threads capture from, in the
+// order of their first threads.
+func (c Config) Interfaces() []string {
+	var out []string
+	seen := map[string]bool{}
+	for n := range c.Threads {
+		if iface := c.ThreadInterface(n); !seen[iface] {
+			seen[iface] = true
+			out = append(out, iface)
+		}
+	}
+	return out
+}
+
+// ReadConfigFile reads in the given configuration file and returns the Config
+// object associated with the decoded configuration data.  Files ending in
+// .yaml or .yml are read as YAML, those ending in .toml as TOML, and any
+// others as JSON.  Fields Config doesn't have are rejected, whatever the
+// format, so misspelled settings aren't silently ignored.  Settings in the
+// file are overridden by STENOGRAPHER_* environment variables, and those by
+// FlagOverrides.
 func ReadConfigFile(filename string) (*Config, error) {
 	v(0, "Reading config %q", filename)
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("could not read config file %q: %v", filename, err)
 	}
+	if data, err = toJSON(filename, data); err != nil {
+		return nil, fmt.Errorf("could not decode config file %q: %v", filename, err)
+	}
 	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
 	var out Config
 	if err := dec.Decode(&out); err != nil {
 		return nil, fmt.Errorf("could not decode config file %q: %v", filename, err)
 	}
+	if dec.More() {
+		return nil, fmt.Errorf("could not decode config file %q: data after the config", filename)
+	}
+	if err := applyOverrides(&out, os.Environ()); err != nil {
+		return nil, err
+	}
 	if out.MaxOpenFiles <= 0 {
 		out.MaxOpenFiles = defaultMaxOpenFiles
 	}
@@ -86,20 +439,229 @@ func ReadConfigFile(filename string) (*Config, error) {
 	return &out, nil
 }
 
-// Validate checks the configuration for common errors.
+// Validate checks the configuration for common errors, returning the first
+// it finds.
 func (c Config) Validate() error {
+	if errs := c.Problems(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Problems checks the configuration for common errors, returning all of them.
+func (c Config) Problems() (errs []error) {
 	for n, thread := range c.Threads {
 		if thread.PacketsDirectory == "" {
-			return fmt.Errorf("No packet directory specified for thread %d in configuration", n)
+			errs = append(errs, fmt.Errorf("No packet directory specified for thread %d in configuration", n))
 		}
 		if thread.IndexDirectory == "" {
-			return fmt.Errorf("No index directory specified for thread %d in configuration", n)
+			errs = append(errs, fmt.Errorf("No index directory specified for thread %d in configuration", n))
+		}
+		if thread.MaxAge != "" {
+			if d, err := time.ParseDuration(thread.MaxAge); err != nil || d <= 0 {
+				errs = append(errs, fmt.Errorf("invalid max age %q for thread %d in configuration", thread.MaxAge, n))
+			}
+		}
+		if thread.MaxBytes < 0 || thread.MinFreeBytes < 0 {
+			errs = append(errs, fmt.Errorf("negative byte limit for thread %d in configuration", n))
+		}
+		for _, w := range thread.PinnedWindows {
+			if _, err := ParseWindow(w); err != nil {
+				errs = append(errs, fmt.Errorf("thread %d: %v", n, err))
+			}
 		}
+		for _, d := range thread.ExtraDirectories {
+			if d.PacketsDirectory == "" || d.IndexDirectory == "" {
+				errs = append(errs, fmt.Errorf("extra directories for thread %d need both a packets and an index directory", n))
+			}
+		}
+		switch thread.Placement {
+		case "", "free_space", "latency":
+		default:
+			errs = append(errs, fmt.Errorf("invalid placement %q for thread %d in configuration", thread.Placement, n))
+		}
+		if (thread.Queue != nil && *thread.Queue < 0) || (thread.CPU != nil && *thread.CPU < 0) {
+			errs = append(errs, fmt.Errorf("negative queue or CPU for thread %d in configuration", n))
+		}
+		if thread.Queue != nil && c.CaptureBackend != "afxdp" {
+			errs = append(errs, fmt.Errorf("thread %d sets a queue, which needs CaptureBackend \"afxdp\"", n))
+		}
+	}
+	switch c.CaptureBackend {
+	case "", "afpacket":
+	case "afxdp":
+		queues := map[string]bool{}
+		for n := range c.Threads {
+			q := fmt.Sprintf("%v queue %d", c.ThreadInterface(n), c.ThreadQueue(n))
+			if queues[q] {
+				errs = append(errs, fmt.Errorf("thread %d reads %v, like an earlier thread", n, q))
+			}
+			queues[q] = true
+		}
+		// AF_XDP sockets can't filter, and take whole queues rather than
+		// joining fanout groups.
+		if c.CaptureFilter != "" || c.FilterFlag() {
+			errs = append(errs, fmt.Errorf("capture filters aren't supported with CaptureBackend \"afxdp\""))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid capture backend %q in configuration", c.CaptureBackend))
+	}
+
+	// Each interface's stenotype joins its own fanout group, and groups
+	// can't span interfaces.
+	if c.Captures() && len(c.Interfaces()) > 1 && c.hasFlag("--fanout_id") {
+		errs = append(errs, fmt.Errorf("--fanout_id can't be set in Flags when capturing from several interfaces"))
+	}
+	if c.CaptureFilter != "" && c.FilterFlag() {
+		errs = append(errs, fmt.Errorf("CaptureFilter can't be used with a --filter flag in Flags"))
+	}
+
+	if c.RetentionTarget != "" {
+		if _, err := time.ParseDuration(c.RetentionTarget); err != nil {
+			errs = append(errs, fmt.Errorf("invalid retention target %q in configuration: %v", c.RetentionTarget, err))
+		}
+	}
+
+	if c.IndexVerifyInterval != "" {
+		if d, err := time.ParseDuration(c.IndexVerifyInterval); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid index verify interval %q in configuration", c.IndexVerifyInterval))
+		}
+	}
+
+	for _, d := range []string{c.RollupAge, c.RollupPeriod} {
+		if d == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(d); err != nil || parsed <= 0 {
+			errs = append(errs, fmt.Errorf("invalid rollup duration %q in configuration", d))
+		}
+	}
+
+	if c.CompressAge != "" {
+		if d, err := time.ParseDuration(c.CompressAge); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid compress age %q in configuration", c.CompressAge))
+		}
+	}
+	if c.QueryStallTimeout != "" {
+		if d, err := time.ParseDuration(c.QueryStallTimeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid query stall timeout %q in configuration", c.QueryStallTimeout))
+		}
+	}
+	if c.PivotPad != "" {
+		if d, err := time.ParseDuration(c.PivotPad); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("invalid pivot pad %q in configuration", c.PivotPad))
+		}
+	}
+	if c.ShutdownTimeout != "" {
+		if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("invalid shutdown timeout %q in configuration", c.ShutdownTimeout))
+		}
+	}
+	switch c.TraceExporter {
+	case "", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Errorf("invalid trace exporter %q in configuration", c.TraceExporter))
+	}
+	if c.TraceEndpoint != "" && c.TraceExporter != "otlp" {
+		errs = append(errs, fmt.Errorf("TraceEndpoint needs TraceExporter \"otlp\""))
+	}
+	for i, t := range c.APITokens {
+		if t.Subject == "" {
+			errs = append(errs, fmt.Errorf("API token %d has no subject in configuration", i))
+		}
+		if b, err := hex.DecodeString(t.SHA256); err != nil || len(b) != sha256.Size {
+			errs = append(errs, fmt.Errorf("API token %q has invalid SHA256 %q in configuration", t.Subject, t.SHA256))
+		}
+	}
+	if (c.OIDCIssuer == "") != (c.OIDCClientID == "") {
+		errs = append(errs, fmt.Errorf("OIDCIssuer and OIDCClientID must be set together"))
+	}
+	if len(c.ACMEDomains) > 0 && c.SPIFFEWorkloadAPI != "" {
+		errs = append(errs, fmt.Errorf("ACMEDomains and SPIFFEWorkloadAPI can't both be set"))
+	}
+	if len(c.ACMEDomains) == 0 && (c.ACMEEmail != "" || c.ACMEDirectoryURL != "" || c.ACMEChallengeAddr != "") {
+		errs = append(errs, fmt.Errorf("ACMEEmail, ACMEDirectoryURL and ACMEChallengeAddr need ACMEDomains"))
+	}
+	if len(c.ACMEDomains) > 0 && c.ACMEChallengeAddr == "" {
+		errs = append(errs, fmt.Errorf("ACMEDomains needs ACMEChallengeAddr, where HTTP-01 challenges are answered"))
+	}
+	if len(c.SPIFFETrustDomains) > 0 && c.SPIFFEWorkloadAPI == "" {
+		errs = append(errs, fmt.Errorf("SPIFFETrustDomains needs SPIFFEWorkloadAPI"))
+	}
+	if c.MaxHoldBytes < 0 {
+		errs = append(errs, fmt.Errorf("invalid max hold bytes %d in configuration", c.MaxHoldBytes))
+	}
+	if c.AuditLogMaxMB < 0 {
+		errs = append(errs, fmt.Errorf("invalid audit log max MB %d in configuration", c.AuditLogMaxMB))
+	}
+	if (c.AuditLogMaxMB != 0 || c.AuditSyslog != "") && c.AuditLogPath == "" {
+		errs = append(errs, fmt.Errorf("AuditLogMaxMB and AuditSyslog need AuditLogPath"))
+	}
+	switch c.LogFormat {
+	case "", "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log format %q in configuration", c.LogFormat))
+	}
+	if c.ParallelBlockfileReads < 0 {
+		errs = append(errs, fmt.Errorf("invalid parallel blockfile reads %d in configuration", c.ParallelBlockfileReads))
+	}
+	if c.CompressCPUPercent < 0 || c.CompressCPUPercent > 100 {
+		errs = append(errs, fmt.Errorf("invalid compress CPU percent %d in configuration", c.CompressCPUPercent))
+	}
+
+	if (c.ArchiveURL == "") != (c.ArchiveCatalogPath == "") {
+		errs = append(errs, fmt.Errorf("ArchiveURL and ArchiveCatalogPath must be set together"))
+	}
+	if c.ArchiveEndpoint != "" && c.ArchiveURL == "" {
+		errs = append(errs, fmt.Errorf("ArchiveEndpoint needs ArchiveURL"))
+	}
+	if c.ReplicateTo != "" {
+		if u, err := url.Parse(c.ReplicateTo); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ReplicateTo %q isn't an https:// URL", c.ReplicateTo))
+		}
+		if c.ReadOnly || c.Standby {
+			errs = append(errs, fmt.Errorf("only a stenographer writing its own files can ReplicateTo a standby"))
+		}
+	}
+	if c.Standby && c.ReadOnly {
+		errs = append(errs, fmt.Errorf("Standby and ReadOnly can't both be set"))
+	}
+	if c.MaxCaptureDowntime != "" {
+		if d, err := time.ParseDuration(c.MaxCaptureDowntime); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid max capture downtime %q in configuration", c.MaxCaptureDowntime))
+		}
+	}
+	if a := c.Alerts; a != nil {
+		if a.Webhook == "" && a.Command == "" {
+			errs = append(errs, fmt.Errorf("Alerts need a Webhook or Command"))
+		}
+		if a.Webhook != "" {
+			if u, err := url.Parse(a.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("alert webhook %q isn't an http:// or https:// URL", a.Webhook))
+			}
+		}
+		for _, d := range []string{a.DropWindow, a.MaxIndexAge} {
+			if d == "" {
+				continue
+			}
+			if parsed, err := time.ParseDuration(d); err != nil || parsed <= 0 {
+				errs = append(errs, fmt.Errorf("invalid alert duration %q in configuration", d))
+			}
+		}
+		if a.MaxDrops < 0 || a.MaxDropPercent < 0 || a.MaxDropPercent > 100 {
+			errs = append(errs, fmt.Errorf("invalid alert drop limits in configuration"))
+		}
+		if a.MaxDrops == 0 && a.MaxDropPercent == 0 && a.MaxIndexAge == "" {
+			errs = append(errs, fmt.Errorf("Alerts need MaxDrops, MaxDropPercent or MaxIndexAge"))
+		}
+	}
+	if c.EncryptionKeyFile != "" && c.EncryptionKeyCommand != "" {
+		errs = append(errs, fmt.Errorf("only one of EncryptionKeyFile and EncryptionKeyCommand may be set"))
 	}
 
 	if host := net.ParseIP(c.Host); host == nil {
-		return fmt.Errorf("invalid listening location %q in configuration", c.Host)
+		errs = append(errs, fmt.Errorf("invalid listening location %q in configuration", c.Host))
 	}
 
-	return nil
+	return errs
 }
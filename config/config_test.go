@@ -0,0 +1,47 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterfaces(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		c           Config
+		want        []string
+		wantThreads []string
+	}{
+		{"one interface", Config{Interface: "eth0", Threads: []ThreadConfig{{}, {}}}, []string{"eth0"}, []string{"eth0", "eth0"}},
+		// Threads without their own Interface capture from the config's.
+		{"several", Config{Interface: "eth0", Threads: []ThreadConfig{{Interface: "eth1"}, {}, {Interface: "eth1"}, {Interface: "eth2"}}},
+			[]string{"eth1", "eth0", "eth2"}, []string{"eth1", "eth0", "eth1", "eth2"}},
+		{"every thread set", Config{Interface: "eth0", Threads: []ThreadConfig{{Interface: "eth1"}}}, []string{"eth1"}, []string{"eth1"}},
+		{"no threads", Config{Interface: "eth0"}, nil, nil},
+	} {
+		if got := test.c.Interfaces(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got interfaces %q, want %q", test.desc, got, test.want)
+		}
+		var got []string
+		for n := range test.c.Threads {
+			got = append(got, test.c.ThreadInterface(n))
+		}
+		if !reflect.DeepEqual(got, test.wantThreads) {
+			t.Errorf("%v: got thread interfaces %q, want %q", test.desc, got, test.wantThreads)
+		}
+	}
+}
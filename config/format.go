@@ -0,0 +1,47 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// toJSON converts a YAML or TOML config file's contents, as the filename's
+// extension says it is, to JSON.  Other files are returned as they are.
+// Converting them lets every format share JSON's field names and strict
+// decoding.
+func toJSON(filename string, data []byte) ([]byte, error) {
+	var out interface{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &out); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		out = m
+	default:
+		return data, nil
+	}
+	return json.Marshal(out)
+}
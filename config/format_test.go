@@ -0,0 +1,324 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file named name holding contents into dir,
+// and returns its path.
+func writeConfig(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// formatConfig is what each of formatTests' files holds.
+var formatConfig = Config{
+	StenotypePath: "/usr/bin/stenotype",
+	Threads: []ThreadConfig{
+		{PacketsDirectory: "/data/0/pkt", IndexDirectory: "/data/0/idx", DiskFreePercentage: 10, MaxDirectoryFiles: 30000, MaxBytes: 5000000000000},
+		{PacketsDirectory: "/data/1/pkt", IndexDirectory: "/data/1/idx", DiskFreePercentage: 25, MaxDirectoryFiles: 30000, PinnedWindows: []string{"Mon-Fri 08:00-18:00"}},
+	},
+	Interface:    "eth0",
+	Flags:        []string{"-v", "--blocks=4096"},
+	Port:         1234,
+	Host:         "127.0.0.1",
+	CertPath:     "/etc/stenographer/certs",
+	MaxOpenFiles: 100000,
+	ReadOnly:     true,
+	Alerts:       &AlertConfig{Webhook: "https://alerts.example.com/", MaxDropPercent: 0.5},
+}
+
+var formatTests = []struct {
+	name, contents string
+}{
+	{"steno.json", `{
+  "StenotypePath": "/usr/bin/stenotype",
+  "Threads": [
+    {"PacketsDirectory": "/data/0/pkt", "IndexDirectory": "/data/0/idx", "MaxBytes": 5000000000000},
+    {"PacketsDirectory": "/data/1/pkt", "IndexDirectory": "/data/1/idx", "DiskFreePercentage": 25, "PinnedWindows": ["Mon-Fri 08:00-18:00"]}
+  ],
+  "Interface": "eth0",
+  "Flags": ["-v", "--blocks=4096"],
+  "Port": 1234,
+  "Host": "127.0.0.1",
+  "CertPath": "/etc/stenographer/certs",
+  "ReadOnly": true,
+  "Alerts": {"Webhook": "https://alerts.example.com/", "MaxDropPercent": 0.5}
+}`},
+	{"steno.yaml", `
+StenotypePath: /usr/bin/stenotype
+Threads:
+  - PacketsDirectory: /data/0/pkt
+    IndexDirectory: /data/0/idx
+    MaxBytes: 5000000000000
+  - PacketsDirectory: /data/1/pkt
+    IndexDirectory: /data/1/idx
+    DiskFreePercentage: 25
+    PinnedWindows: ["Mon-Fri 08:00-18:00"]
+Interface: eth0
+Flags: ["-v", "--blocks=4096"]
+Port: 1234
+Host: 127.0.0.1
+CertPath: /etc/stenographer/certs
+ReadOnly: true
+Alerts:
+  Webhook: https://alerts.example.com/
+  MaxDropPercent: 0.5
+`},
+	{"steno.YML", `
+StenotypePath: /usr/bin/stenotype
+Threads: [{PacketsDirectory: /data/0/pkt, IndexDirectory: /data/0/idx, MaxBytes: 5000000000000}, {PacketsDirectory: /data/1/pkt, IndexDirectory: /data/1/idx, DiskFreePercentage: 25, PinnedWindows: [Mon-Fri 08:00-18:00]}]
+Interface: eth0
+Flags: [-v, --blocks=4096]
+Port: 1234
+Host: 127.0.0.1
+CertPath: /etc/stenographer/certs
+ReadOnly: true
+Alerts: {Webhook: "https://alerts.example.com/", MaxDropPercent: 0.5}
+`},
+	{"steno.toml", `
+StenotypePath = "/usr/bin/stenotype"
+Interface = "eth0"
+Flags = ["-v", "--blocks=4096"]
+Port = 1234
+Host = "127.0.0.1"
+CertPath = "/etc/stenographer/certs"
+ReadOnly = true
+
+[[Threads]]
+PacketsDirectory = "/data/0/pkt"
+IndexDirectory = "/data/0/idx"
+MaxBytes = 5000000000000
+
+[[Threads]]
+PacketsDirectory = "/data/1/pkt"
+IndexDirectory = "/data/1/idx"
+DiskFreePercentage = 25
+PinnedWindows = ["Mon-Fri 08:00-18:00"]
+
+[Alerts]
+Webhook = "https://alerts.example.com/"
+MaxDropPercent = 0.5
+`},
+	// Files with other extensions are JSON.
+	{"steno.conf", `{"StenotypePath": "/usr/bin/stenotype", "Threads": [
+    {"PacketsDirectory": "/data/0/pkt", "IndexDirectory": "/data/0/idx", "MaxBytes": 5000000000000},
+    {"PacketsDirectory": "/data/1/pkt", "IndexDirectory": "/data/1/idx", "DiskFreePercentage": 25, "PinnedWindows": ["Mon-Fri 08:00-18:00"]}],
+  "Interface": "eth0", "Flags": ["-v", "--blocks=4096"], "Port": 1234, "Host": "127.0.0.1",
+  "CertPath": "/etc/stenographer/certs", "ReadOnly": true,
+  "Alerts": {"Webhook": "https://alerts.example.com/", "MaxDropPercent": 0.5}}`},
+}
+
+func TestReadConfigFileFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range formatTests {
+		got, err := ReadConfigFile(writeConfig(t, dir, test.name, test.contents))
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, formatConfig) {
+			t.Errorf("%v: got %+v, want %+v", test.name, *got, formatConfig)
+		}
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name, contents string
+		want           string // In the error.
+	}{
+		// Misspelled settings are rejected, whatever the format.
+		{"unknown.json", `{"Prot": 1234}`, `unknown field "Prot"`},
+		{"unknown.yaml", `Prot: 1234`, `unknown field "Prot"`},
+		{"unknown.yml", `Prot: 1234`, `unknown field "Prot"`},
+		{"unknown.toml", `Prot = 1234`, `unknown field "Prot"`},
+		{"unknown.conf", `{"Prot": 1234}`, `unknown field "Prot"`},
+		{"unknown_thread.json", `{"Threads": [{"PacketDirectory": "/pkt"}]}`, `unknown field "PacketDirectory"`},
+		{"unknown_thread.yaml", "Threads:\n  - PacketDirectory: /pkt\n", `unknown field "PacketDirectory"`},
+		{"unknown_thread.toml", "[[Threads]]\nPacketDirectory = \"/pkt\"\n", `unknown field "PacketDirectory"`},
+		{"unknown_alert.toml", "[Alerts]\nWebhok = \"https://alerts.example.com/\"\n", `unknown field "Webhok"`},
+		// So are settings of the wrong type.
+		{"type.json", `{"Port": "1234"}`, "could not decode"},
+		{"type.yaml", `Port: [1234]`, "could not decode"},
+		{"type.toml", `Port = "1234"`, "could not decode"},
+		{"type_thread.yaml", "Threads:\n  PacketsDirectory: /pkt\n", "could not decode"},
+		// And files that aren't in their format.
+		{"syntax.json", `{"Port": 1234`, "could not decode"},
+		{"syntax.yaml", "Port: 1234\n\tHost: 127.0.0.1\n", "could not decode"},
+		{"syntax.toml", `Port: 1234`, "could not decode"},
+		{"yaml.toml", "Port: 1234\n", "could not decode"},
+		{"toml.yaml", "Port = 1234\n", "could not decode"},
+		{"trailing.json", `{"Port": 1234} {"Port": 5678}`, "data after the config"},
+	} {
+		_, err := ReadConfigFile(writeConfig(t, dir, test.name, test.contents))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got error %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+	if _, err := ReadConfigFile(filepath.Join(dir, "missing.json")); err == nil || !strings.Contains(err.Error(), "could not read") {
+		t.Errorf("missing file: got error %v, want one containing %q", err, "could not read")
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	for _, test := range []struct {
+		name, contents string
+		want           string
+	}{
+		{"a.json", `{"Port":1234}  `, `{"Port":1234}  `}, // Left alone.
+		{"a", `not even JSON`, `not even JSON`},
+		{"a.yaml", "Port: 1234\nFlags: [-v]\n", `{"Flags":["-v"],"Port":1234}`},
+		{"A.YAML", "Port: 1234\n", `{"Port":1234}`},
+		{"a.yml", "Threads:\n  - MaxBytes: 5000000000000\n", `{"Threads":[{"MaxBytes":5000000000000}]}`},
+		{"a.toml", "Port = 1234\nFlags = [\"-v\"]\n", `{"Flags":["-v"],"Port":1234}`},
+		{"a.Toml", "[[Threads]]\nMaxBytes = 5000000000000\n", `{"Threads":[{"MaxBytes":5000000000000}]}`},
+	} {
+		got, err := toJSON(test.name, []byte(test.contents))
+		if err != nil || string(got) != test.want {
+			t.Errorf("toJSON(%q, %q) got %s, %v; want %s", test.name, test.contents, got, err, test.want)
+		}
+	}
+}
+
+func TestProblems(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			Host:    "127.0.0.1",
+			Threads: []ThreadConfig{{PacketsDirectory: "/pkt", IndexDirectory: "/idx"}},
+		}
+	}
+	zero, one, negative := 0, 1, -1
+	for _, test := range []struct {
+		desc   string
+		modify func(c *Config)
+		want   []string // In each problem found.
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"everything valid", func(c *Config) {
+			c.Threads[0].MaxAge = "720h"
+			c.Threads[0].PinnedWindows = []string{"Mon-Fri 08:00-18:00", "22:00-06:00"}
+			c.Threads[0].ExtraDirectories = []ThreadDirectories{{"/pkt2", "/idx2"}}
+			c.Threads[0].Placement = "latency"
+			c.RetentionTarget, c.IndexVerifyInterval, c.RollupAge, c.RollupPeriod = "168h", "24h", "24h", "1h"
+			c.CompressAge, c.QueryStallTimeout, c.PivotPad, c.ShutdownTimeout = "6h", "30s", "0s", "0s"
+			c.TraceExporter, c.TraceEndpoint = "otlp", "http://localhost:4317"
+			c.ACMEDomains, c.ACMEChallengeAddr = []string{"steno.example.com"}, ":80"
+			c.AuditLogPath, c.AuditLogMaxMB, c.LogFormat = "/var/log/steno-audit", 100, "json"
+			c.ArchiveURL, c.ArchiveCatalogPath = "s3://bucket/steno", "/var/lib/steno/catalog.db"
+			c.ReplicateTo = "https://standby.example.com:1234"
+			c.Alerts = &AlertConfig{Command: "page-oncall", MaxIndexAge: "10m"}
+		}, nil},
+		{"no packets directory", func(c *Config) { c.Threads[0].PacketsDirectory = "" }, []string{"No packet directory specified for thread 0"}},
+		{"no index directory", func(c *Config) { c.Threads[0].IndexDirectory = "" }, []string{"No index directory specified for thread 0"}},
+		{"bad max age", func(c *Config) { c.Threads[0].MaxAge = "30d" }, []string{`invalid max age "30d"`}},
+		{"negative max age", func(c *Config) { c.Threads[0].MaxAge = "-1h" }, []string{`invalid max age "-1h"`}},
+		{"negative max bytes", func(c *Config) { c.Threads[0].MaxBytes = -1 }, []string{"negative byte limit for thread 0"}},
+		{"negative min free bytes", func(c *Config) { c.Threads[0].MinFreeBytes = -1 }, []string{"negative byte limit for thread 0"}},
+		{"bad pinned window", func(c *Config) { c.Threads[0].PinnedWindows = []string{"Someday 08:00-18:00"} }, []string{"thread 0: invalid days"}},
+		{"half an extra directory", func(c *Config) { c.Threads[0].ExtraDirectories = []ThreadDirectories{{PacketsDirectory: "/pkt2"}} }, []string{"extra directories for thread 0"}},
+		{"bad placement", func(c *Config) { c.Threads[0].Placement = "random" }, []string{`invalid placement "random"`}},
+		{"negative CPU", func(c *Config) { c.Threads[0].CPU = &negative }, []string{"negative queue or CPU for thread 0"}},
+		{"queue without afxdp", func(c *Config) { c.Threads[0].Queue = &one }, []string{`thread 0 sets a queue, which needs CaptureBackend "afxdp"`}},
+		{"shared queue", func(c *Config) {
+			c.CaptureBackend = "afxdp"
+			c.Threads = append(c.Threads, ThreadConfig{PacketsDirectory: "/pkt1", IndexDirectory: "/idx1", Queue: &zero})
+		}, []string{"thread 1 reads eth0 queue 0, like an earlier thread"}},
+		{"afxdp filter", func(c *Config) { c.CaptureBackend, c.CaptureFilter = "afxdp", "tcp" }, []string{"capture filters aren't supported"}},
+		{"bad backend", func(c *Config) { c.CaptureBackend = "pcap" }, []string{`invalid capture backend "pcap"`}},
+		{"fanout ID with several interfaces", func(c *Config) {
+			c.Flags = []string{"--fanout_id=7"}
+			c.Threads = append(c.Threads, ThreadConfig{PacketsDirectory: "/pkt1", IndexDirectory: "/idx1", Interface: "eth1"})
+		}, []string{"--fanout_id can't be set"}},
+		{"two filters", func(c *Config) { c.CaptureFilter, c.Flags = "tcp", []string{"--filter=0123"} }, []string{"CaptureFilter can't be used with a --filter flag"}},
+		{"bad retention target", func(c *Config) { c.RetentionTarget = "1w" }, []string{`invalid retention target "1w"`}},
+		{"bad index verify interval", func(c *Config) { c.IndexVerifyInterval = "0s" }, []string{`invalid index verify interval "0s"`}},
+		{"bad rollups", func(c *Config) { c.RollupAge, c.RollupPeriod = "day", "-1h" }, []string{`invalid rollup duration "day"`, `invalid rollup duration "-1h"`}},
+		{"bad compress age", func(c *Config) { c.CompressAge = "0s" }, []string{`invalid compress age "0s"`}},
+		{"bad query stall timeout", func(c *Config) { c.QueryStallTimeout = "soon" }, []string{`invalid query stall timeout "soon"`}},
+		{"bad pivot pad", func(c *Config) { c.PivotPad = "-5m" }, []string{`invalid pivot pad "-5m"`}},
+		{"bad shutdown timeout", func(c *Config) { c.ShutdownTimeout = "-1s" }, []string{`invalid shutdown timeout "-1s"`}},
+		{"bad trace exporter", func(c *Config) { c.TraceExporter = "jaeger" }, []string{`invalid trace exporter "jaeger"`}},
+		{"trace endpoint without otlp", func(c *Config) { c.TraceExporter, c.TraceEndpoint = "stdout", "http://localhost:4317" }, []string{"TraceEndpoint needs TraceExporter"}},
+		{"bad API token", func(c *Config) { c.APITokens = []APIToken{{SHA256: "abcd"}} }, []string{"API token 0 has no subject", `API token "" has invalid SHA256 "abcd"`}},
+		{"OIDC issuer alone", func(c *Config) { c.OIDCIssuer = "https://accounts.example.com" }, []string{"OIDCIssuer and OIDCClientID must be set together"}},
+		{"ACME and SPIFFE", func(c *Config) {
+			c.ACMEDomains, c.ACMEChallengeAddr = []string{"steno.example.com"}, ":80"
+			c.SPIFFEWorkloadAPI = "unix:///run/spire/sockets/agent.sock"
+		}, []string{"ACMEDomains and SPIFFEWorkloadAPI can't both be set"}},
+		{"ACME settings without domains", func(c *Config) { c.ACMEEmail = "soc@example.com" }, []string{"ACMEEmail, ACMEDirectoryURL and ACMEChallengeAddr need ACMEDomains"}},
+		{"ACME without challenge address", func(c *Config) { c.ACMEDomains = []string{"steno.example.com"} }, []string{"ACMEDomains needs ACMEChallengeAddr"}},
+		{"SPIFFE trust domains alone", func(c *Config) { c.SPIFFETrustDomains = []string{"example.com"} }, []string{"SPIFFETrustDomains needs SPIFFEWorkloadAPI"}},
+		{"negative max hold bytes", func(c *Config) { c.MaxHoldBytes = -1 }, []string{"invalid max hold bytes -1"}},
+		{"negative audit log size", func(c *Config) { c.AuditLogPath, c.AuditLogMaxMB = "/var/log/steno-audit", -1 }, []string{"invalid audit log max MB -1"}},
+		{"audit syslog without log", func(c *Config) { c.AuditSyslog = "udp://loghost:514" }, []string{"AuditLogMaxMB and AuditSyslog need AuditLogPath"}},
+		{"bad log format", func(c *Config) { c.LogFormat = "xml" }, []string{`invalid log format "xml"`}},
+		{"negative parallel reads", func(c *Config) { c.ParallelBlockfileReads = -1 }, []string{"invalid parallel blockfile reads -1"}},
+		{"compress CPU over 100", func(c *Config) { c.CompressCPUPercent = 101 }, []string{"invalid compress CPU percent 101"}},
+		{"archive without catalog", func(c *Config) { c.ArchiveURL = "s3://bucket/steno" }, []string{"ArchiveURL and ArchiveCatalogPath must be set together"}},
+		{"archive endpoint alone", func(c *Config) { c.ArchiveEndpoint = "https://minio.example.com:9000" }, []string{"ArchiveEndpoint needs ArchiveURL"}},
+		{"replicate over http", func(c *Config) { c.ReplicateTo = "http://standby.example.com:1234" }, []string{`ReplicateTo "http://standby.example.com:1234" isn't an https:// URL`}},
+		{"replicate from standby", func(c *Config) { c.ReplicateTo, c.Standby = "https://standby.example.com:1234", true }, []string{"only a stenographer writing its own files can ReplicateTo"}},
+		{"standby and read-only", func(c *Config) { c.Standby, c.ReadOnly = true, true }, []string{"Standby and ReadOnly can't both be set"}},
+		{"bad max capture downtime", func(c *Config) { c.MaxCaptureDowntime = "0s" }, []string{`invalid max capture downtime "0s"`}},
+		{"alerts sent nowhere", func(c *Config) { c.Alerts = &AlertConfig{MaxDrops: 10} }, []string{"Alerts need a Webhook or Command"}},
+		{"bad alert webhook", func(c *Config) { c.Alerts = &AlertConfig{Webhook: "ftp://alerts.example.com/", MaxDrops: 10} }, []string{`alert webhook "ftp://alerts.example.com/" isn't an http:// or https:// URL`}},
+		{"bad alert duration", func(c *Config) { c.Alerts = &AlertConfig{Command: "page", DropWindow: "5", MaxDrops: 10} }, []string{`invalid alert duration "5"`}},
+		{"bad alert drop limits", func(c *Config) { c.Alerts = &AlertConfig{Command: "page", MaxDropPercent: 101} }, []string{"invalid alert drop limits"}},
+		{"alerts without limits", func(c *Config) { c.Alerts = &AlertConfig{Command: "page"} }, []string{"Alerts need MaxDrops, MaxDropPercent or MaxIndexAge"}},
+		{"two encryption keys", func(c *Config) { c.EncryptionKeyFile, c.EncryptionKeyCommand = "/etc/steno.key", "kms-wrap" }, []string{"only one of EncryptionKeyFile and EncryptionKeyCommand"}},
+		{"bad host", func(c *Config) { c.Host = "localhost" }, []string{`invalid listening location "localhost"`}},
+		// Every problem is found, not just the first.
+		{"several problems", func(c *Config) {
+			c.Threads[0].PacketsDirectory, c.LogFormat, c.Host = "", "xml", ""
+		}, []string{"No packet directory specified", `invalid log format "xml"`, `invalid listening location ""`}},
+	} {
+		c := valid()
+		c.Interface = "eth0"
+		test.modify(&c)
+		errs := c.Problems()
+		if len(errs) != len(test.want) {
+			t.Errorf("%v: got problems %v, want %d", test.desc, errs, len(test.want))
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), test.want[i]) {
+				t.Errorf("%v: got problem %q, want one containing %q", test.desc, err, test.want[i])
+			}
+		}
+		if err := c.Validate(); (err == nil) != (len(errs) == 0) || (err != nil && err.Error() != errs[0].Error()) {
+			t.Errorf("%v: Validate got %v, want the first problem", test.desc, err)
+		}
+	}
+}
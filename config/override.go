@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix starts the names of environment variables overriding config file
+// settings, like STENOGRAPHER_PORT for Port, or
+// STENOGRAPHER_THREADS_0_PACKETS_DIRECTORY for Threads[0].PacketsDirectory.
+const EnvPrefix = "STENOGRAPHER_"
+
+// FlagOverrides are settings like "Port=1234" or
+// "Threads.0.PacketsDirectory=/data", from command line flags, which
+// override both config files and environment variables.
+var FlagOverrides []string
+
+// envName returns the upper snake case form of a field name, as used in
+// environment variables:  "MaxOpenFiles" is "MAX_OPEN_FILES", and
+// "OIDCIssuer" is "OIDC_ISSUER".
+func envName(field string) string {
+	r := []rune(field)
+	var out []rune
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prevLower := unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1])
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if prevLower || (unicode.IsUpper(r[i-1]) && nextLower) {
+				out = append(out, '_')
+			}
+		}
+		out = append(out, unicode.ToUpper(c))
+	}
+	return string(out)
+}
+
+// envPath turns the rest of an environment variable's name after EnvPrefix
+// into the path of the setting it overrides in t, like
+// ["Threads", "0", "PacketsDirectory"].
+func envPath(t reflect.Type, name string) ([]string, bool) {
+	if name == "" {
+		return nil, true
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return envPath(t.Elem(), name)
+	case reflect.Slice:
+		i := strings.Index(name, "_")
+		if i < 0 {
+			i = len(name)
+		}
+		if _, err := strconv.Atoi(name[:i]); err != nil {
+			return nil, false
+		}
+		rest, ok := envPath(t.Elem(), strings.TrimPrefix(name[i:], "_"))
+		return append([]string{name[:i]}, rest...), ok
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			en := envName(f.Name)
+			if name != en && !strings.HasPrefix(name, en+"_") {
+				continue
+			}
+			if rest, ok := envPath(f.Type, strings.TrimPrefix(name[len(en):], "_")); ok {
+				return append([]string{f.Name}, rest...), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// set sets the setting at path in v, growing slices as needed, from value.
+func set(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		return setValue(v, value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if strings.EqualFold(v.Type().Field(i).Name, path[0]) {
+				return set(v.Field(i), path[1:], value)
+			}
+		}
+		return fmt.Errorf("no setting %q", path[0])
+	case reflect.Slice:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 {
+			return fmt.Errorf("invalid index %q", path[0])
+		}
+		if i >= v.Len() {
+			grown := reflect.MakeSlice(v.Type(), i+1, i+1)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		return set(v.Index(i), path[1:], value)
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return set(v.Elem(), path, value)
+	}
+	return fmt.Errorf("%q has no settings", path[0])
+}
+
+// setValue sets v from value:  strings as they are, numbers and booleans as
+// they're written, lists of strings as comma separated lists, and anything
+// else (or any value starting with "[" or "{") as JSON.
+func setValue(v reflect.Value, value string) error {
+	if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") {
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setValue(v.Elem(), value)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(value), v.Addr().Interface())
+		}
+		var parts []string
+		if value != "" {
+			parts = strings.Split(value, ",")
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
+
+// applyOverrides overrides c's settings with the STENOGRAPHER_* variables in
+// environ, then with FlagOverrides.
+func applyOverrides(c *Config, environ []string) error {
+	var vars []string
+	for _, kv := range environ {
+		// STENOGRAPHER_CONFIG tells stenocurl where the config is, rather
+		// than overriding a setting.
+		if strings.HasPrefix(kv, EnvPrefix) && !strings.HasPrefix(kv, EnvPrefix+"CONFIG=") {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars) // So the same environment always has the same result.
+	for _, kv := range vars {
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		path, ok := envPath(reflect.TypeOf(*c), strings.TrimPrefix(name, EnvPrefix))
+		if !ok || len(path) == 0 {
+			return fmt.Errorf("environment variable %v isn't a setting", name)
+		}
+		if err := set(reflect.ValueOf(c).Elem(), path, value); err != nil {
+			return fmt.Errorf("environment variable %v: %v", name, err)
+		}
+	}
+	for _, o := range FlagOverrides {
+		i := strings.Index(o, "=")
+		if i < 0 {
+			return fmt.Errorf("override %q isn't SETTING=VALUE", o)
+		}
+		if err := set(reflect.ValueOf(c).Elem(), strings.Split(o[:i], "."), o[i+1:]); err != nil {
+			return fmt.Errorf("override %q: %v", o, err)
+		}
+	}
+	return nil
+}
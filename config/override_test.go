@@ -0,0 +1,255 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for field, want := range map[string]string{
+		"Port":               "PORT",
+		"MaxOpenFiles":       "MAX_OPEN_FILES",
+		"PacketsDirectory":   "PACKETS_DIRECTORY",
+		"OIDCIssuer":         "OIDC_ISSUER",
+		"SPIFFEWorkloadAPI":  "SPIFFE_WORKLOAD_API",
+		"ACMEDirectoryURL":   "ACME_DIRECTORY_URL",
+		"RPCPort":            "RPC_PORT",
+		"CompressCPUPercent": "COMPRESS_CPU_PERCENT",
+		"CPU":                "CPU",
+		"SHA256":             "SHA256",
+		"MmapIndexMaxBytes":  "MMAP_INDEX_MAX_BYTES",
+	} {
+		if got := envName(field); got != want {
+			t.Errorf("envName(%q) got %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestEnvPath(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want []string // nil if it's not a setting.
+	}{
+		{"PORT", []string{"Port"}},
+		{"MAX_OPEN_FILES", []string{"MaxOpenFiles"}},
+		{"OIDC_CLIENT_ID", []string{"OIDCClientID"}},
+		{"FLAGS", []string{"Flags"}},
+		{"THREADS", []string{"Threads"}},
+		{"THREADS_0", []string{"Threads", "0"}},
+		{"THREADS_0_PACKETS_DIRECTORY", []string{"Threads", "0", "PacketsDirectory"}},
+		{"THREADS_12_CPU", []string{"Threads", "12", "CPU"}},
+		{"THREADS_1_EXTRA_DIRECTORIES_2_INDEX_DIRECTORY", []string{"Threads", "1", "ExtraDirectories", "2", "IndexDirectory"}},
+		{"THREADS_0_PINNED_WINDOWS", []string{"Threads", "0", "PinnedWindows"}},
+		{"API_TOKENS_0_SHA256", []string{"APITokens", "0", "SHA256"}},
+		{"ALERTS_MAX_DROP_PERCENT", []string{"Alerts", "MaxDropPercent"}},
+		{"LOG_VERBOSITY", []string{"LogVerbosity"}},
+		// Settings whose names start with others'.
+		{"MMAP_INDEXES", []string{"MmapIndexes"}},
+		{"MMAP_INDEX_MAX_BYTES", []string{"MmapIndexMaxBytes"}},
+		{"PROT", nil},
+		{"PORTS", nil},
+		{"PORT_1", nil},
+		{"MAX_AGE", nil}, // A thread's setting.
+		{"THREADS_X_MAX_AGE", nil},
+		{"THREADS_0_MAXAGE", nil},
+		{"ALERTS_WEBHOK", nil},
+		{"port", nil},
+	} {
+		got, ok := envPath(reflect.TypeOf(Config{}), test.name)
+		if ok != (test.want != nil) || (ok && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("envPath(%q) got %q, %v; want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	defer func(old []string) { FlagOverrides = old }(FlagOverrides)
+	three := 3
+	for _, test := range []struct {
+		desc    string
+		environ []string
+		flags   []string
+		want    func(c *Config) // Changes from the file's config.
+		wantErr string          // In the error, if there is one.
+	}{
+		{
+			desc:    "nothing set",
+			environ: []string{"PATH=/usr/bin", "HOME=/root"},
+			want:    func(c *Config) {},
+		},
+		{
+			desc: "top level settings",
+			environ: []string{
+				"STENOGRAPHER_PORT=1234",
+				"STENOGRAPHER_HOST=0.0.0.0",
+				"STENOGRAPHER_READ_ONLY=true",
+				"STENOGRAPHER_FLAGS=-v,--blocks=4096",
+				"STENOGRAPHER_MAX_PAYLOAD_SCAN_BYTES=5000000000",
+				"STENOGRAPHER_LOG_VERBOSITY=3",
+			},
+			want: func(c *Config) {
+				c.Port, c.Host, c.ReadOnly = 1234, "0.0.0.0", true
+				c.Flags = []string{"-v", "--blocks=4096"}
+				c.MaxPayloadScanBytes = 5000000000
+				c.LogVerbosity = &three
+			},
+		},
+		{
+			desc:    "empty list",
+			environ: []string{"STENOGRAPHER_FLAGS="},
+			want:    func(c *Config) { c.Flags = nil },
+		},
+		{
+			desc: "nested settings",
+			environ: []string{
+				"STENOGRAPHER_THREADS_0_MAX_AGE=720h",
+				"STENOGRAPHER_THREADS_0_CPU=3",
+				"STENOGRAPHER_THREADS_0_PINNED_WINDOWS=Mon-Fri 08:00-18:00,Sat 10:00-12:00",
+				"STENOGRAPHER_ALERTS_MAX_DROPS=10",
+				"STENOGRAPHER_ALERTS_COMMAND=page-oncall",
+			},
+			want: func(c *Config) {
+				c.Threads[0].MaxAge, c.Threads[0].CPU = "720h", &three
+				c.Threads[0].PinnedWindows = []string{"Mon-Fri 08:00-18:00", "Sat 10:00-12:00"}
+				c.Alerts = &AlertConfig{MaxDrops: 10, Command: "page-oncall"}
+			},
+		},
+		{
+			desc: "new slice elements",
+			environ: []string{
+				"STENOGRAPHER_THREADS_1_PACKETS_DIRECTORY=/pkt1",
+				"STENOGRAPHER_THREADS_1_INDEX_DIRECTORY=/idx1",
+				"STENOGRAPHER_THREADS_0_EXTRA_DIRECTORIES_0_PACKETS_DIRECTORY=/pkt0b",
+			},
+			want: func(c *Config) {
+				c.Threads[0].ExtraDirectories = []ThreadDirectories{{PacketsDirectory: "/pkt0b"}}
+				c.Threads = append(c.Threads, ThreadConfig{PacketsDirectory: "/pkt1", IndexDirectory: "/idx1"})
+			},
+		},
+		{
+			desc: "JSON values",
+			environ: []string{
+				`STENOGRAPHER_API_TOKENS=[{"Subject": "splunk", "SHA256": "ab"}]`,
+				`STENOGRAPHER_ALERTS={"Webhook": "https://alerts.example.com/"}`,
+			},
+			want: func(c *Config) {
+				c.APITokens = []APIToken{{Subject: "splunk", SHA256: "ab"}}
+				c.Alerts = &AlertConfig{Webhook: "https://alerts.example.com/"}
+			},
+		},
+		{
+			// Whole settings are set before their parts, whatever the order
+			// of the environment.
+			desc: "whole and part",
+			environ: []string{
+				"STENOGRAPHER_THREADS_0_MAX_AGE=1h",
+				`STENOGRAPHER_THREADS=[{"PacketsDirectory": "/new", "IndexDirectory": "/newidx"}]`,
+			},
+			want: func(c *Config) {
+				c.Threads = []ThreadConfig{{PacketsDirectory: "/new", IndexDirectory: "/newidx", MaxAge: "1h"}}
+			},
+		},
+		{
+			desc:    "config path",
+			environ: []string{"STENOGRAPHER_CONFIG=/etc/stenographer/config"},
+			want:    func(c *Config) {},
+		},
+		{
+			desc:    "flags override environment",
+			environ: []string{"STENOGRAPHER_PORT=1234", "STENOGRAPHER_THREADS_0_MAX_AGE=1h"},
+			flags:   []string{"Port=5678", "threads.0.maxage=2h", "Threads.1.PacketsDirectory=/pkt1", "Flags=-v"},
+			want: func(c *Config) {
+				c.Port, c.Threads[0].MaxAge, c.Flags = 5678, "2h", []string{"-v"}
+				c.Threads = append(c.Threads, ThreadConfig{PacketsDirectory: "/pkt1"})
+			},
+		},
+		{
+			desc:  "later flags win",
+			flags: []string{"Port=5678", "Port=9012"},
+			want:  func(c *Config) { c.Port = 9012 },
+		},
+		{desc: "unknown variable", environ: []string{"STENOGRAPHER_PROT=1234"}, wantErr: "environment variable STENOGRAPHER_PROT isn't a setting"},
+		{desc: "unknown nested variable", environ: []string{"STENOGRAPHER_THREADS_0_MAXAGE=1h"}, wantErr: "STENOGRAPHER_THREADS_0_MAXAGE isn't a setting"},
+		{desc: "variable without value", environ: []string{"STENOGRAPHER_"}, wantErr: "STENOGRAPHER_ isn't a setting"},
+		{desc: "bad number", environ: []string{"STENOGRAPHER_PORT=http"}, wantErr: "environment variable STENOGRAPHER_PORT"},
+		{desc: "bad boolean", environ: []string{"STENOGRAPHER_READ_ONLY=sometimes"}, wantErr: "environment variable STENOGRAPHER_READ_ONLY"},
+		{desc: "bad JSON", environ: []string{"STENOGRAPHER_THREADS=[{"}, wantErr: "environment variable STENOGRAPHER_THREADS"},
+		{desc: "unknown flag setting", flags: []string{"Prot=1234"}, wantErr: `override "Prot=1234": no setting "Prot"`},
+		{desc: "flag without value", flags: []string{"Port"}, wantErr: `override "Port" isn't SETTING=VALUE`},
+		{desc: "bad flag index", flags: []string{"Threads.-1.CPU=1"}, wantErr: `invalid index "-1"`},
+		{desc: "flag below a value", flags: []string{"Port.Number=1"}, wantErr: `"Number" has no settings`},
+	} {
+		c := Config{Port: 1, Flags: []string{"--seccomp=none"}, Threads: []ThreadConfig{{PacketsDirectory: "/pkt0", IndexDirectory: "/idx0"}}}
+		want := c
+		want.Threads = append([]ThreadConfig(nil), c.Threads...)
+		FlagOverrides = test.flags
+		err := applyOverrides(&c, test.environ)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%v: got error %v, want one containing %q", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.desc, err)
+			continue
+		}
+		test.want(&want)
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%v: got %+v, want %+v", test.desc, c, want)
+		}
+	}
+}
+
+func TestReadConfigFileOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, "steno.yaml", "Port: 1\nHost: 127.0.0.1\nMaxOpenFiles: 10\n")
+	defer os.Unsetenv("STENOGRAPHER_PORT")
+	defer os.Unsetenv("STENOGRAPHER_MAX_OPEN_FILES")
+	defer func(old []string) { FlagOverrides = old }(FlagOverrides)
+	os.Setenv("STENOGRAPHER_PORT", "2")
+	os.Setenv("STENOGRAPHER_MAX_OPEN_FILES", "0") // Then the default.
+	for _, test := range []struct {
+		flags []string
+		want  int
+	}{
+		{nil, 2},
+		{[]string{"Port=3"}, 3},
+	} {
+		FlagOverrides = test.flags
+		c, err := ReadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Port != test.want || c.Host != "127.0.0.1" || c.MaxOpenFiles != defaultMaxOpenFiles {
+			t.Errorf("with flags %q got Port %d, Host %q, MaxOpenFiles %d; want %d, 127.0.0.1, %d", test.flags, c.Port, c.Host, c.MaxOpenFiles, test.want, defaultMaxOpenFiles)
+		}
+	}
+
+	os.Setenv("STENOGRAPHER_PROT", "2")
+	defer os.Unsetenv("STENOGRAPHER_PROT")
+	if _, err := ReadConfigFile(path); err == nil || !strings.Contains(err.Error(), "STENOGRAPHER_PROT") {
+		t.Errorf("with STENOGRAPHER_PROT set got %v, want it rejected", err)
+	}
+}
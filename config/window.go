@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a weekly period of time, like business hours.
+type Window struct {
+	days       [7]bool
+	start, end time.Duration // Since midnight.
+}
+
+// ParseWindow parses a window like "Mon-Fri 08:00-18:00".  Days are a comma
+// separated list of days or day ranges, and may be left off to mean every
+// day.  A window whose end is before its start runs past midnight, and belongs
+// to the day it starts on.
+func ParseWindow(s string) (*Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, r := range strings.Split(fields[0], ",") {
+			from, to := r, r
+			if i := strings.Index(r, "-"); i >= 0 {
+				from, to = r[:i], r[i+1:]
+			}
+			first, ok := weekdays[strings.ToLower(from)]
+			last, ok2 := weekdays[strings.ToLower(to)]
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("invalid days %q in window %q", r, s)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid window %q, want days and hours like \"Mon-Fri 08:00-18:00\"", s)
+	}
+	hours := strings.Split(fields[len(fields)-1], "-")
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("invalid hours in window %q", s)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	if w.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid window %q: empty", s)
+	}
+	return &w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 {
+		return 0, fmt.Errorf("time of day %q isn't HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("time of day %q out of range", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Contains returns whether t, in its own location, falls in the window.
+func (w *Window) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	if w.start < w.end {
+		return w.days[t.Weekday()] && since >= w.start && since < w.end
+	}
+	// The window runs past midnight, so may have started today or yesterday.
+	return (w.days[t.Weekday()] && since >= w.start) ||
+		(w.days[(t.Weekday()+6)%7] && since < w.end)
+}
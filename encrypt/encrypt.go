@@ -0,0 +1,348 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encrypt encrypts stenographer's packet and index files at rest,
+// and reads them back.
+//
+// Each file is encrypted with AES-256-GCM under its own random key, which is
+// stored in the file's header, wrapped by a KeyWrapper.  The file is split
+// into chunks which are sealed separately, so any part of it can be read
+// without decrypting the rest.  An encrypted file is laid out as:
+//
+//	magic:    "STENOE\x00\x01"
+//	header:   chunk size (uint32), length of the KeyWrapper's name (uint8),
+//	          the name, length of the wrapped key (uint16), the wrapped key
+//	chunks:   each chunk of plaintext, sealed
+//
+// All integers are big endian.  Chunks are sealed with a nonce of their
+// index, and the whole header plus a byte saying whether they're the last
+// chunk as additional data, so they can't be reordered, truncated, or moved
+// between files.  Every chunk but the last holds exactly chunk size bytes of
+// plaintext.
+package encrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+var v = base.V // Verbose logging
+
+var magic = []byte("STENOE\x00\x01")
+
+const (
+	fileKeyBytes = 32
+	tagBytes     = 16 // Added to each chunk by GCM.
+	// maxHeaderBytes is more than any header should need, so a corrupt
+	// header can't make readers allocate much.
+	maxHeaderBytes = 1 << 16
+	maxChunkBytes  = 1 << 26
+)
+
+var (
+	chunksDecrypted = stats.S.Get("encrypt_chunks_decrypted")
+	decryptNanos    = stats.S.Get("encrypt_decrypt_nanos")
+)
+
+// chunkNonce returns the nonce for the given chunk.  Keys are only ever used
+// for one file, so chunk indexes are unique nonces.
+func chunkNonce(aead cipher.AEAD, chunk int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(chunk))
+	return nonce
+}
+
+func chunkAdditionalData(header []byte, last bool) []byte {
+	if last {
+		return append(header[:len(header):len(header)], 1)
+	}
+	return append(header[:len(header):len(header)], 0)
+}
+
+// IsEncrypted returns whether the file read by r is encrypted.
+func IsEncrypted(r io.ReaderAt) (bool, error) {
+	var m [8]byte
+	if _, err := r.ReadAt(m[:], 0); err == io.EOF {
+		return false, nil // Too short to be encrypted.
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(m[:], magic), nil
+}
+
+// Reader reads the plaintext of an encrypted file.  It keeps the last chunk
+// it decrypted, since files are mostly read in order.
+type Reader struct {
+	r         io.ReaderAt
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int64
+	chunks    int64
+	size      int64 // Of the plaintext.
+
+	mu     sync.Mutex
+	cached int64 // Index of the chunk in buf, or -1.
+	buf    []byte
+	sealed []byte
+}
+
+// NewReader returns a Reader of the encrypted file in r, which is size bytes
+// long.  The file's key is unwrapped with Keys.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	header := make([]byte, len(magic)+4+1)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %v", err)
+	} else if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errors.New("file isn't encrypted")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(magic):]))
+	nameLen := int(header[len(header)-1])
+	rest := make([]byte, nameLen+2)
+	if _, err := r.ReadAt(rest, int64(len(header))); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %v", err)
+	}
+	name := string(rest[:nameLen])
+	keyLen := int(binary.BigEndian.Uint16(rest[nameLen:]))
+	header = append(header, rest...)
+	wrapped := make([]byte, keyLen)
+	if _, err := r.ReadAt(wrapped, int64(len(header))); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %v", err)
+	}
+	header = append(header, wrapped...)
+	if chunkSize <= 0 || chunkSize > maxChunkBytes || len(header) > maxHeaderBytes || size < int64(len(header))+tagBytes {
+		return nil, errors.New("invalid encryption header")
+	}
+	aead, err := fileCipher(name, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	body := size - int64(len(header))
+	sealedChunk := chunkSize + tagBytes
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	last := body - (chunks-1)*sealedChunk - tagBytes
+	if last < 0 {
+		return nil, errors.New("encrypted file truncated")
+	}
+	return &Reader{
+		r:         r,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      (chunks-1)*chunkSize + last,
+		cached:    -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// chunkLocked makes r.buf the plaintext of chunk n.  r.mu must be held.
+func (r *Reader) chunkLocked(n int64) error {
+	if r.cached == n {
+		return nil
+	}
+	defer decryptNanos.NanoTimer()()
+	chunksDecrypted.Increment()
+	r.cached = -1
+	length := r.chunkSize
+	if n == r.chunks-1 {
+		length = r.size - n*r.chunkSize
+	}
+	start := int64(len(r.header)) + n*(r.chunkSize+tagBytes)
+	if int64(cap(r.sealed)) < length+tagBytes {
+		r.sealed = make([]byte, length+tagBytes)
+	}
+	r.sealed = r.sealed[:length+tagBytes]
+	if _, err := r.r.ReadAt(r.sealed, start); err != nil && err != io.EOF {
+		return fmt.Errorf("reading encrypted chunk %d: %v", n, err)
+	}
+	var err error
+	r.buf, err = r.aead.Open(r.buf[:0], chunkNonce(r.aead, n), r.sealed, chunkAdditionalData(r.header, n == r.chunks-1))
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %v", n, err)
+	}
+	r.cached = n
+	return nil
+}
+
+// ReadAt reads from the plaintext, like os.File.ReadAt.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		if err := r.chunkLocked(off / r.chunkSize); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], r.buf[off%r.chunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// MaybeDecrypt returns a reader of the plaintext of the file in r, which is
+// size bytes long, and the plaintext's size.  If the file isn't encrypted,
+// that's r itself.
+func MaybeDecrypt(r io.ReaderAt, size int64) (io.ReaderAt, int64, error) {
+	if encrypted, err := IsEncrypted(r); err != nil {
+		return nil, 0, err
+	} else if !encrypted {
+		return r, size, nil
+	}
+	d, err := NewReader(r, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, d.size, nil
+}
+
+// Writer encrypts what's written to it.  It must be closed to write out the
+// last chunk.
+type Writer struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	chunks    int64
+	buf       []byte
+	sealed    []byte
+}
+
+// NewWriter returns a Writer encrypting to w with a new random key, wrapped
+// with Keys, in chunks of the given size.  Readers decrypt a whole chunk at
+// a time, so it should be around the size of their usual reads.
+func NewWriter(w io.Writer, chunkSize int) (*Writer, error) {
+	keys := Keys
+	if keys == nil {
+		return nil, errors.New("no encryption key configured")
+	} else if chunkSize <= 0 || chunkSize > maxChunkBytes {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	key := make([]byte, fileKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := keys.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	name := keys.Name()
+	header := append([]byte{}, magic...)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(chunkSize))
+	header = append(header, buf[:]...)
+	header = append(header, byte(len(name)))
+	header = append(header, name...)
+	binary.BigEndian.PutUint16(buf[:], uint16(len(wrapped)))
+	header = append(header, buf[:2]...)
+	header = append(header, wrapped...)
+	if len(name) > 255 || len(wrapped) > 65535 || len(header) > maxHeaderBytes {
+		return nil, errors.New("wrapped key too long")
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, header: header, chunkSize: chunkSize, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// writeChunk seals and writes out the buffered chunk.
+func (w *Writer) writeChunk(last bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], chunkNonce(w.aead, w.chunks), w.buf, chunkAdditionalData(w.header, last))
+	w.chunks++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// Chunks are only written once more data arrives, since the last
+		// chunk is sealed differently.
+		if len(w.buf) == w.chunkSize {
+			if err := w.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// Close writes out the last chunk.  It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	return w.writeChunk(true)
+}
+
+// EncryptFile writes an encrypted copy of the file src to dst, which it
+// creates, in chunks of the given size.
+func EncryptFile(src, dst string, chunkSize int) (returnedErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if encrypted, err := IsEncrypted(in); err != nil {
+		return err
+	} else if encrypted {
+		return fmt.Errorf("%q is already encrypted", src)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); returnedErr == nil {
+			returnedErr = err
+		}
+	}()
+	w, err := NewWriter(out, chunkSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	v(2, "encrypted %q to %q", src, dst)
+	return out.Sync()
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(t *testing.T) KeyWrapper {
+	k, err := NewMasterKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encrypted(t *testing.T, plaintext []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes, to cross chunk boundaries mid-write.
+	for p := plaintext; len(p) > 0; {
+		n := 37
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	defer func(old KeyWrapper) { Keys = old }(Keys)
+	Keys = testKeys(t)
+	const chunk = 100
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3*chunk + 50} {
+		plaintext := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(plaintext)
+		sealed := encrypted(t, plaintext, chunk)
+		if bytes.Contains(sealed, plaintext[:size/2]) && size > 10 {
+			t.Errorf("size %d: plaintext visible in file", size)
+		}
+		r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Errorf("size %d: got plaintext size %d", size, r.Size())
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()+10))
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+		} else if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: got different plaintext back", size)
+		}
+		if size > chunk+10 {
+			buf := make([]byte, 20)
+			if _, err := r.ReadAt(buf, chunk-10); err != nil || !bytes.Equal(buf, plaintext[chunk-10:chunk+10]) {
+				t.Errorf("size %d: reading across chunks got %v, %v", size, buf, err)
+			}
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	defer func(old KeyWrapper) { Keys = old }(Keys)
+	Keys = testKeys(t)
+	const chunk = 100
+	plaintext := bytes.Repeat([]byte("stenographer"), 50)
+	sealed := encrypted(t, plaintext, chunk)
+	readAll := func(sealed []byte) error {
+		r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)))
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		return err
+	}
+	if err := readAll(sealed); err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-200] ^= 1
+	if err := readAll(flipped); err == nil {
+		t.Errorf("read modified file")
+	}
+	if err := readAll(sealed[:len(sealed)-chunk-tagBytes]); err == nil {
+		t.Errorf("read file missing its last chunk")
+	}
+	Keys, _ = NewMasterKey(bytes.Repeat([]byte{8}, 32))
+	if err := readAll(sealed); err == nil {
+		t.Errorf("read file with the wrong master key")
+	}
+	Keys = nil
+	if err := readAll(sealed); err == nil {
+		t.Errorf("read file with no keys")
+	}
+}
+
+func TestCommandWrapper(t *testing.T) {
+	defer func(old KeyWrapper) { Keys = old }(Keys)
+	dir, err := ioutil.TempDir("", "encrypt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A "KMS" which swaps the digits 0-4 and 5-9, and checks its arguments.
+	script := filepath.Join(dir, "kms")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = --flag ] || exit 1\nexec tr 0-9 5-90-4\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if Keys, err = NewCommandWrapper(script + " --flag"); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789")
+	wrapped, err := Keys.WrapKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(wrapped) != "5678901234" {
+		t.Errorf("got wrapped key %q", wrapped)
+	}
+	if got, err := Keys.UnwrapKey(wrapped); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("unwrapped key %q, %v", got, err)
+	}
+}
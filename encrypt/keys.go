@@ -0,0 +1,199 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// KeyWrapper encrypts the per-file keys files are encrypted with, so they can
+// be stored alongside the files they protect.  Implementations may keep
+// their master key in memory, or hand keys to a KMS to wrap.
+type KeyWrapper interface {
+	// Name identifies how keys were wrapped, and is stored in each file, so
+	// files wrapped some other way can be reported as such.
+	Name() string
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// Keys wraps the keys of files this process encrypts, and unwraps those of
+// files it reads.  If nil, files aren't encrypted, and encrypted files can't
+// be read.
+var Keys KeyWrapper
+
+// masterKey wraps keys with AES-GCM under a single master key.
+type masterKey struct {
+	aead cipher.AEAD
+}
+
+// NewMasterKey returns a KeyWrapper which wraps keys with AES-GCM, using the
+// given 16, 24, or 32 byte master key.
+func NewMasterKey(key []byte) (KeyWrapper, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKey{aead}, nil
+}
+
+// ReadMasterKeyFile reads a hex encoded master key from a file, and returns
+// a KeyWrapper using it.
+func ReadMasterKeyFile(filename string) (KeyWrapper, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("master key file %q isn't hex: %v", filename, err)
+	}
+	return NewMasterKey(key)
+}
+
+func (m *masterKey) Name() string { return "master" }
+
+// WrapKey returns a random nonce, followed by the sealed key.
+func (m *masterKey) WrapKey(key []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (m *masterKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < m.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	n := m.aead.NonceSize()
+	key, err := m.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping key (wrong master key?): %v", err)
+	}
+	return key, nil
+}
+
+// commandWrapper wraps keys by running a command, usually a client of some
+// KMS.
+type commandWrapper struct {
+	path string
+	args []string
+}
+
+// NewCommandWrapper returns a KeyWrapper which runs a command to wrap and
+// unwrap keys, so master keys can stay in a KMS.  The command is split on
+// spaces, and run with an extra "wrap" or "unwrap" argument.  It's given
+// the key to wrap or unwrap on stdin, and must write the result to stdout.
+func NewCommandWrapper(command string) (KeyWrapper, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty key command")
+	}
+	return &commandWrapper{fields[0], fields[1:]}, nil
+}
+
+func (c *commandWrapper) Name() string { return "command" }
+
+func (c *commandWrapper) run(op string, in []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.path, append(c.args, op)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(in), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("key command %q %s failed: %v: %s", c.path, op, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (c *commandWrapper) WrapKey(key []byte) ([]byte, error) {
+	return c.run("wrap", key)
+}
+
+func (c *commandWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return c.run("unwrap", wrapped)
+}
+
+// maxCachedKeys limits how many unwrapped keys are cached.  It's far more
+// than the files a sensor usually has, so the cache rarely needs clearing.
+const maxCachedKeys = 1 << 18
+
+// cachedKey identifies a wrapped key, and what it was unwrapped with.
+type cachedKey struct {
+	keys    KeyWrapper
+	wrapped string
+}
+
+// keyCache holds the ciphers of unwrapped file keys, so reopening a file
+// doesn't need another round trip to a KMS.
+var keyCache = struct {
+	sync.Mutex
+	aeads map[cachedKey]cipher.AEAD
+}{aeads: map[cachedKey]cipher.AEAD{}}
+
+// fileCipher returns the cipher for a file key, unwrapping it with Keys.
+func fileCipher(wrapper string, wrapped []byte) (cipher.AEAD, error) {
+	keys := Keys
+	if keys == nil {
+		return nil, errors.New("file is encrypted, but no encryption key is configured")
+	} else if wrapper != keys.Name() {
+		return nil, fmt.Errorf("file key was wrapped by %q, but %q is configured", wrapper, keys.Name())
+	}
+	cached := cachedKey{keys, string(wrapped)}
+	keyCache.Lock()
+	aead := keyCache.aeads[cached]
+	keyCache.Unlock()
+	if aead != nil {
+		return aead, nil
+	}
+	key, err := keys.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newFileCipher(key); err != nil {
+		return nil, err
+	}
+	keyCache.Lock()
+	if len(keyCache.aeads) >= maxCachedKeys {
+		keyCache.aeads = map[cachedKey]cipher.AEAD{}
+	}
+	keyCache.aeads[cached] = aead
+	keyCache.Unlock()
+	return aead, nil
+}
+
+func newFileCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != fileKeyBytes {
+		return nil, fmt.Errorf("file key is %d bytes, want %d", len(key), fileKeyBytes)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+)
+
+// maxCertBodyBytes limits the PEM a client may send to /admin/certs.
+const maxCertBodyBytes = 1 << 20
+
+// indexVerification is the result of checking one thread's indexes.
+type indexVerification struct {
+	Thread      int
+	Verified    int      // Indexes checked.
+	Quarantined []string `json:",omitempty"` // Files found corrupt.
+}
+
+// handleAdmin serves the management operations, which only clients
+// authorized to query every packet may use:  POST /admin/reload rereads the
+// config file, POST /admin/certs reloads the certs (installing the server
+// cert and key in the body first, if any), and POST /admin/verify checks
+// every index for corruption.
+func (e *Env) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if !grant.Unrestricted() {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "management needs access to every packet"})
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/admin/") {
+	case "reload":
+		if e.configFile == "" {
+			http.Error(w, "config file unknown", http.StatusConflict)
+			return
+		}
+		if err := e.reloadConfig(e.configFile, fmt.Sprintf("reload by %v", httputil.Identity(r))); err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_config", Message: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "certs":
+		e.rotateCerts(w, r)
+	case "verify":
+		var out []indexVerification
+		for i, t := range e.threads {
+			verified, quarantined := t.VerifyIndexes(r.Context())
+			if r.Context().Err() != nil {
+				return
+			}
+			out = append(out, indexVerification{Thread: i, Verified: verified, Quarantined: quarantined})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// rotateCerts installs the server cert and key PEM in r's body in CertPath,
+// if there is any, then reloads the certs from CertPath.
+func (e *Env) rotateCerts(w http.ResponseWriter, r *http.Request) {
+	if e.certs == nil {
+		http.Error(w, "certs come from SPIFFE", http.StatusConflict)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCertBodyBytes))
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if len(e.conf.ACMEDomains) > 0 {
+			http.Error(w, "the server cert comes from ACME", http.StatusConflict)
+			return
+		}
+		if err := installServerCert(e.conf.CertPath, body); err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_cert", Message: err.Error()})
+			return
+		}
+	}
+	if err := e.certs.Reload(); err != nil {
+		log.Printf("keeping previous certs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Certs reloaded by %v", httputil.Identity(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// installServerCert writes the certificate and private key in pemBytes to
+// dir's server cert and key files, after checking they're a valid pair.  Each
+// file is replaced by a rename, so a reload never sees half of one.
+func installServerCert(dir string, pemBytes []byte) error {
+	var certPEM, keyPEM []byte
+	for rest := pemBytes; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return errors.New("need a PEM certificate and private key")
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		pem  []byte
+	}{{serverKeyFilename, keyPEM}, {serverCertFilename, certPEM}} {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path+".tmp", f.pem, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
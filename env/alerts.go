@@ -0,0 +1,89 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/alert"
+	"../alert"
+	//"github.com/google/stenographer/config"
+	"../config"
+	"golang.org/x/net/context"
+)
+
+const (
+	// alertFrequency is how often threads are checked against alert limits.
+	alertFrequency = 30 * time.Second
+	// alertTimeout limits how long sending each check's alerts may take.
+	alertTimeout = 30 * time.Second
+	// defaultDropWindow is used if Alerts have no DropWindow.
+	defaultDropWindow = 5 * time.Minute
+)
+
+// setUpAlerts has d check its threads against c.Alerts' limits, if
+// configured.
+func (d *Env) setUpAlerts(c config.Config) error {
+	a := c.Alerts
+	if a == nil {
+		return nil
+	}
+	var notifiers alert.Notifiers
+	if a.Webhook != "" {
+		notifiers = append(notifiers, alert.NewWebhook(a.Webhook, &http.Client{Timeout: alertTimeout}))
+	}
+	if a.Command != "" {
+		n, err := alert.NewCommand(a.Command)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
+	}
+	l := alert.Limits{DropWindow: defaultDropWindow, MaxDrops: a.MaxDrops, MaxDropPercent: a.MaxDropPercent}
+	// Durations were checked by Validate.
+	if a.DropWindow != "" {
+		l.DropWindow, _ = time.ParseDuration(a.DropWindow)
+	}
+	if a.MaxIndexAge != "" {
+		l.MaxIndexAge, _ = time.ParseDuration(a.MaxIndexAge)
+	}
+	d.alerts = alert.NewMonitor(l, notifiers)
+	go d.callEvery(d.checkAlerts, alertFrequency)
+	return nil
+}
+
+// checkAlerts checks each thread's drops, as of its stenotype's last stats
+// line, and its newest file against the alert limits.
+func (d *Env) checkAlerts() {
+	now := time.Now()
+	samples := make([]alert.Sample, len(d.threads))
+	for i, t := range d.threads {
+		id := strconv.Itoa(i)
+		samples[i] = alert.Sample{
+			Thread:  i,
+			Packets: captureStat(id, "packets").Value(),
+			Drops:   captureStat(id, "drops").Value(),
+			Newest:  t.Usage().Newest,
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	if err := d.alerts.Check(ctx, now, samples); err != nil {
+		log.Printf("could not send alert, will retry: %v", err)
+	}
+}
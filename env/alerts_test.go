@@ -0,0 +1,123 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/alert"
+	"../alert"
+	//"github.com/google/stenographer/config"
+	"../config"
+	"golang.org/x/net/context"
+)
+
+// alertRecorder records the alerts it's notified of, failing while err is
+// set.
+type alertRecorder struct {
+	alerts []alert.Alert
+	err    error
+}
+
+func (r *alertRecorder) Notify(ctx context.Context, a alert.Alert) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+// firing returns the names of the alerts r was notified of, with whether
+// they were firing, and forgets them.
+func (r *alertRecorder) firing() map[string]bool {
+	out := map[string]bool{}
+	for _, a := range r.alerts {
+		out[a.Name] = a.Firing
+	}
+	r.alerts = nil
+	return out
+}
+
+func TestCheckAlerts(t *testing.T) {
+	e, cleanup := retentionEnv(t, 10, []time.Time{time.Now().Add(-time.Hour)})
+	defer cleanup()
+	r := &alertRecorder{}
+	e.alerts = alert.NewMonitor(alert.Limits{DropWindow: time.Hour, MaxDrops: 10, MaxIndexAge: 10 * time.Minute}, r)
+	packets, drops := captureStat("0", "packets"), captureStat("0", "drops")
+
+	for _, test := range []struct {
+		desc           string
+		packets, drops int64
+		err            error
+		want           map[string]bool
+	}{
+		// The thread's only file is an hour old.
+		{"first check", 1000, 5, nil, map[string]bool{alert.StaleIndex: true}},
+		{"few drops", 2000, 10, nil, map[string]bool{}},
+		// Failed notifications are retried at the next check.
+		{"many drops, notifying fails", 3000, 100, errors.New("pager down"), map[string]bool{}},
+		{"retried", 3000, 100, nil, map[string]bool{alert.Drops: true}},
+		{"still dropping", 4000, 100, nil, map[string]bool{}},
+	} {
+		packets.Set(test.packets)
+		drops.Set(test.drops)
+		r.err = test.err
+		e.checkAlerts()
+		if got := r.firing(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got alerts %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestSetUpAlerts(t *testing.T) {
+	e, cleanup := retentionEnv(t, 10, []time.Time{time.Now().Add(-time.Hour)})
+	defer cleanup()
+	if err := e.setUpAlerts(config.Config{}); err != nil || e.alerts != nil {
+		t.Fatalf("without alerts got monitor %v, error %v; want neither", e.alerts, err)
+	}
+	if err := e.setUpAlerts(config.Config{Alerts: &config.AlertConfig{Command: " ", MaxIndexAge: "10m"}}); err == nil {
+		t.Errorf("empty alert command succeeded")
+	}
+
+	got := make(chan alert.Alert, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert.Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("decoding alert: %v", err)
+		}
+		got <- a
+	}))
+	defer server.Close()
+	e.done = make(chan bool)
+	defer close(e.done)
+	if err := e.setUpAlerts(config.Config{Alerts: &config.AlertConfig{Webhook: server.URL, MaxIndexAge: "10m"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Threads are checked as soon as alerts are set up.
+	select {
+	case a := <-got:
+		if a.Name != alert.StaleIndex || !a.Firing || a.Thread != 0 {
+			t.Errorf("got alert %+v, want thread 0's stale index firing", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no alert sent for a stale index")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+)
+
+// debugPacketsPath matches the per-thread debug handlers returning a
+// blockfile's packets.
+var debugPacketsPath = regexp.MustCompile(`^/debug/t\d+/packets$`)
+
+// recordRetrieval adds a packet retrieval, which failed with err if it's not
+// nil, to the audit log, if there is one.  Failing to is logged as an alert,
+// since the retrieval's already been served.
+func (e *Env) recordRetrieval(rec audit.Record, err error) {
+	if e.auditLog == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if err := e.auditLog.Add(rec); err != nil {
+		log.Printf("ALERT: could not audit query %d by %q: %v", rec.QueryID, rec.Client, err)
+	}
+}
+
+// auditedWriter is an http.ResponseWriter counting and hashing the response
+// written through it.
+type auditedWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	hash   hash.Hash
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (a *auditedWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (a *auditedWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.hash.Write(p[:n])
+	a.n += int64(n)
+	return n, err
+}
+
+// serveAudited serves r with h, then adds the packets it returned to the
+// audit log.  h reports how many it sent, and why it stopped early, in
+// Steno-Packets and Steno-Error trailers, like /query.
+func (e *Env) serveAudited(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	aw := &auditedWriter{ResponseWriter: w, hash: sha256.New()}
+	h.ServeHTTP(aw, r)
+	rec := audit.Record{
+		API:    r.URL.Path,
+		Client: httputil.Identity(r),
+		Query:  r.URL.RawQuery,
+		Bytes:  aw.n,
+	}
+	var err error
+	switch msg := w.Header().Get("Steno-Error"); {
+	case aw.status != 0 && aw.status != http.StatusOK:
+		err = fmt.Errorf("status %d", aw.status)
+	case msg != "":
+		err = errors.New(msg)
+	}
+	if aw.status == http.StatusOK {
+		rec.Packets, _ = strconv.ParseInt(w.Header().Get("Steno-Packets"), 10, 64)
+		rec.SHA256 = hex.EncodeToString(aw.hash.Sum(nil))
+	}
+	e.recordRetrieval(rec, err)
+}
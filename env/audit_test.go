@@ -0,0 +1,108 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+)
+
+// readAudit returns the records in the audit log at path.
+func readAudit(t *testing.T, path string) []audit.Record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("bad audit entry %q: %v", scanner.Text(), err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestDebugPacketsAudited(t *testing.T) {
+	e, cleanup := authzEnv(t, testPolicy)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	if e.auditLog, err = audit.Open(path, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer e.auditLog.Close()
+
+	const pcap = "not really a pcap"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/t0/packets", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "1500000000000000" {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Trailer", "Steno-Packets, Steno-Error")
+		w.Write([]byte(pcap))
+		w.Header().Set("Steno-Packets", "3")
+	})
+	mux.HandleFunc("/debug/t0/files", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1500000000000000\n"))
+	})
+	h := e.restrictDebug(mux)
+	for _, req := range []*http.Request{
+		certRequest("GET", "/debug/t0/packets?name=1500000000000000", "analyst", "soc"),
+		certRequest("GET", "/debug/t0/packets?name=missing", "analyst", "soc"),
+		certRequest("GET", "/debug/t0/files", "analyst", "soc"),
+		certRequest("GET", "/debug/t0/packets?name=1500000000000000", "contractor", ""),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	sum := sha256.Sum256([]byte(pcap))
+	want := []audit.Record{
+		{API: "/debug/t0/packets", Client: "analyst", Query: "name=1500000000000000", Packets: 3, Bytes: int64(len(pcap)), SHA256: hex.EncodeToString(sum[:])},
+		{API: "/debug/t0/packets", Client: "analyst", Query: "name=missing", Bytes: int64(len("file not found\n")), Err: "status 404"},
+	}
+	got := readAudit(t, path)
+	if len(got) != len(want) {
+		t.Fatalf("got %d audit records %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i].Time.IsZero() {
+			t.Errorf("record %d has no time", i)
+		}
+		got[i].Time = want[i].Time
+		if got[i] != want[i] {
+			t.Errorf("record %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
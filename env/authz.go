@@ -0,0 +1,129 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	//"github.com/google/stenographer/authz"
+	"../authz"
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"golang.org/x/net/context"
+)
+
+// errFlowsOnly is returned when a client only allowed flow metadata asks for
+// packets.
+var errFlowsOnly = errors.New("only authorized to query flows")
+
+// authorize returns what the client whose request ctx is for may query.  It
+// authenticated with a bearer token if ctx says so, or else with cert, if
+// it's not nil.  packets is whether it's asking for packets, rather than flow
+// metadata.  If there's no authorization policy, everything is allowed.
+func (e *Env) authorize(ctx context.Context, cert *x509.Certificate, packets bool) (*authz.Grant, error) {
+	authorizer := e.currentAuthorizer()
+	if authorizer == nil {
+		return nil, nil
+	}
+	var name string
+	var groups []string
+	if id, ok := tokenauth.FromContext(ctx); ok {
+		name, groups = id.Subject, id.Groups
+	} else if cert != nil {
+		name, groups = certs.Name(cert), cert.Subject.OrganizationalUnit
+	}
+	g, err := authorizer.Authorize(name, groups)
+	if err == nil && packets && g.FlowsOnly {
+		err = errFlowsOnly
+	}
+	return g, err
+}
+
+// clientOwner returns who the client the request ctx is for is, as the kind
+// of credential it authenticated with and its name:  "federated:NAME" for a
+// client named by a federator, "token:SUBJECT" for a bearer token,
+// "cert:NAME" for cert, if it's not nil, or "address:ADDR".  Unlike
+// httputil.Identity, names of different kinds can't collide, so a token can't
+// pass for a certificate with the same name.
+func clientOwner(ctx context.Context, cert *x509.Certificate, addr string) string {
+	id, ok := tokenauth.FromContext(ctx)
+	switch {
+	case ok:
+		if _, forwarded := forwardedBy(ctx); forwarded {
+			return "federated:" + id.Subject
+		}
+		return "token:" + id.Subject
+	case cert != nil && certs.Name(cert) != "":
+		return "cert:" + certs.Name(cert)
+	}
+	return "address:" + addr
+}
+
+// requestOwner is clientOwner for an HTTP request.
+func requestOwner(r *http.Request) string {
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+	}
+	return clientOwner(r.Context(), cert, r.RemoteAddr)
+}
+
+// authorizeRequest is authorize for an HTTP request.  If the client isn't
+// authorized, it writes a 403 response and returns false.
+func (e *Env) authorizeRequest(w http.ResponseWriter, r *http.Request, packets bool) (*authz.Grant, bool) {
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+	}
+	g, err := e.authorize(r.Context(), cert, packets)
+	if err != nil {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: err.Error()})
+		return nil, false
+	}
+	return g, true
+}
+
+// restrictDebug wraps h so that the /debug/ handlers, which read blockfiles
+// and internal state directly rather than through authorized queries, are
+// only served to clients authorized to query every packet.  Packets they
+// return are audited like a query's.
+func (e *Env) restrictDebug(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean(r.URL.Path)
+		if !strings.HasPrefix(p, "/debug/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		grant, ok := e.authorizeRequest(w, r, true)
+		if !ok {
+			return
+		}
+		if !grant.Unrestricted() {
+			writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "debugging needs access to every packet"})
+			return
+		}
+		if debugPacketsPath.MatchString(p) {
+			e.serveAudited(h, w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	//"github.com/google/stenographer/authz"
+	"../authz"
+)
+
+const testPolicy = `{"Rules": [
+  {"OU": "soc"},
+  {"CN": "contractor", "Subnets": ["10.1.0.0/16"], "MaxTimeRange": "168h"},
+  {"OU": "noc", "FlowsOnly": true},
+  {"OU": "blue-team", "Filter": "vlan 30 or net 10.30.0.0/16"}
+]}`
+
+// authzEnv returns an Env authorizing clients with policy, and a function
+// cleaning up after it.
+func authzEnv(t *testing.T, policy string) (*Env, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := authz.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Env{authorizer: a}, func() { os.RemoveAll(dir) }
+}
+
+// certRequest returns a request for url from a client with a certificate
+// with the given CN and OU, or no certificate if both are empty.
+func certRequest(method, url, cn, ou string) *http.Request {
+	r := httptest.NewRequest(method, url, nil)
+	if cn != "" || ou != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		if ou != "" {
+			cert.Subject.OrganizationalUnit = []string{ou}
+		}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return r
+}
+
+func TestRestrictDebug(t *testing.T) {
+	e, cleanup := authzEnv(t, testPolicy)
+	defer cleanup()
+	mux := http.NewServeMux()
+	served := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("served")) }
+	mux.HandleFunc("/debug/t0/packets", served)
+	mux.HandleFunc("/debug/t0/index", served)
+	mux.HandleFunc("/debug/t0/files", served)
+	mux.HandleFunc("/debug/config", served)
+	mux.HandleFunc("/query", served)
+	h := e.restrictDebug(mux)
+	for _, test := range []struct {
+		url    string
+		cn, ou string
+		want   int
+	}{
+		{"/debug/t0/packets?name=1500000000000000", "analyst", "soc", http.StatusOK},
+		{"/debug/config", "analyst", "soc", http.StatusOK},
+		{"/debug/t0/packets?name=1500000000000000", "contractor", "", http.StatusForbidden},
+		{"/debug/config", "contractor", "", http.StatusForbidden},
+		{"/debug/t0/packets?name=1500000000000000", "netops", "noc", http.StatusForbidden},
+		{"/debug/t0/packets?name=1500000000000000", "stranger", "", http.StatusForbidden},
+		// Debug handlers can't apply a tenant's filter, so tenants get none.
+		{"/debug/t0/packets?name=1500000000000000", "analyst", "blue-team", http.StatusForbidden},
+		{"/debug/t0/index?name=1500000000000000", "analyst", "blue-team", http.StatusForbidden},
+		{"/debug/t0/files", "analyst", "blue-team", http.StatusForbidden},
+		{"/query/../debug/t0/packets?name=1500000000000000", "contractor", "", http.StatusForbidden},
+		// Other handlers authorize requests themselves.
+		{"/query", "contractor", "", http.StatusOK},
+		{"/query", "stranger", "", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, certRequest("GET", test.url, test.cn, test.ou))
+		if w.Code != test.want {
+			t.Errorf("%v by %v/%v: got status %v, want %v", test.url, test.cn, test.ou, w.Code, test.want)
+		}
+	}
+}
+
+func TestRestrictDebugWithoutPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	(&Env{}).restrictDebug(mux).ServeHTTP(w, certRequest("GET", "/debug/config", "anyone", ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusOK)
+	}
+}
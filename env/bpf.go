@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/bpfutil"
+	"../bpfutil"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const defaultBPFPreviewSamples = 100
+
+// bpfPreview is the response to a /bpf/preview request.
+type bpfPreview struct {
+	// Filter is the hex encoding for each interface, suitable for its
+	// stenotype's --filter flag, and Instructions its length.
+	Filter       map[string]string
+	Instructions map[string]int
+	Kept         int
+	Dropped      int
+	Samples      []bpfSample
+}
+
+// bpfSample details what a BPF filter does with a single sample packet.
+type bpfSample struct {
+	Thread    int
+	Timestamp time.Time
+	Length    int
+	Flow      string
+	Kept      bool
+}
+
+// flowString returns a short human-readable description of a packet's flow.
+func flowString(data []byte) string {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	net := pkt.NetworkLayer()
+	if net == nil {
+		return "non-IP"
+	}
+	flow := net.NetworkFlow().String()
+	if transport := pkt.TransportLayer(); transport != nil {
+		flow += fmt.Sprintf(" %v %v", transport.LayerType(), transport.TransportFlow())
+	}
+	return flow
+}
+
+// handleBPFPreview validates the BPF filter in the request body, then reports
+// which recently captured packets it would keep and which it would drop.  The
+// body is a tcpdump expression, or with ?hex=true an already compiled filter
+// as passed to stenotype's --filter flag.  ?samples=N sets how many packets to
+// sample from each thread.  The filter is compiled for each thread's
+// interface.  Since it shows other clients' traffic, only clients authorized
+// to query every packet may use it.
+func (e *Env) handleBPFPreview(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if !grant.Unrestricted() {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "previewing filters needs access to every packet"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+	vals := r.URL.Query()
+	samples := defaultBPFPreviewSamples
+	if s := vals.Get("samples"); s != "" {
+		if samples, err = strconv.Atoi(s); err != nil || samples <= 0 {
+			http.Error(w, "bad samples", http.StatusBadRequest)
+			return
+		}
+	}
+	e.confMu.RLock()
+	conf := e.conf
+	e.confMu.RUnlock()
+	filters := map[string]*bpfutil.Filter{}
+	out := bpfPreview{Filter: map[string]string{}, Instructions: map[string]int{}, Samples: []bpfSample{}}
+	for _, iface := range conf.Interfaces() {
+		var filter *bpfutil.Filter
+		if vals.Get("hex") == "true" {
+			filter, err = bpfutil.FromHex(string(body))
+		} else {
+			filter, err = bpfutil.Compile(iface, string(body))
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter for %v: %v", iface, err), http.StatusBadRequest)
+			return
+		}
+		filters[iface] = filter
+		out.Filter[iface], out.Instructions[iface] = filter.Hex(), filter.Len()
+	}
+
+	for i, t := range e.threads {
+		filter := filters[conf.ThreadInterface(i)]
+		packets := t.SamplePackets(samples)
+		for p := range packets.Receive() {
+			s := bpfSample{
+				Thread:    i,
+				Timestamp: p.Timestamp,
+				Length:    p.Length,
+				Flow:      flowString(p.Data),
+				Kept:      filter.Matches(p.Data),
+			}
+			if s.Kept {
+				out.Kept++
+			} else {
+				out.Dropped++
+			}
+			out.Samples = append(out.Samples, s)
+		}
+		if err := packets.Err(); err != nil {
+			log.Printf("could not sample packets from thread %d: %v", i, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
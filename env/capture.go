@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+// capture is a stenotype process capturing packets from one network
+// interface into the directories of the threads configured with it.
+type capture struct {
+	iface   string
+	threads []int  // Indexes of the threads it writes.
+	dir     string // Its threads' directories, numbered as stenotype expects.
+	// cpus are the CPUs its threads are pinned to, or nil for stenotype's
+	// default.
+	cpus []int
+	// process is stenotype while it's running, and restarting is set when
+	// it's stopped to be restarted.  downSince is when it last stopped, or
+	// zero while it's running.  restarts counts the times it's failed, and
+	// restartAt is when it's next restarted after failing.  All are guarded
+	// by Env.stenotypeMu.
+	process    *os.Process
+	restarting bool
+	downSince  time.Time
+	restarts   int64
+	restartAt  time.Time
+}
+
+// newCaptures returns a capture for each interface c's threads capture from.
+// With just one, stenotype uses the threads' symlinks in dir, and otherwise
+// each capture gets a subdirectory of dir linking to its threads'
+// symlinks.
+func newCaptures(c config.Config, dir string) ([]*capture, error) {
+	ifaces := c.Interfaces()
+	cpus := threadCPUs(c)
+	out := make([]*capture, len(ifaces))
+	for i, iface := range ifaces {
+		cp := &capture{iface: iface, dir: dir, downSince: time.Now()}
+		for n := range c.Threads {
+			if c.ThreadInterface(n) == iface {
+				cp.threads = append(cp.threads, n)
+			}
+		}
+		cp.cpus = captureCPUs(cp.threads, cpus)
+		out[i] = cp
+		if len(ifaces) == 1 {
+			break
+		}
+		cp.dir = filepath.Join(dir, fmt.Sprintf("capture%d", i))
+		if err := os.Mkdir(cp.dir, 0700); err != nil {
+			return nil, fmt.Errorf("could not create capture directory for %q: %v", iface, err)
+		}
+		// Each links to the thread's own symlink, which points at the
+		// directory its files are placed in.
+		for j, n := range cp.threads {
+			if err := os.Symlink(filepath.Join(dir, fmt.Sprintf("PKT%d", n)), filepath.Join(cp.dir, fmt.Sprintf("PKT%d", j))); err != nil {
+				return nil, fmt.Errorf("couldn't link thread %d's packets for %q: %v", n, iface, err)
+			}
+			if err := os.Symlink(filepath.Join(dir, fmt.Sprintf("IDX%d", n)), filepath.Join(cp.dir, fmt.Sprintf("IDX%d", j))); err != nil {
+				return nil, fmt.Errorf("couldn't link thread %d's index for %q: %v", n, iface, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// captureCPUs returns the CPUs to pin threads to, given each thread's CPU in
+// cpus, or nil if none are set.  Threads without one get stenotype's default,
+// their position in threads.
+func captureCPUs(threads []int, cpus []int) []int {
+	var out []int
+	for _, n := range threads {
+		if cpus[n] >= 0 {
+			out = make([]int, len(threads))
+			break
+		}
+	}
+	for j := range out {
+		if out[j] = cpus[threads[j]]; out[j] < 0 {
+			out[j] = j
+		}
+	}
+	return out
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+func TestCaptureCPUs(t *testing.T) {
+	for _, test := range []struct {
+		threads []int
+		cpus    []int
+		want    []int
+	}{
+		{[]int{0, 1}, []int{-1, -1}, nil},
+		{[]int{0, 1}, []int{8, 9}, []int{8, 9}},
+		{[]int{0, 1, 2}, []int{-1, 5, -1}, []int{0, 5, 2}},
+		{[]int{1, 3}, []int{4, -1, 5, -1}, nil}, // Only other captures' threads are pinned.
+		{[]int{1, 3}, []int{-1, -1, 5, 7}, []int{0, 7}},
+	} {
+		if got := captureCPUs(test.threads, test.cpus); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("captureCPUs(%v, %v) got %v, want %v", test.threads, test.cpus, got, test.want)
+		}
+	}
+}
+
+func TestNewCapturesLinksThreads(t *testing.T) {
+	_, cleanup := fakeSysfs(t, nil)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.Config{Interface: "eth0", Threads: []config.ThreadConfig{{}, {Interface: "eth1"}, {}}}
+	captures, err := newCaptures(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) != 2 {
+		t.Fatalf("got %d captures, want 2", len(captures))
+	}
+	for i, want := range []struct {
+		iface   string
+		threads []int
+	}{
+		{"eth0", []int{0, 2}},
+		{"eth1", []int{1}},
+	} {
+		cp := captures[i]
+		if cp.iface != want.iface || !reflect.DeepEqual(cp.threads, want.threads) {
+			t.Errorf("capture %d got %v threads %v, want %v threads %v", i, cp.iface, cp.threads, want.iface, want.threads)
+		}
+		for j, n := range want.threads {
+			for _, kind := range []string{"PKT", "IDX"} {
+				link := filepath.Join(cp.dir, fmt.Sprintf("%s%d", kind, j))
+				got, err := os.Readlink(link)
+				if want := filepath.Join(dir, fmt.Sprintf("%s%d", kind, n)); err != nil || got != want {
+					t.Errorf("%v got %q, %v; want %q", link, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestNewCapturesOneInterface(t *testing.T) {
+	_, cleanup := fakeSysfs(t, nil)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.Config{Interface: "eth0", Threads: []config.ThreadConfig{{}, {Interface: "eth0"}}}
+	captures, err := newCaptures(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stenotype uses the threads' own symlinks.
+	if len(captures) != 1 || captures[0].iface != "eth0" || captures[0].dir != dir || !reflect.DeepEqual(captures[0].threads, []int{0, 1}) {
+		t.Fatalf("got captures %+v, want one of both threads on eth0 in %q", captures, dir)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("got %v in %q, %v; want nothing created", files, dir, err)
+	}
+}
+
+func TestNewCapturesExistingDirectory(t *testing.T) {
+	_, cleanup := fakeSysfs(t, nil)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "capture1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	c := config.Config{Threads: []config.ThreadConfig{{Interface: "eth0"}, {Interface: "eth1"}}}
+	if _, err := newCaptures(c, dir); err == nil || !strings.Contains(err.Error(), "eth1") {
+		t.Errorf("got %v, want eth1's capture directory to fail", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	_, cleanup := fakeSysfs(t, numaSysfs)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	four, five, six := 4, 5, 6
+	for _, test := range []struct {
+		desc    string
+		backend string
+		iface   string
+		threads []config.ThreadConfig
+		want    [][]string // stenotype's args, after Flags, for each capture.
+	}{
+		{
+			desc:    "afpacket",
+			backend: "afpacket",
+			iface:   "eth0",
+			threads: []config.ThreadConfig{{}, {}},
+			want:    [][]string{{"--threads=2", "--iface=eth0", "--dir=D"}},
+		},
+		{
+			desc:    "default backend with a pinned thread",
+			iface:   "eth0",
+			threads: []config.ThreadConfig{{}, {CPU: &five}},
+			want:    [][]string{{"--thread_cpus=0,5", "--threads=2", "--iface=eth0", "--dir=D"}},
+		},
+		{
+			desc:    "afxdp on node 1",
+			backend: "afxdp",
+			iface:   "eth0",
+			threads: []config.ThreadConfig{{}, {}},
+			want:    [][]string{{"--xdp", "--xdp_queues=0,1", "--thread_cpus=8,9", "--threads=2", "--iface=eth0", "--dir=D"}},
+		},
+		{
+			desc:    "afxdp with queues",
+			backend: "afxdp",
+			iface:   "eth1",
+			threads: []config.ThreadConfig{{Queue: &four}, {Queue: &six}},
+			want:    [][]string{{"--xdp", "--xdp_queues=4,6", "--threads=2", "--iface=eth1", "--dir=D"}},
+		},
+		{
+			desc:    "afxdp on two interfaces",
+			backend: "afxdp",
+			iface:   "eth0",
+			threads: []config.ThreadConfig{{}, {Interface: "eth1"}, {}, {Interface: "eth1", CPU: &five}},
+			want: [][]string{
+				{"--xdp", "--xdp_queues=0,1", "--thread_cpus=8,9", "--threads=2", "--iface=eth0", "--dir=D/capture0"},
+				{"--xdp", "--xdp_queues=0,1", "--thread_cpus=0,5", "--threads=2", "--iface=eth1", "--dir=D/capture1"},
+			},
+		},
+	} {
+		tmp, err := ioutil.TempDir(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := config.Config{Flags: []string{"-v"}, Interface: test.iface, CaptureBackend: test.backend, Threads: test.threads}
+		captures, err := newCaptures(c, tmp)
+		if err != nil {
+			t.Fatalf("%v: %v", test.desc, err)
+		}
+		if len(captures) != len(test.want) {
+			t.Fatalf("%v: got %d captures, want %d", test.desc, len(captures), len(test.want))
+		}
+		e := &Env{conf: c}
+		for i, cp := range captures {
+			want := []string{"-v"}
+			for _, arg := range test.want[i] {
+				want = append(want, strings.Replace(arg, "--dir=D", "--dir="+tmp, 1))
+			}
+			if got := e.args(cp); !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: capture %d got args %q, want %q", test.desc, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"syscall"
+
+	//"github.com/google/stenographer/bpfutil"
+	"../bpfutil"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+var captureFilterChanges = stats.S.Get("capture_filter_changes")
+
+// captureFilter is the response to /capture/filter.
+type captureFilter struct {
+	Filter string // tcpdump expression.  If empty, every packet is captured.
+	// Hex is the filter as passed to each interface's stenotype's --filter
+	// flag.
+	Hex map[string]string `json:",omitempty"`
+}
+
+// compileCaptureFilters returns the hex encoding of the tcpdump expression
+// expr compiled for each of ifaces, or nil if expr is empty.
+func compileCaptureFilters(ifaces []string, expr string) (map[string]string, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for _, iface := range ifaces {
+		f, err := bpfutil.Compile(iface, expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture filter %q for %v: %v", expr, iface, err)
+		}
+		out[iface] = f.Hex()
+	}
+	return out, nil
+}
+
+// currentCaptureFilter returns the capture filter stenotype is, or is about
+// to be, running with.
+func (e *Env) currentCaptureFilter() captureFilter {
+	e.confMu.RLock()
+	defer e.confMu.RUnlock()
+	return captureFilter{Filter: e.conf.CaptureFilter, Hex: e.captureFilterHex}
+}
+
+// setCaptureFilter makes stenotype capture only the packets matching the
+// tcpdump expression expr, restarting it if the filter's changed.
+func (e *Env) setCaptureFilter(expr string) error {
+	e.confMu.RLock()
+	ifaces, old := e.conf.Interfaces(), e.conf.CaptureFilter
+	e.confMu.RUnlock()
+	if expr == old {
+		return nil
+	}
+	hex, err := compileCaptureFilters(ifaces, expr)
+	if err != nil {
+		return err
+	}
+	e.confMu.Lock()
+	e.conf.CaptureFilter, e.captureFilterHex = expr, hex
+	e.confMu.Unlock()
+	captureFilterChanges.Increment()
+	e.restartStenotype()
+	return nil
+}
+
+// restartStenotype stops each stenotype gracefully, letting them flush their
+// files, so RunStenotype restarts them with the current args.  Those not
+// running get them when they next start.
+func (d *Env) restartStenotype() {
+	d.stenotypeMu.Lock()
+	defer d.stenotypeMu.Unlock()
+	for _, c := range d.captures {
+		if c.process == nil {
+			continue
+		}
+		c.restarting = true
+		log.Printf("Restarting stenotype on %v", c.iface)
+		if err := c.process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("could not stop stenotype on %v for restart: %v", c.iface, err)
+		}
+	}
+}
+
+// restartRequested returns whether restartStenotype stopped c's stenotype,
+// and clears it.
+func (d *Env) restartRequested(c *capture) bool {
+	d.stenotypeMu.Lock()
+	defer d.stenotypeMu.Unlock()
+	r := c.restarting
+	c.restarting = false
+	return r
+}
+
+// handleCaptureFilter shows the capture filter with GET /capture/filter, and
+// changes it with POST, whose body is a tcpdump expression, or empty to
+// capture every packet.  Changing it restarts stenotype, so operators can
+// stop capturing, say, a DDoS source without restarting stenographer.  It
+// lasts until stenographer restarts or its config is reloaded, so should be
+// put in CaptureFilter too if it's meant to stay.
+func (e *Env) handleCaptureFilter(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !e.changeCaptureFilter(w, r) {
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.currentCaptureFilter())
+}
+
+// changeCaptureFilter sets the capture filter to the one in r's body.  If it
+// can't, it writes an error response and returns false.
+func (e *Env) changeCaptureFilter(w http.ResponseWriter, r *http.Request) bool {
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return false
+	}
+	if !grant.Unrestricted() {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "changing the capture filter needs access to every packet"})
+		return false
+	}
+	if !e.conf.Captures() {
+		http.Error(w, "read-only replicas and standbys don't capture packets", http.StatusConflict)
+		return false
+	}
+	if e.conf.CaptureBackend == "afxdp" {
+		http.Error(w, "capture filters aren't supported with CaptureBackend \"afxdp\"", http.StatusConflict)
+		return false
+	}
+	if e.conf.FilterFlag() {
+		http.Error(w, "the capture filter is set by a --filter flag in Flags, use CaptureFilter instead", http.StatusConflict)
+		return false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return false
+	}
+	expr := strings.TrimSpace(string(body))
+	if err := e.setCaptureFilter(expr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	log.Printf("Capture filter set to %q by %v", expr, httputil.Identity(r))
+	return true
+}
@@ -0,0 +1,154 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+)
+
+// writeLatency describes how long a thread's block writes took to complete,
+// over the writes since the stats line before its last.
+type writeLatency struct {
+	Writes       int64
+	WrittenBytes int64
+	P50Micros    int64
+	P90Micros    int64
+	P99Micros    int64
+	MaxMicros    int64
+}
+
+// merge adds o's writes to l's, taking the larger of each percentile.
+func (l *writeLatency) merge(o writeLatency) {
+	l.Writes += o.Writes
+	l.WrittenBytes += o.WrittenBytes
+	for _, p := range []struct{ l, o *int64 }{
+		{&l.P50Micros, &o.P50Micros},
+		{&l.P90Micros, &o.P90Micros},
+		{&l.P99Micros, &o.P99Micros},
+		{&l.MaxMicros, &o.MaxMicros},
+	} {
+		if *p.o > *p.l {
+			*p.l = *p.o
+		}
+	}
+}
+
+// threadCaptureStats are what a thread's stenotype reported capturing, as of
+// the last stats line it logged.  Counts are since stenotype started.
+type threadCaptureStats struct {
+	Thread           int
+	Interface        string
+	PacketsDirectory string
+	// Updated is when the stats line was logged, or zero if stenotype
+	// hasn't logged one.
+	Updated     time.Time `json:",omitempty"`
+	Packets     int64
+	Bytes       int64 // Of the packets, as they were on the wire.
+	Blocks      int64
+	Drops       int64 // By the kernel, or the NIC's queue with AF_XDP.
+	DropPercent float64
+	Duplicates  int64 // Removed by deduplication.
+	// CurrentFile is the name of the file stenotype's writing to.
+	CurrentFile  string `json:",omitempty"`
+	WriteLatency writeLatency
+}
+
+// diskCaptureStats are the capture stats of the threads writing to a packets
+// directory.  Percentiles can't be combined, so each of its write latency
+// percentiles is the worst of its threads'.
+type diskCaptureStats struct {
+	Dir          string
+	Threads      []int
+	WriteLatency writeLatency
+}
+
+// captureStats is the response to /capture/stats.
+type captureStats struct {
+	Threads []threadCaptureStats
+	Disks   []diskCaptureStats // Sorted by directory.
+}
+
+// captureStats returns each thread's and each disk's capture stats.
+func (d *Env) captureStats() captureStats {
+	out := captureStats{Threads: []threadCaptureStats{}, Disks: []diskCaptureStats{}}
+	disks := map[string]*diskCaptureStats{}
+	for i, t := range d.threads {
+		id := strconv.Itoa(i)
+		get := func(name string) int64 { return captureStat(id, name).Value() }
+		conf := t.Config()
+		s := threadCaptureStats{
+			Thread:           i,
+			Interface:        d.threadInterface(i),
+			PacketsDirectory: conf.PacketsDirectory,
+			Packets:          get("packets"),
+			Bytes:            get("bytes"),
+			Blocks:           get("blocks"),
+			Drops:            get("drops"),
+			Duplicates:       get("duplicates"),
+			WriteLatency: writeLatency{
+				Writes:       get("writes"),
+				WrittenBytes: get("written_bytes"),
+				P50Micros:    get("write_p50_us"),
+				P90Micros:    get("write_p90_us"),
+				P99Micros:    get("write_p99_us"),
+				MaxMicros:    get("write_max_us"),
+			},
+		}
+		if u := get("updated"); u > 0 {
+			s.Updated = time.Unix(u, 0)
+		}
+		if s.Packets+s.Drops > 0 {
+			s.DropPercent = float64(s.Drops) * 100 / float64(s.Packets+s.Drops)
+		}
+		if f := get("file"); f > 0 {
+			s.CurrentFile = strconv.FormatInt(f, 10)
+		}
+		out.Threads = append(out.Threads, s)
+		disk := disks[conf.PacketsDirectory]
+		if disk == nil {
+			disk = &diskCaptureStats{Dir: conf.PacketsDirectory}
+			disks[disk.Dir] = disk
+		}
+		disk.Threads = append(disk.Threads, i)
+		disk.WriteLatency.merge(s.WriteLatency)
+	}
+	for _, disk := range disks {
+		out.Disks = append(out.Disks, *disk)
+	}
+	sort.Slice(out.Disks, func(i, j int) bool { return out.Disks[i].Dir < out.Disks[j].Dir })
+	return out
+}
+
+// handleCaptureStats serves what each thread's stenotype reported capturing,
+// and how quickly each disk is taking its writes, at /capture/stats.
+// stenotype reports them every 100MB it captures, and at least once a minute.
+func (e *Env) handleCaptureStats(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.captureStats())
+}
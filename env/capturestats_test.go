@@ -0,0 +1,145 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/thread"
+	"../thread"
+)
+
+// captureStatsEnv returns an Env whose first two threads capture from eth0
+// onto one disk, and whose third captures from eth1 onto another, and a
+// function cleaning up after it.  The first two have logged stats lines,
+// the second with slower writes, and the third hasn't.
+func captureStatsEnv(t *testing.T) (*Env, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	tc := []config.ThreadConfig{
+		{PacketsDirectory: a, IndexDirectory: filepath.Join(a, "idx0"), Interface: "eth0", DiskFreePercentage: 10, MaxDirectoryFiles: 10},
+		{PacketsDirectory: a, IndexDirectory: filepath.Join(a, "idx1"), Interface: "eth0", DiskFreePercentage: 10, MaxDirectoryFiles: 10},
+		{PacketsDirectory: b, IndexDirectory: filepath.Join(b, "idx"), Interface: "eth1", DiskFreePercentage: 10, MaxDirectoryFiles: 10},
+	}
+	for _, c := range tc {
+		if err := os.MkdirAll(c.IndexDirectory, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	threads, err := thread.Threads(tc, filepath.Join(dir, "base"), filecache.NewCache(10))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	parseCaptureStats(statsLine(0, 1000, 10), []int{0, 1})
+	slow := strings.NewReplacer("write_p50_us=812", "write_p50_us=500", "write_p99_us=5120", "write_p99_us=9000", "write_max_us=6004", "write_max_us=12000")
+	parseCaptureStats(slow.Replace(statsLine(1, 3000, 0)), []int{0, 1})
+	for _, name := range []string{"packets", "bytes", "blocks", "drops", "duplicates", "updated", "file",
+		"writes", "written_bytes", "write_p50_us", "write_p90_us", "write_p99_us", "write_max_us"} {
+		captureStat("2", name).Set(0)
+	}
+	return &Env{conf: config.Config{Threads: tc}, threads: threads}, func() { os.RemoveAll(dir) }
+}
+
+func TestCaptureStats(t *testing.T) {
+	before := time.Now().Truncate(time.Second)
+	e, cleanup := captureStatsEnv(t)
+	defer cleanup()
+	got := e.captureStats()
+	if len(got.Threads) != 3 {
+		t.Fatalf("got %d threads, want 3", len(got.Threads))
+	}
+	for _, s := range got.Threads[:2] {
+		if s.Updated.Before(before) || s.Updated.After(time.Now()) {
+			t.Errorf("thread %d: got updated %v, want since %v", s.Thread, s.Updated, before)
+		}
+	}
+	got.Threads[0].Updated, got.Threads[1].Updated = time.Time{}, time.Time{}
+	a, b := e.conf.Threads[0].PacketsDirectory, e.conf.Threads[2].PacketsDirectory
+	want := captureStats{
+		Threads: []threadCaptureStats{
+			{
+				Thread: 0, Interface: "eth0", PacketsDirectory: a,
+				Packets: 1000, Bytes: 2201819136, Blocks: 2100, Drops: 10, DropPercent: float64(10) * 100 / 1010,
+				CurrentFile:  "1500000000123456",
+				WriteLatency: writeLatency{Writes: 2100, WrittenBytes: 2202009600, P50Micros: 812, P90Micros: 1290, P99Micros: 5120, MaxMicros: 6004},
+			},
+			{
+				Thread: 1, Interface: "eth0", PacketsDirectory: a,
+				Packets: 3000, Bytes: 2201819136, Blocks: 2100,
+				CurrentFile:  "1500000000123456",
+				WriteLatency: writeLatency{Writes: 2100, WrittenBytes: 2202009600, P50Micros: 500, P90Micros: 1290, P99Micros: 9000, MaxMicros: 12000},
+			},
+			// No stats line yet.
+			{Thread: 2, Interface: "eth1", PacketsDirectory: b},
+		},
+		Disks: []diskCaptureStats{
+			{
+				Dir: a, Threads: []int{0, 1},
+				// The worst of each percentile.
+				WriteLatency: writeLatency{Writes: 4200, WrittenBytes: 2 * 2202009600, P50Micros: 812, P90Micros: 1290, P99Micros: 9000, MaxMicros: 12000},
+			},
+			{Dir: b, Threads: []int{2}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestCaptureStatsWithoutThreads(t *testing.T) {
+	got, err := json.Marshal((&Env{}).captureStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lists are empty rather than null.
+	if want := `{"Threads":[],"Disks":[]}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHandleCaptureStats(t *testing.T) {
+	e, cleanup := captureStatsEnv(t)
+	defer cleanup()
+	w := httptest.NewRecorder()
+	e.handleCaptureStats(w, httptest.NewRequest("GET", "/capture/stats", nil))
+	var got captureStats
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %v, Content-Type %q; want %v JSON", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+	} else if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got.Threads) != 3 || len(got.Disks) != 2 {
+		t.Errorf("got %+v, %v; want 3 threads on 2 disks", got, err)
+	}
+
+	w = httptest.NewRecorder()
+	e.handleCaptureStats(w, httptest.NewRequest("POST", "/capture/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
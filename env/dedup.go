@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// defaultDedupWindow is how close together identical packets must be for
+// ?dedup=true to drop all but the first.  Copies from taps and SPAN ports
+// arrive well within it.
+const defaultDedupWindow = 10 * time.Millisecond
+
+var packetsDeduplicated = stats.S.Get("packets_deduplicated")
+
+// dedupWindow returns the window a query asked for duplicate packets to be
+// dropped within, with ?dedup=true (for the default window) or ?dedup=DURATION,
+// or 0 if it didn't.
+func dedupWindow(r *http.Request) (time.Duration, error) {
+	return parseDedup(r.URL.Query().Get("dedup"))
+}
+
+// parseDedup parses a dedup window given as for ?dedup, with "" meaning none.
+func parseDedup(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	if on, err := strconv.ParseBool(d); err == nil {
+		if on {
+			return defaultDedupWindow, nil
+		}
+		return 0, nil
+	}
+	if window, err := time.ParseDuration(d); err == nil && window > 0 {
+		return window, nil
+	}
+	return 0, fmt.Errorf("invalid dedup parameter %q", d)
+}
+
+// networkHash hashes a packet from its network layer on, so copies of it
+// picked up at different points (with different VLAN tags, say) match.  The
+// length hashed is the network layer's, for the same reason.  IPv4 TTLs and
+// header checksums, and IPv6 hop limits, are left out, since routers between
+// those points change them.  Non-IP packets are hashed whole.  stenotype's
+// NetworkHash, used by --dedup_window_us, matches this, as checked against
+// testdata/network_hash.txt.
+func networkHash(p *base.Packet) uint64 {
+	data := p.Data
+	offset, etherType := 12, uint16(0)
+	for offset+2 <= len(data) {
+		etherType = binary.BigEndian.Uint16(data[offset:])
+		if etherType != 0x8100 && etherType != 0x88a8 { // VLAN tags.
+			break
+		}
+		offset += 4
+	}
+	l3 := data[:0]
+	if offset+2 <= len(data) {
+		l3 = data[offset+2:]
+	}
+	var buf [40]byte
+	var hdr []byte
+	switch {
+	case etherType == 0x0800 && len(l3) >= 20:
+		hdr = buf[:20]
+		copy(hdr, l3)
+		hdr[8], hdr[10], hdr[11] = 0, 0, 0 // TTL and checksum.
+	case etherType == 0x86dd && len(l3) >= 40:
+		hdr = buf[:40]
+		copy(hdr, l3)
+		hdr[7] = 0 // Hop limit.
+	}
+	h := fnv.New64a()
+	var length [4]byte
+	if hdr == nil {
+		binary.BigEndian.PutUint32(length[:], uint32(p.Length))
+		h.Write(length[:])
+		h.Write(data)
+		return h.Sum64()
+	}
+	binary.BigEndian.PutUint32(length[:], uint32(p.Length-offset-2))
+	h.Write(length[:])
+	h.Write(hdr)
+	h.Write(l3[len(hdr):])
+	return h.Sum64()
+}
+
+// seenPacket records when a packet with a given hash was last seen.
+type seenPacket struct {
+	hash uint64
+	ts   time.Time
+}
+
+// dedupPackets drops packets from in identical to one seen up to window
+// before them, which are usually copies from taps or SPAN ports.  in must be
+// sorted by time.
+func dedupPackets(ctx context.Context, in *base.PacketChan, window time.Duration) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		lastSeen := map[uint64]time.Time{}
+		var seen []seenPacket // In time order, to expire lastSeen.
+		for p := range in.Receive() {
+			if base.ContextDone(ctx) {
+				break
+			}
+			expired := 0
+			for ; expired < len(seen) && p.Timestamp.Sub(seen[expired].ts) > window; expired++ {
+				if s := seen[expired]; lastSeen[s.hash].Equal(s.ts) {
+					delete(lastSeen, s.hash)
+				}
+			}
+			seen = seen[expired:]
+			hash := networkHash(p)
+			if last, ok := lastSeen[hash]; ok && p.Timestamp.Sub(last) <= window {
+				packetsDeduplicated.Increment()
+				continue
+			}
+			lastSeen[hash] = p.Timestamp
+			seen = append(seen, seenPacket{hash, p.Timestamp})
+			out.Send(p)
+		}
+		if err := ctx.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+func TestParseDedup(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"true", defaultDedupWindow, false},
+		{"1", defaultDedupWindow, false},
+		{"false", 0, false},
+		{"0", 0, false},
+		{"50ms", 50 * time.Millisecond, false},
+		{"2s", 2 * time.Second, false},
+		{"0s", 0, true},
+		{"-1ms", 0, true},
+		{"sometimes", 0, true},
+	} {
+		got, err := parseDedup(test.in)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseDedup(%q) got %v, %v; want %v, error %v", test.in, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// packet returns a packet of the given length on the wire, captured as the
+// concatenated hex strings.
+func packet(t *testing.T, length int, hexData ...string) *base.Packet {
+	data, err := hex.DecodeString(strings.Join(hexData, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &base.Packet{Data: data, CaptureInfo: gopacket.CaptureInfo{CaptureLength: len(data), Length: length}}
+}
+
+const (
+	macs    = "000000000002000000000001"
+	vlan    = "81000064"
+	qinq    = "88a80065"
+	ipv4TCP = "0800" + "4500002e123440004006abcd0a0000010a000002" + "c9e7005000000001000000005002ffff0000000068656c6c6f21"
+	ipv6UDP = "86dd" + "6000000000101140" + "20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "d4310035001000007465737470617921"
+	arp     = "0806" + "0001080006040001" + "0000000000010a000001" + "0000000000000a000002"
+)
+
+func TestNetworkHash(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		a, b *base.Packet
+		same bool
+	}{
+		{"VLAN tag", packet(t, 60, macs, ipv4TCP), packet(t, 64, macs, vlan, ipv4TCP), true},
+		{"QinQ tags", packet(t, 60, macs, ipv4TCP), packet(t, 68, macs, qinq, vlan, ipv4TCP), true},
+		{"IPv4 TTL and checksum", packet(t, 60, macs, ipv4TCP), packet(t, 60, macs, strings.Replace(ipv4TCP, "4006abcd", "3f061234", 1)), true},
+		{"IPv4 payload", packet(t, 60, macs, ipv4TCP), packet(t, 60, macs, strings.Replace(ipv4TCP, "6f21", "6f3f", 1)), false},
+		{"IPv4 length", packet(t, 60, macs, ipv4TCP), packet(t, 1500, macs, ipv4TCP), false},
+		{"IPv6 hop limit", packet(t, 70, macs, ipv6UDP), packet(t, 70, macs, strings.Replace(ipv6UDP, "1140", "113f", 1)), true},
+		{"IPv6 VLAN tag", packet(t, 70, macs, ipv6UDP), packet(t, 74, macs, vlan, ipv6UDP), true},
+		{"IPv6 addresses", packet(t, 70, macs, ipv6UDP), packet(t, 70, macs, strings.Replace(ipv6UDP, "0000000000000002", "0000000000000003", 1)), false},
+		{"non-IP", packet(t, 42, macs, arp), packet(t, 42, macs, arp), true},
+		{"non-IP VLAN tag", packet(t, 42, macs, arp), packet(t, 46, macs, vlan, arp), false},
+		{"truncated IPv4 header", packet(t, 60, macs, ipv4TCP[:24]), packet(t, 60, macs, "08004500002e123440003f06"), false},
+	} {
+		if same := networkHash(test.a) == networkHash(test.b); same != test.same {
+			t.Errorf("%v: got same hash %v, want %v", test.desc, same, test.same)
+		}
+	}
+}
+
+// TestNetworkHashVectors checks networkHash against the hashes stenotype's
+// NetworkHash is tested against, so the two stay the same.
+func TestNetworkHashVectors(t *testing.T) {
+	f, err := os.Open("../testdata/network_hash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	vectors := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var length int
+		var data string
+		var want uint64
+		if _, err := fmt.Sscanf(line, "%d %s %x", &length, &data, &want); err != nil {
+			t.Fatalf("bad vector %q: %v", line, err)
+		}
+		if got := networkHash(packet(t, length, data)); got != want {
+			t.Errorf("%v: got hash %016x, want %016x", line, got, want)
+		}
+		vectors++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if vectors == 0 {
+		t.Error("no vectors")
+	}
+}
+
+func TestDedupPackets(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, b := packet(t, 60, macs, ipv4TCP), packet(t, 70, macs, ipv6UDP)
+	aTagged := packet(t, 64, macs, vlan, ipv4TCP)
+	in := base.NewPacketChan(10)
+	for _, p := range []struct {
+		p  *base.Packet
+		ms int
+	}{
+		{a, 0},
+		{aTagged, 5}, // Copy of a from another tap.
+		{b, 6},
+		{a, 20}, // Outside the window of a at 0.
+		{aTagged, 25},
+		{a, 29},
+		{b, 40},
+	} {
+		pkt := *p.p
+		pkt.Timestamp = start.Add(time.Duration(p.ms) * time.Millisecond)
+		in.Send(&pkt)
+	}
+	in.Close(nil)
+	dropped := packetsDeduplicated.Value()
+	out := dedupPackets(context.Background(), in, 10*time.Millisecond)
+	var got []int
+	for p := range out.Receive() {
+		got = append(got, int(p.Timestamp.Sub(start)/time.Millisecond))
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 6, 20, 40}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got packets at %v ms, want %v ms", got, want)
+	}
+	if n := packetsDeduplicated.Value() - dropped; n != 3 {
+		t.Errorf("counted %d packets deduplicated, want 3", n)
+	}
+}
@@ -18,6 +18,9 @@
 package env
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,19 +30,51 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	//"github.com/google/stenographer/alert"
+	"../alert"
+	//"github.com/google/stenographer/archive"
+	"../archive"
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	//"github.com/google/stenographer/authz"
+	"../authz"
 	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/certs"
-	"github.com/google/stenographer/config"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/config"
+	"../config"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
 	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/httputil"
+	//"github.com/google/stenographer/hold"
+	"../hold"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
 	//"github.com/google/stenographer/query"
         "../query"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/querystats"
+	"../querystats"
+	//"github.com/google/stenographer/replicate"
+	"../replicate"
+	//"github.com/google/stenographer/stats"
+	"../stats"
 	//"github.com/google/stenographer/thread"
         "../thread"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -51,58 +86,307 @@ var (
 
 const (
 	fileSyncFrequency = 15 * time.Second
+	rollupFrequency   = 10 * time.Minute
+	compressFrequency = 10 * time.Minute
+	encryptFrequency  = time.Minute
+	archiveFrequency  = time.Minute
+	// replicationFrequency is how often files are replicated to a standby,
+	// soon after stenotype finishes them.
+	replicationFrequency = 10 * time.Second
+	// queryFlushInterval is how often query responses are flushed to clients.
+	queryFlushInterval = time.Second
+	// defaultQueryStallTimeout is used if the config has no QueryStallTimeout.
+	defaultQueryStallTimeout = time.Minute
+	// defaultPivotPad is used if the config has no PivotPad.
+	defaultPivotPad = time.Minute
 
 	// These files will be read from Config.CertPath.
 	// Use stenokeys.sh to generate them.
 	caCertFilename     = "ca_cert.pem"
 	serverCertFilename = "server_cert.pem"
 	serverKeyFilename  = "server_key.pem"
+	// acmeCacheDirname holds certs obtained from an ACME CA, if configured.
+	acmeCacheDirname = "acme"
 )
 
 // Serve starts up an HTTP server using http.DefaultServerMux to handle
 // requests.  This server will server over TLS, using the certs
-// stored in c.CertPath to verify itself to clients and verify clients.
+// stored in c.CertPath to verify itself to clients and verify clients, which
+// may use bearer tokens instead if they're configured, or as serverTLSConfig
+// says.  The certs are reread when they change or on SIGHUP, so they can be
+// rotated without stopping capture.  If c.RPCPort is set, the gRPC API is
+// served there too.  Serve returns once either fails, or Shutdown stops them.
 func (e *Env) Serve() error {
-	tlsConfig, err := certs.ClientVerifyingTLSConfig(filepath.Join(e.conf.CertPath, caCertFilename))
+	tlsConfig, err := e.serverTLSConfig()
 	if err != nil {
-		return fmt.Errorf("cannot verify client cert: %v", err)
+		return err
 	}
+	e.clientAuth(tlsConfig)
+	e.tlsConfig = tlsConfig
 	server := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", e.conf.Host, e.conf.Port),
 		TLSConfig: tlsConfig,
+		Handler:   e.authenticate(e.restrictDebug(http.DefaultServeMux)),
 	}
+	e.servers.mu.Lock()
+	e.servers.http = server
+	e.servers.mu.Unlock()
 	http.HandleFunc("/query", e.handleQuery)
+	http.HandleFunc("/pivot", e.handlePivot)
+	http.HandleFunc("/pivot/zeek", e.handlePivot)
+	http.HandleFunc("/explain", e.handleExplain)
+	http.HandleFunc("/flows", e.handleFlows)
+	http.HandleFunc("/querysize", e.handleQuerySize)
+	http.HandleFunc("/capabilities", e.handleCapabilities)
+	http.HandleFunc("/bpf/preview", e.handleBPFPreview)
+	http.HandleFunc("/capture/filter", e.handleCaptureFilter)
+	http.HandleFunc("/capture/stats", e.handleCaptureStats)
+	http.HandleFunc("/index/", e.handleIndexStats)
+	http.HandleFunc("/queries", e.handleQueries)
+	http.HandleFunc("/queries/", e.handleQueries)
+	http.HandleFunc("/live", e.handleLive)
+	http.HandleFunc("/forecast", e.handleForecast)
+	http.HandleFunc("/holds", e.handleHolds)
+	http.HandleFunc("/holds/", e.handleHolds)
+	http.HandleFunc("/admin/", e.handleAdmin)
+	http.HandleFunc(replicate.Path, e.handleReplica)
+	http.HandleFunc("/metrics", e.handleMetrics)
+	http.HandleFunc("/healthz", e.handleHealth)
+	http.HandleFunc("/readyz", e.handleReady)
+	http.HandleFunc("/openapi.json", e.handleOpenAPI)
 	http.Handle("/debug/stats", stats.S)
-	return server.ListenAndServeTLS(
-		filepath.Join(e.conf.CertPath, serverCertFilename),
-		filepath.Join(e.conf.CertPath, serverKeyFilename))
+	if e.queryStats != nil {
+		http.Handle("/debug/querystats", e.queryStats)
+	}
+	errs := make(chan error, 2)
+	if e.conf.RPCPort != 0 {
+		go func() { errs <- e.serveRPC() }()
+	}
+	go func() {
+		// The cert comes from tlsConfig.GetCertificate.
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+	return <-errs
 }
 
 func (e *Env) handleQuery(w http.ResponseWriter, r *http.Request) {
 	w = httputil.Log(w, r, true)
 	defer log.Print(w)
+	spanCtx, span := startQuerySpan(r, "query")
+	defer span.End()
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
 
 	limit, err := base.LimitFromHeaders(r.Header)
 	if err != nil {
-		http.Error(w, "Invalid Limit Headers", http.StatusBadRequest)
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "invalid_limit", Message: err.Error()})
 		return
 	}
 
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	format, err := responseFormat(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	payload := false
+	if p := r.URL.Query().Get("payload"); p != "" {
+		if payload, err = strconv.ParseBool(p); err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: fmt.Sprintf("invalid payload parameter %q", p)})
+			return
+		}
+	}
+	dedup, err := dedupWindow(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	resume, err := parseResume(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	estimate := false
+	if p := r.URL.Query().Get("estimate"); p != "" {
+		if estimate, err = strconv.ParseBool(p); err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: fmt.Sprintf("invalid estimate parameter %q", p)})
+			return
+		}
+	}
+	snaplen := base.SnapLen
+	if s := r.URL.Query().Get("snaplen"); s != "" {
+		if snaplen, err = strconv.Atoi(s); err != nil || snaplen < 1 {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: fmt.Sprintf("invalid snaplen parameter %q", s)})
+			return
+		} else if snaplen > base.SnapLen {
+			snaplen = base.SnapLen
+		}
+	}
 	queryBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "could not read request body", http.StatusBadRequest)
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
 		return
 	}
-	q, err := query.NewQuery(string(queryBytes))
+	_, parse := tracer.Start(spanCtx, "parse")
+	q, err := query.ParseWithOptions(string(queryBytes), opts)
+	parse.End()
 	if err != nil {
-		http.Error(w, "could not parse query", http.StatusBadRequest)
+		span.SetStatus(codes.Error, err.Error())
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
 		return
 	}
+	q = grant.Restrict(q, time.Now())
+	span.SetAttributes(attribute.String("query", q.String()))
+	if warning := e.retentionWarning(q); warning != nil {
+		if b, err := json.Marshal(warning); err == nil {
+			w.Header().Set("Steno-Warning", string(b))
+		}
+	}
+	defer querySeconds.SecondsTimer()()
 	ctx := httputil.Context(w, r, time.Minute*15)
 	defer ctx.Cancel()
-	packets := e.Lookup(ctx, q)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	base.PacketsToFile(packets, w, limit)
+	out := &countingWriter{}
+	id := e.running.add(r.URL.Path, httputil.Identity(r), string(queryBytes), &out.n, ctx.Cancel)
+	defer e.running.remove(id)
+	// Index lookups and blockfile reads are traced as children of the query,
+	// and log which query they're for.
+	lookupCtx := base.WithLogAttrs(trace.ContextWithSpan(ctx, span), "query_id", id, "client", httputil.Identity(r))
+	if estimate {
+		// Sent before any packets, so clients can show their progress.
+		if size, err := e.estimateSize(ctx, q); err != nil {
+			log.Printf("could not estimate query size: %v", err)
+		} else {
+			w.Header().Set("Steno-Estimated-Packets", strconv.FormatInt(size.Packets, 10))
+			w.Header().Set("Steno-Estimated-Bytes", strconv.FormatInt(size.Bytes, 10))
+		}
+	}
+	packets := e.lookup(lookupCtx, q, format != formatPcap, dedup, resume)
+	switch format {
+	case formatPcapng:
+		w.Header().Set("Content-Type", pcapngContentType)
+	case formatNDJSON:
+		w.Header().Set("Content-Type", ndjsonContentType)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// Clients can verify the packets they received against these trailers, sent
+	// once it's all been written, and resume from Steno-Resume if it failed or
+	// hit a limit.
+	w.Header().Set("Trailer", "Steno-Sha256, Steno-Error, Steno-Packets, Steno-Resume")
+	// The checksum is of the uncompressed response.
+	hash := sha256.New()
+	cw, closeCompression := httputil.Compress(w, r)
+	stream := httputil.NewStream(cw, ctx, queryFlushInterval, e.queryStallTimeout())
+	out.w = io.MultiWriter(stream, hash)
+	w.Header().Set("Steno-Query-Id", strconv.FormatInt(id, 10))
+	start := time.Now()
+	_, write := tracer.Start(spanCtx, "write")
+	var count int64
+	tracker := newResumeTracker(resume)
+	switch format {
+	case formatPcapng:
+		count, err = packetsToPcapng(packets, out, limit, string(queryBytes), e.threadInterfaces(), snaplen, tracker.wrote)
+	case formatNDJSON:
+		count, err = packetsToNDJSON(packets, out, limit, e.threadInterfaces(), payload, snaplen, tracker.wrote)
+	default:
+		count, err = base.PacketsToFileWatch(packets, out, limit, snaplen, tracker.wrote)
+	}
+	closeCompression()
+	stream.Close()
+	write.SetAttributes(attribute.Int64("bytes", out.n))
+	write.End()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	w.Header().Set("Steno-Sha256", sum)
+	w.Header().Set("Steno-Packets", strconv.FormatInt(count, 10))
+	if token := tracker.token(); token != "" {
+		w.Header().Set("Steno-Resume", token)
+	}
+	if err != nil {
+		w.Header().Set("Steno-Error", err.Error())
+	}
+	e.recordRetrieval(audit.Record{
+		QueryID: id,
+		API:     r.URL.Path,
+		Client:  httputil.Identity(r),
+		Query:   string(queryBytes),
+		Packets: count,
+		Bytes:   out.n,
+		SHA256:  sum,
+	}, err)
+	if e.queryStats != nil {
+		rec := querystats.Record{
+			Start:    start,
+			Duration: time.Since(start),
+			Client:   httputil.Identity(r),
+			Query:    q.String(),
+			Bytes:    out.n,
+		}
+		if err != nil {
+			rec.Err = err.Error()
+		}
+		if err := e.queryStats.Add(rec); err != nil {
+			log.Printf("could not record query stats: %v", err)
+		}
+	}
+}
+
+// queryStallTimeout returns how long a client may stop reading a query's
+// response before the query is canceled.
+func (e *Env) queryStallTimeout() time.Duration {
+	e.confMu.RLock()
+	defer e.confMu.RUnlock()
+	if e.conf.QueryStallTimeout == "" {
+		return defaultQueryStallTimeout
+	}
+	d, _ := time.ParseDuration(e.conf.QueryStallTimeout) // checked by Validate
+	return d
+}
+
+// queryError is the JSON body returned for queries that can't be run.
+type queryError struct {
+	Code       string // Machine-readable error type, like "parse_error".
+	Message    string
+	Position   *int   `json:",omitempty"` // Character offset of a parse error.
+	Suggestion string `json:",omitempty"` // Keyword the user may have meant.
+}
+
+// parseQueryError returns the queryError for a query that failed to parse.
+func parseQueryError(err error) queryError {
+	qe := queryError{Code: "parse_error", Message: err.Error()}
+	if pe, ok := err.(*query.ParseError); ok {
+		qe.Message, qe.Position, qe.Suggestion = pe.Message, &pe.Position, pe.Suggestion
+	}
+	return qe
+}
+
+func writeQueryError(w http.ResponseWriter, status int, qe queryError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(qe)
+}
+
+// countingWriter counts the bytes written through it.  n is updated
+// atomically, so other goroutines can read it while it's written to.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
 }
 
 // New returns a new Env for use in running Stenotype.
@@ -120,44 +404,245 @@ func New(c config.Config) (_ *Env, returnedErr error) {
 			os.RemoveAll(dirname)
 		}
 	}()
-	threads, err := thread.Threads(c.Threads, dirname, filecache.NewCache(c.MaxOpenFiles))
+	fc := filecache.NewCache(c.MaxOpenFiles)
+	threads, err := thread.Threads(c.Threads, dirname, fc)
 	if err != nil {
 		return nil, err
 	}
+	for _, t := range threads {
+		if c.ReadOnly {
+			t.SetReadOnly()
+		} else if err := t.ClaimWriter(); err != nil {
+			return nil, err
+		}
+	}
 	d := &Env{
 		conf:    c,
 		name:    dirname,
 		threads: threads,
 		done:    make(chan bool),
+		fc:      fc,
+		started: time.Now(),
+	}
+	if c.QueryStatsPath != "" {
+		if d.queryStats, err = querystats.Open(c.QueryStatsPath); err != nil {
+			return nil, err
+		}
+	}
+	if tokensEnabled(c) {
+		if d.tokens, err = tokenauth.New(c.APITokens, c.OIDCIssuer, c.OIDCClientID); err != nil {
+			return nil, err
+		}
+	}
+	if c.AuthzPolicyPath != "" {
+		if d.authorizer, err = authz.New(c.AuthzPolicyPath); err != nil {
+			return nil, err
+		}
+	}
+	if c.HoldDirectory != "" {
+		if d.holds, err = hold.Open(c.HoldDirectory); err != nil {
+			return nil, err
+		}
+	}
+	if c.AuditLogPath != "" {
+		if d.auditLog, err = audit.Open(c.AuditLogPath, c.AuditLogMaxMB<<20, c.AuditSyslog); err != nil {
+			return nil, err
+		}
+	}
+	if c.Captures() {
+		if d.captures, err = newCaptures(c, dirname); err != nil {
+			return nil, err
+		}
+		if d.captureFilterHex, err = compileCaptureFilters(c.Interfaces(), c.CaptureFilter); err != nil {
+			return nil, err
+		}
+	}
+	applyQuerySettings(c)
+	if c.IndexLookupCacheBytes != 0 {
+		blockfile.PositionsCacheBytes = c.IndexLookupCacheBytes
+	}
+	indexfile.UseMmap = c.MmapIndexes
+	if c.MmapIndexMaxBytes > 0 {
+		indexfile.MmapMaxBytes = c.MmapIndexMaxBytes
+	}
+	indexfile.BlockCacheBytes = c.IndexBlockCacheBytes
+	thread.VerifyIndexesOnOpen = c.VerifyIndexesOnOpen
+	if c.RollupPeriod != "" {
+		thread.RollupPeriod, _ = time.ParseDuration(c.RollupPeriod) // checked by Validate
+	}
+	if c.CompressCodec != "" {
+		if _, err := blockfile.CodecByName(c.CompressCodec); err != nil {
+			return nil, err
+		}
+		thread.CompressCodec = c.CompressCodec
+	}
+	if c.CompressCPUPercent > 0 {
+		thread.CompressCPU = float64(c.CompressCPUPercent) / 100
+	}
+	if c.CompressAge != "" {
+		// Replicas need this too, to notice files the writer compresses.
+		thread.CompressAge, _ = time.ParseDuration(c.CompressAge) // checked by Validate
+	}
+	switch {
+	case c.EncryptionKeyFile != "":
+		if encrypt.Keys, err = encrypt.ReadMasterKeyFile(c.EncryptionKeyFile); err != nil {
+			return nil, fmt.Errorf("could not read encryption key: %v", err)
+		}
+	case c.EncryptionKeyCommand != "":
+		if encrypt.Keys, err = encrypt.NewCommandWrapper(c.EncryptionKeyCommand); err != nil {
+			return nil, err
+		}
+	}
+	if d.stopTracing, err = startTracing(c); err != nil {
+		return nil, err
 	}
 	go d.callEvery(d.syncFiles, fileSyncFrequency)
+	// The retention target may be set by reloading the config, so it's always
+	// checked.
+	d.retentionShort = make([]bool, len(threads))
+	go d.callEvery(d.checkRetention, retentionCheckFrequency)
+	if c.IndexVerifyInterval != "" {
+		interval, _ := time.ParseDuration(c.IndexVerifyInterval) // checked by Validate
+		go d.callEvery(d.verifyIndexes, interval)
+	}
+	if c.RollupAge != "" && !c.ReadOnly {
+		thread.RollupAge, _ = time.ParseDuration(c.RollupAge) // checked by Validate
+		go d.callEvery(d.compactRollups, rollupFrequency)
+	}
+	if c.CompressAge != "" && !c.ReadOnly {
+		go d.callEvery(d.compressFiles, compressFrequency)
+	}
+	if encrypt.Keys != nil && !c.ReadOnly {
+		go d.callEvery(d.encryptFiles, encryptFrequency)
+	}
+	if c.ArchiveURL != "" {
+		store, err := archive.NewStore(c.ArchiveURL, c.ArchiveEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		catalog, err := archive.OpenCatalog(c.ArchiveCatalogPath)
+		if err != nil {
+			return nil, err
+		}
+		d.archive = archive.New(store, catalog, filepath.Join(dirname, "archive"), fc)
+		if !c.ReadOnly {
+			for _, t := range threads {
+				t.SetArchiver(d.archive)
+			}
+			go d.callEvery(d.archiveFiles, archiveFrequency)
+		}
+	}
+	if err := d.setUpReplication(c); err != nil {
+		return nil, err
+	}
+	if err := d.setUpAlerts(c); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
-// args is the set of command line arguments to pass to stentype.
-func (d *Env) args() []string {
-	return append(d.conf.Flags,
-		fmt.Sprintf("--threads=%d", len(d.conf.Threads)),
-		fmt.Sprintf("--iface=%s", d.conf.Interface),
-		fmt.Sprintf("--dir=%s", d.Path()))
+// args is the set of command line arguments to pass to stentype to run c.
+func (d *Env) args(c *capture) []string {
+	d.confMu.RLock()
+	defer d.confMu.RUnlock()
+	args := append([]string(nil), d.conf.Flags...)
+	if hex := d.captureFilterHex[c.iface]; hex != "" {
+		args = append(args, "--filter="+hex)
+	}
+	if d.conf.CaptureBackend == "afxdp" {
+		queues := make([]string, len(c.threads))
+		for j, n := range c.threads {
+			queues[j] = strconv.Itoa(d.conf.ThreadQueue(n))
+		}
+		args = append(args, "--xdp", "--xdp_queues="+strings.Join(queues, ","))
+	}
+	if c.cpus != nil {
+		cpus := make([]string, len(c.cpus))
+		for j, cpu := range c.cpus {
+			cpus[j] = strconv.Itoa(cpu)
+		}
+		args = append(args, "--thread_cpus="+strings.Join(cpus, ","))
+	}
+	return append(args,
+		fmt.Sprintf("--threads=%d", len(c.threads)),
+		fmt.Sprintf("--iface=%s", c.iface),
+		fmt.Sprintf("--dir=%s", c.dir))
 }
 
 // stenotype returns a exec.Cmd which runs the stenotype binary with all of
-// the appropriate flags.
-func (d *Env) stenotype() *exec.Cmd {
-	v(0, "Starting stenotype")
-	args := d.args()
+// the appropriate flags to run c.
+func (d *Env) stenotype(c *capture) *exec.Cmd {
+	v(0, "Starting stenotype on %v", c.iface)
+	args := d.args(c)
 	v(1, "Starting as %q with args %q", d.conf.StenotypePath, args)
 	return exec.Command(d.conf.StenotypePath, args...)
 }
 
 // Env contains information necessary to run Stenotype.
 type Env struct {
+	// conf's fields which Reload changes are guarded by confMu.
 	conf    config.Config
+	confMu  sync.RWMutex
 	name    string
 	threads []*thread.Thread
-	done    chan bool
+	done    chan bool // Closed by Shutdown, to stop background work.
 	fc      *filecache.Cache
+	started time.Time
+	// captures are the stenotypes run, one per interface, unless read-only.
+	captures []*capture
+	// stenotypeMu guards each capture's running process.
+	stenotypeMu sync.Mutex
+	// capturing tracks RunStenotype's runCaptures.
+	capturing sync.WaitGroup
+	// servers are what Serve is serving the APIs with.
+	servers servers
+	// captureFilterHex is conf.CaptureFilter compiled for each interface's
+	// stenotype's --filter flag.  Guarded by confMu.
+	captureFilterHex map[string]string
+	// queryStats records query executions, if configured.
+	queryStats *querystats.Store
+	// archive holds files aged out of the threads, if configured.
+	archive *archive.Archive
+	// replicator copies the threads' files to a standby, and receiver
+	// receives them on one, if configured.
+	replicator *replicate.Sender
+	receiver   *replicate.Receiver
+	// holds preserves the packets of queries on legal hold, if configured.
+	holds *hold.Store
+	// auditLog records every packet retrieval, if configured.
+	auditLog *audit.Log
+	// authorizer limits what each client may query, if configured.
+	authorizer *authz.Authorizer
+	// tokens authenticates clients with bearer tokens, if configured.
+	tokens *tokenauth.Authenticator
+	// authMu guards authorizer and tokens, which Reload replaces.
+	authMu sync.RWMutex
+	// tlsConfig is what both APIs serve with, set by Serve.
+	tlsConfig *tls.Config
+	// certs are the CA, and maybe server, certs tlsConfig uses, unless they
+	// come from SPIFFE.
+	certs *certs.Reloader
+	// configFile is where the config was read from, set by WatchConfig, so
+	// /admin/reload can reread it.
+	configFile string
+	// retentionShort tracks which threads were last seen below the retention
+	// target.  Only used by checkRetention.
+	retentionShort []bool
+	// rebuilding holds the packet files whose indexes are being rebuilt.
+	rebuilding   map[string]bool
+	rebuildingMu sync.Mutex
+	// rebuildOne is held while rebuilding an index, so only one is rebuilt at
+	// a time.
+	rebuildOne sync.Mutex
+	// running tracks the queries being served.
+	running queryRegistry
+	// writeRates tracks how fast each thread writes files, for forecasts.
+	writeRates writeRates
+	// alerts checks threads against the alert limits, if configured.  Only
+	// used by checkAlerts.
+	alerts *alert.Monitor
+	// stopTracing flushes and stops the trace exporter.
+	stopTracing func()
 	// StenotypeOutput is the writer that stenotype STDOUT/STDERR will be
 	// redirected to.
 	StenotypeOutput io.Writer
@@ -166,6 +651,15 @@ type Env struct {
 // Close closes the directory.  This should only be done when stenotype has
 // stopped using it.  After this call, Env should no longer be used.
 func (d *Env) Close() error {
+	if d.queryStats != nil {
+		d.queryStats.Close()
+	}
+	if d.auditLog != nil {
+		d.auditLog.Close()
+	}
+	if d.stopTracing != nil {
+		d.stopTracing()
+	}
 	return os.RemoveAll(d.name)
 }
 
@@ -216,44 +710,54 @@ func filesIn(dir string) (map[string]os.FileInfo, error) {
 	return out, nil
 }
 
-// removeOldFiles removes hidden files from previous runs, as well as packet
+// removeOldFiles removes hidden files from previous runs of the given threads, as well as packet
 // files without indexes and vice versa.
-func (d *Env) removeOldFiles() {
-	for _, thread := range d.conf.Threads {
-		v(1, "Checking %q/%q for stale pkt/idx files...", thread.PacketsDirectory, thread.IndexDirectory)
-		removeHiddenFilesFrom(thread.PacketsDirectory)
-		removeHiddenFilesFrom(thread.IndexDirectory)
-		packetFiles, err := filesIn(thread.PacketsDirectory)
-		if err != nil {
-			log.Printf("could not get files from %q: %v", thread.PacketsDirectory, err)
-			continue
-		}
-		indexFiles, err := filesIn(thread.IndexDirectory)
-		if err != nil {
-			log.Printf("could not get files from %q: %v", thread.IndexDirectory, err)
-			continue
-		}
-		var mismatchedFilesToRemove []string
-		for file := range packetFiles {
-			if indexFiles[file] == nil {
-				mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.PacketsDirectory, file))
-				log.Printf("Removing packet file %q without index found in %q", file, thread.PacketsDirectory)
+func (d *Env) removeOldFiles(threads []int) {
+	for _, i := range threads {
+		t := d.threads[i]
+		dirs := t.Config().Directories()
+		// Holding the files lock keeps the thread from moving files between
+		// its directories while they're checked.
+		unlock := t.LockFiles()
+		for _, thread := range dirs {
+			v(1, "Checking %q/%q for stale pkt/idx files...", thread.PacketsDirectory, thread.IndexDirectory)
+			removeHiddenFilesFrom(thread.PacketsDirectory)
+			removeHiddenFilesFrom(thread.IndexDirectory)
+			packetFiles, err := filesIn(thread.PacketsDirectory)
+			if err != nil {
+				log.Printf("could not get files from %q: %v", thread.PacketsDirectory, err)
+				continue
 			}
-		}
-		for file := range indexFiles {
-			if packetFiles[file] == nil {
-				mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.IndexDirectory, file))
-				log.Printf("Removing index file %q without packets found in %q", file, thread.IndexDirectory)
+			indexFiles, err := filesIn(thread.IndexDirectory)
+			if err != nil {
+				log.Printf("could not get files from %q: %v", thread.IndexDirectory, err)
+				continue
 			}
-		}
-		for _, file := range mismatchedFilesToRemove {
-			v(2, "Removing file %q", file)
-			if err := os.Remove(file); err != nil {
-				log.Printf("Unable to remove mismatched file %q", file)
-			} else {
-				rmMismatchFiles.Increment()
+			var mismatchedFilesToRemove []string
+			for file := range packetFiles {
+				if indexFiles[file] == nil && d.conf.RebuildMissingIndexes {
+					d.rebuildIndex(filepath.Join(thread.PacketsDirectory, file), filepath.Join(thread.IndexDirectory, file))
+				} else if indexFiles[file] == nil {
+					mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.PacketsDirectory, file))
+					log.Printf("Removing packet file %q without index found in %q", file, thread.PacketsDirectory)
+				}
+			}
+			for file := range indexFiles {
+				if packetFiles[file] == nil && !indexfile.IsShardPath(file) {
+					mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.IndexDirectory, file))
+					log.Printf("Removing index file %q without packets found in %q", file, thread.IndexDirectory)
+				}
+			}
+			for _, file := range mismatchedFilesToRemove {
+				v(2, "Removing file %q", file)
+				if err := os.Remove(file); err != nil {
+					log.Printf("Unable to remove mismatched file %q", file)
+				} else {
+					rmMismatchFiles.Increment()
+				}
 			}
 		}
+		unlock()
 	}
 }
 
@@ -261,6 +765,42 @@ func (d *Env) syncFiles() {
 	for _, t := range d.threads {
 		t.SyncFiles()
 	}
+	d.sampleWriteRates()
+}
+
+// verifyIndexes checks all threads' indexes for corruption.
+func (d *Env) verifyIndexes() {
+	for _, t := range d.threads {
+		t.VerifyIndexes(context.Background())
+	}
+}
+
+// compactRollups merges old indexes into rollups in all threads.
+func (d *Env) compactRollups() {
+	for _, t := range d.threads {
+		t.CompactRollups(context.Background())
+	}
+}
+
+// compressFiles compresses old packet files in all threads.
+func (d *Env) compressFiles() {
+	for _, t := range d.threads {
+		t.CompressFiles(context.Background())
+	}
+}
+
+// archiveFiles archives files not yet archived in all threads.
+func (d *Env) archiveFiles() {
+	for _, t := range d.threads {
+		t.ArchiveFiles(context.Background())
+	}
+}
+
+// encryptFiles encrypts newly written packet and index files in all threads.
+func (d *Env) encryptFiles() {
+	for _, t := range d.threads {
+		t.EncryptFiles(context.Background())
+	}
 }
 
 // Path returns the underlying directory path for the given Env.
@@ -271,21 +811,107 @@ func (d *Env) Path() string {
 // Lookup looks up the given query in all blockfiles currently known in this
 // Env.
 func (d *Env) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	return d.lookup(ctx, q, false, 0, nil)
+}
+
+// lookup is Lookup, optionally setting each packet's
+// CaptureInfo.InterfaceIndex to the thread it came from, dropping duplicate
+// packets within dedup of each other, and resuming from a point a client
+// gave.
+func (d *Env) lookup(ctx context.Context, q query.Query, tagThreads bool, dedup time.Duration, resume *resumePoint) *base.PacketChan {
+	lookup := q
+	if inner, ok := query.Bidirectional(q); ok {
+		flows, err := query.FlowQuery(ctx, q, d.lookupAll(ctx, inner, false))
+		if err != nil {
+			out := base.NewPacketChan(0)
+			out.Close(err)
+			return out
+		}
+		lookup = flows
+	}
+	if resume != nil {
+		lookup = query.After(lookup, resume.ts)
+	}
+	packets := d.lookupAll(ctx, lookup, tagThreads)
+	if dedup > 0 {
+		packets = dedupPackets(ctx, packets, dedup)
+	}
+	packets = query.Sample(ctx, q, packets)
+	if resume != nil {
+		packets = resumePackets(ctx, packets, resume)
+	}
+	return packets
+}
+
+// lookupAll looks up q in every thread, applying any bpf filter it has.
+func (d *Env) lookupAll(ctx context.Context, q query.Query, tagThreads bool) *base.PacketChan {
 	var inputs []*base.PacketChan
-	for _, thread := range d.threads {
-		inputs = append(inputs, thread.Lookup(ctx, q))
+	for i, thread := range d.threads {
+		tq := query.Scope(q, i, d.threadInterface(i))
+		packets := thread.Lookup(ctx, tq)
+		if d.archive != nil {
+			// Archived files are only searched where they're older than those
+			// still on disk, which may also have been archived.
+			archived := d.archive.Lookup(ctx, i, tq, thread.OldestFileTimestamp())
+			packets = base.MergePacketChans(ctx, []*base.PacketChan{archived, packets})
+		}
+		packets = query.Filter(ctx, tq, packets)
+		if tagThreads {
+			packets = tagInterface(ctx, packets, i)
+		}
+		inputs = append(inputs, packets)
 	}
 	return base.MergePacketChans(ctx, inputs)
 }
 
+// threadInterface returns the network interface the i'th thread's packets
+// come from.
+func (d *Env) threadInterface(i int) string {
+	return d.conf.ThreadInterface(i)
+}
+
+// threadInterfaces returns the network interface each thread's packets come
+// from.
+func (d *Env) threadInterfaces() []string {
+	out := make([]string, len(d.threads))
+	for i := range out {
+		out[i] = d.threadInterface(i)
+	}
+	return out
+}
+
 // ExportDebugHandlers exports a few debugging handlers to an HTTP ServeMux.
 func (d *Env) ExportDebugHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, false)
 		defer log.Print(w)
 		w.Header().Set("Content-Type", "application/json")
+		d.confMu.RLock()
+		defer d.confMu.RUnlock()
 		json.NewEncoder(w).Encode(d.conf)
 	})
+	mux.HandleFunc("/debug/retention", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		if d.retentionTarget() == 0 {
+			http.Error(w, "no RetentionTarget configured", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.retentionStatuses())
+	})
+	mux.HandleFunc("/debug/leafstats", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(query.LeafStats())
+	})
+	mux.HandleFunc("/debug/recommendations", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.recommendations())
+	})
 	for _, thread := range d.threads {
 		thread.ExportDebugHandlers(mux)
 	}
@@ -307,9 +933,18 @@ func (d *Env) ExportDebugHandlers(mux *http.ServeMux) {
 // MinLastFileSeen returns the timestamp of the oldest among the newest files
 // created by all threads.
 func (d *Env) MinLastFileSeen() time.Time {
+	all := make([]int, len(d.threads))
+	for i := range all {
+		all[i] = i
+	}
+	return d.minLastFileSeen(all)
+}
+
+// minLastFileSeen is MinLastFileSeen for the given threads.
+func (d *Env) minLastFileSeen(threads []int) time.Time {
 	var t time.Time
-	for _, thread := range d.threads {
-		ls := thread.FileLastSeen()
+	for _, i := range threads {
+		ls := d.threads[i].FileLastSeen()
 		if t.IsZero() || ls.Before(t) {
 			t = ls
 		}
@@ -319,17 +954,18 @@ func (d *Env) MinLastFileSeen() time.Time {
 
 // runStaleFileCheck watches files generated by stenotype to make sure it's
 // regularly generating new files.  It will Kill() stenotype if it doesn't see
-// at least one new file every maxFileLastSeenDuration in each thread directory.
-func (d *Env) runStaleFileCheck(cmd *exec.Cmd, done chan struct{}) {
+// at least one new file every maxFileLastSeenDuration in each of c's thread
+// directories.
+func (d *Env) runStaleFileCheck(c *capture, cmd *exec.Cmd, done chan struct{}) {
 	ticker := time.NewTicker(maxFileLastSeenDuration)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			v(2, "Checking stenotype for stale files...")
-			diff := time.Now().Sub(d.MinLastFileSeen())
+			diff := time.Now().Sub(d.minLastFileSeen(c.threads))
 			if diff > maxFileLastSeenDuration {
-				log.Printf("Restarting stenotype due to stale file.  Age: %v", diff)
+				log.Printf("Restarting stenotype on %v due to stale file.  Age: %v", c.iface, diff)
 				if err := cmd.Process.Kill(); err != nil {
 					log.Fatalf("Failed to kill stenotype,  stale file found: %v", err)
 				}
@@ -347,37 +983,85 @@ const (
 	maxFileLastSeenDuration       = time.Minute * 5
 )
 
-// runStenotypeOnce runs the stenotype binary a single time, returning any
-// errors associated with its running.
-func (d *Env) runStenotypeOnce() error {
-	d.removeOldFiles()
-	cmd := d.stenotype()
+// runStenotypeOnce runs the stenotype binary for c a single time, returning
+// how it exited, if it started, and any errors associated with its running.
+// Its output is also written to tail.
+func (d *Env) runStenotypeOnce(c *capture, tail io.Writer) (*os.ProcessState, error) {
+	d.removeOldFiles(c.threads)
+	for _, n := range c.threads {
+		d.threads[n].Place()
+	}
+	cmd := d.stenotype(c)
 	done := make(chan struct{})
 	defer close(done)
 	// Start running stenotype.
-	cmd.Stdout = d.StenotypeOutput
-	cmd.Stderr = d.StenotypeOutput
+	out := io.MultiWriter(&captureStatsWriter{threads: c.threads}, tail)
+	if d.StenotypeOutput != nil {
+		out = io.MultiWriter(d.StenotypeOutput, out)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("cannot start stenotype: %v", err)
+		return nil, fmt.Errorf("cannot start stenotype: %v", err)
 	}
-	go d.runStaleFileCheck(cmd, done)
+	d.setStenotype(c, cmd.Process)
+	defer d.setStenotype(c, nil)
+	go d.runStaleFileCheck(c, cmd, done)
 	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("stenotype wait failed: %v", err)
+		return cmd.ProcessState, fmt.Errorf("stenotype wait failed: %v", err)
 	}
-	return fmt.Errorf("stenotype stopped")
+	return cmd.ProcessState, fmt.Errorf("stenotype stopped")
 }
 
-// RunStenotype keeps the stenotype binary running, restarting it if necessary
-// but trying not to allow crash loops.
+// RunStenotype keeps a stenotype binary running for each interface,
+// restarting them if necessary but trying not to allow crash loops, until
+// Shutdown stops them.
 func (d *Env) RunStenotype() {
-	for {
+	if d.conf.ReadOnly {
+		log.Printf("Read-only replica, not running stenotype")
+		return
+	}
+	if d.conf.Standby {
+		log.Printf("Standby, not running stenotype")
+		return
+	}
+	for _, c := range d.captures {
+		d.capturing.Add(1)
+		go func(c *capture) {
+			defer d.capturing.Done()
+			d.runCapture(c)
+		}(c)
+	}
+	d.capturing.Wait()
+}
+
+// runCapture keeps stenotype running for c.  When it fails, a crash report
+// is logged, and it's restarted after a backoff which doubles each time it
+// fails again without running for minStenotypeRuntimeForRestart, so a crash
+// loop doesn't spin.
+func (d *Env) runCapture(c *capture) {
+	var backoff time.Duration
+	for !d.stopping() {
 		start := time.Now()
-		v(1, "Running Stenotype")
-		err := d.runStenotypeOnce()
+		v(1, "Running Stenotype on %v", c.iface)
+		tail := &tailWriter{max: crashOutputBytes}
+		state, err := d.runStenotypeOnce(c, tail)
 		duration := time.Since(start)
-		log.Printf("Stenotype stopped after %v: %v", duration, err)
-		if duration < minStenotypeRuntimeForRestart {
-			log.Fatalf("Stenotype ran for too little time, crashing to avoid stenotype crash loop")
+		log.Printf("Stenotype on %v stopped after %v: %v", c.iface, duration, err)
+		if d.stopping() {
+			return
+		}
+		if d.restartRequested(c) {
+			continue
+		}
+		backoff = stenotypeBackoff(backoff, duration)
+		d.reportCrash(newCrashReport(c.iface, start, duration, state, err, tail.String()))
+		d.stenotypeFailed(c, backoff)
+		log.Printf("Restarting stenotype on %v in %v", c.iface, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-d.done:
+			return
 		}
 	}
 }
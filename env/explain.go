@@ -0,0 +1,119 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/thread"
+	"../thread"
+)
+
+// explanation is the response to an /explain request.
+type explanation struct {
+	*query.Explanation
+	Threads []threadExplanation
+	// EstimatedPackets is how many packets the indexes match, before any
+	// post-filtering or sampling, excluding files where the query matches
+	// every packet.  Those are counted in AllPacketsFiles and
+	// AllPacketsBytes instead.
+	EstimatedPackets int
+	AllPacketsFiles  int
+	AllPacketsBytes  int64
+}
+
+// threadExplanation lists the files a query would read in a single thread.
+type threadExplanation struct {
+	Thread    int
+	Interface string
+	Files     []thread.FileEstimate
+}
+
+// queryVars returns the ?var.NAME=VALUE query variables passed in r.
+func queryVars(r *http.Request) map[string]string {
+	vars := map[string]string{}
+	for k, v := range r.URL.Query() {
+		if strings.HasPrefix(k, "var.") && len(v) > 0 {
+			vars[k[len("var."):]] = v[0]
+		}
+	}
+	return vars
+}
+
+// handleExplain parses a query and describes how it would be run, looking up
+// matching positions in the indexes but without reading any packets.
+func (e *Env) handleExplain(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	queryBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
+		return
+	}
+	q, exp, err := query.NewQueryExplained(string(queryBytes), opts)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
+		return
+	}
+	q = grant.Restrict(q, time.Now())
+	if inner, ok := query.Bidirectional(q); ok {
+		// The second pass depends on the packets the first one finds, so
+		// only the first can be explained.
+		q = inner
+	}
+	ctx := httputil.Context(w, r, time.Minute)
+	defer ctx.Cancel()
+	out := explanation{Explanation: exp}
+	for i, t := range e.threads {
+		iface := e.threadInterface(i)
+		files, err := t.Explain(ctx, query.Scope(q, i, iface))
+		if err != nil {
+			writeQueryError(w, http.StatusInternalServerError, queryError{Code: "index_error", Message: err.Error()})
+			return
+		}
+		for _, f := range files {
+			if f.Packets < 0 {
+				out.AllPacketsFiles++
+				out.AllPacketsBytes += f.Bytes
+			} else {
+				out.EstimatedPackets += f.Packets
+			}
+		}
+		out.Threads = append(out.Threads, threadExplanation{Thread: i, Interface: iface, Files: files})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,212 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/query"
+	"../query"
+	"golang.org/x/net/context"
+)
+
+// maxFlowRecords limits how many flows a /flows request may aggregate, since
+// they're all kept in memory until the query's done.
+const maxFlowRecords = 1 << 20
+
+// flowKey is a directional 5-tuple, plus the interface the flow was seen on.
+type flowKey struct {
+	Interface        string
+	SrcIP, DstIP     string
+	Protocol         string
+	SrcPort, DstPort uint16
+}
+
+// flowRecord summarizes the packets of a flow matched by a query.
+type flowRecord struct {
+	flowKey
+	FirstSeen, LastSeen time.Time
+	Packets             int64
+	Bytes               int64  // Original lengths on the wire.
+	TCPFlags            string `json:",omitempty"` // Every flag seen.
+	tcpFlags            uint8
+}
+
+// aggregateFlows reads packets from in, and sums them up into flows.
+// Packets with no IP layer are left out.
+func aggregateFlows(ctx context.Context, in *base.PacketChan, ifaces []string) ([]*flowRecord, error) {
+	defer in.Discard()
+	flows := map[flowKey]*flowRecord{}
+	for p := range in.Receive() {
+		if base.ContextDone(ctx) {
+			return nil, ctx.Err()
+		}
+		r := recordOf(p, ifaces, false)
+		if r.SrcIP == "" {
+			continue
+		}
+		key := flowKey{r.Interface, r.SrcIP, r.DstIP, r.Protocol, r.SrcPort, r.DstPort}
+		f := flows[key]
+		if f == nil {
+			if len(flows) >= maxFlowRecords {
+				return nil, fmt.Errorf("query matched more than %d flows", maxFlowRecords)
+			}
+			f = &flowRecord{flowKey: key, FirstSeen: r.Time, LastSeen: r.Time}
+			flows[key] = f
+		}
+		if r.Time.Before(f.FirstSeen) {
+			f.FirstSeen = r.Time
+		}
+		if r.Time.After(f.LastSeen) {
+			f.LastSeen = r.Time
+		}
+		f.Packets++
+		f.Bytes += int64(r.Length)
+		f.tcpFlags |= r.tcpFlags
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]*flowRecord, 0, len(flows))
+	for _, f := range flows {
+		f.TCPFlags = formatTCPFlags(f.tcpFlags)
+		out = append(out, f)
+	}
+	sort.Sort(flowsByFirstSeen(out))
+	return out, nil
+}
+
+type flowsByFirstSeen []*flowRecord
+
+func (f flowsByFirstSeen) Len() int      { return len(f) }
+func (f flowsByFirstSeen) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f flowsByFirstSeen) Less(i, j int) bool {
+	if !f[i].FirstSeen.Equal(f[j].FirstSeen) {
+		return f[i].FirstSeen.Before(f[j].FirstSeen)
+	}
+	return f[i].LastSeen.Before(f[j].LastSeen)
+}
+
+// writeFlowsCSV writes flows as CSV, with a header line.
+func writeFlowsCSV(out io.Writer, flows []*flowRecord) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"interface", "src_ip", "dst_ip", "protocol", "src_port", "dst_port",
+		"first_seen", "last_seen", "packets", "bytes", "tcp_flags"})
+	for _, f := range flows {
+		w.Write([]string{f.Interface, f.SrcIP, f.DstIP, f.Protocol,
+			strconv.Itoa(int(f.SrcPort)), strconv.Itoa(int(f.DstPort)),
+			f.FirstSeen.Format(time.RFC3339Nano), f.LastSeen.Format(time.RFC3339Nano),
+			strconv.FormatInt(f.Packets, 10), strconv.FormatInt(f.Bytes, 10), f.TCPFlags})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// handleFlows runs a query like /query, but returns a summary of each flow
+// the matching packets belong to rather than the packets themselves.  The
+// query is the q URL parameter, or the request body.
+func (e *Env) handleFlows(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	useCSV := false
+	switch f := r.URL.Query().Get("format"); f {
+	case "", formatNDJSON:
+		useCSV = f == "" && strings.Contains(r.Header.Get("Accept"), "text/csv")
+	case "csv":
+		useCSV = true
+	default:
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: fmt.Sprintf("unknown format %q", f)})
+		return
+	}
+	dedup, err := dedupWindow(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	queryString := r.URL.Query().Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := query.ParseWithOptions(queryString, opts)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
+		return
+	}
+	q = grant.Restrict(q, time.Now())
+	if warning := e.retentionWarning(q); warning != nil {
+		if b, err := json.Marshal(warning); err == nil {
+			w.Header().Set("Steno-Warning", string(b))
+		}
+	}
+	defer querySeconds.SecondsTimer()()
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	out := &countingWriter{}
+	id := e.running.add(r.URL.Path, httputil.Identity(r), queryString, &out.n, ctx.Cancel)
+	defer e.running.remove(id)
+	w.Header().Set("Steno-Query-Id", strconv.FormatInt(id, 10))
+	flows, err := aggregateFlows(ctx, e.lookup(base.WithLogAttrs(ctx, "query_id", id, "client", httputil.Identity(r)), q, true, dedup, nil), e.threadInterfaces())
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, queryError{Code: "query_failed", Message: err.Error()})
+		return
+	}
+	cw, closeCompression := httputil.Compress(w, r)
+	defer closeCompression()
+	out.w = cw
+	if useCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		err = writeFlowsCSV(out, flows)
+	} else {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		enc := json.NewEncoder(out)
+		for _, f := range flows {
+			if err = enc.Encode(f); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("error writing flows: %v", err)
+	}
+}
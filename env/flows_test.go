@@ -0,0 +1,215 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ipv4TCPAck is ipv4TCP with only ACK set.
+	ipv4TCPAck = "0800" + "4500002e123440004006abcd0a0000010a000002" + "c9e7005000000001000000005010ffff0000000068656c6c6f21"
+	// ipv4TCPReply is a SYN|ACK replying to ipv4TCP.
+	ipv4TCPReply = "0800" + "4500002e123440004006abcd0a0000020a000001" + "0050c9e700000001000000015012ffff0000000068656c6c6f21"
+)
+
+func TestAggregateFlows(t *testing.T) {
+	ts := time.Unix(1500000000, 0).UTC()
+	in := packetChan(
+		threadPacket(t, 0, ts.Add(time.Second), 60, macs, ipv4TCP),
+		threadPacket(t, 0, ts.Add(3*time.Second), 1500, macs, ipv4TCPAck),
+		threadPacket(t, 0, ts, 60, macs, ipv4TCPAck), // Read out of order.
+		threadPacket(t, 0, ts.Add(2*time.Second), 60, macs, ipv4TCPReply),
+		threadPacket(t, 1, ts.Add(time.Second), 60, macs, ipv4TCP),
+		threadPacket(t, 0, ts.Add(500*time.Millisecond), 70, macs, ipv6UDP),
+		threadPacket(t, 0, ts, 42, macs, arp), // No IP layer.
+	)
+	got, err := aggregateFlows(context.Background(), in, []string{"eth0", "eth1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range got {
+		f.tcpFlags = 0
+	}
+	want := []*flowRecord{
+		{
+			flowKey:   flowKey{"eth0", "10.0.0.1", "10.0.0.2", "TCP", 51687, 80},
+			FirstSeen: ts, LastSeen: ts.Add(3 * time.Second),
+			Packets: 3, Bytes: 1620, TCPFlags: "SYN|ACK",
+		},
+		{
+			flowKey:   flowKey{"eth0", "2001:db8::1", "2001:db8::2", "UDP", 54321, 53},
+			FirstSeen: ts.Add(500 * time.Millisecond), LastSeen: ts.Add(500 * time.Millisecond),
+			Packets: 1, Bytes: 70,
+		},
+		{
+			flowKey:   flowKey{"eth1", "10.0.0.1", "10.0.0.2", "TCP", 51687, 80},
+			FirstSeen: ts.Add(time.Second), LastSeen: ts.Add(time.Second),
+			Packets: 1, Bytes: 60, TCPFlags: "SYN",
+		},
+		{
+			flowKey:   flowKey{"eth0", "10.0.0.2", "10.0.0.1", "TCP", 80, 51687},
+			FirstSeen: ts.Add(2 * time.Second), LastSeen: ts.Add(2 * time.Second),
+			Packets: 1, Bytes: 60, TCPFlags: "SYN|ACK",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for i := 0; i < len(got) || i < len(want); i++ {
+			var g, w *flowRecord
+			if i < len(got) {
+				g = got[i]
+			}
+			if i < len(want) {
+				w = want[i]
+			}
+			if !reflect.DeepEqual(g, w) {
+				t.Errorf("flow %d: got %+v, want %+v", i, g, w)
+			}
+		}
+	}
+}
+
+func TestAggregateFlowsErrors(t *testing.T) {
+	in := base.NewPacketChan(1)
+	in.Send(threadPacket(t, 0, time.Unix(0, 0), 60, macs, ipv4TCP))
+	readErr := errors.New("disk on fire")
+	in.Close(readErr)
+	if _, err := aggregateFlows(context.Background(), in, nil); err != readErr {
+		t.Errorf("failed read got %v, want %v", err, readErr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := aggregateFlows(ctx, packetChan(threadPacket(t, 0, time.Unix(0, 0), 60, macs, ipv4TCP)), nil); err != context.Canceled {
+		t.Errorf("canceled query got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWriteFlowsCSV(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 500000000, time.UTC)
+	var buf bytes.Buffer
+	if err := writeFlowsCSV(&buf, []*flowRecord{{
+		flowKey:   flowKey{"eth0", "10.0.0.1", "10.0.0.2", "TCP", 51687, 80},
+		FirstSeen: ts, LastSeen: ts.Add(time.Second),
+		Packets: 3, Bytes: 1620, TCPFlags: "SYN|ACK",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "interface,src_ip,dst_ip,protocol,src_port,dst_port,first_seen,last_seen,packets,bytes,tcp_flags\n" +
+		"eth0,10.0.0.1,10.0.0.2,TCP,51687,80,2017-07-14T02:40:00.5Z,2017-07-14T02:40:01.5Z,3,1620,SYN|ACK\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandleFlows(t *testing.T) {
+	e, cleanup := rpcEnv(t)
+	defer cleanup()
+	for _, test := range []struct {
+		desc     string
+		method   string
+		url      string
+		body     string
+		accept   string
+		cn, ou   string
+		wantCode int
+		wantType string
+		wantPkts int64
+	}{
+		{"NDJSON", "GET", "/flows?q=port+67", "", "", "analyst", "soc", http.StatusOK, ndjsonContentType, dhcpPackets},
+		{"query in body", "POST", "/flows", "port 67", "", "analyst", "soc", http.StatusOK, ndjsonContentType, dhcpPackets},
+		{"CSV", "GET", "/flows?q=port+67&format=csv", "", "", "analyst", "soc", http.StatusOK, "text/csv", dhcpPackets},
+		{"CSV accepted", "GET", "/flows?q=port+67", "", "text/csv", "analyst", "soc", http.StatusOK, "text/csv", dhcpPackets},
+		{"flows only", "GET", "/flows?q=port+67", "", "", "oncall", "noc", http.StatusOK, ndjsonContentType, dhcpPackets},
+		{"restricted to other subnets", "GET", "/flows?q=port+67", "", "", "contractor", "", http.StatusOK, ndjsonContentType, 0},
+		{"no match", "GET", "/flows?q=port+69", "", "", "analyst", "soc", http.StatusOK, ndjsonContentType, 0},
+		{"unknown client", "GET", "/flows?q=port+67", "", "", "stranger", "", http.StatusForbidden, "", 0},
+		{"no certificate", "GET", "/flows?q=port+67", "", "", "", "", http.StatusForbidden, "", 0},
+		{"unknown format", "GET", "/flows?q=port+67&format=pcap", "", "", "analyst", "soc", http.StatusBadRequest, "", 0},
+		{"bad query", "GET", "/flows?q=port+67+and", "", "", "analyst", "soc", http.StatusBadRequest, "", 0},
+	} {
+		r := certRequest(test.method, test.url, test.cn, test.ou)
+		r.Body = ioutil.NopCloser(strings.NewReader(test.body))
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		e.handleFlows(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%v: got status %v (%s), want %v", test.desc, w.Code, w.Body.String(), test.wantCode)
+			continue
+		}
+		if test.wantCode != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != test.wantType {
+			t.Errorf("%v: got Content-Type %q, want %q", test.desc, got, test.wantType)
+		}
+		if w.Header().Get("Steno-Query-Id") == "" {
+			t.Errorf("%v: no Steno-Query-Id", test.desc)
+		}
+		var packets int64
+		if test.wantType == "text/csv" {
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil || len(rows) == 0 || rows[0][0] != "interface" {
+				t.Errorf("%v: got CSV %v, %v; want a header line", test.desc, rows, err)
+				continue
+			}
+			for _, row := range rows[1:] {
+				if row[3] != "UDP" {
+					t.Errorf("%v: got flow %q, want UDP", test.desc, row)
+				}
+				n, err := strconv.ParseInt(row[8], 10, 64)
+				if err != nil {
+					t.Errorf("%v: got flow %q: %v", test.desc, row, err)
+				}
+				packets += n
+			}
+		} else {
+			for scanner := bufio.NewScanner(w.Body); scanner.Scan(); {
+				var f flowRecord
+				if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+					t.Errorf("%v: decoding %q: %v", test.desc, scanner.Text(), err)
+					continue
+				}
+				if f.Protocol != "UDP" || (f.SrcPort != 67 && f.DstPort != 67) {
+					t.Errorf("%v: got flow %+v, want UDP port 67", test.desc, f)
+				}
+				packets += f.Packets
+			}
+		}
+		if packets != test.wantPkts {
+			t.Errorf("%v: got %d packets in flows, want %d", test.desc, packets, test.wantPkts)
+		}
+	}
+	if jobs := e.running.list(); len(jobs) != 0 {
+		t.Errorf("queries still running: %v", jobs)
+	}
+}
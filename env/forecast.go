@@ -0,0 +1,234 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// writeRateWindow is how far back write rates are averaged over.
+const writeRateWindow = time.Hour
+
+// minWriteRateWindow is how long a thread's writes must be watched before its
+// write rate is known.
+const minWriteRateWindow = 5 * time.Minute
+
+// writeSample is how many bytes of files a thread had written at a time.
+type writeSample struct {
+	at      time.Time
+	written int64
+}
+
+// writeRates tracks the rate each thread writes files at, averaged over the
+// last writeRateWindow.  Its zero value is ready to use.
+type writeRates struct {
+	mu      sync.Mutex
+	samples [][]writeSample // By thread, oldest first.
+}
+
+// add records that thread had written the given bytes by now.
+func (w *writeRates) add(thread int, now time.Time, written int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.samples) <= thread {
+		w.samples = append(w.samples, nil)
+	}
+	s := append(w.samples[thread], writeSample{now, written})
+	// Keep the newest sample at least writeRateWindow old, so the window is
+	// always fully covered once we've run that long.
+	drop := 0
+	for drop+1 < len(s) && now.Sub(s[drop+1].at) >= writeRateWindow {
+		drop++
+	}
+	w.samples[thread] = s[drop:]
+}
+
+// rate returns the bytes per second thread has written recently, or false if
+// it hasn't been watched long enough to tell.
+func (w *writeRates) rate(thread int) (float64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if thread >= len(w.samples) || len(w.samples[thread]) < 2 {
+		return 0, false
+	}
+	s := w.samples[thread]
+	first, last := s[0], s[len(s)-1]
+	elapsed := last.at.Sub(first.at)
+	if elapsed < minWriteRateWindow {
+		return 0, false
+	}
+	return float64(last.written-first.written) / elapsed.Seconds(), true
+}
+
+// sampleWriteRates records how much each thread has written.  It's called
+// after syncing files, so the files already on disk at startup are in the
+// first sample rather than counted as written.
+func (d *Env) sampleWriteRates() {
+	now := time.Now()
+	for i, t := range d.threads {
+		d.writeRates.add(i, now, t.Usage().Written)
+		if r, ok := d.writeRates.rate(i); ok {
+			stats.S.Get(fmt.Sprintf("thread%d_write_bytes_per_second", i)).Set(int64(r))
+		}
+	}
+}
+
+// diskForecast describes how much packet history a packets directory
+// retains, and how much it will once current traffic has filled it.
+type diskForecast struct {
+	Dir     string
+	Threads []int // Writing to Dir.
+	// Oldest is when the oldest file in Dir was started, the horizon before
+	// which packets are gone.
+	Oldest          time.Time `json:",omitempty"`
+	Retained        string    // How far back Oldest is.
+	RetainedSeconds float64
+	// WriteBytesPerSecond is how fast Dir's threads have written files over
+	// the last hour, or 0 until they've been watched for a few minutes.
+	WriteBytesPerSecond float64
+	UsedBytes           int64 // By the threads' files.
+	// UsableBytes is how many bytes the threads' files may take before the
+	// oldest are deleted, given the disk's free space and the threads'
+	// DiskFreePercentage, MinFreeBytes and MaxBytes.
+	UsableBytes int64
+	// Forecast is how much history UsableBytes holds at the current write
+	// rate, limited by the threads' MaxAge and MaxDirectoryFiles.  It's
+	// empty until the write rate is known.
+	Forecast        string  `json:",omitempty"`
+	ForecastSeconds float64 `json:",omitempty"`
+}
+
+// diskForecasts returns a forecast for each packets directory, sorted by
+// directory.
+func (d *Env) diskForecasts() []diskForecast {
+	now := time.Now()
+	byDir := map[string]*diskForecast{}
+	var dirs []string
+	// Limits the threads on each disk put on its history.  Each only applies
+	// if every thread on the disk has it.
+	type limits struct {
+		reserve, maxBytes int64
+		maxAge, maxFiles  time.Duration
+		allMaxBytes       bool
+		allMaxAge         bool
+		rate              float64
+		rateKnown         bool
+	}
+	lim := map[string]*limits{}
+	for i, t := range d.threads {
+		conf := t.Config()
+		f := byDir[conf.PacketsDirectory]
+		if f == nil {
+			f = &diskForecast{Dir: conf.PacketsDirectory}
+			byDir[f.Dir] = f
+			lim[f.Dir] = &limits{allMaxBytes: true, allMaxAge: true}
+			dirs = append(dirs, f.Dir)
+		}
+		l := lim[f.Dir]
+		f.Threads = append(f.Threads, i)
+		u := t.Usage()
+		f.UsedBytes += u.Bytes
+		if !u.Oldest.IsZero() && (f.Oldest.IsZero() || u.Oldest.Before(f.Oldest)) {
+			f.Oldest = u.Oldest
+		}
+		if r, ok := d.writeRates.rate(i); ok {
+			l.rate += r
+			l.rateKnown = true
+		}
+		if total, err := base.PathDiskTotalBytes(conf.PacketsDirectory); err == nil {
+			if r := total * int64(conf.DiskFreePercentage) / 100; r > l.reserve {
+				l.reserve = r
+			}
+		}
+		if conf.MinFreeBytes > l.reserve {
+			l.reserve = conf.MinFreeBytes
+		}
+		if conf.MaxBytes > 0 {
+			l.maxBytes += conf.MaxBytes
+		} else {
+			l.allMaxBytes = false
+		}
+		if age, err := time.ParseDuration(conf.MaxAge); err == nil && age > 0 {
+			if age > l.maxAge {
+				l.maxAge = age
+			}
+		} else {
+			l.allMaxAge = false
+		}
+		// MaxDirectoryFiles caps history at that many files, at the rate
+		// they've been started, however little is written to them.
+		if u.Files > 1 {
+			perFile := u.Newest.Sub(u.Oldest) / time.Duration(u.Files-1)
+			if files := perFile * time.Duration(conf.MaxDirectoryFiles); files > l.maxFiles {
+				l.maxFiles = files
+			}
+		}
+	}
+	sort.Strings(dirs)
+	out := make([]diskForecast, 0, len(dirs))
+	for _, dir := range dirs {
+		f, l := byDir[dir], lim[dir]
+		if !f.Oldest.IsZero() {
+			retained := now.Sub(f.Oldest)
+			f.Retained, f.RetainedSeconds = retained.String(), retained.Seconds()
+		}
+		if free, err := base.PathDiskFreeBytes(dir); err != nil {
+			log.Printf("could not get free bytes for %q: %v", dir, err)
+		} else if f.UsableBytes = f.UsedBytes + free - l.reserve; f.UsableBytes < 0 {
+			f.UsableBytes = 0
+		}
+		if l.allMaxBytes && l.maxBytes < f.UsableBytes {
+			f.UsableBytes = l.maxBytes
+		}
+		f.WriteBytesPerSecond = l.rate
+		if l.rateKnown && l.rate > 0 {
+			forecast := time.Duration(float64(f.UsableBytes) / l.rate * float64(time.Second))
+			if l.allMaxAge && l.maxAge < forecast {
+				forecast = l.maxAge
+			}
+			if l.maxFiles > 0 && l.maxFiles < forecast {
+				forecast = l.maxFiles
+			}
+			f.Forecast, f.ForecastSeconds = forecast.String(), forecast.Seconds()
+		}
+		out = append(out, *f)
+	}
+	return out
+}
+
+// handleForecast serves each packets directory's retention horizon and
+// forecast at /forecast.
+func (e *Env) handleForecast(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.diskForecasts())
+}
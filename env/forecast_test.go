@@ -0,0 +1,149 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteRates(t *testing.T) {
+	var w writeRates
+	start := time.Unix(1500000000, 0)
+	if _, ok := w.rate(0); ok {
+		t.Error("rate known without samples")
+	}
+	w.add(1, start, 1000)
+	if _, ok := w.rate(1); ok {
+		t.Error("rate known from one sample")
+	}
+	w.add(1, start.Add(time.Minute), 7000)
+	if _, ok := w.rate(1); ok {
+		t.Errorf("rate known after %v, want only after %v", time.Minute, minWriteRateWindow)
+	}
+	w.add(1, start.Add(10*time.Minute), 61000)
+	if r, ok := w.rate(1); !ok || r != 100 {
+		t.Errorf("after 10m got rate %v, %v; want 100", r, ok)
+	}
+	if _, ok := w.rate(0); ok {
+		t.Error("rate known for a thread without samples")
+	}
+	// Samples older than the window are dropped, but one at least the
+	// window old is kept.
+	w.add(1, start.Add(70*time.Minute), 61000+60*60*10)
+	if r, ok := w.rate(1); !ok || r != 10 {
+		t.Errorf("after 70m got rate %v, %v; want 10 over the last hour", r, ok)
+	}
+	w.add(1, start.Add(200*time.Minute), 61000+60*60*10)
+	if r, ok := w.rate(1); !ok || r != 0 {
+		t.Errorf("after 200m got rate %v, %v; want 0 after writing nothing", r, ok)
+	}
+}
+
+func TestDiskForecasts(t *testing.T) {
+	now := time.Now()
+	// Files are started an hour apart, so keeping at most 10 of them keeps
+	// 10 hours.
+	starts := []time.Time{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Hour)}
+	for _, test := range []struct {
+		desc     string
+		maxBytes int64
+		maxAge   string
+		rate     int64 // Bytes written per second, or 0 if unknown.
+		want     time.Duration
+	}{
+		{"limited by bytes", 36000, "", 10, time.Hour},
+		{"limited by files", 3600000, "", 10, 10 * time.Hour},
+		{"limited by age", 3600000, "2h", 10, 2 * time.Hour},
+		{"rate unknown", 36000, "", 0, 0},
+	} {
+		e, cleanup := retentionEnv(t, 10, starts)
+		conf := e.threads[0].Config()
+		conf.MaxBytes, conf.MaxAge = test.maxBytes, test.maxAge
+		if err := e.threads[0].SetConfig(conf); err != nil {
+			t.Fatalf("%v: %v", test.desc, err)
+		}
+		if test.rate > 0 {
+			e.writeRates.add(0, now.Add(-10*time.Minute), 0)
+			e.writeRates.add(0, now, test.rate*600)
+		}
+		got := e.diskForecasts()
+		cleanup()
+		if len(got) != 1 {
+			t.Errorf("%v: got %d forecasts, want 1", test.desc, len(got))
+			continue
+		}
+		f := got[0]
+		if f.Dir != conf.PacketsDirectory || len(f.Threads) != 1 || f.Threads[0] != 0 {
+			t.Errorf("%v: got %q for threads %v, want %q for thread 0", test.desc, f.Dir, f.Threads, conf.PacketsDirectory)
+		}
+		if !f.Oldest.Equal(starts[0].Truncate(time.Microsecond)) || f.RetainedSeconds < 3*3600 || f.RetainedSeconds > 3*3600+60 {
+			t.Errorf("%v: got oldest %v, retained %v; want %v, 3h", test.desc, f.Oldest, f.Retained, starts[0])
+		}
+		if f.UsedBytes <= 0 || f.UsableBytes != test.maxBytes {
+			t.Errorf("%v: got %d bytes used of %d, want some of %d", test.desc, f.UsedBytes, f.UsableBytes, test.maxBytes)
+		}
+		if f.WriteBytesPerSecond != float64(test.rate) {
+			t.Errorf("%v: got %v bytes per second, want %v", test.desc, f.WriteBytesPerSecond, test.rate)
+		}
+		if test.want == 0 {
+			if f.Forecast != "" || f.ForecastSeconds != 0 {
+				t.Errorf("%v: got forecast %q, want none", test.desc, f.Forecast)
+			}
+		} else if f.Forecast != test.want.String() || f.ForecastSeconds != test.want.Seconds() {
+			t.Errorf("%v: got forecast %q (%vs), want %v", test.desc, f.Forecast, f.ForecastSeconds, test.want)
+		}
+	}
+}
+
+func TestDiskForecastsSorted(t *testing.T) {
+	e, cleanup := retentionEnv(t, 10, nil, nil, nil)
+	defer cleanup()
+	got := e.diskForecasts()
+	if len(got) != 3 {
+		t.Fatalf("got %d forecasts, want one for each thread's directory", len(got))
+	}
+	for i, f := range got {
+		if i > 0 && f.Dir <= got[i-1].Dir {
+			t.Errorf("got %q after %q, want directories sorted", f.Dir, got[i-1].Dir)
+		}
+		// Without files, nothing's retained yet.
+		if !f.Oldest.IsZero() || f.Retained != "" || f.UsedBytes != 0 {
+			t.Errorf("%q: got %+v, want nothing retained", f.Dir, f)
+		}
+	}
+}
+
+func TestHandleForecast(t *testing.T) {
+	e, cleanup := retentionEnv(t, 10, []time.Time{time.Now().Add(-time.Hour)})
+	defer cleanup()
+	w := httptest.NewRecorder()
+	e.handleForecast(w, httptest.NewRequest("GET", "/forecast", nil))
+	var got []diskForecast
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %v, Content-Type %q; want %v JSON", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+	} else if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got) != 1 || got[0].Retained == "" {
+		t.Errorf("got %+v, %v; want a forecast retaining the thread's file", got, err)
+	}
+
+	w = httptest.NewRecorder()
+	e.handleForecast(w, httptest.NewRequest("POST", "/forecast", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got status %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// healthCheck is the result of one check in the response to /healthz or
+// /readyz.
+type healthCheck struct {
+	// Name is "stenotype", "disk", "index_freshness", "thread_lag" or
+	// "capture_downtime".
+	Name   string
+	Thread *int `json:",omitempty"` // The thread checked, if it's per-thread.
+	// Interface is the one whose stenotype was checked, if it's of stenotype.
+	Interface string `json:",omitempty"`
+	OK        bool
+	Message   string
+}
+
+// healthStatus is the response to /healthz or /readyz.
+type healthStatus struct {
+	OK     bool
+	Checks []healthCheck
+}
+
+// setStenotype records the stenotype process currently running for c, or
+// nil once it's stopped.
+func (d *Env) setStenotype(c *capture, p *os.Process) {
+	d.stenotypeMu.Lock()
+	defer d.stenotypeMu.Unlock()
+	c.process = p
+	if p != nil && d.stopping() {
+		// Started as Shutdown signaled the others.
+		p.Signal(syscall.SIGTERM)
+	}
+	if p == nil {
+		c.downSince = time.Now()
+	} else {
+		c.downSince = time.Time{}
+	}
+}
+
+// checkStenotype checks that each interface's stenotype is running, or
+// waiting to be restarted after failing, which isn't cause to restart
+// stenographer too.
+func (d *Env) checkStenotype() (out []healthCheck) {
+	now := time.Now()
+	for _, cp := range d.captures {
+		c := healthCheck{Name: "stenotype", Interface: cp.iface}
+		d.stenotypeMu.Lock()
+		p, restarts, restartAt := cp.process, cp.restarts, cp.restartAt
+		d.stenotypeMu.Unlock()
+		switch {
+		case p == nil && restartAt.After(now):
+			c.OK = true
+			c.Message = fmt.Sprintf("restarting in %v, after failing %d times", restartAt.Sub(now).Truncate(time.Second), restarts)
+		case p == nil:
+			c.Message = "not running"
+		case p.Signal(syscall.Signal(0)) != nil:
+			c.Message = fmt.Sprintf("pid %d has exited", p.Pid)
+		default:
+			c.OK, c.Message = true, fmt.Sprintf("running as pid %d", p.Pid)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// checkWritable checks that a file can be created in dir.  The file is
+// hidden, so stenographer ignores it, and removes it at startup if it's left
+// behind.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".healthz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte{0}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkThreads checks each thread's directories are writable, if disk is
+// set, and that its files are up to date.
+func (d *Env) checkThreads(disk bool) (out []healthCheck) {
+	now := time.Now()
+	for i, t := range d.threads {
+		i := i
+		if disk {
+			c := healthCheck{Name: "disk", Thread: &i, OK: true, Message: "writable"}
+			conf := d.conf.Threads[i]
+			for _, dir := range []string{conf.PacketsDirectory, conf.IndexDirectory} {
+				if err := checkWritable(dir); err != nil {
+					c.OK, c.Message = false, fmt.Sprintf("%q not writable: %v", dir, err)
+					break
+				}
+			}
+			out = append(out, c)
+		}
+		// Files are named for when stenotype started writing them, and
+		// stenotype starts a new one at least every minute.
+		c := healthCheck{Name: "index_freshness", Thread: &i}
+		if newest := t.Usage().Newest; newest.IsZero() {
+			c.OK = now.Sub(d.started) < maxFileLastSeenDuration
+			c.Message = "no files yet"
+		} else {
+			age := now.Sub(newest)
+			c.OK = age < maxFileLastSeenDuration
+			c.Message = fmt.Sprintf("newest file started %v ago", age.Truncate(time.Second))
+		}
+		out = append(out, c)
+		// Lag is how long it's been since the thread picked up a new file,
+		// which is what runStaleFileCheck restarts stenotype over.
+		c = healthCheck{Name: "thread_lag", Thread: &i}
+		last := t.FileLastSeen()
+		if last.IsZero() {
+			last = d.started
+		}
+		lag := now.Sub(last)
+		c.OK = lag < maxFileLastSeenDuration
+		c.Message = fmt.Sprintf("last new file seen %v ago", lag.Truncate(time.Second))
+		out = append(out, c)
+	}
+	return out
+}
+
+// health runs the liveness checks, and the readiness checks too if ready is
+// set, including stenotype's downtime if MaxCaptureDowntime is.  Read-only replicas neither run stenotype nor write, so only their
+// files' freshness is checked, and standbys don't run stenotype.
+func (d *Env) health(ready bool) healthStatus {
+	var checks []healthCheck
+	if d.conf.Captures() {
+		checks = append(checks, d.checkStenotype()...)
+	}
+	for _, c := range d.checkThreads(!d.conf.ReadOnly) {
+		if ready || c.Name == "disk" {
+			checks = append(checks, c)
+		}
+	}
+	if ready && d.conf.Captures() {
+		checks = append(checks, d.checkCaptureDowntime()...)
+	}
+	s := healthStatus{OK: true, Checks: checks}
+	for _, c := range checks {
+		s.OK = s.OK && c.OK
+	}
+	return s
+}
+
+// handleHealth serves /healthz, whether stenographer is alive:  stenotype is
+// running and every thread's disks are writable.  Failing this needs a
+// restart or an operator.
+func (e *Env) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, e.health(false))
+}
+
+// handleReady serves /readyz, whether queries return recent packets:  the
+// /healthz checks, and every thread has recent files.
+func (e *Env) handleReady(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, e.health(true))
+}
+
+// writeHealth writes s as JSON, with status 503 if it's not OK.
+func writeHealth(w http.ResponseWriter, s healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
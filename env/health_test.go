@@ -0,0 +1,232 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+// healthEnv returns an Env capturing from eth0 into one thread, which has a
+// file started each of ages ago, and a function cleaning up after it.  The
+// thread's directories are writable, and stenotype is running.
+func healthEnv(t *testing.T, ages ...time.Duration) (*Env, func()) {
+	files := map[string]string{}
+	for _, age := range ages {
+		files[datedFile(time.Now().Add(-age))] = "dhcp"
+	}
+	threads, cleanupThreads := testThreads(t, 10, files)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+		cleanupThreads()
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	e := &Env{
+		conf: config.Config{
+			Interface: "eth0",
+			Threads:   []config.ThreadConfig{{PacketsDirectory: dir, IndexDirectory: dir}},
+		},
+		threads:  threads,
+		captures: []*capture{{iface: "eth0"}},
+		started:  time.Now(),
+	}
+	e.setStenotype(e.captures[0], self)
+	return e, cleanup
+}
+
+// exitedProcess returns a process which has run and exited.
+func exitedProcess(t *testing.T) *os.Process {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process
+}
+
+// healthResults summarizes s's checks as "name[subject]=ok".
+func healthResults(s healthStatus) []string {
+	var out []string
+	for _, c := range s.Checks {
+		subject := c.Interface
+		if c.Thread != nil {
+			subject = fmt.Sprint(*c.Thread)
+		}
+		out = append(out, fmt.Sprintf("%s[%s]=%v", c.Name, subject, c.OK))
+	}
+	return out
+}
+
+func TestHealth(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		ages   []time.Duration
+		setup  func(e *Env)
+		ready  bool
+		wantOK bool
+		want   []string
+	}{
+		{
+			desc: "alive", ready: false, wantOK: true,
+			want: []string{"stenotype[eth0]=true", "disk[0]=true"},
+		},
+		{
+			desc: "ready", ready: true, wantOK: true,
+			setup: func(e *Env) { e.conf.MaxCaptureDowntime = "1m" },
+			want:  []string{"stenotype[eth0]=true", "disk[0]=true", "index_freshness[0]=true", "thread_lag[0]=true", "capture_downtime[eth0]=true"},
+		},
+		{
+			desc: "stenotype stopped", ready: false, wantOK: false,
+			setup: func(e *Env) { e.setStenotype(e.captures[0], nil) },
+			want:  []string{"stenotype[eth0]=false", "disk[0]=true"},
+		},
+		{
+			desc: "stenotype exited", ready: false, wantOK: false,
+			setup: func(e *Env) { e.setStenotype(e.captures[0], exitedProcess(t)) },
+			want:  []string{"stenotype[eth0]=false", "disk[0]=true"},
+		},
+		{
+			desc: "stenotype waiting to restart", ready: false, wantOK: true,
+			setup: func(e *Env) {
+				e.setStenotype(e.captures[0], nil)
+				e.captures[0].restarts, e.captures[0].restartAt = 2, time.Now().Add(time.Minute)
+			},
+			want: []string{"stenotype[eth0]=true", "disk[0]=true"},
+		},
+		{
+			desc: "stenotype down too long", ready: true, wantOK: false,
+			setup: func(e *Env) {
+				e.conf.MaxCaptureDowntime = "1m"
+				e.setStenotype(e.captures[0], nil)
+				e.captures[0].downSince = time.Now().Add(-2 * time.Minute)
+				e.captures[0].restartAt = time.Now().Add(time.Minute)
+			},
+			want: []string{"stenotype[eth0]=true", "disk[0]=true", "index_freshness[0]=true", "thread_lag[0]=true", "capture_downtime[eth0]=false"},
+		},
+		{
+			desc: "disk not writable", ready: false, wantOK: false,
+			setup: func(e *Env) {
+				e.conf.Threads[0].IndexDirectory = filepath.Join(e.conf.Threads[0].PacketsDirectory, "missing")
+			},
+			want: []string{"stenotype[eth0]=true", "disk[0]=false"},
+		},
+		{
+			desc: "fresh files", ages: []time.Duration{time.Hour, time.Minute}, ready: true, wantOK: true,
+			want: []string{"stenotype[eth0]=true", "disk[0]=true", "index_freshness[0]=true", "thread_lag[0]=true"},
+		},
+		{
+			// The file is an hour old, but was only just seen.
+			desc: "stale files alive", ages: []time.Duration{time.Hour}, ready: false, wantOK: true,
+			want: []string{"stenotype[eth0]=true", "disk[0]=true"},
+		},
+		{
+			desc: "stale files not ready", ages: []time.Duration{time.Hour}, ready: true, wantOK: false,
+			want: []string{"stenotype[eth0]=true", "disk[0]=true", "index_freshness[0]=false", "thread_lag[0]=true"},
+		},
+		{
+			desc: "no files since starting", ready: true, wantOK: false,
+			setup: func(e *Env) { e.started = time.Now().Add(-2 * maxFileLastSeenDuration) },
+			want:  []string{"stenotype[eth0]=true", "disk[0]=true", "index_freshness[0]=false", "thread_lag[0]=false"},
+		},
+		{
+			// Replicas neither run stenotype nor write.
+			desc: "read only", ready: true, wantOK: true,
+			setup: func(e *Env) {
+				e.conf.ReadOnly = true
+				e.conf.Threads[0].IndexDirectory = filepath.Join(e.conf.Threads[0].PacketsDirectory, "missing")
+			},
+			want: []string{"index_freshness[0]=true", "thread_lag[0]=true"},
+		},
+		{
+			desc: "standby", ready: false, wantOK: true,
+			setup: func(e *Env) { e.conf.Standby = true },
+			want:  []string{"disk[0]=true"},
+		},
+	} {
+		e, cleanup := healthEnv(t, test.ages...)
+		if test.setup != nil {
+			test.setup(e)
+		}
+		s := e.health(test.ready)
+		if got := healthResults(s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got checks %q, want %q", test.desc, got, test.want)
+		}
+		if s.OK != test.wantOK {
+			t.Errorf("%v: got OK %v, want %v: %+v", test.desc, s.OK, test.wantOK, s.Checks)
+		}
+		cleanup()
+	}
+}
+
+func TestSetStenotype(t *testing.T) {
+	e, cleanup := healthEnv(t)
+	defer cleanup()
+	cp := e.captures[0]
+	if !cp.downSince.IsZero() {
+		t.Errorf("running: got down since %v, want zero", cp.downSince)
+	}
+	before := time.Now()
+	e.setStenotype(cp, nil)
+	if cp.process != nil || cp.downSince.Before(before) {
+		t.Errorf("stopped: got process %v down since %v, want nil since after %v", cp.process, cp.downSince, before)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	e, cleanup := healthEnv(t, time.Hour)
+	defer cleanup()
+	for _, test := range []struct {
+		path    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"/healthz", e.handleHealth, http.StatusOK},
+		{"/readyz", e.handleReady, http.StatusServiceUnavailable}, // The files are stale.
+	} {
+		w := httptest.NewRecorder()
+		test.handler(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.want {
+			t.Errorf("%v: got status %v, want %v", test.path, w.Code, test.want)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%v: got Content-Type %q, want application/json", test.path, got)
+		}
+		var s healthStatus
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Errorf("%v: decoding response: %v", test.path, err)
+		} else if s.OK != (test.want == http.StatusOK) || len(s.Checks) == 0 {
+			t.Errorf("%v: got %+v, want OK %v with checks", test.path, s, test.want == http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	//"github.com/google/stenographer/authz"
+	"../authz"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/hold"
+	"../hold"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// defaultMaxHoldBytes is how many bytes of packets a hold preserves, unless
+// MaxHoldBytes is set.
+const defaultMaxHoldBytes = 10 << 30
+
+var (
+	holdsPlaced   = stats.S.Get("holds_placed")
+	holdsFailed   = stats.S.Get("holds_failed")
+	holdsReleased = stats.S.Get("holds_released")
+)
+
+// handleHolds places a legal hold on a query's packets with POST /holds,
+// lists holds at /holds, shows one at /holds/ID, returns its packets at
+// /holds/ID/pcap, and releases it with DELETE /holds/ID.  Clients only see
+// and release the holds they placed, unless they may query every packet.
+func (e *Env) handleHolds(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if e.holds == nil {
+		http.Error(w, "holds aren't configured", http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/holds"), "/")
+	if path == "" {
+		switch r.Method {
+		case "GET":
+			grant, ok := e.authorizeRequest(w, r, false)
+			if !ok {
+				return
+			}
+			holds, err := e.holds.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			visible := []hold.Hold{}
+			for _, h := range holds {
+				if mayAccessHold(r, grant, h) {
+					visible = append(visible, h)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(visible)
+		case "POST":
+			e.placeHold(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, pcap := path, false
+	if strings.HasSuffix(path, "/pcap") {
+		id, pcap = strings.TrimSuffix(path, "/pcap"), true
+	}
+	switch {
+	case pcap && r.Method == "GET":
+		e.serveHoldPackets(w, r, id)
+	case pcap:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == "GET":
+		h, ok := e.authorizedHold(w, r, id, false)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h)
+	case r.Method == "DELETE":
+		h, ok := e.authorizedHold(w, r, id, true)
+		if !ok {
+			return
+		}
+		err := e.holds.Release(id)
+		e.recordRetrieval(audit.Record{
+			API:     r.URL.Path,
+			Client:  httputil.Identity(r),
+			Action:  "release_hold",
+			Query:   h.Query,
+			Packets: h.Packets,
+			Bytes:   h.Bytes,
+			SHA256:  h.SHA256,
+		}, err)
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("no hold %q", id), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		holdsReleased.Increment()
+		log.Printf("Hold %s released by %v", id, httputil.Identity(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mayAccessHold returns whether the client making r, with the given grant,
+// may see and release hold h:  it owns h, or it may query every packet.
+// Holds' queries were restricted by whoever placed them, so a restricted
+// grant can't be shown to cover another client's hold.  Holds placed before
+// they had owners are only accessible to unrestricted clients.
+func mayAccessHold(r *http.Request, grant *authz.Grant, h hold.Hold) bool {
+	return (h.Owner != "" && h.Owner == requestOwner(r)) || grant.Unrestricted()
+}
+
+// authorizedHold returns the hold with the given ID, if the client may access
+// it.  packets is whether it's asking for the hold's packets or to release
+// it, rather than its description.  Otherwise it writes an error response
+// and returns false.
+func (e *Env) authorizedHold(w http.ResponseWriter, r *http.Request, id string, packets bool) (hold.Hold, bool) {
+	grant, ok := e.authorizeRequest(w, r, packets)
+	if !ok {
+		return hold.Hold{}, false
+	}
+	h, err := e.holds.Get(id)
+	if os.IsNotExist(err) || (err == nil && !mayAccessHold(r, grant, h)) {
+		// Others' holds are reported missing, so their IDs can't be probed.
+		http.Error(w, fmt.Sprintf("no hold %q", id), http.StatusNotFound)
+		return hold.Hold{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return hold.Hold{}, false
+	}
+	return h, true
+}
+
+// placeHold creates a hold on the query in the q parameter or request body,
+// and preserves its packets in the background, responding with the hold as
+// it's created.
+func (e *Env) placeHold(w http.ResponseWriter, r *http.Request) {
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	limit, err := base.LimitFromHeaders(r.Header)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "invalid_limit", Message: err.Error()})
+		return
+	}
+	e.confMu.RLock()
+	maxBytes := e.conf.MaxHoldBytes
+	e.confMu.RUnlock()
+	if maxBytes == 0 {
+		maxBytes = defaultMaxHoldBytes
+	}
+	if limit.Bytes <= 0 || limit.Bytes > maxBytes {
+		limit.Bytes = maxBytes
+	}
+	queryString := r.URL.Query().Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := query.ParseWithOptions(queryString, opts)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
+		return
+	}
+	q = grant.Restrict(q, time.Now())
+	client := httputil.Identity(r)
+	h, err := e.holds.Create(q.String(), r.URL.Query().Get("reason"), client, requestOwner(r))
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, queryError{Code: "hold_failed", Message: err.Error()})
+		return
+	}
+	holdsPlaced.Increment()
+	log.Printf("Hold %s on %q placed by %v", h.ID, h.Query, client)
+	go e.preserve(h, q, limit)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/holds/"+h.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h)
+}
+
+// preserve copies the packets of hold h, matching q, into the hold store, up
+// to limit.  It runs as a query listed by /queries, so it can be watched and
+// canceled.
+func (e *Env) preserve(h hold.Hold, q query.Query, limit base.Limit) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &countingWriter{}
+	id := e.running.add("/holds", h.Client, h.Query, &out.n, cancel)
+	defer e.running.remove(id)
+	h, err := e.holds.Preserve(h, func(w io.Writer) (int64, bool, error) {
+		out.w = w
+		packets := e.lookup(base.WithLogAttrs(ctx, "query_id", id, "client", h.Client), q, false, 0, nil)
+		n, err := base.PacketsToFileCount(packets, out, limit, base.SnapLen)
+		return n, (limit.Bytes > 0 && out.n >= limit.Bytes) || (limit.Packets > 0 && n >= limit.Packets), err
+	})
+	if err != nil {
+		holdsFailed.Increment()
+		log.Printf("Hold %s failed: %v", h.ID, err)
+	}
+	e.recordRetrieval(audit.Record{
+		QueryID: id,
+		API:     "/holds",
+		Client:  h.Client,
+		Query:   h.Query,
+		Packets: h.Packets,
+		Bytes:   h.Bytes,
+		SHA256:  h.SHA256,
+	}, err)
+}
+
+// serveHoldPackets returns the preserved packets of the hold with the given
+// ID, as a pcap.
+func (e *Env) serveHoldPackets(w http.ResponseWriter, r *http.Request, id string) {
+	h, ok := e.authorizedHold(w, r, id, true)
+	if !ok {
+		return
+	}
+	if h.State != hold.Held {
+		http.Error(w, fmt.Sprintf("hold %s is %s", id, h.State), http.StatusConflict)
+		return
+	}
+	f, err := e.holds.Packets(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Steno-Sha256", h.SHA256)
+	http.ServeContent(w, r, id+".pcap", h.Created, f)
+	e.recordRetrieval(audit.Record{
+		API:     r.URL.Path,
+		Client:  httputil.Identity(r),
+		Query:   h.Query,
+		Packets: h.Packets,
+		Bytes:   h.Bytes,
+		SHA256:  h.SHA256,
+	}, nil)
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+)
+
+// threadIndexStats is one entry in the response to /index/NAME/stats.
+type threadIndexStats struct {
+	Thread int
+	*indexfile.Stats
+}
+
+// handleIndexStats serves /index/NAME/stats, summarizing the index of file
+// NAME in each thread that has one.
+func (e *Env) handleIndexStats(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/index/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "stats" {
+		http.NotFound(w, r)
+		return
+	}
+	var out []threadIndexStats
+	for i, t := range e.threads {
+		s, found, err := t.IndexStats(parts[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if found {
+			out = append(out, threadIndexStats{i, s})
+		}
+	}
+	if len(out) == 0 {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
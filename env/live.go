@@ -0,0 +1,180 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/query"
+	"../query"
+	"golang.org/x/net/context"
+)
+
+// handleLive streams the packets matching a query, POSTed as with /query, as
+// stenotype captures them, until the client disconnects, its limit headers
+// are reached, or ?duration=DURATION passes.
+func (e *Env) handleLive(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	limit, err := base.LimitFromHeaders(r.Header)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "invalid_limit", Message: err.Error()})
+		return
+	}
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	format, err := responseFormat(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	var duration time.Duration
+	if d := r.URL.Query().Get("duration"); d != "" {
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: fmt.Sprintf("invalid duration parameter %q", d)})
+			return
+		}
+	}
+	queryBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
+		return
+	}
+	q, err := query.ParseWithOptions(string(queryBytes), opts)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
+		return
+	}
+	q = grant.Restrict(q, time.Now())
+	if _, ok := query.Bidirectional(q); ok {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "bidirectional queries can't be run live"})
+		return
+	}
+	ctx := httputil.Context(w, r, duration)
+	defer ctx.Cancel()
+	switch format {
+	case formatPcapng:
+		w.Header().Set("Content-Type", pcapngContentType)
+	case formatNDJSON:
+		w.Header().Set("Content-Type", ndjsonContentType)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	out := &countingWriter{}
+	id := e.running.add(r.URL.Path, httputil.Identity(r), string(queryBytes), &out.n, ctx.Cancel)
+	defer e.running.remove(id)
+	packets := e.live(base.WithLogAttrs(ctx, "query_id", id, "client", httputil.Identity(r)), q, format != formatPcap)
+	w.Header().Set("Steno-Query-Id", strconv.FormatInt(id, 10))
+	cw, closeCompression := httputil.Compress(w, r)
+	// Send the headers now, so clients know the query's running before any
+	// packets match it.
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	stream := httputil.NewStream(cw, ctx, queryFlushInterval, e.queryStallTimeout())
+	out.w = stream
+	var count int64
+	switch format {
+	case formatPcapng:
+		count, err = packetsToPcapng(packets, out, limit, string(queryBytes), e.threadInterfaces(), base.SnapLen, nil)
+	case formatNDJSON:
+		count, err = packetsToNDJSON(packets, out, limit, e.threadInterfaces(), false, base.SnapLen, nil)
+	default:
+		count, err = base.PacketsToFileCount(packets, out, limit, base.SnapLen)
+	}
+	closeCompression()
+	stream.Close()
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		err = nil // How live queries normally end.
+	} else if err != nil {
+		log.Printf("Live query %d failed: %v", id, err)
+	}
+	e.recordRetrieval(audit.Record{
+		QueryID: id,
+		API:     r.URL.Path,
+		Client:  httputil.Identity(r),
+		Query:   string(queryBytes),
+		Packets: count,
+		Bytes:   out.n,
+	}, err)
+}
+
+// live returns the packets matching q that are captured from now on, by
+// every thread, in the order they're found rather than strictly by time.
+// If a thread fails, the others carry on, and the error is returned once
+// they're done.
+func (e *Env) live(ctx context.Context, q query.Query, tagThreads bool) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i, thread := range e.threads {
+		tq := query.Scope(q, i, e.threadInterface(i))
+		packets := query.Filter(ctx, tq, thread.Live(ctx, tq))
+		if tagThreads {
+			packets = tagInterface(ctx, packets, i)
+		}
+		wg.Add(1)
+		go func(i int, in *base.PacketChan) {
+			defer wg.Done()
+			defer in.Discard()
+			for p := range in.Receive() {
+				select {
+				case out.C <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err := in.Err(); err != nil && ctx.Err() == nil {
+				base.Logf(ctx, "Thread %d stopped live query: %v", i, err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(i, packets)
+	}
+	go func() {
+		wg.Wait()
+		if firstErr != nil {
+			out.Close(firstErr)
+			return
+		}
+		out.Close(ctx.Err())
+	}()
+	return out
+}
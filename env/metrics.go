@@ -0,0 +1,90 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// metricsPrefix is prepended to every metric /metrics exports.
+const metricsPrefix = "stenographer_"
+
+// querySeconds is how long each query took to serve, over either API.
+var querySeconds = stats.S.Histogram("query_seconds", []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900})
+
+// handleMetrics serves every stat at /metrics in the Prometheus text
+// exposition format, along with per-thread and per-disk gauges.
+func (e *Env) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	stats.S.WritePrometheus(w, metricsPrefix)
+
+	var files, bytes, oldest, packets, drops, captured, writeP99, free []stats.Sample
+	dirs := map[string]bool{}
+	for i, t := range e.threads {
+		conf := e.conf.Threads[i]
+		thread := map[string]string{"thread": strconv.Itoa(i)}
+		disk := map[string]string{"thread": strconv.Itoa(i), "dir": conf.PacketsDirectory}
+		u := t.Usage()
+		files = append(files, stats.Sample{Labels: thread, Value: float64(u.Files)})
+		bytes = append(bytes, stats.Sample{Labels: disk, Value: float64(u.Bytes)})
+		if ts := t.OldestFileTimestamp(); !ts.IsZero() {
+			oldest = append(oldest, stats.Sample{Labels: disk, Value: float64(ts.UnixNano()) / 1e9})
+		}
+		id := strconv.Itoa(i)
+		packets = append(packets, stats.Sample{Labels: thread, Value: float64(captureStat(id, "packets").Value())})
+		drops = append(drops, stats.Sample{Labels: thread, Value: float64(captureStat(id, "drops").Value())})
+		captured = append(captured, stats.Sample{Labels: thread, Value: float64(captureStat(id, "bytes").Value())})
+		writeP99 = append(writeP99, stats.Sample{Labels: disk, Value: float64(captureStat(id, "write_p99_us").Value()) / 1e6})
+		if dirs[conf.PacketsDirectory] {
+			continue
+		}
+		dirs[conf.PacketsDirectory] = true
+		if df, err := base.PathDiskFreePercentage(conf.PacketsDirectory); err == nil {
+			free = append(free, stats.Sample{Labels: map[string]string{"dir": conf.PacketsDirectory}, Value: float64(df)})
+		}
+	}
+	stats.WritePrometheusGauge(w, metricsPrefix+"thread_files", "Blockfiles each thread retains.", files)
+	stats.WritePrometheusGauge(w, metricsPrefix+"thread_disk_bytes", "Bytes of blockfiles each thread retains on disk.", bytes)
+	stats.WritePrometheusGauge(w, metricsPrefix+"thread_oldest_packet_timestamp_seconds", "When the oldest blockfile each thread retains was started, roughly when its oldest packet was captured, in seconds since the epoch.", oldest)
+	var rate, retained, forecast []stats.Sample
+	for _, f := range e.diskForecasts() {
+		dir := map[string]string{"dir": f.Dir}
+		rate = append(rate, stats.Sample{Labels: dir, Value: f.WriteBytesPerSecond})
+		retained = append(retained, stats.Sample{Labels: dir, Value: f.RetainedSeconds})
+		if f.Forecast != "" {
+			forecast = append(forecast, stats.Sample{Labels: dir, Value: f.ForecastSeconds})
+		}
+	}
+	stats.WritePrometheusGauge(w, metricsPrefix+"disk_write_bytes_per_second", "Bytes each packets directory's threads wrote per second, over the last hour.", rate)
+	stats.WritePrometheusGauge(w, metricsPrefix+"disk_retained_seconds", "How far back the oldest file in each packets directory was started.", retained)
+	stats.WritePrometheusGauge(w, metricsPrefix+"disk_forecast_retention_seconds", "How much history each packets directory will retain at its current write rate.", forecast)
+	stats.WritePrometheusGauge(w, metricsPrefix+"disk_free_percent", "Free space on each packets directory's disk.", free)
+	var restarts []stats.Sample
+	e.stenotypeMu.Lock()
+	for _, c := range e.captures {
+		restarts = append(restarts, stats.Sample{Labels: map[string]string{"interface": c.iface}, Value: float64(c.restarts)})
+	}
+	e.stenotypeMu.Unlock()
+	stats.WritePrometheusGauge(w, metricsPrefix+"stenotype_interface_restarts", "Times each interface's stenotype has failed and been restarted.", restarts)
+	stats.WritePrometheusGauge(w, metricsPrefix+"stenotype_packets", "Packets each stenotype thread captured, as of its last stats log line.", packets)
+	stats.WritePrometheusGauge(w, metricsPrefix+"stenotype_dropped_packets", "Packets each stenotype thread dropped, as of its last stats log line.", drops)
+	stats.WritePrometheusGauge(w, metricsPrefix+"stenotype_bytes", "Bytes of packets each stenotype thread captured, as of its last stats log line.", captured)
+	stats.WritePrometheusGauge(w, metricsPrefix+"stenotype_write_p99_seconds", "The 99th percentile of how long each stenotype thread's block writes took, between its last two stats log lines.", writeP99)
+}
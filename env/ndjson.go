@@ -0,0 +1,164 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+)
+
+// ndjsonContentType is sent with, and may be requested in an Accept header
+// to get, NDJSON responses.
+const ndjsonContentType = "application/x-ndjson"
+
+// packetRecord is the JSON written for each packet in NDJSON responses.
+// Fields for layers a packet doesn't have are left out.
+type packetRecord struct {
+	Time          time.Time
+	Interface     string `json:",omitempty"` // Of the thread that captured it.
+	Length        int    // On the wire.
+	CaptureLength int
+
+	SrcMAC    string   `json:",omitempty"`
+	DstMAC    string   `json:",omitempty"`
+	VLANs     []uint16 `json:",omitempty"` // Outermost first.
+	EtherType string   `json:",omitempty"`
+
+	SrcIP    string `json:",omitempty"`
+	DstIP    string `json:",omitempty"`
+	Protocol string `json:",omitempty"`
+	TTL      uint8  `json:",omitempty"` // Or IPv6 hop limit.
+
+	SrcPort  uint16 `json:",omitempty"`
+	DstPort  uint16 `json:",omitempty"`
+	TCPFlags string `json:",omitempty"` // Like "SYN|ACK".
+	tcpFlags uint8
+	ICMPType *uint8 `json:",omitempty"`
+	ICMPCode *uint8 `json:",omitempty"`
+
+	// Payload is the application payload, base64 encoded.  Only sent if
+	// requested.
+	Payload []byte `json:",omitempty"`
+}
+
+// tcpFlagNames are the names of TCP flags, by bit in the TCP header.
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+// tcpFlagBits returns the flags set on a TCP header, one bit each.
+func tcpFlagBits(tcp *layers.TCP) (bits uint8) {
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits
+}
+
+// formatTCPFlags returns flag bits as names, like "SYN|ACK".
+func formatTCPFlags(bits uint8) string {
+	var flags []string
+	for i, name := range tcpFlagNames {
+		if bits&(1<<uint(i)) != 0 {
+			flags = append(flags, name)
+		}
+	}
+	return strings.Join(flags, "|")
+}
+
+// recordOf decodes a packet's metadata.
+func recordOf(p *base.Packet, ifaces []string, payload bool) *packetRecord {
+	r := &packetRecord{Time: p.Timestamp.UTC(), Length: p.Length, CaptureLength: p.CaptureLength}
+	if p.InterfaceIndex >= 0 && p.InterfaceIndex < len(ifaces) {
+		r.Interface = ifaces[p.InterfaceIndex]
+	}
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	transport := false // Set once the outermost transport layer is seen.
+	for _, layer := range pkt.Layers() {
+		if transport {
+			break // Anything further is tunneled.
+		}
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			r.SrcMAC, r.DstMAC, r.EtherType = l.SrcMAC.String(), l.DstMAC.String(), l.EthernetType.String()
+		case *layers.Dot1Q:
+			r.VLANs = append(r.VLANs, l.VLANIdentifier)
+			r.EtherType = l.Type.String()
+		case *layers.IPv4:
+			if r.SrcIP == "" { // Ignore IP-in-IP packets' inner IPs.
+				r.SrcIP, r.DstIP, r.Protocol, r.TTL = l.SrcIP.String(), l.DstIP.String(), l.Protocol.String(), l.TTL
+			}
+		case *layers.IPv6:
+			if r.SrcIP == "" {
+				r.SrcIP, r.DstIP, r.Protocol, r.TTL = l.SrcIP.String(), l.DstIP.String(), l.NextHeader.String(), l.HopLimit
+			}
+		case *layers.TCP:
+			r.SrcPort, r.DstPort, r.tcpFlags = uint16(l.SrcPort), uint16(l.DstPort), tcpFlagBits(l)
+			r.TCPFlags = formatTCPFlags(r.tcpFlags)
+			transport = true
+		case *layers.UDP:
+			r.SrcPort, r.DstPort = uint16(l.SrcPort), uint16(l.DstPort)
+			transport = true
+		case *layers.ICMPv4:
+			typ, code := l.TypeCode.Type(), l.TypeCode.Code()
+			r.ICMPType, r.ICMPCode = &typ, &code
+			transport = true
+		case *layers.ICMPv6:
+			typ, code := l.TypeCode.Type(), l.TypeCode.Code()
+			r.ICMPType, r.ICMPCode = &typ, &code
+			transport = true
+		}
+	}
+	if payload {
+		if app := pkt.ApplicationLayer(); app != nil {
+			r.Payload = app.Payload()
+		}
+	}
+	return r
+}
+
+// packetsToNDJSON is like base.PacketsToFile, but writes a JSON object per
+// packet, one per line, describing its headers.  Each packet's
+// CaptureInfo.InterfaceIndex is the thread it was read from.  Limits count
+// the bytes of JSON written.  Only the first snaplen bytes of each packet are
+// decoded.  It returns how many packets were written, calling wrote, if it's
+// set, with each once it's been written.
+func packetsToNDJSON(in *base.PacketChan, out io.Writer, limit base.Limit, ifaces []string, payload bool, snaplen int, wrote func(*base.Packet)) (int64, error) {
+	defer in.Discard()
+	var count int64
+	cw := &countingWriter{w: out}
+	enc := json.NewEncoder(cw)
+	for p := range in.Receive() {
+		before := cw.n
+		p.Truncate(snaplen)
+		if err := enc.Encode(recordOf(p, ifaces, payload)); err != nil {
+			return count, fmt.Errorf("error writing packet: %v", err)
+		}
+		count++
+		if wrote != nil {
+			wrote(p)
+		}
+		if limit.ShouldStopAfter(base.Limit{Bytes: cw.n - before, Packets: 1}) {
+			return count, nil
+		}
+	}
+	return count, in.Err()
+}
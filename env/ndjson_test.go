@@ -0,0 +1,136 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+func TestPacketsToNDJSON(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 123456789, time.FixedZone("PDT", -7*3600))
+	tcp := packetRecord{
+		Time: ts.UTC(), Interface: "eth1", Length: 60, CaptureLength: 60,
+		SrcMAC: "00:00:00:00:00:01", DstMAC: "00:00:00:00:00:02", EtherType: "IPv4",
+		SrcIP: "10.0.0.1", DstIP: "10.0.0.2", Protocol: "TCP", TTL: 64,
+		SrcPort: 51687, DstPort: 80, TCPFlags: "SYN",
+	}
+	for _, test := range []struct {
+		desc    string
+		in      *base.Packet
+		payload bool
+		snaplen int
+		want    packetRecord
+	}{
+		{"IPv4 TCP", threadPacket(t, 1, ts, 60, macs, ipv4TCP), false, 1500, tcp},
+		{"payload", threadPacket(t, 1, ts, 60, macs, ipv4TCP), true, 1500, func() packetRecord {
+			r := tcp
+			r.Payload = []byte("hello!")
+			return r
+		}()},
+		{"payload past snaplen", threadPacket(t, 1, ts, 60, macs, ipv4TCP), true, 58, func() packetRecord {
+			r := tcp
+			r.CaptureLength, r.Payload = 58, []byte("hell")
+			return r
+		}()},
+		{"TCP header past snaplen", threadPacket(t, 1, ts, 60, macs, ipv4TCP), false, 34, func() packetRecord {
+			r := tcp
+			r.CaptureLength, r.SrcPort, r.DstPort, r.TCPFlags = 34, 0, 0, ""
+			return r
+		}()},
+		{"VLAN tags", threadPacket(t, 1, ts, 68, macs, qinq, vlan, ipv4TCP), false, 1500, func() packetRecord {
+			r := tcp
+			r.Length, r.CaptureLength, r.VLANs = 68, 68, []uint16{101, 100}
+			return r
+		}()},
+		{"IPv6 UDP", threadPacket(t, 0, ts, 70, macs, ipv6UDP), false, 1500, packetRecord{
+			Time: ts.UTC(), Interface: "eth0", Length: 70, CaptureLength: 70,
+			SrcMAC: "00:00:00:00:00:01", DstMAC: "00:00:00:00:00:02", EtherType: "IPv6",
+			SrcIP: "2001:db8::1", DstIP: "2001:db8::2", Protocol: "UDP", TTL: 64,
+			SrcPort: 54321, DstPort: 53,
+		}},
+		{"unknown thread", threadPacket(t, 2, ts, 42, macs, arp), false, 1500, packetRecord{
+			Time: ts.UTC(), Length: 42, CaptureLength: 42,
+			SrcMAC: "00:00:00:00:00:01", DstMAC: "00:00:00:00:00:02", EtherType: "ARP",
+		}},
+	} {
+		var buf bytes.Buffer
+		count, err := packetsToNDJSON(packetChan(test.in), &buf, base.Limit{}, []string{"eth0", "eth1"}, test.payload, test.snaplen, nil)
+		if err != nil || count != 1 {
+			t.Errorf("%v: packetsToNDJSON got %v, %v; want 1, nil", test.desc, count, err)
+			continue
+		}
+		var got packetRecord
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Errorf("%v: decoding %q: %v", test.desc, buf.String(), err)
+			continue
+		}
+		if !got.Time.Equal(test.want.Time) {
+			t.Errorf("%v: got time %v, want %v", test.desc, got.Time, test.want.Time)
+		}
+		got.Time, test.want.Time = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestPacketsToNDJSONEncoding(t *testing.T) {
+	ts := time.Unix(1500000000, 123456789)
+	in := packetChan(
+		threadPacket(t, 0, ts, 60, macs, ipv4TCP),
+		threadPacket(t, 0, ts, 70, macs, ipv6UDP),
+	)
+	var buf bytes.Buffer
+	if _, err := packetsToNDJSON(in, &buf, base.Limit{}, []string{"eth0"}, true, 1500, nil); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&buf)
+	if !scanner.Scan() {
+		t.Fatal("no first line")
+	}
+	first := scanner.Text()
+	for _, want := range []string{
+		`"Time":"2017-07-14T02:40:00.123456789Z"`,
+		`"Interface":"eth0"`,
+		`"TCPFlags":"SYN"`,
+		`"Payload":"aGVsbG8h"`,
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("got %s, want it to contain %s", first, want)
+		}
+	}
+	for _, omitted := range []string{"VLANs", "ICMPType", "ICMPCode", "tcpFlags"} {
+		if strings.Contains(first, `"`+omitted+`"`) {
+			t.Errorf("got %s, want no %s", first, omitted)
+		}
+	}
+	if !scanner.Scan() {
+		t.Fatal("no second line")
+	}
+	if second := scanner.Text(); strings.Contains(second, "TCPFlags") {
+		t.Errorf("got %s for a UDP packet, want no TCPFlags", second)
+	}
+	if scanner.Scan() {
+		t.Errorf("got extra line %s", scanner.Text())
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+// sysfs is where sysfs is mounted.  Tests point it at a fake.
+var sysfs = "/sys"
+
+// readNUMANode returns the NUMA node in the sysfs numa_node file at path, or
+// -1 if it's unknown.
+func readNUMANode(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// interfaceNUMANode returns the NUMA node of iface's NIC, or -1 if it's
+// unknown.
+func interfaceNUMANode(iface string) int {
+	return readNUMANode(filepath.Join(sysfs, "class/net", iface, "device/numa_node"))
+}
+
+// dirNUMANode returns the NUMA node of the disk dir is on, or -1 if it's
+// unknown, as it is for virtual devices like RAID or LVM volumes.
+func dirNUMANode(dir string) int {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return -1
+	}
+	major := (st.Dev>>8)&0xfff | (st.Dev>>32)&^0xfff
+	minor := st.Dev&0xff | (st.Dev>>12)&^0xff
+	dev, err := filepath.EvalSymlinks(filepath.Join(sysfs, fmt.Sprintf("dev/block/%d:%d", major, minor)))
+	if err != nil {
+		return -1
+	}
+	devices, err := filepath.EvalSymlinks(filepath.Join(sysfs, "devices"))
+	if err != nil {
+		return -1
+	}
+	// The disk's controller is somewhere above its block device.
+	for ; dev != devices && dev != "/"; dev = filepath.Dir(dev) {
+		if node := readNUMANode(filepath.Join(dev, "numa_node")); node >= 0 {
+			return node
+		}
+	}
+	return -1
+}
+
+// nodeCPUs returns the CPUs on NUMA node node.
+func nodeCPUs(node int) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysfs, fmt.Sprintf("devices/system/node/node%d/cpulist", node)))
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad cpulist %q", data)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("bad cpulist %q", data)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// threadCPUs returns the CPU stenotype should pin each of c's threads to, or
+// -1 for its default.  With AF_XDP, threads are spread over the CPUs of
+// their NIC's NUMA node, so packets are copied into memory local to the NIC.
+// Threads whose packets are written to disks on other nodes are logged, since
+// each packet then crosses between nodes.
+func threadCPUs(c config.Config) []int {
+	out := make([]int, len(c.Threads))
+	next := map[int]int{} // Index of the next CPU to use on each node.
+	for n, t := range c.Threads {
+		out[n] = -1
+		if t.CPU != nil {
+			out[n] = *t.CPU
+		}
+		if c.CaptureBackend != "afxdp" {
+			continue
+		}
+		iface := c.ThreadInterface(n)
+		node := interfaceNUMANode(iface)
+		if node < 0 {
+			continue
+		}
+		if disk := dirNUMANode(t.PacketsDirectory); disk >= 0 && disk != node {
+			log.Printf("Thread %d captures from %v on NUMA node %d, but writes to %q on node %d:  it should capture from an interface on node %d, or write to a disk on node %d", n, iface, node, t.PacketsDirectory, disk, disk, node)
+		}
+		if t.CPU != nil {
+			continue
+		}
+		cpus, err := nodeCPUs(node)
+		if err != nil || len(cpus) == 0 {
+			log.Printf("Not pinning thread %d to NUMA node %d: %v", n, node, err)
+			continue
+		}
+		out[n] = cpus[next[node]%len(cpus)]
+		next[node]++
+	}
+	return out
+}
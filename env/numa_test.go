@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+// fakeSysfs points sysfs at a temporary directory holding files, by path
+// relative to it, and returns a function restoring it.
+func fakeSysfs(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := sysfs
+	sysfs = dir
+	return dir, func() {
+		sysfs = old
+		os.RemoveAll(dir)
+	}
+}
+
+// numaSysfs has eth0's NIC on node 1, and eth1's on an unknown node.
+var numaSysfs = map[string]string{
+	"class/net/eth0/device/numa_node":           "1\n",
+	"class/net/eth1/device/numa_node":           "-1\n",
+	"devices/system/node/node0/cpulist":         "0-7\n",
+	"devices/system/node/node1/cpulist":         "8-9,12\n",
+	"devices/system/node/node2/cpulist":         "4,x\n",
+	"devices/system/node/node3/cpulist":         "\n",
+	"devices/pci0000:00/0000:00:17.0/numa_node": "0\n",
+}
+
+func TestNodeCPUs(t *testing.T) {
+	_, cleanup := fakeSysfs(t, numaSysfs)
+	defer cleanup()
+	for _, test := range []struct {
+		node    int
+		want    []int
+		wantErr bool
+	}{
+		{0, []int{0, 1, 2, 3, 4, 5, 6, 7}, false},
+		{1, []int{8, 9, 12}, false},
+		{2, nil, true},
+		{3, nil, true},
+		{4, nil, true}, // No such node.
+	} {
+		got, err := nodeCPUs(test.node)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != test.wantErr {
+			t.Errorf("nodeCPUs(%d) got %v, %v; want %v, error %v", test.node, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestInterfaceNUMANode(t *testing.T) {
+	_, cleanup := fakeSysfs(t, numaSysfs)
+	defer cleanup()
+	for iface, want := range map[string]int{"eth0": 1, "eth1": -1, "eth2": -1} {
+		if got := interfaceNUMANode(iface); got != want {
+			t.Errorf("interfaceNUMANode(%q) got %d, want %d", iface, got, want)
+		}
+	}
+}
+
+func TestDirNUMANode(t *testing.T) {
+	root, cleanup := fakeSysfs(t, numaSysfs)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if got := dirNUMANode(dir); got != -1 {
+		t.Errorf("with no block device, got node %d, want -1", got)
+	}
+
+	// Link dir's device to a disk on a controller on node 0, like sysfs.
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	major := (st.Dev>>8)&0xfff | (st.Dev>>32)&^0xfff
+	minor := st.Dev&0xff | (st.Dev>>12)&^0xff
+	disk := filepath.Join(root, "devices/pci0000:00/0000:00:17.0/ata1/host0/block/sda/sda1")
+	if err := os.MkdirAll(disk, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dev/block"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(disk, filepath.Join(root, fmt.Sprintf("dev/block/%d:%d", major, minor))); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNUMANode(dir); got != 0 {
+		t.Errorf("got node %d, want 0", got)
+	}
+}
+
+func TestThreadCPUs(t *testing.T) {
+	_, cleanup := fakeSysfs(t, numaSysfs)
+	defer cleanup()
+	three := 3
+	threads := []config.ThreadConfig{
+		{PacketsDirectory: "/nonexistent/0"},
+		{PacketsDirectory: "/nonexistent/1"},
+		{PacketsDirectory: "/nonexistent/2", CPU: &three},
+		{PacketsDirectory: "/nonexistent/3"},
+		{PacketsDirectory: "/nonexistent/4"},
+		{PacketsDirectory: "/nonexistent/5", Interface: "eth1"},
+		{PacketsDirectory: "/nonexistent/6", Interface: "eth2"},
+	}
+	for _, test := range []struct {
+		backend string
+		want    []int
+	}{
+		// Threads are spread over node 1's CPUs, skipping pinned ones, and
+		// left to stenotype where the node's unknown.
+		{"afxdp", []int{8, 9, 3, 12, 8, -1, -1}},
+		// AF_PACKET threads are only pinned where configured.
+		{"afpacket", []int{-1, -1, 3, -1, -1, -1, -1}},
+		{"", []int{-1, -1, 3, -1, -1, -1, -1}},
+	} {
+		c := config.Config{Interface: "eth0", CaptureBackend: test.backend, Threads: threads}
+		if got := threadCPUs(c); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("backend %q: got CPUs %v, want %v", test.backend, got, test.want)
+		}
+	}
+}
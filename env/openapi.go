@@ -0,0 +1,315 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	//"github.com/google/stenographer/eve"
+	"../eve"
+	//"github.com/google/stenographer/hold"
+	"../hold"
+	//"github.com/google/stenographer/replicate"
+	"../replicate"
+)
+
+// apiParam is a parameter of an HTTP API operation.
+type apiParam struct {
+	name, in, typ, desc string // in is "query", "header" or "path".
+}
+
+// apiOperation describes one method of an HTTP API endpoint, for
+// /openapi.json.
+type apiOperation struct {
+	path, method, summary string
+	params                []apiParam
+	queryBody             bool        // Takes a query as a text/plain body.
+	request               interface{} // Value of the JSON request body type, if any.
+	response              interface{} // Value of the JSON response type, if any.
+	contentTypes          []string    // Of a non-JSON response, if response is nil.
+	status                int         // Of a successful response, if not 200.
+}
+
+// Parameters shared by the operations that run queries.
+var (
+	qParam        = apiParam{"q", "query", "string", "The query, if it's not sent as the body."}
+	versionParam  = apiParam{languageVersionHeader, "header", "integer", "Reject query keywords added after this language version."}
+	varsParam     = apiParam{"var.NAME", "query", "string", "The value of $NAME in the query."}
+	holdIDParam   = apiParam{"id", "path", "string", "The hold's ID."}
+	threadParam   = apiParam{"thread", "query", "integer", "The thread's number."}
+	pivotPadParam = apiParam{"pad", "query", "string", `How long before a flow started, and after it was logged, to return packets from, like "5m".  Defaults to the config's PivotPad.`}
+	packetsParams = []apiParam{
+		{"format", "query", "string", `"pcap" (the default), "pcapng" or "ndjson".`},
+		{"Steno-Limit-Packets", "header", "integer", "Stop after this many packets."},
+		{"Steno-Limit-Bytes", "header", "integer", "Stop after this many bytes of response."},
+		{"snaplen", "query", "integer", "Truncate packets to this many bytes."},
+		{"dedup", "query", "string", `Drop duplicate packets seen within a window, like "10ms", or "true" for the default.`},
+		{"resume", "query", "string", "Resume after the packet captured at SECONDS.FRACTION[:N], as given by an earlier response's Steno-Resume trailer."},
+		{"payload", "query", "boolean", "Include packet payloads in NDJSON."},
+	}
+)
+
+// apiOperations is every operation of the HTTP API /openapi.json documents.
+var apiOperations = []apiOperation{
+	{path: "/query", method: "post", summary: "Return the packets matching a query.",
+		params: append([]apiParam{versionParam, varsParam,
+			{"estimate", "query", "boolean", "Estimate the results' size first, in Steno-Estimated-Packets and Steno-Estimated-Bytes headers."}}, packetsParams...), queryBody: true,
+		contentTypes: []string{"application/octet-stream", pcapngContentType, ndjsonContentType}},
+	{path: "/pivot", method: "post", summary: "Return the packets of the flow a Suricata EVE JSON event, like an alert, describes, sending the query it's translated to in a Steno-Query header.",
+		params:       append([]apiParam{pivotPadParam}, packetsParams...),
+		request:      eve.Event{},
+		contentTypes: []string{"application/octet-stream", pcapngContentType, ndjsonContentType}},
+	{path: "/pivot/zeek", method: "post", summary: "Return the packets of every connection in the Zeek conn.log entries in the body, as TSV with a #fields header or JSON, merged into one response.  The query they're translated to is sent in a Steno-Query header.",
+		params:       append([]apiParam{pivotPadParam}, packetsParams...),
+		contentTypes: []string{"application/octet-stream", pcapngContentType, ndjsonContentType}},
+	{path: "/live", method: "post", summary: "Stream packets matching a query as they're captured.",
+		params: append([]apiParam{versionParam, varsParam, {"duration", "query", "string", `Stop after this long, like "5m".`}}, packetsParams...), queryBody: true,
+		contentTypes: []string{"application/octet-stream", pcapngContentType, ndjsonContentType}},
+	{path: "/flows", method: "post", summary: "Summarize the flows of the packets matching a query.",
+		params: []apiParam{qParam, versionParam, varsParam, {"format", "query", "string", `"ndjson" (the default) or "csv".`}}, queryBody: true,
+		contentTypes: []string{ndjsonContentType, "text/csv"}},
+	{path: "/querysize", method: "post", summary: "Estimate how large a query's results are, from the indexes.",
+		params: []apiParam{qParam, versionParam, varsParam}, queryBody: true, response: querySize{}},
+	{path: "/explain", method: "post", summary: "Explain how a query is parsed and which files it reads.",
+		params: []apiParam{qParam, versionParam, varsParam}, queryBody: true, response: explanation{}},
+	{path: "/capabilities", method: "get", summary: "List the query language features this server supports.",
+		response: capabilities{}},
+	{path: "/queries", method: "get", summary: "List the queries being served.",
+		response: []runningQuery{}},
+	{path: "/queries/{id}", method: "get", summary: "Show a query being served.",
+		params: []apiParam{{"id", "path", "integer", "The query's ID, from its Steno-Query-Id header."}}, response: runningQuery{}},
+	{path: "/queries/{id}", method: "delete", summary: "Cancel a query being served.",
+		params: []apiParam{{"id", "path", "integer", "The query's ID, from its Steno-Query-Id header."}}, status: http.StatusNoContent},
+	{path: "/forecast", method: "get", summary: "Show how much history each packets directory retains, and will at current traffic levels.",
+		response: []diskForecast{}},
+	{path: "/capture/filter", method: "get", summary: "Show the BPF filter packets are captured with.",
+		response: captureFilter{}},
+	{path: "/capture/filter", method: "post", summary: "Change the capture filter to the tcpdump expression in the body, restarting stenotype.",
+		response: captureFilter{}},
+	{path: "/capture/stats", method: "get", summary: "Show what each thread's stenotype has captured and dropped, and how quickly each disk takes its writes.",
+		response: captureStats{}},
+	{path: "/holds", method: "post", summary: "Place a legal hold on a query's packets, preserving them until it's released.",
+		params:    []apiParam{qParam, versionParam, varsParam, {"reason", "query", "string", "Why the packets are held, like a case number."}},
+		queryBody: true, response: hold.Hold{}, status: http.StatusAccepted},
+	{path: "/holds", method: "get", summary: "List the holds.",
+		response: []hold.Hold{}},
+	{path: "/holds/{id}", method: "get", summary: "Show a hold.",
+		params: []apiParam{holdIDParam}, response: hold.Hold{}},
+	{path: "/holds/{id}", method: "delete", summary: "Release a hold, deleting its preserved packets.",
+		params: []apiParam{holdIDParam}, status: http.StatusNoContent},
+	{path: "/holds/{id}/pcap", method: "get", summary: "Return a hold's preserved packets.",
+		params: []apiParam{holdIDParam}, contentTypes: []string{"application/octet-stream"}},
+	{path: "/admin/reload", method: "post", summary: "Reread the config file, applying the settings that can change while running.",
+		status: http.StatusNoContent},
+	{path: "/admin/certs", method: "post", summary: "Reload the certs from CertPath, first installing the PEM server certificate and private key in the body, if any.",
+		status: http.StatusNoContent},
+	{path: "/admin/verify", method: "post", summary: "Check every index for corruption, quarantining those which are corrupt.",
+		response: []indexVerification{}},
+	{path: replicate.Path, method: "get", summary: "List a thread's files on a standby, to replicate those it's missing.",
+		params: []apiParam{threadParam}, response: replicate.FileList{}},
+	{path: replicate.Path, method: "put", summary: "Receive part of a file replicated to a standby, with its SHA256 in an X-Stenographer-Sha256 trailer.",
+		params: []apiParam{threadParam, {"name", "query", "string", "The file's name."},
+			{"part", "query", "string", `"packets", "index", or "index.ipN" for an IP shard.  The index is sent last.`}}},
+	{path: "/debug/stats", method: "get", summary: `List every stat, one "NAME\tVALUE" line each.`,
+		contentTypes: []string{"text/plain"}},
+	{path: "/metrics", method: "get", summary: "Export stats in the Prometheus text format.",
+		contentTypes: []string{"text/plain"}},
+	{path: "/healthz", method: "get", summary: "Check stenographer is alive.  Responds 503 if it's not.",
+		response: healthStatus{}},
+	{path: "/readyz", method: "get", summary: "Check queries return recent packets.  Responds 503 if they don't.",
+		response: healthStatus{}},
+}
+
+// openAPI returns the OpenAPI document describing the HTTP API.  Response
+// schemas are derived from the types the handlers encode, so they can't
+// drift from what's actually sent.
+func openAPI() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		var params []interface{}
+		for _, p := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.desc,
+				"required":    p.in == "path",
+				"schema":      map[string]string{"type": p.typ},
+			})
+		}
+		content := map[string]interface{}{}
+		if op.response != nil {
+			content["application/json"] = map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.response), schemas)}
+		}
+		for _, ct := range op.contentTypes {
+			content[ct] = map[string]interface{}{}
+		}
+		status, resp := "200", map[string]interface{}{"description": "OK"}
+		if op.status != 0 {
+			status, resp["description"] = strconv.Itoa(op.status), http.StatusText(op.status)
+		}
+		if len(content) > 0 {
+			resp["content"] = content
+		}
+		operation := map[string]interface{}{
+			"summary": op.summary,
+			"responses": map[string]interface{}{
+				status: resp,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(queryError{}), schemas)},
+						"text/plain":       map[string]interface{}{},
+					},
+				},
+			},
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.queryBody {
+			operation["requestBody"] = map[string]interface{}{
+				"description": "The query.",
+				"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]string{"type": "string"}}},
+			}
+		}
+		if op.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.request), schemas)}},
+			}
+		}
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]interface{}{}
+		}
+		paths[op.path][op.method] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info":    map[string]string{"title": "stenographer", "version": "1"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"clientCertificate": map[string]string{"type": "mutualTLS"},
+				"bearerToken":       map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []map[string][]string{{"clientCertificate": {}}, {"bearerToken": {}}},
+	}
+}
+
+// jsonSchema returns the JSON schema of the values of t encoding/json
+// produces.  Struct types are added to schemas under their capitalized names,
+// and referred to.
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]string{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(time.Duration(0)):
+		return map[string]string{"type": "integer", "description": "Nanoseconds."}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]string{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]string{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]string{"type": "number"}
+	case reflect.String:
+		return map[string]string{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]string{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		schema := map[string]interface{}{"type": "object"}
+		if t.Name() == "" {
+			addFields(t, schema, schemas)
+			return schema
+		}
+		name := []rune(t.Name())
+		name[0] = unicode.ToUpper(name[0])
+		ref := map[string]string{"$ref": "#/components/schemas/" + string(name)}
+		if _, ok := schemas[string(name)]; !ok {
+			schemas[string(name)] = schema // Before the fields, in case they refer back to it.
+			addFields(t, schema, schemas)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// addFields sets the properties of object schema to the fields of struct
+// type t, including those of its embedded structs, and lists those that are
+// always sent as required.
+func addFields(t reflect.Type, schema map[string]interface{}, schemas map[string]interface{}) {
+	props, _ := schema["properties"].(map[string]interface{})
+	if props == nil {
+		props = map[string]interface{}{}
+		schema["properties"] = props
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if f.Anonymous && tag[0] == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addFields(ft, schema, schemas)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		props[name] = jsonSchema(f.Type, schemas)
+		omitempty := false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			required, _ := schema["required"].([]string)
+			schema["required"] = append(required, name)
+		}
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document describing the HTTP API.
+func (e *Env) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPI())
+}
@@ -0,0 +1,216 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// Formats query responses can be written in.
+const (
+	formatPcap   = "pcap"
+	formatPcapng = "pcapng"
+	formatNDJSON = "ndjson"
+)
+
+// pcapngContentType is sent with, and may be requested in an Accept header
+// to get, pcapng responses.
+const pcapngContentType = "application/x-pcapng"
+
+// responseFormat returns the format a query asked for its packets in, with a
+// format URL parameter or an Accept header.  Defaults to pcap.
+func responseFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case formatPcap, formatPcapng, formatNDJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", f)
+	}
+	switch accept := r.Header.Get("Accept"); {
+	case strings.Contains(accept, pcapngContentType):
+		return formatPcapng, nil
+	case strings.Contains(accept, ndjsonContentType):
+		return formatNDJSON, nil
+	}
+	return formatPcap, nil
+}
+
+// pcapng block types and options.  See
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html
+const (
+	pcapngSectionHeader       = 0x0A0D0D0A
+	pcapngInterfaceDesc       = 1
+	pcapngEnhancedPacket      = 6
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngOptEnd              = 0
+	pcapngOptComment          = 1
+	pcapngOptShbUserAppl      = 4
+	pcapngOptIfName           = 2
+	pcapngOptIfDescription    = 3
+	pcapngOptIfTsresol        = 9
+	pcapngLinkTypeEthernet    = 1
+	pcapngEnhancedPacketBytes = 32 // Excluding packet data and its padding.
+)
+
+// pcapngWriter writes a pcapng section, with an interface per stenographer
+// thread.  All values are little endian, as flagged by the byte order magic.
+type pcapngWriter struct {
+	w       io.Writer
+	buf     []byte
+	snapLen int
+}
+
+func pad4(n int) int { return (n + 3) &^ 3 }
+
+func (p *pcapngWriter) u16(v uint16) { p.buf = append(p.buf, byte(v), byte(v>>8)) }
+func (p *pcapngWriter) u32(v uint32) {
+	p.buf = append(p.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// option appends an option, padded to 32 bits.
+func (p *pcapngWriter) option(code uint16, value []byte) {
+	p.u16(code)
+	p.u16(uint16(len(value)))
+	p.buf = append(p.buf, value...)
+	p.buf = append(p.buf, make([]byte, pad4(len(value))-len(value))...)
+}
+
+// block writes out a block of the given type, whose body has been appended
+// to p.buf.
+func (p *pcapngWriter) block(typ uint32) (int, error) {
+	body := p.buf
+	total := uint32(12 + len(body))
+	out := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(out, typ)
+	binary.LittleEndian.PutUint32(out[4:], total)
+	out = append(out, body...)
+	out = append(out, out[4:8]...)
+	p.buf = p.buf[:0]
+	return p.w.Write(out)
+}
+
+// writeHeader writes the section header, carrying the query as a comment, and
+// an interface description for each thread's interface.
+func (p *pcapngWriter) writeHeader(query string, ifaces []string) (int, error) {
+	p.u32(pcapngByteOrderMagic)
+	p.u16(1) // Major version.
+	p.u16(0) // Minor version.
+	p.u32(0xFFFFFFFF)
+	p.u32(0xFFFFFFFF) // Section length unknown.
+	p.option(pcapngOptShbUserAppl, []byte("stenographer"))
+	if query != "" {
+		p.option(pcapngOptComment, []byte(query))
+	}
+	p.option(pcapngOptEnd, nil)
+	n, err := p.block(pcapngSectionHeader)
+	if err != nil {
+		return n, err
+	}
+	for i, iface := range ifaces {
+		p.u16(pcapngLinkTypeEthernet)
+		p.u16(0) // Reserved.
+		p.u32(uint32(p.snapLen))
+		if iface != "" {
+			p.option(pcapngOptIfName, []byte(iface))
+		}
+		p.option(pcapngOptIfDescription, []byte(fmt.Sprintf("stenographer thread %d", i)))
+		p.option(pcapngOptIfTsresol, []byte{9}) // Nanoseconds.
+		p.option(pcapngOptEnd, nil)
+		m, err := p.block(pcapngInterfaceDesc)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writePacket writes a packet, captured on the given interface.
+func (p *pcapngWriter) writePacket(iface int, pkt *base.Packet) error {
+	ts := uint64(pkt.Timestamp.UnixNano())
+	p.u32(uint32(iface))
+	p.u32(uint32(ts >> 32))
+	p.u32(uint32(ts))
+	p.u32(uint32(len(pkt.Data)))
+	p.u32(uint32(pkt.Length))
+	p.buf = append(p.buf, pkt.Data...)
+	p.buf = append(p.buf, make([]byte, pad4(len(pkt.Data))-len(pkt.Data))...)
+	_, err := p.block(pcapngEnhancedPacket)
+	return err
+}
+
+// packetsToPcapng is like base.PacketsToFile, but writes pcapng.  Each
+// packet's CaptureInfo.InterfaceIndex is the thread it was read from, which
+// must be an index into ifaces.  It returns how many packets were written,
+// calling wrote, if it's set, with each once it's been written.
+func packetsToPcapng(in *base.PacketChan, out io.Writer, limit base.Limit, query string, ifaces []string, snaplen int, wrote func(*base.Packet)) (int64, error) {
+	defer in.Discard()
+	var count int64
+	w := &pcapngWriter{w: out, snapLen: snaplen}
+	n, err := w.writeHeader(query, ifaces)
+	if err != nil {
+		return 0, fmt.Errorf("error writing header: %v", err)
+	}
+	if limit.ShouldStopAfter(base.Limit{Bytes: int64(n)}) {
+		return 0, nil
+	}
+	for p := range in.Receive() {
+		p.Truncate(snaplen)
+		if p.InterfaceIndex < 0 || p.InterfaceIndex >= len(ifaces) {
+			return count, fmt.Errorf("packet from unknown thread %d", p.InterfaceIndex)
+		}
+		if err := w.writePacket(p.InterfaceIndex, p); err != nil {
+			return count, fmt.Errorf("error writing packet: %v", err)
+		}
+		count++
+		if wrote != nil {
+			wrote(p)
+		}
+		if limit.ShouldStopAfter(base.Limit{Bytes: int64(pad4(len(p.Data)) + pcapngEnhancedPacketBytes), Packets: 1}) {
+			return count, nil
+		}
+	}
+	return count, in.Err()
+}
+
+// tagInterface sets the InterfaceIndex of each packet from in to the given
+// thread, so pcapng and NDJSON output can tell which thread it came from.
+func tagInterface(ctx context.Context, in *base.PacketChan, thread int) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for p := range in.Receive() {
+			if base.ContextDone(ctx) {
+				break
+			}
+			p.InterfaceIndex = thread
+			out.Send(p)
+		}
+		if err := ctx.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
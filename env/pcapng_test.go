@@ -0,0 +1,154 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// packetChan returns a closed channel holding the given packets.
+func packetChan(pkts ...*base.Packet) *base.PacketChan {
+	in := base.NewPacketChan(len(pkts))
+	for _, p := range pkts {
+		in.Send(p)
+	}
+	in.Close(nil)
+	return in
+}
+
+// threadPacket returns packet(t, length, hexData...) as read by the given
+// thread at the given time.
+func threadPacket(t *testing.T, thread int, ts time.Time, length int, hexData ...string) *base.Packet {
+	p := packet(t, length, hexData...)
+	p.InterfaceIndex = thread
+	p.Timestamp = ts
+	return p
+}
+
+func TestPacketsToPcapng(t *testing.T) {
+	const snaplen = 96
+	ts := time.Unix(1500000000, 123456789)
+	pkts := []*base.Packet{
+		threadPacket(t, 0, ts, 60, macs, ipv4TCP),
+		threadPacket(t, 1, ts.Add(time.Nanosecond), 70, macs, ipv6UDP),
+		threadPacket(t, 1, ts.Add(time.Second), 1500, macs, ipv4TCP, ipv6UDP),
+	}
+	var want [][]byte
+	for _, p := range pkts {
+		want = append(want, append([]byte(nil), p.Data...))
+	}
+	want[2] = want[2][:snaplen]
+
+	var buf bytes.Buffer
+	ifaces := []string{"eth0", "eth1"}
+	count, err := packetsToPcapng(packetChan(pkts...), &buf, base.Limit{}, "port 80", ifaces, snaplen, nil)
+	if err != nil || count != int64(len(pkts)) {
+		t.Fatalf("packetsToPcapng got %v, %v; want %v, nil", count, err, len(pkts))
+	}
+
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("reading section header: %v", err)
+	}
+	if info := r.SectionInfo(); info.Application != "stenographer" || info.Comment != "port 80" {
+		t.Errorf("section header got application %q, comment %q; want %q, %q", info.Application, info.Comment, "stenographer", "port 80")
+	}
+	for i, p := range pkts {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(data, want[i]) {
+			t.Errorf("packet %d: got data %x, want %x", i, data, want[i])
+		}
+		if ci.InterfaceIndex != p.InterfaceIndex {
+			t.Errorf("packet %d: got interface %d, want %d", i, ci.InterfaceIndex, p.InterfaceIndex)
+		}
+		if ci.CaptureLength != len(want[i]) || ci.Length != p.Length {
+			t.Errorf("packet %d: got lengths %d/%d, want %d/%d", i, ci.CaptureLength, ci.Length, len(want[i]), p.Length)
+		}
+		if !ci.Timestamp.Equal(p.Timestamp) {
+			t.Errorf("packet %d: got timestamp %v, want %v", i, ci.Timestamp, p.Timestamp)
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("after last packet got %v, want EOF", err)
+	}
+
+	if n := r.NInterfaces(); n != len(ifaces) {
+		t.Fatalf("got %d interfaces, want %d", n, len(ifaces))
+	}
+	for i, name := range ifaces {
+		iface, err := r.Interface(i)
+		if err != nil {
+			t.Fatalf("interface %d: %v", i, err)
+		}
+		if iface.Name != name || iface.LinkType != layers.LinkTypeEthernet || iface.SnapLength != snaplen {
+			t.Errorf("interface %d: got %q, link type %v, snaplen %d; want %q, %v, %d", i, iface.Name, iface.LinkType, iface.SnapLength, name, layers.LinkTypeEthernet, snaplen)
+		}
+	}
+}
+
+func TestPacketsToPcapngUnknownThread(t *testing.T) {
+	in := packetChan(threadPacket(t, 2, time.Unix(0, 0), 60, macs, ipv4TCP))
+	var buf bytes.Buffer
+	if count, err := packetsToPcapng(in, &buf, base.Limit{}, "", []string{"eth0", "eth1"}, 1500, nil); count != 0 || err == nil {
+		t.Errorf("packetsToPcapng got %v, %v; want 0, error", count, err)
+	}
+}
+
+func TestTagInterface(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	failed := errors.New("disk on fire")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		desc    string
+		ctx     context.Context
+		err     error
+		want    int
+		wantErr error
+	}{
+		{"tagged", context.Background(), nil, 3, nil},
+		{"failed", context.Background(), failed, 3, failed},
+		{"canceled", canceled, nil, 0, context.Canceled},
+	} {
+		in := base.NewPacketChan(3)
+		for i := 0; i < 3; i++ {
+			in.Send(threadPacket(t, 0, ts.Add(time.Duration(i)*time.Second), 60, macs, ipv4TCP))
+		}
+		in.Close(test.err)
+		out := tagInterface(test.ctx, in, 2)
+		got := 0
+		for p := range out.Receive() {
+			if p.InterfaceIndex != 2 {
+				t.Errorf("%v: got packet from thread %d, want 2", test.desc, p.InterfaceIndex)
+			}
+			got++
+		}
+		if got != test.want || out.Err() != test.wantErr {
+			t.Errorf("%v: got %d packets, %v; want %d, %v", test.desc, got, out.Err(), test.want, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	//"github.com/google/stenographer/eve"
+	"../eve"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/zeek"
+	"../zeek"
+)
+
+const (
+	// maxEventBytes limits the EVE event, or conn.log entries, a client may
+	// send to /pivot.
+	maxEventBytes = 16 << 20
+	// maxPivotConns limits how many conn.log entries one /pivot/zeek
+	// request may pull the packets of.
+	maxPivotConns = 1000
+	// maxQueryHeaderBytes limits the query sent back in Steno-Query, so
+	// those of many conn.log entries don't overflow clients' header limits.
+	maxQueryHeaderBytes = 16 << 10
+)
+
+// handlePivot returns the packets of the flow the Suricata EVE event (like
+// an IDS alert) in the request body describes, from the pad parameter, or
+// the config's PivotPad, before the flow started until as long after the
+// event.  At /pivot/zeek, it returns the packets of every connection in the
+// Zeek conn.log entries in the body instead, merged into one response.  The
+// query the body's translated to is run as by /query, which takes the same
+// parameters, and sent back in a Steno-Query header, unless it's very long.
+func (e *Env) handlePivot(w http.ResponseWriter, r *http.Request) {
+	q, err := e.pivotQuery(r)
+	if err != nil {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_event", Message: err.Error()})
+		return
+	}
+	if len(q) <= maxQueryHeaderBytes {
+		w.Header().Set("Steno-Query", q)
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(q))
+	e.handleQuery(w, r)
+}
+
+// pivotQuery returns the query for the event, or conn.log entries, in r's
+// body.
+func (e *Env) pivotQuery(r *http.Request) (string, error) {
+	pad := e.pivotPad()
+	if p := r.URL.Query().Get("pad"); p != "" {
+		d, err := time.ParseDuration(p)
+		if err != nil || d < 0 {
+			return "", fmt.Errorf("invalid pad parameter %q", p)
+		}
+		pad = d
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEventBytes))
+	if err != nil {
+		return "", errors.New("could not read request body")
+	}
+	if r.URL.Path == "/pivot/zeek" {
+		conns, err := zeek.ParseConns(body)
+		if err != nil {
+			return "", err
+		}
+		if len(conns) > maxPivotConns {
+			return "", fmt.Errorf("%d conn.log entries given, at most %d are allowed", len(conns), maxPivotConns)
+		}
+		return zeek.Query(conns, pad)
+	}
+	event, err := eve.Parse(body)
+	if err != nil {
+		return "", err
+	}
+	return event.Query(pad)
+}
+
+// pivotPad returns how far before and after an event's flow /pivot returns
+// packets from, by default.
+func (e *Env) pivotPad() time.Duration {
+	e.confMu.RLock()
+	defer e.confMu.RUnlock()
+	if e.conf.PivotPad == "" {
+		return defaultPivotPad
+	}
+	d, _ := time.ParseDuration(e.conf.PivotPad) // checked by Validate
+	return d
+}
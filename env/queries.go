@@ -0,0 +1,188 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+var queriesCanceled = stats.S.Get("queries_canceled")
+
+// runningQuery is a query being served, as listed by /queries.
+type runningQuery struct {
+	ID       int64
+	Path     string // What's serving it, like "/query", or a gRPC method.
+	Start    time.Time
+	Duration string // How long it's been running.
+	Client   string
+	Query    string
+	Bytes    int64 // Response bytes written so far.
+
+	written *int64 // Updated atomically with the bytes written.
+	cancel  func()
+}
+
+// queryRegistry tracks the queries being served, so they can be listed and
+// canceled.  Its zero value is empty and ready to use.
+type queryRegistry struct {
+	mu      sync.Mutex
+	lastID  int64
+	running map[int64]*runningQuery
+}
+
+// add registers a query being served at path to client, and returns its ID.
+// written is atomically updated with the bytes of response written, and
+// cancel is called to cancel it.  Remove the query once it's done.
+func (qr *queryRegistry) add(path, client, q string, written *int64, cancel func()) int64 {
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+	if qr.running == nil {
+		qr.running = map[int64]*runningQuery{}
+	}
+	qr.lastID++
+	qr.running[qr.lastID] = &runningQuery{
+		ID:      qr.lastID,
+		Path:    path,
+		Start:   time.Now(),
+		Client:  client,
+		Query:   q,
+		written: written,
+		cancel:  cancel,
+	}
+	return qr.lastID
+}
+
+// remove unregisters the query with the given ID.
+func (qr *queryRegistry) remove(id int64) {
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+	delete(qr.running, id)
+}
+
+// list returns a snapshot of the running queries, oldest first.
+func (qr *queryRegistry) list() []runningQuery {
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+	out := make([]runningQuery, 0, len(qr.running))
+	for _, q := range qr.running {
+		out = append(out, q.snapshot())
+	}
+	sort.Sort(queriesByID(out))
+	return out
+}
+
+// get returns a snapshot of the query with the given ID.
+func (qr *queryRegistry) get(id int64) (runningQuery, bool) {
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+	q, ok := qr.running[id]
+	if !ok {
+		return runningQuery{}, false
+	}
+	return q.snapshot(), true
+}
+
+// cancel cancels the query with the given ID, returning false if there's no
+// such query running.
+func (qr *queryRegistry) cancel(id int64) bool {
+	qr.mu.Lock()
+	q, ok := qr.running[id]
+	qr.mu.Unlock()
+	if ok {
+		q.cancel()
+	}
+	return ok
+}
+
+// snapshot returns a copy of q with its Duration and Bytes filled in.
+func (q *runningQuery) snapshot() runningQuery {
+	out := *q
+	out.Duration = time.Since(q.Start).String()
+	out.Bytes = atomic.LoadInt64(q.written)
+	return out
+}
+
+type queriesByID []runningQuery
+
+func (q queriesByID) Len() int           { return len(q) }
+func (q queriesByID) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q queriesByID) Less(i, j int) bool { return q[i].ID < q[j].ID }
+
+// handleQueries lists the running queries at /queries, shows one at
+// /queries/ID, and cancels one with DELETE /queries/ID.  Since they show
+// and stop other clients' queries, only clients authorized to query every
+// packet may use them.
+func (e *Env) handleQueries(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if !grant.Unrestricted() {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "managing queries needs access to every packet"})
+		return
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/queries"), "/")
+	if path == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.running.list())
+		return
+	}
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid query ID %q", path), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		q, ok := e.running.get(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no query %d running", id), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(q)
+	case "DELETE":
+		if !e.running.cancel(id) {
+			http.Error(w, fmt.Sprintf("no query %d running", id), http.StatusNotFound)
+			return
+		}
+		queriesCanceled.Increment()
+		log.Printf("Query %d canceled by %v", id, httputil.Identity(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
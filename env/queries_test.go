@@ -0,0 +1,151 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+func TestQueryRegistry(t *testing.T) {
+	var qr queryRegistry
+	if got := qr.list(); len(got) != 0 {
+		t.Errorf("empty registry listed %+v", got)
+	}
+	var written [3]int64
+	canceled := map[int64]bool{}
+	var ids []int64
+	for i, q := range []string{"port 80", "host 10.0.0.1", "tcp"} {
+		i := i
+		id := qr.add("/query", "analyst", q, &written[i], func() { canceled[int64(i)] = true })
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatalf("got IDs %v, want them unique", ids)
+	}
+	atomic.StoreInt64(&written[1], 1500)
+
+	got := qr.list()
+	if len(got) != 3 {
+		t.Fatalf("got %d queries, want 3", len(got))
+	}
+	for i, q := range got {
+		if q.ID != ids[i] {
+			t.Errorf("query %d: got ID %d, want %d, oldest first", i, q.ID, ids[i])
+		}
+		if q.Duration == "" || q.Path != "/query" || q.Client != "analyst" {
+			t.Errorf("query %d: got %+v, want it filled in", i, q)
+		}
+	}
+	if got[1].Bytes != 1500 || got[1].Query != "host 10.0.0.1" {
+		t.Errorf("got %+v, want 1500 bytes written for host 10.0.0.1", got[1])
+	}
+	atomic.StoreInt64(&written[1], 3000)
+	if q, ok := qr.get(ids[1]); !ok || q.Bytes != 3000 {
+		t.Errorf("get(%d) got %+v, %v; want 3000 bytes written", ids[1], q, ok)
+	}
+
+	if !qr.cancel(ids[1]) {
+		t.Errorf("cancel(%d) got false", ids[1])
+	}
+	if !canceled[1] || canceled[0] || canceled[2] {
+		t.Errorf("got %v canceled, want just the second", canceled)
+	}
+	// Canceled queries are listed until they stop and are removed.
+	if _, ok := qr.get(ids[1]); !ok {
+		t.Errorf("canceled query not listed until removed")
+	}
+	qr.remove(ids[1])
+	if _, ok := qr.get(ids[1]); ok {
+		t.Errorf("removed query still listed")
+	}
+	if qr.cancel(ids[1]) {
+		t.Errorf("canceling removed query got true")
+	}
+	if got := qr.list(); len(got) != 2 || got[0].ID != ids[0] || got[1].ID != ids[2] {
+		t.Errorf("after removal got %+v, want the first and third", got)
+	}
+	if id := qr.add("/query", "analyst", "udp", new(int64), func() {}); id <= ids[2] {
+		t.Errorf("got ID %d after %d, want IDs not reused", id, ids[2])
+	}
+}
+
+func TestHandleQueries(t *testing.T) {
+	e, cleanup := authzEnv(t, testPolicy)
+	defer cleanup()
+	ctx := base.NewContext(0)
+	defer ctx.Cancel()
+	id := e.running.add("/query", "analyst", "port 80", new(int64), ctx.Cancel)
+	defer e.running.remove(id)
+
+	for _, test := range []struct {
+		desc     string
+		method   string
+		path     string
+		cn, ou   string
+		wantCode int
+	}{
+		{"list", "GET", "/queries", "analyst", "soc", http.StatusOK},
+		{"list with slash", "GET", "/queries/", "analyst", "soc", http.StatusOK},
+		{"get", "GET", fmt.Sprintf("/queries/%d", id), "analyst", "soc", http.StatusOK},
+		{"get missing", "GET", fmt.Sprintf("/queries/%d", id+1), "analyst", "soc", http.StatusNotFound},
+		{"bad ID", "GET", "/queries/first", "analyst", "soc", http.StatusBadRequest},
+		{"delete list", "DELETE", "/queries", "analyst", "soc", http.StatusMethodNotAllowed},
+		{"post", "POST", fmt.Sprintf("/queries/%d", id), "analyst", "soc", http.StatusMethodNotAllowed},
+		{"cancel missing", "DELETE", fmt.Sprintf("/queries/%d", id+1), "analyst", "soc", http.StatusNotFound},
+		// Only clients who may see every packet may see others' queries.
+		{"restricted", "GET", "/queries", "contractor", "", http.StatusForbidden},
+		{"restricted cancel", "DELETE", fmt.Sprintf("/queries/%d", id), "contractor", "", http.StatusForbidden},
+		{"flows only", "GET", "/queries", "netops", "noc", http.StatusForbidden},
+		{"no certificate", "GET", "/queries", "", "", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		e.handleQueries(w, certRequest(test.method, test.path, test.cn, test.ou))
+		if w.Code != test.wantCode {
+			t.Errorf("%v: got status %v (%s), want %v", test.desc, w.Code, w.Body.String(), test.wantCode)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("query canceled by a failed request: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	e.handleQueries(w, certRequest("GET", "/queries", "analyst", "soc"))
+	var listed []runningQuery
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != id || listed[0].Query != "port 80" || listed[0].Client != "analyst" {
+		t.Errorf("got %+v, want the running query", listed)
+	}
+
+	w = httptest.NewRecorder()
+	e.handleQueries(w, certRequest("DELETE", fmt.Sprintf("/queries/%d", id), "analyst", "soc"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("cancel got status %v (%s), want %v", w.Code, w.Body.String(), http.StatusNoContent)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("DELETE didn't cancel the query")
+	}
+}
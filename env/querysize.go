@@ -0,0 +1,119 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/query"
+	"../query"
+	"golang.org/x/net/context"
+)
+
+// pcapFileHeaderBytes is the size of the header at the start of a pcap.
+const pcapFileHeaderBytes = 24
+
+// querySize is the response to a /querysize request.
+type querySize struct {
+	// Packets and Bytes estimate how many packets the query returns, and how
+	// large a pcap they make, before any post-filtering or sampling.
+	Packets int64
+	Bytes   int64
+	Files   int // How many files the query reads.
+	// UncountedFiles are files whose packets all match, but whose indexes
+	// don't record how many packets they hold.  Their packets are left out of
+	// Packets, and their sizes on disk are counted in Bytes.
+	UncountedFiles int `json:",omitempty"`
+}
+
+// handleQuerySize estimates how large a query's results are, from the
+// indexes alone, before anyone commits to downloading them.  The query is
+// given as a q URL parameter, or POSTed as with /query.
+func (e *Env) handleQuerySize(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	grant, ok := e.authorizeRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	opts, err := parseOptions(r)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	queryString := r.URL.Query().Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeQueryError(w, http.StatusBadRequest, queryError{Code: "bad_request", Message: "could not read request body"})
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := query.ParseWithOptions(queryString, opts)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, parseQueryError(err))
+		return
+	}
+	q = grant.Restrict(q, time.Now())
+	if warning := e.retentionWarning(q); warning != nil {
+		if b, err := json.Marshal(warning); err == nil {
+			w.Header().Set("Steno-Warning", string(b))
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute)
+	defer ctx.Cancel()
+	out, err := e.estimateSize(ctx, q)
+	if err != nil {
+		writeQueryError(w, http.StatusInternalServerError, queryError{Code: "index_error", Message: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// estimateSize estimates how large q's results are from the indexes.
+func (e *Env) estimateSize(ctx context.Context, q query.Query) (querySize, error) {
+	if inner, ok := query.Bidirectional(q); ok {
+		// As with /explain, only the first pass can be estimated.
+		q = inner
+	}
+	out := querySize{Bytes: pcapFileHeaderBytes}
+	for i, t := range e.threads {
+		files, err := t.Explain(ctx, query.Scope(q, i, e.threadInterface(i)))
+		if err != nil {
+			return querySize{}, err
+		}
+		for _, f := range files {
+			out.Files++
+			out.Bytes += f.EstimatedBytes
+			if f.EstimatedPackets < 0 {
+				out.UncountedFiles++
+			} else {
+				out.Packets += int64(f.EstimatedPackets)
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+
+	//"github.com/google/stenographer/reindex"
+	"../reindex"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var indexRebuildFailures = stats.S.Get("index_rebuild_failures")
+
+// rebuildIndex rebuilds the index of a packet file in the background, unless
+// it's already being rebuilt.  Once the index is in place, the thread picks
+// the file up like any other.  If rebuilding fails, the packet file is kept,
+// and rebuilding is retried the next time stenotype is restarted.
+func (d *Env) rebuildIndex(packetPath, indexPath string) {
+	d.rebuildingMu.Lock()
+	defer d.rebuildingMu.Unlock()
+	if d.rebuilding == nil {
+		d.rebuilding = map[string]bool{}
+	}
+	if d.rebuilding[packetPath] {
+		return
+	}
+	d.rebuilding[packetPath] = true
+	log.Printf("Rebuilding missing index %q for packet file %q", indexPath, packetPath)
+	go func() {
+		d.rebuildOne.Lock()
+		r, err := reindex.Rebuild(context.Background(), packetPath, indexPath)
+		d.rebuildOne.Unlock()
+		if err != nil {
+			indexRebuildFailures.Increment()
+			log.Printf("Unable to rebuild index %q: %v", indexPath, err)
+		} else {
+			log.Printf("Rebuilt index %q with %d keys for %d packets", indexPath, r.Keys, r.Packets)
+		}
+		d.rebuildingMu.Lock()
+		delete(d.rebuilding, packetPath)
+		d.rebuildingMu.Unlock()
+	}()
+}
@@ -0,0 +1,333 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	//"github.com/google/stenographer/authz"
+	"../authz"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/config"
+	"../config"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	//"github.com/google/stenographer/thread"
+	"../thread"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	configReloads        = stats.S.Get("config_reloads")
+	configReloadFailures = stats.S.Get("config_reload_failures")
+)
+
+// reloadable are the Config fields Reload applies.  Changes to any others
+// need a restart.  Threads' PacketsDirectory, IndexDirectory and interfaces
+// need one too, but the rest of each ThreadConfig is reloadable.
+var reloadable = map[string]bool{
+	"Threads":                true,
+	"AuthzPolicyPath":        true,
+	"APITokens":              true,
+	"OIDCIssuer":             true,
+	"OIDCClientID":           true,
+	"FederatorNames":         true,
+	"RetentionTarget":        true,
+	"HostSetDirectory":       true,
+	"SavedQueriesPath":       true,
+	"MaxPayloadScanBytes":    true,
+	"MaxRegexpPacketBytes":   true,
+	"IndexLookupConcurrency": true,
+	"ParallelBlockfileReads": true,
+	"ReorderBufferPackets":   true,
+	"SkipCorruptPackets":     true,
+	"QueryStallTimeout":      true,
+	"PivotPad":               true,
+	"MaxHoldBytes":           true,
+	"LogVerbosity":           true,
+	"CaptureFilter":          true,
+}
+
+// tokenFields are the Config fields configuring bearer tokens.
+var tokenFields = map[string]bool{"APITokens": true, "OIDCIssuer": true, "OIDCClientID": true}
+
+// tokensEnabled returns whether c has clients authenticate with bearer
+// tokens.
+func tokensEnabled(c config.Config) bool {
+	return len(c.APITokens) > 0 || c.OIDCIssuer != ""
+}
+
+// applyQuerySettings sets the packages' query settings from c, restoring the
+// defaults of those c doesn't set.  Queries running meanwhile see each
+// setting either before or after it changes.
+func applyQuerySettings(c config.Config) {
+	qs := query.DefaultSettings
+	qs.HostSetDirectory = c.HostSetDirectory
+	qs.SavedQueriesPath = c.SavedQueriesPath
+	if c.MaxPayloadScanBytes > 0 {
+		qs.MaxPayloadScanBytes = c.MaxPayloadScanBytes
+	}
+	if c.MaxRegexpPacketBytes > 0 {
+		qs.MaxRegexpPacketBytes = c.MaxRegexpPacketBytes
+	}
+	query.SetSettings(qs)
+	lookups := thread.DefaultIndexLookupConcurrency
+	if c.IndexLookupConcurrency > 0 {
+		lookups = c.IndexLookupConcurrency
+	}
+	thread.SetIndexLookupConcurrency(lookups)
+	reads := thread.DefaultParallelBlockfileReads
+	if c.ParallelBlockfileReads > 0 {
+		reads = c.ParallelBlockfileReads
+	}
+	thread.SetParallelBlockfileReads(reads)
+	reorder := thread.DefaultReorderBufferPackets
+	if c.ReorderBufferPackets != 0 {
+		reorder = c.ReorderBufferPackets
+	}
+	thread.SetReorderBufferPackets(reorder)
+	blockfile.SetSkipCorrupt(c.SkipCorruptPackets)
+	if c.LogVerbosity != nil {
+		base.SetVerbosity(*c.LogVerbosity)
+	} else {
+		base.SetVerbosity(*base.VerboseLogging)
+	}
+}
+
+// needsRestart returns the fields which differ between old and c, but which
+// Reload can't change.
+func needsRestart(old, c config.Config) []string {
+	var out []string
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(c)
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		if !reloadable[name] && !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			out = append(out, name)
+		}
+	}
+	if len(old.Threads) != len(c.Threads) {
+		out = append(out, "Threads")
+		c.Threads = nil
+	}
+	for i, t := range c.Threads {
+		o := old.Threads[i]
+		if t.PacketsDirectory != o.PacketsDirectory || t.IndexDirectory != o.IndexDirectory || t.Interface != o.Interface || !reflect.DeepEqual([]*int{t.Queue, t.CPU}, []*int{o.Queue, o.CPU}) {
+			out = append(out, fmt.Sprintf("Threads[%d]", i))
+		}
+	}
+	// Bearer tokens decide whether client certificates are required, which
+	// is fixed once serving, so they can't be turned on or off.
+	if tokensEnabled(old) != tokensEnabled(c) {
+		out = append(out, "APITokens")
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Reload applies the settings in c which can change while running:  query
+// limits, authentication and authorization, threads' retention settings, the
+// retention target, log verbosity, and the capture filter and threads'
+// ExtraDirectories and Placement, which restart stenotype.  Other changes are
+// logged as needing a restart, and otherwise ignored.  If c is invalid,
+// nothing changes.
+func (e *Env) Reload(c config.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	e.confMu.RLock()
+	old := e.conf
+	e.confMu.RUnlock()
+	restart := needsRestart(old, c)
+	threadsChanged := false
+	for _, name := range restart {
+		threadsChanged = threadsChanged || strings.HasPrefix(name, "Threads")
+	}
+
+	// Build everything that can fail before changing anything.
+	var authorizer *authz.Authorizer
+	if c.AuthzPolicyPath != "" {
+		if c.AuthzPolicyPath == old.AuthzPolicyPath {
+			authorizer = e.currentAuthorizer()
+		} else {
+			var err error
+			if authorizer, err = authz.New(c.AuthzPolicyPath); err != nil {
+				return err
+			}
+		}
+	}
+	tokens := e.currentTokens()
+	tokensToggled := tokensEnabled(c) != tokensEnabled(old)
+	if tokens != nil && !tokensToggled && !reflect.DeepEqual([]interface{}{old.APITokens, old.OIDCIssuer, old.OIDCClientID}, []interface{}{c.APITokens, c.OIDCIssuer, c.OIDCClientID}) {
+		var err error
+		if tokens, err = tokenauth.New(c.APITokens, c.OIDCIssuer, c.OIDCClientID); err != nil {
+			return err
+		}
+	}
+	var filterHex map[string]string
+	filterChanged := c.CaptureFilter != old.CaptureFilter && old.Captures()
+	if filterChanged {
+		if old.FilterFlag() {
+			return fmt.Errorf("CaptureFilter can't be set while Flags has a --filter flag, until a restart")
+		}
+		var err error
+		if filterHex, err = compileCaptureFilters(old.Interfaces(), c.CaptureFilter); err != nil {
+			return err
+		}
+	}
+	placementChanged := false
+	if !threadsChanged {
+		for i, t := range e.threads {
+			o := t.Config()
+			placementChanged = placementChanged || o.Placement != c.Threads[i].Placement || !reflect.DeepEqual(o.ExtraDirectories, c.Threads[i].ExtraDirectories)
+			if err := t.PrepareConfig(c.Threads[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Nothing below fails, so the reload applies in full.
+	if !threadsChanged {
+		for i, t := range e.threads {
+			if err := t.SetConfig(c.Threads[i]); err != nil {
+				log.Printf("ALERT: thread %d config prepared but not set: %v", i, err)
+			}
+		}
+	}
+
+	e.authMu.Lock()
+	e.authorizer = authorizer
+	e.tokens = tokens
+	e.authMu.Unlock()
+	applyQuerySettings(c)
+	e.confMu.Lock()
+	for name := range reloadable {
+		if (name == "Threads" && threadsChanged) || (tokensToggled && tokenFields[name]) {
+			continue
+		}
+		reflect.ValueOf(&e.conf).Elem().FieldByName(name).Set(reflect.ValueOf(c).FieldByName(name))
+	}
+	if filterChanged {
+		e.captureFilterHex = filterHex
+	}
+	e.confMu.Unlock()
+	if filterChanged {
+		captureFilterChanges.Increment()
+	}
+	if filterChanged || placementChanged {
+		// Stenotype picks up a new filter, and threads place their files,
+		// when it starts.
+		e.restartStenotype()
+	}
+	for _, name := range restart {
+		log.Printf("Config change to %v needs a restart to take effect", name)
+	}
+	return nil
+}
+
+// reloadConfig rereads the config file and reloads it, logging the result.
+func (e *Env) reloadConfig(filename, why string) error {
+	c, err := config.ReadConfigFile(filename)
+	if err == nil {
+		err = e.Reload(*c)
+	}
+	if err != nil {
+		configReloadFailures.Increment()
+		log.Printf("%v: keeping previous config: %v", why, err)
+		return err
+	}
+	configReloads.Increment()
+	log.Printf("%v: reloaded config %q", why, filename)
+	return nil
+}
+
+// configSettleDelay is how long after the config file changes it's reread,
+// so editors that write it in several steps are done.
+const configSettleDelay = time.Second
+
+// WatchConfig reloads the config from filename whenever it changes, or
+// stenographer gets a SIGHUP.
+func (e *Env) WatchConfig(filename string) {
+	e.configFile = filename
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			e.reloadConfig(filename, "SIGHUP")
+		}
+	}()
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		// The directory is watched rather than the file itself, since
+		// editors often replace files by renaming new ones over them.
+		err = w.Add(filepath.Dir(filename))
+	}
+	if err != nil {
+		log.Printf("Not watching config for changes, send SIGHUP to reload it: %v", err)
+		if w != nil {
+			w.Close()
+		}
+		return
+	}
+	go func() {
+		defer w.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case ev := <-w.Events:
+				if filepath.Clean(ev.Name) == filepath.Clean(filename) {
+					settle = time.After(configSettleDelay)
+				}
+			case err := <-w.Errors:
+				log.Printf("config watch error: %v", err)
+			case <-settle:
+				settle = nil
+				e.reloadConfig(filename, "config changed")
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// currentAuthorizer returns what authorizes clients, or nil if everything is
+// allowed.
+func (e *Env) currentAuthorizer() *authz.Authorizer {
+	e.authMu.RLock()
+	defer e.authMu.RUnlock()
+	return e.authorizer
+}
+
+// currentTokens returns what authenticates bearer tokens, or nil if they're
+// not accepted.
+func (e *Env) currentTokens() *tokenauth.Authenticator {
+	e.authMu.RLock()
+	defer e.authMu.RUnlock()
+	return e.tokens
+}
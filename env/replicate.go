@@ -0,0 +1,75 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+	"net/http"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/replicate"
+	"../replicate"
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+// setUpReplication has d replicate its files to c.ReplicateTo, or receive
+// them as a standby, if configured.
+func (d *Env) setUpReplication(c config.Config) error {
+	if c.Standby {
+		d.receiver = replicate.NewReceiver(c.Threads)
+	}
+	if c.ReplicateTo == "" {
+		return nil
+	}
+	client, err := stenoclient.NewFromCertPath(c.ReplicateTo, c.CertPath)
+	if err != nil {
+		return err
+	}
+	d.replicator = replicate.NewSender(c.ReplicateTo, client.HTTP)
+	go d.callEvery(d.replicateFiles, replicationFrequency)
+	return nil
+}
+
+// replicateFiles copies files the standby doesn't have yet from all threads.
+func (d *Env) replicateFiles() {
+	for _, t := range d.threads {
+		t.ReplicateFiles(context.Background(), d.replicator)
+	}
+}
+
+// handleReplica receives files replicated to a standby, which only clients
+// authorized to query every packet may send.
+func (e *Env) handleReplica(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if e.receiver == nil {
+		http.Error(w, "not a standby", http.StatusNotFound)
+		return
+	}
+	grant, ok := e.authorizeRequest(w, r, true)
+	if !ok {
+		return
+	}
+	if !grant.Unrestricted() {
+		writeQueryError(w, http.StatusForbidden, queryError{Code: "forbidden", Message: "replication needs access to every packet"})
+		return
+	}
+	e.receiver.ServeHTTP(w, r)
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// resumePoint is where a client asked for a query's results to be resumed
+// from:  after the packet captured at ts (to the given precision), and skip
+// more packets captured then.
+type resumePoint struct {
+	ts        time.Time
+	precision time.Duration
+	skip      int
+}
+
+// parseResume returns the point a query asked to be resumed from with
+// ?resume=SECONDS.FRACTION[:N], or nil if it didn't.  SECONDS.FRACTION is the
+// capture time of the last packet the client received, as printed by
+// `tcpdump -tt` (so in micros for pcap, or nanos for pcapng), and N is how
+// many packets captured then it received, by default 1.
+func parseResume(r *http.Request) (*resumePoint, error) {
+	token := r.URL.Query().Get("resume")
+	if token == "" {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("invalid resume parameter %q", token)
+	ts, count := token, "1"
+	if i := strings.Index(token, ":"); i >= 0 {
+		ts, count = token[:i], token[i+1:]
+	}
+	out := &resumePoint{precision: time.Second}
+	var err error
+	if out.skip, err = strconv.Atoi(count); err != nil || out.skip < 0 {
+		return nil, invalid
+	}
+	secs, frac := ts, ""
+	if i := strings.Index(ts, "."); i >= 0 {
+		secs, frac = ts[:i], ts[i+1:]
+	}
+	if len(frac) > 9 {
+		return nil, invalid
+	}
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || s < 0 {
+		return nil, invalid
+	}
+	var nanos int64
+	if frac != "" {
+		if nanos, err = strconv.ParseInt(frac, 10, 64); err != nil || nanos < 0 {
+			return nil, invalid
+		}
+		for range frac {
+			out.precision /= 10
+		}
+		nanos *= int64(out.precision)
+	}
+	out.ts = time.Unix(s, nanos)
+	return out, nil
+}
+
+// resumePackets drops the packets from in that a client resuming from point
+// already has:  those before it, and the first point.skip captured at it.
+// Packets are compared at the precision the client gave.
+func resumePackets(ctx context.Context, in *base.PacketChan, point *resumePoint) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		skipped, resumed := 0, false
+		for p := range in.Receive() {
+			if base.ContextDone(ctx) {
+				break
+			}
+			if !resumed {
+				ts := p.Timestamp.Truncate(point.precision)
+				if ts.Before(point.ts) {
+					continue
+				} else if ts.Equal(point.ts) && skipped < point.skip {
+					skipped++
+					continue
+				}
+				resumed = true
+			}
+			out.Send(p)
+		}
+		if err := ctx.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// resumeTracker tracks the resume parameter a client can send to resume a
+// query's results after the last packet written, at the precision the query
+// was itself resumed at, or nanos.
+type resumeTracker struct {
+	precision time.Duration
+	last      time.Time // Truncated to precision.
+	count     int       // Packets written captured at last.
+}
+
+// newResumeTracker returns a resumeTracker for a query resumed from point,
+// which may be nil.
+func newResumeTracker(point *resumePoint) *resumeTracker {
+	if point == nil {
+		return &resumeTracker{precision: time.Nanosecond}
+	}
+	return &resumeTracker{precision: point.precision, last: point.ts, count: point.skip}
+}
+
+// wrote records that p was written.
+func (t *resumeTracker) wrote(p *base.Packet) {
+	if ts := p.Timestamp.Truncate(t.precision); ts.Equal(t.last) {
+		t.count++
+	} else {
+		t.last, t.count = ts, 1
+	}
+}
+
+// token returns the resume parameter for after the last packet written, or
+// "" if none have been.
+func (t *resumeTracker) token() string {
+	if t.count == 0 {
+		return ""
+	}
+	out := strconv.FormatInt(t.last.Unix(), 10)
+	digits := 0
+	for p := time.Second; p > t.precision; p /= 10 {
+		digits++
+	}
+	if digits > 0 {
+		out += fmt.Sprintf(".%0*d", digits, int64(t.last.Nanosecond())/int64(t.precision))
+	}
+	return fmt.Sprintf("%s:%d", out, t.count)
+}
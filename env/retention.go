@@ -0,0 +1,150 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+const retentionCheckFrequency = time.Minute
+
+var retentionShortfallThreads = stats.S.Get("retention_shortfall_threads")
+
+// retentionStatus describes how much packet history a single thread retains
+// compared to the configured RetentionTarget.
+type retentionStatus struct {
+	Thread    int
+	Retained  string
+	Target    string
+	Shortfall bool
+	// Aging is true once the thread has started deleting old files.  Until
+	// then, retention is only limited by how long we've been running.
+	Aging bool
+}
+
+// retentionTarget returns the configured RetentionTarget, or 0 if there's
+// none.
+func (d *Env) retentionTarget() time.Duration {
+	d.confMu.RLock()
+	defer d.confMu.RUnlock()
+	target, _ := time.ParseDuration(d.conf.RetentionTarget) // checked by Validate
+	return target
+}
+
+// retentionStatuses computes the current retention of each thread.
+func (d *Env) retentionStatuses() []retentionStatus {
+	target := d.retentionTarget()
+	now := time.Now()
+	out := make([]retentionStatus, len(d.threads))
+	for i, t := range d.threads {
+		u := t.Usage()
+		var retained time.Duration
+		if !u.Oldest.IsZero() {
+			retained = now.Sub(u.Oldest)
+		}
+		out[i] = retentionStatus{
+			Thread:    i,
+			Retained:  retained.String(),
+			Target:    target.String(),
+			Aging:     u.Aged > 0,
+			Shortfall: u.Aged > 0 && retained < target,
+		}
+		stats.S.Get(fmt.Sprintf("thread%d_retained_seconds", i)).Set(int64(retained.Seconds()))
+	}
+	return out
+}
+
+// checkRetention exports retention stats and logs whenever a thread's
+// effective retention drops below, or recovers to, the configured target.
+func (d *Env) checkRetention() {
+	if d.retentionTarget() == 0 {
+		for i := range d.retentionShort {
+			d.retentionShort[i] = false
+		}
+		retentionShortfallThreads.Set(0)
+		return
+	}
+	short := 0
+	for _, s := range d.retentionStatuses() {
+		if s.Shortfall {
+			short++
+		}
+		if s.Shortfall != d.retentionShort[s.Thread] {
+			if s.Shortfall {
+				log.Printf("ALERT: thread %d retains only %v of packets, below retention target %v", s.Thread, s.Retained, s.Target)
+			} else {
+				log.Printf("Thread %d retention of %v meets retention target %v again", s.Thread, s.Retained, s.Target)
+			}
+			d.retentionShort[s.Thread] = s.Shortfall
+		}
+	}
+	retentionShortfallThreads.Set(int64(short))
+}
+
+// queryWarning is sent as JSON in the Steno-Warning header of query responses
+// whose results are known to be incomplete.
+type queryWarning struct {
+	Code    string // Machine-readable warning type, like "range_unavailable".
+	Message string
+	// UnavailableStart and UnavailableEnd bound the requested time range
+	// that's no longer retained.
+	UnavailableStart time.Time `json:",omitempty"`
+	UnavailableEnd   time.Time `json:",omitempty"`
+}
+
+// retentionWarning returns a warning if q asks for packets older than those
+// every thread still retains, or nil if it doesn't.  Files outside a query's
+// time range are never read, so the query is effectively clamped to what's
+// retained either way; this just tells the user about it.
+func (d *Env) retentionWarning(q query.Query) *queryWarning {
+	start, stop := query.TimeSpan(q)
+	if start.IsZero() {
+		return nil
+	}
+	// Threads age out files independently, so only packets after the newest
+	// of their oldest files are retained by all of them.  Archived files count.
+	var retained time.Time
+	for i, t := range d.threads {
+		oldest := t.Usage().Oldest
+		if d.archive != nil {
+			if a := d.archive.Oldest(i); !a.IsZero() && (oldest.IsZero() || a.Before(oldest)) {
+				oldest = a
+			}
+		}
+		if oldest.After(retained) {
+			retained = oldest
+		}
+	}
+	if retained.IsZero() || !start.Before(retained) {
+		return nil
+	}
+	end := retained
+	if !stop.IsZero() && stop.Before(end) {
+		end = stop
+	}
+	return &queryWarning{
+		Code:             "range_unavailable",
+		Message:          fmt.Sprintf("packets before %v are no longer retained, results only cover %v onwards", retained.Format(time.RFC3339), retained.Format(time.RFC3339)),
+		UnavailableStart: start,
+		UnavailableEnd:   end,
+	}
+}
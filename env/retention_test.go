@@ -0,0 +1,187 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// retentionEnv returns an Env with a thread for each of starts, keeping at
+// most maxFiles files, with files started at each of its times, and a
+// function cleaning up after it.
+func retentionEnv(t *testing.T, maxFiles int, starts ...[]time.Time) (*Env, func()) {
+	e := &Env{}
+	var cleanups []func()
+	for _, times := range starts {
+		files := map[string]string{}
+		for _, ts := range times {
+			files[datedFile(ts)] = "dhcp"
+		}
+		threads, cleanup := testThreads(t, maxFiles, files)
+		e.threads = append(e.threads, threads...)
+		cleanups = append(cleanups, cleanup)
+	}
+	e.retentionShort = make([]bool, len(e.threads))
+	return e, func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+}
+
+func TestRetentionStatuses(t *testing.T) {
+	now := time.Now()
+	hoursAgo := func(hours ...int) (out []time.Time) {
+		for _, h := range hours {
+			out = append(out, now.Add(-time.Duration(h)*time.Hour))
+		}
+		return out
+	}
+	for _, test := range []struct {
+		desc      string
+		maxFiles  int
+		starts    []time.Time
+		target    string
+		wantAging bool
+		wantShort bool
+		wantHours int
+	}{
+		// Until files are aged out, retention is only limited by how long
+		// stenographer's been capturing.
+		{"not aging", 10, hoursAgo(2, 1), "3h", false, false, 2},
+		{"aging below target", 2, hoursAgo(3, 2, 1), "3h", true, true, 2},
+		{"aging above target", 2, hoursAgo(3, 2, 1), "1h", true, false, 2},
+		{"no target", 2, hoursAgo(3, 2, 1), "", true, false, 2},
+		{"no files", 10, nil, "3h", false, false, 0},
+	} {
+		e, cleanup := retentionEnv(t, test.maxFiles, test.starts)
+		e.conf.RetentionTarget = test.target
+		got := e.retentionStatuses()
+		cleanup()
+		if len(got) != 1 {
+			t.Errorf("%v: got %d statuses, want 1", test.desc, len(got))
+			continue
+		}
+		s := got[0]
+		if s.Aging != test.wantAging || s.Shortfall != test.wantShort {
+			t.Errorf("%v: got %+v, want aging %v, shortfall %v", test.desc, s, test.wantAging, test.wantShort)
+		}
+		retained, err := time.ParseDuration(s.Retained)
+		if err != nil {
+			t.Errorf("%v: got retained %q: %v", test.desc, s.Retained, err)
+		} else if want := time.Duration(test.wantHours) * time.Hour; retained < want || retained > want+time.Minute {
+			t.Errorf("%v: got retained %v, want %v", test.desc, retained, want)
+		}
+		if got, want := stats.S.Get("thread0_retained_seconds").Value(), int64(test.wantHours*3600); got < want || got > want+60 {
+			t.Errorf("%v: got %d seconds retained exported, want %d", test.desc, got, want)
+		}
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	now := time.Now()
+	// The first thread has aged out files older than 2h, and the second
+	// hasn't had to.
+	e, cleanup := retentionEnv(t, 2,
+		[]time.Time{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Hour)},
+		[]time.Time{now.Add(-time.Hour)})
+	defer cleanup()
+	for _, test := range []struct {
+		target string
+		want   []bool
+	}{
+		{"3h", []bool{true, false}},
+		{"3h", []bool{true, false}}, // Still short.
+		{"1h", []bool{false, false}},
+		{"3h", []bool{true, false}},
+		{"", []bool{false, false}},
+	} {
+		e.conf.RetentionTarget = test.target
+		e.checkRetention()
+		short := int64(0)
+		for i, want := range test.want {
+			if e.retentionShort[i] != want {
+				t.Errorf("target %q: thread %d got short %v, want %v", test.target, i, e.retentionShort[i], want)
+			}
+			if want {
+				short++
+			}
+		}
+		if got := retentionShortfallThreads.Value(); got != short {
+			t.Errorf("target %q: got %d threads short exported, want %d", test.target, got, short)
+		}
+	}
+}
+
+func TestRetentionWarning(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	at := func(ago time.Duration) string { return now.Add(-ago).UTC().Format(time.RFC3339) }
+	// Only packets since the second thread's oldest file, an hour ago, are
+	// retained by both.
+	e, cleanup := retentionEnv(t, 10, []time.Time{now.Add(-2 * time.Hour)}, []time.Time{now.Add(-time.Hour)})
+	defer cleanup()
+	retained := now.Add(-time.Hour)
+	for _, test := range []struct {
+		query     string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"after " + at(3*time.Hour), now.Add(-3 * time.Hour), retained},
+		{fmt.Sprintf("after %v and before %v", at(3*time.Hour), at(90*time.Minute)), now.Add(-3 * time.Hour), now.Add(-90 * time.Minute)},
+		{fmt.Sprintf("after %v and before %v", at(3*time.Hour), at(30*time.Minute)), now.Add(-3 * time.Hour), retained},
+		{"after " + at(90*time.Minute), now.Add(-90 * time.Minute), retained}, // Only the first thread has it.
+		{"after " + at(time.Hour), time.Time{}, time.Time{}},
+		{"after " + at(30*time.Minute), time.Time{}, time.Time{}},
+		{"before " + at(3*time.Hour), time.Time{}, time.Time{}}, // Only queries with a start are warned about.
+		{"port 67", time.Time{}, time.Time{}},
+	} {
+		q, err := query.NewQuery(test.query)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		w := e.retentionWarning(q)
+		if test.wantStart.IsZero() {
+			if w != nil {
+				t.Errorf("%q: got warning %+v, want none", test.query, w)
+			}
+			continue
+		}
+		if w == nil {
+			t.Errorf("%q: got no warning, want one", test.query)
+			continue
+		}
+		if w.Code != "range_unavailable" || !w.UnavailableStart.Equal(test.wantStart) || !w.UnavailableEnd.Equal(test.wantEnd) {
+			t.Errorf("%q: got %+v, want %v to %v unavailable", test.query, w, test.wantStart, test.wantEnd)
+		}
+	}
+
+	// Nothing's known to be missing before any files are written.
+	e, cleanup = retentionEnv(t, 10, nil)
+	defer cleanup()
+	q, err := query.NewQuery("after " + at(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := e.retentionWarning(q); w != nil {
+		t.Errorf("without files got warning %+v, want none", w)
+	}
+}
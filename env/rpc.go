@@ -0,0 +1,320 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/protobuf"
+	"../protobuf"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// rpcMaxQueryBytes caps the pcap the Query RPC returns, leaving room for
+	// the packet that crosses it under gRPC's default 4MB message limit.
+	rpcMaxQueryBytes = 4<<20 - 128<<10
+	// rpcBatchPackets and rpcBatchBytes cap the size of each PacketBatch
+	// QueryStream sends.
+	rpcBatchPackets = 1000
+	rpcBatchBytes   = 1 << 20
+)
+
+// serveRPC serves the gRPC API on the configured RPCPort, with the same TLS
+// setup as the HTTP API.
+func (e *Env) serveRPC() error {
+	tlsConfig := e.tlsConfig.Clone()
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", e.conf.Host, e.conf.RPCPort))
+	if err != nil {
+		return fmt.Errorf("cannot listen for gRPC: %v", err)
+	}
+	server := grpc.NewServer(append(e.rpcAuthInterceptors(), grpc.Creds(credentials.NewTLS(tlsConfig)))...)
+	protobuf.RegisterStenographerServer(server, &rpcServer{e})
+	e.servers.mu.Lock()
+	e.servers.grpc = server
+	e.servers.mu.Unlock()
+	return server.Serve(listener)
+}
+
+// rpcServer implements protobuf.StenographerServer.
+type rpcServer struct {
+	e *Env
+}
+
+// rpcQuery is a query started by a gRPC call.
+type rpcQuery struct {
+	id      int64
+	ctx     base.Context
+	packets *base.PacketChan
+	limit   base.Limit
+	snaplen int
+	done    func(packets int64, sum string, err error)
+}
+
+// startQuery parses a query request and starts looking it up, registering
+// it to be listed by Jobs.  written should be atomically updated with the
+// bytes sent back.  Call done once the query's finished, with the packets
+// sent back, the SHA-256 of the response if it has one, and any error, so
+// it's audited.
+func (s *rpcServer) startQuery(ctx context.Context, method string, req *protobuf.QueryRequest, tagThreads bool, written *int64) (*rpcQuery, error) {
+	if req.LanguageVersion < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid language version %d", req.LanguageVersion)
+	}
+	q, err := query.ParseWithOptions(req.Query, query.ParseOptions{
+		LanguageVersion: int(req.LanguageVersion),
+		Vars:            req.Vars,
+	})
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", parseQueryError(err).Message)
+	}
+	grant, err := s.e.authorize(ctx, rpcCert(ctx), true)
+	if err != nil {
+		return nil, grpc.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	q = grant.Restrict(q, time.Now())
+	dedup, err := parseDedup(req.Dedup)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if req.LimitBytes < 0 || req.LimitPackets < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid limit")
+	}
+	snaplen := int(req.Snaplen)
+	if snaplen < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid snaplen %d", req.Snaplen)
+	} else if snaplen == 0 || snaplen > base.SnapLen {
+		snaplen = base.SnapLen
+	}
+	lookupCtx := base.NewContext(time.Minute * 15)
+	go func() {
+		select {
+		case <-ctx.Done():
+			lookupCtx.Cancel()
+		case <-lookupCtx.Done():
+		}
+	}()
+	id := s.e.running.add(method, rpcIdentity(ctx), req.Query, written, lookupCtx.Cancel)
+	observe := querySeconds.SecondsTimer()
+	return &rpcQuery{
+		id:      id,
+		ctx:     lookupCtx,
+		packets: s.e.lookup(base.WithLogAttrs(lookupCtx, "query_id", id, "client", rpcIdentity(ctx)), q, tagThreads, dedup, nil),
+		limit:   base.Limit{Bytes: req.LimitBytes, Packets: req.LimitPackets},
+		snaplen: snaplen,
+		done: func(packets int64, sum string, err error) {
+			observe()
+			s.e.running.remove(id)
+			lookupCtx.Cancel()
+			s.e.recordRetrieval(audit.Record{
+				QueryID: id,
+				API:     method,
+				Client:  rpcIdentity(ctx),
+				Query:   req.Query,
+				Packets: packets,
+				Bytes:   atomic.LoadInt64(written),
+				SHA256:  sum,
+			}, err)
+		},
+	}, nil
+}
+
+// Query implements protobuf.StenographerServer.
+func (s *rpcServer) Query(ctx context.Context, req *protobuf.QueryRequest) (_ *protobuf.QueryResponse, err error) {
+	var buf bytes.Buffer
+	out := &countingWriter{w: &buf}
+	r, err := s.startQuery(ctx, "Query", req, false, &out.n)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	var sum string
+	defer func() { r.done(count, sum, err) }()
+	limit, capped := r.limit, false
+	if limit.Bytes == 0 || limit.Bytes > rpcMaxQueryBytes {
+		limit.Bytes, capped = rpcMaxQueryBytes, true
+	}
+	if count, err = base.PacketsToFileCount(r.packets, out, limit, r.snaplen); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	}
+	if capped && buf.Len() >= rpcMaxQueryBytes {
+		return nil, grpc.Errorf(codes.ResourceExhausted, "results are over %d bytes, use QueryStream", rpcMaxQueryBytes)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	sum = hex.EncodeToString(hash[:])
+	return &protobuf.QueryResponse{JobId: r.id, Pcap: buf.Bytes()}, nil
+}
+
+// QueryStream implements protobuf.StenographerServer.
+func (s *rpcServer) QueryStream(req *protobuf.QueryRequest, stream protobuf.Stenographer_QueryStreamServer) (err error) {
+	var written int64
+	r, err := s.startQuery(stream.Context(), "QueryStream", req, true, &written)
+	if err != nil {
+		return err
+	}
+	var count int64
+	defer func() { r.done(count, "", err) }()
+	defer r.packets.Discard()
+	if err := stream.Send(&protobuf.PacketBatch{JobId: r.id}); err != nil {
+		return err
+	}
+	batch := &protobuf.PacketBatch{}
+	batchBytes := 0
+	send := func() error {
+		if len(batch.Packets) == 0 {
+			return nil
+		}
+		if err := stream.Send(batch); err != nil {
+			return err
+		}
+		atomic.AddInt64(&written, int64(batchBytes))
+		count += int64(len(batch.Packets))
+		batch, batchBytes = &protobuf.PacketBatch{}, 0
+		return nil
+	}
+	for p := range r.packets.Receive() {
+		p.Truncate(r.snaplen)
+		batch.Packets = append(batch.Packets, &protobuf.Packet{
+			TimestampNanos: p.Timestamp.UnixNano(),
+			Length:         int64(p.Length),
+			Thread:         int32(p.InterfaceIndex),
+			Data:           p.Data,
+		})
+		batchBytes += len(p.Data)
+		stop := r.limit.ShouldStopAfter(base.Limit{Bytes: int64(len(p.Data)), Packets: 1})
+		if len(batch.Packets) >= rpcBatchPackets || batchBytes >= rpcBatchBytes || stop {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if stop {
+			return nil
+		}
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	if err := r.packets.Err(); err != nil {
+		if r.ctx.Err() != nil {
+			return grpc.Errorf(codes.Canceled, "%v", err)
+		}
+		return grpc.Errorf(codes.Internal, "%v", err)
+	}
+	return nil
+}
+
+// authorizeUnrestricted returns a PermissionDenied error unless the client
+// of a gRPC call is authorized to query every packet, as it must be to see
+// stats and other clients' jobs.
+func (s *rpcServer) authorizeUnrestricted(ctx context.Context) error {
+	grant, err := s.e.authorize(ctx, rpcCert(ctx), true)
+	if err != nil {
+		return grpc.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	if !grant.Unrestricted() {
+		return grpc.Errorf(codes.PermissionDenied, "needs access to every packet")
+	}
+	return nil
+}
+
+// Stats implements protobuf.StenographerServer.
+func (s *rpcServer) Stats(ctx context.Context, req *protobuf.StatsRequest) (*protobuf.StatsResponse, error) {
+	if err := s.authorizeUnrestricted(ctx); err != nil {
+		return nil, err
+	}
+	return &protobuf.StatsResponse{Stats: stats.S.Values()}, nil
+}
+
+// Jobs implements protobuf.StenographerServer.
+func (s *rpcServer) Jobs(ctx context.Context, req *protobuf.JobsRequest) (*protobuf.JobsResponse, error) {
+	if err := s.authorizeUnrestricted(ctx); err != nil {
+		return nil, err
+	}
+	out := &protobuf.JobsResponse{}
+	for _, q := range s.e.running.list() {
+		out.Jobs = append(out.Jobs, &protobuf.Job{
+			Id:             q.ID,
+			Method:         q.Path,
+			StartUnixNanos: q.Start.UnixNano(),
+			Client:         q.Client,
+			Query:          q.Query,
+			Bytes:          q.Bytes,
+		})
+	}
+	return out, nil
+}
+
+// CancelJob implements protobuf.StenographerServer.
+func (s *rpcServer) CancelJob(ctx context.Context, req *protobuf.CancelJobRequest) (*protobuf.CancelJobResponse, error) {
+	if err := s.authorizeUnrestricted(ctx); err != nil {
+		return nil, err
+	}
+	if !s.e.running.cancel(req.Id) {
+		return nil, grpc.Errorf(codes.NotFound, "no job %d running", req.Id)
+	}
+	queriesCanceled.Increment()
+	log.Printf("Query %d canceled by %v", req.Id, rpcIdentity(ctx))
+	return &protobuf.CancelJobResponse{}, nil
+}
+
+// rpcIdentity is httputil.Identity for gRPC calls.
+func rpcIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if id, ok := tokenauth.FromContext(ctx); ok {
+		return id.Subject
+	}
+	if cert := rpcCert(ctx); cert != nil && certs.Name(cert) != "" {
+		return certs.Name(cert)
+	}
+	return p.Addr.String()
+}
+
+// rpcCert returns the certificate the client of a gRPC call authenticated
+// with, or nil if it didn't present one.
+func rpcCert(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		return info.State.PeerCertificates[0]
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/protobuf"
+	"../protobuf"
+	//"github.com/google/stenographer/thread"
+	"../thread"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// dhcpPackets is how many packets testdata's dhcp file has, all to or from
+// port 67.
+const dhcpPackets = 4
+
+// packetThreads returns a thread serving copies of the given files from
+// testdata, and a function cleaning up after it.
+func packetThreads(t *testing.T, names ...string) ([]*thread.Thread, func()) {
+	files := map[string]string{}
+	for _, name := range names {
+		files[name] = name
+	}
+	return testThreads(t, 10, files)
+}
+
+// datedFile returns the name stenotype gives a file it starts writing at ts.
+func datedFile(ts time.Time) string {
+	return strconv.FormatInt(ts.UnixNano()/1000, 10)
+}
+
+// testThreads returns a thread keeping at most maxFiles files, which serves
+// the testdata files named by files' values as its keys, and a function
+// cleaning up after it.  Files over maxFiles are aged out, oldest first.
+func testThreads(t *testing.T, maxFiles int, files map[string]string) ([]*thread.Thread, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := []config.ThreadConfig{{
+		PacketsDirectory:   filepath.Join(dir, "pkt"),
+		IndexDirectory:     filepath.Join(dir, "idx"),
+		DiskFreePercentage: 10,
+		MaxDirectoryFiles:  maxFiles,
+	}}
+	for from, to := range map[string]string{"../testdata/PKT0": tc[0].PacketsDirectory, "../testdata/IDX0": tc[0].IndexDirectory} {
+		if err := os.MkdirAll(to, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for name, src := range files {
+			data, err := ioutil.ReadFile(filepath.Join(from, src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(to, name), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	threads, err := thread.Threads(tc, filepath.Join(dir, "base"), filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, th := range threads {
+		th.SyncFiles()
+	}
+	return threads, func() { os.RemoveAll(dir) }
+}
+
+// pcapPackets returns the number of packets in the pcap file data.
+func pcapPackets(t *testing.T, data []byte) int {
+	if len(data) < 24 {
+		t.Fatalf("pcap is only %d bytes", len(data))
+	}
+	count := 0
+	for data = data[24:]; len(data) > 0; count++ {
+		if len(data) < 16 {
+			t.Fatalf("pcap has a truncated packet header")
+		}
+		n := int(binary.LittleEndian.Uint32(data[8:12]))
+		if len(data) < 16+n {
+			t.Fatalf("pcap has a truncated packet")
+		}
+		data = data[16+n:]
+	}
+	return count
+}
+
+// rpcContext returns the context of a gRPC call from a client with a
+// certificate with the given CN and OU, or no certificate if both are empty.
+func rpcContext(cn, ou string) context.Context {
+	p := &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 41234}}
+	if cn != "" || ou != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		if ou != "" {
+			cert.Subject.OrganizationalUnit = []string{ou}
+		}
+		p.AuthInfo = credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+	}
+	return peer.NewContext(context.Background(), p)
+}
+
+// queryStream is a protobuf.Stenographer_QueryStreamServer keeping the
+// batches sent.
+type queryStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	batches []*protobuf.PacketBatch
+}
+
+func (s *queryStream) Context() context.Context { return s.ctx }
+
+func (s *queryStream) Send(b *protobuf.PacketBatch) error {
+	s.batches = append(s.batches, b)
+	return nil
+}
+
+// rpcEnv returns an Env authorizing clients with testPolicy, serving the dhcp
+// test file, and a function cleaning up after it.
+func rpcEnv(t *testing.T) (*Env, func()) {
+	e, cleanupAuthz := authzEnv(t, testPolicy)
+	threads, cleanupThreads := packetThreads(t, "dhcp")
+	e.threads = threads
+	e.conf.Threads = make([]config.ThreadConfig, len(threads))
+	return e, func() {
+		cleanupThreads()
+		cleanupAuthz()
+	}
+}
+
+func TestRPCQuery(t *testing.T) {
+	e, cleanup := rpcEnv(t)
+	defer cleanup()
+	s := &rpcServer{e}
+	for _, test := range []struct {
+		desc        string
+		cn, ou      string
+		req         protobuf.QueryRequest
+		wantCode    codes.Code
+		wantPackets int
+	}{
+		{"unrestricted", "analyst", "soc", protobuf.QueryRequest{Query: "port 67"}, codes.OK, dhcpPackets},
+		{"packet limit", "analyst", "soc", protobuf.QueryRequest{Query: "port 67", LimitPackets: 1}, codes.OK, 1},
+		// The test packets are outside what restricted clients may see.
+		{"subnet restricted", "contractor", "", protobuf.QueryRequest{Query: "port 67"}, codes.OK, 0},
+		{"tenant", "analyst", "blue-team", protobuf.QueryRequest{Query: "port 67"}, codes.OK, 0},
+		{"flows only", "netops", "noc", protobuf.QueryRequest{Query: "port 67"}, codes.PermissionDenied, 0},
+		{"not in policy", "stranger", "", protobuf.QueryRequest{Query: "port 67"}, codes.PermissionDenied, 0},
+		{"no certificate", "", "", protobuf.QueryRequest{Query: "port 67"}, codes.PermissionDenied, 0},
+		{"bad query", "analyst", "soc", protobuf.QueryRequest{Query: "port"}, codes.InvalidArgument, 0},
+		{"bad limit", "analyst", "soc", protobuf.QueryRequest{Query: "port 67", LimitBytes: -1}, codes.InvalidArgument, 0},
+		{"bad snaplen", "analyst", "soc", protobuf.QueryRequest{Query: "port 67", Snaplen: -1}, codes.InvalidArgument, 0},
+	} {
+		resp, err := s.Query(rpcContext(test.cn, test.ou), &test.req)
+		if code := grpc.Code(err); code != test.wantCode {
+			t.Errorf("%v: got %v (%v), want %v", test.desc, code, err, test.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := pcapPackets(t, resp.Pcap); got != test.wantPackets {
+			t.Errorf("%v: got %d packets, want %d", test.desc, got, test.wantPackets)
+		}
+		if resp.JobId == 0 {
+			t.Errorf("%v: got no job ID", test.desc)
+		}
+	}
+	if jobs := e.running.list(); len(jobs) != 0 {
+		t.Errorf("finished queries still listed as jobs: %+v", jobs)
+	}
+}
+
+func TestRPCQueryStream(t *testing.T) {
+	e, cleanup := rpcEnv(t)
+	defer cleanup()
+	s := &rpcServer{e}
+	for _, test := range []struct {
+		desc        string
+		cn, ou      string
+		req         protobuf.QueryRequest
+		wantCode    codes.Code
+		wantPackets int
+	}{
+		{"unrestricted", "analyst", "soc", protobuf.QueryRequest{Query: "port 67"}, codes.OK, dhcpPackets},
+		{"packet limit", "analyst", "soc", protobuf.QueryRequest{Query: "port 67", LimitPackets: 2}, codes.OK, 2},
+		{"subnet restricted", "contractor", "", protobuf.QueryRequest{Query: "port 67"}, codes.OK, 0},
+		{"tenant", "analyst", "blue-team", protobuf.QueryRequest{Query: "port 67"}, codes.OK, 0},
+		{"flows only", "netops", "noc", protobuf.QueryRequest{Query: "port 67"}, codes.PermissionDenied, 0},
+		{"not in policy", "stranger", "", protobuf.QueryRequest{Query: "port 67"}, codes.PermissionDenied, 0},
+		{"bad query", "analyst", "soc", protobuf.QueryRequest{Query: "port"}, codes.InvalidArgument, 0},
+	} {
+		stream := &queryStream{ctx: rpcContext(test.cn, test.ou)}
+		err := s.QueryStream(&test.req, stream)
+		if code := grpc.Code(err); code != test.wantCode {
+			t.Errorf("%v: got %v (%v), want %v", test.desc, code, err, test.wantCode)
+			continue
+		}
+		if err != nil {
+			if len(stream.batches) != 0 {
+				t.Errorf("%v: got %d batches after failing", test.desc, len(stream.batches))
+			}
+			continue
+		}
+		// The first batch names the job, before any packets are found.
+		if len(stream.batches) == 0 || stream.batches[0].JobId == 0 || len(stream.batches[0].Packets) != 0 {
+			t.Errorf("%v: first batch doesn't just name the job: %+v", test.desc, stream.batches)
+			continue
+		}
+		got := 0
+		for _, b := range stream.batches[1:] {
+			for _, p := range b.Packets {
+				if p.Thread != 0 || p.Length < int64(len(p.Data)) || p.TimestampNanos == 0 {
+					t.Errorf("%v: bad packet %+v", test.desc, p)
+				}
+				got++
+			}
+		}
+		if got != test.wantPackets {
+			t.Errorf("%v: got %d packets, want %d", test.desc, got, test.wantPackets)
+		}
+	}
+	if jobs := e.running.list(); len(jobs) != 0 {
+		t.Errorf("finished queries still listed as jobs: %+v", jobs)
+	}
+}
+
+func TestRPCJobs(t *testing.T) {
+	e, cleanup := authzEnv(t, testPolicy)
+	defer cleanup()
+	s := &rpcServer{e}
+	written := int64(1234)
+	canceled := false
+	id := e.running.add("/query", "analyst", "port 67", &written, func() { canceled = true })
+
+	for _, test := range []struct {
+		cn, ou string
+		want   codes.Code
+	}{
+		{"contractor", "", codes.PermissionDenied},
+		{"analyst", "blue-team", codes.PermissionDenied},
+		{"netops", "noc", codes.PermissionDenied},
+		{"stranger", "", codes.PermissionDenied},
+	} {
+		ctx := rpcContext(test.cn, test.ou)
+		if _, err := s.Jobs(ctx, &protobuf.JobsRequest{}); grpc.Code(err) != test.want {
+			t.Errorf("Jobs by %v/%v got %v, want %v", test.cn, test.ou, err, test.want)
+		}
+		if _, err := s.CancelJob(ctx, &protobuf.CancelJobRequest{Id: id}); grpc.Code(err) != test.want {
+			t.Errorf("CancelJob by %v/%v got %v, want %v", test.cn, test.ou, err, test.want)
+		}
+	}
+	if canceled {
+		t.Fatal("job canceled by client without access to every packet")
+	}
+
+	ctx := rpcContext("analyst", "soc")
+	resp, err := s.Jobs(ctx, &protobuf.JobsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Jobs) != 1 {
+		t.Fatalf("got jobs %+v, want 1", resp.Jobs)
+	}
+	job := resp.Jobs[0]
+	job.StartUnixNanos = 0
+	if want := (protobuf.Job{Id: id, Method: "/query", Client: "analyst", Query: "port 67", Bytes: 1234}); !reflect.DeepEqual(*job, want) {
+		t.Errorf("got job %+v, want %+v", *job, want)
+	}
+	if _, err := s.CancelJob(ctx, &protobuf.CancelJobRequest{Id: id + 1}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("canceling unknown job got %v, want NotFound", err)
+	}
+	if _, err := s.CancelJob(ctx, &protobuf.CancelJobRequest{Id: id}); err != nil || !canceled {
+		t.Errorf("canceling job got %v, canceled %v", err, canceled)
+	}
+}
+
+func TestRPCAuthenticate(t *testing.T) {
+	e, cleanup := rpcEnv(t)
+	defer cleanup()
+	e.conf.FederatorNames = []string{"federator"}
+	sum := sha256.Sum256([]byte("s3cret"))
+	tokens, err := tokenauth.New([]config.APIToken{{Subject: "splunk", Groups: []string{"soc"}, SHA256: hex.EncodeToString(sum[:])}}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withMetadata := func(ctx context.Context, kv ...string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(kv...))
+	}
+	for _, test := range []struct {
+		desc        string
+		tokens      *tokenauth.Authenticator
+		ctx         context.Context
+		wantCode    codes.Code
+		wantID      *tokenauth.Identity // Of a client authenticated by token or federator.
+		wantPackets int                 // Returned to the client's query.
+	}{
+		{"certificate", tokens, rpcContext("analyst", "soc"), codes.OK, nil, dhcpPackets},
+		{"token", tokens, withMetadata(rpcContext("", ""), "authorization", "Bearer s3cret"), codes.OK, &tokenauth.Identity{Subject: "splunk", Groups: []string{"soc"}}, dhcpPackets},
+		{"wrong token", tokens, withMetadata(rpcContext("", ""), "authorization", "Bearer s3cre"), codes.Unauthenticated, nil, 0},
+		{"no credentials", tokens, rpcContext("", ""), codes.Unauthenticated, nil, 0},
+		{"no tokens accepted", nil, rpcContext("", ""), codes.OK, nil, -1},
+		{"federated", tokens, withMetadata(rpcContext("federator", ""), "steno-client", "alice", "steno-client-groups", "soc,noc"), codes.OK, &tokenauth.Identity{Subject: "alice", Groups: []string{"soc", "noc"}}, dhcpPackets},
+		{"federated restricted", tokens, withMetadata(rpcContext("federator", ""), "steno-client", "contractor"), codes.OK, &tokenauth.Identity{Subject: "contractor"}, 0},
+		{"federated without client", tokens, rpcContext("federator", ""), codes.PermissionDenied, nil, 0},
+		// Only federators may name clients.
+		{"not a federator", tokens, withMetadata(rpcContext("analyst", "soc"), "steno-client", "contractor"), codes.OK, nil, dhcpPackets},
+		{"token naming client", tokens, withMetadata(rpcContext("", ""), "authorization", "Bearer s3cret", "steno-client", "contractor"), codes.OK, &tokenauth.Identity{Subject: "splunk", Groups: []string{"soc"}}, dhcpPackets},
+	} {
+		e.tokens = test.tokens
+		ctx, err := e.rpcAuthenticate(test.ctx)
+		if code := grpc.Code(err); code != test.wantCode {
+			t.Errorf("%v: got %v (%v), want %v", test.desc, code, err, test.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		id, ok := tokenauth.FromContext(ctx)
+		if (test.wantID == nil) != !ok || (ok && !reflect.DeepEqual(id, *test.wantID)) {
+			t.Errorf("%v: got identity %+v, %v; want %+v", test.desc, id, ok, test.wantID)
+		}
+		if test.wantPackets < 0 {
+			continue
+		}
+		// The query is authorized as whoever the call authenticated as.
+		resp, err := (&rpcServer{e}).Query(ctx, &protobuf.QueryRequest{Query: "port 67"})
+		if err != nil {
+			t.Errorf("%v: query failed: %v", test.desc, err)
+		} else if got := pcapPackets(t, resp.Pcap); got != test.wantPackets {
+			t.Errorf("%v: got %d packets, want %d", test.desc, got, test.wantPackets)
+		}
+	}
+}
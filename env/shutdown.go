@@ -0,0 +1,138 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	// defaultShutdownTimeout is used if the config has no ShutdownTimeout.
+	defaultShutdownTimeout = 30 * time.Second
+	// stenotypeStopTimeout is how long stenotype may take to flush its files
+	// and write their indexes when stopped, before it's killed.
+	stenotypeStopTimeout = 2 * time.Minute
+)
+
+// servers are the HTTP and gRPC servers Serve started, for Shutdown to stop.
+type servers struct {
+	mu   sync.Mutex
+	http *http.Server
+	grpc *grpc.Server
+}
+
+// stopping returns whether Shutdown has been called.
+func (d *Env) stopping() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownTimeout returns how long Shutdown waits for in-flight queries.
+func (d *Env) shutdownTimeout() time.Duration {
+	if t, err := time.ParseDuration(d.conf.ShutdownTimeout); err == nil {
+		return t
+	}
+	return defaultShutdownTimeout
+}
+
+// Shutdown stops stenographer gracefully.  It stops its background work and
+// accepting requests, and waits up to ShutdownTimeout for in-flight queries to finish, canceling
+// those still running.  Then it stops each stenotype, which flushes its
+// current packet files and writes their indexes, and waits for them to exit,
+// so every packet they captured is queryable after a restart.
+func (d *Env) Shutdown() {
+	close(d.done)
+	ctx, cancel := context.WithTimeout(context.Background(), d.shutdownTimeout())
+	defer cancel()
+	d.servers.mu.Lock()
+	h, g := d.servers.http, d.servers.grpc
+	d.servers.mu.Unlock()
+	var wg sync.WaitGroup
+	if h != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.Shutdown(ctx); err != nil {
+				log.Printf("Queries still running at shutdown, canceling them: %v", err)
+				h.Close()
+			}
+		}()
+	}
+	if g != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				g.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				log.Printf("gRPC queries still running at shutdown, canceling them")
+				g.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+	log.Printf("Queries drained, stopping stenotype")
+	d.stopStenotype()
+}
+
+// stopStenotype has each stenotype flush its files and exit, killing those
+// that take longer than stenotypeStopTimeout, and waits for RunStenotype to
+// return.  runCapture doesn't restart them once stopping.
+func (d *Env) stopStenotype() {
+	d.stenotypeMu.Lock()
+	for _, c := range d.captures {
+		if c.process != nil {
+			if err := c.process.Signal(syscall.SIGTERM); err != nil {
+				log.Printf("could not stop stenotype on %v: %v", c.iface, err)
+			}
+		}
+	}
+	d.stenotypeMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.capturing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("Stenotype stopped")
+	case <-time.After(stenotypeStopTimeout):
+		log.Printf("Stenotype didn't stop within %v, killing it", stenotypeStopTimeout)
+		d.stenotypeMu.Lock()
+		for _, c := range d.captures {
+			if c.process != nil {
+				c.process.Kill()
+			}
+		}
+		d.stenotypeMu.Unlock()
+		<-done
+	}
+}
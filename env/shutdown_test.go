@@ -0,0 +1,209 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestShutdownTimeout(t *testing.T) {
+	for timeout, want := range map[string]time.Duration{
+		"":    defaultShutdownTimeout,
+		"1m":  time.Minute,
+		"0s":  0,
+		"bad": defaultShutdownTimeout,
+	} {
+		d := &Env{}
+		d.conf.ShutdownTimeout = timeout
+		if got := d.shutdownTimeout(); got != want {
+			t.Errorf("%q: got %v, want %v", timeout, got, want)
+		}
+	}
+}
+
+// shutdownEnv returns an Env serving HTTP with handler, as Serve would, and
+// the URL it's served at.
+func shutdownEnv(t *testing.T, timeout string, handler http.HandlerFunc) (*Env, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Env{done: make(chan bool)}
+	d.conf.ShutdownTimeout = timeout
+	d.servers.http = &http.Server{Handler: handler}
+	d.servers.grpc = grpc.NewServer()
+	go d.servers.http.Serve(l)
+	return d, "http://" + l.Addr().String()
+}
+
+// getBody requests url, returning its body once it's all read.
+func getBody(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// shutdown calls d.Shutdown, closing the returned channel once it returns.
+func shutdown(d *Env) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	return done
+}
+
+func TestShutdownDrainsQueries(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	d, url := shutdownEnv(t, "1m", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		io.WriteString(w, "packets")
+	})
+	body := make(chan string, 1)
+	go func() {
+		b, err := getBody(url)
+		if err != nil {
+			t.Errorf("in-flight query got %v", err)
+		}
+		body <- b
+	}()
+	<-started
+	done := shutdown(d)
+	for deadline := time.Now().Add(5 * time.Second); !d.stopping(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not stopping after Shutdown")
+		}
+	}
+	// No new queries are accepted while draining.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := getBody(url); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new queries still served while shutting down")
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a query in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return once the query finished")
+	}
+	if b := <-body; b != "packets" {
+		t.Errorf("in-flight query got %q, want its packets", b)
+	}
+}
+
+func TestShutdownCancelsQueries(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	d, url := shutdownEnv(t, "50ms", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	})
+	go getBody(url)
+	<-started
+	select {
+	case <-shutdown(d):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return after its timeout")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("query still running after shutdown")
+	}
+}
+
+// startStenotype starts a process standing in for stenotype on cp, which is
+// tracked like RunStenotype's, and returns the error it exits with.
+func startStenotype(t *testing.T, d *Env, cp *capture) chan error {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	d.setStenotype(cp, cmd.Process)
+	exited := make(chan error, 1)
+	d.capturing.Add(1)
+	go func() {
+		defer d.capturing.Done()
+		err := cmd.Wait()
+		d.setStenotype(cp, nil)
+		exited <- err
+	}()
+	return exited
+}
+
+func TestShutdownStopsStenotype(t *testing.T) {
+	d, _ := shutdownEnv(t, "1m", func(http.ResponseWriter, *http.Request) {})
+	d.captures = []*capture{{iface: "eth0"}, {iface: "eth1"}}
+	var exited []chan error
+	for _, cp := range d.captures {
+		exited = append(exited, startStenotype(t, d, cp))
+	}
+	select {
+	case <-shutdown(d):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return once stenotype stopped")
+	}
+	for i, e := range exited {
+		err := <-e
+		if status, ok := err.(*exec.ExitError); !ok || status.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+			t.Errorf("%v: got %v, want stopped by SIGTERM", d.captures[i].iface, err)
+		}
+	}
+
+	// Stenotype started as Shutdown signals the others is stopped too.
+	cp := &capture{iface: "eth2"}
+	if err := <-startStenotype(t, d, cp); err == nil {
+		t.Errorf("stenotype started while stopping got %v, want stopped", err)
+	}
+}
+
+func TestStopStenotypeWithoutProcess(t *testing.T) {
+	// Stenotype waiting to be restarted has no process to signal.
+	d := &Env{done: make(chan bool), captures: []*capture{{iface: "eth0"}}}
+	close(d.done)
+	stopped := make(chan struct{})
+	go func() {
+		d.stopStenotype()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopStenotype didn't return")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+const (
+	// Stenotype is restarted this long after it first fails, doubling each
+	// time it fails again soon after, up to maxStenotypeBackoff.
+	minStenotypeBackoff = time.Second
+	maxStenotypeBackoff = 5 * time.Minute
+	// crashOutputBytes is how much of stenotype's last output is kept for
+	// crash reports.
+	crashOutputBytes = 16 << 10
+	// corePatternPath is where the kernel says core dumps go.
+	corePatternPath = "/proc/sys/kernel/core_pattern"
+)
+
+var (
+	stenotypeRestarts = stats.S.Get("stenotype_restarts")
+	stenotypeCrashes  = stats.S.Get("stenotype_crashes") // Killed by a signal, or exited with an error.
+)
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+// Write implements io.Writer.
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// String returns what was last written, from the first full line.
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := string(t.buf)
+	if len(t.buf) == t.max {
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	return s
+}
+
+// crashReport describes how stenotype stopped, when it wasn't asked to.
+type crashReport struct {
+	Time      time.Time
+	Interface string
+	Ran       string // How long it ran for.
+	Error     string
+	ExitCode  int    `json:",omitempty"` // If it exited.
+	Signal    string `json:",omitempty"` // If it was killed by one.
+	// CoreHint says whether it dumped core, and where the kernel puts cores.
+	CoreHint string `json:",omitempty"`
+	Output   string // Its last output.
+}
+
+// newCrashReport returns a report of stenotype on iface stopping, after
+// running since start for duration, with err and, if it had started, state.
+func newCrashReport(iface string, start time.Time, duration time.Duration, state *os.ProcessState, err error, output string) crashReport {
+	r := crashReport{
+		Time:      start.Add(duration),
+		Interface: iface,
+		Ran:       duration.String(),
+		Error:     err.Error(),
+		Output:    output,
+	}
+	if state == nil {
+		return r
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return r
+	}
+	if !ws.Signaled() {
+		r.ExitCode = ws.ExitStatus()
+		return r
+	}
+	r.Signal = ws.Signal().String()
+	pattern := "unknown"
+	if p, err := ioutil.ReadFile(corePatternPath); err == nil {
+		pattern = strings.TrimSpace(string(p))
+	}
+	if ws.CoreDump() {
+		r.CoreHint = fmt.Sprintf("dumped core, with core_pattern %q", pattern)
+	} else {
+		r.CoreHint = fmt.Sprintf("no core dumped; check its core size limit (LimitCORE for systemd), and core_pattern %q", pattern)
+	}
+	return r
+}
+
+// reportCrash logs r, and appends it as a line of JSON to CrashLogPath, if
+// configured.
+func (d *Env) reportCrash(r crashReport) {
+	stenotypeCrashes.Increment()
+	hint := ""
+	if r.CoreHint != "" {
+		hint = " (" + r.CoreHint + ")"
+	}
+	log.Printf("Stenotype on %v failed after %v: %v%v, last output:\n%s", r.Interface, r.Ran, r.Error, hint, r.Output)
+	if d.conf.CrashLogPath == "" {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("could not encode crash report: %v", err)
+		return
+	}
+	f, err := os.OpenFile(d.conf.CrashLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("could not open crash log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("could not write crash log: %v", err)
+	}
+}
+
+// stenotypeBackoff returns how long to wait before restarting stenotype
+// after it failed having run for ran, given the backoff before it was last
+// restarted, or 0 if it hasn't been.
+func stenotypeBackoff(last, ran time.Duration) time.Duration {
+	if last == 0 || ran >= minStenotypeRuntimeForRestart {
+		return minStenotypeBackoff
+	}
+	if last *= 2; last > maxStenotypeBackoff {
+		return maxStenotypeBackoff
+	}
+	return last
+}
+
+// stenotypeFailed records that c's stenotype will be restarted after backoff.
+func (d *Env) stenotypeFailed(c *capture, backoff time.Duration) {
+	stenotypeRestarts.Increment()
+	d.stenotypeMu.Lock()
+	defer d.stenotypeMu.Unlock()
+	c.restarts++
+	c.restartAt = time.Now().Add(backoff)
+}
+
+// checkCaptureDowntime checks that no interface's stenotype has been down
+// for longer than MaxCaptureDowntime, if it's set.
+func (d *Env) checkCaptureDowntime() (out []healthCheck) {
+	max, err := time.ParseDuration(d.conf.MaxCaptureDowntime)
+	if err != nil {
+		return nil // Unset, as Validate checked it.
+	}
+	now := time.Now()
+	for _, cp := range d.captures {
+		c := healthCheck{Name: "capture_downtime", Interface: cp.iface, OK: true, Message: "capturing"}
+		d.stenotypeMu.Lock()
+		down := cp.downSince
+		d.stenotypeMu.Unlock()
+		if !down.IsZero() {
+			c.OK = now.Sub(down) <= max
+			c.Message = fmt.Sprintf("down for %v", now.Sub(down).Truncate(time.Second))
+		}
+		out = append(out, c)
+	}
+	return out
+}
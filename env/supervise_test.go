@@ -0,0 +1,181 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStenotypeBackoff(t *testing.T) {
+	// Crash looping backs off exponentially, up to a limit.
+	var got []time.Duration
+	backoff := time.Duration(0)
+	for i := 0; i < 12; i++ {
+		backoff = stenotypeBackoff(backoff, time.Second)
+		got = append(got, backoff)
+	}
+	want := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		64 * time.Second, 128 * time.Second, 256 * time.Second, maxStenotypeBackoff, maxStenotypeBackoff, maxStenotypeBackoff,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("failure %d: got backoff %v, want %v", i+1, got[i], want[i])
+		}
+	}
+
+	// Running long enough resets it.
+	for _, test := range []struct {
+		last, ran, want time.Duration
+	}{
+		{maxStenotypeBackoff, minStenotypeRuntimeForRestart, minStenotypeBackoff},
+		{maxStenotypeBackoff, time.Hour, minStenotypeBackoff},
+		{8 * time.Second, minStenotypeRuntimeForRestart - time.Second, 16 * time.Second},
+		{0, time.Hour, minStenotypeBackoff},
+	} {
+		if got := stenotypeBackoff(test.last, test.ran); got != test.want {
+			t.Errorf("after %v, running %v: got %v, want %v", test.last, test.ran, got, test.want)
+		}
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	for _, test := range []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"starting\n", "capturing\n"}, "starting\ncapturing\n"},
+		// Once over max, it starts from the first full line kept.
+		{[]string{"line one\n", "line two\n", "line three\n"}, "line three\n"},
+		{[]string{strings.Repeat("x", 30) + "\n", "fail\n"}, "fail\n"},
+		{[]string{strings.Repeat("x", 30)}, strings.Repeat("x", 20)}, // No full line to start from.
+	} {
+		w := &tailWriter{max: 20}
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("%q: writing %q got %v, %v", test.writes, s, n, err)
+			}
+		}
+		if got := w.String(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.writes, got, test.want)
+		}
+	}
+}
+
+// exitState runs script with sh, returning how it exited.
+func exitState(t *testing.T, script string) *os.ProcessState {
+	cmd := exec.Command("sh", "-c", script)
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+	return cmd.ProcessState
+}
+
+func TestNewCrashReport(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	for _, test := range []struct {
+		desc       string
+		state      *os.ProcessState
+		wantCode   int
+		wantSignal string
+		wantHint   bool
+	}{
+		{"not started", nil, 0, "", false},
+		{"exited", exitState(t, "exit 3"), 3, "", false},
+		{"killed", exitState(t, "kill -TERM $$"), 0, syscall.SIGTERM.String(), true},
+	} {
+		r := newCrashReport("eth0", start, 90*time.Second, test.state, errors.New("stenotype stopped"), "last words\n")
+		if r.Interface != "eth0" || !r.Time.Equal(start.Add(90*time.Second)) || r.Ran != "1m30s" || r.Error != "stenotype stopped" || r.Output != "last words\n" {
+			t.Errorf("%v: got %+v, want it filled in", test.desc, r)
+		}
+		if r.ExitCode != test.wantCode || r.Signal != test.wantSignal {
+			t.Errorf("%v: got exit code %d, signal %q; want %d, %q", test.desc, r.ExitCode, r.Signal, test.wantCode, test.wantSignal)
+		}
+		if (r.CoreHint != "") != test.wantHint || (test.wantHint && !strings.Contains(r.CoreHint, "core_pattern")) {
+			t.Errorf("%v: got core hint %q, want one: %v", test.desc, r.CoreHint, test.wantHint)
+		}
+	}
+}
+
+func TestReportCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &Env{}
+	d.reportCrash(crashReport{Interface: "eth0", Error: "not logged"}) // Without a crash log.
+
+	d.conf.CrashLogPath = filepath.Join(dir, "crashes.log")
+	before := stenotypeCrashes.Value()
+	for _, iface := range []string{"eth0", "eth1"} {
+		d.reportCrash(newCrashReport(iface, time.Now(), time.Second, exitState(t, "exit 1"), errors.New("stenotype stopped"), "bad things\n"))
+	}
+	if got := stenotypeCrashes.Value() - before; got != 2 {
+		t.Errorf("got %d crashes counted, want 2", got)
+	}
+	f, err := os.Open(d.conf.CrashLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var r crashReport
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Errorf("decoding %q: %v", scanner.Text(), err)
+			continue
+		}
+		if r.ExitCode != 1 || r.Output != "bad things\n" {
+			t.Errorf("got report %+v, want exit code 1 with output", r)
+		}
+		got = append(got, r.Interface)
+	}
+	if strings.Join(got, ",") != "eth0,eth1" {
+		t.Errorf("got reports for %q, want one line for each of eth0 and eth1", got)
+	}
+}
+
+func TestStenotypeFailed(t *testing.T) {
+	d := &Env{}
+	c := &capture{iface: "eth0"}
+	before := stenotypeRestarts.Value()
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		start := time.Now()
+		d.stenotypeFailed(c, backoff)
+		if c.restarts != int64(i+1) {
+			t.Errorf("failure %d: got %d restarts", i+1, c.restarts)
+		}
+		if c.restartAt.Before(start.Add(backoff)) || c.restartAt.After(time.Now().Add(backoff)) {
+			t.Errorf("failure %d: got restart at %v, want %v from now", i+1, c.restartAt, backoff)
+		}
+	}
+	if got := stenotypeRestarts.Value() - before; got != 2 {
+		t.Errorf("got %d restarts counted, want 2", got)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	"golang.org/x/net/context"
+)
+
+// serverTLSConfig returns the TLS config both APIs serve with.  Its server
+// certificate comes from CertPath, an ACME CA or the SPIFFE workload API, and
+// clients are verified against CertPath's CA certificate, or as SPIFFE
+// workloads, as the config says.
+func (e *Env) serverTLSConfig() (*tls.Config, error) {
+	if e.conf.SPIFFEWorkloadAPI != "" {
+		s, err := certs.NewSPIFFESource(context.Background(), e.conf.SPIFFEWorkloadAPI, e.conf.SPIFFETrustDomains)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Serving SPIFFE SVIDs from %v", e.conf.SPIFFEWorkloadAPI)
+		return s.TLSConfig(), nil
+	}
+	acme := len(e.conf.ACMEDomains) > 0
+	certFile, keyFile := filepath.Join(e.conf.CertPath, serverCertFilename), filepath.Join(e.conf.CertPath, serverKeyFilename)
+	if acme {
+		certFile, keyFile = "", ""
+	}
+	var err error
+	if e.certs, err = certs.NewReloader(filepath.Join(e.conf.CertPath, caCertFilename), certFile, keyFile); err != nil {
+		return nil, err
+	}
+	if _, err := e.certs.Watch(); err != nil {
+		log.Printf("Not watching certs for changes, send SIGHUP to reload them: %v", err)
+	}
+	e.reloadCertsOnHUP()
+	if !acme {
+		return e.certs.TLSConfig(), nil
+	}
+	tlsConfig, challenges := certs.ACMETLSConfig(certs.ACMEConfig{
+		Domains:      e.conf.ACMEDomains,
+		Email:        e.conf.ACMEEmail,
+		DirectoryURL: e.conf.ACMEDirectoryURL,
+		CacheDir:     filepath.Join(e.conf.CertPath, acmeCacheDirname),
+	}, e.certs)
+	go func() {
+		addr := e.conf.ACMEChallengeAddr
+		log.Printf("ACME challenge server on %v failed: %v", addr, http.ListenAndServe(addr, challenges))
+	}()
+	log.Printf("Serving certs for %v from ACME", e.conf.ACMEDomains)
+	return tlsConfig, nil
+}
+
+// reloadCertsOnHUP rereads the certs whenever stenographer gets a SIGHUP.
+func (e *Env) reloadCertsOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := e.certs.Reload(); err != nil {
+				log.Printf("SIGHUP: keeping previous certs: %v", err)
+			} else {
+				log.Printf("SIGHUP: reloaded certs")
+			}
+		}
+	}()
+}
@@ -0,0 +1,196 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// clientAuth sets how tlsConfig verifies clients:  if they may authenticate
+// with bearer tokens, certificates become optional, though those given are
+// still verified.
+func (e *Env) clientAuth(tlsConfig *tls.Config) {
+	if e.tokens != nil {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+}
+
+// authenticate wraps h so that, if bearer tokens are accepted, clients
+// without a verified certificate must present a valid one.  Requests from
+// federators are then served as the clients they name.
+func (e *Env) authenticate(h http.Handler) http.Handler {
+	h = e.forwardedClients(h)
+	if e.tokens == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token, ok := tokenauth.BearerToken(r.Header.Get("Authorization"))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "client certificate or bearer token required", http.StatusUnauthorized)
+			return
+		}
+		id, err := e.currentTokens().Authenticate(r.Context(), token)
+		if err != nil {
+			log.Printf("Rejected bearer token from %v: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(tokenauth.NewContext(r.Context(), id)))
+	})
+}
+
+// forwardedClients wraps h so that requests from the FederatorNames are served
+// as the client their Steno-Client and Steno-Client-Groups headers name,
+// which they must set.  Others' headers are ignored.
+func (e *Env) forwardedClients(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cert *x509.Certificate
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert = r.TLS.PeerCertificates[0]
+		}
+		ctx, err := e.forward(r.Context(), cert, r.Header.Get("Steno-Client"), r.Header.Get("Steno-Client-Groups"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forwardedKey is the context key of the federator a request was forwarded
+// by.
+type forwardedKey struct{}
+
+// forward returns the context to serve a request with ctx with.  If its
+// client authenticated with cert, and that's one of the FederatorNames, it's
+// served as client, in the comma-separated groups.  Federators are only
+// recognized by their certificates, so bearer tokens can't name clients.
+func (e *Env) forward(ctx context.Context, cert *x509.Certificate, client, groups string) (context.Context, error) {
+	if cert == nil {
+		return ctx, nil
+	}
+	e.confMu.RLock()
+	federators := e.conf.FederatorNames
+	e.confMu.RUnlock()
+	federator := certs.Name(cert)
+	for _, name := range federators {
+		if name != federator || name == "" {
+			continue
+		}
+		if client == "" {
+			return nil, errors.New("federated requests must name their client in Steno-Client")
+		}
+		var g []string
+		if groups != "" {
+			g = strings.Split(groups, ",")
+		}
+		v(1, "Serving request for %v through federator %v", client, federator)
+		ctx = context.WithValue(ctx, forwardedKey{}, federator)
+		return tokenauth.NewContext(ctx, tokenauth.Identity{Subject: client, Groups: g}), nil
+	}
+	return ctx, nil
+}
+
+// forwardedBy returns the federator the request ctx is for was forwarded by,
+// if it was.
+func forwardedBy(ctx context.Context) (string, bool) {
+	federator, ok := ctx.Value(forwardedKey{}).(string)
+	return federator, ok
+}
+
+// rpcAuthenticate is authenticate for gRPC calls, returning the context to
+// serve the call with.  Federators name their clients in steno-client and
+// steno-client-groups metadata.
+func (e *Env) rpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if cert := rpcCert(ctx); cert != nil {
+		ctx, err := e.forward(ctx, cert, firstValue(md, "steno-client"), firstValue(md, "steno-client-groups"))
+		if err != nil {
+			return nil, grpc.Errorf(codes.PermissionDenied, "%v", err)
+		}
+		return ctx, nil
+	}
+	if e.currentTokens() == nil {
+		return ctx, nil
+	}
+	token, _ := tokenauth.BearerToken(firstValue(md, "authorization"))
+	if token == "" {
+		return nil, grpc.Errorf(codes.Unauthenticated, "client certificate or bearer token required")
+	}
+	id, err := e.currentTokens().Authenticate(ctx, token)
+	if err != nil {
+		log.Printf("Rejected bearer token from %v: %v", rpcIdentity(ctx), err)
+		return nil, grpc.Errorf(codes.Unauthenticated, "invalid bearer token")
+	}
+	return tokenauth.NewContext(ctx, id), nil
+}
+
+// firstValue returns the first value of the metadata key, or "".
+func firstValue(md metadata.MD, key string) string {
+	if vals := md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// rpcAuthInterceptors returns the server options authenticating each gRPC
+// call with rpcAuthenticate.
+func (e *Env) rpcAuthInterceptors() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := e.rpcAuthenticate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := e.rpcAuthenticate(ss.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, authenticatedStream{ss, ctx})
+		}),
+	}
+}
+
+// authenticatedStream is a grpc.ServerStream whose context says who its
+// client authenticated as.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context { return s.ctx }
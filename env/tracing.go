@@ -0,0 +1,74 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// tracer traces the steps of serving each query.  Until startTracing
+// installs an exporter, its spans are no-ops.
+var tracer = otel.Tracer("github.com/google/stenographer/env")
+
+// startTracing exports traces as the config's TraceExporter says, and
+// returns a function that flushes and stops exporting them.
+func startTracing(c config.Config) (func(), error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.TraceExporter {
+	case "":
+		return func() {}, nil
+	case "otlp":
+		var opts []otlptracegrpc.Option
+		if c.TraceEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(c.TraceEndpoint))
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not start %s trace exporter: %v", c.TraceExporter, err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			log.Printf("could not flush traces: %v", err)
+		}
+	}, nil
+}
+
+// startQuerySpan starts the span tracing a query served over HTTP, as a
+// child of any trace the client passed in a traceparent header.
+func startQuerySpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.path", r.URL.Path)))
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID  = "00f067aa0ba902b7"
+)
+
+// Tracing is set up globally, so it's tested in one go:  before it's
+// started, then with each exporter.
+func TestTracing(t *testing.T) {
+	// As a traced client sends it.
+	r := httptest.NewRequest("POST", "/query", strings.NewReader("port 80"))
+	r.Header.Set("traceparent", "00-"+parentTraceID+"-"+parentSpanID+"-01")
+
+	stop, err := startTracing(config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if _, span := startQuerySpan(r, "query"); span.IsRecording() {
+		t.Error("span recorded without tracing")
+	}
+
+	// Spans go to stdout, so catch them in a file.
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	stop, err = startTracing(config.Config{TraceExporter: "stdout"})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := startQuerySpan(r, "query")
+	if !span.IsRecording() {
+		t.Fatal("span not recorded with tracing")
+	}
+	// The client's trace is carried on.
+	if got := span.SpanContext().TraceID().String(); got != parentTraceID {
+		t.Errorf("got trace %v, want %v", got, parentTraceID)
+	}
+	ro := span.(sdktrace.ReadOnlySpan)
+	if got := ro.Parent().SpanID().String(); got != parentSpanID {
+		t.Errorf("got parent span %v, want %v", got, parentSpanID)
+	}
+	if ro.SpanKind() != trace.SpanKindServer {
+		t.Errorf("got span kind %v, want %v", ro.SpanKind(), trace.SpanKindServer)
+	}
+	var path string
+	for _, a := range ro.Attributes() {
+		if a.Key == attribute.Key("http.path") {
+			path = a.Value.AsString()
+		}
+	}
+	if path != "/query" {
+		t.Errorf("got http.path %q, want /query", path)
+	}
+	span.End()
+	stop() // Flushes the span.
+	exported, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(exported), parentTraceID) || !strings.Contains(string(exported), `"Name":"query"`) {
+		t.Errorf("got exported %s, want the query's span", exported)
+	}
+
+	// Collectors are connected to lazily, so there needn't be one.
+	stop, err = startTracing(config.Config{TraceExporter: "otlp", TraceEndpoint: "http://127.0.0.1:4317"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+}
@@ -0,0 +1,267 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+const (
+	// Above this drop percentage, stenotype isn't keeping up with the wire.
+	tuningMaxDropPercentage = 0.1
+	// Indexing ~1Gbps takes most of a core (see README.md), so past roughly
+	// 100MB/s a single thread is at risk of dropping.
+	tuningMaxThreadBytesPerSec = 100 << 20
+	// Files rotate every minute or every 4GB, so files created faster than
+	// this mean we're hitting the size limit.
+	tuningMinFileInterval = time.Minute
+	// If the busiest thread writes this many times more than the quietest,
+	// fanout isn't spreading load well.
+	tuningMaxThreadImbalance = 2
+	// stenotype writes 1MB blocks; if 1% of writes take longer than this,
+	// the disk can't keep up with bursts.
+	tuningMaxWriteLatency = 100 * time.Millisecond
+	// Index lookups slower than this on average mostly wait on reopening
+	// files the file cache has closed.
+	tuningMaxIndexLookup = 20 * time.Millisecond
+	// stenotype's default for --blocks.
+	defaultStenotypeBlocks = 2048
+	// AF_PACKET fanout types, as --fanout_type takes them.  stenotype
+	// defaults to load balancing with rollover.
+	packetFanoutHash       = 0
+	packetFanoutTypeMask   = 0xff
+	defaultStenotypeFanout = "4097 (PACKET_FANOUT_LB | PACKET_FANOUT_FLAG_ROLLOVER)"
+)
+
+var captureStatsLine = regexp.MustCompile(`Thread (\d+) stats: (.*)$`)
+
+// captureStatsWriter watches stenotype's log output for the periodic
+// per-thread capture statistics it logs with LOG(INFO), and exports them as
+// stenotype_thread<N>_<name> stats.  stenotype only prints INFO lines once
+// its verbosity's raised, with a -v in Config.Flags.  stenotype numbers its threads
+// from 0, so threads maps its numbers to ours.
+type captureStatsWriter struct {
+	buf     []byte
+	threads []int
+}
+
+// Write implements io.Writer.
+func (c *captureStatsWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		parseCaptureStats(string(c.buf[:i]), c.threads)
+		c.buf = c.buf[i+1:]
+	}
+	if len(c.buf) > 1<<16 {
+		c.buf = nil // Not a line we care about, don't grow forever.
+	}
+	return len(p), nil
+}
+
+// parseCaptureStats parses a single stats line from the stenotype running
+// threads, which looks like:
+//
+//	... Thread 0 stats: MB=100 secs=12.3 MBps=8.1 packets=1234 blocks=100 polls=5 drops=0 drop%=0 duplicates=0 bytes=567890 file=1500000000000000 writes=100 written_bytes=104857600 write_p50_us=800 write_p90_us=1200 write_p99_us=5000 write_max_us=6000
+//
+// The write stats cover the writes since the thread's previous line.
+func parseCaptureStats(line string, threads []int) {
+	m := captureStatsLine.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n >= len(threads) {
+		return
+	}
+	thread := strconv.Itoa(threads[n])
+	for _, field := range strings.Fields(m[2]) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "packets", "blocks", "polls", "drops", "duplicates", "bytes", "file",
+			"writes", "written_bytes", "write_p50_us", "write_p90_us", "write_p99_us", "write_max_us":
+			if n, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				captureStat(thread, kv[0]).Set(n)
+			}
+		}
+	}
+	captureStat(thread, "updated").Set(time.Now().Unix())
+}
+
+func captureStat(thread, name string) *stats.Stat {
+	return stats.S.Get(fmt.Sprintf("stenotype_thread%s_%s", thread, name))
+}
+
+// recommendation is a single suggested configuration change.
+type recommendation struct {
+	Setting   string
+	Current   string
+	Suggested string
+	Reason    string
+}
+
+// flagValue returns the value of a --name=value flag passed to stenotype.
+func flagValue(flags []string, name string) (string, bool) {
+	prefix := "--" + name + "="
+	for _, f := range flags {
+		if strings.HasPrefix(f, prefix) {
+			return f[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// recommendations looks at what stenotype and stenographer have observed so
+// far (traffic and drops, disk write rates and latencies, and how queries use
+// the file cache) and suggests configuration changes that would likely help.
+func (d *Env) recommendations() []recommendation {
+	d.confMu.RLock()
+	flags, maxOpenFiles := d.conf.Flags, d.conf.MaxOpenFiles
+	d.confMu.RUnlock()
+	out := []recommendation{}
+	var totalFiles int
+	var minRate, maxRate float64
+	for i, t := range d.threads {
+		conf := t.Config()
+		u := t.Usage()
+		totalFiles += u.Files
+		id := strconv.Itoa(i)
+
+		packets := captureStat(id, "packets").Value()
+		drops := captureStat(id, "drops").Value()
+		if packets+drops > 0 {
+			if pct := float64(drops) * 100 / float64(packets+drops); pct > tuningMaxDropPercentage {
+				blocks := defaultStenotypeBlocks
+				if b, ok := flagValue(flags, "blocks"); ok {
+					blocks, _ = strconv.Atoi(b)
+				}
+				out = append(out, recommendation{
+					Setting:   "Flags --blocks",
+					Current:   strconv.Itoa(blocks),
+					Suggested: strconv.Itoa(blocks * 2),
+					Reason:    fmt.Sprintf("thread %d dropped %.2f%% of packets; more blocks give the kernel more room to buffer bursts", i, pct),
+				})
+			}
+		}
+
+		if p99 := time.Duration(captureStat(id, "write_p99_us").Value()) * time.Microsecond; p99 > tuningMaxWriteLatency {
+			out = append(out, recommendation{
+				Setting:   fmt.Sprintf("Threads[%d].ExtraDirectories", i),
+				Current:   strconv.Itoa(len(conf.ExtraDirectories)),
+				Suggested: strconv.Itoa(len(conf.ExtraDirectories) + 1),
+				Reason:    fmt.Sprintf("thread %d's slowest 1%% of block writes take over %v; another disk, with Placement \"latency\", spreads its writes", i, p99),
+			})
+		}
+
+		if u.Files < 2 {
+			continue
+		}
+		span := u.Newest.Sub(u.Oldest)
+		rate := float64(u.Bytes) / span.Seconds()
+		if r, ok := d.writeRates.rate(i); ok {
+			rate = r // Recent disk throughput, rather than over every file.
+		}
+		if minRate == 0 || rate < minRate {
+			minRate = rate
+		}
+		if rate > maxRate {
+			maxRate = rate
+		}
+		if interval := span / time.Duration(u.Files-1); interval < tuningMinFileInterval {
+			out = append(out, recommendation{
+				Setting:   "Threads",
+				Current:   strconv.Itoa(len(d.threads)),
+				Suggested: strconv.Itoa(len(d.threads) + 1),
+				Reason:    fmt.Sprintf("thread %d rotates files every %v, so it's hitting the file size limit rather than the one-minute age limit", i, interval),
+			})
+		}
+		if u.Files >= conf.MaxDirectoryFiles*95/100 {
+			if df, err := base.PathDiskFreePercentage(conf.PacketsDirectory); err == nil && df > conf.DiskFreePercentage+10 {
+				out = append(out, recommendation{
+					Setting:   fmt.Sprintf("Threads[%d].MaxDirectoryFiles", i),
+					Current:   strconv.Itoa(conf.MaxDirectoryFiles),
+					Suggested: strconv.Itoa(conf.MaxDirectoryFiles * 2),
+					Reason:    fmt.Sprintf("thread %d is deleting files because of the file count limit while its disk is still %d%% free", i, df),
+				})
+			}
+		}
+	}
+	if maxRate > tuningMaxThreadBytesPerSec {
+		suggested := int(maxRate)/tuningMaxThreadBytesPerSec + 1
+		if suggested <= len(d.threads) {
+			suggested = len(d.threads) + 1
+		}
+		out = append(out, recommendation{
+			Setting:   "Threads",
+			Current:   strconv.Itoa(len(d.threads)),
+			Suggested: strconv.Itoa(suggested),
+			Reason:    fmt.Sprintf("busiest thread writes %.1fMB/s, more than a single core can reliably index", maxRate/(1<<20)),
+		})
+	}
+	if minRate > 0 && maxRate/minRate > tuningMaxThreadImbalance {
+		if r, ok := fanoutRecommendation(flags, maxRate/minRate); ok {
+			out = append(out, r)
+		}
+	}
+	// Every tracked file needs an open index and packet file to be queried
+	// without thrashing the file cache, which shows in slow index lookups.
+	lookups := stats.S.Get("index_base_lookups_finished").Value()
+	if want := totalFiles * 2; want > maxOpenFiles && lookups > 0 {
+		if mean := time.Duration(stats.S.Get("index_base_lookup_nanos").Value() / lookups); mean > tuningMaxIndexLookup {
+			out = append(out, recommendation{
+				Setting:   "MaxOpenFiles",
+				Current:   strconv.Itoa(maxOpenFiles),
+				Suggested: strconv.Itoa(want),
+				Reason:    fmt.Sprintf("%d files are tracked, and index lookups average %v, so queries are reopening files the cache closed", totalFiles, mean),
+			})
+		}
+	}
+	return out
+}
+
+// fanoutRecommendation suggests stenotype's default fanout if flags set hash
+// fanout, given the busiest thread writes imbalance times more than the
+// quietest.  The default balances packets evenly across threads, so only hash
+// fanout, which keeps each flow on one thread, explains uneven ones.
+func fanoutRecommendation(flags []string, imbalance float64) (recommendation, bool) {
+	f, ok := flagValue(flags, "fanout_type")
+	if !ok {
+		return recommendation{}, false
+	}
+	if n, err := strconv.Atoi(f); err != nil || n&packetFanoutTypeMask != packetFanoutHash {
+		return recommendation{}, false
+	}
+	return recommendation{
+		Setting:   "Flags --fanout_type",
+		Current:   f + " (PACKET_FANOUT_HASH)",
+		Suggested: defaultStenotypeFanout,
+		Reason:    fmt.Sprintf("busiest thread writes %.1fx more than the quietest; a few large flows are dominating hash fanout", imbalance),
+	}, true
+}
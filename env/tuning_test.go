@@ -0,0 +1,240 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	//"github.com/google/stenographer/thread"
+	"../thread"
+)
+
+// statsLine returns a stats line as logged by stenotype's thread n.
+func statsLine(n int, packets, drops int64) string {
+	pct := float64(drops) * 100 / float64(packets+drops)
+	return fmt.Sprintf("2017-07-14T02:40:00.123456Z T:7f3a1c [stenotype.cc:599] Thread %d stats: MB=2100 secs=61.0441 MBps=34.4013 packets=%d blocks=2100 polls=1873 drops=%d drop%%=%g duplicates=0 bytes=2201819136 file=1500000000123456 writes=2100 written_bytes=2202009600 write_p50_us=812 write_p90_us=1290 write_p99_us=5120 write_max_us=6004", n, packets, drops, pct)
+}
+
+func TestParseCaptureStats(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		line    string
+		threads []int
+		want    map[string]int64 // Stats not listed are never set.
+	}{
+		{
+			desc:    "first thread",
+			line:    statsLine(0, 2483122, 17),
+			threads: []int{10},
+			want: map[string]int64{
+				"stenotype_thread10_packets":       2483122,
+				"stenotype_thread10_blocks":        2100,
+				"stenotype_thread10_polls":         1873,
+				"stenotype_thread10_drops":         17,
+				"stenotype_thread10_duplicates":    0,
+				"stenotype_thread10_bytes":         2201819136,
+				"stenotype_thread10_file":          1500000000123456,
+				"stenotype_thread10_writes":        2100,
+				"stenotype_thread10_written_bytes": 2202009600,
+				"stenotype_thread10_write_p50_us":  812,
+				"stenotype_thread10_write_p90_us":  1290,
+				"stenotype_thread10_write_p99_us":  5120,
+				"stenotype_thread10_write_max_us":  6004,
+				"stenotype_thread10_MB":            0,
+				"stenotype_thread10_drop%":         0,
+			},
+		},
+		{
+			desc:    "mapped thread",
+			line:    statsLine(1, 1000, 2),
+			threads: []int{11, 12},
+			want: map[string]int64{
+				"stenotype_thread1_packets":  0,
+				"stenotype_thread11_packets": 0,
+				"stenotype_thread12_packets": 1000,
+				"stenotype_thread12_drops":   2,
+			},
+		},
+		{
+			desc:    "no packets yet",
+			line:    "2017-07-14T02:39:00.000012Z T:7f3a1c [stenotype.cc:599] Thread 0 stats: MB=0 secs=0.012 MBps=0 packets=0 blocks=0 polls=1 drops=0 drop%=-nan duplicates=0 bytes=0 file=1500000000000000 writes=0 written_bytes=0 write_p50_us=0 write_p90_us=0 write_p99_us=0 write_max_us=0",
+			threads: []int{13},
+			want: map[string]int64{
+				"stenotype_thread13_polls": 1,
+				"stenotype_thread13_file":  1500000000000000,
+			},
+		},
+		{
+			desc:    "unknown thread",
+			line:    statsLine(2, 1000, 0),
+			threads: []int{14, 15},
+			want: map[string]int64{
+				"stenotype_thread2_packets":  0,
+				"stenotype_thread14_packets": 0,
+				"stenotype_thread15_packets": 0,
+				"stenotype_thread14_updated": 0,
+				"stenotype_thread15_updated": 0,
+			},
+		},
+		{
+			desc:    "not a stats line",
+			line:    "2017-07-14T02:39:00.000001Z T:7f3a1c [stenotype.cc:512] Thread 0 starting to process packets",
+			threads: []int{16},
+			want: map[string]int64{
+				"stenotype_thread16_packets": 0,
+				"stenotype_thread16_updated": 0,
+			},
+		},
+	} {
+		parseCaptureStats(test.line, test.threads)
+		for name, want := range test.want {
+			if got := stats.S.Get(name).Value(); got != want {
+				t.Errorf("%v: %v got %v, want %v", test.desc, name, got, want)
+			}
+		}
+	}
+}
+
+func TestCaptureStatsWriterSplitsLines(t *testing.T) {
+	w := &captureStatsWriter{threads: []int{20, 21}}
+	log := statsLine(0, 500, 0) + "\n" + statsLine(1, 700, 0) + "\n" + statsLine(0, 900, 0)
+	for _, chunk := range []string{log[:40], log[40:300], log[300:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		name string
+		want int64
+	}{
+		{"stenotype_thread20_packets", 500}, // The last line isn't finished.
+		{"stenotype_thread21_packets", 700},
+	} {
+		if got := stats.S.Get(test.name).Value(); got != test.want {
+			t.Errorf("%v got %v, want %v", test.name, got, test.want)
+		}
+	}
+	w.Write([]byte("\n"))
+	if got := stats.S.Get("stenotype_thread20_packets").Value(); got != 900 {
+		t.Errorf("after newline, stenotype_thread20_packets got %v, want 900", got)
+	}
+}
+
+func TestRecommendations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	var tc []config.ThreadConfig
+	for i := 0; i < 2; i++ {
+		tc = append(tc, config.ThreadConfig{
+			PacketsDirectory:   fmt.Sprintf("%s/pkt%d", tempDir, i),
+			IndexDirectory:     fmt.Sprintf("%s/idx%d", tempDir, i),
+			DiskFreePercentage: 10,
+			MaxDirectoryFiles:  10,
+		})
+	}
+	threads, err := thread.Threads(tc, tempDir+"/base/", filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc  string
+		flags []string
+		log   []string // stenotype's output.
+		want  []recommendation
+	}{
+		{
+			desc: "no drops",
+			log:  []string{statsLine(0, 2483122, 0), statsLine(1, 2483122, 0)},
+			want: []recommendation{},
+		},
+		{
+			desc: "drops at threshold",
+			log:  []string{statsLine(0, 2483122, 0), statsLine(1, 999000, 1000)},
+			want: []recommendation{},
+		},
+		{
+			desc: "drops with default blocks",
+			log:  []string{statsLine(0, 2483122, 0), statsLine(1, 990000, 10000)},
+			want: []recommendation{{Setting: "Flags --blocks", Current: "2048", Suggested: "4096"}},
+		},
+		{
+			desc:  "drops with configured blocks",
+			flags: []string{"-v", "--blocks=512"},
+			log:   []string{statsLine(0, 990000, 10000), statsLine(1, 2483122, 0)},
+			want:  []recommendation{{Setting: "Flags --blocks", Current: "512", Suggested: "1024"}},
+		},
+		{
+			desc: "slow writes",
+			log:  []string{statsLine(0, 2483122, 0), strings.Replace(statsLine(1, 2483122, 0), "write_p99_us=5120", "write_p99_us=250000", 1)},
+			want: []recommendation{{Setting: "Threads[1].ExtraDirectories", Current: "0", Suggested: "1"}},
+		},
+		{
+			desc: "latest line wins",
+			log:  []string{statsLine(0, 1000, 1000), statsLine(1, 2483122, 0), statsLine(0, 2483122, 0)},
+			want: []recommendation{},
+		},
+	} {
+		w := &captureStatsWriter{threads: []int{0, 1}}
+		for _, line := range test.log {
+			w.Write([]byte(line + "\n"))
+		}
+		e := &Env{threads: threads, conf: config.Config{Flags: test.flags, MaxOpenFiles: 100}}
+		got := e.recommendations()
+		for i := range got {
+			got[i].Reason = ""
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestFanoutRecommendation(t *testing.T) {
+	for _, test := range []struct {
+		flags   []string
+		want    bool
+		current string
+	}{
+		{nil, false, ""}, // stenotype's default balances load.
+		{[]string{"--fanout_type=0"}, true, "0 (PACKET_FANOUT_HASH)"},
+		{[]string{"-v", "--fanout_type=32768"}, true, "32768 (PACKET_FANOUT_HASH)"}, // With PACKET_FANOUT_FLAG_DEFRAG.
+		{[]string{"--fanout_type=1"}, false, ""},
+		{[]string{"--fanout_type=4097"}, false, ""},
+		{[]string{"--fanout_type=2"}, false, ""},
+		{[]string{"--fanout_type=hash"}, false, ""},
+	} {
+		got, ok := fanoutRecommendation(test.flags, 3)
+		if ok != test.want || got.Current != test.current {
+			t.Errorf("fanoutRecommendation(%q) got %q, %v; want %q, %v", test.flags, got.Current, ok, test.current, test.want)
+		}
+		if ok && (got.Setting != "Flags --fanout_type" || got.Suggested != defaultStenotypeFanout) {
+			t.Errorf("fanoutRecommendation(%q) got %+v, want stenotype's default fanout", test.flags, got)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+// languageVersionHeader is sent by clients to pin the query language version
+// their queries are written against, and by the server with the version it
+// supports.
+const languageVersionHeader = "Steno-Language-Version"
+
+// capabilities is the response to a /capabilities request.
+type capabilities struct {
+	LanguageVersion int
+	// Keywords maps each query keyword to the language version it was added
+	// in.
+	Keywords map[string]int
+}
+
+// handleCapabilities tells clients which query language features this server
+// supports.
+func (e *Env) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(languageVersionHeader, strconv.Itoa(query.LanguageVersion))
+	json.NewEncoder(w).Encode(capabilities{
+		LanguageVersion: query.LanguageVersion,
+		Keywords:        query.Keywords(),
+	})
+}
+
+// parseOptions returns the options to parse the query in r with.
+func parseOptions(r *http.Request) (query.ParseOptions, error) {
+	opts := query.ParseOptions{Vars: queryVars(r)}
+	if v := r.Header.Get(languageVersionHeader); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid %s header %q", languageVersionHeader, v)
+		}
+		opts.LanguageVersion = n
+	}
+	return opts, nil
+}
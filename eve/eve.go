@@ -0,0 +1,133 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eve translates Suricata EVE JSON events, like IDS alerts, into
+// stenographer queries for the packets of the flows they describe.
+package eve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is the part of an EVE event identifying its flow.  Alerts, and most
+// other event types, carry all of it, but a hand-written event with just the
+// addresses, ports, protocol and timestamp works too.
+type Event struct {
+	Timestamp string `json:"timestamp"` // Like "2018-01-01T12:00:00.123456+0000".
+	SrcIP     string `json:"src_ip"`
+	SrcPort   int    `json:"src_port,omitempty"` // For TCP, UDP and SCTP.
+	DestIP    string `json:"dest_ip"`
+	DestPort  int    `json:"dest_port,omitempty"`
+	Proto     string `json:"proto"` // Like "TCP", or a protocol number.
+	Flow      struct {
+		Start string `json:"start,omitempty"` // When the flow's first packet was seen.
+	} `json:"flow,omitempty"`
+}
+
+// timeLayouts are the layouts event timestamps are parsed with:  Suricata's,
+// and RFC 3339 for hand-written events.
+var timeLayouts = []string{"2006-01-02T15:04:05.999999999-0700", time.RFC3339Nano}
+
+// parseTime parses an event timestamp.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// protocols maps the protocol names Suricata logs, lowercased, to query
+// keywords.
+var protocols = map[string]string{
+	"tcp":       "tcp",
+	"udp":       "udp",
+	"sctp":      "sctp",
+	"icmp":      "icmp",
+	"ipv6-icmp": "icmp6",
+	"gre":       "gre",
+	"esp":       "esp",
+	"ah":        "ah",
+}
+
+// Parse decodes an EVE JSON event.
+func Parse(data []byte) (*Event, error) {
+	e := &Event{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("invalid EVE JSON: %v", err)
+	}
+	return e, nil
+}
+
+// Query returns a query for the packets of e's flow, in both directions,
+// from pad before the flow started (or e's timestamp, if its start isn't
+// known) until pad after e's timestamp.
+func (e *Event) Query(pad time.Duration) (string, error) {
+	var parts []string
+	for _, ip := range []string{e.SrcIP, e.DestIP} {
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid IP %q", ip)
+		}
+		parts = append(parts, "host "+ip)
+	}
+	if e.SrcIP == e.DestIP {
+		parts = parts[:1]
+	}
+	proto, ok := protocols[strings.ToLower(e.Proto)]
+	if n, err := strconv.Atoi(e.Proto); err == nil && n >= 0 && n < 256 {
+		proto, ok = fmt.Sprintf("ip proto %d", n), true
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown protocol %q", e.Proto)
+	}
+	parts = append(parts, proto)
+	if proto == "tcp" || proto == "udp" || proto == "sctp" {
+		for _, port := range []int{e.SrcPort, e.DestPort} {
+			if port <= 0 || port > 65535 {
+				return "", fmt.Errorf("invalid port %d", port)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("port %d", e.SrcPort))
+		if e.DestPort != e.SrcPort {
+			parts = append(parts, fmt.Sprintf("port %d", e.DestPort))
+		}
+	}
+	end, err := parseTime(e.Timestamp)
+	if err != nil {
+		return "", err
+	}
+	start := end
+	if e.Flow.Start != "" {
+		flowStart, err := parseTime(e.Flow.Start)
+		if err != nil {
+			return "", fmt.Errorf("invalid flow start: %v", err)
+		}
+		if flowStart.Before(start) {
+			start = flowStart
+		}
+	}
+	// Times are whole seconds in queries, so the window is widened to them.
+	start = start.Add(-pad).Truncate(time.Second)
+	if end = end.Add(pad); !end.Equal(end.Truncate(time.Second)) {
+		end = end.Truncate(time.Second).Add(time.Second)
+	}
+	parts = append(parts, fmt.Sprintf("between %s and %s", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)))
+	return strings.Join(parts, " and "), nil
+}
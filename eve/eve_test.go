@@ -0,0 +1,76 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eve
+
+import (
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+func TestQuery(t *testing.T) {
+	for _, test := range []struct {
+		event string
+		pad   time.Duration
+		want  string
+	}{
+		{`{"timestamp":"2018-01-01T12:00:00.250000+0000","flow_id":1,"event_type":"alert","src_ip":"10.0.0.1","src_port":51000,"dest_ip":"10.0.0.2","dest_port":80,"proto":"TCP","alert":{"signature":"ET x"},"flow":{"pkts_toserver":3,"start":"2018-01-01T11:59:58.900000+0000"}}`,
+			time.Minute, "host 10.0.0.1 and host 10.0.0.2 and tcp and port 51000 and port 80 and between 2018-01-01T11:58:58Z and 2018-01-01T12:01:01Z"},
+		{`{"timestamp":"2018-01-01T14:00:00+02:00","src_ip":"2001:db8::1","src_port":53,"dest_ip":"2001:db8::2","dest_port":53,"proto":"udp"}`,
+			0, "host 2001:db8::1 and host 2001:db8::2 and udp and port 53 and between 2018-01-01T12:00:00Z and 2018-01-01T12:00:00Z"},
+		{`{"timestamp":"2018-01-01T12:00:00.000000+0000","src_ip":"10.0.0.1","dest_ip":"10.0.0.2","proto":"IPv6-ICMP"}`,
+			time.Second, "host 10.0.0.1 and host 10.0.0.2 and icmp6 and between 2018-01-01T11:59:59Z and 2018-01-01T12:00:01Z"},
+		{`{"timestamp":"2018-01-01T12:00:00.000000+0000","src_ip":"10.0.0.1","dest_ip":"10.0.0.1","proto":"47"}`,
+			time.Second, "host 10.0.0.1 and ip proto 47 and between 2018-01-01T11:59:59Z and 2018-01-01T12:00:01Z"},
+	} {
+		e, err := Parse([]byte(test.event))
+		if err != nil {
+			t.Errorf("%s: %v", test.event, err)
+			continue
+		}
+		got, err := e.Query(test.pad)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v; want %q", test.event, got, err, test.want)
+			continue
+		}
+		if _, err := query.NewQuery(got); err != nil {
+			t.Errorf("%q doesn't parse: %v", got, err)
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, event := range []string{
+		`{"src_ip":"10.0.0.1","src_port":1,"dest_ip":"10.0.0.2","dest_port":2,"proto":"TCP"}`,
+		`{"timestamp":"2018-01-01T12:00:00Z","src_ip":"host","src_port":1,"dest_ip":"10.0.0.2","dest_port":2,"proto":"TCP"}`,
+		`{"timestamp":"2018-01-01T12:00:00Z","src_ip":"10.0.0.1","dest_ip":"10.0.0.2","proto":"TCP"}`,
+		`{"timestamp":"2018-01-01T12:00:00Z","src_ip":"10.0.0.1","dest_ip":"10.0.0.2","proto":"IPX"}`,
+		`{"timestamp":"2018-01-01T12:00:00Z","src_ip":"10.0.0.1","src_port":1,"dest_ip":"10.0.0.2","dest_port":2,"proto":"TCP","flow":{"start":"yesterday"}}`,
+	} {
+		e, err := Parse([]byte(event))
+		if err != nil {
+			t.Errorf("%s: %v", event, err)
+			continue
+		}
+		if q, err := e.Query(time.Minute); err == nil {
+			t.Errorf("%s: got %q, want an error", event, q)
+		}
+	}
+	if _, err := Parse([]byte("alert")); err == nil {
+		t.Error("parsed non-JSON")
+	}
+}
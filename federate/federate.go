@@ -0,0 +1,439 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package federate runs queries across several stenographer sensors at once,
+// merging their packets into a single pcap in time order, so analysts don't
+// need to know which sensor saw the traffic they're after.
+package federate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/httputil"
+	"../httputil"
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+var v = base.V // verbose logging
+
+// queryTimeout limits how long a federated query may run, as stenographer
+// limits its own queries.
+const queryTimeout = 15 * time.Minute
+
+// flushInterval is how often merged packets are flushed to the client.
+const flushInterval = time.Second
+
+// Sensor is a stenographer server queries are sent to.
+type Sensor struct {
+	Name   string // Used in errors and warnings.
+	Client *stenoclient.Client
+}
+
+// Federation sends queries to a set of sensors.
+type Federation struct {
+	Sensors []Sensor
+	// AuditLog, if set, records every query served by ServeHTTP.
+	AuditLog *audit.Log
+}
+
+// Results are the packets a federated query returned.
+type Results struct {
+	// Packets are every sensor's packets, merged in time order.
+	Packets *base.PacketChan
+	// Warnings are the warnings sensors sent about their results being
+	// incomplete, by sensor name.
+	Warnings map[string]*stenoclient.Warning
+
+	mu       sync.Mutex
+	errs     map[string]error
+	failed   map[string]error // Sensors that failed before sending any packets.
+	progress []Progress       // By sensor, in the Federation's order.
+}
+
+// Progress is how far a sensor has got sending its packets.
+type Progress struct {
+	Sensor  string
+	Packets int64
+	Bytes   int64 // Of the packets' data.
+	Done    bool
+	Err     error // If it failed.
+}
+
+// Progress returns how far each sensor has got sending its packets, in the
+// order of the Federation's sensors.
+func (r *Results) Progress() []Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Progress(nil), r.progress...)
+}
+
+// update applies fn to the progress of the i'th sensor.
+func (r *Results) update(i int, fn func(p *Progress)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.progress[i])
+}
+
+// fail records that the named sensor failed.
+func (r *Results) fail(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs[name] = err
+}
+
+// Failed returns the errors of the sensors that couldn't run the query at
+// all, by sensor name.  Their packets are missing from the results.
+func (r *Results) Failed() map[string]error {
+	return r.failed
+}
+
+// Errors returns the errors of sensors that failed while sending their
+// packets, by sensor name.  It's only complete once Packets is done.
+func (r *Results) Errors() map[string]error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]error, len(r.errs))
+	for k, v := range r.errs {
+		out[k] = v
+	}
+	return out
+}
+
+// Unavailable is returned by Query when no sensor could run it, holding each
+// sensor's error by name.
+type Unavailable map[string]error
+
+func (u Unavailable) Error() string {
+	var msgs []string
+	for name, err := range u {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(msgs)
+	return "every sensor failed: " + strings.Join(msgs, "; ")
+}
+
+// badRequest returns the error every sensor rejected the query with as
+// invalid, if they all did.
+func (u Unavailable) badRequest() (*stenoclient.Error, bool) {
+	var out *stenoclient.Error
+	for _, err := range u {
+		e, ok := err.(*stenoclient.Error)
+		if !ok || e.StatusCode != http.StatusBadRequest {
+			return nil, false
+		}
+		out = e
+	}
+	return out, out != nil
+}
+
+// Query runs q on every sensor.  Sensors that fail don't stop the others:
+// their errors are returned in the Results, unless they all fail before
+// sending any packets, which returns Unavailable.  Each packet's
+// InterfaceIndex is the index of the sensor it came from.
+func (f *Federation) Query(ctx context.Context, q string, opts *stenoclient.QueryOptions) (*Results, error) {
+	if opts != nil && opts.Format != "" && opts.Format != stenoclient.FormatPcap {
+		return nil, fmt.Errorf("federated queries only return pcap, not %q", opts.Format)
+	}
+	streams := make([]*stenoclient.Packets, len(f.Sensors))
+	errs := make([]error, len(f.Sensors))
+	var wg sync.WaitGroup
+	for i, s := range f.Sensors {
+		wg.Add(1)
+		go func(i int, s Sensor) {
+			defer wg.Done()
+			streams[i], errs[i] = s.Client.Query(ctx, q, opts)
+		}(i, s)
+	}
+	wg.Wait()
+	r := &Results{
+		Warnings: map[string]*stenoclient.Warning{},
+		errs:     map[string]error{},
+		failed:   map[string]error{},
+		progress: make([]Progress, len(f.Sensors)),
+	}
+	var inputs []*base.PacketChan
+	for i, s := range f.Sensors {
+		r.progress[i].Sensor = s.Name
+		if errs[i] != nil {
+			log.Printf("Sensor %q failed query: %v", s.Name, errs[i])
+			r.failed[s.Name] = errs[i]
+			r.progress[i].Done, r.progress[i].Err = true, errs[i]
+			continue
+		}
+		if w := streams[i].Warning; w != nil {
+			r.Warnings[s.Name] = w
+		}
+		inputs = append(inputs, r.read(ctx, i, s.Name, streams[i]))
+	}
+	if len(inputs) == 0 {
+		return nil, Unavailable(r.failed)
+	}
+	r.Packets = base.MergePacketChans(ctx, inputs)
+	return r, nil
+}
+
+// hashingReader hashes what's read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (h hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	return n, err
+}
+
+// read returns the packets in the i'th sensor's pcap stream.  If the sensor
+// fails partway through, or its checksum doesn't match, that's recorded in r,
+// and the packets it sent up to then are still returned, so the other
+// sensors' packets aren't lost.
+func (r *Results) read(ctx context.Context, i int, name string, p *stenoclient.Packets) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		defer p.Close()
+		count := 0
+		err := func() error {
+			h := hashingReader{p, sha256.New()}
+			pr, err := pcapgo.NewReader(h)
+			if err != nil {
+				return fmt.Errorf("invalid pcap: %v", err)
+			}
+			for {
+				data, ci, err := pr.ReadPacketData()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+				ci.InterfaceIndex = i
+				select {
+				case out.C <- &base.Packet{Data: data, CaptureInfo: ci}:
+					count++
+					r.update(i, func(p *Progress) {
+						p.Packets++
+						p.Bytes += int64(len(data))
+					})
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			// Read whatever's left, so the trailers arrive.
+			io.Copy(ioutil.Discard, h)
+			if err := p.Err(); err != nil {
+				return err
+			}
+			if sum := hex.EncodeToString(h.h.Sum(nil)); p.SHA256() != "" && p.SHA256() != sum {
+				return fmt.Errorf("checksum mismatch, want %s, got %s", p.SHA256(), sum)
+			}
+			return nil
+		}()
+		v(1, "sensor %q returned %d packets", name, count)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Sensor %q failed partway through query: %v", name, err)
+			r.fail(name, err)
+		}
+		r.update(i, func(p *Progress) {
+			p.Done = true
+			if ctx.Err() == nil {
+				p.Err = err
+			}
+		})
+		out.Close(nil)
+	}()
+	return out
+}
+
+// queryError is the JSON body returned for queries that can't be run, as by
+// stenographer.
+type queryError struct {
+	Code    string
+	Message string
+}
+
+func writeQueryError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(queryError{Code: code, Message: err.Error()})
+}
+
+// queryWarning is sent as JSON in the Steno-Warning header, as by
+// stenographer.
+type queryWarning struct {
+	Code    string
+	Message string
+}
+
+// warning returns the Steno-Warning header saying the results are
+// incomplete, or "" if they're not known to be.
+func (r *Results) warning() string {
+	var msgs []string
+	code := "range_unavailable"
+	for name, err := range r.Failed() {
+		code = "sensor_unavailable"
+		msgs = append(msgs, fmt.Sprintf("sensor %s unavailable: %v", name, err))
+	}
+	for name, w := range r.Warnings {
+		msgs = append(msgs, fmt.Sprintf("sensor %s: %s", name, w.Message))
+	}
+	if len(msgs) == 0 {
+		return ""
+	}
+	sort.Strings(msgs)
+	b, _ := json.Marshal(queryWarning{Code: code, Message: strings.Join(msgs, "; ")})
+	return string(b)
+}
+
+// ServeHTTP serves POST /query like stenographer does, with the query as the
+// body, Steno-Limit-* and Steno-Language-Version headers, and ?var.NAME
+// parameters.  Results from sensors that are unavailable or warn are noted
+// in a Steno-Warning header, and sensors failing partway through in a
+// Steno-Error trailer.
+//
+// Queries are sent to sensors naming the client in Steno-Client headers, so
+// sensors listing stenofed in their FederatorNames authorize and audit them
+// as that client's.
+func (f *Federation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, err := base.LimitFromHeaders(r.Header)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "invalid_limit", err)
+		return
+	}
+	opts := &stenoclient.QueryOptions{
+		LimitPackets: limit.Packets,
+		LimitBytes:   limit.Bytes,
+		Vars:         map[string]string{},
+		Client:       httputil.Identity(r),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		opts.ClientGroups = r.TLS.PeerCertificates[0].Subject.OrganizationalUnit
+	}
+	if lv := r.Header.Get("Steno-Language-Version"); lv != "" {
+		if opts.LanguageVersion, err = strconv.Atoi(lv); err != nil {
+			writeQueryError(w, http.StatusBadRequest, "bad_request", fmt.Errorf("invalid Steno-Language-Version header %q", lv))
+			return
+		}
+	}
+	for k, vals := range r.URL.Query() {
+		if strings.HasPrefix(k, "var.") && len(vals) > 0 {
+			opts.Vars[k[len("var."):]] = vals[0]
+		}
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		opts.Format = format
+	}
+	queryBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_request", fmt.Errorf("could not read request body"))
+		return
+	}
+	ctx := httputil.Context(w, r, queryTimeout)
+	defer ctx.Cancel()
+	rec := audit.Record{API: r.URL.Path, Client: opts.Client, Query: string(queryBytes)}
+	results, err := f.Query(ctx, string(queryBytes), opts)
+	if err != nil {
+		f.audit(rec, err)
+	}
+	if u, ok := err.(Unavailable); ok {
+		// Every sensor rejecting a query as invalid is the client's fault, and
+		// they'll have all said the same thing.
+		if e, ok := u.badRequest(); ok {
+			writeQueryError(w, http.StatusBadRequest, e.Code, fmt.Errorf("%s", e.Message))
+		} else {
+			writeQueryError(w, http.StatusBadGateway, "query_failed", err)
+		}
+		return
+	} else if err != nil {
+		writeQueryError(w, http.StatusBadRequest, "bad_request", err)
+		return
+	}
+	if warning := results.warning(); warning != "" {
+		w.Header().Set("Steno-Warning", warning)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", "Steno-Sha256, Steno-Error")
+	sum := sha256.New()
+	cw, closeCompression := httputil.Compress(w, r)
+	stream := httputil.NewStream(cw, ctx, flushInterval, 0)
+	out := &countingWriter{w: io.MultiWriter(stream, sum)}
+	rec.Packets, err = base.PacketsToFileCount(results.Packets, out, limit, base.SnapLen)
+	closeCompression()
+	stream.Close()
+	rec.Bytes, rec.SHA256 = out.n, hex.EncodeToString(sum.Sum(nil))
+	f.audit(rec, err)
+	w.Header().Set("Steno-Sha256", rec.SHA256)
+	var msgs []string
+	if err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	for name, err := range results.Errors() {
+		msgs = append(msgs, fmt.Sprintf("sensor %s: %v", name, err))
+	}
+	if len(msgs) > 0 {
+		sort.Strings(msgs)
+		w.Header().Set("Steno-Error", strings.Join(msgs, "; "))
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// audit adds a query, which failed with err if it's not nil, to the audit
+// log, if there is one.
+func (f *Federation) audit(rec audit.Record, err error) {
+	if f.AuditLog == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if err := f.AuditLog.Add(rec); err != nil {
+		log.Printf("ALERT: could not audit query by %q: %v", rec.Client, err)
+	}
+}
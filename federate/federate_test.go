@@ -0,0 +1,225 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+// pcapOf returns a pcap of one-byte packets, each holding its capture
+// second.
+func pcapOf(t *testing.T, secs ...int) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range secs {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(s), 0), CaptureLength: 1, Length: 1}
+		if err := w.WritePacket(ci, []byte{byte(s)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// sensor returns a fake sensor serving h.
+func sensor(t *testing.T, name string, h http.HandlerFunc) (Sensor, func()) {
+	s := httptest.NewServer(h)
+	return Sensor{Name: name, Client: stenoclient.New(s.URL+"/", s.Client())}, s.Close
+}
+
+// servePcap returns a handler serving data as stenographer would, with the
+// given Steno-Warning header and Steno-Error trailer if they're set.
+func servePcap(data []byte, warning, errMsg string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Steno-Sha256, Steno-Error")
+		if warning != "" {
+			w.Header().Set("Steno-Warning", warning)
+		}
+		w.Write(data)
+		sum := sha256.Sum256(data)
+		w.Header().Set("Steno-Sha256", hex.EncodeToString(sum[:]))
+		if errMsg != "" {
+			w.Header().Set("Steno-Error", errMsg)
+		}
+	}
+}
+
+func badQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(`{"Code":"parse_error","Message":"bad query"}`))
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "down", http.StatusServiceUnavailable)
+}
+
+// query runs q through f's HTTP handler, returning the response and the
+// capture seconds of the packets in it.
+func query(t *testing.T, f *Federation, q string) (*http.Response, []int) {
+	s := httptest.NewServer(f)
+	defer s.Close()
+	resp, err := s.Client().Post(s.URL+"/query", "text/plain", strings.NewReader(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, nil
+	}
+	pr, err := pcapgo.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secs []int
+	for {
+		_, ci, err := pr.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		secs = append(secs, int(ci.Timestamp.Unix()))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp, secs
+}
+
+func TestMerge(t *testing.T) {
+	a, done := sensor(t, "a", servePcap(pcapOf(t, 1, 4, 5), "", ""))
+	defer done()
+	b, done := sensor(t, "b", servePcap(pcapOf(t, 2, 3, 6), "", ""))
+	defer done()
+	resp, secs := query(t, &Federation{Sensors: []Sensor{a, b}}, "port 80")
+	if want := []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(secs, want) {
+		t.Errorf("got packets %v, want %v", secs, want)
+	}
+	if w, e := resp.Header.Get("Steno-Warning"), resp.Trailer.Get("Steno-Error"); w != "" || e != "" {
+		t.Errorf("got warning %q, error %q", w, e)
+	}
+	if resp.Trailer.Get("Steno-Sha256") == "" {
+		t.Errorf("no Steno-Sha256 trailer")
+	}
+}
+
+func TestSensorUnavailable(t *testing.T) {
+	a, done := sensor(t, "a", servePcap(pcapOf(t, 1, 2), "", ""))
+	defer done()
+	b, done := sensor(t, "b", unavailable)
+	defer done()
+	resp, secs := query(t, &Federation{Sensors: []Sensor{a, b}}, "port 80")
+	if want := []int{1, 2}; !reflect.DeepEqual(secs, want) {
+		t.Errorf("got packets %v, want %v", secs, want)
+	}
+	if w := resp.Header.Get("Steno-Warning"); !strings.Contains(w, "sensor_unavailable") || !strings.Contains(w, "sensor b") {
+		t.Errorf("got warning %q", w)
+	}
+}
+
+func TestSensorWarning(t *testing.T) {
+	a, done := sensor(t, "a", servePcap(pcapOf(t, 1), `{"Code":"range_unavailable","Message":"aged out"}`, ""))
+	defer done()
+	resp, _ := query(t, &Federation{Sensors: []Sensor{a}}, "port 80")
+	if w := resp.Header.Get("Steno-Warning"); !strings.Contains(w, "range_unavailable") || !strings.Contains(w, "sensor a: aged out") {
+		t.Errorf("got warning %q", w)
+	}
+}
+
+func TestSensorFailsPartway(t *testing.T) {
+	a, done := sensor(t, "a", servePcap(pcapOf(t, 1, 3), "", ""))
+	defer done()
+	b, done := sensor(t, "b", servePcap(pcapOf(t, 2), "", "disk on fire"))
+	defer done()
+	resp, secs := query(t, &Federation{Sensors: []Sensor{a, b}}, "port 80")
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(secs, want) {
+		t.Errorf("got packets %v, want %v", secs, want)
+	}
+	if e := resp.Trailer.Get("Steno-Error"); e != "sensor b: disk on fire" {
+		t.Errorf("got error %q", e)
+	}
+}
+
+func TestAllFail(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		handlers []http.HandlerFunc
+		status   int
+	}{
+		{"invalid", []http.HandlerFunc{badQuery, badQuery}, http.StatusBadRequest},
+		{"unavailable", []http.HandlerFunc{badQuery, unavailable}, http.StatusBadGateway},
+	} {
+		var sensors []Sensor
+		for i, h := range test.handlers {
+			s, done := sensor(t, string(rune('a'+i)), h)
+			defer done()
+			sensors = append(sensors, s)
+		}
+		if resp, _ := query(t, &Federation{Sensors: sensors}, "port 80"); resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	a, done := sensor(t, "a", servePcap(pcapOf(t, 1, 3), "", ""))
+	defer done()
+	b, done := sensor(t, "b", unavailable)
+	defer done()
+	c, done := sensor(t, "c", servePcap(pcapOf(t, 2), "", ""))
+	defer done()
+	r, err := (&Federation{Sensors: []Sensor{a, b, c}}).Query(context.Background(), "port 80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sensors []int
+	for p := range r.Packets.Receive() {
+		sensors = append(sensors, p.CaptureInfo.InterfaceIndex)
+	}
+	if want := []int{0, 2, 0}; !reflect.DeepEqual(sensors, want) {
+		t.Errorf("got packets from sensors %v, want %v", sensors, want)
+	}
+	got := r.Progress()
+	if len(got) != 3 || got[1].Err == nil {
+		t.Fatalf("got progress %+v, want sensor b failed", got)
+	}
+	got[1].Err = nil
+	if want := []Progress{
+		{Sensor: "a", Packets: 2, Bytes: 2, Done: true},
+		{Sensor: "b", Done: true},
+		{Sensor: "c", Packets: 1, Bytes: 1, Done: true},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got progress %+v, want %+v", got, want)
+	}
+}
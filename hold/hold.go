@@ -0,0 +1,247 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hold preserves the packets matching queries under legal hold.
+// Each hold's packets are copied into a preservation directory, apart from
+// the threads' directories, so they're kept however old they get, until the
+// hold is released.
+package hold
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+var v = base.V // verbose logging
+
+// States of a hold.
+const (
+	Preserving = "preserving" // Its packets are being copied.
+	Held       = "held"       // Its packets are all preserved.
+	Failed     = "failed"     // Copying its packets failed, see Err.
+)
+
+// Hold is a query whose packets are preserved.
+type Hold struct {
+	ID      string
+	Query   string
+	Reason  string `json:",omitempty"` // Why it's held, like a case number.
+	Client  string // Who placed it.
+	Owner   string `json:",omitempty"` // Who placed it, as their credential's kind and name, like "cert:alice".
+	Created time.Time
+	State   string
+	Err     string `json:",omitempty"` // Why it failed, if it did.
+	Packets int64  // Packets preserved.
+	Bytes   int64  // Bytes of preserved pcap.
+	Limited bool   `json:",omitempty"` // Set if a limit stopped it preserving every packet.
+	SHA256  string `json:",omitempty"` // Hex SHA-256 of the preserved pcap, once held.
+}
+
+// Store keeps holds in a directory, as ID.json files describing them and
+// ID.pcap files of their packets.
+type Store struct {
+	dir string
+	mu  sync.Mutex // Held while writing a hold's description.
+}
+
+// Open opens the store in dir, creating it if necessary.  Holds still
+// preserving are marked failed, since whatever was copying their packets
+// stopped before it finished.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create hold directory: %v", err)
+	}
+	s := &Store{dir: dir}
+	holds, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range holds {
+		if h.State != Preserving {
+			continue
+		}
+		h.State, h.Err = Failed, "interrupted by restart"
+		os.Remove(s.path(h.ID, ".pcap.tmp"))
+		if err := s.save(h); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// validID returns whether id could be one Create made, so can safely be used
+// in paths.
+func validID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// save atomically writes h's description.
+func (s *Store) save(h Hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path(h.ID, ".json.tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(h.ID, ".json"))
+}
+
+// Create records a new hold on q, placed by client and owned by owner,
+// preserving, and returns it.  Follow it with Preserve to copy its packets.
+func (s *Store) Create(q, reason, client, owner string) (Hold, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return Hold{}, err
+	}
+	h := Hold{
+		ID:      hex.EncodeToString(id[:]),
+		Query:   q,
+		Reason:  reason,
+		Client:  client,
+		Owner:   owner,
+		Created: time.Now().UTC(),
+		State:   Preserving,
+	}
+	return h, s.save(h)
+}
+
+// Preserve copies the packets of the hold h into the store with write, which
+// writes them as a pcap and returns how many it wrote, and whether it stopped
+// at a limit.  h is then held, or failed if write fails, and is returned as
+// it's saved.
+func (s *Store) Preserve(h Hold, write func(io.Writer) (packets int64, limited bool, _ error)) (Hold, error) {
+	tmp := s.path(h.ID, ".pcap.tmp")
+	err := func() error {
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		cw := &countingWriter{w: io.MultiWriter(f, hash)}
+		if h.Packets, h.Limited, err = write(cw); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		h.Bytes, h.SHA256 = cw.n, hex.EncodeToString(hash.Sum(nil))
+		return os.Rename(tmp, s.path(h.ID, ".pcap"))
+	}()
+	if err != nil {
+		os.Remove(tmp)
+		h.State, h.Err, h.SHA256 = Failed, err.Error(), ""
+	} else {
+		h.State = Held
+		v(1, "hold %s preserved %d packets, %d bytes", h.ID, h.Packets, h.Bytes)
+	}
+	if serr := s.save(h); serr != nil {
+		return h, serr
+	}
+	return h, err
+}
+
+// Get returns the hold with the given ID.  It returns an error satisfying
+// os.IsNotExist if there's no such hold.
+func (s *Store) Get(id string) (Hold, error) {
+	var h Hold
+	if !validID(id) {
+		return h, &os.PathError{Op: "get", Path: id, Err: os.ErrNotExist}
+	}
+	b, err := ioutil.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return h, err
+	}
+	return h, json.Unmarshal(b, &h)
+}
+
+// List returns every hold, oldest first.
+func (s *Store) List() ([]Hold, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	holds := []Hold{}
+	for _, name := range names {
+		h, err := s.Get(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if os.IsNotExist(err) {
+			continue // Released meanwhile, or not a hold.
+		} else if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Created.Before(holds[j].Created) })
+	return holds, nil
+}
+
+// Packets opens the preserved pcap of the hold with the given ID.
+func (s *Store) Packets(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
+	}
+	return os.Open(s.path(id, ".pcap"))
+}
+
+// Release deletes the hold with the given ID and its packets.
+func (s *Store) Release(id string) error {
+	h, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if h.State == Preserving {
+		return fmt.Errorf("hold %s is still preserving packets", id)
+	}
+	if err := os.Remove(s.path(id, ".pcap")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.path(id, ".json"))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hold
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func openStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestPreserveAndRelease(t *testing.T) {
+	s, dir := openStore(t)
+	defer os.RemoveAll(dir)
+	h, err := s.Create("port 80", "case 123", "alice", "cert:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != Preserving {
+		t.Errorf("new hold is %q, want %q", h.State, Preserving)
+	}
+	h, err = s.Preserve(h, func(w io.Writer) (int64, bool, error) {
+		_, err := io.WriteString(w, "packets")
+		return 3, true, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h || got.State != Held || got.Packets != 3 || got.Bytes != 7 || !got.Limited || got.Reason != "case 123" {
+		t.Errorf("got hold %+v, want held %+v", got, h)
+	}
+	f, err := s.Packets(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "packets" {
+		t.Errorf("read preserved packets %q, %v", b, err)
+	}
+	if holds, err := s.List(); err != nil || len(holds) != 1 || holds[0].ID != h.ID {
+		t.Errorf("listed %v, %v", holds, err)
+	}
+
+	if err := s.Release(h.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(h.ID); !os.IsNotExist(err) {
+		t.Errorf("got released hold, err %v", err)
+	}
+	if _, err := s.Packets(h.ID); !os.IsNotExist(err) {
+		t.Errorf("opened released packets, err %v", err)
+	}
+	if holds, err := s.List(); err != nil || len(holds) != 0 {
+		t.Errorf("listed %v, %v after release", holds, err)
+	}
+}
+
+func TestPreserveFails(t *testing.T) {
+	s, dir := openStore(t)
+	defer os.RemoveAll(dir)
+	h, err := s.Create("port 80", "", "alice", "cert:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Preserve(h, func(w io.Writer) (int64, bool, error) {
+		return 0, false, errors.New("disk full")
+	}); err == nil {
+		t.Fatal("preserve succeeded")
+	}
+	if got, err := s.Get(h.ID); err != nil || got.State != Failed || got.Err != "disk full" {
+		t.Errorf("got %+v, %v, want failed hold", got, err)
+	}
+	if _, err := s.Packets(h.ID); !os.IsNotExist(err) {
+		t.Errorf("failed hold has packets, err %v", err)
+	}
+}
+
+func TestInterruptedHoldsFail(t *testing.T) {
+	s, dir := openStore(t)
+	defer os.RemoveAll(dir)
+	h, err := s.Create("port 80", "", "alice", "cert:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(h.ID); err == nil {
+		t.Error("released a hold still preserving")
+	}
+	if s, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(h.ID); err != nil || got.State != Failed {
+		t.Errorf("got %+v, %v, want failed hold after reopening", got, err)
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	s, dir := openStore(t)
+	defer os.RemoveAll(dir)
+	for _, id := range []string{"", "../../etc/passwd", "0123456789ABCDEF", "0123456789abcdeg"} {
+		if _, err := s.Get(id); !os.IsNotExist(err) {
+			t.Errorf("get %q: %v", id, err)
+		}
+		if _, err := s.Packets(id); !os.IsNotExist(err) {
+			t.Errorf("packets %q: %v", id, err)
+		}
+	}
+}
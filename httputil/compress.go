@@ -0,0 +1,138 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	compressedGzip = stats.S.Get("http_responses_compressed_gzip")
+	compressedZstd = stats.S.Get("http_responses_compressed_zstd")
+)
+
+// encoder is a compressor, like *gzip.Writer or *zstd.Encoder.
+type encoder interface {
+	Write([]byte) (int, error)
+	Flush() error
+	Close() error
+}
+
+// compressWriter is an http.ResponseWriter compressing what's written to it.
+type compressWriter struct {
+	http.ResponseWriter
+	mu     sync.Mutex
+	enc    encoder
+	closed bool
+}
+
+// Write implements io.Writer.
+func (c *compressWriter) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Write(data)
+}
+
+// Flush sends everything written so far to the client.
+func (c *compressWriter) Flush() {
+	c.mu.Lock()
+	if !c.closed {
+		c.enc.Flush()
+	}
+	c.mu.Unlock()
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.enc.Close()
+}
+
+// acceptedEncoding returns the best content encoding an Accept-Encoding
+// header allows, "zstd" or "gzip", or "" if it allows neither.  zstd wins
+// ties, since it's both faster and smaller.
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if w, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = w
+				}
+			}
+		}
+		q[name] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range []string{"zstd", "gzip"} {
+		w, ok := q[enc]
+		if !ok {
+			w, ok = q["*"]
+		}
+		if ok && w > bestQ {
+			best, bestQ = enc, w
+		}
+	}
+	return best
+}
+
+// Compress returns a ResponseWriter writing to w, compressed with zstd or
+// gzip if r's Accept-Encoding allows either, and a function to call once the
+// response has been written, which writes the end of the compressed data.
+// Flushing the returned writer flushes the data compressed so far, so it
+// can be streamed.  Call Compress only once the response is known to
+// succeed, since it sets the Content-Encoding header.
+func Compress(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	var enc encoder
+	switch acceptedEncoding(r.Header.Get("Accept-Encoding")) {
+	case "zstd":
+		z, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return w, func() error { return nil }
+		}
+		compressedZstd.Increment()
+		w.Header().Set("Content-Encoding", "zstd")
+		enc = z
+	case "gzip":
+		compressedGzip.Increment()
+		w.Header().Set("Content-Encoding", "gzip")
+		enc = gzip.NewWriter(w)
+	default:
+		return w, func() error { return nil }
+	}
+	w.Header().Del("Content-Length")
+	c := &compressWriter{ResponseWriter: w, enc: enc}
+	return c, c.close
+}
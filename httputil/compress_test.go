@@ -0,0 +1,153 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"gzip":                     "gzip",
+		"GZIP":                     "gzip",
+		"deflate, gzip":            "gzip",
+		"zstd":                     "zstd",
+		"gzip, zstd":               "zstd", // zstd wins ties.
+		"gzip;q=1.0, zstd;q=0.5":   "gzip",
+		"gzip ; q=0.2, zstd;q=0.8": "zstd",
+		"gzip;q=0, zstd;q=0":       "",
+		"*":                        "zstd",
+		"*;q=0.5, gzip":            "gzip",
+		"*, zstd;q=0":              "gzip",
+		"gzip;q=bogus":             "gzip", // Unparseable weights are ignored.
+	} {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+// decode returns data decompressed as encoding, reading as much as it can
+// if the compressed data isn't finished.
+func decode(t *testing.T, encoding string, data []byte) string {
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		z, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		r = z
+	case "zstd":
+		z, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("zstd: %v", err)
+		}
+		defer z.Close()
+		r = z
+	default:
+		return string(data)
+	}
+	var out bytes.Buffer
+	io.Copy(&out, r) // Unfinished data ends in an error.
+	return out.String()
+}
+
+func TestCompress(t *testing.T) {
+	for _, accept := range []string{"", "gzip", "zstd"} {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Length", "10")
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		cw, done := Compress(w, r)
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%q: got Vary %q, want Accept-Encoding", accept, got)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != accept {
+			t.Errorf("%q: got Content-Encoding %q, want %q", accept, got, accept)
+		}
+		if got, want := w.Header().Get("Content-Length") != "", accept == ""; got != want {
+			t.Errorf("%q: got Content-Length %v, want %v", accept, got, want)
+		}
+		if accept == "" && cw != http.ResponseWriter(w) {
+			t.Errorf("uncompressed: got writer %T, want the original", cw)
+		}
+
+		// Flushing sends what's been compressed so far.
+		first := strings.Repeat("first ", 1000)
+		if _, err := io.WriteString(cw, first); err != nil {
+			t.Fatalf("%q: %v", accept, err)
+		}
+		cw.(http.Flusher).Flush()
+		if !w.Flushed {
+			t.Errorf("%q: underlying writer not flushed", accept)
+		}
+		if got := decode(t, accept, w.Body.Bytes()); got != first {
+			t.Errorf("%q: after flush, got %d bytes, want %d", accept, len(got), len(first))
+		}
+
+		second := strings.Repeat("second ", 1000)
+		if _, err := io.WriteString(cw, second); err != nil {
+			t.Fatalf("%q: %v", accept, err)
+		}
+		if err := done(); err != nil {
+			t.Errorf("%q: finishing got %v", accept, err)
+		}
+		if err := done(); err != nil {
+			t.Errorf("%q: finishing twice got %v", accept, err)
+		}
+		cw.(http.Flusher).Flush() // Safe once finished.
+		if got := decode(t, accept, w.Body.Bytes()); got != first+second {
+			t.Errorf("%q: got %d bytes, want %d", accept, len(got), len(first+second))
+		}
+		if accept != "" && w.Body.Len() >= len(first+second)/10 {
+			t.Errorf("%q: got %d bytes compressed, want much less than %d", accept, w.Body.Len(), len(first+second))
+		}
+	}
+}
+
+func TestCompressServed(t *testing.T) {
+	const body = "packets packets packets"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw, done := Compress(w, r)
+		defer done()
+		io.WriteString(cw, body)
+	}))
+	defer server.Close()
+	// The default transport asks for gzip and decompresses it.
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Uncompressed || string(got) != body {
+		t.Errorf("got %q (uncompressed %v), want %q decompressed", got, resp.Uncompressed, body)
+	}
+}
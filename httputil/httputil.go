@@ -26,7 +26,12 @@ import (
 	"time"
 
 	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	//"github.com/google/stenographer/tokenauth"
+	"../tokenauth"
 )
 
 // Context returns a new context.Content that cancels when the
@@ -46,6 +51,22 @@ func Context(w http.ResponseWriter, r *http.Request, timeout time.Duration) base
 	return ctx
 }
 
+// Identity returns a human-readable identity for the requester:  the subject
+// of the bearer token it authenticated with, or the name (see certs.Name) of
+// its verified client certificate if there is one, otherwise its remote
+// address.
+func Identity(r *http.Request) string {
+	if id, ok := tokenauth.FromContext(r.Context()); ok {
+		return id.Subject
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if name := certs.Name(r.TLS.PeerCertificates[0]); name != "" {
+			return name
+		}
+	}
+	return r.RemoteAddr
+}
+
 type httpLog struct {
 	r      *http.Request
 	w      http.ResponseWriter
@@ -96,6 +117,22 @@ func (h *httpLog) WriteHeader(code int) {
 	h.w.WriteHeader(code)
 }
 
+// Flush implements http.Flusher, if the underlying ResponseWriter does.
+func (h *httpLog) Flush() {
+	if f, ok := h.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier.  If the underlying
+// ResponseWriter doesn't, the returned channel never receives.
+func (h *httpLog) CloseNotify() <-chan bool {
+	if c, ok := h.w.(http.CloseNotifier); ok {
+		return c.CloseNotify()
+	}
+	return nil
+}
+
 // String implements fmt.Stringer.
 func (h *httpLog) String() string {
 	var errstr string
@@ -0,0 +1,116 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+var streamsStalled = stats.S.Get("http_streams_stalled")
+
+// Stream is an io.Writer for streaming a long response, like a query's
+// packets, to a client.  Writes block while the client isn't reading, which
+// in turn blocks whatever is producing the response, so a slow client slows
+// the disk reads behind it rather than having them buffered up in memory.
+type Stream struct {
+	w     http.ResponseWriter
+	ctx   base.Context
+	stall time.Duration
+	done  chan struct{}
+
+	mu    sync.Mutex // Held while writing to or flushing w.
+	dirty bool       // Whether w has data written since it was last flushed.
+}
+
+// NewStream returns a Stream writing to w.  Data written is flushed to the
+// client at least every interval (if w supports it), so the client sees it as
+// it's produced instead of once the server's buffers fill.  Writes fail once
+// ctx is done, and if the client accepts nothing for stall, ctx is canceled
+// so the work feeding the response stops.  An interval or stall of 0 turns
+// that off.  Close the Stream once done writing.
+func NewStream(w http.ResponseWriter, ctx base.Context, interval, stall time.Duration) *Stream {
+	s := &Stream{w: w, ctx: ctx, stall: stall, done: make(chan struct{})}
+	if interval > 0 {
+		go s.flushEvery(interval)
+	}
+	return s
+}
+
+// Write implements io.Writer.
+func (s *Stream) Write(data []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer s.watch()()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = true
+	return s.w.Write(data)
+}
+
+// Close stops flushing, and flushes anything not yet flushed.
+func (s *Stream) Close() error {
+	close(s.done)
+	s.flush()
+	return nil
+}
+
+// watch cancels the Stream's context if the returned function isn't called
+// within its stall timeout.
+func (s *Stream) watch() func() {
+	if s.stall <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(s.stall, func() {
+		streamsStalled.Increment()
+		log.Printf("HTTP client stopped reading for %v, canceling", s.stall)
+		s.ctx.Cancel()
+	})
+	return func() { t.Stop() }
+}
+
+func (s *Stream) flush() {
+	f, ok := s.w.(http.Flusher)
+	if !ok {
+		return
+	}
+	defer s.watch()()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty {
+		f.Flush()
+		s.dirty = false
+	}
+}
+
+func (s *Stream) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
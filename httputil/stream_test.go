@@ -0,0 +1,166 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+// slowClient is a ResponseWriter whose writes block until unblock is
+// called, like a connection to a client that's stopped reading.
+type slowClient struct {
+	*httptest.ResponseRecorder
+	blocked chan struct{}
+
+	mu      sync.Mutex
+	flushes int
+}
+
+func newSlowClient(blocked bool) *slowClient {
+	c := &slowClient{ResponseRecorder: httptest.NewRecorder(), blocked: make(chan struct{})}
+	if !blocked {
+		c.unblock()
+	}
+	return c
+}
+
+func (c *slowClient) unblock() { close(c.blocked) }
+
+func (c *slowClient) Write(data []byte) (int, error) {
+	<-c.blocked
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ResponseRecorder.Write(data)
+}
+
+func (c *slowClient) Flush() {
+	<-c.blocked
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes++
+}
+
+func (c *slowClient) flushed() (flushes int, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushes, c.Body.String()
+}
+
+func TestStreamStall(t *testing.T) {
+	client := newSlowClient(true)
+	ctx := base.NewContext(0)
+	defer ctx.Cancel()
+	s := NewStream(client, ctx, 0, 20*time.Millisecond)
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("packet"))
+		written <- err
+	}()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled while client stalled")
+	}
+	client.unblock()
+	if err := <-written; err != nil {
+		t.Errorf("stalled write got %v, want it to finish once unblocked", err)
+	}
+	if _, err := s.Write([]byte("packet")); err != ctx.Err() {
+		t.Errorf("write after stall got %v, want %v", err, ctx.Err())
+	}
+	s.Close()
+	if _, body := client.flushed(); body != "packet" {
+		t.Errorf("got %q written, want one packet", body)
+	}
+}
+
+func TestStreamSlowClient(t *testing.T) {
+	// A client slower than the stall timeout, but still reading, isn't
+	// canceled, and nor is any client when the timeout is off.
+	for _, stall := range []time.Duration{time.Second, 0} {
+		client := newSlowClient(true)
+		ctx := base.NewContext(0)
+		s := NewStream(client, ctx, 0, stall)
+		time.AfterFunc(50*time.Millisecond, client.unblock)
+		for i := 0; i < 3; i++ {
+			if _, err := s.Write([]byte("packet")); err != nil {
+				t.Errorf("stall %v: write %d got %v", stall, i, err)
+			}
+		}
+		s.Close()
+		if err := ctx.Err(); err != nil {
+			t.Errorf("stall %v: got context %v, want not canceled", stall, err)
+		}
+		ctx.Cancel()
+	}
+}
+
+func TestStreamFlush(t *testing.T) {
+	client := newSlowClient(false)
+	ctx := base.NewContext(0)
+	defer ctx.Cancel()
+	s := NewStream(client, ctx, 5*time.Millisecond, 0)
+	if _, err := s.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if flushes, _ := client.flushed(); flushes > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write not flushed")
+		}
+	}
+	// Nothing's flushed until there's something new to flush.
+	time.Sleep(50 * time.Millisecond)
+	if flushes, _ := client.flushed(); flushes != 1 {
+		t.Errorf("got %d flushes with nothing written, want 1", flushes)
+	}
+	s.Close()
+	if flushes, _ := client.flushed(); flushes != 1 {
+		t.Errorf("closing got %d flushes with nothing written, want 1", flushes)
+	}
+
+	// Without flushing as it goes, closing flushes.
+	client = newSlowClient(false)
+	s = NewStream(client, ctx, 0, 0)
+	s.Write([]byte("packet"))
+	if flushes, _ := client.flushed(); flushes != 0 {
+		t.Errorf("got %d flushes before closing, want 0", flushes)
+	}
+	s.Close()
+	if flushes, body := client.flushed(); flushes != 1 || body != "packet" {
+		t.Errorf("closing got %d flushes of %q, want 1 of one packet", flushes, body)
+	}
+}
+
+func TestStreamCanceled(t *testing.T) {
+	client := newSlowClient(false)
+	ctx := base.NewContext(0)
+	s := NewStream(client, ctx, 0, 0)
+	ctx.Cancel()
+	if _, err := s.Write([]byte("packet")); err == nil {
+		t.Error("write after cancel succeeded")
+	}
+	s.Close()
+	if _, body := client.flushed(); body != "" {
+		t.Errorf("got %q written after cancel, want nothing", body)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// BlockCacheBytes limits how much memory is used to cache blocks read from
+// index files, shared between all queries and threads.  Recent index files
+// are read over and over, so caching their blocks saves a read syscall (and
+// often a disk seek) per block.  If <= 0, nothing is cached.  Memory mapped
+// indexes (see UseMmap) are left to the OS page cache instead.
+var BlockCacheBytes int64
+
+// blockCacheBlockSize is the size and alignment of cached blocks.  It's a
+// little larger than most leveldb table blocks, so a table block usually
+// lies within one or two cached blocks.
+const blockCacheBlockSize = 32 << 10
+
+var (
+	blockCacheHits      = stats.S.Get("indexfile_block_cache_hits")
+	blockCacheMisses    = stats.S.Get("indexfile_block_cache_misses")
+	blockCacheEvictions = stats.S.Get("indexfile_block_cache_evictions")
+	blockCacheSize      = stats.S.Get("indexfile_block_cache_bytes")
+)
+
+// blockKey identifies a cached block.
+type blockKey struct {
+	file    string
+	modTime int64 // In case the file's replaced, e.g. by reindexing.
+	off     int64
+}
+
+type blockEntry struct {
+	key  blockKey
+	data []byte
+}
+
+func blockEntryBytes(e *blockEntry) int64 {
+	return int64(len(e.data)+len(e.key.file)) + 64
+}
+
+// blockCache is an LRU cache of index file blocks.
+type blockCache struct {
+	mu      sync.Mutex
+	lru     *list.List // Of *blockEntry, most recently used first.
+	entries map[blockKey]*list.Element
+	bytes   int64
+}
+
+var blocks = &blockCache{lru: list.New(), entries: map[blockKey]*list.Element{}}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		blockCacheHits.Increment()
+		return elem.Value.(*blockEntry).data, true
+	}
+	blockCacheMisses.Increment()
+	return nil, false
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	e := &blockEntry{key, data}
+	size := blockEntryBytes(e)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > BlockCacheBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.bytes > BlockCacheBytes {
+		c.removeLocked(c.lru.Back())
+		blockCacheEvictions.Increment()
+	}
+	blockCacheSize.Set(c.bytes)
+}
+
+// invalidate drops all cached blocks of the given file.
+func (c *blockCache) invalidate(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*blockEntry).key.file == file {
+			c.removeLocked(elem)
+		}
+		elem = next
+	}
+	blockCacheSize.Set(c.bytes)
+}
+
+func (c *blockCache) removeLocked(elem *list.Element) {
+	e := c.lru.Remove(elem).(*blockEntry)
+	delete(c.entries, e.key)
+	c.bytes -= blockEntryBytes(e)
+}
+
+// tableFile is the file interface leveldb tables are read through.
+type tableFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// blockCachedFile reads an index file through the block cache.
+type blockCachedFile struct {
+	tableFile
+	name    string
+	once    sync.Once
+	modTime int64
+	size    int64
+	err     error
+	off     int64 // For Read.
+}
+
+func newBlockCachedFile(name string, f tableFile) *blockCachedFile {
+	return &blockCachedFile{tableFile: f, name: name}
+}
+
+// stat records the file's size and modification time the first time it's
+// read, rather than on open, since the file cache opens files lazily.
+func (b *blockCachedFile) stat() error {
+	b.once.Do(func() {
+		info, err := b.tableFile.Stat()
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.modTime, b.size = info.ModTime().UnixNano(), info.Size()
+	})
+	return b.err
+}
+
+// block returns the cached block starting at off, reading it if necessary.
+func (b *blockCachedFile) block(off int64) ([]byte, error) {
+	key := blockKey{b.name, b.modTime, off}
+	if data, ok := blocks.get(key); ok {
+		return data, nil
+	}
+	size := int64(blockCacheBlockSize)
+	if off+size > b.size {
+		size = b.size - off
+	}
+	data := make([]byte, size)
+	if n, err := b.tableFile.ReadAt(data, off); err != nil && !(err == io.EOF && int64(n) == size) {
+		return nil, err
+	}
+	blocks.put(key, data)
+	return data, nil
+}
+
+func (b *blockCachedFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := b.stat(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= b.size {
+			return n, io.EOF
+		}
+		start := off - off%blockCacheBlockSize
+		data, err := b.block(start)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], data[off-start:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (b *blockCachedFile) Read(p []byte) (int, error) {
+	n, err := b.ReadAt(p, b.off)
+	b.off += int64(n)
+	return n, err
+}
+
+func (b *blockCachedFile) Close() error {
+	blocks.invalidate(b.name)
+	return b.tableFile.Close()
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"os"
+	"sync"
+
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+)
+
+// EncryptChunkBytes is the size of the chunks index files are encrypted in.
+// Lookups read a few small blocks of each index, so chunks are much smaller
+// than blockfiles'.
+const EncryptChunkBytes = 64 << 10
+
+// decryptingFile reads an index file which may be encrypted, decrypting it if
+// so.  Whether it is is checked when it's first used, rather than on open,
+// since the file cache opens files lazily.
+type decryptingFile struct {
+	tableFile
+	once sync.Once
+	info os.FileInfo
+	r    *encrypt.Reader // nil if the file isn't encrypted.
+	err  error
+	off  int64 // For Read.
+}
+
+func (d *decryptingFile) init() error {
+	d.once.Do(func() {
+		if d.info, d.err = d.tableFile.Stat(); d.err != nil {
+			return
+		}
+		var encrypted bool
+		if encrypted, d.err = encrypt.IsEncrypted(d.tableFile); encrypted {
+			d.r, d.err = encrypt.NewReader(d.tableFile, d.info.Size())
+		}
+	})
+	return d.err
+}
+
+// encrypted returns whether the file is encrypted on disk.
+func (d *decryptingFile) encrypted() bool {
+	return d.init() == nil && d.r != nil
+}
+
+func (d *decryptingFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.init(); err != nil {
+		return 0, err
+	}
+	if d.r == nil {
+		return d.tableFile.ReadAt(p, off)
+	}
+	return d.r.ReadAt(p, off)
+}
+
+func (d *decryptingFile) Read(p []byte) (int, error) {
+	n, err := d.ReadAt(p, d.off)
+	d.off += int64(n)
+	return n, err
+}
+
+// plaintextInfo reports the size of a file's plaintext, rather than its size
+// on disk.
+type plaintextInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (p plaintextInfo) Size() int64 { return p.size }
+
+func (d *decryptingFile) Stat() (os.FileInfo, error) {
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+	if d.r == nil {
+		return d.info, nil
+	}
+	return plaintextInfo{d.info, d.r.Size()}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/leveldb/table"
+)
+
+// ExportRow is a single packet position stored under an index key, flattened
+// out for analysis in other tools.
+type ExportRow struct {
+	Type KeyType
+	Key  []byte // Without the type byte.
+	// File is the name of the blockfile the packet is in.
+	File     string
+	Position int64
+	// Time is when the packet was captured, or zero if unknown.
+	Time time.Time
+}
+
+// ExportWriter writes out exported rows in some format.
+type ExportWriter interface {
+	Write(row *ExportRow) error
+	// Close finishes writing, but doesn't close the underlying writer.
+	Close() error
+}
+
+// Export calls w.Write for every position of every data key in the index,
+// in key order.  If timeOf is non-nil, it's used to fill in each row's Time.
+func (i *IndexFile) Export(w ExportWriter, timeOf func(file string, pos int64) time.Time) error {
+	for _, ss := range append([]*table.Reader{i.ss}, i.shards...) {
+		iter := ss.Find([]byte{}, nil)
+		for iter.Next() {
+			key := iter.Key()
+			if len(key) == 0 || key[0] == 0 { // Metadata, like the version.
+				continue
+			}
+			for _, pos := range i.decodePositions(iter.Value()) {
+				row := &ExportRow{Type: KeyType(key[0]), Key: key[1:], File: filepath.Base(i.name), Position: pos}
+				if i.rollupOf != nil {
+					if file := int(pos >> 32); file < len(i.rollupOf) {
+						row.File, row.Position = i.rollupOf[file], pos&0xFFFFFFFF
+					}
+				}
+				if timeOf != nil {
+					row.Time = timeOf(row.File, row.Position)
+				}
+				if err := w.Write(row); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return corruption(i.name, fmt.Errorf("reading index %q: %v", i.name, err), err)
+		}
+	}
+	return nil
+}
+
+// ExportTable is the table exported rows are inserted into by SQL exports.
+const ExportTable = "index_keys"
+
+// sqlExporter writes rows as SQL statements, which can be piped into
+// sqlite3 to build a database.
+type sqlExporter struct {
+	w io.Writer
+}
+
+// NewSQLExporter returns an ExportWriter writing SQLite statements that
+// create ExportTable (if it doesn't exist yet) and insert each row into it,
+// all in a single transaction.  Times are microseconds since the epoch, or
+// NULL if unknown.
+func NewSQLExporter(w io.Writer) (ExportWriter, error) {
+	_, err := fmt.Fprintf(w, "BEGIN TRANSACTION;\n"+
+		"CREATE TABLE IF NOT EXISTS %s (key_type TEXT, key TEXT, blockfile TEXT, position INTEGER, timestamp INTEGER);\n",
+		ExportTable)
+	return &sqlExporter{w}, err
+}
+
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (s *sqlExporter) Write(row *ExportRow) error {
+	ts := "NULL"
+	if !row.Time.IsZero() {
+		ts = strconv.FormatInt(row.Time.UnixNano()/1000, 10)
+	}
+	_, err := fmt.Fprintf(s.w, "INSERT INTO %s VALUES(%s,%s,%s,%d,%s);\n", ExportTable,
+		sqlQuote(row.Type.String()), sqlQuote(FormatKey(row.Type, row.Key)), sqlQuote(row.File), row.Position, ts)
+	return err
+}
+
+func (s *sqlExporter) Close() error {
+	_, err := io.WriteString(s.w, "COMMIT;\n")
+	return err
+}
+
+// csvExporter writes rows as CSV, for tools which import that, or convert it
+// to other formats like Parquet.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+// NewCSVExporter returns an ExportWriter writing a CSV header line, then a
+// line per row.  Times are RFC 3339, or empty if unknown.
+func NewCSVExporter(w io.Writer) (ExportWriter, error) {
+	c := &csvExporter{csv.NewWriter(w)}
+	return c, c.w.Write([]string{"key_type", "key", "blockfile", "position", "timestamp"})
+}
+
+func (c *csvExporter) Write(row *ExportRow) error {
+	ts := ""
+	if !row.Time.IsZero() {
+		ts = row.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return c.w.Write([]string{row.Type.String(), FormatKey(row.Type, row.Key), row.File, strconv.FormatInt(row.Position, 10), ts})
+}
+
+func (c *csvExporter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
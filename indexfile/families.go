@@ -0,0 +1,199 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// KeyType is the type of an index key, stored as its first byte.  Each query
+// primitive looks up keys of a single type.
+type KeyType byte
+
+// Key types stenotype writes.  These must match the type bytes used by
+// stenotype's Index::WriteTo.  Each has a KeyFamily registered below.
+const (
+	ProtoKeys     KeyType = 1
+	PortKeys      KeyType = 2
+	VLANKeys      KeyType = 3
+	IPv4Keys      KeyType = 4
+	MPLSKeys      KeyType = 5
+	IPv6Keys      KeyType = 6
+	ICMPTypeKeys  KeyType = 7
+	ICMPCodeKeys  KeyType = 8
+	InnerVLANKeys KeyType = 9
+	MPLSDepthKeys KeyType = 10
+	DSCPKeys      KeyType = 11
+	LengthKeys    KeyType = 12
+	FlagKeys      KeyType = 13
+	InnerIPv4Keys KeyType = 14
+	InnerIPv6Keys KeyType = 15
+	// IPv4PrefixKeys are only written by stenotype --index_ip_prefixes.  See
+	// prefixedIPv4Positions.
+	IPv4PrefixKeys KeyType = 16
+)
+
+// KeyFamily describes a type of index key.  Adding a new type of key to
+// stenographer means adding its KeyType above, registering its family, and
+// giving queries a way to look it up (usually just KeyPositions).  Stats,
+// exports, HasKeys, and IP sharding all work from the registry.
+type KeyFamily struct {
+	Type KeyType
+	// Name is used for the family in stats, exports, and logs.
+	Name string
+	// KeyLen is the length of each key, not counting the type byte.  Zero if
+	// keys vary in length.
+	KeyLen int
+	// MinMinorVersion is the first index minor version stenotype could
+	// write keys of this family in.  Older indexes are known not to have any,
+	// without having to look.
+	MinMinorVersion uint32
+	// Sharded families are stored in the IP shards of indexes that have them,
+	// rather than in the main index, split up by the value of the key's
+	// ShardByte'th byte.
+	Sharded   bool
+	ShardByte int
+	// Format returns a human readable version of a key, without its type
+	// byte.  It's only passed keys of length KeyLen.
+	Format func(key []byte) string
+}
+
+var keyFamilies = map[KeyType]*KeyFamily{}
+
+// RegisterKeyFamily adds a family of keys to the registry.  It panics if the
+// family's type is already registered, or is 0, which is reserved for
+// metadata.
+func RegisterKeyFamily(f KeyFamily) {
+	if f.Type == 0 {
+		panic("key type 0 is reserved for index metadata")
+	}
+	if old, ok := keyFamilies[f.Type]; ok {
+		panic(fmt.Sprintf("key type %d registered as both %q and %q", f.Type, old.Name, f.Name))
+	}
+	if f.Format == nil {
+		f.Format = hex.EncodeToString
+	}
+	keyFamilies[f.Type] = &f
+}
+
+// Family returns the registered family of keys of the given type, or nil.
+func Family(t KeyType) *KeyFamily {
+	return keyFamilies[t]
+}
+
+// KeyFamilies returns all registered families, ordered by type.
+func KeyFamilies() []*KeyFamily {
+	var out []*KeyFamily
+	for _, f := range keyFamilies {
+		out = append(out, f)
+	}
+	sort.Sort(familiesByType(out))
+	return out
+}
+
+type familiesByType []*KeyFamily
+
+func (f familiesByType) Len() int           { return len(f) }
+func (f familiesByType) Less(i, j int) bool { return f[i].Type < f[j].Type }
+func (f familiesByType) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (t KeyType) String() string {
+	if f := Family(t); f != nil {
+		return f.Name
+	}
+	return fmt.Sprintf("type%d", byte(t))
+}
+
+// FormatKey returns a human readable version of a key of the given type,
+// like "10.1.2.3" or "443".  Keys of unknown types, or of unexpected length,
+// are hex encoded.
+func FormatKey(t KeyType, key []byte) string {
+	if f := Family(t); f != nil && (f.KeyLen == 0 || len(key) == f.KeyLen) {
+		return f.Format(key)
+	}
+	return hex.EncodeToString(key)
+}
+
+// KeyPositions returns the positions in the block file of all packets with
+// keys of the given type from through to, inclusive.  Keys don't include
+// the type byte, and must be the family's length.
+func (i *IndexFile) KeyPositions(ctx context.Context, t KeyType, from, to []byte) (base.Positions, error) {
+	f := Family(t)
+	switch {
+	case f == nil:
+		return nil, fmt.Errorf("unknown key type %d", t)
+	case len(from) != len(to), f.KeyLen != 0 && len(from) != f.KeyLen:
+		return nil, fmt.Errorf("invalid %v key lengths %d, %d", t, len(from), len(to))
+	}
+	fromKey, toKey := append([]byte{byte(t)}, from...), append([]byte{byte(t)}, to...)
+	if f.Sharded && len(i.shards) > 0 {
+		if len(from) <= f.ShardByte {
+			return nil, fmt.Errorf("%v key too short to shard", t)
+		}
+		return i.shardedPositions(ctx, i.shardFor(from[f.ShardByte]), i.shardFor(to[f.ShardByte]), fromKey, toKey)
+	}
+	return i.positions(ctx, fromKey, toKey)
+}
+
+func formatIP(key []byte) string { return net.IP(key).String() }
+
+func formatUint8(key []byte) string { return strconv.Itoa(int(key[0])) }
+
+func formatUint16(key []byte) string { return strconv.Itoa(int(binary.BigEndian.Uint16(key))) }
+
+func init() {
+	for _, f := range []KeyFamily{
+		{Type: ProtoKeys, Name: "proto", KeyLen: 1, Format: formatUint8},
+		{Type: PortKeys, Name: "port", KeyLen: 2, Format: formatUint16},
+		{Type: VLANKeys, Name: "vlan", KeyLen: 2, Format: formatUint16},
+		{Type: IPv4Keys, Name: "ipv4", KeyLen: 4, Sharded: true, Format: formatIP},
+		{Type: MPLSKeys, Name: "mpls", KeyLen: 4, Format: func(key []byte) string {
+			return strconv.FormatUint(uint64(binary.BigEndian.Uint32(key)), 10)
+		}},
+		{Type: IPv6Keys, Name: "ipv6", KeyLen: 16, Sharded: true, Format: formatIP},
+		{Type: ICMPTypeKeys, Name: "icmptype", KeyLen: 1, MinMinorVersion: 1, Format: formatUint8},
+		{Type: ICMPCodeKeys, Name: "icmpcode", KeyLen: 1, MinMinorVersion: 1, Format: formatUint8},
+		{Type: InnerVLANKeys, Name: "innervlan", KeyLen: 2, MinMinorVersion: 2, Format: formatUint16},
+		// Keys are [depth][label], depth 1 being the outermost label.
+		{Type: MPLSDepthKeys, Name: "mplsdepth", KeyLen: 5, MinMinorVersion: 4, Format: func(key []byte) string {
+			return fmt.Sprintf("%d/%d", key[0], binary.BigEndian.Uint32(key[1:]))
+		}},
+		{Type: DSCPKeys, Name: "dscp", KeyLen: 1, MinMinorVersion: 5, Format: formatUint8},
+		{Type: LengthKeys, Name: "length", KeyLen: 2, MinMinorVersion: 6, Format: formatUint16},
+		{Type: FlagKeys, Name: "flags", KeyLen: 1, MinMinorVersion: 7, Format: formatUint8},
+		{Type: InnerIPv4Keys, Name: "inneripv4", KeyLen: 4, MinMinorVersion: 8, Format: formatIP},
+		{Type: InnerIPv6Keys, Name: "inneripv6", KeyLen: 16, MinMinorVersion: 8, Format: formatIP},
+		// Keys are [prefix length][the prefix's first length/8 bytes], so vary
+		// in length.  See ipv4Prefix.
+		{Type: IPv4PrefixKeys, Name: "ipv4prefix", MinMinorVersion: 9, Sharded: true, ShardByte: 1, Format: func(key []byte) string {
+			if len(key) == 0 || len(key) > 4 || len(key) != 1+int(key[0])/8 {
+				return hex.EncodeToString(key)
+			}
+			var ip [4]byte
+			copy(ip[:], key[1:])
+			return fmt.Sprintf("%v/%d", net.IP(ip[:]), key[0])
+		}},
+	} {
+		RegisterKeyFamily(f)
+	}
+}
@@ -23,12 +23,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/golang/leveldb/table"
 	"github.com/google/stenographer/base"
 	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/stats"
+	"../stats"
 	"golang.org/x/net/context"
 )
 
@@ -42,10 +45,28 @@ var (
 // Major version number of the file format that we support.
 const majorVersionNumber = 2
 
+// ipShardsKey is the index key holding the number of IP shard files written
+// alongside an index, if stenotype was run with --index_ip_shards.
+var ipShardsKey = []byte{0, 1}
+
 // IndexFile wraps a stenotype index, allowing it to be queried.
 type IndexFile struct {
-	name string
-	ss   *table.Reader
+	name   string
+	ss     *table.Reader
+	shards []*table.Reader // If non-empty, IP keys are stored here, not in ss.
+	minor  uint32          // Minor version of the file format.
+	// encrypted is set if the index and all its shards are encrypted.
+	encrypted bool
+	// rollupOf holds the blockfiles covered, if this is a rollup index.  See
+	// WriteRollup.
+	rollupOf []string
+	times    *TimeHistogram // nil if the index doesn't record packet times.
+	// packetLength reads packets' lengths from the blockfile, for
+	// LengthPositions.  nil if it wasn't set with SetPacketLengths.
+	packetLength func(pos int64) (int, error)
+
+	mu       sync.Mutex
+	keyTypes map[KeyType]bool // Cache for HasKeys.
 }
 
 // IndexPathFromBlockfilePath returns the path to an index file based on the path to a
@@ -60,20 +81,72 @@ func BlockfilePathFromIndexPath(p string) string {
 	return strings.Replace(p, "IDX", "PKT", 1)
 }
 
-// NewIndexFile returns a new handle to the named index file.
-func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
-	v(1, "opening index %q", filename)
-	ss := table.NewReader(fc.Open(filename), nil)
+// ShardPaths returns the paths to all IP shard files belonging to the given
+// index file.
+func ShardPaths(p string) []string {
+	matches, _ := filepath.Glob(p + ".ip*")
+	return matches
+}
+
+// IsShardPath returns true if the given path is an IP shard file, not an index.
+func IsShardPath(p string) bool {
+	return strings.Contains(filepath.Base(p), ".ip")
+}
+
+func shardPath(p string, shard int) string {
+	return fmt.Sprintf("%s.ip%d", p, shard)
+}
+
+// checkVersion checks the major version of an index file, and returns its
+// minor version.
+func checkVersion(filename string, ss *table.Reader) (uint32, error) {
 	if versions, err := ss.Get([]byte{0}, nil); err != nil {
-		return nil, fmt.Errorf("invalid index file %q missing versions record: %v", filename, err)
+		return 0, corruption(filename, fmt.Errorf("invalid index file %q missing versions record: %v", filename, err), err)
 	} else if len(versions) != 8 {
-		return nil, fmt.Errorf("invalid index file %q invalid versions record: %v", filename, versions)
+		return 0, &CorruptError{filename, fmt.Errorf("invalid index file %q invalid versions record: %v", filename, versions)}
 	} else if major, minor := binary.BigEndian.Uint32(versions[:4]), binary.BigEndian.Uint32(versions[4:]); major != majorVersionNumber {
-		return nil, fmt.Errorf("invalid index file %q: version mismatch, want %d got %d", filename, majorVersionNumber, major)
+		return 0, fmt.Errorf("invalid index file %q: version mismatch, want %d got %d", filename, majorVersionNumber, major)
 	} else {
 		v(3, "index file %q has file format version %d:%d", filename, major, minor)
+		return minor, nil
+	}
+}
+
+// NewIndexFile returns a new handle to the named index file.
+func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
+	v(1, "opening index %q", filename)
+	ss, encrypted := openTable(filename, fc)
+	minor, err := checkVersion(filename, ss)
+	if err != nil {
+		return nil, err
+	}
+	index := &IndexFile{ss: ss, name: filename, minor: minor, encrypted: encrypted}
+	// Older indexes, and those written without --index_ip_shards, don't have
+	// this key, and store IPs directly.
+	if count, err := ss.Get(ipShardsKey, nil); err == nil && len(count) == 4 {
+		for i := 0; i < int(binary.BigEndian.Uint32(count)); i++ {
+			name := shardPath(filename, i)
+			shard, encrypted := openTable(name, fc)
+			index.shards = append(index.shards, shard)
+			index.encrypted = index.encrypted && encrypted
+			if _, err := checkVersion(name, shard); err != nil {
+				index.Close()
+				return nil, err
+			}
+		}
+		v(3, "index file %q has %d IP shards", filename, len(index.shards))
+	}
+	if times, err := ss.Get(timesKey, nil); err == nil {
+		if index.times, err = parseTimeHistogram(times); err != nil {
+			index.Close()
+			return nil, &CorruptError{filename, fmt.Errorf("invalid index file %q: %v", filename, err)}
+		}
+	}
+	if files, err := ss.Get(rollupFilesKey, nil); err == nil {
+		index.rollupOf = strings.Split(string(files), "\x00")
+		v(3, "index file %q is a rollup of %d files", filename, len(index.rollupOf))
 	}
-	if *base.VerboseLogging >= 10 {
+	if base.Verbosity() >= 10 {
 		iter := ss.Find([]byte{}, nil)
 		v(4, "=== %q ===", filename)
 		for iter.Next() {
@@ -81,10 +154,15 @@ func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
 		}
 		v(4, "  ERR: %v", iter.Close())
 	}
-	index := &IndexFile{ss: ss, name: filename}
 	return index, nil
 }
 
+// Encrypted returns whether the index, and all its shards, are encrypted on
+// disk.
+func (i *IndexFile) Encrypted() bool {
+	return i.encrypted
+}
+
 // Name returns the name of the file underlying this index.
 func (i *IndexFile) Name() string {
 	return i.name
@@ -94,29 +172,86 @@ func (i *IndexFile) Name() string {
 // between the given ranges.  Both IPs must be 4 or 16 bytes long, both must be
 // the same length, and from must be <= to.
 func (i *IndexFile) IPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
-	var version byte
+	fromKey, toKey, err := ipKeys(from, to, IPv4Keys, IPv6Keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 4 && i.HasKeys(IPv4PrefixKeys) {
+		return i.prefixedIPv4Positions(ctx, from, to)
+	}
+	return i.ipRangePositions(ctx, from, to, fromKey, toKey)
+}
+
+// ipRangePositions looks up the IP keys fromKey through toKey, for IPs from
+// through to, in the main index or its shards.
+func (i *IndexFile) ipRangePositions(ctx context.Context, from, to net.IP, fromKey, toKey []byte) (base.Positions, error) {
+	if len(i.shards) == 0 {
+		return i.positions(ctx, fromKey, toKey)
+	}
+	return i.shardedPositions(ctx, i.shardFor(from[0]), i.shardFor(to[0]), fromKey, toKey)
+}
+
+// shardFor returns the IP shard holding addresses starting with the given byte.
+// This must match stenotype's Index::IPShard.
+// ipKeys returns the index keys for an IP range, prefixed by the given index
+// type for IPv4 or IPv6.
+func ipKeys(from, to net.IP, v4, v6 KeyType) (fromKey, toKey []byte, _ error) {
+	var version KeyType
 	switch {
 	case len(from) != len(to):
-		return nil, fmt.Errorf("IP length mismatch")
+		return nil, nil, fmt.Errorf("IP length mismatch")
 	case bytes.Compare(from, to) > 0:
-		return nil, fmt.Errorf("from IP greater than to IP")
+		return nil, nil, fmt.Errorf("from IP greater than to IP")
 	case len(from) == 16:
-		version = 6
+		version = v6
 	case len(from) == 4:
-		version = 4
+		version = v4
 	default:
-		return nil, fmt.Errorf("Invalid IP length")
+		return nil, nil, fmt.Errorf("Invalid IP length")
+	}
+	return append([]byte{byte(version)}, []byte(from)...), append([]byte{byte(version)}, []byte(to)...), nil
+}
+
+func (i *IndexFile) shardFor(firstByte byte) int {
+	return int(firstByte) * len(i.shards) / 256
+}
+
+// shardedPositions looks up keys 'from' through 'to' in IP shards first
+// through last, in parallel, and returns the union of the results.
+func (i *IndexFile) shardedPositions(ctx context.Context, first, last int, from, to []byte) (base.Positions, error) {
+	type result struct {
+		pos base.Positions
+		err error
+	}
+	results := make(chan result, last-first+1)
+	for shard := first; shard <= last; shard++ {
+		go func(ss *table.Reader) {
+			pos, err := i.positionsIn(ctx, ss, from, to)
+			results <- result{pos, err}
+		}(i.shards[shard])
+	}
+	var out base.Positions
+	var err error
+	for shard := first; shard <= last; shard++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+		} else if out == nil {
+			out = r.pos
+		} else {
+			out = out.Union(r.pos)
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
-	return i.positions(
-		ctx,
-		append([]byte{version}, []byte(from)...),
-		append([]byte{version}, []byte(to)...))
+	return out, nil
 }
 
 // ProtoPositions returns the positions in the block file of all packets with
 // the give IP protocol number.
 func (i *IndexFile) ProtoPositions(ctx context.Context, proto byte) (base.Positions, error) {
-	return i.positionsSingleKey(ctx, []byte{1, proto})
+	return i.positionsSingleKey(ctx, []byte{byte(ProtoKeys), proto})
 }
 
 // PortPositions returns the positions in the block file of all packets with
@@ -124,7 +259,7 @@ func (i *IndexFile) ProtoPositions(ctx context.Context, proto byte) (base.Positi
 func (i *IndexFile) PortPositions(ctx context.Context, port uint16) (base.Positions, error) {
 	var buf [3]byte
 	binary.BigEndian.PutUint16(buf[1:], port)
-	buf[0] = 2
+	buf[0] = byte(PortKeys)
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
@@ -133,7 +268,7 @@ func (i *IndexFile) PortPositions(ctx context.Context, port uint16) (base.Positi
 func (i *IndexFile) VLANPositions(ctx context.Context, port uint16) (base.Positions, error) {
 	var buf [3]byte
 	binary.BigEndian.PutUint16(buf[1:], port)
-	buf[0] = 3
+	buf[0] = byte(VLANKeys)
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
@@ -142,13 +277,125 @@ func (i *IndexFile) VLANPositions(ctx context.Context, port uint16) (base.Positi
 func (i *IndexFile) MPLSPositions(ctx context.Context, mpls uint32) (base.Positions, error) {
 	var buf [5]byte
 	binary.BigEndian.PutUint32(buf[1:], mpls)
-	buf[0] = 5
+	buf[0] = byte(MPLSKeys)
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// ICMPTypePositions returns the positions in the block file of all ICMP and
+// ICMPv6 packets with the given type.
+func (i *IndexFile) ICMPTypePositions(ctx context.Context, icmpType byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, []byte{byte(ICMPTypeKeys), icmpType})
+}
+
+// ICMPCodePositions returns the positions in the block file of all ICMP and
+// ICMPv6 packets with the given code.
+func (i *IndexFile) ICMPCodePositions(ctx context.Context, icmpCode byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, []byte{byte(ICMPCodeKeys), icmpCode})
+}
+
+// InnerVLANPositions returns the positions in the block file of all packets
+// carrying the given VLAN number in a tag other than the outermost one.
+func (i *IndexFile) InnerVLANPositions(ctx context.Context, vlan uint16) (base.Positions, error) {
+	var buf [3]byte
+	binary.BigEndian.PutUint16(buf[1:], vlan)
+	buf[0] = byte(InnerVLANKeys)
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// MPLSDepthPositions returns the positions in the block file of all packets
+// with the given MPLS label at the given stack depth (1 is the outermost).
+func (i *IndexFile) MPLSDepthPositions(ctx context.Context, mpls uint32, depth byte) (base.Positions, error) {
+	var buf [6]byte
+	binary.BigEndian.PutUint32(buf[2:], mpls)
+	buf[0] = byte(MPLSDepthKeys)
+	buf[1] = depth
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
-// Dump writes out a debug version of the entire index to the given writer.
+// DSCPPositions returns the positions in the block file of all IPv4 and IPv6
+// packets with the given DSCP value.
+func (i *IndexFile) DSCPPositions(ctx context.Context, dscp byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, []byte{byte(DSCPKeys), dscp})
+}
+
+// Flags stenotype indexes packets with, for use with FlagPositions.
+const (
+	FlagIPFragment    = 1 // IPv4 or IPv6 fragment.
+	FlagBadIPChecksum = 2 // IPv4 header checksum is wrong.
+)
+
+// FlagPositions returns the positions in the block file of all packets
+// stenotype flagged with the given flag.
+func (i *IndexFile) FlagPositions(ctx context.Context, flag byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, []byte{byte(FlagKeys), flag})
+}
+
+// HasInnerIPs returns whether this index was written by a stenotype that
+// indexes the inner IPs of tunneled packets.
+func (i *IndexFile) HasInnerIPs() bool {
+	return i.minor >= Family(InnerIPv4Keys).MinMinorVersion
+}
+
+// InnerIPPositions returns the positions in the block file of all GRE, VXLAN,
+// and Geneve packets whose encapsulated IPs are in the given range.  IPs are
+// as for IPPositions.
+func (i *IndexFile) InnerIPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	fromKey, toKey, err := ipKeys(from, to, InnerIPv4Keys, InnerIPv6Keys)
+	if err != nil {
+		return nil, err
+	}
+	return i.positions(ctx, fromKey, toKey)
+}
+
+// HasKeys returns whether this index has any keys of all the given types.  A
+// query needing a type of key the index doesn't have can't match anything in
+// it, so its lookup can be skipped entirely.  Results are cached, so each
+// type is only looked for once per file, and indexes older than a type's
+// KeyFamily.MinMinorVersion aren't searched at all.
+func (i *IndexFile) HasKeys(types ...KeyType) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.keyTypes == nil {
+		i.keyTypes = map[KeyType]bool{}
+	}
+	for _, t := range types {
+		has, ok := i.keyTypes[t]
+		if !ok {
+			has = i.hasKeysLocked(t)
+			i.keyTypes[t] = has
+		}
+		if !has {
+			return false
+		}
+	}
+	return true
+}
+
+// hasKeysLocked looks for any keys of the given type.  Errors count as
+// having keys, so that the real lookup reports them.
+func (i *IndexFile) hasKeysLocked(t KeyType) bool {
+	f := Family(t)
+	if f != nil && i.minor < f.MinMinorVersion {
+		return false
+	}
+	tables := []*table.Reader{i.ss}
+	if len(i.shards) > 0 && f != nil && f.Sharded {
+		tables = i.shards
+	}
+	for _, ss := range tables {
+		iter := ss.Find([]byte{byte(t)}, nil)
+		found := iter.Next() && len(iter.Key()) > 0 && iter.Key()[0] == byte(t)
+		if err := iter.Close(); err != nil || found {
+			return true
+		}
+	}
+	return false
+}
+
+// Dump writes out a debug version of the index keys from start through finish
+// to the given writer.  An empty finish dumps through the end of the index.
 func (i *IndexFile) Dump(out io.Writer, start, finish []byte) {
-	for iter := i.ss.Find(start, nil); iter.Next() && bytes.Compare(iter.Key(), finish) <= 0; {
+	for iter := i.ss.Find(start, nil); iter.Next() && (len(finish) == 0 || bytes.Compare(iter.Key(), finish) <= 0); {
 		fmt.Fprintf(out, "%v\n", hex.EncodeToString(iter.Key()))
 	}
 }
@@ -156,7 +403,13 @@ func (i *IndexFile) Dump(out io.Writer, start, finish []byte) {
 // positions returns a set of positions to look for packets, based on a
 // lookup of all blockfile positions stored between (inclusively) index
 // keys 'from' and 'to'.
-func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Positions, _ error) {
+func (i *IndexFile) positions(ctx context.Context, from, to []byte) (base.Positions, error) {
+	return i.positionsIn(ctx, i.ss, from, to)
+}
+
+// positionsIn is like positions, but reads from the given table, which is
+// either the main index or one of its IP shards.
+func (i *IndexFile) positionsIn(ctx context.Context, ss *table.Reader, from, to []byte) (out base.Positions, _ error) {
 	v(4, "%q multi key iterator %v:%v start", i.name, from, to)
 	if len(from) != len(to) {
 		return nil, fmt.Errorf("invalid from/to lengths don't match: %v %v", from, to)
@@ -167,16 +420,13 @@ func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Po
 		indexReads.Increment()
 	}()
 	defer indexReadNanos.NanoTimer()()
-	iter := i.ss.Find(from, nil)
+	iter := ss.Find(from, nil)
 	for iter.Next() && !base.ContextDone(ctx) {
 		if to != nil && bytes.Compare(iter.Key(), to) > 0 {
 			v(4, "%q multi key iterator %v:%v hit limit with %v", i.name, from, to, iter.Key())
 			break
 		}
-		current := make(base.Positions, len(iter.Value())/4)
-		for i := 0; i < len(iter.Value()); i += 4 {
-			current[i/4] = int64(binary.BigEndian.Uint32(iter.Value()[i : i+4]))
-		}
+		current := i.decodePositions(iter.Value())
 		v(4, "%q multi key iterator got in-iter union of length %d for %v", i.name, len(current), iter.Key())
 		if out == nil {
 			out = current
@@ -191,7 +441,7 @@ func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Po
 	v(4, "%q multi key iterator done, got %d", i.name, len(out))
 	if err := iter.Close(); err != nil {
 		v(4, "%q multi key iterator err=%v", i.name, err)
-		return nil, err
+		return nil, corruption(i.name, fmt.Errorf("reading index %q: %v", i.name, err), err)
 	}
 	return out, nil
 }
@@ -211,6 +461,14 @@ func parseIP(in string) net.IP {
 }
 
 // Close the indexfile.
-func (i *IndexFile) Close() error {
-	return i.ss.Close()
+func (i *IndexFile) Close() (err error) {
+	for _, shard := range i.shards {
+		if e := shard.Close(); e != nil {
+			err = e
+		}
+	}
+	if e := i.ss.Close(); e != nil {
+		err = e
+	}
+	return
 }
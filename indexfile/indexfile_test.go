@@ -16,19 +16,29 @@ package indexfile
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/golang/leveldb/table"
 	"github.com/google/stenographer/base"
 	"github.com/google/stenographer/filecache"
 )
 
 var ctx = context.Background()
 
-func testIndexFile(t *testing.T, filename string) *IndexFile {
+func testIndexFile(t testing.TB, filename string) *IndexFile {
 	idx, err := NewIndexFile(filename, filecache.NewCache(10))
 	if err != nil {
 		t.Fatal(err)
@@ -139,3 +149,705 @@ func TestDump(t *testing.T) {
 		t.Fatalf("invalid dump.\nwant %q\n got: %q\n", want, got)
 	}
 }
+
+func TestUnshardedIndex(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	if len(idx.shards) != 0 {
+		t.Errorf("unsharded index opened with %d shards", len(idx.shards))
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	idx := &IndexFile{shards: make([]*table.Reader, 4)}
+	for _, test := range []struct {
+		first byte
+		want  int
+	}{
+		{0, 0},
+		{10, 0},
+		{63, 0},
+		{64, 1},
+		{192, 3},
+		{255, 3},
+	} {
+		if got := idx.shardFor(test.first); got != test.want {
+			t.Errorf("shardFor(%d) = %d, want %d", test.first, got, test.want)
+		}
+	}
+}
+
+func TestIsShardPath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want bool
+	}{
+		{"IDX0/1420000000000000", false},
+		{"IDX0/1420000000000000.ip0", true},
+		{"IDX0/1420000000000000.ip15", true},
+	} {
+		if got := IsShardPath(test.path); got != test.want {
+			t.Errorf("IsShardPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestHasKeys(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/vlan")
+	defer idx.Close()
+	for _, test := range []struct {
+		types []KeyType
+		want  bool
+	}{
+		{nil, true},
+		{[]KeyType{VLANKeys}, true},
+		{[]KeyType{VLANKeys, PortKeys}, true},
+		{[]KeyType{MPLSKeys}, false},
+		{[]KeyType{VLANKeys, InnerIPv6Keys}, false},
+	} {
+		// Twice, to check cached results too.
+		for i := 0; i < 2; i++ {
+			if got := idx.HasKeys(test.types...); got != test.want {
+				t.Errorf("HasKeys(%v) = %v, want %v", test.types, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMmap(t *testing.T) {
+	const filename = "../testdata/IDX0/dhcp"
+	want, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := openMmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want)+10)
+	if n, err := m.ReadAt(got, 0); n != len(want) || err != io.EOF {
+		t.Errorf("ReadAt past end: got %d, %v want %d, EOF", n, err, len(want))
+	} else if !bytes.Equal(got[:n], want) {
+		t.Errorf("mapped contents differ from file")
+	}
+	if err := m.Close(); err != nil {
+		t.Error(err)
+	}
+
+	defer func(use bool, max int64) { UseMmap, MmapMaxBytes = use, max }(UseMmap, MmapMaxBytes)
+	UseMmap = true
+	for _, max := range []int64{1 << 30, 10} { // Mapped, then too big to map.
+		MmapMaxBytes = max
+		idx := testIndexFile(t, filename)
+		if got, err := idx.IPPositions(ctx, parseIP("192.168.0.1"), parseIP("192.168.0.254")); err != nil {
+			t.Fatal(err)
+		} else if want := (base.Positions{1049024, 1049848}); !reflect.DeepEqual(got, want) {
+			t.Errorf("max %d: wrong IP positions.\nwant: %v\n got: %v\n", max, want, got)
+		}
+		idx.Close()
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	defer func(old int64) { BlockCacheBytes = old }(BlockCacheBytes)
+	BlockCacheBytes = 1 << 20
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	for i := 0; i < 2; i++ {
+		misses := blockCacheMisses.Value()
+		if got, err := idx.IPPositions(ctx, parseIP("192.168.0.1"), parseIP("192.168.0.254")); err != nil {
+			t.Fatal(err)
+		} else if want := (base.Positions{1049024, 1049848}); !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong IP positions.\nwant: %v\n got: %v\n", want, got)
+		}
+		if got := blockCacheMisses.Value() - misses; i > 0 && got != 0 {
+			t.Errorf("repeated lookup got %d cache misses", got)
+		}
+	}
+	idx.Close()
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+	for key := range blocks.entries {
+		if key.file == "../testdata/IDX0/dhcp" {
+			t.Fatalf("blocks still cached after file was closed")
+		}
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	defer func(old int64) { BlockCacheBytes = old }(BlockCacheBytes)
+	c := &blockCache{lru: list.New(), entries: map[blockKey]*list.Element{}}
+	data := make([]byte, 100)
+	BlockCacheBytes = 3 * blockEntryBytes(&blockEntry{blockKey{"f", 0, 0}, data})
+	for i := int64(0); i < 4; i++ {
+		c.put(blockKey{"f", 0, i}, data)
+		if i == 1 {
+			c.get(blockKey{"f", 0, 0}) // Make block 1 the least recently used.
+		}
+	}
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := c.get(blockKey{"f", 0, int64(i)}); ok != want {
+			t.Errorf("block %d cached: %v, want %v", i, ok, want)
+		}
+	}
+}
+
+func TestFormatKey(t *testing.T) {
+	for _, test := range []struct {
+		t    KeyType
+		key  string
+		want string
+	}{
+		{IPv4Keys, "0a010203", "10.1.2.3"},
+		{IPv6Keys, "20010db8000000000000000000000001", "2001:db8::1"},
+		{PortKeys, "01bb", "443"},
+		{ProtoKeys, "06", "6"},
+		{MPLSDepthKeys, "0200000010", "2/16"},
+		{IPv4PrefixKeys, "100a01", "10.1.0.0/16"},
+		{PortKeys, "01", "01"},
+		{KeyType(99), "abcd", "abcd"},
+	} {
+		key, _ := hex.DecodeString(test.key)
+		if got := FormatKey(test.t, key); got != test.want {
+			t.Errorf("FormatKey(%v, %v) got %q, want %q", test.t, test.key, got, test.want)
+		}
+	}
+}
+
+func TestKeyFamilies(t *testing.T) {
+	types := map[KeyType]bool{}
+	for _, f := range KeyFamilies() {
+		if types[f.Type] {
+			t.Errorf("key type %d listed twice", f.Type)
+		}
+		types[f.Type] = true
+		if f.Name == "" || f.Format == nil {
+			t.Errorf("key type %d has no name or format", f.Type)
+		}
+	}
+	for typ := ProtoKeys; typ <= IPv4PrefixKeys; typ++ {
+		if !types[typ] {
+			t.Errorf("key type %d not registered", typ)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a duplicate key type didn't panic")
+		}
+	}()
+	RegisterKeyFamily(KeyFamily{Type: PortKeys, Name: "port2"})
+}
+
+func TestKeyPositions(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	want, err := idx.IPPositions(ctx, parseIP("192.168.0.1"), parseIP("192.168.0.254"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := idx.KeyPositions(ctx, IPv4Keys, parseIP("192.168.0.1"), parseIP("192.168.0.254")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong positions.\nwant: %v\n got: %v", want, got)
+	}
+	if _, err := idx.KeyPositions(ctx, PortKeys, []byte{1}, []byte{1}); err == nil {
+		t.Errorf("short port key didn't fail")
+	}
+	// Index minor versions predate ICMP keys, so there's no need to look.
+	if idx.HasKeys(ICMPTypeKeys) {
+		t.Errorf("old index claims ICMP keys")
+	}
+}
+
+func TestExport(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	var buf bytes.Buffer
+	w, err := NewCSVExporter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1e9, 0)
+	if err := idx.Export(w, func(file string, pos int64) time.Time { return when }); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if want := 1 + 6 + 8 + 8 + 4; len(lines) != want { // Header, then positions counted by TestStats.
+		t.Errorf("got %d lines, want %d", len(lines), want)
+	}
+	if want := "ipv4,192.168.0.1,dhcp,1049024,2001-09-09T01:46:40Z"; !strings.Contains(buf.String(), want+"\n") {
+		t.Errorf("export missing %q:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if w, err = NewSQLExporter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Export(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO index_keys VALUES('ipv4','192.168.0.1','dhcp',1049024,NULL);\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("export missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	s, err := idx.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"proto": 2, "port": 2, "ipv4": 4, "ipv6": 2}; !reflect.DeepEqual(s.Keys, want) {
+		t.Errorf("wrong key counts.\nwant: %v\n got: %v", want, s.Keys)
+	}
+	if want := map[string]int64{"proto": 6, "port": 8, "ipv4": 8, "ipv6": 4}; !reflect.DeepEqual(s.Positions, want) {
+		t.Errorf("wrong position counts.\nwant: %v\n got: %v", want, s.Positions)
+	}
+	if s.MinKey != "0111" || s.MaxKey != "06ff020000000000000000000000000002" {
+		t.Errorf("wrong key range %v-%v", s.MinKey, s.MaxKey)
+	}
+	if s.Bytes != 294 || s.Shards != 0 {
+		t.Errorf("got %d bytes in %d shards, want 294 in 0", s.Bytes, s.Shards)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const filename = "../testdata/IDX0/dhcp"
+	idx := testIndexFile(t, filename)
+	if err := idx.Verify(ctx, 0); err != nil {
+		t.Errorf("verifying good index: %v", err)
+	}
+	if err := idx.Verify(ctx, 1049848); !IsCorrupt(err) {
+		t.Errorf("verifying index with positions past the end of its blockfile: got %v, want corrupt", err)
+	}
+	idx.Close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data[10] ^= 0xFF // In the first data block.
+	f.Write(data)
+	f.Close()
+	if _, err := NewIndexFile(f.Name(), filecache.NewCache(10)); !IsCorrupt(err) {
+		t.Errorf("opening damaged index: got %v, want corrupt", err)
+	}
+	if _, err := NewIndexFile(f.Name()+".missing", filecache.NewCache(10)); err == nil || IsCorrupt(err) {
+		t.Errorf("opening missing index: got %v, want non-corrupt error", err)
+	}
+}
+
+func TestWriteRollup(t *testing.T) {
+	var indexes []*IndexFile
+	for _, name := range []string{"dhcp", "mpls", "vlan"} {
+		idx := testIndexFile(t, "../testdata/IDX0/"+name)
+		defer idx.Close()
+		indexes = append(indexes, idx)
+	}
+	f, err := ioutil.TempFile("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := WriteRollup(f.Name(), indexes); err != nil {
+		t.Fatal(err)
+	}
+	rollup := testIndexFile(t, f.Name())
+	defer rollup.Close()
+	if want := []string{"dhcp", "mpls", "vlan"}; !reflect.DeepEqual(rollup.RollupOf(), want) {
+		t.Errorf("rollup of %v, want %v", rollup.RollupOf(), want)
+	}
+	if err := rollup.Verify(ctx, 0); err != nil {
+		t.Errorf("verifying rollup: %v", err)
+	}
+	lookups := []func(*IndexFile) (base.Positions, error){
+		func(i *IndexFile) (base.Positions, error) { return i.ProtoPositions(ctx, 17) },
+		func(i *IndexFile) (base.Positions, error) { return i.PortPositions(ctx, 67) },
+		func(i *IndexFile) (base.Positions, error) {
+			return i.IPPositions(ctx, parseIP("0.0.0.0"), parseIP("255.255.255.255"))
+		},
+	}
+	for n, lookup := range lookups {
+		pos, err := lookup(rollup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]base.Positions{}
+		for _, idx := range indexes {
+			p, err := lookup(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p) > 0 {
+				want[filepath.Base(idx.Name())] = p
+			}
+		}
+		if got := rollup.SplitRollupPositions(pos); !reflect.DeepEqual(got, want) {
+			t.Errorf("lookup %d got %v, want %v", n, got, want)
+		}
+	}
+	if got := rollup.SplitRollupPositions(base.AllPositions); len(got) != 3 || !got["mpls"].IsAllPositions() {
+		t.Errorf("all positions split into %v", got)
+	}
+}
+
+func TestTimeHistogram(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	var h TimeHistogram
+	for _, s := range []string{"2015-01-01T10:05:10Z", "2015-01-01T10:05:50Z", "2015-01-01T10:03:00Z", "2015-01-01T10:07:59Z"} {
+		h.Add(at(s))
+	}
+	if want := []uint32{1, 0, 2, 0, 1}; !reflect.DeepEqual(h.Minutes, want) {
+		t.Errorf("got minutes %v, want %v", h.Minutes, want)
+	}
+	parsed, err := parseTimeHistogram(h.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.First.Equal(h.First) || !parsed.Last.Equal(h.Last) || !reflect.DeepEqual(parsed.Minutes, h.Minutes) {
+		t.Errorf("round trip got %+v, want %+v", parsed, h)
+	}
+	for _, test := range []struct {
+		start, stop string
+		want        bool
+	}{
+		{"2015-01-01T10:00:00Z", "2015-01-01T10:02:59Z", false},
+		{"2015-01-01T10:00:00Z", "2015-01-01T10:03:00Z", true},
+		{"2015-01-01T10:04:00Z", "2015-01-01T10:04:59Z", false}, // No packets that minute.
+		{"2015-01-01T10:04:30Z", "2015-01-01T10:05:00Z", true},
+		{"2015-01-01T10:07:30Z", "", true},
+		{"2015-01-01T10:08:00Z", "", false},
+		{"", "2015-01-01T10:03:00Z", true},
+	} {
+		var start, stop time.Time
+		if test.start != "" {
+			start = at(test.start)
+		}
+		if test.stop != "" {
+			stop = at(test.stop)
+		}
+		if got := h.Overlaps(start, stop); got != test.want {
+			t.Errorf("overlaps %q-%q got %v, want %v", test.start, test.stop, got, test.want)
+		}
+	}
+
+	h.Add(at("2015-01-05T00:00:00Z"))
+	if h.Minutes != nil || !h.Overlaps(at("2015-01-03T00:00:00Z"), at("2015-01-03T00:01:00Z")) {
+		t.Errorf("packets spanning days got minutes %v", h.Minutes)
+	}
+}
+
+func TestSplitIPv4Range(t *testing.T) {
+	ip := func(s string) uint32 { return binary.BigEndian.Uint32(parseIP(s)) }
+	prefixes, ranges := splitIPv4Range(ip("10.0.0.200"), ip("11.1.0.9"))
+	want := []ipv4Prefix{{24, ip("10.0.1.0")}}
+	for i := 2; i < 256; i++ {
+		want = append(want, ipv4Prefix{24, ip("10.0.0.0") + uint32(i)<<8})
+	}
+	for i := 1; i < 256; i++ {
+		want = append(want, ipv4Prefix{16, ip("10.0.0.0") + uint32(i)<<16})
+	}
+	want = append(want, ipv4Prefix{16, ip("11.0.0.0")})
+	if !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("got %d prefixes %v..., want %d", len(prefixes), prefixes[:3], len(want))
+	}
+	if want := [][2]uint32{{ip("10.0.0.200"), ip("10.0.0.255")}, {ip("11.1.0.0"), ip("11.1.0.9")}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %v, want %v", ranges, want)
+	}
+	if prefixes, ranges := splitIPv4Range(0, 0xFFFFFFFF); len(prefixes) != 256 || len(ranges) != 0 {
+		t.Errorf("whole address space split into %d prefixes and %d ranges", len(prefixes), len(ranges))
+	}
+}
+
+// writeIPv4Index writes an index with a key for each of n IPv4 addresses
+// scattered across 10.0.0.0/8, each in a packet of its own.  If prefixes is
+// set, IPv4PrefixKeys are written too, as stenotype --index_ip_prefixes
+// would.
+func writeIPv4Index(tb testing.TB, n int, prefixes bool) string {
+	keys := map[string][]uint32{}
+	for pos := 0; pos < n; pos++ {
+		var key [5]byte
+		key[0] = byte(IPv4Keys)
+		binary.BigEndian.PutUint32(key[1:], 10<<24|uint32(pos)*2654435761&0xFFFFFF)
+		keys[string(key[:])] = append(keys[string(key[:])], uint32(pos))
+		for _, bits := range ipv4PrefixLengths {
+			if prefixes {
+				p := ipv4Prefix{bits, binary.BigEndian.Uint32(key[1:]) >> (32 - bits) << (32 - bits)}
+				keys[string(p.key())] = append(keys[string(p.key())], uint32(pos))
+			}
+		}
+	}
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	f, err := ioutil.TempFile("", "indexfile_test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w := table.NewWriter(f, nil)
+	w.Set([]byte{0}, []byte{0, 0, 0, 2, 0, 0, 0, 9}, nil)
+	for _, key := range sorted {
+		value := make([]byte, 4*len(keys[key]))
+		for i, pos := range keys[key] {
+			binary.BigEndian.PutUint32(value[4*i:], pos)
+		}
+		w.Set([]byte(key), value, nil)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestIPv4Prefixes(t *testing.T) {
+	plainFile, prefixedFile := writeIPv4Index(t, 5000, false), writeIPv4Index(t, 5000, true)
+	defer os.Remove(plainFile)
+	defer os.Remove(prefixedFile)
+	plain, prefixed := testIndexFile(t, plainFile), testIndexFile(t, prefixedFile)
+	defer plain.Close()
+	defer prefixed.Close()
+	if plain.HasKeys(IPv4PrefixKeys) || !prefixed.HasKeys(IPv4PrefixKeys) {
+		t.Fatalf("prefix keys not written as expected")
+	}
+	for _, r := range [][2]string{
+		{"10.0.0.0", "10.255.255.255"},
+		{"10.1.0.0", "10.1.255.255"},
+		{"10.1.2.0", "10.1.2.255"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.0.0.77", "10.130.1.2"},
+		{"9.0.0.0", "9.255.255.255"},
+	} {
+		want, err := plain.IPPositions(ctx, parseIP(r[0]), parseIP(r[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := prefixed.IPPositions(ctx, parseIP(r[0]), parseIP(r[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("range %v got %d positions, want %d", r, len(got), len(want))
+		}
+	}
+}
+
+func benchmarkIPv4Range(b *testing.B, prefixes bool, from, to string) {
+	filename := writeIPv4Index(b, 200000, prefixes)
+	defer os.Remove(filename)
+	idx := testIndexFile(b, filename)
+	defer idx.Close()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := idx.IPPositions(ctx, parseIP(from), parseIP(to)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIPv4Slash16Scan(b *testing.B) {
+	benchmarkIPv4Range(b, false, "10.1.0.0", "10.1.255.255")
+}
+func BenchmarkIPv4Slash16Prefix(b *testing.B) {
+	benchmarkIPv4Range(b, true, "10.1.0.0", "10.1.255.255")
+}
+func BenchmarkIPv4Slash24Scan(b *testing.B) {
+	benchmarkIPv4Range(b, false, "10.1.2.0", "10.1.2.255")
+}
+func BenchmarkIPv4Slash24Prefix(b *testing.B) {
+	benchmarkIPv4Range(b, true, "10.1.2.0", "10.1.2.255")
+}
+
+// writeLengthIndex writes an index of packets with the given lengths, the
+// n'th at position 16*n, with a key for each length or, if bucketed, each
+// length bucket.
+func writeLengthIndex(t *testing.T, lengths []int, bucketed bool) string {
+	keys := map[string][]uint32{}
+	minor := byte(9)
+	for n, length := range lengths {
+		if length > 0xFFFF {
+			length = 0xFFFF
+		}
+		if bucketed {
+			length -= length % LengthBucketBytes
+			minor = lengthBucketsMinorVersion
+		}
+		key := string(lengthKey(length))
+		keys[key] = append(keys[key], uint32(16*n))
+	}
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	f, err := ioutil.TempFile("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := table.NewWriter(f, nil)
+	w.Set([]byte{0}, []byte{0, 0, 0, 2, 0, 0, 0, minor}, nil)
+	for _, key := range sorted {
+		value := make([]byte, 4*len(keys[key]))
+		for i, pos := range keys[key] {
+			binary.BigEndian.PutUint32(value[4*i:], pos)
+		}
+		w.Set([]byte(key), value, nil)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLengthPositions(t *testing.T) {
+	var lengths []int
+	for length := 0; length < 1600; length += 7 {
+		lengths = append(lengths, length)
+	}
+	lengths = append(lengths, 9000, 65472, 65535, 70000)
+	exactFile, bucketedFile := writeLengthIndex(t, lengths, false), writeLengthIndex(t, lengths, true)
+	defer os.Remove(exactFile)
+	defer os.Remove(bucketedFile)
+	exact, bucketed := testIndexFile(t, exactFile), testIndexFile(t, bucketedFile)
+	defer exact.Close()
+	defer bucketed.Close()
+	reads := 0
+	bucketed.SetPacketLengths(func(pos int64) (int, error) {
+		reads++
+		return lengths[pos/16], nil
+	})
+
+	for _, test := range []struct {
+		from, to uint16
+		reads    bool // Whether any packets' lengths need reading.
+	}{
+		{0, 63, false},
+		{64, 65535, false},
+		{1408, 65535, false},
+		{1401, 65535, true},
+		{0, 127, false},
+		{0, 128, true},
+		{60, 60, true},
+		{61, 62, true},
+		{100, 1000, true},
+		{65472, 65535, false},
+		{65535, 65535, true},
+		{1600, 8959, false},
+		{8999, 9000, true},
+	} {
+		var want base.Positions
+		for n, length := range lengths {
+			if length > 0xFFFF {
+				length = 0xFFFF
+			}
+			if length >= int(test.from) && length <= int(test.to) {
+				want = append(want, int64(16*n))
+			}
+		}
+		for _, i := range []*IndexFile{exact, bucketed} {
+			reads = 0
+			got, err := i.LengthPositions(ctx, test.from, test.to)
+			if err != nil {
+				t.Fatalf("%v..%v: %v", test.from, test.to, err)
+			}
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("%v..%v in %v got %v, want %v", test.from, test.to, i.Name(), got, want)
+			}
+		}
+		if (reads > 0) != test.reads {
+			t.Errorf("%v..%v read %d packets' lengths, want reads %v", test.from, test.to, reads, test.reads)
+		}
+	}
+
+	// Without a way to read packets' lengths, only bucket-aligned ranges can
+	// be looked up.
+	bucketed.SetPacketLengths(nil)
+	if _, err := bucketed.LengthPositions(ctx, 0, 127); err != nil {
+		t.Errorf("aligned lookup without packet lengths got %v", err)
+	}
+	if _, err := bucketed.LengthPositions(ctx, 1401, 65535); err != ErrNoPacketLengths {
+		t.Errorf("unaligned lookup without packet lengths got %v, want %v", err, ErrNoPacketLengths)
+	}
+}
+
+// writeLengthRollup writes a rollup of indexes of the given packet lengths,
+// bucketed or not, and returns it with its files' names.
+func writeLengthRollup(t *testing.T, lengths []int, bucketed ...bool) (string, []string) {
+	var indexes []*IndexFile
+	var names []string
+	for _, b := range bucketed {
+		name := writeLengthIndex(t, lengths, b)
+		defer os.Remove(name)
+		idx := testIndexFile(t, name)
+		defer idx.Close()
+		indexes = append(indexes, idx)
+		names = append(names, filepath.Base(name))
+	}
+	f, err := ioutil.TempFile("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := WriteRollup(f.Name(), indexes); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name(), names
+}
+
+func TestLengthPositionsRollup(t *testing.T) {
+	lengths := []int{40, 90, 1500, 1514}
+	name, files := writeLengthRollup(t, lengths, true, true)
+	defer os.Remove(name)
+	rollup := testIndexFile(t, name)
+	defer rollup.Close()
+	pos, err := rollup.LengthPositions(ctx, 1472, 1535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]base.Positions{files[0]: {32, 48}, files[1]: {32, 48}}
+	if got := rollup.SplitRollupPositions(pos); !reflect.DeepEqual(got, want) {
+		t.Errorf("aligned lookup got %v, want %v", got, want)
+	}
+	// Rollups can't read packets, so lookups needing their lengths fail, and
+	// fall back to the files' own indexes.
+	if _, err := rollup.LengthPositions(ctx, 1500, 1500); err != ErrNoPacketLengths {
+		t.Errorf("unaligned lookup got %v, want %v", err, ErrNoPacketLengths)
+	}
+
+	// Exact lengths from older indexes could be anywhere in a bucket, so
+	// they're always checked.
+	name, files = writeLengthRollup(t, lengths, false, true)
+	defer os.Remove(name)
+	mixed := testIndexFile(t, name)
+	defer mixed.Close()
+	if _, err := mixed.LengthPositions(ctx, 1472, 1535); err != ErrNoPacketLengths {
+		t.Errorf("aligned lookup in mixed rollup got %v, want %v", err, ErrNoPacketLengths)
+	}
+	if pos, err = mixed.LengthPositions(ctx, 0, 1471); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]base.Positions{files[0]: {0, 16}, files[1]: {0, 16}}
+	if got := mixed.SplitRollupPositions(pos); !reflect.DeepEqual(got, want) {
+		t.Errorf("lookup in mixed rollup got %v, want %v", got, want)
+	}
+}
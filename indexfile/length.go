@@ -0,0 +1,113 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// LengthBucketBytes is how many packet lengths share each LengthKeys key:  a
+// packet's key is its length rounded down to a multiple of this.  This must
+// match stenotype's kLengthBucketBytes.
+const LengthBucketBytes = 64
+
+// lengthBucketsMinorVersion is the first index minor version with bucketed
+// LengthKeys.  Older indexes have a key for each exact length.
+const lengthBucketsMinorVersion = 10
+
+// ErrNoPacketLengths is returned by LengthPositions when packets in a
+// length bucket only partly in the range looked up must be checked, and the
+// index can't read their lengths, like a rollup index.
+var ErrNoPacketLengths = errors.New("index can't read packet lengths")
+
+// SetPacketLengths sets the function LengthPositions uses to read the length
+// on the wire of the packet at a position in the index's blockfile.  It must
+// be called before any lookups.
+func (i *IndexFile) SetPacketLengths(f func(pos int64) (int, error)) {
+	i.packetLength = f
+}
+
+// lengthKey returns the LengthKeys key for length.
+func lengthKey(length int) []byte {
+	var key [3]byte
+	key[0] = byte(LengthKeys)
+	binary.BigEndian.PutUint16(key[1:], uint16(length))
+	return key[:]
+}
+
+// LengthPositions returns the positions in the block file of all packets
+// whose original length on the wire is between from and to, inclusive.
+// Packets in length buckets wholly in the range all match, while those in the
+// buckets at its ends are post-filtered by reading their lengths.
+func (i *IndexFile) LengthPositions(ctx context.Context, from, to uint16) (base.Positions, error) {
+	if i.minor < lengthBucketsMinorVersion && i.rollupOf == nil {
+		return i.positions(ctx, lengthKey(int(from)), lengthKey(int(to)))
+	}
+	// Rollups may merge bucketed and exact keys, so any key whose bucket
+	// might reach outside the range is checked.
+	lo, hi := int(from), int(to)
+	var out base.Positions
+	if hi-LengthBucketBytes+1 >= lo {
+		pos, err := i.positions(ctx, lengthKey(lo), lengthKey(hi-LengthBucketBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		out = pos
+	}
+	var check base.Positions
+	edges := [][2]int{{lo - lo%LengthBucketBytes, lo - 1}, {hi - LengthBucketBytes + 2, hi}}
+	if edges[1][0] < lo {
+		edges[1][0] = lo
+	}
+	for _, edge := range edges {
+		if edge[0] > edge[1] {
+			continue
+		}
+		pos, err := i.positions(ctx, lengthKey(edge[0]), lengthKey(edge[1]))
+		if err != nil {
+			return nil, err
+		}
+		check = check.Union(pos)
+	}
+	if len(check) == 0 {
+		return out, nil
+	}
+	if i.packetLength == nil {
+		return nil, ErrNoPacketLengths
+	}
+	v(4, "%q checking the lengths of %d packets for length %d-%d", i.name, len(check), from, to)
+	var matched base.Positions
+	for _, pos := range check {
+		if base.ContextDone(ctx) {
+			return nil, ctx.Err()
+		}
+		length, err := i.packetLength(pos)
+		if err != nil {
+			return nil, fmt.Errorf("reading length of packet at %d: %v", pos, err)
+		}
+		if length > 0xFFFF {
+			length = 0xFFFF
+		}
+		if length >= lo && length <= hi {
+			matched = append(matched, pos)
+		}
+	}
+	return out.Union(matched), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/golang/leveldb/table"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+// UseMmap makes index files be read through a memory mapping rather than
+// with a read syscall per block, leaving caching up to the OS page cache.
+// Files are still read normally if they can't be mapped.
+var UseMmap = false
+
+// MmapMaxBytes is the size of the largest index file which will be mapped.
+// Larger files are read normally, so a few huge indexes can't exhaust the
+// process's address space.
+var MmapMaxBytes int64 = 4 << 30
+
+var (
+	indexMmaps         = stats.S.Get("indexfile_mmapped_files")
+	indexMmapFallbacks = stats.S.Get("indexfile_mmap_fallbacks")
+)
+
+// mmapSupported is false on 32-bit platforms, where address space is too
+// scarce to map index files.
+const mmapSupported = ^uint(0)>>32 != 0
+
+// openTable opens the named index or shard file, and returns whether it's
+// encrypted.
+func openTable(filename string, fc *filecache.Cache) (*table.Reader, bool) {
+	if UseMmap {
+		f, err := openMmap(filename)
+		if err == nil {
+			indexMmaps.Increment()
+			d := &decryptingFile{tableFile: f}
+			return table.NewReader(d, nil), d.encrypted()
+		}
+		indexMmapFallbacks.Increment()
+		v(1, "not mapping index %q, reading it instead: %v", filename, err)
+	}
+	d := &decryptingFile{tableFile: fc.Open(filename)}
+	if BlockCacheBytes > 0 {
+		// Cache the plaintext, so cached blocks needn't be decrypted again.
+		return table.NewReader(newBlockCachedFile(filename, d), nil), d.encrypted()
+	}
+	return table.NewReader(d, nil), d.encrypted()
+}
+
+// mmapFile is a read-only file whose contents are memory mapped.  The file
+// descriptor is closed once the file is mapped, so mapped files don't count
+// against the file cache's limit.
+type mmapFile struct {
+	data []byte
+	info os.FileInfo
+	off  int64 // For Read.
+}
+
+func openMmap(filename string) (*mmapFile, error) {
+	if !mmapSupported {
+		return nil, errors.New("mmap disabled on 32-bit platforms")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	switch size := info.Size(); {
+	case size == 0:
+		return nil, errors.New("empty file")
+	case size > MmapMaxBytes:
+		return nil, fmt.Errorf("size %d exceeds limit %d", size, MmapMaxBytes)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %v", err)
+	}
+	// Lookups touch a few scattered blocks, so readahead mostly wastes I/O.
+	if err := syscall.Madvise(data, syscall.MADV_RANDOM); err != nil {
+		v(2, "madvise of index %q failed: %v", filename, err)
+	}
+	return &mmapFile{data: data, info: info}, nil
+}
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapFile) Read(p []byte) (int, error) {
+	n, err := m.ReadAt(p, m.off)
+	m.off += int64(n)
+	return n, err
+}
+
+func (m *mmapFile) Write(p []byte) (int, error) {
+	return 0, errors.New("mmapped index files are read-only")
+}
+
+func (m *mmapFile) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *mmapFile) Sync() error {
+	return nil
+}
+
+func (m *mmapFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
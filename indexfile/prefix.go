@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// ipv4PrefixLengths are the lengths, in bits, of the prefixes stenotype writes
+// IPv4PrefixKeys for.  This must match stenotype's Index::WriteIPv4Prefixes.
+var ipv4PrefixLengths = []uint{8, 16, 24}
+
+// ipv4Prefix is an aligned block of IPv4 addresses.
+type ipv4Prefix struct {
+	bits uint   // Prefix length.
+	ip   uint32 // First address in the block.
+}
+
+// key returns the index key holding the positions of all addresses in p:
+// [IPv4PrefixKeys][prefix length][the first bits/8 bytes of the prefix].
+func (p ipv4Prefix) key() []byte {
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], p.ip)
+	return append([]byte{byte(IPv4PrefixKeys), byte(p.bits)}, ip[:p.bits/8]...)
+}
+
+// splitIPv4Range splits the addresses from through to into the fewest
+// prefixes with IPv4PrefixKeys, plus ranges too small or unaligned to be
+// covered by a prefix.  Each leftover range is within a single /24.
+func splitIPv4Range(from, to uint32) (prefixes []ipv4Prefix, ranges [][2]uint32) {
+	for cur := uint64(from); cur <= uint64(to); {
+		found := false
+		for _, bits := range ipv4PrefixLengths {
+			size := uint64(1) << (32 - bits)
+			if cur%size == 0 && cur+size-1 <= uint64(to) {
+				prefixes = append(prefixes, ipv4Prefix{bits, uint32(cur)})
+				cur += size
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		end := cur | 0xFF
+		if end > uint64(to) {
+			end = uint64(to)
+		}
+		ranges = append(ranges, [2]uint32{uint32(cur), uint32(end)})
+		cur = end + 1
+	}
+	return prefixes, ranges
+}
+
+// prefixedIPv4Positions looks up an IPv4 range in an index with
+// IPv4PrefixKeys.  Each /8, /16, or /24 block in the range is a single key
+// lookup, so a wide range reads a handful of keys instead of scanning past a
+// key for every address seen in it.
+func (i *IndexFile) prefixedIPv4Positions(ctx context.Context, from, to net.IP) (out base.Positions, _ error) {
+	prefixes, ranges := splitIPv4Range(binary.BigEndian.Uint32(from), binary.BigEndian.Uint32(to))
+	v(4, "%q looking up %v-%v as %d prefixes and %d ranges", i.name, from, to, len(prefixes), len(ranges))
+	add := func(pos base.Positions) {
+		if out == nil {
+			out = pos
+		} else if pos != nil {
+			out = out.Union(pos)
+		}
+	}
+	for _, p := range prefixes {
+		key := p.key()[1:]
+		pos, err := i.KeyPositions(ctx, IPv4PrefixKeys, key, key)
+		if err != nil {
+			return nil, err
+		}
+		add(pos)
+	}
+	for _, r := range ranges {
+		var fromIP, toIP [4]byte
+		binary.BigEndian.PutUint32(fromIP[:], r[0])
+		binary.BigEndian.PutUint32(toIP[:], r[1])
+		fromKey, toKey, err := ipKeys(net.IP(fromIP[:]), net.IP(toIP[:]), IPv4Keys, IPv6Keys)
+		if err != nil {
+			return nil, err
+		}
+		pos, err := i.ipRangePositions(ctx, fromIP[:], toIP[:], fromKey, toKey)
+		if err != nil {
+			return nil, err
+		}
+		add(pos)
+	}
+	return out, nil
+}
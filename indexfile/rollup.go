@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/leveldb/table"
+	"github.com/google/stenographer/base"
+)
+
+// A rollup index merges the indexes of many blockfiles into one, so a query
+// over a long time range opens and searches one file instead of hundreds.
+// It's an ordinary index file, except that:
+//   * it has a rollupFilesKey, holding the names of the blockfiles it covers
+//   * its values are 8 byte positions, the top 4 bytes of which are the
+//     covered file's number in rollupFilesKey, and the bottom 4 the position
+//     in that file
+//   * it never has IP shards.
+
+// rollupFilesKey is the index key holding the NUL separated names of the
+// blockfiles a rollup index covers.
+var rollupFilesKey = []byte{0, 2}
+
+// RollupOf returns the names of the blockfiles this index covers if it's a
+// rollup, or nil if it's an ordinary index of a single blockfile.
+func (i *IndexFile) RollupOf() []string {
+	return i.rollupOf
+}
+
+// positionBytes returns the length of each position stored in this index.
+func (i *IndexFile) positionBytes() int {
+	if i.rollupOf != nil {
+		return 8
+	}
+	return 4
+}
+
+// decodePositions decodes an index value into the positions it holds.
+func (i *IndexFile) decodePositions(value []byte) base.Positions {
+	n := i.positionBytes()
+	out := make(base.Positions, len(value)/n)
+	for j := range out {
+		if n == 8 {
+			out[j] = int64(binary.BigEndian.Uint64(value[j*8:]))
+		} else {
+			out[j] = int64(binary.BigEndian.Uint32(value[j*4:]))
+		}
+	}
+	return out
+}
+
+// SplitRollupPositions splits positions looked up in a rollup index into the
+// positions in each of the blockfiles it covers, keyed by name.  Files with
+// no matching packets are left out.
+func (i *IndexFile) SplitRollupPositions(pos base.Positions) map[string]base.Positions {
+	out := map[string]base.Positions{}
+	if pos.IsAllPositions() {
+		for _, name := range i.rollupOf {
+			out[name] = base.AllPositions
+		}
+		return out
+	}
+	for _, p := range pos {
+		if file := int(p >> 32); file < len(i.rollupOf) {
+			name := i.rollupOf[file]
+			out[name] = append(out[name], p&0xFFFFFFFF)
+		}
+	}
+	return out
+}
+
+// WriteRollup merges the given blockfile indexes into a single rollup index,
+// written to filename.  Indexes must be ordinary (not rollup) indexes, and
+// should be passed in the order of their blockfiles, so that merged
+// positions stay sorted.
+func WriteRollup(filename string, indexes []*IndexFile) error {
+	var names []string
+	minor := uint32(0)
+	h := &rollupHeap{}
+	defer func() {
+		for _, it := range *h {
+			it.iter.Close()
+		}
+	}()
+	for n, index := range indexes {
+		if index.rollupOf != nil {
+			return fmt.Errorf("index %q is already a rollup", index.name)
+		}
+		name := filepath.Base(index.name)
+		if strings.Contains(name, "\x00") {
+			return fmt.Errorf("invalid index name %q", index.name)
+		}
+		names = append(names, name)
+		if n == 0 || index.minor < minor {
+			minor = index.minor
+		}
+		for _, ss := range append([]*table.Reader{index.ss}, index.shards...) {
+			it := &rollupIter{iter: ss.Find([]byte{}, nil), file: uint64(n)}
+			if err := it.next(); err != nil {
+				return corruption(index.name, fmt.Errorf("reading index %q: %v", index.name, err), err)
+			} else if it.key != nil {
+				heap.Push(h, it)
+			}
+		}
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := table.NewWriter(f, nil)
+	var version [8]byte
+	binary.BigEndian.PutUint32(version[:4], majorVersionNumber)
+	binary.BigEndian.PutUint32(version[4:], minor)
+	if err := w.Set([]byte{0}, version[:], nil); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Set(rollupFilesKey, []byte(strings.Join(names, "\x00")), nil); err != nil {
+		w.Close()
+		return err
+	}
+	var key, value []byte
+	for h.Len() > 0 {
+		it := (*h)[0]
+		if key != nil && !bytes.Equal(key, it.key) {
+			if err := w.Set(key, value, nil); err != nil {
+				w.Close()
+				return err
+			}
+			value = value[:0]
+		}
+		key = append(key[:0], it.key...)
+		var buf [8]byte
+		for j := 0; j+4 <= len(it.value); j += 4 {
+			binary.BigEndian.PutUint64(buf[:], it.file<<32|uint64(binary.BigEndian.Uint32(it.value[j:])))
+			value = append(value, buf[:]...)
+		}
+		if err := it.next(); err != nil {
+			heap.Pop(h) // Already closed.
+			w.Close()
+			name := indexes[it.file].name
+			return corruption(name, fmt.Errorf("reading index %q: %v", name, err), err)
+		} else if it.key == nil {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	if key != nil {
+		if err := w.Set(key, value, nil); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// iterator is the subset of the leveldb table iterator used here.
+type iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Close() error
+}
+
+// rollupIter reads the data keys of one of the tables being merged by
+// WriteRollup.
+type rollupIter struct {
+	iter       iterator
+	file       uint64 // Number of the index this table belongs to.
+	key, value []byte // Copied, since the iterator may reuse its buffers.
+}
+
+// next moves on to the next data key, setting key to nil once there are no
+// more.
+func (r *rollupIter) next() error {
+	for r.iter.Next() {
+		if key := r.iter.Key(); len(key) > 0 && key[0] != 0 { // Skip metadata.
+			r.key = append(r.key[:0], key...)
+			r.value = append(r.value[:0], r.iter.Value()...)
+			return nil
+		}
+	}
+	r.key = nil
+	return r.iter.Close()
+}
+
+// rollupHeap orders the tables being merged by their current key, then by
+// index, so each key's positions are written out sorted.
+type rollupHeap []*rollupIter
+
+func (h rollupHeap) Len() int      { return len(h) }
+func (h rollupHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h rollupHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].key, h[j].key); c != 0 {
+		return c < 0
+	}
+	return h[i].file < h[j].file
+}
+func (h *rollupHeap) Push(x interface{}) { *h = append(*h, x.(*rollupIter)) }
+func (h *rollupHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/leveldb/table"
+)
+
+// Stats summarizes what's in an index file.
+type Stats struct {
+	Name         string
+	MinorVersion uint32
+	Bytes        int64 // Of the index and all its IP shards.
+	Shards       int
+	// RollupOf lists the blockfiles covered by a rollup index.
+	RollupOf []string `json:",omitempty"`
+	// Keys counts the keys of each type, by KeyType.String.  Types with no
+	// keys are left out.
+	Keys map[string]int
+	// Positions counts the packet positions stored under each type of key.
+	Positions map[string]int64
+	// MinKey and MaxKey are the hex encoded smallest and largest keys,
+	// ignoring the file's metadata keys.
+	MinKey, MaxKey string
+	// Start and End are the times of the first and last packets indexed.
+	// Indexes which don't record packet times use when stenotype created the
+	// file, and when it wrote the index, instead.
+	Start, End time.Time
+}
+
+// Stats reads through the entire index to summarize it.
+func (i *IndexFile) Stats() (*Stats, error) {
+	s := &Stats{
+		Name:         i.name,
+		MinorVersion: i.minor,
+		Shards:       len(i.shards),
+		RollupOf:     i.rollupOf,
+		Keys:         map[string]int{},
+		Positions:    map[string]int64{},
+	}
+	for _, name := range append([]string{i.name}, ShardPaths(i.name)...) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		s.Bytes += fi.Size()
+		if name == i.name {
+			s.End = fi.ModTime()
+		}
+	}
+	if micros, err := strconv.ParseInt(filepath.Base(i.name), 10, 64); err == nil {
+		s.Start = time.Unix(0, micros*1000)
+	}
+	if i.times != nil {
+		s.Start, s.End = i.times.First, i.times.Last
+	}
+	var min, max []byte
+	for _, ss := range append([]*table.Reader{i.ss}, i.shards...) {
+		iter := ss.Find([]byte{}, nil)
+		for iter.Next() {
+			key := iter.Key()
+			if len(key) == 0 || key[0] == 0 { // Metadata, like the version.
+				continue
+			}
+			t := KeyType(key[0]).String()
+			s.Keys[t]++
+			s.Positions[t] += int64(len(iter.Value()) / i.positionBytes())
+			if min == nil || bytes.Compare(key, min) < 0 {
+				min = append([]byte(nil), key...)
+			}
+			if max == nil || bytes.Compare(key, max) > 0 {
+				max = append([]byte(nil), key...)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, fmt.Errorf("reading index %q: %v", i.name, err)
+		}
+	}
+	s.MinKey, s.MaxKey = hex.EncodeToString(min), hex.EncodeToString(max)
+	return s, nil
+}
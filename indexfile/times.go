@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// timesKey is the index key holding a file's TimeHistogram.  Its value is the
+// first and last packet times, as 8 byte microseconds since the epoch,
+// followed by a 4 byte packet count for each minute from the first packet's
+// through the last packet's.  This must match stenotype's kIndexTimesKey.
+var timesKey = []byte{0, 3}
+
+// MaxHistogramMinutes is the longest span of packet times that per-minute
+// counts are kept for.  A file whose packets span longer (normally because of
+// a bogus timestamp or two) only records its first and last packet times.
+// This must match stenotype's kMaxTimeHistogramMinutes.
+const MaxHistogramMinutes = 24 * 60
+
+// TimeHistogram records when the packets in a blockfile were captured.
+type TimeHistogram struct {
+	First, Last time.Time
+	// Minutes counts the packets captured in each minute, starting with the
+	// one First is in.  It's empty if packets span more than
+	// MaxHistogramMinutes.
+	Minutes []uint32
+	// overflow is set once packets have spanned too long to count.
+	overflow bool
+}
+
+// minute returns the number of whole minutes since the epoch, rounding down.
+func minute(t time.Time) int64 {
+	micros := t.UnixNano() / 1000
+	m := micros / 60e6
+	if micros < 0 && micros%60e6 != 0 {
+		m--
+	}
+	return m
+}
+
+// Add records a packet captured at t.  Packets may be added in any order.
+func (h *TimeHistogram) Add(t time.Time) {
+	if h.First.IsZero() && h.Last.IsZero() {
+		h.First, h.Last = t, t
+		h.Minutes = []uint32{1}
+		return
+	}
+	first, last := h.First, h.Last
+	if t.Before(first) {
+		first = t
+	}
+	if t.After(last) {
+		last = t
+	}
+	if h.overflow || minute(last)-minute(first) >= MaxHistogramMinutes {
+		h.First, h.Last, h.overflow, h.Minutes = first, last, true, nil
+		return
+	}
+	if n := minute(h.First) - minute(first); n > 0 {
+		h.Minutes = append(make([]uint32, n), h.Minutes...)
+	}
+	h.First, h.Last = first, last
+	m := int(minute(t) - minute(h.First))
+	for len(h.Minutes) <= m {
+		h.Minutes = append(h.Minutes, 0)
+	}
+	h.Minutes[m]++
+}
+
+// Overlaps returns whether any packets were captured between start and stop.
+// A zero start or stop leaves that end of the range open.
+func (h *TimeHistogram) Overlaps(start, stop time.Time) bool {
+	if (!start.IsZero() && h.Last.Before(start)) || (!stop.IsZero() && h.First.After(stop)) {
+		return false
+	}
+	if len(h.Minutes) == 0 {
+		return true
+	}
+	first := minute(h.First)
+	for m, count := range h.Minutes {
+		if count == 0 {
+			continue
+		}
+		from := time.Unix((first+int64(m))*60, 0)
+		if (start.IsZero() || from.Add(time.Minute).After(start)) && (stop.IsZero() || !from.After(stop)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes encodes the histogram as it's stored in an index.
+func (h *TimeHistogram) Bytes() []byte {
+	out := make([]byte, 16+4*len(h.Minutes))
+	binary.BigEndian.PutUint64(out, uint64(h.First.UnixNano()/1000))
+	binary.BigEndian.PutUint64(out[8:], uint64(h.Last.UnixNano()/1000))
+	for m, count := range h.Minutes {
+		binary.BigEndian.PutUint32(out[16+4*m:], count)
+	}
+	return out
+}
+
+// parseTimeHistogram decodes a histogram encoded by Bytes.
+func parseTimeHistogram(b []byte) (*TimeHistogram, error) {
+	if len(b) < 16 || len(b)%4 != 0 {
+		return nil, fmt.Errorf("invalid %d byte packet times record", len(b))
+	}
+	micros := func(b []byte) time.Time {
+		return time.Unix(0, int64(binary.BigEndian.Uint64(b))*1000)
+	}
+	h := &TimeHistogram{First: micros(b), Last: micros(b[8:])}
+	if h.Last.Before(h.First) {
+		return nil, fmt.Errorf("packet times record ends before it starts")
+	}
+	for i := 16; i < len(b); i += 4 {
+		h.Minutes = append(h.Minutes, binary.BigEndian.Uint32(b[i:]))
+	}
+	if len(h.Minutes) > 0 && int64(len(h.Minutes)) != minute(h.Last)-minute(h.First)+1 {
+		return nil, fmt.Errorf("packet times record has %d minutes, want %d", len(h.Minutes), minute(h.Last)-minute(h.First)+1)
+	}
+	return h, nil
+}
+
+// Times returns when the packets in this index's blockfile were captured, or
+// nil if the index was written without recording them.
+func (i *IndexFile) Times() *TimeHistogram {
+	return i.times
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/leveldb/table"
+	"golang.org/x/net/context"
+)
+
+// CorruptError is returned for index files whose contents are damaged, as
+// opposed to ones which couldn't be read at all.
+type CorruptError struct {
+	File string
+	Err  error
+}
+
+func (e *CorruptError) Error() string {
+	return e.Err.Error()
+}
+
+// IsCorrupt returns true if err is a CorruptError.
+func IsCorrupt(err error) bool {
+	_, ok := err.(*CorruptError)
+	return ok
+}
+
+// corruption returns err as a CorruptError of the given file if its cause
+// was the leveldb library finding the file's contents invalid.  Failures to
+// read the file at all may well be temporary (for example, running out of
+// file descriptors), so they're returned as is.
+func corruption(filename string, err, cause error) error {
+	if strings.HasPrefix(cause.Error(), "leveldb") {
+		return &CorruptError{filename, err}
+	}
+	return err
+}
+
+// Verify reads through the entire index, checking the checksum of every
+// block, and that every key's positions are sorted and within the first
+// maxPos bytes of the blockfile.  If maxPos is <= 0, positions are only
+// checked for order.  Rollup indexes cover many blockfiles, so maxPos is
+// ignored for them, and positions are only checked to refer to files the
+// rollup covers.
+func (i *IndexFile) Verify(ctx context.Context, maxPos int64) error {
+	if err := i.verifyTable(ctx, i.name, i.ss, maxPos); err != nil {
+		return err
+	}
+	for n, shard := range i.shards {
+		if err := i.verifyTable(ctx, shardPath(i.name, n), shard, maxPos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *IndexFile) verifyTable(ctx context.Context, filename string, ss *table.Reader, maxPos int64) error {
+	limit := maxPos
+	if i.rollupOf != nil {
+		limit = int64(len(i.rollupOf)) << 32
+	}
+	var last []byte
+	iter := ss.Find([]byte{}, nil)
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		key, value := iter.Key(), iter.Value()
+		if last != nil && bytes.Compare(key, last) <= 0 {
+			iter.Close()
+			return &CorruptError{filename, fmt.Errorf("index %q key %x out of order after %x", filename, key, last)}
+		}
+		last = append(last[:0], key...)
+		if len(key) == 0 || key[0] == 0 { // Metadata, like the version.
+			continue
+		}
+		n := i.positionBytes()
+		if len(value) == 0 || len(value)%n != 0 {
+			iter.Close()
+			return &CorruptError{filename, fmt.Errorf("index %q key %x has %d byte value", filename, key, len(value))}
+		}
+		prev := int64(-1)
+		for _, pos := range i.decodePositions(value) {
+			if pos <= prev || (limit > 0 && pos >= limit) {
+				iter.Close()
+				return &CorruptError{filename, fmt.Errorf("index %q key %x has bad position %d", filename, key, pos)}
+			}
+			prev = pos
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return corruption(filename, fmt.Errorf("reading index %q: %v", filename, err), err)
+	}
+	return nil
+}
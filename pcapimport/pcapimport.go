@@ -0,0 +1,237 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcapimport imports pcap and pcapng files captured by other tools
+// into a thread's directories, as blockfiles and indexes like stenotype's, so
+// their packets can be queried like any stenographer captured.
+package pcapimport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/reindex"
+	"../reindex"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	v               = base.V // verbose logging
+	packetsImported = stats.S.Get("packets_imported")
+	filesImported   = stats.S.Get("files_imported")
+)
+
+const (
+	// fileDuration is the longest span of packets put in one file.  Like
+	// stenotype's files, which it rotates every minute, each is named for
+	// the time of its first packet, and queries for a time range only look
+	// in files named for times near it.
+	fileDuration = time.Minute
+	// maxFileBytes is the largest file written, stenotype's largest
+	// --filesize_mb less a block, since indexes hold 32 bit positions.
+	maxFileBytes = 4<<30 - 1<<20
+)
+
+// pcapngMagic starts every pcapng file, as its section header block's type.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// Result describes an import.
+type Result struct {
+	Packets int
+	// Truncated counts packets too large for a block, whose data was cut
+	// short.
+	Truncated int
+	Files     []string // Names of the blockfiles written.
+}
+
+// packetReader reads packets from a pcap or pcapng file.
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// newReader returns a packetReader for the pcap or pcapng file in r, and a
+// function returning the link type of each packet it reads.
+func newReader(r io.Reader) (packetReader, func(gopacket.CaptureInfo) layers.LinkType, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read file header: %v", err)
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pcapng file: %v", err)
+		}
+		return ng, func(ci gopacket.CaptureInfo) layers.LinkType {
+			iface, err := ng.Interface(ci.InterfaceIndex)
+			if err != nil {
+				return layers.LinkTypeNull
+			}
+			return iface.LinkType
+		}, nil
+	}
+	pr, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pcap file: %v", err)
+	}
+	return pr, func(gopacket.CaptureInfo) layers.LinkType { return pr.LinkType() }, nil
+}
+
+// Import reads the pcap or pcapng file in r, writing its packets to new
+// blockfiles in packetDir and their indexes to indexDir.  Only ethernet
+// packets can be imported, as stenotype only captures ethernet.  Each file is
+// written hidden, and its index last, so a running stenographer picks up only
+// complete files.  Files are named for the time of
+// their first packet, so retention deletes imported files by the age of their
+// packets, not when they were imported.
+func Import(ctx context.Context, r io.Reader, packetDir, indexDir string) (*Result, error) {
+	pr, linkType, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	var f *file
+	defer func() {
+		if f != nil {
+			f.abort()
+		}
+	}()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, ci, err := pr.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading packet %d: %v", res.Packets+1, err)
+		}
+		if lt := linkType(ci); lt != layers.LinkTypeEthernet {
+			return nil, fmt.Errorf("packet %d has link type %v, only ethernet can be imported", res.Packets+1, lt)
+		}
+		if f != nil && !f.fits(ci.Timestamp) {
+			if err := f.finish(ctx); err != nil {
+				return nil, err
+			}
+			res.Files = append(res.Files, f.name)
+			f = nil
+		}
+		if f == nil {
+			if f, err = newFile(packetDir, indexDir, ci.Timestamp); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) > blockfile.MaxPacketBytes {
+			res.Truncated++
+		}
+		if err := f.w.WritePacket(ci, data); err != nil {
+			return nil, fmt.Errorf("writing %q: %v", f.hidden, err)
+		}
+		res.Packets++
+		packetsImported.Increment()
+	}
+	if f != nil {
+		if err := f.finish(ctx); err != nil {
+			return nil, err
+		}
+		res.Files = append(res.Files, f.name)
+		f = nil
+	}
+	v(1, "imported %d packets into %d files in %q", res.Packets, len(res.Files), packetDir)
+	return res, nil
+}
+
+// file is a blockfile being imported.
+type file struct {
+	name                string
+	hidden              string // Where it's written until it's indexed.
+	packetDir, indexDir string
+	start               time.Time // Of its first packet.
+	w                   *blockfile.Writer
+}
+
+// newFile starts a blockfile for packets from start on, named for the
+// microsecond of start, or the first after it no file already has.
+func newFile(packetDir, indexDir string, start time.Time) (*file, error) {
+	for micros := start.UnixNano() / 1000; ; micros++ {
+		name := strconv.FormatInt(micros, 10)
+		if _, err := os.Lstat(filepath.Join(packetDir, name)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		f := &file{
+			name:      name,
+			hidden:    filepath.Join(packetDir, "."+name),
+			packetDir: packetDir,
+			indexDir:  indexDir,
+			start:     start,
+		}
+		w, err := blockfile.NewWriter(f.hidden)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f.w = w
+		return f, nil
+	}
+}
+
+// fits returns whether a packet captured at t can go in f, rather than
+// starting a new file.
+func (f *file) fits(t time.Time) bool {
+	return !t.Before(f.start) && t.Sub(f.start) < fileDuration && f.w.Size() < maxFileBytes
+}
+
+// finish closes f, moves it into place, and indexes it.
+func (f *file) finish(ctx context.Context) error {
+	if err := f.w.Close(); err != nil {
+		os.Remove(f.hidden)
+		return fmt.Errorf("writing %q: %v", f.hidden, err)
+	}
+	packetPath := filepath.Join(f.packetDir, f.name)
+	if err := os.Rename(f.hidden, packetPath); err != nil {
+		os.Remove(f.hidden)
+		return err
+	}
+	// stenographer finds blockfiles by their indexes, so ignores this one
+	// until its index is renamed into place.
+	if _, err := reindex.Rebuild(ctx, packetPath, filepath.Join(f.indexDir, f.name)); err != nil {
+		os.Remove(packetPath)
+		return err
+	}
+	filesImported.Increment()
+	return nil
+}
+
+// abort removes f, which won't be finished.
+func (f *file) abort() {
+	f.w.Close()
+	os.Remove(f.hidden)
+}
@@ -0,0 +1,172 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapimport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	"golang.org/x/net/context"
+)
+
+// testPackets returns the packets in a test blockfile, with the last moved
+// two minutes later, so it's imported into a separate file.
+func testPackets(t *testing.T) []*base.Packet {
+	var out []*base.Packet
+	if err := blockfile.ScanPackets("../testdata/PKT0/vlan", func(pos int64, p *base.Packet) error {
+		out = append(out, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) < 2 {
+		t.Fatalf("got %d test packets", len(out))
+	}
+	last := out[len(out)-1]
+	last.CaptureInfo.Timestamp = last.CaptureInfo.Timestamp.Add(2 * time.Minute)
+	return out
+}
+
+func writePcap(t *testing.T, packets []*base.Packet, linkType layers.LinkType) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	if err := w.WriteFileHeader(65536, linkType); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writePcapng(t *testing.T, packets []*base.Packet) []byte {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImport(t *testing.T) {
+	packets := testPackets(t)
+	for _, test := range []struct {
+		format string
+		data   []byte
+	}{
+		{"pcap", writePcap(t, packets, layers.LinkTypeEthernet)},
+		{"pcapng", writePcapng(t, packets)},
+	} {
+		dir, err := ioutil.TempDir("", "pcapimport_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		pkts, idx := filepath.Join(dir, "PKT"), filepath.Join(dir, "IDX")
+		for _, d := range []string{pkts, idx} {
+			if err := os.Mkdir(d, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := Import(context.Background(), bytes.NewReader(test.data), pkts, idx)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if res.Packets != len(packets) || len(res.Files) != 2 {
+			t.Fatalf("%s: imported %d packets into %v, want %d packets in 2 files", test.format, res.Packets, res.Files, len(packets))
+		}
+		if want := strconv.FormatInt(packets[0].CaptureInfo.Timestamp.UnixNano()/1000, 10); res.Files[0] != want {
+			t.Errorf("%s: first file named %q, want %q", test.format, res.Files[0], want)
+		}
+		var got []*base.Packet
+		for _, name := range res.Files {
+			if _, err := os.Stat(filepath.Join(idx, name)); err != nil {
+				t.Errorf("%s: no index for %q: %v", test.format, name, err)
+			}
+			if err := blockfile.ScanPackets(filepath.Join(pkts, name), func(pos int64, p *base.Packet) error {
+				got = append(got, p)
+				return nil
+			}); err != nil {
+				t.Fatalf("%s: %v", test.format, err)
+			}
+		}
+		if len(got) != len(packets) {
+			t.Fatalf("%s: read back %d packets, want %d", test.format, len(got), len(packets))
+		}
+		for i, p := range got {
+			want := packets[i]
+			if !bytes.Equal(p.Data, want.Data) || !p.CaptureInfo.Timestamp.Equal(want.CaptureInfo.Timestamp) || p.CaptureInfo.Length != want.CaptureInfo.Length {
+				t.Errorf("%s: packet %d read back as %v, want %v", test.format, i, p.CaptureInfo, want.CaptureInfo)
+			}
+		}
+		hidden, _ := filepath.Glob(filepath.Join(pkts, ".*"))
+		if len(hidden) != 0 {
+			t.Errorf("%s: left behind %v", test.format, hidden)
+		}
+	}
+}
+
+func TestImportRejectsNonEthernet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapimport_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := writePcap(t, testPackets(t), layers.LinkTypeRaw)
+	if _, err := Import(context.Background(), bytes.NewReader(data), dir, dir); err == nil {
+		t.Errorf("imported raw IP packets")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("left behind %d files", len(files))
+	}
+}
+
+func TestFileFits(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := &file{start: start, w: &blockfile.Writer{}}
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{start, true},
+		{start.Add(59 * time.Second), true},
+		{start.Add(time.Minute), false},
+		{start.Add(-time.Nanosecond), false},
+	} {
+		if got := f.fits(test.t); got != test.want {
+			t.Errorf("fits(%v) = %v, want %v", test.t, got, test.want)
+		}
+	}
+}
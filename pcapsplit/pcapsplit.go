@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcapsplit splits a pcap into files of at most a given size, or
+// spanning at most a given time, like tcpdump's -C and -G.  Unlike tcpdump,
+// it rotates files by when their packets were captured, not when they're
+// written, since packets fetched from stenographer were captured long before.
+package pcapsplit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+)
+
+var v = base.V // verbose logging
+
+const (
+	// pcapFileHeaderBytes and pcapPacketHeaderBytes are the sizes of a pcap's
+	// header and of each packet's.
+	pcapFileHeaderBytes   = 24
+	pcapPacketHeaderBytes = 16
+)
+
+// pcapngMagic starts every pcapng file, as its section header block's type.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// nanosMagic starts pcap files with nanosecond timestamps, in either byte
+// order.  It's checked here since pcapgo.Reader.Resolution gets it backwards.
+var nanosMagic = [][]byte{{0x4d, 0x3c, 0xb2, 0xa1}, {0xa1, 0xb2, 0x3c, 0x4d}}
+
+// Options say when to start a new file.
+type Options struct {
+	// MaxBytes, if positive, starts a new file rather than letting one grow
+	// larger, unless it would have no packets.
+	MaxBytes int64
+	// Interval, if positive, starts a new file for each Interval of capture
+	// time, aligned as by time.Truncate, so an Interval of an hour gives a
+	// file per hour of packets.
+	Interval time.Duration
+}
+
+// file is a file being written.
+type file struct {
+	f       *os.File
+	buf     *bufio.Writer
+	w       *pcapgo.Writer
+	bytes   int64
+	packets int
+	period  time.Time // The start of the Interval its packets are in.
+}
+
+// close flushes and closes the file.
+func (f *file) close() error {
+	err := f.buf.Flush()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Split reads the pcap in r, writing its packets to files named by pattern,
+// and returns their names.  As with tcpdump -G, pattern may hold strftime
+// conversions (%Y, %m, %d, %H, %M and %S, in local time, %s for Unix seconds,
+// and %%), which are filled in with the start of the file's Interval, or
+// without one, the capture time of its first packet.  As with tcpdump -C,
+// names that repeat get a number appended, counting from 1.
+func Split(r io.Reader, pattern string, opts Options) ([]string, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(pcapngMagic))
+	if bytes.Equal(magic, pcapngMagic) {
+		return nil, fmt.Errorf("can only split pcap files, not pcapng")
+	}
+	nanos := bytes.Equal(magic, nanosMagic[0]) || bytes.Equal(magic, nanosMagic[1])
+	pr, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pcap file: %v", err)
+	}
+	var names []string
+	used := map[string]int{}
+	var f *file
+	create := func(ci gopacket.CaptureInfo) error {
+		if f != nil {
+			if err := f.close(); err != nil {
+				return err
+			}
+			v(1, "wrote %d packets to %q", f.packets, names[len(names)-1])
+		}
+		f = &file{period: ci.Timestamp}
+		if opts.Interval > 0 {
+			f.period = ci.Timestamp.Truncate(opts.Interval)
+		}
+		name := expand(pattern, f.period)
+		if n := used[name]; n > 0 {
+			used[name]++
+			name += strconv.Itoa(n)
+		} else {
+			used[name] = 1
+		}
+		out, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		f.f, f.buf = out, bufio.NewWriter(out)
+		if nanos {
+			f.w = pcapgo.NewWriterNanos(f.buf)
+		} else {
+			f.w = pcapgo.NewWriter(f.buf)
+		}
+		names = append(names, name)
+		f.bytes = pcapFileHeaderBytes
+		return f.w.WriteFileHeader(pr.Snaplen(), pr.LinkType())
+	}
+	defer func() {
+		if f != nil {
+			f.close()
+		}
+	}()
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return names, fmt.Errorf("error reading packet: %v", err)
+		}
+		size := int64(pcapPacketHeaderBytes + len(data))
+		switch {
+		case f == nil,
+			opts.Interval > 0 && !ci.Timestamp.Truncate(opts.Interval).Equal(f.period),
+			opts.MaxBytes > 0 && f.packets > 0 && f.bytes+size > opts.MaxBytes:
+			if err := create(ci); err != nil {
+				return names, err
+			}
+		}
+		if err := f.w.WritePacket(ci, data); err != nil {
+			return names, fmt.Errorf("error writing packet: %v", err)
+		}
+		f.bytes += size
+		f.packets++
+	}
+	if f == nil {
+		return names, nil
+	}
+	err = f.close()
+	f = nil
+	return names, err
+}
+
+// expand fills in pattern's strftime conversions with t.
+func expand(pattern string, t time.Time) string {
+	var out strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			out.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&out, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&out, "%02d", t.Month())
+		case 'd':
+			fmt.Fprintf(&out, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&out, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&out, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&out, "%02d", t.Second())
+		case 's':
+			fmt.Fprintf(&out, "%d", t.Unix())
+		case '%':
+			out.WriteByte('%')
+		default:
+			out.WriteByte('%')
+			out.WriteByte(pattern[i])
+		}
+	}
+	return out.String()
+}
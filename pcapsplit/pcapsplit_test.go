@@ -0,0 +1,143 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapsplit
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapOf returns a nanosecond pcap of 100 byte packets captured at each of
+// secs.
+func pcapOf(t *testing.T, secs ...int64) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range secs {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(s, 1), CaptureLength: 100, Length: 100}
+		if err := w.WritePacket(ci, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// captureTimes returns the capture seconds of the packets in each of files.
+func captureTimes(t *testing.T, files []string) [][]int64 {
+	var out [][]int64
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		r, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var secs []int64
+		for {
+			_, ci, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if ci.Timestamp.Nanosecond() != 1 {
+				t.Errorf("%s: lost nanosecond timestamps", name)
+			}
+			secs = append(secs, ci.Timestamp.Unix())
+		}
+		out = append(out, secs)
+	}
+	return out
+}
+
+func TestSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapsplit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name    string
+		pattern string
+		opts    Options
+		files   []string
+		times   [][]int64
+	}{
+		{"unsplit", "all.pcap", Options{}, []string{"all.pcap"}, [][]int64{{1000, 1010, 1070, 1200}}},
+		{"size", "size.pcap", Options{MaxBytes: 24 + 2*116}, []string{"size.pcap", "size.pcap1"}, [][]int64{{1000, 1010}, {1070, 1200}}},
+		// A packet larger than MaxBytes still gets a file of its own.
+		{"tiny", "tiny.pcap", Options{MaxBytes: 1}, []string{"tiny.pcap", "tiny.pcap1", "tiny.pcap2", "tiny.pcap3"}, [][]int64{{1000}, {1010}, {1070}, {1200}}},
+		{"interval", "%s.pcap", Options{Interval: time.Minute}, []string{"960.pcap", "1020.pcap", "1200.pcap"}, [][]int64{{1000, 1010}, {1070}, {1200}}},
+		{"both", "b%s.pcap", Options{Interval: 2 * time.Minute, MaxBytes: 24 + 116}, []string{"b960.pcap", "b960.pcap1", "b960.pcap2", "b1200.pcap"}, [][]int64{{1000}, {1010}, {1070}, {1200}}},
+		{"first packet", "p%s.pcap", Options{MaxBytes: 24 + 2*116}, []string{"p1000.pcap", "p1070.pcap"}, [][]int64{{1000, 1010}, {1070, 1200}}},
+	} {
+		names, err := Split(bytes.NewReader(pcapOf(t, 1000, 1010, 1070, 1200)), filepath.Join(dir, test.pattern), test.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var want []string
+		for _, f := range test.files {
+			want = append(want, filepath.Join(dir, f))
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: wrote %v, want %v", test.name, names, want)
+			continue
+		}
+		if got := captureTimes(t, names); !reflect.DeepEqual(got, test.times) {
+			t.Errorf("%s: got packets at %v, want %v", test.name, got, test.times)
+		}
+	}
+}
+
+func TestSplitRejectsPcapng(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if names, err := Split(&buf, "unused", Options{}); err == nil {
+		t.Errorf("split pcapng into %v", names)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	for pattern, want := range map[string]string{
+		"out.pcap":           "out.pcap",
+		"%Y%m%d-%H%M%S.pcap": "20180102-030405.pcap",
+		"%s.pcap":            "1514862245.pcap",
+		"100%%-%q%":          "100%-%q%",
+	} {
+		if got := expand(pattern, ts); got != want {
+			t.Errorf("expand(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
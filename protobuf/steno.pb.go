@@ -0,0 +1,902 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: steno.proto
+
+package protobuf
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type QueryRequest struct {
+	// The query, in the same language as the HTTP API's.
+	Query string `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	// Stop once this many bytes or packets have been returned, if nonzero.
+	LimitBytes   int64 `protobuf:"varint,2,opt,name=limit_bytes,json=limitBytes,proto3" json:"limit_bytes,omitempty"`
+	LimitPackets int64 `protobuf:"varint,3,opt,name=limit_packets,json=limitPackets,proto3" json:"limit_packets,omitempty"`
+	// Return only the first snaplen bytes of each packet, if nonzero.
+	Snaplen int32 `protobuf:"varint,4,opt,name=snaplen,proto3" json:"snaplen,omitempty"`
+	// Reject keywords added after this query language version, if nonzero.
+	LanguageVersion int32 `protobuf:"varint,5,opt,name=language_version,json=languageVersion,proto3" json:"language_version,omitempty"`
+	// Drop duplicate packets within this window (e.g. "10ms", or "true" for
+	// the default), as with the HTTP API's ?dedup.
+	Dedup string `protobuf:"bytes,6,opt,name=dedup,proto3" json:"dedup,omitempty"`
+	// Values for $variables in the query.
+	Vars                 map[string]string `protobuf:"bytes,7,rep,name=vars,proto3" json:"vars,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *QueryRequest) Reset()         { *m = QueryRequest{} }
+func (m *QueryRequest) String() string { return proto.CompactTextString(m) }
+func (*QueryRequest) ProtoMessage()    {}
+func (*QueryRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{0}
+}
+
+func (m *QueryRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_QueryRequest.Unmarshal(m, b)
+}
+func (m *QueryRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_QueryRequest.Marshal(b, m, deterministic)
+}
+func (m *QueryRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_QueryRequest.Merge(m, src)
+}
+func (m *QueryRequest) XXX_Size() int {
+	return xxx_messageInfo_QueryRequest.Size(m)
+}
+func (m *QueryRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_QueryRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_QueryRequest proto.InternalMessageInfo
+
+func (m *QueryRequest) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetLimitBytes() int64 {
+	if m != nil {
+		return m.LimitBytes
+	}
+	return 0
+}
+
+func (m *QueryRequest) GetLimitPackets() int64 {
+	if m != nil {
+		return m.LimitPackets
+	}
+	return 0
+}
+
+func (m *QueryRequest) GetSnaplen() int32 {
+	if m != nil {
+		return m.Snaplen
+	}
+	return 0
+}
+
+func (m *QueryRequest) GetLanguageVersion() int32 {
+	if m != nil {
+		return m.LanguageVersion
+	}
+	return 0
+}
+
+func (m *QueryRequest) GetDedup() string {
+	if m != nil {
+		return m.Dedup
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetVars() map[string]string {
+	if m != nil {
+		return m.Vars
+	}
+	return nil
+}
+
+type QueryResponse struct {
+	// The ID the query ran as, as listed by Jobs.
+	JobId int64 `protobuf:"varint,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	// The query's packets, as a pcap file.
+	Pcap                 []byte   `protobuf:"bytes,2,opt,name=pcap,proto3" json:"pcap,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *QueryResponse) Reset()         { *m = QueryResponse{} }
+func (m *QueryResponse) String() string { return proto.CompactTextString(m) }
+func (*QueryResponse) ProtoMessage()    {}
+func (*QueryResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{1}
+}
+
+func (m *QueryResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_QueryResponse.Unmarshal(m, b)
+}
+func (m *QueryResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_QueryResponse.Marshal(b, m, deterministic)
+}
+func (m *QueryResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_QueryResponse.Merge(m, src)
+}
+func (m *QueryResponse) XXX_Size() int {
+	return xxx_messageInfo_QueryResponse.Size(m)
+}
+func (m *QueryResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_QueryResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_QueryResponse proto.InternalMessageInfo
+
+func (m *QueryResponse) GetJobId() int64 {
+	if m != nil {
+		return m.JobId
+	}
+	return 0
+}
+
+func (m *QueryResponse) GetPcap() []byte {
+	if m != nil {
+		return m.Pcap
+	}
+	return nil
+}
+
+type Packet struct {
+	TimestampNanos       int64    `protobuf:"varint,1,opt,name=timestamp_nanos,json=timestampNanos,proto3" json:"timestamp_nanos,omitempty"`
+	Length               int64    `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+	Thread               int32    `protobuf:"varint,3,opt,name=thread,proto3" json:"thread,omitempty"`
+	Data                 []byte   `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Packet) Reset()         { *m = Packet{} }
+func (m *Packet) String() string { return proto.CompactTextString(m) }
+func (*Packet) ProtoMessage()    {}
+func (*Packet) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{2}
+}
+
+func (m *Packet) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Packet.Unmarshal(m, b)
+}
+func (m *Packet) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Packet.Marshal(b, m, deterministic)
+}
+func (m *Packet) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Packet.Merge(m, src)
+}
+func (m *Packet) XXX_Size() int {
+	return xxx_messageInfo_Packet.Size(m)
+}
+func (m *Packet) XXX_DiscardUnknown() {
+	xxx_messageInfo_Packet.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Packet proto.InternalMessageInfo
+
+func (m *Packet) GetTimestampNanos() int64 {
+	if m != nil {
+		return m.TimestampNanos
+	}
+	return 0
+}
+
+func (m *Packet) GetLength() int64 {
+	if m != nil {
+		return m.Length
+	}
+	return 0
+}
+
+func (m *Packet) GetThread() int32 {
+	if m != nil {
+		return m.Thread
+	}
+	return 0
+}
+
+func (m *Packet) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type PacketBatch struct {
+	// The ID the query is running as.  Only set in the first batch, which has
+	// no packets, so callers can cancel the query before any are found.
+	JobId                int64     `protobuf:"varint,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Packets              []*Packet `protobuf:"bytes,2,rep,name=packets,proto3" json:"packets,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *PacketBatch) Reset()         { *m = PacketBatch{} }
+func (m *PacketBatch) String() string { return proto.CompactTextString(m) }
+func (*PacketBatch) ProtoMessage()    {}
+func (*PacketBatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{3}
+}
+
+func (m *PacketBatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PacketBatch.Unmarshal(m, b)
+}
+func (m *PacketBatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PacketBatch.Marshal(b, m, deterministic)
+}
+func (m *PacketBatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PacketBatch.Merge(m, src)
+}
+func (m *PacketBatch) XXX_Size() int {
+	return xxx_messageInfo_PacketBatch.Size(m)
+}
+func (m *PacketBatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_PacketBatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PacketBatch proto.InternalMessageInfo
+
+func (m *PacketBatch) GetJobId() int64 {
+	if m != nil {
+		return m.JobId
+	}
+	return 0
+}
+
+func (m *PacketBatch) GetPackets() []*Packet {
+	if m != nil {
+		return m.Packets
+	}
+	return nil
+}
+
+type StatsRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return proto.CompactTextString(m) }
+func (*StatsRequest) ProtoMessage()    {}
+func (*StatsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{4}
+}
+
+func (m *StatsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatsRequest.Unmarshal(m, b)
+}
+func (m *StatsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatsRequest.Marshal(b, m, deterministic)
+}
+func (m *StatsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatsRequest.Merge(m, src)
+}
+func (m *StatsRequest) XXX_Size() int {
+	return xxx_messageInfo_StatsRequest.Size(m)
+}
+func (m *StatsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatsRequest proto.InternalMessageInfo
+
+type StatsResponse struct {
+	Stats                map[string]int64 `protobuf:"bytes,1,rep,name=stats,proto3" json:"stats,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *StatsResponse) Reset()         { *m = StatsResponse{} }
+func (m *StatsResponse) String() string { return proto.CompactTextString(m) }
+func (*StatsResponse) ProtoMessage()    {}
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{5}
+}
+
+func (m *StatsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatsResponse.Unmarshal(m, b)
+}
+func (m *StatsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatsResponse.Marshal(b, m, deterministic)
+}
+func (m *StatsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatsResponse.Merge(m, src)
+}
+func (m *StatsResponse) XXX_Size() int {
+	return xxx_messageInfo_StatsResponse.Size(m)
+}
+func (m *StatsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatsResponse proto.InternalMessageInfo
+
+func (m *StatsResponse) GetStats() map[string]int64 {
+	if m != nil {
+		return m.Stats
+	}
+	return nil
+}
+
+type JobsRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *JobsRequest) Reset()         { *m = JobsRequest{} }
+func (m *JobsRequest) String() string { return proto.CompactTextString(m) }
+func (*JobsRequest) ProtoMessage()    {}
+func (*JobsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{6}
+}
+
+func (m *JobsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_JobsRequest.Unmarshal(m, b)
+}
+func (m *JobsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_JobsRequest.Marshal(b, m, deterministic)
+}
+func (m *JobsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_JobsRequest.Merge(m, src)
+}
+func (m *JobsRequest) XXX_Size() int {
+	return xxx_messageInfo_JobsRequest.Size(m)
+}
+func (m *JobsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_JobsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_JobsRequest proto.InternalMessageInfo
+
+type Job struct {
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// What's serving it, like "/query" for the HTTP API, or the gRPC method.
+	Method               string   `protobuf:"bytes,2,opt,name=method,proto3" json:"method,omitempty"`
+	StartUnixNanos       int64    `protobuf:"varint,3,opt,name=start_unix_nanos,json=startUnixNanos,proto3" json:"start_unix_nanos,omitempty"`
+	Client               string   `protobuf:"bytes,4,opt,name=client,proto3" json:"client,omitempty"`
+	Query                string   `protobuf:"bytes,5,opt,name=query,proto3" json:"query,omitempty"`
+	Bytes                int64    `protobuf:"varint,6,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Job) Reset()         { *m = Job{} }
+func (m *Job) String() string { return proto.CompactTextString(m) }
+func (*Job) ProtoMessage()    {}
+func (*Job) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{7}
+}
+
+func (m *Job) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Job.Unmarshal(m, b)
+}
+func (m *Job) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Job.Marshal(b, m, deterministic)
+}
+func (m *Job) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Job.Merge(m, src)
+}
+func (m *Job) XXX_Size() int {
+	return xxx_messageInfo_Job.Size(m)
+}
+func (m *Job) XXX_DiscardUnknown() {
+	xxx_messageInfo_Job.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Job proto.InternalMessageInfo
+
+func (m *Job) GetId() int64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *Job) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *Job) GetStartUnixNanos() int64 {
+	if m != nil {
+		return m.StartUnixNanos
+	}
+	return 0
+}
+
+func (m *Job) GetClient() string {
+	if m != nil {
+		return m.Client
+	}
+	return ""
+}
+
+func (m *Job) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *Job) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+type JobsResponse struct {
+	Jobs                 []*Job   `protobuf:"bytes,1,rep,name=jobs,proto3" json:"jobs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *JobsResponse) Reset()         { *m = JobsResponse{} }
+func (m *JobsResponse) String() string { return proto.CompactTextString(m) }
+func (*JobsResponse) ProtoMessage()    {}
+func (*JobsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{8}
+}
+
+func (m *JobsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_JobsResponse.Unmarshal(m, b)
+}
+func (m *JobsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_JobsResponse.Marshal(b, m, deterministic)
+}
+func (m *JobsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_JobsResponse.Merge(m, src)
+}
+func (m *JobsResponse) XXX_Size() int {
+	return xxx_messageInfo_JobsResponse.Size(m)
+}
+func (m *JobsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_JobsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_JobsResponse proto.InternalMessageInfo
+
+func (m *JobsResponse) GetJobs() []*Job {
+	if m != nil {
+		return m.Jobs
+	}
+	return nil
+}
+
+type CancelJobRequest struct {
+	Id                   int64    `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CancelJobRequest) Reset()         { *m = CancelJobRequest{} }
+func (m *CancelJobRequest) String() string { return proto.CompactTextString(m) }
+func (*CancelJobRequest) ProtoMessage()    {}
+func (*CancelJobRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{9}
+}
+
+func (m *CancelJobRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CancelJobRequest.Unmarshal(m, b)
+}
+func (m *CancelJobRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CancelJobRequest.Marshal(b, m, deterministic)
+}
+func (m *CancelJobRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CancelJobRequest.Merge(m, src)
+}
+func (m *CancelJobRequest) XXX_Size() int {
+	return xxx_messageInfo_CancelJobRequest.Size(m)
+}
+func (m *CancelJobRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CancelJobRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CancelJobRequest proto.InternalMessageInfo
+
+func (m *CancelJobRequest) GetId() int64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+type CancelJobResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CancelJobResponse) Reset()         { *m = CancelJobResponse{} }
+func (m *CancelJobResponse) String() string { return proto.CompactTextString(m) }
+func (*CancelJobResponse) ProtoMessage()    {}
+func (*CancelJobResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a047459a1ab3dd2b, []int{10}
+}
+
+func (m *CancelJobResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CancelJobResponse.Unmarshal(m, b)
+}
+func (m *CancelJobResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CancelJobResponse.Marshal(b, m, deterministic)
+}
+func (m *CancelJobResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CancelJobResponse.Merge(m, src)
+}
+func (m *CancelJobResponse) XXX_Size() int {
+	return xxx_messageInfo_CancelJobResponse.Size(m)
+}
+func (m *CancelJobResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CancelJobResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CancelJobResponse proto.InternalMessageInfo
+
+func init() {
+	proto.RegisterType((*QueryRequest)(nil), "stenographer.QueryRequest")
+	proto.RegisterMapType((map[string]string)(nil), "stenographer.QueryRequest.VarsEntry")
+	proto.RegisterType((*QueryResponse)(nil), "stenographer.QueryResponse")
+	proto.RegisterType((*Packet)(nil), "stenographer.Packet")
+	proto.RegisterType((*PacketBatch)(nil), "stenographer.PacketBatch")
+	proto.RegisterType((*StatsRequest)(nil), "stenographer.StatsRequest")
+	proto.RegisterType((*StatsResponse)(nil), "stenographer.StatsResponse")
+	proto.RegisterMapType((map[string]int64)(nil), "stenographer.StatsResponse.StatsEntry")
+	proto.RegisterType((*JobsRequest)(nil), "stenographer.JobsRequest")
+	proto.RegisterType((*Job)(nil), "stenographer.Job")
+	proto.RegisterType((*JobsResponse)(nil), "stenographer.JobsResponse")
+	proto.RegisterType((*CancelJobRequest)(nil), "stenographer.CancelJobRequest")
+	proto.RegisterType((*CancelJobResponse)(nil), "stenographer.CancelJobResponse")
+}
+
+func init() { proto.RegisterFile("steno.proto", fileDescriptor_a047459a1ab3dd2b) }
+
+var fileDescriptor_a047459a1ab3dd2b = []byte{
+	// 657 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x54, 0xdd, 0x6e, 0xd3, 0x4c,
+	0x10, 0xad, 0xed, 0x38, 0xfd, 0x32, 0x71, 0xd2, 0x74, 0xbf, 0x82, 0x5c, 0x57, 0xa2, 0x91, 0xf9,
+	0x0b, 0x37, 0x11, 0x2a, 0x42, 0x54, 0x15, 0x12, 0x52, 0x10, 0x12, 0xf4, 0xa2, 0x02, 0x17, 0x7a,
+	0xc1, 0x4d, 0xb4, 0x8e, 0x97, 0xc4, 0xad, 0xb3, 0xeb, 0x7a, 0xd7, 0x55, 0xfb, 0x04, 0x3c, 0x04,
+	0x2f, 0xc2, 0x6b, 0xf1, 0x06, 0x68, 0x7f, 0xec, 0x26, 0x25, 0x81, 0xbb, 0x3d, 0x67, 0x67, 0x8f,
+	0x67, 0xce, 0xcc, 0x18, 0xda, 0x5c, 0x10, 0xca, 0x86, 0x79, 0xc1, 0x04, 0x43, 0x9e, 0x02, 0xd3,
+	0x02, 0xe7, 0x33, 0x52, 0x84, 0x3f, 0x6d, 0xf0, 0x3e, 0x95, 0xa4, 0xb8, 0x89, 0xc8, 0x65, 0x49,
+	0xb8, 0x40, 0x3b, 0xe0, 0x5e, 0x4a, 0xec, 0x5b, 0x7d, 0x6b, 0xd0, 0x8a, 0x34, 0x40, 0xfb, 0xd0,
+	0xce, 0xd2, 0x79, 0x2a, 0xc6, 0xf1, 0x8d, 0x20, 0xdc, 0xb7, 0xfb, 0xd6, 0xc0, 0x89, 0x40, 0x51,
+	0x23, 0xc9, 0xa0, 0x87, 0xd0, 0xd1, 0x01, 0x39, 0x9e, 0x5c, 0x10, 0xc1, 0x7d, 0x47, 0x85, 0x78,
+	0x8a, 0xfc, 0xa8, 0x39, 0xe4, 0xc3, 0x26, 0xa7, 0x38, 0xcf, 0x08, 0xf5, 0x1b, 0x7d, 0x6b, 0xe0,
+	0x46, 0x15, 0x44, 0xcf, 0xa0, 0x97, 0x61, 0x3a, 0x2d, 0xf1, 0x94, 0x8c, 0xaf, 0x48, 0xc1, 0x53,
+	0x46, 0x7d, 0x57, 0x85, 0x6c, 0x55, 0xfc, 0x99, 0xa6, 0x65, 0x82, 0x09, 0x49, 0xca, 0xdc, 0x6f,
+	0xea, 0x04, 0x15, 0x40, 0x87, 0xd0, 0xb8, 0xc2, 0x05, 0xf7, 0x37, 0xfb, 0xce, 0xa0, 0x7d, 0xf0,
+	0x68, 0xb8, 0x58, 0xe4, 0x70, 0xb1, 0xc0, 0xe1, 0x19, 0x2e, 0xf8, 0x3b, 0x2a, 0x8a, 0x9b, 0x48,
+	0xbd, 0x08, 0x5e, 0x41, 0xab, 0xa6, 0x50, 0x0f, 0x9c, 0x0b, 0x52, 0xd5, 0x2e, 0x8f, 0xf2, 0x73,
+	0x57, 0x38, 0x2b, 0x89, 0xaa, 0xb9, 0x15, 0x69, 0x70, 0x64, 0x1f, 0x5a, 0xe1, 0x11, 0x74, 0x8c,
+	0x30, 0xcf, 0x19, 0xe5, 0x04, 0xdd, 0x83, 0xe6, 0x39, 0x8b, 0xc7, 0x69, 0xa2, 0xde, 0x3b, 0x91,
+	0x7b, 0xce, 0xe2, 0x0f, 0x09, 0x42, 0xd0, 0xc8, 0x27, 0x38, 0x57, 0x02, 0x5e, 0xa4, 0xce, 0x61,
+	0x09, 0x4d, 0x6d, 0x0a, 0x7a, 0x0a, 0x5b, 0x22, 0x9d, 0x13, 0x2e, 0xf0, 0x3c, 0x1f, 0x53, 0x4c,
+	0x19, 0x37, 0xaf, 0xbb, 0x35, 0x7d, 0x22, 0x59, 0x74, 0x1f, 0x9a, 0x19, 0xa1, 0x53, 0x31, 0x33,
+	0xee, 0x1b, 0x24, 0x79, 0x31, 0x2b, 0x08, 0x4e, 0x94, 0xe5, 0x6e, 0x64, 0x90, 0xfc, 0x6c, 0x82,
+	0x05, 0x56, 0x4e, 0x7b, 0x91, 0x3a, 0x87, 0x9f, 0xa1, 0xad, 0x3f, 0x3b, 0xc2, 0x62, 0x32, 0x5b,
+	0x97, 0xf0, 0x10, 0x36, 0xab, 0x2e, 0xda, 0xca, 0xce, 0x9d, 0x65, 0x3b, 0xb5, 0x44, 0x54, 0x05,
+	0x85, 0x5d, 0xf0, 0x4e, 0x05, 0x16, 0xdc, 0x38, 0x1c, 0x7e, 0xb7, 0xa0, 0x63, 0x08, 0xe3, 0xcc,
+	0x6b, 0x70, 0xb9, 0x24, 0x7c, 0x4b, 0xe9, 0x3d, 0x59, 0xd6, 0x5b, 0x8a, 0xd5, 0x48, 0x37, 0x48,
+	0x3f, 0x0a, 0x0e, 0x01, 0x6e, 0xc9, 0x7f, 0xb5, 0xc8, 0x59, 0x6c, 0x51, 0x07, 0xda, 0xc7, 0x2c,
+	0xae, 0x13, 0xfb, 0x61, 0x81, 0x73, 0xcc, 0x62, 0xd4, 0x05, 0xbb, 0xae, 0xd9, 0x4e, 0x13, 0x69,
+	0xe1, 0x9c, 0x88, 0x19, 0x4b, 0x4c, 0x93, 0x0d, 0x42, 0x03, 0xe8, 0x71, 0x81, 0x0b, 0x31, 0x2e,
+	0x69, 0x7a, 0x6d, 0x9a, 0xa3, 0xe7, 0xba, 0xab, 0xf8, 0x2f, 0x34, 0xbd, 0xae, 0x9b, 0x33, 0xc9,
+	0x52, 0x42, 0x85, 0xb2, 0xbb, 0x15, 0x19, 0x74, 0xbb, 0x4d, 0xee, 0xe2, 0x36, 0xed, 0x80, 0xab,
+	0xf7, 0xa8, 0xa9, 0x13, 0x56, 0x20, 0x7c, 0x09, 0x9e, 0x4e, 0xd6, 0x98, 0xf6, 0x18, 0x1a, 0xe7,
+	0x2c, 0xae, 0x3c, 0xdb, 0x5e, 0xf6, 0xec, 0x98, 0xc5, 0x91, 0xba, 0x0e, 0x43, 0xe8, 0xbd, 0xc5,
+	0x74, 0x42, 0x32, 0x49, 0x99, 0x25, 0xbe, 0x53, 0x60, 0xf8, 0x3f, 0x6c, 0x2f, 0xc4, 0x68, 0xfd,
+	0x83, 0x5f, 0xb6, 0xec, 0xdb, 0xad, 0x26, 0x1a, 0x81, 0xab, 0x06, 0x1a, 0x05, 0xeb, 0xd7, 0x27,
+	0xd8, 0x5b, 0x79, 0xa7, 0x25, 0xc3, 0x0d, 0xf4, 0x1e, 0xda, 0x8a, 0x3a, 0x15, 0x05, 0xc1, 0xf3,
+	0xbf, 0x2a, 0xed, 0xae, 0x9a, 0x2a, 0x35, 0x98, 0xe1, 0xc6, 0x73, 0x4b, 0x66, 0xa3, 0xba, 0x7e,
+	0x57, 0x63, 0x71, 0xd4, 0x82, 0xbd, 0x95, 0x77, 0x75, 0x36, 0x6f, 0xa0, 0x21, 0x2d, 0x45, 0xbb,
+	0x7f, 0x98, 0x57, 0x2b, 0x04, 0xab, 0xae, 0x6a, 0x81, 0x13, 0x68, 0xd5, 0xc6, 0xa1, 0x07, 0xcb,
+	0xa1, 0x77, 0x5d, 0x0f, 0xf6, 0xd7, 0xde, 0x57, 0x7a, 0x23, 0xf8, 0xfa, 0x9f, 0xfa, 0x0b, 0xc7,
+	0xe5, 0xb7, 0xb8, 0xa9, 0x4e, 0x2f, 0x7e, 0x0f, 0x00, 0x7c, 0xb0, 0xd8, 0x2f, 0x9e, 0x05, 0x00,
+	0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// StenographerClient is the client API for Stenographer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type StenographerClient interface {
+	// Query runs a query and returns its packets as a single pcap.  Responses
+	// are capped at the server's maximum message size, so use QueryStream for
+	// anything large.
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+	// QueryStream runs a query and streams its packets back in batches, in
+	// time order.
+	QueryStream(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Stenographer_QueryStreamClient, error)
+	// Stats returns the server's current stats, as served at /debug/stats.
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	// Jobs lists the queries being served, over either API.
+	Jobs(ctx context.Context, in *JobsRequest, opts ...grpc.CallOption) (*JobsResponse, error)
+	// CancelJob cancels a query being served.
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*CancelJobResponse, error)
+}
+
+type stenographerClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewStenographerClient(cc *grpc.ClientConn) StenographerClient {
+	return &stenographerClient{cc}
+}
+
+func (c *stenographerClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	out := new(QueryResponse)
+	err := c.cc.Invoke(ctx, "/stenographer.Stenographer/Query", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stenographerClient) QueryStream(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Stenographer_QueryStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Stenographer_serviceDesc.Streams[0], "/stenographer.Stenographer/QueryStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &stenographerQueryStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Stenographer_QueryStreamClient interface {
+	Recv() (*PacketBatch, error)
+	grpc.ClientStream
+}
+
+type stenographerQueryStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *stenographerQueryStreamClient) Recv() (*PacketBatch, error) {
+	m := new(PacketBatch)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *stenographerClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, "/stenographer.Stenographer/Stats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stenographerClient) Jobs(ctx context.Context, in *JobsRequest, opts ...grpc.CallOption) (*JobsResponse, error) {
+	out := new(JobsResponse)
+	err := c.cc.Invoke(ctx, "/stenographer.Stenographer/Jobs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stenographerClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*CancelJobResponse, error) {
+	out := new(CancelJobResponse)
+	err := c.cc.Invoke(ctx, "/stenographer.Stenographer/CancelJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StenographerServer is the server API for Stenographer service.
+type StenographerServer interface {
+	// Query runs a query and returns its packets as a single pcap.  Responses
+	// are capped at the server's maximum message size, so use QueryStream for
+	// anything large.
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	// QueryStream runs a query and streams its packets back in batches, in
+	// time order.
+	QueryStream(*QueryRequest, Stenographer_QueryStreamServer) error
+	// Stats returns the server's current stats, as served at /debug/stats.
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// Jobs lists the queries being served, over either API.
+	Jobs(context.Context, *JobsRequest) (*JobsResponse, error)
+	// CancelJob cancels a query being served.
+	CancelJob(context.Context, *CancelJobRequest) (*CancelJobResponse, error)
+}
+
+// UnimplementedStenographerServer can be embedded to have forward compatible implementations.
+type UnimplementedStenographerServer struct {
+}
+
+func (*UnimplementedStenographerServer) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (*UnimplementedStenographerServer) QueryStream(req *QueryRequest, srv Stenographer_QueryStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method QueryStream not implemented")
+}
+func (*UnimplementedStenographerServer) Stats(ctx context.Context, req *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (*UnimplementedStenographerServer) Jobs(ctx context.Context, req *JobsRequest) (*JobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Jobs not implemented")
+}
+func (*UnimplementedStenographerServer) CancelJob(ctx context.Context, req *CancelJobRequest) (*CancelJobResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+
+func RegisterStenographerServer(s *grpc.Server, srv StenographerServer) {
+	s.RegisterService(&_Stenographer_serviceDesc, srv)
+}
+
+func _Stenographer_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StenographerServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stenographer.Stenographer/Query",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StenographerServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stenographer_QueryStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StenographerServer).QueryStream(m, &stenographerQueryStreamServer{stream})
+}
+
+type Stenographer_QueryStreamServer interface {
+	Send(*PacketBatch) error
+	grpc.ServerStream
+}
+
+type stenographerQueryStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *stenographerQueryStreamServer) Send(m *PacketBatch) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Stenographer_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StenographerServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stenographer.Stenographer/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StenographerServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stenographer_Jobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StenographerServer).Jobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stenographer.Stenographer/Jobs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StenographerServer).Jobs(ctx, req.(*JobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stenographer_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StenographerServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stenographer.Stenographer/CancelJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StenographerServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Stenographer_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "stenographer.Stenographer",
+	HandlerType: (*StenographerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Query",
+			Handler:    _Stenographer_Query_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _Stenographer_Stats_Handler,
+		},
+		{
+			MethodName: "Jobs",
+			Handler:    _Stenographer_Jobs_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _Stenographer_CancelJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "QueryStream",
+			Handler:       _Stenographer_QueryStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "steno.proto",
+}
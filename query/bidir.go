@@ -0,0 +1,141 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// maxBidirFlows limits how many flows a bidir query may expand to, since each
+// becomes its own set of index lookups.
+const maxBidirFlows = 1000
+
+// bidirQuery returns every packet, in both directions, of each flow with a
+// packet matching the wrapped query.  It's run in two passes:  the wrapped
+// query finds the flows, then FlowQuery looks up their full tuples.  If
+// restrict is set, by Restrict, the flows' packets must match it too.
+type bidirQuery struct {
+	Query
+	restrict Query
+}
+
+func (q bidirQuery) String() string { return "bidir " + q.Query.String() }
+
+// Bidirectional returns the query whose flows should be returned, if q is a
+// bidir query.
+func Bidirectional(q Query) (Query, bool) {
+	if sq, ok := q.(sampledQuery); ok {
+		q = sq.Query
+	}
+	bq, ok := q.(bidirQuery)
+	if !ok {
+		return nil, false
+	}
+	return bq.Query, true
+}
+
+// bidirRestriction returns what Restrict limited a bidir query to, if
+// anything.
+func bidirRestriction(q Query) Query {
+	if sq, ok := q.(sampledQuery); ok {
+		q = sq.Query
+	}
+	if bq, ok := q.(bidirQuery); ok {
+		return bq.restrict
+	}
+	return nil
+}
+
+// flowTuple identifies a flow regardless of direction:  the lower IP/port
+// pair always comes first.
+type flowTuple struct {
+	proto        byte
+	ipA, ipB     string
+	portA, portB uint16
+}
+
+func tupleOf(data []byte) (t flowTuple, ok bool) {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	var src, dst net.IP
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst, t.proto = ip.SrcIP.To4(), ip.DstIP.To4(), byte(ip.Protocol)
+	case *layers.IPv6:
+		src, dst, t.proto = ip.SrcIP.To16(), ip.DstIP.To16(), byte(ip.NextHeader)
+	default:
+		return t, false
+	}
+	var srcPort, dstPort uint16
+	switch l4 := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		srcPort, dstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+	case *layers.UDP:
+		srcPort, dstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+	}
+	t.ipA, t.ipB, t.portA, t.portB = string(src), string(dst), srcPort, dstPort
+	if t.ipA > t.ipB || (t.ipA == t.ipB && t.portA > t.portB) {
+		t.ipA, t.ipB, t.portA, t.portB = t.ipB, t.ipA, t.portB, t.portA
+	}
+	return t, true
+}
+
+func (t flowTuple) query() Query {
+	a, b := net.IP(t.ipA), net.IP(t.ipB)
+	q := intersectQuery{ipQuery{a, a}, ipQuery{b, b}, protocolQuery(t.proto)}
+	if t.portA != 0 || t.portB != 0 {
+		q = append(q, portQuery(t.portA), portQuery(t.portB))
+	}
+	return q
+}
+
+// FlowQuery reads the packets found for a bidir query's wrapped query from in,
+// and returns a query for all packets of their flows, in both directions and
+// within q's time range and restriction.
+func FlowQuery(ctx context.Context, q Query, in *base.PacketChan) (Query, error) {
+	defer in.Discard()
+	flows := map[flowTuple]bool{}
+	for p := range in.Receive() {
+		if base.ContextDone(ctx) {
+			return nil, ctx.Err()
+		}
+		if t, ok := tupleOf(p.Data); ok {
+			flows[t] = true
+		}
+		if len(flows) > maxBidirFlows {
+			return nil, fmt.Errorf("bidir query matched more than %d flows", maxBidirFlows)
+		}
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	union := unionQuery{}
+	for t := range flows {
+		union = append(union, t.query())
+	}
+	var out Query = union
+	if start, stop := TimeSpan(q); !start.IsZero() || !stop.IsZero() {
+		out = intersectQuery{union, timeQuery{start, stop}}
+	}
+	if restrict := bidirRestriction(q); restrict != nil {
+		out = intersectQuery{out, restrict}
+	}
+	return out, nil
+}
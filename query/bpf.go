@@ -0,0 +1,45 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+
+	//"github.com/google/stenographer/bpfutil"
+	"../bpfutil"
+)
+
+// compileBPF compiles bpf clauses.  It's a variable so tests can run without
+// tcpdump.
+var compileBPF = bpfutil.CompileEthernet
+
+// bpfFilter matches packets with a classic BPF program.
+type bpfFilter struct {
+	expr   string
+	filter *bpfutil.Filter
+}
+
+func (f bpfFilter) String() string { return fmt.Sprintf("bpf %q", f.expr) }
+func (f bpfFilter) matches(data []byte) (bool, int) {
+	return f.filter.Matches(data), 0
+}
+
+func newBPFFilter(expr string) (bpfFilter, error) {
+	filter, err := compileBPF(expr)
+	if err != nil {
+		return bpfFilter{}, err
+	}
+	return bpfFilter{expr: expr, filter: filter}, nil
+}
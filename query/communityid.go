@@ -0,0 +1,44 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	//"github.com/google/stenographer/communityid"
+	"../communityid"
+)
+
+// communityIDFilter matches packets of the flow with a Community ID, as
+// logged by Zeek or Suricata with the default seed of 0.  The ID's a hash,
+// so it can't be looked up in the indexes:  it must follow index clauses,
+// like a host or port of the flow.
+type communityIDFilter string
+
+func (f communityIDFilter) String() string { return fmt.Sprintf("communityid %q", string(f)) }
+func (f communityIDFilter) matches(data []byte) (bool, int) {
+	flow, ok := communityid.FromPacket(data)
+	return ok && flow.ID(0) == string(f), 0
+}
+
+func newCommunityIDFilter(id string) (communityIDFilter, error) {
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(id, "1:"))
+	if !strings.HasPrefix(id, "1:") || err != nil || len(hash) != 20 {
+		return "", fmt.Errorf("bad communityid %q, want a version 1 ID like \"1:LQU9qZlK+B5F3KDmev6m5PMibrg=\"", id)
+	}
+	return communityIDFilter(id), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+)
+
+// ParseError is returned by NewQuery for queries that can't be parsed.
+type ParseError struct {
+	Message    string // What went wrong.
+	Position   int    // Character offset into Input where it went wrong.
+	Input      string // The full query.
+	Suggestion string // If non-empty, a keyword the user may have meant.
+}
+
+// Error implements error.
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%v at character %v (%q HERE %q)", e.Message, e.Position, e.Input[:e.Position], e.Input[e.Position:])
+	if e.Suggestion != "" {
+		msg += fmt.Sprintf(", did you mean %q?", e.Suggestion)
+	}
+	return msg
+}
+
+// isWordChar returns true for characters that can appear in keywords.
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c >= '0' && c <= '9'
+}
+
+// wordAt returns the word in s containing or ending at pos.
+func wordAt(s string, pos int) string {
+	start, end := pos, pos
+	for start > 0 && isWordChar(s[start-1]) {
+		start--
+	}
+	for end < len(s) && isWordChar(s[end]) {
+		end++
+	}
+	return s[start:end]
+}
+
+// suggestKeyword returns the keyword closest to word, if it's close enough to
+// plausibly be a typo, or "" otherwise.
+func suggestKeyword(word string) string {
+	if word == "" || tokens[word] != 0 || protocols[word] != 0 {
+		return ""
+	}
+	best, bestDist := "", 3 // Only suggest keywords at most 2 edits away.
+	check := func(keyword string) {
+		if !isWordChar(keyword[0]) {
+			return // Skip symbols like "&&".
+		}
+		if d := editDistance(word, keyword); d < bestDist || d == bestDist && keyword < best {
+			best, bestDist = keyword, d
+		}
+	}
+	for keyword := range tokens {
+		check(keyword)
+	}
+	for keyword := range protocols {
+		check(keyword)
+	}
+	if bestDist >= len(word) {
+		return "" // Short words are close to too many keywords to be useful.
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Explanation describes how a query will be run.
+type Explanation struct {
+	Query string // Normalized form of the query.
+	AST   *ExplainNode
+	// Start and Stop bound the packets the query can match, and are nil if
+	// it's unbounded.
+	Start, Stop *time.Time `json:",omitempty"`
+}
+
+// ExplainNode is a single node of a parsed query.
+type ExplainNode struct {
+	Type     string         // Kind of node, like "union" or "port".
+	Value    string         `json:",omitempty"` // Leaf value, in query syntax.
+	Children []*ExplainNode `json:",omitempty"`
+}
+
+// NewQueryExplained parses a query like ParseWithOptions, and also returns an
+// explanation of it.
+func NewQueryExplained(query string, opts ParseOptions) (Query, *Explanation, error) {
+	q, err := ParseWithOptions(query, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &Explanation{Query: q.String(), AST: explainNode(q)}
+	if start, stop := TimeSpan(q); !start.IsZero() || !stop.IsZero() {
+		if !start.IsZero() {
+			e.Start = &start
+		}
+		if !stop.IsZero() {
+			e.Stop = &stop
+		}
+	}
+	return q, e, nil
+}
+
+// nodeType returns the name of q's type, without the Query or Filter suffix.
+func nodeType(q interface{}) string {
+	t := strings.TrimPrefix(fmt.Sprintf("%T", q), "query.")
+	return strings.TrimSuffix(strings.TrimSuffix(t, "Query"), "Filter")
+}
+
+func explainNode(q Query) *ExplainNode {
+	n := &ExplainNode{Type: nodeType(q)}
+	switch q := q.(type) {
+	case unionQuery:
+		for _, sub := range q {
+			n.Children = append(n.Children, explainNode(sub))
+		}
+	case intersectQuery:
+		for _, sub := range q {
+			n.Children = append(n.Children, explainNode(sub))
+		}
+	case savedQuery:
+		n.Value = q.name
+		n.Children = []*ExplainNode{explainNode(q.q)}
+	case filteredQuery:
+		n.Children = []*ExplainNode{explainNode(q.Query)}
+		for _, f := range q.filters {
+			n.Children = append(n.Children, &ExplainNode{Type: nodeType(f), Value: f.String()})
+		}
+	case bidirQuery:
+		n.Children = []*ExplainNode{explainNode(q.Query)}
+	case sampledQuery:
+		n.Value = strings.TrimPrefix(q.String(), q.Query.String()+" ")
+		n.Children = []*ExplainNode{explainNode(q.Query)}
+	default:
+		n.Value = q.String()
+	}
+	return n
+}
@@ -0,0 +1,234 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	payloadRegexpScans     = stats.S.Get("payload_regexp_scans")
+	payloadRegexpScanBytes = stats.S.Get("payload_regexp_scan_bytes")
+	payloadRegexpScanNanos = stats.S.Get("payload_regexp_scan_nanos")
+)
+
+// packetFilter is a condition on packet contents that the indexes can't
+// answer, checked against each packet the index lookups return.
+type packetFilter interface {
+	String() string
+	// matches returns whether data matches, and how many payload bytes it
+	// scanned to decide.
+	matches(data []byte) (bool, int)
+}
+
+// indexedFilter is a packetFilter that can also narrow down packets with the
+// index, before they're filtered.
+type indexedFilter interface {
+	packetFilter
+	index() Query
+}
+
+// filteredQuery post-filters the packets found by the wrapped query.
+// Filtering happens on the packets read for the wrapped query, by Filter.
+type filteredQuery struct {
+	Query
+	filters []packetFilter
+}
+
+func (q filteredQuery) String() string {
+	all := []string{q.Query.String()}
+	for _, f := range q.filters {
+		all = append(all, f.String())
+	}
+	return strings.Join(all, " and ")
+}
+
+// newFilteredQuery returns a query for packets matching q (which may be nil)
+// and all the given filters.
+func newFilteredQuery(q Query, filters []packetFilter) (Query, error) {
+	var lookup intersectQuery
+	if q != nil {
+		lookup = append(lookup, q)
+	}
+	for _, f := range filters {
+		if i, ok := f.(indexedFilter); ok {
+			lookup = append(lookup, i.index())
+		}
+	}
+	if !indexed(lookup) {
+		return nil, fmt.Errorf("post-filter clauses need an index clause, like host or port, to narrow packets down first")
+	}
+	if len(lookup) == 1 {
+		return filteredQuery{lookup[0], filters}, nil
+	}
+	return filteredQuery{lookup, filters}, nil
+}
+
+// indexed returns whether q narrows down packets with index lookups, rather
+// than just by time.  Post-filters on unindexed queries would read every
+// packet in range.
+func indexed(q Query) bool {
+	switch q := q.(type) {
+	case timeQuery, threadQuery, ifaceQuery:
+		return false
+	case savedQuery:
+		return indexed(q.q)
+	case unionQuery:
+		for _, sub := range q {
+			if !indexed(sub) {
+				return false
+			}
+		}
+		return true
+	case intersectQuery:
+		for _, sub := range q {
+			if indexed(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Filter returns the packets from in that match q's post-filters, if it has
+// any.  Otherwise, in is returned as is.
+func Filter(ctx context.Context, q Query, in *base.PacketChan) *base.PacketChan {
+	if sq, ok := q.(sampledQuery); ok {
+		q = sq.Query
+	}
+	fq, ok := q.(filteredQuery)
+	if !ok {
+		return in
+	}
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		var scanned int64
+		maxScanned := CurrentSettings().MaxPayloadScanBytes
+	packets:
+		for p := range in.Receive() {
+			if base.ContextDone(ctx) {
+				break
+			}
+			for _, f := range fq.filters {
+				match, n := f.matches(p.Data)
+				scanned += int64(n)
+				if scanned > maxScanned {
+					out.Close(fmt.Errorf("query scanned more than %d payload bytes", maxScanned))
+					return
+				}
+				if !match {
+					continue packets
+				}
+			}
+			out.Send(p)
+		}
+		if err := ctx.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// payloadOf returns the application payload of an ethernet packet, or nil if
+// it has none.
+func payloadOf(data []byte) []byte {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if app := pkt.ApplicationLayer(); app != nil {
+		return app.Payload()
+	}
+	if transport := pkt.TransportLayer(); transport != nil {
+		return transport.LayerPayload()
+	}
+	return nil
+}
+
+// payloadFilter matches packets whose payload contains a byte string.
+type payloadFilter struct {
+	want []byte
+	hex  bool // Whether it was given as hex, for String.
+}
+
+func (f payloadFilter) String() string {
+	if f.hex {
+		return fmt.Sprintf("payloadhex 0x%x", f.want)
+	}
+	return fmt.Sprintf("payload %q", f.want)
+}
+func (f payloadFilter) matches(data []byte) (bool, int) {
+	payload := payloadOf(data)
+	return bytes.Contains(payload, f.want), len(payload)
+}
+
+func newPayloadHexFilter(in string) (payloadFilter, error) {
+	want, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(in, "0x"), "0X"))
+	if err != nil || len(want) == 0 {
+		return payloadFilter{}, fmt.Errorf("bad payloadhex %q", in)
+	}
+	return payloadFilter{want: want, hex: true}, nil
+}
+
+// regexpFilter matches packets whose payload matches a regular expression.
+// Go's RE2-based regexp package runs in time linear in the payload size, so
+// scans are bounded by the MaxRegexpPacketBytes and MaxPayloadScanBytes
+// settings.
+type regexpFilter struct {
+	re *regexp.Regexp
+}
+
+func (f regexpFilter) String() string { return fmt.Sprintf("payloadre \"/%v/\"", f.re) }
+func (f regexpFilter) matches(data []byte) (bool, int) {
+	payload := payloadOf(data)
+	if max := CurrentSettings().MaxRegexpPacketBytes; len(payload) > max {
+		payload = payload[:max]
+	}
+	start := time.Now()
+	match := f.re.Match(payload)
+	payloadRegexpScanNanos.IncrementBy(time.Since(start).Nanoseconds())
+	payloadRegexpScans.Increment()
+	payloadRegexpScanBytes.IncrementBy(int64(len(payload)))
+	return match, len(payload)
+}
+
+// newRegexpFilter compiles a payloadre clause, which may be given with or
+// without surrounding slashes.
+func newRegexpFilter(in string) (regexpFilter, error) {
+	if len(in) >= 2 && strings.HasPrefix(in, "/") && strings.HasSuffix(in, "/") {
+		in = in[1 : len(in)-1]
+	}
+	if in == "" {
+		return regexpFilter{}, fmt.Errorf("empty payloadre")
+	}
+	re, err := regexp.Compile(in)
+	if err != nil {
+		return regexpFilter{}, fmt.Errorf("bad payloadre: %v", err)
+	}
+	return regexpFilter{re}, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// hostSetQuery matches packets to or from any of a named list of IPs and
+// networks.
+type hostSetQuery struct {
+	name   string
+	ranges []ipQuery // Sorted and non-overlapping.
+}
+
+func (q hostSetQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	for _, r := range q.ranges {
+		pos, err := index.IPPositions(ctx, r[0], r[1])
+		if err != nil {
+			return nil, err
+		}
+		bp = bp.Union(pos)
+	}
+	return bp, nil
+}
+func (q hostSetQuery) String() string { return "hostset " + q.name }
+func (q hostSetQuery) base() bool     { return true }
+func (q hostSetQuery) RequiredIndexes() []indexfile.KeyType {
+	all := make(unionQuery, len(q.ranges))
+	for i, r := range q.ranges {
+		all[i] = r
+	}
+	return all.RequiredIndexes()
+}
+func (q hostSetQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+// loadHostSet reads the named file in the HostSetDirectory setting.  Each line
+// holds an IP or CIDR network; blank lines and anything following a '#' are
+// ignored.
+func loadHostSet(name string) (hostSetQuery, error) {
+	q := hostSetQuery{name: name}
+	dir := CurrentSettings().HostSetDirectory
+	if dir == "" {
+		return q, fmt.Errorf("hostset queries are not configured")
+	}
+	if name == "" || name != filepath.Base(name) || name[0] == '.' {
+		return q, fmt.Errorf("invalid hostset name %q", name)
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return q, fmt.Errorf("could not open hostset %q: %v", name, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		r, err := parseHostSetEntry(text)
+		if err != nil {
+			return q, fmt.Errorf("hostset %q line %d: %v", name, line, err)
+		}
+		q.ranges = append(q.ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return q, fmt.Errorf("could not read hostset %q: %v", name, err)
+	}
+	q.ranges = mergeIPRanges(q.ranges)
+	return q, nil
+}
+
+func parseHostSetEntry(s string) (ipQuery, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipQuery{}, fmt.Errorf("bad IP %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ipQuery{ip, ip}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipQuery{}, fmt.Errorf("bad network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	from, to, err := ipsFromNet(ip, ipnet.Mask)
+	if err != nil {
+		return ipQuery{}, err
+	}
+	return ipQuery{from, to}, nil
+}
+
+// mergeIPRanges sorts the given ranges and combines any that overlap or are
+// adjacent, so each index key is read at most once per lookup.
+func mergeIPRanges(in []ipQuery) []ipQuery {
+	sort.Sort(ipRanges(in))
+	var out []ipQuery
+	for _, r := range in {
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if len(last[1]) == len(r[0]) && bytes.Compare(nextIP(last[1]), r[0]) >= 0 {
+				if bytes.Compare(r[1], last[1]) > 0 {
+					last[1] = r[1]
+				}
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// ipRanges sorts IPv4 ranges before IPv6 ranges, then by starting address.
+type ipRanges []ipQuery
+
+func (r ipRanges) Len() int      { return len(r) }
+func (r ipRanges) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r ipRanges) Less(i, j int) bool {
+	if len(r[i][0]) != len(r[j][0]) {
+		return len(r[i][0]) < len(r[j][0])
+	}
+	return bytes.Compare(r[i][0], r[j][0]) < 0
+}
+
+// nextIP returns the IP following ip, or ip itself if it's the last address.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			return next
+		}
+	}
+	return ip
+}
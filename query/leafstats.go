@@ -0,0 +1,89 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+// Leaves beyond this many distinct ones aren't tracked, so queries over huge
+// numbers of distinct hosts can't grow memory without bound.
+const maxTrackedLeaves = 10000
+
+// LeafStat records how a single base query (a leaf of the query tree, like
+// "port 443") has fared in index lookups, one lookup per index file.
+type LeafStat struct {
+	Lookups   int64   // Number of index files this leaf was looked up in.
+	Hits      int64   // Number of those lookups that found any packets.
+	Positions int64   // Total packet positions found.
+	Nanos     int64   // Total time spent in lookups.
+	HitRate   float64 // Hits / Lookups.
+}
+
+var leafStats = struct {
+	sync.Mutex
+	m map[string]*LeafStat
+}{m: map[string]*LeafStat{}}
+
+func recordLeaf(q Query, positions base.Positions, d time.Duration) {
+	name := q.String()
+	leafStats.Lock()
+	defer leafStats.Unlock()
+	s := leafStats.m[name]
+	if s == nil {
+		if len(leafStats.m) >= maxTrackedLeaves {
+			return
+		}
+		s = &LeafStat{}
+		leafStats.m[name] = s
+	}
+	s.Lookups++
+	if len(positions) > 0 {
+		s.Hits++
+	}
+	if !positions.IsAllPositions() {
+		s.Positions += int64(len(positions))
+	}
+	s.Nanos += d.Nanoseconds()
+}
+
+// LeafStats returns statistics for every leaf looked up so far, keyed by the
+// leaf's String().
+func LeafStats() map[string]LeafStat {
+	leafStats.Lock()
+	defer leafStats.Unlock()
+	out := make(map[string]LeafStat, len(leafStats.m))
+	for name, s := range leafStats.m {
+		c := *s
+		c.HitRate = float64(c.Hits) / float64(c.Lookups)
+		out[name] = c
+	}
+	return out
+}
+
+// LeafHitRate returns the fraction of index files in which the given leaf
+// query has found packets, and false if it hasn't been looked up yet.
+func LeafHitRate(q Query) (float64, bool) {
+	leafStats.Lock()
+	defer leafStats.Unlock()
+	s := leafStats.m[q.String()]
+	if s == nil || s.Lookups == 0 {
+		return 0, false
+	}
+	return float64(s.Hits) / float64(s.Lookups), true
+}
@@ -36,6 +36,9 @@ import (
 	"strings"
 	"time"
 	"unicode"
+
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
 )
 
 %}
@@ -47,12 +50,22 @@ import (
 	query Query
 	dur time.Duration
 	time time.Time
+	bound timeBound
+	filter packetFilter
+	filters []packetFilter
 }
 
-%type	<query>	top expr expr2
-%type <time> timestamp
+%type	<query>	top expr expr2 filtered flows
+%type <bound> timestamp
+%type <num> sampleunit
+%type <filter> postfilter
+%type <filters> postfilters
 
-%token <str> HOST PORT PROTO AND OR NET MASK TCP UDP ICMP BEFORE AFTER IPP AGO VLAN MPLS BETWEEN
+%token <str> HOST PORT PROTO AND OR NET MASK BEFORE AFTER IPP AGO VLAN MPLS BETWEEN
+%token <str> ICMPTYPE ICMPCODE INNERVLAN DEPTH HOSTSET SAVEDQUERY DSCP LEN DOTDOT
+%token <str> SAMPLE PACKETS FLOWS IPFRAG BADCKSUM BPF STRING BIDIR
+%token <str> PAYLOAD PAYLOADHEX PAYLOADRE INNER THREAD IFACE COMMUNITYID
+%token <num> PROTONAME
 %token <ip> IP
 %token <num> NUM
 %token <dur> DURATION
@@ -61,10 +74,115 @@ import (
 %%
 
 top:
-   expr
+   flows
 {
 	parserlex.(*parserLex).out = $1
 }
+|   flows SAMPLE NUM '/' NUM sampleunit
+{
+	if $3 < 1 || $3 > $5 {
+		parserlex.Error(fmt.Sprintf("invalid sample rate %v/%v", $3, $5))
+	}
+	parserlex.(*parserLex).out = sampledQuery{$1, $3, $5, $6 == FLOWS}
+}
+
+flows:
+    filtered
+|   BIDIR filtered
+{
+	$$ = bidirQuery{Query: $2}
+}
+
+filtered:
+    expr
+|   expr AND postfilters
+{
+	q, err := newFilteredQuery($1, $3)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+|   postfilters
+{
+	q, err := newFilteredQuery(nil, $1)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+
+postfilters:
+    postfilter
+{
+	$$ = []packetFilter{$1}
+}
+|   postfilters AND postfilter
+{
+	$$ = append($1, $3)
+}
+
+postfilter:
+    INNER expr2
+{
+	ips, ok := $2.(ipQuery)
+	if !ok {
+		parserlex.Error("inner only supports host and net")
+	}
+	$$ = innerFilter(ips)
+}
+|   BPF STRING
+{
+	f, err := newBPFFilter($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = f
+}
+|   PAYLOAD STRING
+{
+	if $2 == "" {
+		parserlex.Error("empty payload")
+	}
+	$$ = payloadFilter{want: []byte($2)}
+}
+|   PAYLOADRE STRING
+{
+	f, err := newRegexpFilter($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = f
+}
+|   PAYLOADHEX
+{
+	f, err := newPayloadHexFilter($1)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = f
+}
+|   COMMUNITYID STRING
+{
+	f, err := newCommunityIDFilter($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = f
+}
+
+sampleunit:
+{
+	$$ = PACKETS
+}
+|   PACKETS
+{
+	$$ = PACKETS
+}
+|   FLOWS
+{
+	$$ = FLOWS
+}
 
 expr:
     expr2
@@ -96,6 +214,13 @@ expr2:
 	}
 	$$ = vlanQuery($2)
 }
+|   INNERVLAN NUM
+{
+	if $2 < 0 || $2 >= 4096 {
+		parserlex.Error(fmt.Sprintf("invalid inner-vlan %v", $2))
+	}
+	$$ = innerVLANQuery($2)
+}
 |   MPLS NUM
 {
 	if $2 < 0 || $2 >= (1 << 20) {
@@ -103,6 +228,16 @@ expr2:
 	}
 	$$ = mplsQuery($2)
 }
+|   MPLS NUM DEPTH NUM
+{
+	if $2 < 0 || $2 >= (1 << 20) {
+		parserlex.Error(fmt.Sprintf("invalid mpls %v", $2))
+	}
+	if $4 < 1 || $4 >= 256 {
+		parserlex.Error(fmt.Sprintf("invalid mpls depth %v", $4))
+	}
+	$$ = mplsDepthQuery{uint32($2), byte($4)}
+}
 |   IPP PROTO NUM
 {
 	if $3 < 0 || $3 >= 256 {
@@ -110,6 +245,63 @@ expr2:
 	}
 	$$ = protocolQuery($3)
 }
+|   ICMPTYPE NUM
+{
+	if $2 < 0 || $2 >= 256 {
+		parserlex.Error(fmt.Sprintf("invalid icmptype %v", $2))
+	}
+	$$ = icmpTypeQuery($2)
+}
+|   ICMPCODE NUM
+{
+	if $2 < 0 || $2 >= 256 {
+		parserlex.Error(fmt.Sprintf("invalid icmpcode %v", $2))
+	}
+	$$ = icmpCodeQuery($2)
+}
+|   DSCP NUM
+{
+	if $2 < 0 || $2 >= 64 {
+		parserlex.Error(fmt.Sprintf("invalid dscp %v", $2))
+	}
+	$$ = dscpQuery($2)
+}
+|   LEN NUM
+{
+	if $2 < 0 || $2 > maxLength {
+		parserlex.Error(fmt.Sprintf("invalid len %v", $2))
+	}
+	$$ = lengthQuery{uint16($2), uint16($2)}
+}
+|   LEN '>' NUM
+{
+	if $3 < 0 || $3 >= maxLength {
+		parserlex.Error(fmt.Sprintf("invalid len > %v", $3))
+	}
+	$$ = lengthQuery{uint16($3 + 1), maxLength}
+}
+|   LEN '<' NUM
+{
+	if $3 <= 0 || $3 > maxLength {
+		parserlex.Error(fmt.Sprintf("invalid len < %v", $3))
+	}
+	$$ = lengthQuery{0, uint16($3 - 1)}
+}
+|   LEN NUM DOTDOT NUM
+{
+	if $2 < 0 || $4 > maxLength || $2 > $4 {
+		parserlex.Error(fmt.Sprintf("invalid len %v..%v", $2, $4))
+	}
+	$$ = lengthQuery{uint16($2), uint16($4)}
+}
+|   IPFRAG
+{
+	$$ = flagQuery(indexfile.FlagIPFragment)
+}
+|   BADCKSUM
+{
+	$$ = flagQuery(indexfile.FlagBadIPChecksum)
+}
 |   NET IP '/' NUM
 {
 		mask := net.CIDRMask($4, len($2) * 8)
@@ -130,57 +322,100 @@ expr2:
 		}
 		$$ = ipQuery{from, to}
 }
-|   '(' expr ')'
+|   THREAD NUM
 {
-	$$ = $2
+	if $2 < 0 {
+		parserlex.Error(fmt.Sprintf("invalid thread %v", $2))
+	}
+	$$ = threadQuery($2)
 }
-|   TCP
+|   IFACE
 {
-	$$ = protocolQuery(6)
+	if $1 == "" {
+		parserlex.Error("missing iface name")
+	}
+	$$ = ifaceQuery($1)
 }
-|   UDP
+|   HOSTSET
 {
-	$$ = protocolQuery(17)
+	q, err := loadHostSet($1)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
 }
-|   ICMP
+|   SAVEDQUERY
 {
-	$$ = protocolQuery(1)
+	x := parserlex.(*parserLex)
+	q, err := expandSavedQuery($1, x.expanding, x.vars, x.now)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+|   '(' expr ')'
+{
+	$$ = $2
+}
+|   PROTONAME
+{
+	$$ = protocolQuery($1)
 }
 |   BEFORE timestamp
 {
 	var t timeQuery
-	t[1] = $2
+	t[1] = $2.t
 	$$ = t
 }
 |   AFTER timestamp
 {
 	var t timeQuery
-	t[0] = $2
+	t[0] = $2.t
 	$$ = t
 }
 |   BETWEEN timestamp AND timestamp
 {
-	if $2.After($4) {
-		parserlex.Error(fmt.Sprintf("first timestamp %s must be less than or equal to second timestamp %s", $2, $4))
+	// Either bound may be relative, so they can only be compared once both
+	// are resolved against now.
+	if $2.t.After($4.t) {
+		parserlex.Error(fmt.Sprintf("between start %v must not be after end %v", $2, $4))
 	}
 	var t timeQuery
-	t[0] = $2
-	t[1] = $4
+	t[0] = $2.t
+	t[1] = $4.t
 	$$ = t
 }
 
 timestamp:
     TIME
 {
-	$$ = $1
+	$$ = timeBound{t: $1}
 }
 |   DURATION AGO
 {
-	$$ = parserlex.(*parserLex).now.Add(-$1)
+	$$ = timeBound{t: parserlex.(*parserLex).now.Add(-$1), ago: $1}
 }
 
 %%
 
+// timeBound is a time given in a query, either absolute or relative to when
+// the query was parsed.
+type timeBound struct {
+	t   time.Time
+	ago time.Duration // If non-zero, t was given as this long ago.
+}
+
+func (b timeBound) String() string {
+	if b.ago != 0 {
+		return fmt.Sprintf("%v ago (%s)", b.ago, b.t.UTC().Format(time.RFC3339))
+	}
+	return b.t.Format(time.RFC3339)
+}
+
+// maxLength is the largest packet length stenotype indexes.  Longer packets
+// are indexed as this length.
+const maxLength = 65535
+
 func ipsFromNet(ip net.IP, mask net.IPMask) (from, to net.IP, _ error) {
 	if len(ip) != len(mask) || (len(ip) != 4 && len(ip) != 16) {
 		return nil, nil, fmt.Errorf("bad IP or mask: %v %v", ip, mask)
@@ -203,6 +438,9 @@ type parserLex struct {
 	pos int
 	out Query
 	err error
+	expanding []string  // saved queries being expanded, to detect cycles
+	vars map[string]string  // values of $name variables
+	version int  // if set, the query language version to restrict keywords to
 }
 
 // tokens provides a simple map for adding new keywords and mapping them
@@ -214,7 +452,10 @@ var tokens = map[string]int{
  "and": AND,
  "before": BEFORE,
  "host": HOST,
- "icmp": ICMP,
+ "hostset": HOSTSET,
+ "query": SAVEDQUERY,
+ "icmptype": ICMPTYPE,
+ "icmpcode": ICMPCODE,
  "ip": IPP,
  "mask": MASK,
  "net": NET,
@@ -222,102 +463,210 @@ var tokens = map[string]int{
  "or": OR,
  "port": PORT,
  "vlan": VLAN,
+ "inner-vlan": INNERVLAN,
  "mpls": MPLS,
+ "depth": DEPTH,
+ "dscp": DSCP,
+ "len": LEN,
+ "sample": SAMPLE,
+ "packets": PACKETS,
+ "flows": FLOWS,
+ "ipfrag": IPFRAG,
+ "badcksum": BADCKSUM,
+ "bpf": BPF,
+ "bidir": BIDIR,
+ "payload": PAYLOAD,
+ "payloadhex": PAYLOADHEX,
+ "payloadre": PAYLOADRE,
+ "inner": INNER,
+ "thread": THREAD,
+ "iface": IFACE,
+ "communityid": COMMUNITYID,
+ "..": DOTDOT,
  "proto": PROTO,
- "tcp": TCP,
- "udp": UDP,
  "between": BETWEEN,
 }
 
+// protocols maps protocol names usable as shorthand for 'ip proto N' to their
+// IP protocol numbers.  Names added here need no grammar changes.
+var protocols = map[string]int{
+ "icmp": 1,
+ "tcp": 6,
+ "udp": 17,
+ "gre": 47,
+ "esp": 50,
+ "ah": 51,
+ "icmp6": 58,
+ "sctp": 132,
+}
+
 // Lex is called by the parser to get each new token.  This implementation
 // is currently quite simplistic, but it seems to work pretty well for our
 // needs.
 //
 // The type of the input argument must be *<prefix>SymType.
 func (x *parserLex) Lex(yylval *parserSymType) (ret int) {
-	for x.pos < len(x.in) && unicode.IsSpace(rune(x.in[x.pos])) {
-		x.pos++
+	if !x.skipSpaceAndComments() {
+		return -1
+	}
+	if x.pos < len(x.in) && x.in[x.pos] == '$' {
+		return x.lexVariable(yylval)
 	}
-	for t, i := range tokens {
-		if strings.HasPrefix(x.in[x.pos:], t) {
+	if x.pos < len(x.in) && x.in[x.pos] == '"' {
+		end := strings.IndexByte(x.in[x.pos+1:], '"')
+		if end < 0 {
+			x.Error("unterminated string")
+			return -1
+		}
+		yylval.str = x.in[x.pos+1 : x.pos+1+end]
+		x.pos += end + 2
+		return STRING
+	}
+	for t, tok := range tokens {
+		if !isWordChar(t[0]) && strings.HasPrefix(x.in[x.pos:], t) {
 			x.pos += len(t)
-			return i
+			return tok
 		}
 	}
 	s := x.pos
-	var isIP, isDuration, isTime bool
-L:
-	for x.pos < len(x.in) {
-		switch c := x.in[x.pos]; c {
-		case ':', '.':
-			isIP = true
-			x.pos++
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
-			x.pos++
-		case 'm', 'h':
-			x.pos++
-			isDuration = true
-			break L
-		case '-', 'T', '+', 'Z':
-			x.pos++
-			isTime = true
-		default:
-			break L
+	for x.pos < len(x.in) && isTokenChar(x.in[x.pos]) && !strings.HasPrefix(x.in[x.pos:], "..") {
+		x.pos++
+	}
+	if word := x.in[s:x.pos]; word != "" && word != "." && word != ":" {
+		return x.lexWord(yylval, s, word)
+	}
+	x.pos = s
+	if x.pos >= len(x.in) {
+		return 0
+	}
+	switch c := x.in[x.pos]; c {
+	case ':', '.', '(', ')', '/', '<', '>':
+		x.pos++
+		return int(c)
+	}
+	x.unsupportedWord()
+	return -1
+}
+
+// isTokenChar returns true for characters that can be part of a keyword, IP,
+// number, duration or time.
+func isTokenChar(c byte) bool {
+	return isWordChar(c) || c == ':' || c == '.' || c == '+'
+}
+
+// lexWord classifies a whole word starting at start, which Lex has just
+// consumed.  Classifying the word as a whole, rather than by its first few
+// characters, keeps an IPv6 address like 'cafe::1' or 'add::1' from being
+// mistaken for keywords or a duration, and allows durations like '1h30m'.
+func (x *parserLex) lexWord(yylval *parserSymType, start int, word string) int {
+	if proto, ok := protocols[word]; ok {
+		if !x.checkKeywordVersion(word) {
+			return -1
 		}
+		yylval.num = proto
+		return PROTONAME
 	}
-	part := x.in[s:x.pos]
-	switch {
-	case isTime:
-		t, err := time.Parse(time.RFC3339, part)
-		if err != nil {
-			x.Error(fmt.Sprintf("bad time %q", part))
+	if t, ok := tokens[word]; ok {
+		if !x.checkKeywordVersion(word) {
+			return -1
 		}
+		if t == HOSTSET || t == SAVEDQUERY || t == PAYLOADHEX || t == IFACE {
+			// The name following these keywords is part of the token, since
+			// it'd otherwise be lexed as a mix of keywords and numbers.
+			for x.pos < len(x.in) && unicode.IsSpace(rune(x.in[x.pos])) {
+				x.pos++
+			}
+			s := x.pos
+			for x.pos < len(x.in) && !unicode.IsSpace(rune(x.in[x.pos])) && x.in[x.pos] != ')' {
+				x.pos++
+			}
+			yylval.str = x.wordVariable(x.in[s:x.pos])
+		}
+		return t
+	}
+	if t, err := time.Parse(time.RFC3339, word); err == nil {
 		yylval.time = t
 		return TIME
-	case isIP:
-		yylval.ip = net.ParseIP(part)
-		if yylval.ip == nil {
-			x.Error(fmt.Sprintf("bad IP %q", part))
-			return -1
-		}
-		if ip4 := yylval.ip.To4(); ip4 != nil {
-			yylval.ip = ip4
+	}
+	if ip := net.ParseIP(word); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
 		}
+		yylval.ip = ip
 		return IP
-	case isDuration:
-		duration, err := time.ParseDuration(part)
-		if err != nil {
-			x.Error(fmt.Sprintf("bad duration %q", part))
-		}
-		yylval.dur = duration
-		return DURATION
-	case x.pos != s:
-		n, err := strconv.Atoi(part)
-		if err != nil { return -1 }
+	}
+	digit := word[0] >= '0' && word[0] <= '9'
+	if n, err := strconv.Atoi(word); err == nil && digit {
 		yylval.num = n
 		return NUM
-	case x.pos >= len(x.in):
-		return 0
 	}
-	switch c := x.in[x.pos]; c {
-	case ':', '.', '(', ')', '/':
-		x.pos++
-		return int(c)
+	if d, err := time.ParseDuration(word); err == nil && digit {
+		yylval.dur = d
+		return DURATION
+	}
+	unit := strings.TrimLeft(word, "0123456789.")
+	switch {
+	case digit && strings.Contains(word, "-"):
+		x.Error(fmt.Sprintf("bad time %q", word))
+	case digit && len(unit) == 1 && strings.Contains("smhdw", unit):
+		x.Error(fmt.Sprintf("bad duration %q (units are h, m and s)", word))
+	case strings.ContainsAny(word, ":."):
+		x.Error(fmt.Sprintf("bad IP %q", word))
+	case digit:
+		x.Error(fmt.Sprintf("bad number %q", word))
+	default:
+		x.pos = start
+		x.unsupportedWord()
 	}
 	return -1
 }
 
+// skipSpaceAndComments advances past any whitespace, '# ...' comments running
+// to the end of the line, and '/* ... */' comments.  It returns false on an
+// unterminated comment.
+func (x *parserLex) skipSpaceAndComments() bool {
+	for x.pos < len(x.in) {
+		switch rest := x.in[x.pos:]; {
+		case unicode.IsSpace(rune(rest[0])):
+			x.pos++
+		case rest[0] == '#':
+			if end := strings.IndexByte(rest, '\n'); end >= 0 {
+				x.pos += end + 1
+			} else {
+				x.pos = len(x.in)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				x.Error("unterminated comment")
+				return false
+			}
+			x.pos += end + 4
+		default:
+			return true
+		}
+	}
+	return true
+}
+
 // Error is called by the parser on a parse error.
 func (x *parserLex) Error(s string) {
 	if x.err == nil {
-		x.err = fmt.Errorf("%v at character %v (%q HERE %q)", s, x.pos, x.in[:x.pos], x.in[x.pos:])
+		x.err = &ParseError{
+			Message:    s,
+			Position:   x.pos,
+			Input:      x.in,
+			Suggestion: suggestKeyword(wordAt(x.in, x.pos)),
+		}
 	}
 }
 
 // parse parses an input string into a Query.
-func parse(in string) (Query, error) {
-	lex := &parserLex{in: in, now: time.Now()}
-	parserParse(lex)
+func parse(in string, opts ParseOptions) (Query, error) {
+	lex := &parserLex{in: in, now: time.Now(), vars: opts.Vars, version: opts.LanguageVersion}
+	if lex.defineVariables() {
+		parserParse(lex)
+	}
 	if lex.err != nil {
 		return nil, lex.err
 	}
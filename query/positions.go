@@ -0,0 +1,219 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// positionIter yields sorted, unique packet positions one at a time, so set
+// operations can be combined without materializing intermediate results.
+type positionIter interface {
+	// next returns the next position, or false if there are no more.
+	next() (int64, bool)
+	// seek skips to the first position >= pos, returning it like next.
+	seek(pos int64) (int64, bool)
+}
+
+// iterIn returns an iterator over the positions q matches in index.  Unions
+// and intersections are merged lazily from their operands; other queries are
+// looked up in full.  If all is true, q matches every position in the index
+// and iter is nil.
+func iterIn(ctx context.Context, q Query, index *indexfile.IndexFile) (iter positionIter, all bool, _ error) {
+	switch q := q.(type) {
+	case unionQuery:
+		return q.iterIn(ctx, index)
+	case intersectQuery:
+		return q.iterIn(ctx, index)
+	}
+	pos, err := q.LookupIn(ctx, index)
+	if err != nil {
+		return nil, false, err
+	}
+	if pos.IsAllPositions() {
+		return nil, true, nil
+	}
+	return &sliceIter{p: pos}, false, nil
+}
+
+// collect reads all remaining positions from iter, stopping early if ctx is
+// done.
+func collect(ctx context.Context, iter positionIter) (base.Positions, error) {
+	if s, ok := iter.(*sliceIter); ok && s.i == 0 {
+		return s.p, nil // Nothing to merge, so don't copy.
+	}
+	var out base.Positions
+	for pos, ok := iter.next(); ok; pos, ok = iter.next() {
+		if len(out)%(1<<16) == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		out = append(out, pos)
+	}
+	return out, nil
+}
+
+// sliceIter iterates over already looked up positions.
+type sliceIter struct {
+	p base.Positions
+	i int
+}
+
+func (s *sliceIter) next() (int64, bool) {
+	if s.i >= len(s.p) {
+		return 0, false
+	}
+	s.i++
+	return s.p[s.i-1], true
+}
+
+// seek gallops forward from the current position, then binary searches, so
+// that skipping ahead by n positions costs O(log n).
+func (s *sliceIter) seek(pos int64) (int64, bool) {
+	lo, step := s.i, 1
+	for lo+step < len(s.p) && s.p[lo+step] < pos {
+		lo += step
+		step *= 2
+	}
+	hi := lo + step
+	if hi > len(s.p) {
+		hi = len(s.p)
+	}
+	s.i = lo + sort.Search(hi-lo, func(i int) bool { return s.p[lo+i] >= pos })
+	return s.next()
+}
+
+// unionIter does a k-way merge of its operands.
+type unionIter struct {
+	heads positionHeap
+	last  int64
+	begun bool
+}
+
+type positionHead struct {
+	pos  int64
+	iter positionIter
+}
+
+type positionHeap []positionHead
+
+func (h positionHeap) Len() int            { return len(h) }
+func (h positionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h positionHeap) Less(i, j int) bool  { return h[i].pos < h[j].pos }
+func (h *positionHeap) Push(x interface{}) { *h = append(*h, x.(positionHead)) }
+func (h *positionHeap) Pop() (x interface{}) {
+	x, *h = (*h)[len(*h)-1], (*h)[:len(*h)-1]
+	return x
+}
+
+func newUnionIter(iters []positionIter) *unionIter {
+	u := &unionIter{}
+	for _, iter := range iters {
+		if pos, ok := iter.next(); ok {
+			u.heads = append(u.heads, positionHead{pos, iter})
+		}
+	}
+	heap.Init(&u.heads)
+	return u
+}
+
+func (u *unionIter) next() (int64, bool) {
+	for len(u.heads) > 0 {
+		head := &u.heads[0]
+		pos := head.pos
+		if next, ok := head.iter.next(); ok {
+			head.pos = next
+			heap.Fix(&u.heads, 0)
+		} else {
+			heap.Pop(&u.heads)
+		}
+		if !u.begun || pos != u.last {
+			u.begun, u.last = true, pos
+			return pos, true
+		}
+	}
+	return 0, false
+}
+
+func (u *unionIter) seek(pos int64) (int64, bool) {
+	heads := u.heads
+	u.heads = u.heads[:0]
+	for _, h := range heads {
+		if h.pos < pos {
+			var ok bool
+			if h.pos, ok = h.iter.seek(pos); !ok {
+				continue
+			}
+		}
+		u.heads = append(u.heads, h)
+	}
+	heap.Init(&u.heads)
+	return u.next()
+}
+
+// intersectIter leapfrogs its operands past each other, seeking each to the
+// largest position seen so far until they all agree.
+type intersectIter struct {
+	iters []positionIter
+	cur   []int64 // The last position returned by each of iters.
+	last  int64   // The last position we returned.
+}
+
+func newIntersectIter(iters []positionIter) *intersectIter {
+	in := &intersectIter{iters: iters, cur: make([]int64, len(iters)), last: -1}
+	for i := range in.cur {
+		in.cur[i] = -1
+	}
+	return in
+}
+
+func (in *intersectIter) next() (int64, bool) {
+	return in.align(in.last + 1)
+}
+
+func (in *intersectIter) seek(pos int64) (int64, bool) {
+	if pos <= in.last {
+		pos = in.last + 1
+	}
+	return in.align(pos)
+}
+
+// align returns the first position >= target that all operands contain.
+func (in *intersectIter) align(target int64) (int64, bool) {
+	for {
+		agree := true
+		for i, iter := range in.iters {
+			if in.cur[i] < target {
+				pos, ok := iter.seek(target)
+				if !ok {
+					return 0, false
+				}
+				in.cur[i] = pos
+			}
+			if in.cur[i] > target {
+				target, agree = in.cur[i], false
+			}
+		}
+		if agree {
+			in.last = target
+			return target, true
+		}
+	}
+}
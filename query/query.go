@@ -19,6 +19,7 @@
 package query
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"path/filepath"
@@ -27,8 +28,10 @@ import (
 	"time"
 
 	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/indexfile"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
 	"golang.org/x/net/context"
 )
 
@@ -56,6 +59,9 @@ type Query interface {
 	base() bool
         // Get timespan i.e. first and last date in the query
         GetTimeSpan(time.Time, time.Time) (time.Time, time.Time)
+	// RequiredIndexes returns the types of index keys the query can't match
+	// any packets without, so lookups in indexes lacking them can be skipped.
+	RequiredIndexes() []indexfile.KeyType
 }
 
 func log(q Query, i *indexfile.IndexFile, bp *base.Positions, err *error) func() {
@@ -70,6 +76,9 @@ func log(q Query, i *indexfile.IndexFile, bp *base.Positions, err *error) func()
 		if q.base() {
 			indexBaseLookupsFinished.Increment()
 			indexBaseLookupNanos.IncrementBy(duration.Nanoseconds())
+			if *err == nil {
+				recordLeaf(q, *bp, duration)
+			}
 		} else {
 			indexSetLookupsFinished.Increment()
 			indexSetLookupNanos.IncrementBy(duration.Nanoseconds())
@@ -86,6 +95,9 @@ func (q portQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 }
 func (q portQuery) String() string { return fmt.Sprintf("port %d", q) }
 func (q portQuery) base() bool     { return true }
+func (q portQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.PortKeys}
+}
 func (q portQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
         return startTime, stopTime
 }
@@ -98,10 +110,28 @@ func (q vlanQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 }
 func (q vlanQuery) String() string { return fmt.Sprintf("vlan %d", q) }
 func (q vlanQuery) base() bool     { return true }
+func (q vlanQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.VLANKeys}
+}
 func (q vlanQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
         return startTime, stopTime
 }
 
+type innerVLANQuery uint16
+
+func (q innerVLANQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerVLANPositions(ctx, uint16(q))
+}
+func (q innerVLANQuery) String() string { return fmt.Sprintf("inner-vlan %d", q) }
+func (q innerVLANQuery) base() bool     { return true }
+func (q innerVLANQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.InnerVLANKeys}
+}
+func (q innerVLANQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
 type mplsQuery uint32
 
 func (q mplsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -110,6 +140,9 @@ func (q mplsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 }
 func (q mplsQuery) String() string { return fmt.Sprintf("mpls %d", q) }
 func (q mplsQuery) base() bool     { return true }
+func (q mplsQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.MPLSKeys}
+}
 func (q mplsQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
         return startTime, stopTime
 }
@@ -122,10 +155,117 @@ func (q protocolQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile)
 }
 func (q protocolQuery) String() string { return fmt.Sprintf("ip proto %d", q) }
 func (q protocolQuery) base() bool     { return true }
+func (q protocolQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.ProtoKeys}
+}
 func (q protocolQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
         return startTime, stopTime
 }
 
+type mplsDepthQuery struct {
+	label uint32
+	depth byte
+}
+
+func (q mplsDepthQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.MPLSDepthPositions(ctx, q.label, q.depth)
+}
+func (q mplsDepthQuery) String() string { return fmt.Sprintf("mpls %d depth %d", q.label, q.depth) }
+func (q mplsDepthQuery) base() bool     { return true }
+func (q mplsDepthQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.MPLSDepthKeys}
+}
+func (q mplsDepthQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+type icmpTypeQuery byte
+
+func (q icmpTypeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.ICMPTypePositions(ctx, byte(q))
+}
+func (q icmpTypeQuery) String() string { return fmt.Sprintf("icmptype %d", q) }
+func (q icmpTypeQuery) base() bool     { return true }
+func (q icmpTypeQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.ICMPTypeKeys}
+}
+func (q icmpTypeQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+type icmpCodeQuery byte
+
+func (q icmpCodeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.ICMPCodePositions(ctx, byte(q))
+}
+func (q icmpCodeQuery) String() string { return fmt.Sprintf("icmpcode %d", q) }
+func (q icmpCodeQuery) base() bool     { return true }
+func (q icmpCodeQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.ICMPCodeKeys}
+}
+func (q icmpCodeQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+type dscpQuery byte
+
+func (q dscpQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.DSCPPositions(ctx, byte(q))
+}
+func (q dscpQuery) String() string { return fmt.Sprintf("dscp %d", q) }
+func (q dscpQuery) base() bool     { return true }
+func (q dscpQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.DSCPKeys}
+}
+func (q dscpQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+// lengthQuery matches packets whose length on the wire is between its bounds,
+// inclusive.  Lengths are indexed in buckets, so lookups in rollups may fail
+// with indexfile.ErrNoPacketLengths, and fall back to the files' own indexes.
+type lengthQuery [2]uint16
+
+func (q lengthQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.LengthPositions(ctx, q[0], q[1])
+}
+func (q lengthQuery) String() string { return fmt.Sprintf("len %d..%d", q[0], q[1]) }
+func (q lengthQuery) base() bool     { return true }
+func (q lengthQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.LengthKeys}
+}
+func (q lengthQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+type flagQuery byte
+
+func (q flagQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.FlagPositions(ctx, byte(q))
+}
+func (q flagQuery) String() string {
+	switch q {
+	case indexfile.FlagIPFragment:
+		return "ipfrag"
+	case indexfile.FlagBadIPChecksum:
+		return "badcksum"
+	}
+	return fmt.Sprintf("flag %d", q)
+}
+func (q flagQuery) base() bool { return true }
+func (q flagQuery) RequiredIndexes() []indexfile.KeyType {
+	return []indexfile.KeyType{indexfile.FlagKeys}
+}
+func (q flagQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
 type ipQuery [2]net.IP
 
 func (q ipQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -134,6 +274,12 @@ func (q ipQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp b
 }
 func (q ipQuery) String() string { return fmt.Sprintf("host %v-%v", q[0], q[1]) }
 func (q ipQuery) base() bool     { return true }
+func (q ipQuery) RequiredIndexes() []indexfile.KeyType {
+	if len(q[0]) == 4 {
+		return []indexfile.KeyType{indexfile.IPv4Keys}
+	}
+	return []indexfile.KeyType{indexfile.IPv6Keys}
+}
 func (q ipQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
         return startTime, stopTime
 }
@@ -142,15 +288,29 @@ type unionQuery []Query
 
 func (a unionQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	var positions base.Positions
+	iter, all, err := a.iterIn(ctx, index)
+	switch {
+	case err != nil:
+		return nil, err
+	case all:
+		return base.AllPositions, nil
+	}
+	return collect(ctx, iter)
+}
+
+// iterIn merges the positions of all operands as they're read, so nested
+// unions (which the parser produces for 'a or b or c') and large unions like
+// bidirectional flow lookups don't build up intermediate results.
+func (a unionQuery) iterIn(ctx context.Context, index *indexfile.IndexFile) (positionIter, bool, error) {
+	var iters []positionIter
 	for _, query := range a {
-		pos, err := query.LookupIn(ctx, index)
-		if err != nil {
-			return nil, err
+		iter, all, err := iterIn(ctx, query, index)
+		if err != nil || all {
+			return nil, all, err
 		}
-		positions = positions.Union(pos)
+		iters = append(iters, iter)
 	}
-	return positions, nil
+	return newUnionIter(iters), false, nil
 }
 func (a unionQuery) String() string {
 	all := make([]string, len(a))
@@ -160,6 +320,24 @@ func (a unionQuery) String() string {
 	return "(" + strings.Join(all, " or ") + ")"
 }
 func (a unionQuery) base() bool { return false }
+func (a unionQuery) RequiredIndexes() []indexfile.KeyType {
+	// Only keys every alternative needs are required.
+	var out []indexfile.KeyType
+	for i, query := range a {
+		if i == 0 {
+			out = query.RequiredIndexes()
+			continue
+		}
+		var both []indexfile.KeyType
+		for _, t := range query.RequiredIndexes() {
+			if hasKeyType(out, t) {
+				both = append(both, t)
+			}
+		}
+		out = both
+	}
+	return out
+}
 func (a unionQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
 	for _, query := range a {
 		startTime, stopTime = query.GetTimeSpan(startTime, stopTime)
@@ -171,15 +349,38 @@ type intersectQuery []Query
 
 func (a intersectQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	positions := base.AllPositions
+	iter, all, err := a.iterIn(ctx, index)
+	switch {
+	case err != nil:
+		return nil, err
+	case all:
+		return base.AllPositions, nil
+	}
+	return collect(ctx, iter)
+}
+
+// iterIn intersects the positions of all operands as they're read, seeking
+// past runs of positions that can't match.  Once an operand is known to
+// match nothing, the rest aren't looked up at all.
+func (a intersectQuery) iterIn(ctx context.Context, index *indexfile.IndexFile) (positionIter, bool, error) {
+	var iters []positionIter
 	for _, query := range a {
-		pos, err := query.LookupIn(ctx, index)
-		if err != nil {
-			return nil, err
+		iter, all, err := iterIn(ctx, query, index)
+		switch {
+		case err != nil:
+			return nil, false, err
+		case all:
+			continue
+		}
+		if s, ok := iter.(*sliceIter); ok && len(s.p) == 0 {
+			return s, false, nil
 		}
-		positions = positions.Intersect(pos)
+		iters = append(iters, iter)
 	}
-	return positions, nil
+	if len(iters) == 0 {
+		return nil, true, nil
+	}
+	return newIntersectIter(iters), false, nil
 }
 func (a intersectQuery) String() string {
 	all := make([]string, len(a))
@@ -189,6 +390,17 @@ func (a intersectQuery) String() string {
 	return "(" + strings.Join(all, " and ") + ")"
 }
 func (a intersectQuery) base() bool { return false }
+func (a intersectQuery) RequiredIndexes() []indexfile.KeyType {
+	var out []indexfile.KeyType
+	for _, query := range a {
+		for _, t := range query.RequiredIndexes() {
+			if !hasKeyType(out, t) {
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
 func (a intersectQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
 	for _, query := range a {
 		startTime, stopTime = query.GetTimeSpan(startTime, stopTime)
@@ -196,14 +408,65 @@ func (a intersectQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (ti
 	return startTime, stopTime
 }
 
+// hasKeyType returns whether types contains t.
+func hasKeyType(types []indexfile.KeyType, t indexfile.KeyType) bool {
+	for _, u := range types {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
+
 type timeQuery [2]time.Time
 
+// ErrPartialRollup is returned when looking up a time query in a rollup
+// index, some but not all of whose files are in the queried time range.
+// Rollups can't tell which of their positions came from which time, so the
+// files' own indexes must be used instead.
+var ErrPartialRollup = errors.New("time range covers part of rollup index")
+
 func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	last := filepath.Base(index.Name())
+	// Indexes recording when their packets were captured can be checked
+	// exactly, rather than guessing from when the file was created.
+	if times := index.Times(); times != nil {
+		if !times.Overlaps(a[0], a[1]) {
+			v(2, "time query skipping %q, with packets from %v to %v", index.Name(), times.First, times.Last)
+			return base.NoPositions, nil
+		}
+		v(2, "time query using %q", index.Name())
+		return base.AllPositions, nil
+	}
+	files := index.RollupOf()
+	if files == nil {
+		files = []string{filepath.Base(index.Name())}
+	}
+	matched := 0
+	for _, name := range files {
+		match, err := a.matchesFile(name)
+		if err != nil {
+			return nil, err
+		} else if match {
+			matched++
+		}
+	}
+	switch matched {
+	case 0:
+		return base.NoPositions, nil
+	case len(files):
+		v(2, "time query using %q", index.Name())
+		return base.AllPositions, nil
+	}
+	return nil, ErrPartialRollup
+}
+
+// matchesFile returns whether the blockfile with the given name was created
+// within the query's time range.
+func (a timeQuery) matchesFile(last string) (bool, error) {
 	intval, err := strconv.ParseInt(last, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse basename %q: %v", last, err)
+		return false, fmt.Errorf("could not parse basename %q: %v", last, err)
 	}
 	fileTime := time.Unix(0, intval*1000) // converts micros -> nanos
 
@@ -221,19 +484,17 @@ func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 	if hasStartTime && hasStopTime {
 		// "between"
 		if fileTime.Before(startTime) || fileTime.After(stopTime) {
-			v(2, "time query \"between\" skipping %q", index.Name())
-			return base.NoPositions, nil
+			v(2, "time query \"between\" skipping %q", last)
+			return false, nil
 		}
 	} else if hasStartTime && fileTime.Before(startTime) {
-		v(2, "time query \"after\" skipping %q", index.Name())
-		return base.NoPositions, nil
+		v(2, "time query \"after\" skipping %q", last)
+		return false, nil
 	} else if hasStopTime && fileTime.After(stopTime) {
-		v(2, "time query \"before\" skipping %q", index.Name())
-		return base.NoPositions, nil
+		v(2, "time query \"before\" skipping %q", last)
+		return false, nil
 	}
-
-	v(2, "time query using %q", index.Name())
-	return base.AllPositions, nil
+	return true, nil
 }
 func (a timeQuery) String() string {
         if !a[0].IsZero() && !a[1].IsZero() {
@@ -264,6 +525,114 @@ func (a timeQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Ti
         }
         return startTime, stopTime
 }
+func (a timeQuery) RequiredIndexes() []indexfile.KeyType { return nil }
+
+// CacheKey returns a string identifying the index positions q matches, for
+// caching lookups.  It's like q's String, but covers only the index lookup of
+// post-filtered or sampled queries, and the current contents of hostsets.
+func CacheKey(q Query) string {
+	switch q := q.(type) {
+	case hostSetQuery:
+		return fmt.Sprintf("%v %v", q, q.ranges)
+	case unionQuery:
+		return setCacheKey(q, " or ")
+	case intersectQuery:
+		return setCacheKey(q, " and ")
+	case savedQuery:
+		return CacheKey(q.q)
+	case scopedQuery:
+		return fmt.Sprintf("(%v %v)", q.Query, q.match)
+	case filteredQuery:
+		return CacheKey(q.Query)
+	case bidirQuery:
+		return CacheKey(q.Query)
+	case sampledQuery:
+		return CacheKey(q.Query)
+	}
+	return q.String()
+}
+
+func setCacheKey(queries []Query, op string) string {
+	all := make([]string, len(queries))
+	for i, query := range queries {
+		all[i] = CacheKey(query)
+	}
+	return "(" + strings.Join(all, op) + ")"
+}
+
+// TimeSpan returns the time range q asks for, without the minute of padding
+// GetTimeSpan adds on either side.  Unbounded ends are zero.
+func TimeSpan(q Query) (start, stop time.Time) {
+	start, stop = q.GetTimeSpan(time.Time{}, time.Time{})
+	if !start.IsZero() {
+		start = start.Add(time.Minute)
+	}
+	if !stop.IsZero() {
+		stop = stop.Add(-time.Minute)
+	}
+	return start, stop
+}
+
+// After returns q, looking up only packets captured from around t on, for
+// resuming a query partway through.  It keeps q's post-filters, but packet
+// sampling depends on every packet q finds, so packet-sampled queries are
+// returned as is.
+func After(q Query, t time.Time) Query {
+	switch q := q.(type) {
+	case filteredQuery:
+		return filteredQuery{After(q.Query, t), q.filters}
+	case sampledQuery:
+		if q.flows {
+			q.Query = After(q.Query, t)
+		}
+		return q
+	}
+	return intersectQuery{q, timeQuery{t, time.Time{}}}
+}
+
+// Restrict returns q, limited to the packets that also match to, for
+// enforcing what a client may see.  Unlike After, sampled queries are
+// restricted too, and bidir queries only expand to flows that match to.  to
+// must be a plain index query, without post-filters, sampling or bidir.
+func Restrict(q, to Query) Query {
+	switch q := q.(type) {
+	case filteredQuery:
+		return filteredQuery{Restrict(q.Query, to), q.filters}
+	case sampledQuery:
+		q.Query = Restrict(q.Query, to)
+		return q
+	case bidirQuery:
+		if q.restrict != nil {
+			to = intersectQuery{q.restrict, to}
+		}
+		return bidirQuery{Restrict(q.Query, to), to}
+	}
+	return intersectQuery{q, to}
+}
+
+// Plain returns whether q is a plain index query, without post-filters,
+// sampling or bidir, so it can be used to Restrict others.
+func Plain(q Query) bool {
+	switch q := q.(type) {
+	case filteredQuery, sampledQuery, bidirQuery:
+		return false
+	case savedQuery:
+		return Plain(q.q)
+	case unionQuery:
+		for _, sub := range q {
+			if !Plain(sub) {
+				return false
+			}
+		}
+	case intersectQuery:
+		for _, sub := range q {
+			if !Plain(sub) {
+				return false
+			}
+		}
+	}
+	return true
+}
 
 // NewQuery parses the given query arg and returns a query object.
 // This query can then be passed into a blockfile to get out the set of packets
@@ -272,5 +641,5 @@ func (a timeQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Ti
 // Currently, we support one simple method of parsing a query, detailed in the
 // README.md file.  Returns an error if the query string is invalid.
 func NewQuery(query string) (Query, error) {
-	return parse(query)
+	return parse(query, ParseOptions{})
 }
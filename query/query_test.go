@@ -15,7 +15,25 @@
 package query
 
 import (
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/bpfutil"
+	"../bpfutil"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
 )
 
 func TestParsingValidQueries(t *testing.T) {
@@ -28,6 +46,41 @@ func TestParsingValidQueries(t *testing.T) {
 		"tcp",
 		"udp",
 		"icmp",
+		"sctp",
+		"gre",
+		"esp",
+		"ah",
+		"icmp6",
+		"icmp6 or icmp",
+		"icmptype 8",
+		"icmpcode 0",
+		"icmp and icmptype 3 and icmpcode 1",
+		"vlan 100 and inner-vlan 200",
+		"mpls 16",
+		"mpls 16 depth 2",
+		"mpls 16 depth 1 and mpls 300 depth 2",
+		"dscp 46",
+		"dscp 0 and udp",
+		"len > 1400",
+		"len < 64",
+		"len 0..128",
+		"len 60 or len>9000",
+		"udp and len 1000..1500",
+		"port 80 # web",
+		"# leading comment\nport 80",
+		"net 10.0.0.0/8 /* corp */ and /* not DNS */ port 53",
+		"port 80 or # TICKET-1234\n  port 443",
+		"udp sample 1/10",
+		"ipfrag",
+		"badcksum or ipfrag and udp",
+		"port 80 sample 1/100 flows",
+		"(port 80 or port 443) and after 3h ago sample 3/1000 packets",
+		"bidir host 1.2.3.4 and port 80",
+		"inner host 10.1.2.3",
+		"thread 2 and port 80",
+		"iface eth1 or iface eth2",
+		"port 4789 and inner net 10.0.0.0/8 and payload \"GET\"",
+		"bidir host 1.2.3.4 and len 1000..1500 sample 1/10 flows",
 		"before 45m ago",
 		"after 3h ago",
 		"after 2015-01-01T13:14:15Z",
@@ -39,6 +92,9 @@ func TestParsingValidQueries(t *testing.T) {
 		"(port 80 && after 2015-01-01T13:14:15Z) || (host 1.2.3.4 && before 2015-01-01T13:14:15Z)",
 		"between 2018-01-01T12:00:00Z and 2018-01-01T13:00:00Z",
 		"between 3h ago and 2h ago",
+		"between 2018-01-01T12:00:00Z and 3h ago",
+		"between 3h ago and 2100-01-01T00:00:00Z",
+		"between 90m ago and 1h ago and port 80",
 	} {
 		if q, err := NewQuery(test); err != nil {
 			t.Fatalf("could not parse valid query %q: %v", test, err)
@@ -56,9 +112,27 @@ func TestParsingInvalidQuery(t *testing.T) {
 		"port 77777 and port 8",
 		"protocol -1",
 		"protocol 256",
+		"icmptype 256",
+		"icmpcode -1",
+		"inner-vlan 4096",
+		"mpls 16 depth 0",
+		"mpls 16 depth 256",
+		"dscp 64",
+		"len > 65535",
+		"len < 0",
+		"len 128..0",
+		"len 0..65536",
+		"port 80 /* unterminated",
+		"# everything is a comment",
+		"port 80 sample 0/10",
+		"port 80 sample 11/10",
+		"sample 1/10",
+		"port 80 sample 1/10 and port 443",
 		"last 4",
 		"between 2h ago and 3h ago",
 		"between 2018-01-01T13:00:00Z and 2018-01-01T12:00:00Z",
+		"between 3h ago and 2018-01-01T12:00:00Z",
+		"between 2100-01-01T00:00:00Z and 3h ago",
 	} {
 		if q, err := NewQuery(test); err == nil {
 			t.Fatalf("parsed invalid query %q: %v", test, q)
@@ -67,3 +141,763 @@ func TestParsingInvalidQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestProtocolNames(t *testing.T) {
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"tcp", "ip proto 6"},
+		{"icmp", "ip proto 1"},
+		{"icmp6", "ip proto 58"},
+		{"sctp", "ip proto 132"},
+		{"gre", "ip proto 47"},
+		{"esp", "ip proto 50"},
+		{"ah", "ip proto 51"},
+		{"icmptype 3", "icmptype 3"},
+		{"inner-vlan 200", "inner-vlan 200"},
+		{"mpls 16 depth 2", "mpls 16 depth 2"},
+		{"dscp 46", "dscp 46"},
+		{"ipfrag", "ipfrag"},
+		{"badcksum", "badcksum"},
+		{"len > 1400", "len 1401..65535"},
+		{"len < 64", "len 0..63"},
+		{"len 0..128", "len 0..128"},
+		{"len 60", "len 60..60"},
+		{"port 53 sample 1/10", "port 53 sample 1/10 packets"},
+		{"port 53 sample 1/10 flows", "port 53 sample 1/10 flows"},
+	} {
+		if q, err := NewQuery(test.query); err != nil {
+			t.Errorf("could not parse %q: %v", test.query, err)
+		} else if got := q.String(); got != test.want {
+			t.Errorf("query %q parsed as %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestHostSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetSettings(CurrentSettings())
+	s := DefaultSettings
+	s.HostSetDirectory = dir
+	SetSettings(s)
+	contents := `# Known bad hosts.
+10.0.0.5
+10.0.0.0/24   # overlaps the above
+10.0.1.0/24
+192.168.1.1
+
+2001:db8::/32
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.txt"), []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.txt"), []byte("1.2.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQuery("hostset bad.txt and (port 80 or hostset bad.txt)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := q.(intersectQuery)[0].(hostSetQuery)
+	var got []string
+	for _, r := range hs.ranges {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"host 10.0.0.0-10.0.1.255",
+		"host 192.168.1.1-192.168.1.1",
+		"host 2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong hostset ranges.\nwant: %v\n got: %v", want, got)
+	}
+
+	for _, test := range []string{
+		"hostset missing.txt",
+		"hostset broken.txt",
+		"hostset ../bad.txt",
+		"hostset",
+	} {
+		if q, err := NewQuery(test); err == nil {
+			t.Errorf("parsed invalid query %q: %v", test, q)
+		}
+	}
+	SetSettings(DefaultSettings)
+	if q, err := NewQuery("hostset bad.txt"); err == nil {
+		t.Errorf("parsed hostset query with no HostSetDirectory: %v", q)
+	}
+}
+
+func TestLeafStats(t *testing.T) {
+	q := portQuery(12345)
+	if _, ok := LeafHitRate(q); ok {
+		t.Fatalf("got hit rate for leaf never looked up")
+	}
+	recordLeaf(q, base.Positions{1, 2, 3}, time.Millisecond)
+	recordLeaf(q, nil, time.Millisecond)
+	recordLeaf(q, base.AllPositions, time.Millisecond)
+	recordLeaf(q, base.Positions{4}, time.Millisecond)
+	if rate, ok := LeafHitRate(q); !ok || rate != 0.75 {
+		t.Errorf("got hit rate %v, %v, want 0.75", rate, ok)
+	}
+	want := LeafStat{Lookups: 4, Hits: 3, Positions: 4, Nanos: int64(4 * time.Millisecond), HitRate: 0.75}
+	if got := LeafStats()["port 12345"]; got != want {
+		t.Errorf("got leaf stats %+v, want %+v", got, want)
+	}
+}
+
+func TestSavedQueries(t *testing.T) {
+	f, err := ioutil.TempFile("", "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	defer SetSettings(CurrentSettings())
+	s := DefaultSettings
+	s.SavedQueriesPath = f.Name()
+	SetSettings(s)
+	if err := ioutil.WriteFile(f.Name(), []byte(`{
+		"dns": "port 53",
+		"corp-dns": "net 10.0.0.0/8 and query dns",
+		"loop-a": "port 1 or query loop-b",
+		"loop-b": "query loop-a",
+		"self": "query self",
+		"bad": "port 77777"
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQuery("query corp-dns or port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.String(), "(query corp-dns (host 10.0.0.0-10.255.255.255 and query dns port 53) or port 80)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, test := range []string{
+		"query loop-a",
+		"query self",
+		"query bad",
+		"query missing",
+	} {
+		if q, err := NewQuery(test); err == nil {
+			t.Errorf("parsed invalid query %q: %v", test, q)
+		} else {
+			t.Log(err)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, test := range []struct {
+		query      string
+		position   int
+		suggestion string
+	}{
+		{"prot 6", 0, "proto"},
+		{"pourt 80", 0, "port"},
+		{"hots 1.2.3.4", 0, "host"},
+		{"port 80 and vlna 3", 12, "vlan"},
+		{"port 77777", 10, ""},
+		{"tcp and", 7, ""},
+	} {
+		_, err := NewQuery(test.query)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("query %q got error %v, want *ParseError", test.query, err)
+			continue
+		}
+		if pe.Position != test.position || pe.Suggestion != test.suggestion {
+			t.Errorf("query %q got position %d suggestion %q, want %d %q", test.query, pe.Position, pe.Suggestion, test.position, test.suggestion)
+		}
+	}
+}
+
+func TestLexerCorpus(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/lexer_corpus.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			t.Fatalf("line %d: no tab", i+1)
+		}
+		query, err := strconv.Unquote(parts[0])
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		q, err := NewQuery(query)
+		switch want := parts[1]; {
+		case want == "error":
+			if err == nil {
+				t.Errorf("line %d: parsed invalid query %q: %v", i+1, query, q)
+			}
+		case err != nil:
+			t.Errorf("line %d: could not parse %q: %v", i+1, query, err)
+		case want != "ok" && q.String() != want:
+			t.Errorf("line %d: query %q got %q, want %q", i+1, query, q.String(), want)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"port 80", 100},
+		{"port 80 sample 1/10", 10},
+		{"port 80 sample 3/10 packets", 30},
+		{"port 80 sample 1/1 flows", 100},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := base.NewPacketChan(100)
+		for i := 0; i < 100; i++ {
+			in.Send(&base.Packet{Data: []byte{byte(i)}})
+		}
+		in.Close(nil)
+		out := Sample(context.Background(), q, in)
+		got := 0
+		for _ = range out.Receive() {
+			got++
+		}
+		if got != test.want {
+			t.Errorf("query %q returned %d of 100 packets, want %d", test.query, got, test.want)
+		}
+	}
+}
+
+func TestBPFFilter(t *testing.T) {
+	defer func(c func(string) (*bpfutil.Filter, error)) { compileBPF = c }(compileBPF)
+	compileBPF = func(expr string) (*bpfutil.Filter, error) {
+		// 'tcpdump -ddd ip' on an ethernet interface.
+		return bpfutil.FromHex("002800000000000c" + "0015000100000800" + "000600000000ffff" + "0006000000000000")
+	}
+	q, err := NewQuery(`port 80 and bpf "ip" sample 1/1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{`bpf "ip"`, `after 3h ago and bpf "ip"`, `(port 80 or after 3h ago) and bpf "ip"`} {
+		if _, err := NewQuery(bad); err == nil {
+			t.Errorf("bpf clause without an index query parsed: %q", bad)
+		}
+	}
+	in := base.NewPacketChan(10)
+	for _, ethertype := range []byte{0x00, 0xdd, 0x00} {
+		data := make([]byte, 34)
+		data[12], data[13] = 0x08, ethertype
+		if ethertype == 0xdd {
+			data[12] = 0x86
+		}
+		in.Send(&base.Packet{Data: data})
+	}
+	in.Close(nil)
+	got := 0
+	for _ = range Filter(context.Background(), q, in).Receive() {
+		got++
+	}
+	if got != 2 {
+		t.Errorf("filter returned %d of 3 packets, want 2", got)
+	}
+}
+
+func TestTimeSpan(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	stop := start.Add(time.Hour)
+	q, err := NewQuery("port 80 and between 2018-01-01T12:00:00Z and 2018-01-01T13:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStart, gotStop := TimeSpan(q); !gotStart.Equal(start) || !gotStop.Equal(stop) {
+		t.Errorf("got span %v -> %v, want %v -> %v", gotStart, gotStop, start, stop)
+	}
+	q, err = NewQuery("port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStart, gotStop := TimeSpan(q); !gotStart.IsZero() || !gotStop.IsZero() {
+		t.Errorf("unbounded query got span %v -> %v", gotStart, gotStop)
+	}
+}
+
+func TestAfter(t *testing.T) {
+	at := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"port 80", "(port 80 and after 2018-01-01T12:00:00Z)"},
+		{`port 80 and payload "GET"`, `(port 80 and after 2018-01-01T12:00:00Z) and payload "GET"`},
+		{"port 80 sample 1/10 flows", "(port 80 and after 2018-01-01T12:00:00Z) sample 1/10 flows"},
+		{"port 80 sample 1/10", "port 80 sample 1/10 packets"},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if got := After(q, at).String(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	to, err := NewQuery("net 1.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"port 80", "(port 80 and host 1.1.0.0-1.1.255.255)"},
+		{"port 80 or port 81", "((port 80 or port 81) and host 1.1.0.0-1.1.255.255)"},
+		{`port 80 and payload "GET"`, `(port 80 and host 1.1.0.0-1.1.255.255) and payload "GET"`},
+		{"port 80 sample 1/10", "(port 80 and host 1.1.0.0-1.1.255.255) sample 1/10 packets"},
+		{"bidir port 80", "bidir (port 80 and host 1.1.0.0-1.1.255.255)"},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if got := Restrict(q, to).String(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestPlain(t *testing.T) {
+	for query, want := range map[string]bool{
+		"vlan 20 or net 10.0.0.0/8":                  true,
+		"port 80 and (vlan 20 or vlan 21)":           true,
+		`port 80 and payload "GET"`:                  false,
+		"port 80 sample 1/10":                        false,
+		"bidir port 80":                              false,
+		"after 3m ago and (vlan 20 or host 1.1.1.1)": true,
+	} {
+		q, err := NewQuery(query)
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if got := Plain(q); got != want {
+			t.Errorf("%q: got %v, want %v", query, got, want)
+		}
+	}
+}
+
+func tcpPacket(t *testing.T, src, dst string, srcPort, dstPort uint16, payload string) *base.Packet {
+	eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort)}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return &base.Packet{Data: buf.Bytes()}
+}
+
+func TestFlowQuery(t *testing.T) {
+	q, err := NewQuery("bidir host 1.1.1.1 and port 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Bidirectional(q); !ok {
+		t.Fatalf("query %v not bidirectional", q)
+	}
+	in := base.NewPacketChan(10)
+	in.Send(tcpPacket(t, "1.1.1.1", "2.2.2.2", 80, 34567, ""))
+	in.Send(tcpPacket(t, "2.2.2.2", "1.1.1.1", 34567, 80, ""))
+	in.Send(tcpPacket(t, "1.1.1.1", "3.3.3.3", 80, 45678, ""))
+	in.Close(nil)
+	flows, err := FlowQuery(context.Background(), q, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := flows.(unionQuery); !ok || len(u) != 2 {
+		t.Errorf("got flow query %v, want a union of 2 flows", flows)
+	}
+
+	// Restricted bidir queries only expand to the packets they're allowed.
+	to, err := NewQuery("vlan 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in = base.NewPacketChan(10)
+	in.Send(tcpPacket(t, "1.1.1.1", "2.2.2.2", 80, 34567, ""))
+	in.Close(nil)
+	flows, err = FlowQuery(context.Background(), Restrict(q, to), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, ok := flows.(intersectQuery); !ok || len(i) != 2 || i[1] != to {
+		t.Errorf("got flow query %v, want it restricted to %v", flows, to)
+	}
+}
+
+func TestPayloadFilter(t *testing.T) {
+	packet := tcpPacket(t, "1.1.1.1", "2.2.2.2", 34567, 80, "GET / HTTP/1.1\r\n")
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{`port 80 and payload "GET /"`, 1},
+		{`port 80 and payload "POST /"`, 0},
+		{`port 80 and payloadhex 0x474554`, 1},
+		{`port 80 and payloadhex 474554 and payload "HTTP"`, 1},
+		{`port 80 and payloadhex 0xdeadbeef`, 0},
+		{`port 80 and payloadre "/^GET /(admin|login)?/"`, 1},
+		{`port 80 and payloadre "HTTP/1\.[01]"`, 1},
+		{`port 80 and payloadre "/^POST/"`, 0},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := base.NewPacketChan(1)
+		in.Send(packet)
+		in.Close(nil)
+		got := 0
+		for _ = range Filter(context.Background(), q, in).Receive() {
+			got++
+		}
+		if got != test.want {
+			t.Errorf("query %q returned %d packets, want %d", test.query, got, test.want)
+		}
+	}
+	for _, bad := range []string{`port 80 and payload ""`, `port 80 and payloadhex 0xabc`, `payload "GET"`, `port 80 and payloadre "/(/"`, `port 80 and payloadre "//"`} {
+		if _, err := NewQuery(bad); err == nil {
+			t.Errorf("invalid query %q parsed", bad)
+		}
+	}
+}
+
+func TestCommunityIDFilter(t *testing.T) {
+	// The Community ID spec's example flow, in each direction, and another.
+	packets := []*base.Packet{
+		tcpPacket(t, "128.232.110.120", "66.35.250.204", 34855, 80, ""),
+		tcpPacket(t, "66.35.250.204", "128.232.110.120", 80, 34855, ""),
+		tcpPacket(t, "128.232.110.120", "66.35.250.204", 34856, 80, ""),
+	}
+	q, err := NewQuery(`host 66.35.250.204 and communityid "1:LQU9qZlK+B5F3KDmev6m5PMibrg="`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := base.NewPacketChan(len(packets))
+	for _, p := range packets {
+		in.Send(p)
+	}
+	in.Close(nil)
+	var got []*base.Packet
+	for p := range Filter(context.Background(), q, in).Receive() {
+		got = append(got, p)
+	}
+	if len(got) != 2 || got[0] != packets[0] || got[1] != packets[1] {
+		t.Errorf("got %d packets, want the first 2", len(got))
+	}
+	for _, bad := range []string{`communityid "1:LQU9qZlK+B5F3KDmev6m5PMibrg="`, `port 80 and communityid "2:LQU9qZlK+B5F3KDmev6m5PMibrg="`, `port 80 and communityid "1:abc"`} {
+		if _, err := NewQuery(bad); err == nil {
+			t.Errorf("invalid query %q parsed", bad)
+		}
+	}
+}
+
+func TestPayloadScanLimit(t *testing.T) {
+	defer SetSettings(CurrentSettings())
+	s := DefaultSettings
+	s.MaxPayloadScanBytes = 10
+	SetSettings(s)
+	q, err := NewQuery(`port 80 and payload "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := tcpPacket(t, "1.1.1.1", "2.2.2.2", 34567, 80, "0123456789")
+	in := base.NewPacketChan(2)
+	in.Send(packet)
+	in.Send(packet)
+	in.Close(nil)
+	out := Filter(context.Background(), q, in)
+	for _ = range out.Receive() {
+	}
+	if out.Err() == nil {
+		t.Errorf("scanning past the payload limit didn't fail")
+	}
+}
+
+func TestRegexpPacketLimit(t *testing.T) {
+	defer SetSettings(CurrentSettings())
+	s := DefaultSettings
+	s.MaxRegexpPacketBytes = 4
+	SetSettings(s)
+	f, err := newRegexpFilter("/GET /")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, _ := f.matches(tcpPacket(t, "1.1.1.1", "2.2.2.2", 34567, 80, "GET /").Data); !match {
+		t.Errorf("regexp didn't match within the packet limit")
+	}
+	if match, n := f.matches(tcpPacket(t, "1.1.1.1", "2.2.2.2", 34567, 80, "....GET /").Data); match || n != 4 {
+		t.Errorf("regexp scanned past the packet limit: matched %v, scanned %d", match, n)
+	}
+}
+
+func TestInnerFilter(t *testing.T) {
+	q, err := NewQuery("inner net 10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQuery("inner port 80"); err == nil {
+		t.Errorf("inner port parsed")
+	}
+	mac := make(net.HardwareAddr, 6)
+	vxlan := func(inner string) *base.Packet {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("192.168.0.1"), DstIP: net.ParseIP("192.168.0.2")},
+			&layers.UDP{SrcPort: 12345, DstPort: 4789},
+			&layers.VXLAN{ValidIDFlag: true, VNI: 1},
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(inner), DstIP: net.ParseIP("10.2.0.1")},
+			&layers.TCP{SrcPort: 80, DstPort: 34567},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return &base.Packet{Data: buf.Bytes()}
+	}
+	in := base.NewPacketChan(3)
+	in.Send(vxlan("10.1.2.3"))
+	in.Send(vxlan("10.3.2.1"))
+	in.Send(tcpPacket(t, "10.1.2.3", "10.2.0.1", 80, 34567, ""))
+	in.Close(nil)
+	got := 0
+	for _ = range Filter(context.Background(), q, in).Receive() {
+		got++
+	}
+	if got != 1 {
+		t.Errorf("inner filter returned %d of 3 packets, want 1", got)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		vars  map[string]string
+		want  string
+	}{
+		{"$victim = 10.0.0.5; host $victim and port 445", nil, "(host 10.0.0.5-10.0.0.5 and port 445)"},
+		{"host $victim and port $port", map[string]string{"victim": "10.0.0.5", "port": "445"}, "(host 10.0.0.5-10.0.0.5 and port 445)"},
+		{"$port = 53; port $port", map[string]string{"port": "445"}, "port 53"},
+		{`$needle = "a;b"; port 80 and payload $needle`, nil, `port 80 and payload "a;b"`},
+		{"port 80 and payload $needle", map[string]string{"needle": "x\" or port 22"}, `port 80 and payload "x\" or port 22"`},
+	} {
+		q, err := ParseWithVars(test.query, test.vars)
+		if err != nil {
+			t.Errorf("query %q: %v", test.query, err)
+			continue
+		}
+		if got := q.String(); got != test.want {
+			t.Errorf("query %q got %q, want %q", test.query, got, test.want)
+		}
+	}
+	for _, test := range []struct {
+		query string
+		vars  map[string]string
+	}{
+		{"host $victim", nil},
+		{"$victim = 10.0.0.5 host $victim", nil},
+		{"host $victim", map[string]string{"victim": "10.0.0.5 or port 22"}},
+		{"port $port", map[string]string{"port": "80) or (port 22"}},
+	} {
+		if _, err := ParseWithVars(test.query, test.vars); err == nil {
+			t.Errorf("query %q with vars %v parsed", test.query, test.vars)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	q, err := NewQuery("(iface eth1 and port 80) or (thread 2 and port 443)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		thread int
+		iface  string
+		want   []bool // Whether each scope clause matches.
+	}{
+		{0, "eth1", []bool{true, false}},
+		{2, "eth0", []bool{false, true}},
+		{1, "eth0", []bool{false, false}},
+	} {
+		scoped := Scope(q, test.thread, test.iface).(unionQuery)
+		for i, want := range test.want {
+			if got := scoped[i].(intersectQuery)[0].(scopedQuery).match; got != want {
+				t.Errorf("thread %d iface %q clause %d got match %v, want %v", test.thread, test.iface, i, got, want)
+			}
+		}
+	}
+	if _, err := NewQuery(`thread 1 and payload "x"`); err == nil {
+		t.Errorf("payload filter over a whole thread parsed")
+	}
+}
+
+func TestNewQueryExplained(t *testing.T) {
+	_, e, err := NewQueryExplained("(port 80 or port 443) and after 2018-01-01T12:00:00Z sample 1/10", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ExplainNode{Type: "sampled", Value: "sample 1/10 packets", Children: []*ExplainNode{
+		{Type: "intersect", Children: []*ExplainNode{
+			{Type: "union", Children: []*ExplainNode{
+				{Type: "port", Value: "port 80"},
+				{Type: "port", Value: "port 443"},
+			}},
+			{Type: "time", Value: "after 2018-01-01T12:00:00Z"},
+		}},
+	}}
+	if !reflect.DeepEqual(e.AST, want) {
+		t.Errorf("got AST %+v, want %+v", e.AST, want)
+	}
+	if e.Start == nil || !e.Start.Equal(time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)) || e.Stop != nil {
+		t.Errorf("got time window %v -> %v", e.Start, e.Stop)
+	}
+}
+
+func TestLanguageVersion(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		version int
+		ok      bool
+	}{
+		{"host 1.2.3.4 and port 80", 1, true},
+		{"tcp and after 3h ago", 1, true},
+		{"dscp 10", 1, false},
+		{"port 80 and ip proto sctp", 1, false},
+		{"dscp 10", 2, true},
+		{"dscp 10", 0, true},
+		{`port 80 and communityid "1:LQU9qZlK+B5F3KDmev6m5PMibrg="`, 2, false},
+		{`port 80 and communityid "1:LQU9qZlK+B5F3KDmev6m5PMibrg="`, 3, true},
+		{"port 80", LanguageVersion + 1, false},
+	} {
+		_, err := ParseWithOptions(test.query, ParseOptions{LanguageVersion: test.version})
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("query %q at version %d: got error %v", test.query, test.version, err)
+		}
+	}
+	if v := Keywords()["bidir"]; v != 2 {
+		t.Errorf("bidir got version %d, want 2", v)
+	}
+	if v := Keywords()["host"]; v != 1 {
+		t.Errorf("host got version %d, want 1", v)
+	}
+}
+
+func TestUnsupportedKeyword(t *testing.T) {
+	for _, query := range []string{"src host 1.2.3.4", "not port 80", "port 80 and dst port 22"} {
+		_, err := NewQuery(query)
+		if err == nil || !strings.Contains(err.Error(), "unsupported keyword") {
+			t.Errorf("query %q got error %v, want unsupported keyword", query, err)
+		}
+	}
+}
+
+func TestRequiredIndexes(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  []indexfile.KeyType
+	}{
+		{"vlan 100", []indexfile.KeyType{indexfile.VLANKeys}},
+		{"vlan 100 and port 80", []indexfile.KeyType{indexfile.VLANKeys, indexfile.PortKeys}},
+		{"(vlan 100 and port 80) or (vlan 200 and tcp)", []indexfile.KeyType{indexfile.VLANKeys}},
+		{"vlan 100 or port 80", nil},
+		{"host 1.2.3.4 or net 10.0.0.0/8", []indexfile.KeyType{indexfile.IPv4Keys}},
+		{"host ::1 and after 3h ago", []indexfile.KeyType{indexfile.IPv6Keys}},
+		{"after 3h ago", nil},
+		{"inner host 10.1.2.3", nil},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.RequiredIndexes(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("query %q got required indexes %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestBetweenResolvesRelativeBounds(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	lex := &parserLex{in: "between 2018-06-01T10:00:00Z and 1h ago", now: now}
+	if parserParse(lex) != 0 || lex.err != nil {
+		t.Fatalf("parse failed: %v", lex.err)
+	}
+	want := timeQuery{time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC), now.Add(-time.Hour)}
+	if got, ok := lex.out.(timeQuery); !ok || !got[0].Equal(want[0]) || !got[1].Equal(want[1]) {
+		t.Errorf("got %v, want %v", lex.out, want)
+	}
+
+	lex = &parserLex{in: "between 1h ago and 2018-06-01T10:00:00Z", now: now}
+	if parserParse(lex) == 0 && lex.err == nil {
+		t.Fatalf("parsed out of order bounds as %v", lex.out)
+	}
+	if want := "between start 1h0m0s ago (2018-06-01T11:00:00Z) must not be after end 2018-06-01T10:00:00Z"; !strings.Contains(lex.err.Error(), want) {
+		t.Errorf("got error %v, want %q", lex.err, want)
+	}
+}
+
+func randomPositions(r *rand.Rand, n int, max int64) base.Positions {
+	seen := map[int64]bool{}
+	var out base.Positions
+	for i := 0; i < n; i++ {
+		if pos := r.Int63n(max); !seen[pos] {
+			seen[pos] = true
+			out = append(out, pos)
+		}
+	}
+	out.Sort()
+	return out
+}
+
+func TestPositionIters(t *testing.T) {
+	ctx := context.Background()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var sets []base.Positions
+		for j := r.Intn(4) + 1; j > 0; j-- {
+			sets = append(sets, randomPositions(r, r.Intn(500), int64(r.Intn(2000)+1)))
+		}
+		wantUnion, wantIntersect := base.Positions(nil), base.AllPositions
+		var unionIters, intersectIters []positionIter
+		for _, set := range sets {
+			wantUnion = wantUnion.Union(set)
+			wantIntersect = wantIntersect.Intersect(set)
+			unionIters = append(unionIters, &sliceIter{p: set})
+			intersectIters = append(intersectIters, &sliceIter{p: set})
+		}
+		if got, _ := collect(ctx, newUnionIter(unionIters)); len(got)+len(wantUnion) > 0 && !reflect.DeepEqual(got, wantUnion) {
+			t.Errorf("union of %v: got %v, want %v", sets, got, wantUnion)
+		}
+		if got, _ := collect(ctx, newIntersectIter(intersectIters)); len(got)+len(wantIntersect) > 0 && !reflect.DeepEqual(got, wantIntersect) {
+			t.Errorf("intersection of %v: got %v, want %v", sets, got, wantIntersect)
+		}
+		// Nesting iterators exercises seeking within unions.
+		nested := newIntersectIter([]positionIter{
+			newUnionIter([]positionIter{&sliceIter{p: sets[0]}}),
+			&sliceIter{p: wantUnion},
+		})
+		if got, _ := collect(ctx, nested); len(got)+len(sets[0]) > 0 && !reflect.DeepEqual(got, sets[0]) {
+			t.Errorf("nested intersection of %v: got %v, want %v", sets[0], got, sets[0])
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// sampledQuery is a query whose results should be sampled, returning num out
+// of every den packets or flows.  Sampling happens on the packets read for
+// the wrapped query, by Sample.
+type sampledQuery struct {
+	Query
+	num, den int
+	flows    bool
+}
+
+func (q sampledQuery) String() string {
+	unit := "packets"
+	if q.flows {
+		unit = "flows"
+	}
+	return fmt.Sprintf("%v sample %d/%d %s", q.Query, q.num, q.den, unit)
+}
+
+// Sample returns the packets from in that should be returned for q.  If q
+// doesn't sample its results, in is returned as is.
+func Sample(ctx context.Context, q Query, in *base.PacketChan) *base.PacketChan {
+	sq, ok := q.(sampledQuery)
+	if !ok {
+		return in
+	}
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		var count uint64
+		for p := range in.Receive() {
+			if base.ContextDone(ctx) {
+				break
+			}
+			key := count
+			count++
+			if sq.flows {
+				key = flowHash(p.Data)
+			}
+			if key%uint64(sq.den) < uint64(sq.num) {
+				out.Send(p)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// flowHash returns a hash of the packet's flow, which is the same for packets
+// in either direction.
+func flowHash(data []byte) uint64 {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if net := pkt.NetworkLayer(); net != nil {
+		h := net.NetworkFlow().FastHash()
+		if transport := pkt.TransportLayer(); transport != nil {
+			h = h*31 + transport.TransportFlow().FastHash()
+		}
+		return h
+	}
+	if link := pkt.LinkLayer(); link != nil {
+		return link.LinkFlow().FastHash()
+	}
+	return 0
+}
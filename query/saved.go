@@ -0,0 +1,115 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// savedQuery is a saved query, expanded to its definition.
+type savedQuery struct {
+	name string
+	q    Query
+}
+
+func (q savedQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (base.Positions, error) {
+	return q.q.LookupIn(ctx, index)
+}
+func (q savedQuery) String() string { return fmt.Sprintf("query %s %v", q.name, q.q) }
+func (q savedQuery) base() bool     { return false }
+func (q savedQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return q.q.GetTimeSpan(startTime, stopTime)
+}
+func (q savedQuery) RequiredIndexes() []indexfile.KeyType { return q.q.RequiredIndexes() }
+
+// savedQueries caches the contents of the SavedQueriesPath setting.
+var savedQueries struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	defs    map[string]string
+}
+
+// savedQueryDefinition returns the query string saved under the given name,
+// rereading the SavedQueriesPath setting if it's changed.
+func savedQueryDefinition(name string) (string, error) {
+	path := CurrentSettings().SavedQueriesPath
+	if path == "" {
+		return "", fmt.Errorf("saved queries are not configured")
+	}
+	savedQueries.Lock()
+	defer savedQueries.Unlock()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("could not stat saved queries: %v", err)
+	}
+	if savedQueries.path != path || !fi.ModTime().Equal(savedQueries.modTime) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read saved queries: %v", err)
+		}
+		var defs map[string]string
+		if err := json.Unmarshal(data, &defs); err != nil {
+			return "", fmt.Errorf("could not parse saved queries: %v", err)
+		}
+		v(1, "loaded %d saved queries from %q", len(defs), path)
+		savedQueries.path, savedQueries.modTime, savedQueries.defs = path, fi.ModTime(), defs
+	}
+	def, ok := savedQueries.defs[name]
+	if !ok {
+		return "", fmt.Errorf("no saved query %q", name)
+	}
+	return def, nil
+}
+
+// expandSavedQuery parses the saved query with the given name.  expanding
+// holds the names of saved queries currently being expanded, outermost first,
+// and is used to detect cycles.  Saved queries see the variables defined by
+// the query using them.
+func expandSavedQuery(name string, expanding []string, vars map[string]string, now time.Time) (Query, error) {
+	for _, n := range expanding {
+		if n == name {
+			return nil, fmt.Errorf("saved query cycle: %s -> %s", strings.Join(expanding, " -> "), name)
+		}
+	}
+	def, err := savedQueryDefinition(name)
+	if err != nil {
+		return nil, err
+	}
+	lex := &parserLex{
+		in:        def,
+		now:       now,
+		expanding: append(expanding[:len(expanding):len(expanding)], name),
+		vars:      vars,
+	}
+	if lex.defineVariables() {
+		parserParse(lex)
+	}
+	if lex.err != nil {
+		return nil, fmt.Errorf("saved query %q: %v", name, lex.err)
+	}
+	return savedQuery{name, lex.out}, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// threadQuery matches packets captured by a single stenotype thread.  Like
+// ifaceQuery, it can't be looked up in an index, and must be resolved per
+// thread with Scope first.
+type threadQuery int
+
+func (q threadQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (base.Positions, error) {
+	return nil, fmt.Errorf("%v not scoped to a thread", q)
+}
+func (q threadQuery) String() string { return fmt.Sprintf("thread %d", q) }
+func (q threadQuery) base() bool     { return false }
+func (q threadQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+func (q threadQuery) RequiredIndexes() []indexfile.KeyType { return nil }
+
+// ifaceQuery matches packets captured from a single network interface.
+type ifaceQuery string
+
+func (q ifaceQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (base.Positions, error) {
+	return nil, fmt.Errorf("%v not scoped to a thread", q)
+}
+func (q ifaceQuery) String() string { return fmt.Sprintf("iface %s", string(q)) }
+func (q ifaceQuery) base() bool     { return false }
+func (q ifaceQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+func (q ifaceQuery) RequiredIndexes() []indexfile.KeyType { return nil }
+
+// scopedQuery is a threadQuery or ifaceQuery resolved for a specific thread,
+// which matches either all of its packets or none.
+type scopedQuery struct {
+	Query
+	match bool
+}
+
+func (q scopedQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (base.Positions, error) {
+	if q.match {
+		return base.AllPositions, nil
+	}
+	return base.NoPositions, nil
+}
+
+// Scope returns q as it applies to packets captured by the given thread from
+// the given interface, resolving any thread and iface clauses.
+func Scope(q Query, thread int, iface string) Query {
+	switch q := q.(type) {
+	case threadQuery:
+		return scopedQuery{q, int(q) == thread}
+	case ifaceQuery:
+		return scopedQuery{q, string(q) == iface}
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		for i, sub := range q {
+			out[i] = Scope(sub, thread, iface)
+		}
+		return out
+	case intersectQuery:
+		out := make(intersectQuery, len(q))
+		for i, sub := range q {
+			out[i] = Scope(sub, thread, iface)
+		}
+		return out
+	case savedQuery:
+		return savedQuery{q.name, Scope(q.q, thread, iface)}
+	case filteredQuery:
+		return filteredQuery{Scope(q.Query, thread, iface), q.filters}
+	case bidirQuery:
+		q.Query = Scope(q.Query, thread, iface)
+		return q
+	case sampledQuery:
+		q.Query = Scope(q.Query, thread, iface)
+		return q
+	}
+	return q
+}
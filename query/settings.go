@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import "sync"
+
+// Settings configure how queries are parsed and filtered.  They're set from
+// the stenographer config, and may be changed while queries run.
+type Settings struct {
+	// HostSetDirectory is the directory 'hostset NAME' queries load their IP
+	// lists from.  If empty, hostset queries are rejected.
+	HostSetDirectory string
+	// SavedQueriesPath is a JSON file mapping saved query names to query
+	// strings, usable as 'query NAME'.  It's reread whenever it changes.  If
+	// empty, saved queries are rejected.
+	SavedQueriesPath string
+	// MaxPayloadScanBytes limits how many payload bytes the payload filters
+	// of a single query may scan, across all packets, before the query fails.
+	MaxPayloadScanBytes int64
+	// MaxRegexpPacketBytes limits how many bytes of each packet's payload
+	// payloadre clauses scan.
+	MaxRegexpPacketBytes int
+}
+
+// DefaultSettings are the settings until SetSettings changes them.
+var DefaultSettings = Settings{
+	MaxPayloadScanBytes:  1 << 30,
+	MaxRegexpPacketBytes: 1 << 16,
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   = DefaultSettings
+)
+
+// SetSettings replaces the settings.  Queries already parsed keep the
+// hostsets and saved queries they loaded, and queries already being filtered
+// their payload scan limit.
+func SetSettings(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = s
+}
+
+// CurrentSettings returns the settings in effect.
+func CurrentSettings() Settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// tunnelQuery finds all GRE, VXLAN, and Geneve packets.
+var tunnelQuery = unionQuery{protocolQuery(47), portQuery(4789), portQuery(6081)}
+
+// innerIPQuery finds tunneled packets with encapsulated IPs in a range.  It
+// uses the inner IP index where stenotype wrote one, and otherwise returns
+// every tunneled packet, so it must be paired with an innerFilter.
+type innerIPQuery ipQuery
+
+func (q innerIPQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	if !index.HasInnerIPs() {
+		return tunnelQuery.LookupIn(ctx, index)
+	}
+	return index.InnerIPPositions(ctx, q[0], q[1])
+}
+func (q innerIPQuery) String() string { return fmt.Sprintf("inner-index host %v-%v", q[0], q[1]) }
+func (q innerIPQuery) base() bool     { return true }
+func (q innerIPQuery) RequiredIndexes() []indexfile.KeyType {
+	return nil // Indexes without inner IPs fall back to finding all tunnels.
+}
+func (q innerIPQuery) GetTimeSpan(startTime time.Time, stopTime time.Time) (time.Time, time.Time) {
+	return startTime, stopTime
+}
+
+// innerFilter matches GRE, VXLAN, and Geneve packets with encapsulated IPs in
+// a range, by decapsulating them.
+type innerFilter ipQuery
+
+func (f innerFilter) String() string { return fmt.Sprintf("inner host %v-%v", f[0], f[1]) }
+func (f innerFilter) index() Query   { return innerIPQuery(f) }
+func (f innerFilter) matches(data []byte) (bool, int) {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	inner := false
+	for _, layer := range pkt.Layers() {
+		switch l := layer.(type) {
+		case *layers.GRE, *layers.VXLAN, *layers.Geneve:
+			inner = true
+		case *layers.IPv4:
+			if inner && (f.contains(l.SrcIP) || f.contains(l.DstIP)) {
+				return true, 0
+			}
+		case *layers.IPv6:
+			if inner && (f.contains(l.SrcIP) || f.contains(l.DstIP)) {
+				return true, 0
+			}
+		}
+	}
+	return false, 0
+}
+
+func (f innerFilter) contains(ip net.IP) bool {
+	if len(f[0]) == 4 {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	return ip != nil && bytes.Compare(ip, f[0]) >= 0 && bytes.Compare(ip, f[1]) <= 0
+}
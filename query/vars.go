@@ -0,0 +1,142 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseWithVars parses the given query like NewQuery, substituting $name
+// references with values from vars.  Each value stands for a single IP,
+// number, duration, time or string, never for query syntax, so values from
+// untrusted sources can't change the structure of the query.
+func ParseWithVars(query string, vars map[string]string) (Query, error) {
+	return parse(query, ParseOptions{Vars: vars})
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || c == '-' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+// variableName reads a $name at the current position, returning "" if there
+// isn't one.
+func (x *parserLex) variableName() string {
+	if x.pos >= len(x.in) || x.in[x.pos] != '$' {
+		return ""
+	}
+	s := x.pos + 1
+	e := s
+	for e < len(x.in) && isVariableChar(x.in[e]) {
+		e++
+	}
+	if e == s {
+		return ""
+	}
+	x.pos = e
+	return x.in[s:e]
+}
+
+// defineVariables reads '$name = value;' definitions from the start of the
+// query.  Values run to the next ';', or may be double-quoted.  It returns
+// false on error.
+func (x *parserLex) defineVariables() bool {
+	for x.skipSpaceAndComments() {
+		start := x.pos
+		name := x.variableName()
+		if name == "" {
+			return true
+		}
+		x.skipSpaceAndComments()
+		if x.pos >= len(x.in) || x.in[x.pos] != '=' {
+			// A query starting with a variable reference, not a definition.
+			x.pos = start
+			return true
+		}
+		x.pos++
+		x.skipSpaceAndComments()
+		var value string
+		if x.pos < len(x.in) && x.in[x.pos] == '"' {
+			end := strings.IndexByte(x.in[x.pos+1:], '"')
+			if end < 0 {
+				x.Error("unterminated string")
+				return false
+			}
+			value = x.in[x.pos+1 : x.pos+1+end]
+			x.pos += end + 2
+			x.skipSpaceAndComments()
+			if x.pos >= len(x.in) || x.in[x.pos] != ';' {
+				x.Error(fmt.Sprintf("missing ';' after definition of $%s", name))
+				return false
+			}
+		} else {
+			end := strings.IndexByte(x.in[x.pos:], ';')
+			if end < 0 {
+				x.Error(fmt.Sprintf("missing ';' after definition of $%s", name))
+				return false
+			}
+			value = strings.TrimSpace(x.in[x.pos : x.pos+end])
+			x.pos += end
+		}
+		x.pos++ // Skip the ';'.
+		vars := map[string]string{name: value}
+		for k, v := range x.vars {
+			if k != name {
+				vars[k] = v
+			}
+		}
+		x.vars = vars
+	}
+	return false
+}
+
+// wordVariable substitutes a $name used as the name lexed as part of a
+// keyword token, like 'hostset $name'.  Other words are returned as is.
+func (x *parserLex) wordVariable(word string) string {
+	if !strings.HasPrefix(word, "$") {
+		return word
+	}
+	value, ok := x.vars[word[1:]]
+	if !ok {
+		x.Error(fmt.Sprintf("undefined variable %s", word))
+	}
+	return value
+}
+
+// lexVariable lexes a $name reference into the single token its value
+// stands for.  Values that aren't an IP, number, duration or time are
+// strings.
+func (x *parserLex) lexVariable(yylval *parserSymType) int {
+	start := x.pos
+	name := x.variableName()
+	value, ok := x.vars[name]
+	if !ok {
+		x.pos = start
+		x.Error(fmt.Sprintf("undefined variable $%s", name))
+		return -1
+	}
+	sub := &parserLex{in: value, now: x.now}
+	var val parserSymType
+	switch tok := sub.Lex(&val); tok {
+	case IP, NUM, DURATION, TIME:
+		if sub.skipSpaceAndComments() && sub.pos == len(value) && sub.err == nil {
+			*yylval = val
+			return tok
+		}
+	}
+	yylval.str = value
+	return STRING
+}
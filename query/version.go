@@ -0,0 +1,93 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// LanguageVersion is the version of the query language this package parses.
+// It should be incremented whenever keywords are added, and the new keywords
+// added to keywordVersions.
+const LanguageVersion = 3
+
+// keywordVersions holds the language version each keyword (or protocol name)
+// was added in, if later than version 1.
+var keywordVersions = map[string]int{
+	"hostset": 2, "query": 2, "icmptype": 2, "icmpcode": 2, "inner-vlan": 2,
+	"depth": 2, "dscp": 2, "len": 2, "..": 2, "sample": 2, "packets": 2,
+	"flows": 2, "ipfrag": 2, "badcksum": 2, "bpf": 2, "bidir": 2,
+	"payload": 2, "payloadhex": 2, "payloadre": 2, "inner": 2, "thread": 2,
+	"iface": 2, "gre": 2, "esp": 2, "ah": 2, "icmp6": 2, "sctp": 2,
+	"communityid": 3,
+}
+
+// ParseOptions control how a query is parsed.
+type ParseOptions struct {
+	// LanguageVersion, if set, rejects keywords added in later versions of
+	// the query language, so clients can rely on queries parsing the same
+	// way across servers.
+	LanguageVersion int
+	// Vars holds the values of $name variables, as for ParseWithVars.
+	Vars map[string]string
+}
+
+// ParseWithOptions parses the given query like NewQuery, with options.
+func ParseWithOptions(query string, opts ParseOptions) (Query, error) {
+	if opts.LanguageVersion > LanguageVersion {
+		return nil, fmt.Errorf("query language version %d requested, but this server only supports version %d", opts.LanguageVersion, LanguageVersion)
+	}
+	return parse(query, opts)
+}
+
+// Keywords returns every keyword and protocol name in the query language,
+// mapped to the language version it was added in.  Clients can use it to
+// check whether a server supports the features a query needs.
+func Keywords() map[string]int {
+	out := map[string]int{}
+	for k := range tokens {
+		out[k] = keywordVersion(k)
+	}
+	for p := range protocols {
+		out[p] = keywordVersion(p)
+	}
+	return out
+}
+
+func keywordVersion(keyword string) int {
+	if v, ok := keywordVersions[keyword]; ok {
+		return v
+	}
+	return 1
+}
+
+// checkKeywordVersion reports an error if keyword was added after the
+// language version the query is being parsed with.
+func (x *parserLex) checkKeywordVersion(keyword string) bool {
+	if v := keywordVersion(keyword); x.version > 0 && v > x.version {
+		x.Error(fmt.Sprintf("keyword %q needs query language version %d, but version %d was requested", keyword, v, x.version))
+		return false
+	}
+	return true
+}
+
+// unsupportedWord reports an error for a word at the current position that
+// isn't part of the query language.
+func (x *parserLex) unsupportedWord() {
+	if word := wordAt(x.in, x.pos); word != "" && unicode.IsLetter(rune(word[0])) {
+		x.Error(fmt.Sprintf("unsupported keyword %q on this server (query language version %d)", word, LanguageVersion))
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package querystats keeps a long-term record of query executions in a local
+// SQLite database, for capacity planning and abuse detection.  Only metadata
+// about each query is stored, never the packets it returned.
+package querystats
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/stenographer/base"
+	_ "github.com/mattn/go-sqlite3" // registers the "sqlite3" driver
+)
+
+var v = base.V // verbose logging
+
+const schema = `
+CREATE TABLE IF NOT EXISTS queries (
+  start_nanos    INTEGER NOT NULL,
+  duration_nanos INTEGER NOT NULL,
+  client         TEXT NOT NULL,
+  query          TEXT NOT NULL,
+  bytes          INTEGER NOT NULL,
+  err            TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queries_start ON queries (start_nanos);
+`
+
+// Record is the metadata stored for a single query execution.
+type Record struct {
+	Start    time.Time
+	Duration time.Duration
+	Client   string // Who ran the query.
+	Query    string
+	Bytes    int64  // Bytes of packet data served.
+	Err      string // Empty if the query succeeded.
+}
+
+// Summary aggregates all the records sharing a single Key.
+type Summary struct {
+	Key         string // Day, month, or client, depending on the grouping.
+	Queries     int64
+	Errors      int64
+	Bytes       int64
+	Clients     int64
+	MeanLatency time.Duration
+	MaxLatency  time.Duration
+}
+
+// groupings maps the supported ways to group summaries to the SQL expression
+// computing their key.
+var groupings = map[string]string{
+	"day":    "strftime('%Y-%m-%d', start_nanos / 1000000000, 'unixepoch')",
+	"month":  "strftime('%Y-%m', start_nanos / 1000000000, 'unixepoch')",
+	"client": "client",
+}
+
+// Store is a SQLite-backed store of query Records.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens the named SQLite database, creating it if necessary.
+func Open(filename string) (*Store, error) {
+	v(1, "opening query stats database %q", filename)
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open query stats database %q: %v", filename, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create query stats schema in %q: %v", filename, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Add stores a single record.
+func (s *Store) Add(r Record) error {
+	_, err := s.db.Exec(
+		"INSERT INTO queries (start_nanos, duration_nanos, client, query, bytes, err) VALUES (?, ?, ?, ?, ?, ?)",
+		r.Start.UnixNano(), r.Duration.Nanoseconds(), r.Client, r.Query, r.Bytes, r.Err)
+	return err
+}
+
+// Summarize aggregates all records started at or after 'since', grouped by
+// 'by', which must be one of "day", "month" or "client".
+func (s *Store) Summarize(since time.Time, by string) ([]Summary, error) {
+	key, ok := groupings[by]
+	if !ok {
+		return nil, fmt.Errorf("invalid grouping %q", by)
+	}
+	rows, err := s.db.Query(`
+SELECT `+key+` AS k, COUNT(*), SUM(err != ''), SUM(bytes), COUNT(DISTINCT client),
+       CAST(AVG(duration_nanos) AS INTEGER), MAX(duration_nanos)
+FROM queries WHERE start_nanos >= ? GROUP BY k ORDER BY k`, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Summary{}
+	for rows.Next() {
+		var sum Summary
+		if err := rows.Scan(&sum.Key, &sum.Queries, &sum.Errors, &sum.Bytes, &sum.Clients, &sum.MeanLatency, &sum.MaxLatency); err != nil {
+			return nil, err
+		}
+		out = append(out, sum)
+	}
+	return out, rows.Err()
+}
+
+// ServeHTTP makes Store an http.Handler, serving JSON summaries.  It accepts
+// the URL parameters 'since' (a duration, default 30 days) and 'by' (default
+// "day").
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+	since := time.Hour * 24 * 30
+	if str := vals.Get("since"); str != "" {
+		var err error
+		if since, err = time.ParseDuration(str); err != nil {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+	}
+	by := vals.Get("by")
+	if by == "" {
+		by = "day"
+	}
+	summaries, err := s.Summarize(time.Now().Add(-since), by)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
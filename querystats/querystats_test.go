@@ -0,0 +1,71 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package querystats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	d, err := ioutil.TempDir("", "querystats_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, err := Open(filepath.Join(d, "stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	day := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, r := range []Record{
+		{Start: day, Duration: time.Second, Client: "alice", Query: "port 80", Bytes: 100},
+		{Start: day, Duration: 3 * time.Second, Client: "bob", Query: "port 81", Bytes: 200, Err: "oops"},
+		{Start: day.Add(24 * time.Hour), Duration: time.Second, Client: "alice", Query: "port 82", Bytes: 300},
+	} {
+		if err := s.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		by   string
+		want []Summary
+	}{
+		{"day", []Summary{
+			{Key: "2015-01-02", Queries: 2, Errors: 1, Bytes: 300, Clients: 2, MeanLatency: 2 * time.Second, MaxLatency: 3 * time.Second},
+			{Key: "2015-01-03", Queries: 1, Bytes: 300, Clients: 1, MeanLatency: time.Second, MaxLatency: time.Second},
+		}},
+		{"client", []Summary{
+			{Key: "alice", Queries: 2, Bytes: 400, Clients: 1, MeanLatency: time.Second, MaxLatency: time.Second},
+			{Key: "bob", Queries: 1, Errors: 1, Bytes: 200, Clients: 1, MeanLatency: 3 * time.Second, MaxLatency: 3 * time.Second},
+		}},
+	} {
+		got, err := s.Summarize(day.Add(-time.Hour), test.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong summary by %v.\nwant: %+v\n got: %+v\n", test.by, test.want, got)
+		}
+	}
+	if _, err := s.Summarize(day, "bogus"); err == nil {
+		t.Errorf("summarized by invalid grouping")
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reindex
+
+import (
+	"encoding/binary"
+
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+)
+
+// This is a port of stenotype's Index::Process, and must produce the same
+// keys for every packet.  It works on raw bytes rather than gopacket layers
+// so that truncated and malformed packets are indexed exactly as far as
+// stenotype would have gotten with them.
+
+// typeEthernet is NOT a valid ethertype.  It signifies that the next layer to
+// decode is an ethernet header.
+const typeEthernet = 0
+
+const (
+	ethPIP                  = 0x0800
+	ethPIPv6                = 0x86DD
+	ethP8021Q               = 0x8100
+	ethP8021AD              = 0x88A8
+	ethPQinQ1               = 0x9100
+	ethPQinQ2               = 0x9200
+	ethPQinQ3               = 0x9300
+	ethPMPLSUnicast         = 0x8847
+	ethPMPLSMulticast       = 0x8848
+	ethPTransparentEthernet = 0x6558
+
+	mplsBottomOfStack = 1 << 8
+
+	ipProtoHopOpts  = 0
+	ipProtoICMP     = 1
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoGRE      = 47
+	ipProtoICMPv6   = 58
+	ipProtoDstOpts  = 60
+	ipProtoMH       = 135
+
+	vxlanPort  = 4789
+	genevePort = 6081
+)
+
+// skip returns b without its first n bytes, or nothing if it's shorter.
+func skip(b []byte, n int) []byte {
+	if n > len(b) {
+		return nil
+	}
+	return b[n:]
+}
+
+func be16(b []byte) uint16 { return binary.BigEndian.Uint16(b) }
+func be32(b []byte) uint32 { return binary.BigEndian.Uint32(b) }
+
+// ipv4ChecksumOK returns true if the IPv4 header hdr has a valid checksum.
+func ipv4ChecksumOK(hdr []byte) bool {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(be16(hdr[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return sum == 0xFFFF
+}
+
+// process indexes a single packet, which is length bytes long on the wire and
+// captured as data.
+func (x *index) process(pos uint32, length int, data []byte) {
+	x.packets++
+	if length > 0xFFFF {
+		length = 0xFFFF
+	}
+	x.add16(indexfile.LengthKeys, pos, uint16(length-length%indexfile.LengthBucketBytes))
+	b := data
+	typ := uint16(typeEthernet)
+	var protocol byte
+	vlanTags := 0
+
+	// Strip all pre-IP-header layers off the packet.
+preIP:
+	for {
+		switch typ {
+		case typeEthernet:
+			if len(b) < 14 {
+				return
+			}
+			typ = be16(b[12:])
+			b = b[14:]
+		case ethP8021Q, ethP8021AD, ethPQinQ1, ethPQinQ2, ethPQinQ3:
+			if len(b) < 4 {
+				return
+			}
+			vlan := be16(b) & 0x0FFF
+			x.add16(indexfile.VLANKeys, pos, vlan)
+			if vlanTags > 0 {
+				x.add16(indexfile.InnerVLANKeys, pos, vlan)
+			}
+			vlanTags++
+			typ = be16(b[2:])
+			b = b[4:]
+		case ethPMPLSUnicast, ethPMPLSMulticast:
+			var depth byte
+			for {
+				// We need the first nibble after the MPLS header too, to figure
+				// out the next layer type.
+				if len(b) < 5 {
+					return
+				}
+				hdr := be32(b)
+				var label [4]byte
+				binary.BigEndian.PutUint32(label[:], hdr>>12)
+				x.add(indexfile.MPLSKeys, pos, label[:]...)
+				if depth < 255 {
+					depth++
+					x.add(indexfile.MPLSDepthKeys, pos, depth, label[0], label[1], label[2], label[3])
+				}
+				b = b[4:]
+				if hdr&mplsBottomOfStack != 0 {
+					break
+				}
+			}
+			switch b[0] >> 4 {
+			case 0: // RFC4385
+				typ = typeEthernet
+				b = skip(b, 4) // Skip over PW ethernet control word.
+			case 4:
+				typ = ethPIP
+			case 6:
+				typ = ethPIPv6
+			default:
+				return
+			}
+		case ethPIP:
+			if len(b) < 20 {
+				return
+			}
+			x.add(indexfile.IPv4Keys, pos, b[12:16]...)
+			x.add(indexfile.IPv4Keys, pos, b[16:20]...)
+			x.add(indexfile.DSCPKeys, pos, b[1]>>2)
+			// Any fragment has either the more-fragments bit or an offset set.
+			if be16(b[6:])&0x3FFF != 0 {
+				x.add(indexfile.FlagKeys, pos, indexfile.FlagIPFragment)
+			}
+			hdrLen := int(b[0]&0x0F) * 4
+			if hdrLen < 20 {
+				return
+			}
+			if hdrLen <= len(b) && !ipv4ChecksumOK(b[:hdrLen]) {
+				x.add(indexfile.FlagKeys, pos, indexfile.FlagBadIPChecksum)
+			}
+			protocol = b[9]
+			b = skip(b, hdrLen)
+			break preIP
+		case ethPIPv6:
+			if len(b) < 40 {
+				return
+			}
+			protocol = b[6]
+			// The traffic class follows the 4-bit version, and DSCP is its top
+			// 6 bits.
+			x.add(indexfile.DSCPKeys, pos, byte(be32(b)>>22)&0x3F)
+			x.add(indexfile.IPv6Keys, pos, b[8:24]...)
+			x.add(indexfile.IPv6Keys, pos, b[24:40]...)
+			b = b[40:]
+			x.skipIPv6Extensions(pos, &protocol, &b)
+			break preIP
+		default:
+			return
+		}
+	}
+
+	x.add(indexfile.ProtoKeys, pos, protocol)
+	switch protocol {
+	case ipProtoTCP:
+		if len(b) < 20 {
+			return
+		}
+		x.add16(indexfile.PortKeys, pos, be16(b))
+		x.add16(indexfile.PortKeys, pos, be16(b[2:]))
+	case ipProtoUDP:
+		if len(b) < 8 {
+			return
+		}
+		dst := be16(b[2:])
+		x.add16(indexfile.PortKeys, pos, be16(b))
+		x.add16(indexfile.PortKeys, pos, dst)
+		b = b[8:]
+		if dst == vxlanPort {
+			// VXLAN's 8-byte header is followed by an ethernet frame.
+			x.processTunnel(pos, typeEthernet, skip(b, 8))
+		} else if dst == genevePort && len(b) >= 8 {
+			// Geneve's 8-byte header is followed by (byte 0 & 0x3F) * 4 bytes
+			// of options, and bytes 2-3 are the inner protocol.
+			typ := be16(b[2:])
+			if typ == ethPTransparentEthernet {
+				typ = typeEthernet
+			}
+			x.processTunnel(pos, typ, skip(b, 8+int(b[0]&0x3F)*4))
+		}
+	case ipProtoGRE:
+		if len(b) < 4 {
+			return
+		}
+		flags, typ := be16(b), be16(b[2:])
+		hdrLen := 4
+		// Checksum, key, and sequence number fields are each optional.
+		for _, bit := range []uint16{0x8000, 0x2000, 0x1000} {
+			if flags&bit != 0 {
+				hdrLen += 4
+			}
+		}
+		if typ == ethPTransparentEthernet {
+			typ = typeEthernet
+		}
+		x.processTunnel(pos, typ, skip(b, hdrLen))
+	case ipProtoICMP, ipProtoICMPv6:
+		// ICMP and ICMPv6 both start with a 1-byte type then a 1-byte code.
+		if len(b) < 2 {
+			return
+		}
+		x.add(indexfile.ICMPTypeKeys, pos, b[0])
+		x.add(indexfile.ICMPCodeKeys, pos, b[1])
+	}
+}
+
+// skipIPv6Extensions strips IPv6 extension headers off b, updating protocol
+// to the type of the header that follows them.  Fragments other than the first
+// are left with the fragment protocol, since what follows isn't a header.
+func (x *index) skipIPv6Extensions(pos uint32, protocol *byte, b *[]byte) {
+	for {
+		switch *protocol {
+		case ipProtoFragment:
+			if len(*b) < 8 {
+				return
+			}
+			x.add(indexfile.FlagKeys, pos, indexfile.FlagIPFragment)
+			if be16((*b)[2:])&0xFFF8 != 0 {
+				return
+			}
+			fallthrough
+		case ipProtoMH, ipProtoHopOpts, ipProtoRouting, ipProtoDstOpts:
+			if len(*b) < 2 {
+				return
+			}
+			*protocol = (*b)[0]
+			*b = skip(*b, (int((*b)[1])+1)*8)
+		default:
+			return
+		}
+	}
+}
+
+// processTunnel indexes the inner IPs of a GRE/VXLAN/Geneve payload b, whose
+// first layer is of the given type.
+func (x *index) processTunnel(pos uint32, typ uint16, b []byte) {
+	if typ == typeEthernet {
+		if len(b) < 14 {
+			return
+		}
+		typ = be16(b[12:])
+		b = b[14:]
+		for typ == ethP8021Q || typ == ethP8021AD {
+			if len(b) < 4 {
+				return
+			}
+			typ = be16(b[2:])
+			b = b[4:]
+		}
+	}
+	switch typ {
+	case ethPIP:
+		if len(b) < 20 {
+			return
+		}
+		x.add(indexfile.InnerIPv4Keys, pos, b[12:16]...)
+		x.add(indexfile.InnerIPv4Keys, pos, b[16:20]...)
+	case ethPIPv6:
+		if len(b) < 40 {
+			return
+		}
+		x.add(indexfile.InnerIPv6Keys, pos, b[8:24]...)
+		x.add(indexfile.InnerIPv6Keys, pos, b[24:40]...)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reindex rebuilds stenotype index files from their blockfiles, so
+// packets whose index was lost or corrupted can be searched again.
+package reindex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/leveldb/table"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	v              = base.V // verbose logging
+	indexesRebuilt = stats.S.Get("indexes_rebuilt")
+)
+
+// Version of the index file format we write.  These must match stenotype's
+// kIndexVersionNumberMajor and kIndexVersionNumberMinor.
+const (
+	majorVersion = 2
+	minorVersion = 10
+)
+
+// Result describes a rebuilt index.
+type Result struct {
+	Packets int
+	Keys    int
+}
+
+// Rebuild scans the blockfile at packetPath and writes its index to
+// indexPath, replacing any index already there.  The index is written to a
+// hidden file, then renamed into place, so stenographer never opens a partial
+// one.  Rebuilt indexes hold the same keys stenotype would have written, but
+// never split IPs into shards.
+func Rebuild(ctx context.Context, packetPath, indexPath string) (*Result, error) {
+	v(1, "rebuilding index %q from %q", indexPath, packetPath)
+	idx := &index{keys: map[string][]uint32{}}
+	if err := blockfile.ScanPackets(packetPath, func(pos int64, p *base.Packet) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return idx.addPacket(pos, p)
+	}); err != nil {
+		return nil, fmt.Errorf("scanning %q: %v", packetPath, err)
+	}
+	hidden := filepath.Join(filepath.Dir(indexPath), "."+filepath.Base(indexPath))
+	if err := idx.writeTo(hidden); err != nil {
+		os.Remove(hidden)
+		return nil, fmt.Errorf("writing %q: %v", hidden, err)
+	}
+	if err := os.Rename(hidden, indexPath); err != nil {
+		os.Remove(hidden)
+		return nil, err
+	}
+	// Shards of the index we replaced would otherwise be mistaken for ours.
+	for _, shard := range indexfile.ShardPaths(indexPath) {
+		if err := os.Remove(shard); err != nil {
+			return nil, err
+		}
+	}
+	indexesRebuilt.Increment()
+	v(1, "rebuilt index %q with %d keys for %d packets", indexPath, len(idx.keys), idx.packets)
+	return &Result{Packets: idx.packets, Keys: len(idx.keys)}, nil
+}
+
+// WriteIndex writes an index of packets, found at the given positions in
+// their blockfile, to filename.  It's Rebuild for packets that aren't in a
+// finished blockfile, like those stenotype is still writing.
+func WriteIndex(filename string, positions []int64, packets []*base.Packet) error {
+	if len(positions) != len(packets) {
+		return fmt.Errorf("%d positions for %d packets", len(positions), len(packets))
+	}
+	idx := &index{keys: map[string][]uint32{}}
+	for i, p := range packets {
+		if err := idx.addPacket(positions[i], p); err != nil {
+			return err
+		}
+	}
+	return idx.writeTo(filename)
+}
+
+// index accumulates the positions of packets under each of their keys.
+type index struct {
+	keys    map[string][]uint32 // Keys include their leading KeyType byte.
+	packets int
+	times   indexfile.TimeHistogram
+}
+
+// add appends pos to the positions of the given key.  Packets are processed
+// in order, so positions stay sorted, and a packet adding the same key twice
+// (e.g. with equal source and destination ports) is only stored once.
+func (x *index) add(t indexfile.KeyType, pos uint32, val ...byte) {
+	key := string(append([]byte{byte(t)}, val...))
+	p := x.keys[key]
+	if len(p) > 0 && p[len(p)-1] == pos {
+		return
+	}
+	x.keys[key] = append(p, pos)
+}
+
+// addPacket indexes the packet at pos.  Packets must be added in position
+// order.
+func (x *index) addPacket(pos int64, p *base.Packet) error {
+	if pos >= 1<<32 {
+		return fmt.Errorf("packet position %d too large to index", pos)
+	}
+	x.times.Add(p.CaptureInfo.Timestamp)
+	x.process(uint32(pos), p.CaptureInfo.Length, p.Data)
+	return nil
+}
+
+func (x *index) add16(t indexfile.KeyType, pos uint32, val uint16) {
+	x.add(t, pos, byte(val>>8), byte(val))
+}
+
+// writeTo writes out the index as a leveldb table, like stenotype's
+// Index::WriteTo.
+func (x *index) writeTo(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := table.NewWriter(f, nil)
+	var version [8]byte
+	binary.BigEndian.PutUint32(version[:4], majorVersion)
+	binary.BigEndian.PutUint32(version[4:], minorVersion)
+	if err := w.Set([]byte{0}, version[:], nil); err != nil {
+		w.Close()
+		return err
+	}
+	if x.packets > 0 {
+		// Packet times, stored like stenotype's kIndexTimesKey.
+		if err := w.Set([]byte{0, 3}, x.times.Bytes(), nil); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	keys := make([]string, 0, len(x.keys))
+	for key := range x.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		positions := x.keys[key]
+		value := make([]byte, 4*len(positions))
+		for i, pos := range positions {
+			binary.BigEndian.PutUint32(value[4*i:], pos)
+		}
+		if err := w.Set([]byte(key), value, nil); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reindex
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/leveldb/table"
+	"golang.org/x/net/context"
+)
+
+// readTable returns all the entries in a leveldb table, hex encoded.
+func readTable(t *testing.T, filename string) map[string]string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := table.NewReader(f, nil)
+	defer ss.Close()
+	out := map[string]string{}
+	iter := ss.Find(nil, nil)
+	for iter.Next() {
+		out[hex.EncodeToString(iter.Key())] = hex.EncodeToString(iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"dhcp", "mpls", "vlan"} {
+		indexPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(indexPath+".ip0", []byte("stale shard"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Rebuild(context.Background(), "../testdata/PKT0/"+name, indexPath); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(indexPath + ".ip0"); !os.IsNotExist(err) {
+			t.Errorf("%s: stale shard not removed: %v", name, err)
+		}
+		want := readTable(t, "../testdata/IDX0/"+name)
+		got := readTable(t, indexPath)
+		if v := got["00"]; v != "000000020000000a" {
+			t.Errorf("%s: got version %v", name, v)
+		}
+		if _, ok := got["0003"]; !ok {
+			t.Errorf("%s: no packet times recorded", name)
+		}
+		// The test indexes were written before stenotype indexed lengths,
+		// flags, etc, so only the keys they do have are compared.
+		for key, value := range want {
+			if key == "00" {
+				continue
+			}
+			if got[key] != value {
+				t.Errorf("%s: key %v has positions %v, want %v", name, key, got[key], value)
+			}
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	// A VLAN-tagged IPv4 UDP packet to the VXLAN port, encapsulating an
+	// ethernet frame with an IPv4 header.
+	pkt, _ := hex.DecodeString("" +
+		"000000000001000000000002810000640800" + // ethernet, VLAN 100
+		"450000000000400040110000" + "0a000001" + "0a000002" + // IPv4
+		"04d212b500000000" + // UDP 1234 -> 4789
+		"0800000000000100" + // VXLAN
+		"0000000000030000000000040800" + // inner ethernet
+		"450000000000000040060000" + "c0a80001" + "c0a80002") // inner IPv4
+	x := &index{keys: map[string][]uint32{}}
+	x.process(16, len(pkt), pkt)
+	if len(x.keys) != 11 {
+		t.Errorf("got %d keys, want 11", len(x.keys))
+	}
+	var keys []string
+	for key := range x.keys {
+		keys = append(keys, hex.EncodeToString([]byte(key)))
+	}
+	for _, want := range []string{
+		"030064",     // VLAN 100
+		"040a000001", // IPv4 src
+		"040a000002", // IPv4 dst
+		"0111",       // UDP
+		"0204d2",     // port 1234
+		"0212b5",     // port 4789
+		"0d02",       // bad IP checksum
+		"0ec0a80001", // inner IPv4 src
+		"0ec0a80002", // inner IPv4 dst
+		"0b00",       // DSCP 0
+		"0c0040",     // length 88, in the bucket from 64
+	} {
+		if positions, ok := x.keys[string(mustHex(want))]; !ok || len(positions) != 1 || positions[0] != 16 {
+			t.Errorf("key %v: got positions %v, want [16] (all keys: %v)", want, positions, keys)
+		}
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,309 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicate copies the packet files stenographer has finished
+// writing, and their indexes, to a standby stenographer over HTTPS, so its
+// packets survive the sensor's hardware failing.
+package replicate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/config"
+	"../config"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	v = base.V // verbose logging
+
+	filesSent       = stats.S.Get("replication_files_sent")
+	bytesSent       = stats.S.Get("replication_bytes_sent")
+	sendFailures    = stats.S.Get("replication_send_failures")
+	filesReceived   = stats.S.Get("replication_files_received")
+	receiveFailures = stats.S.Get("replication_receive_failures")
+)
+
+// Path is where a standby serves replication requests:  GET lists a thread's
+// files, and PUT receives part of one.
+const Path = "/replica/files"
+
+// sha256Trailer carries the SHA256 of each part sent, checked before the part
+// is moved into place.
+const sha256Trailer = "X-Stenographer-Sha256"
+
+// Parts of a file are sent packets first, then the index's IP shards, then
+// the index, since stenographer finds files by their indexes.
+const (
+	partPackets = "packets"
+	partIndex   = "index"
+)
+
+// FileList is the response to a GET of Path.
+type FileList struct {
+	Files []string // Oldest first.
+}
+
+// Sender sends files to a standby.  It implements thread.Replicator.
+type Sender struct {
+	url  string
+	http *http.Client
+}
+
+// NewSender returns a Sender to the standby at baseURL, making requests with
+// c.
+func NewSender(baseURL string, c *http.Client) *Sender {
+	return &Sender{url: strings.TrimSuffix(baseURL, "/"), http: c}
+}
+
+// Replicated returns the names of a thread's files the standby has, oldest
+// first.
+func (s *Sender) Replicated(ctx context.Context, thread int) ([]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?thread=%d", s.url, Path, thread), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := responseError(resp); err != nil {
+		return nil, err
+	}
+	var list FileList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid file list from standby: %v", err)
+	}
+	return list.Files, nil
+}
+
+// Replicate sends the named file of a thread, given its packet file's path
+// and its index's, followed by those of the index's IP shards.
+func (s *Sender) Replicate(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error {
+	var total int64
+	send := func(part, path string) error {
+		n, err := s.put(ctx, thread, name, part, path)
+		total += n
+		return err
+	}
+	err := send(partPackets, packetPath)
+	for _, path := range indexPaths[1:] {
+		if err == nil {
+			err = send(partIndex+strings.TrimPrefix(path, indexPaths[0]), path)
+		}
+	}
+	if err == nil {
+		err = send(partIndex, indexPaths[0])
+	}
+	if err != nil {
+		sendFailures.Increment()
+		return err
+	}
+	filesSent.Increment()
+	bytesSent.IncrementBy(total)
+	v(1, "replicated thread %d file %q, %d bytes", thread, name, total)
+	return nil
+}
+
+// hashingReader hashes what's read through it, setting its SHA256 in trailer
+// once it's all read.
+type hashingReader struct {
+	r       io.Reader
+	h       hash.Hash
+	trailer http.Header
+	n       int64
+}
+
+// Read implements io.Reader.
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	h.n += int64(n)
+	if err == io.EOF {
+		h.trailer.Set(sha256Trailer, hex.EncodeToString(h.h.Sum(nil)))
+	}
+	return n, err
+}
+
+// put sends one part of a file, returning its size.
+func (s *Sender) put(ctx context.Context, thread int, name, part, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	q := url.Values{"thread": {strconv.Itoa(thread)}, "name": {name}, "part": {part}}
+	body := &hashingReader{r: f, h: sha256.New(), trailer: http.Header{sha256Trailer: nil}}
+	req, err := http.NewRequest("PUT", s.url+Path+"?"+q.Encode(), ioutil.NopCloser(body))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = -1 // Chunked, to send the trailer.
+	req.Trailer = body.trailer
+	resp, err := s.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("could not send %q: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if err := responseError(resp); err != nil {
+		return 0, fmt.Errorf("could not send %q: %v", path, err)
+	}
+	return body.n, nil
+}
+
+// responseError returns an error describing resp if it failed.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	return fmt.Errorf("standby returned %v: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Receiver receives files on a standby, into its threads' directories.  It
+// doesn't authorize requests, which its caller must.
+type Receiver struct {
+	threads []config.ThreadConfig
+}
+
+// NewReceiver returns a Receiver writing to the directories of threads.
+func NewReceiver(threads []config.ThreadConfig) *Receiver {
+	return &Receiver{threads: threads}
+}
+
+// ServeHTTP serves Path.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	thread, err := strconv.Atoi(req.FormValue("thread"))
+	if err != nil || thread < 0 || thread >= len(r.threads) {
+		http.Error(w, fmt.Sprintf("invalid thread %q:  the standby has %d", req.FormValue("thread"), len(r.threads)), http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		files, err := r.files(thread)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FileList{Files: files})
+	case "PUT":
+		if status, err := r.receive(thread, req); err != nil {
+			receiveFailures.Increment()
+			http.Error(w, err.Error(), status)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// files returns the names of the files a thread has, oldest first.  Like the
+// thread, it finds them by their indexes.
+func (r *Receiver) files(thread int) ([]string, error) {
+	infos, err := ioutil.ReadDir(r.threads[thread].IndexDirectory)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, info := range infos {
+		if name := info.Name(); !info.IsDir() && name[0] != '.' && !indexfile.IsShardPath(name) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// validName returns whether name could be a file stenotype wrote, which is
+// named for the microsecond it was created.
+func validName(name string) bool {
+	_, err := strconv.ParseUint(name, 10, 64)
+	return err == nil
+}
+
+// receive writes the part of a file in req's body into place in thread's
+// directories, returning the status to reply with if it fails.  The part is
+// written to a hidden file, which is only moved into place once it's all been
+// received and its checksum matches.
+func (r *Receiver) receive(thread int, req *http.Request) (int, error) {
+	name, part := req.FormValue("name"), req.FormValue("part")
+	if !validName(name) {
+		return http.StatusBadRequest, fmt.Errorf("invalid file name %q", name)
+	}
+	t := r.threads[thread]
+	var path string
+	switch {
+	case part == partPackets:
+		path = filepath.Join(t.PacketsDirectory, name)
+	case part == partIndex:
+		path = filepath.Join(t.IndexDirectory, name)
+	case strings.HasPrefix(part, partIndex+".ip"):
+		if _, err := strconv.ParseUint(strings.TrimPrefix(part, partIndex+".ip"), 10, 8); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid part %q", part)
+		}
+		path = filepath.Join(t.IndexDirectory, name+strings.TrimPrefix(part, partIndex))
+	default:
+		return http.StatusBadRequest, fmt.Errorf("invalid part %q", part)
+	}
+	hidden := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".replica")
+	f, err := os.Create(hidden)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), req.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(hidden)
+		return http.StatusInternalServerError, fmt.Errorf("could not write %q: %v", hidden, err)
+	}
+	if got, want := hex.EncodeToString(h.Sum(nil)), req.Trailer.Get(sha256Trailer); got != want {
+		os.Remove(hidden)
+		return http.StatusBadRequest, fmt.Errorf("received %s part of %q with SHA256 %v, want %q", part, name, got, want)
+	}
+	if err := os.Rename(hidden, path); err != nil {
+		os.Remove(hidden)
+		return http.StatusInternalServerError, err
+	}
+	if part == partIndex {
+		filesReceived.Increment()
+		v(1, "received thread %d file %q", thread, name)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"golang.org/x/net/context"
+)
+
+// standby returns a Receiver's threads' directories, and a Sender to it.
+func standby(t *testing.T, dir string) (config.ThreadConfig, *Sender, func()) {
+	tc := config.ThreadConfig{PacketsDirectory: filepath.Join(dir, "PKT0"), IndexDirectory: filepath.Join(dir, "IDX0")}
+	for _, d := range []string{tc.PacketsDirectory, tc.IndexDirectory} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(NewReceiver([]config.ThreadConfig{tc}))
+	return tc, NewSender(srv.URL, srv.Client()), srv.Close
+}
+
+func TestReplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tc, s, done := standby(t, filepath.Join(dir, "standby"))
+	defer done()
+	ctx := context.Background()
+
+	if got, err := s.Replicated(ctx, 0); err != nil || len(got) != 0 {
+		t.Fatalf("empty standby has files %v, %v", got, err)
+	}
+	files := map[string]string{
+		"1500000000000000":         "packets",
+		"idx/1500000000000000":     "index",
+		"idx/1500000000000000.ip0": "shard",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(dir, "idx/1500000000000000")
+	if err := s.Replicate(ctx, 0, "1500000000000000", filepath.Join(dir, "1500000000000000"), []string{indexPath, indexPath + ".ip0"}); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(tc.PacketsDirectory, "1500000000000000"):   "packets",
+		filepath.Join(tc.IndexDirectory, "1500000000000000"):     "index",
+		filepath.Join(tc.IndexDirectory, "1500000000000000.ip0"): "shard",
+	} {
+		if got, err := ioutil.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("standby has %q as %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if got, err := s.Replicated(ctx, 0); err != nil || !reflect.DeepEqual(got, []string{"1500000000000000"}) {
+		t.Errorf("standby has files %v, %v", got, err)
+	}
+	if _, err := s.Replicated(ctx, 1); err == nil {
+		t.Errorf("listed a thread the standby doesn't have")
+	}
+	hidden, _ := filepath.Glob(filepath.Join(tc.IndexDirectory, ".*"))
+	if len(hidden) != 0 {
+		t.Errorf("standby left behind %v", hidden)
+	}
+}
+
+func TestReceiveRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tc, s, done := standby(t, dir)
+	defer done()
+	for _, test := range []struct {
+		query, sha256 string
+	}{
+		{"thread=0&name=../../etc&part=packets", ""},
+		{"thread=0&name=1500000000000000&part=../index", ""},
+		{"thread=0&name=1500000000000000&part=index.ipx", ""},
+		{"thread=1&name=1500000000000000&part=index", ""},
+		{"thread=0&name=1500000000000000&part=index", strings.Repeat("0", 64)},
+	} {
+		req, err := http.NewRequest("PUT", s.url+Path+"?"+test.query, ioutil.NopCloser(bytes.NewReader([]byte("data"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1
+		req.Trailer = http.Header{sha256Trailer: {test.sha256}}
+		resp, err := s.http.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %v, want 400", test.query, resp.Status)
+		}
+	}
+	for _, d := range []string{tc.PacketsDirectory, tc.IndexDirectory} {
+		if files, _ := ioutil.ReadDir(d); len(files) != 0 {
+			t.Errorf("rejected parts left %d files in %q", len(files), d)
+		}
+	}
+}
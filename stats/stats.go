@@ -17,8 +17,12 @@ package stats
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,8 +35,9 @@ type Stat struct {
 
 // Stats provides a mapping of named variables.
 type Stats struct {
-	mu   sync.RWMutex
-	vars map[string]*Stat
+	mu         sync.RWMutex
+	vars       map[string]*Stat
+	histograms map[string]*Histogram
 }
 
 // Get returns the stat with the given name, creating it if necessary.
@@ -49,7 +54,9 @@ func (s *Stats) Get(name string) *Stat {
 func (s *Stat) Set(val int64) {
 	atomic.StoreInt64(&s.int64, val)
 }
-func (s *Stat) get() int64 {
+
+// Value returns the current value of this stat.
+func (s *Stat) Value() int64 {
 	return atomic.LoadInt64(&s.int64)
 }
 
@@ -70,6 +77,17 @@ func (s *Stat) Increment() {
 	s.IncrementBy(1)
 }
 
+// Values returns the current value of every stat.
+func (s *Stats) Values() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]int64, len(s.vars))
+	for k, v := range s.vars {
+		out[k] = v.Value()
+	}
+	return out
+}
+
 // ServeHTTP makes Stats an http.Handler.
 func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
@@ -81,7 +99,137 @@ func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	sort.Strings(strs)
 	for _, k := range strs {
-		fmt.Fprintf(w, "%v\t%v\n", k, s.vars[k].get())
+		fmt.Fprintf(w, "%v\t%v\n", k, s.vars[k].Value())
+	}
+}
+
+// Histogram counts observed values, like query latencies, in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64 // Upper bounds of each bucket, ascending.
+	buckets []int64   // Observations in each bucket, then those above them all.
+	sum     float64
+}
+
+// Histogram returns the histogram with the given name, creating it with the
+// given bucket upper bounds if necessary.
+func (s *Stats) Histogram(name string, bounds []float64) *Histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.histograms == nil {
+		s.histograms = map[string]*Histogram{}
+	}
+	if s.histograms[name] == nil {
+		sorted := append([]float64(nil), bounds...)
+		sort.Float64s(sorted)
+		s.histograms[name] = &Histogram{bounds: sorted, buckets: make([]int64, len(sorted)+1)}
+	}
+	return s.histograms[name]
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(val float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[sort.SearchFloat64s(h.bounds, val)]++
+	h.sum += val
+}
+
+// SecondsTimer returns a function that observes the seconds since it was
+// returned.
+func (h *Histogram) SecondsTimer() func() {
+	start := time.Now()
+	return func() {
+		h.Observe(time.Since(start).Seconds())
+	}
+}
+
+// promName turns a stat name into a valid Prometheus metric name.
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func promFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Sample is a single value of a labeled metric.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+func (s Sample) labels() string {
+	if len(s.Labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s.Labels[k])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, promName(k), v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WritePrometheusGauge writes a gauge, with a sample for each set of labels,
+// in the Prometheus text exposition format.
+func WritePrometheusGauge(w io.Writer, name, help string, samples []Sample) {
+	name = promName(name)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, s.labels(), promFloat(s.Value))
+	}
+}
+
+// WritePrometheus writes every stat and histogram in the Prometheus text
+// exposition format, with prefix prepended to their names.  Stats are
+// untyped, since they mix counters and gauges.
+func (s *Stats) WritePrometheus(w io.Writer, prefix string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.vars))
+	for k := range s.vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		name := promName(prefix + k)
+		fmt.Fprintf(w, "# TYPE %s untyped\n%s %d\n", name, name, s.vars[k].Value())
+	}
+	names = names[:0]
+	for k := range s.histograms {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		h := s.histograms[k]
+		name := promName(prefix + k)
+		h.mu.Lock()
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		var count int64
+		for i, n := range h.buckets {
+			count += n
+			bound := math.Inf(1)
+			if i < len(h.bounds) {
+				bound = h.bounds[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, promFloat(bound), count)
+		}
+		fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, promFloat(h.sum), name, count)
+		h.mu.Unlock()
 	}
 }
 
@@ -15,6 +15,7 @@
 package stats
 
 import (
+	"bytes"
 	"testing"
 	"time"
 )
@@ -29,3 +30,50 @@ func TestNanoTimer(t *testing.T) {
 		t.Error("invalid nano time:", got)
 	}
 }
+
+func TestValues(t *testing.T) {
+	s := &Stats{vars: map[string]*Stat{}}
+	s.Get("a").IncrementBy(3)
+	s.Get("b")
+	got := s.Values()
+	if len(got) != 2 || got["a"] != 3 || got["b"] != 0 {
+		t.Errorf("got %v, want map[a:3 b:0]", got)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	s := &Stats{vars: map[string]*Stat{}}
+	s.Get("http_request_index_a.b_GET_completed").IncrementBy(2)
+	h := s.Histogram("query_seconds", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	var buf bytes.Buffer
+	s.WritePrometheus(&buf, "steno_")
+	want := `# TYPE steno_http_request_index_a_b_GET_completed untyped
+steno_http_request_index_a_b_GET_completed 2
+# TYPE steno_query_seconds histogram
+steno_query_seconds_bucket{le="0.1"} 1
+steno_query_seconds_bucket{le="1"} 2
+steno_query_seconds_bucket{le="+Inf"} 3
+steno_query_seconds_sum 5.55
+steno_query_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWritePrometheusGauge(t *testing.T) {
+	var buf bytes.Buffer
+	WritePrometheusGauge(&buf, "disk_bytes", "Bytes on disk.", []Sample{
+		{Labels: map[string]string{"thread": "0", "dir": `/a"b`}, Value: 1.5},
+	})
+	want := `# HELP disk_bytes Bytes on disk.
+# TYPE disk_bytes gauge
+disk_bytes{dir="/a\"b",thread="0"} 1.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,609 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stenoclient is a Go client for stenographer's HTTP API, as
+// described by the OpenAPI document it serves at /openapi.json.
+package stenoclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Client talks to a single stenographer server.
+type Client struct {
+	// URL is the server's base URL, like "https://127.0.0.1:1234".
+	URL string
+	// HTTP makes the requests.  It must present a client certificate the
+	// server trusts, unless Token is set.
+	HTTP *http.Client
+	// Token, if set, is sent as a bearer token, for servers configured to
+	// accept APITokens or OIDC ID tokens instead of client certificates.
+	Token string
+}
+
+// New returns a Client for the server at baseURL, making requests with c.
+func New(baseURL string, c *http.Client) *Client {
+	return &Client{URL: strings.TrimSuffix(baseURL, "/"), HTTP: c}
+}
+
+// NewFromCertPath returns a Client for the server at baseURL, authenticating
+// with the client certificate in certPath (the server's CertPath, as created
+// by stenokeys.sh), and verifying the server with the CA there.
+func NewFromCertPath(baseURL, certPath string) (*Client, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "client_cert.pem"), filepath.Join(certPath, "client_key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca_cert.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no CA certificates found")
+	}
+	tr := &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}}
+	return New(baseURL, &http.Client{Transport: tr}), nil
+}
+
+// Error is returned for requests the server refused or failed.
+type Error struct {
+	StatusCode int
+	// Code is a machine-readable error type, like "parse_error", for errors
+	// running queries.  Empty for other errors.
+	Code    string
+	Message string
+	// Position is the character offset of a query parse error, and
+	// Suggestion the keyword the user may have meant.
+	Position   *int
+	Suggestion string
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("stenographer: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("stenographer: %d: %s", e.StatusCode, e.Message)
+}
+
+// do makes a request to path, returning its response if its status is one
+// of ok, or an *Error otherwise.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	e := &Error{}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") || json.Unmarshal(msg, e) != nil {
+		e = &Error{Message: strings.TrimSpace(string(msg))}
+	}
+	e.StatusCode = resp.StatusCode
+	return nil, e
+}
+
+// getJSON GETs path, decoding its JSON response into out.
+func (c *Client) getJSON(ctx context.Context, path string, out interface{}, ok ...int) error {
+	if len(ok) == 0 {
+		ok = []int{http.StatusOK}
+	}
+	resp, err := c.do(ctx, "GET", path, nil, nil, ok...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Formats packets may be returned in.
+const (
+	FormatPcap   = "pcap"
+	FormatPcapng = "pcapng"
+	FormatNDJSON = "ndjson"
+)
+
+// QueryOptions are optional settings for a query.
+type QueryOptions struct {
+	// Format is FormatPcap (the default), FormatPcapng or FormatNDJSON.
+	Format string
+	// LimitPackets and LimitBytes, if positive, stop the results after this
+	// many packets or bytes.
+	LimitPackets, LimitBytes int64
+	// LanguageVersion, if set, rejects query keywords added in later
+	// versions of the query language.
+	LanguageVersion int
+	// Vars holds the values of $name variables in the query.
+	Vars map[string]string
+	// Snaplen, if positive, truncates each packet to this many bytes.
+	Snaplen int
+	// Dedup, if positive, drops duplicate packets captured within this long
+	// of each other.
+	Dedup time.Duration
+	// Resume resumes the results after a packet, as SECONDS.FRACTION[:N],
+	// like the Resume of an earlier query's Packets.
+	Resume string
+	// Estimate has the server estimate the results' size before sending
+	// them, in the Packets' Estimated fields.
+	Estimate bool
+	// Payload includes packet payloads in NDJSON results.
+	Payload bool
+	// Duration, for Live queries, stops them after this long.
+	Duration time.Duration
+	// Client and ClientGroups name the client a federating server queries
+	// for.  Servers only act on them for the identities in their
+	// FederatorNames.
+	Client       string
+	ClientGroups []string
+}
+
+// params returns the URL parameters and headers setting o.
+func (o *QueryOptions) params() (url.Values, http.Header) {
+	v, h := url.Values{}, http.Header{}
+	if o == nil {
+		return v, h
+	}
+	if o.Format != "" {
+		v.Set("format", o.Format)
+	}
+	if o.LimitPackets > 0 {
+		h.Set("Steno-Limit-Packets", strconv.FormatInt(o.LimitPackets, 10))
+	}
+	if o.LimitBytes > 0 {
+		h.Set("Steno-Limit-Bytes", strconv.FormatInt(o.LimitBytes, 10))
+	}
+	if o.LanguageVersion > 0 {
+		h.Set("Steno-Language-Version", strconv.Itoa(o.LanguageVersion))
+	}
+	for k, val := range o.Vars {
+		v.Set("var."+k, val)
+	}
+	if o.Snaplen > 0 {
+		v.Set("snaplen", strconv.Itoa(o.Snaplen))
+	}
+	if o.Dedup > 0 {
+		v.Set("dedup", o.Dedup.String())
+	}
+	if o.Resume != "" {
+		v.Set("resume", o.Resume)
+	}
+	if o.Estimate {
+		v.Set("estimate", "true")
+	}
+	if o.Payload {
+		v.Set("payload", "true")
+	}
+	if o.Duration > 0 {
+		v.Set("duration", o.Duration.String())
+	}
+	if o.Client != "" {
+		h.Set("Steno-Client", o.Client)
+		h.Set("Steno-Client-Groups", strings.Join(o.ClientGroups, ","))
+	}
+	return v, h
+}
+
+// withParams returns path with the URL parameters v.
+func withParams(path string, v url.Values) string {
+	if len(v) == 0 {
+		return path
+	}
+	return path + "?" + v.Encode()
+}
+
+// Warning is a warning that a query's results are incomplete.
+type Warning struct {
+	Code    string // Like "range_unavailable".
+	Message string
+	// UnavailableStart and UnavailableEnd bound the requested time range
+	// that's no longer retained.
+	UnavailableStart time.Time `json:",omitempty"`
+	UnavailableEnd   time.Time `json:",omitempty"`
+}
+
+// Packets is the stream of a query's results.  Read it to the end, then
+// check Err, which reports errors the server hit after it started sending.
+type Packets struct {
+	// ID identifies the query in Jobs while it runs.
+	ID int64
+	// Warning, if set, says the results are incomplete.
+	Warning *Warning
+	// EstimatedPackets and EstimatedBytes estimate how many packets the
+	// results hold, and how large they are as a pcap, if QueryOptions.Estimate
+	// asked for them, or are -1.
+	EstimatedPackets, EstimatedBytes int64
+	// Query is the query a Pivot event or PivotZeek entries were translated
+	// to, unless it was too long to send.
+	Query string
+	resp  *http.Response
+}
+
+// Read implements io.Reader.
+func (p *Packets) Read(b []byte) (int, error) { return p.resp.Body.Read(b) }
+
+// Close stops reading the results.
+func (p *Packets) Close() error { return p.resp.Body.Close() }
+
+// Err returns the error the server hit while sending the results, if any.
+// It's only known once they've been read to the end.
+func (p *Packets) Err() error {
+	if msg := p.resp.Trailer.Get("Steno-Error"); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// SHA256 returns the hex SHA-256 of the results the server sent, for
+// checking they arrived intact.  It's only known once they've been read to
+// the end.
+func (p *Packets) SHA256() string {
+	return p.resp.Trailer.Get("Steno-Sha256")
+}
+
+// Count returns how many packets the server sent, or -1 if it didn't say.
+// It's only known once they've been read to the end.
+func (p *Packets) Count() int64 {
+	n, err := strconv.ParseInt(p.resp.Trailer.Get("Steno-Packets"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Resume returns the QueryOptions.Resume that resumes the results after the
+// last packet the server sent, if it sent any, for when they failed partway
+// through or stopped at a limit.  It's only known once they've been read to
+// the end.
+func (p *Packets) Resume() string {
+	return p.resp.Trailer.Get("Steno-Resume")
+}
+
+// Query returns the packets matching q.  Close them when done.
+func (c *Client) Query(ctx context.Context, q string, opts *QueryOptions) (*Packets, error) {
+	return c.packets(ctx, "/query", q, opts, nil)
+}
+
+// Live returns packets matching q as they're captured, until ctx is
+// canceled, opts.Duration passes, or a limit's reached.
+func (c *Client) Live(ctx context.Context, q string, opts *QueryOptions) (*Packets, error) {
+	return c.packets(ctx, "/live", q, opts, nil)
+}
+
+// Pivot returns the packets of the flow a Suricata EVE JSON event, like an
+// IDS alert, describes:  from pad before the flow started until pad after
+// the event, or the server's configured PivotPad if pad is 0.  The event
+// may be just its addresses, ports, proto and timestamp.  The query it was
+// translated to is in the result's Query.
+func (c *Client) Pivot(ctx context.Context, event []byte, pad time.Duration, opts *QueryOptions) (*Packets, error) {
+	return c.pivot(ctx, "/pivot", event, pad, opts)
+}
+
+// PivotZeek returns the packets of every connection in conns, Zeek conn.log
+// entries in its tab-separated format with a #fields header or in JSON,
+// merged in one pcap:  from pad before each connection started until pad
+// after it ended, or the server's configured PivotPad if pad is 0.
+func (c *Client) PivotZeek(ctx context.Context, conns []byte, pad time.Duration, opts *QueryOptions) (*Packets, error) {
+	return c.pivot(ctx, "/pivot/zeek", conns, pad, opts)
+}
+
+func (c *Client) pivot(ctx context.Context, path string, body []byte, pad time.Duration, opts *QueryOptions) (*Packets, error) {
+	v := url.Values{}
+	if pad > 0 {
+		v.Set("pad", pad.String())
+	}
+	return c.packets(ctx, path, string(body), opts, v)
+}
+
+// packets POSTs body to path, with opts and the params in extra, returning
+// the packets it responds with.
+func (c *Client) packets(ctx context.Context, path, body string, opts *QueryOptions, extra url.Values) (*Packets, error) {
+	v, h := opts.params()
+	for k, vals := range extra {
+		v[k] = vals
+	}
+	resp, err := c.do(ctx, "POST", withParams(path, v), h, strings.NewReader(body), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	p := &Packets{resp: resp, EstimatedPackets: -1, EstimatedBytes: -1, Query: resp.Header.Get("Steno-Query")}
+	p.ID, _ = strconv.ParseInt(resp.Header.Get("Steno-Query-Id"), 10, 64)
+	if n, err := strconv.ParseInt(resp.Header.Get("Steno-Estimated-Packets"), 10, 64); err == nil {
+		p.EstimatedPackets = n
+	}
+	if n, err := strconv.ParseInt(resp.Header.Get("Steno-Estimated-Bytes"), 10, 64); err == nil {
+		p.EstimatedBytes = n
+	}
+	if w := resp.Header.Get("Steno-Warning"); w != "" {
+		p.Warning = &Warning{}
+		if err := json.Unmarshal([]byte(w), p.Warning); err != nil {
+			p.Warning = &Warning{Message: w}
+		}
+	}
+	return p, nil
+}
+
+// QuerySize estimates how large a query's results are, from the indexes.
+type QuerySize struct {
+	// Packets and Bytes estimate how many packets the query returns, and how
+	// large a pcap they make, before any post-filtering or sampling.
+	Packets int64
+	Bytes   int64
+	Files   int // How many files the query reads.
+	// UncountedFiles are files whose packets all match, but whose indexes
+	// don't record how many packets they hold.
+	UncountedFiles int `json:",omitempty"`
+}
+
+// QuerySize estimates how large q's results are.
+func (c *Client) QuerySize(ctx context.Context, q string, opts *QueryOptions) (*QuerySize, error) {
+	v, h := opts.params()
+	resp, err := c.do(ctx, "POST", withParams("/querysize", v), h, strings.NewReader(q), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out := &QuerySize{}
+	return out, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Capabilities lists the query language features a server supports.
+type Capabilities struct {
+	LanguageVersion int
+	// Keywords maps each query keyword to the language version it was added
+	// in.
+	Keywords map[string]int
+}
+
+// Capabilities returns the query language features the server supports.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	out := &Capabilities{}
+	return out, c.getJSON(ctx, "/capabilities", out)
+}
+
+// Job is a query being served.
+type Job struct {
+	ID       int64
+	Path     string // What's serving it, like "/query", or a gRPC method.
+	Start    time.Time
+	Duration string // How long it's been running.
+	Client   string
+	Query    string
+	Bytes    int64 // Response bytes written so far.
+}
+
+// Jobs lists the queries being served, oldest first.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var out []Job
+	return out, c.getJSON(ctx, "/queries", &out)
+}
+
+// Job returns the query being served with the given ID.
+func (c *Client) Job(ctx context.Context, id int64) (*Job, error) {
+	out := &Job{}
+	return out, c.getJSON(ctx, fmt.Sprintf("/queries/%d", id), out)
+}
+
+// CancelJob cancels the query being served with the given ID.
+func (c *Client) CancelJob(ctx context.Context, id int64) error {
+	resp, err := c.do(ctx, "DELETE", fmt.Sprintf("/queries/%d", id), nil, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stats returns the value of every stat the server keeps.
+func (c *Client) Stats(ctx context.Context) (map[string]int64, error) {
+	resp, err := c.do(ctx, "GET", "/debug/stats", nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out := map[string]int64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stats line %q", scanner.Text())
+		}
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stats line %q", scanner.Text())
+		}
+		out[parts[0]] = n
+	}
+	return out, scanner.Err()
+}
+
+// HealthCheck is the result of one of a server's health checks.
+type HealthCheck struct {
+	Name    string // "stenotype", "disk", "index_freshness" or "thread_lag".
+	Thread  *int   `json:",omitempty"` // The thread checked, if it's per-thread.
+	OK      bool
+	Message string
+}
+
+// Health is the result of a server's health checks.
+type Health struct {
+	OK     bool
+	Checks []HealthCheck
+}
+
+// Health runs the server's liveness checks.  Failing checks aren't an error;
+// check the result's OK.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	out := &Health{}
+	return out, c.getJSON(ctx, "/healthz", out, http.StatusOK, http.StatusServiceUnavailable)
+}
+
+// Ready runs the server's readiness checks.  Failing checks aren't an error;
+// check the result's OK.
+func (c *Client) Ready(ctx context.Context) (*Health, error) {
+	out := &Health{}
+	return out, c.getJSON(ctx, "/readyz", out, http.StatusOK, http.StatusServiceUnavailable)
+}
+
+// DiskForecast is how much history a packets directory retains, and will at
+// the current write rate.
+type DiskForecast struct {
+	Dir     string
+	Threads []int // Writing to Dir.
+	// Oldest is when the oldest file in Dir was started, the horizon before
+	// which packets are gone.
+	Oldest              time.Time
+	Retained            string // How far back Oldest is.
+	RetainedSeconds     float64
+	WriteBytesPerSecond float64 // 0 until the write rate is known.
+	UsedBytes           int64
+	// UsableBytes is how many bytes the threads' files may take before the
+	// oldest are deleted.
+	UsableBytes int64
+	// Forecast is how much history UsableBytes holds at the current write
+	// rate, or empty until that's known.
+	Forecast        string
+	ForecastSeconds float64
+}
+
+// Forecast returns a DiskForecast for each of the server's packets
+// directories.
+func (c *Client) Forecast(ctx context.Context) ([]DiskForecast, error) {
+	var out []DiskForecast
+	return out, c.getJSON(ctx, "/forecast", &out)
+}
+
+// Hold is a legal hold preserving a query's packets.
+type Hold struct {
+	ID      string
+	Query   string
+	Reason  string // Why it's held, like a case number.
+	Client  string // Who placed it.
+	Created time.Time
+	State   string // "preserving", "held" or "failed".
+	Err     string // Why it failed, if it did.
+	Packets int64  // Packets preserved.
+	Bytes   int64  // Bytes of preserved pcap.
+	SHA256  string // Hex SHA-256 of the preserved pcap, once held.
+}
+
+// Holds lists the server's holds.
+func (c *Client) Holds(ctx context.Context) ([]Hold, error) {
+	var out []Hold
+	return out, c.getJSON(ctx, "/holds", &out)
+}
+
+// PlaceHold places a hold on q's packets, giving reason for it.  The packets
+// are preserved in the background:  poll Hold until its State isn't
+// "preserving".
+func (c *Client) PlaceHold(ctx context.Context, q, reason string, opts *QueryOptions) (*Hold, error) {
+	v, h := opts.params()
+	if reason != "" {
+		v.Set("reason", reason)
+	}
+	resp, err := c.do(ctx, "POST", withParams("/holds", v), h, strings.NewReader(q), http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out := &Hold{}
+	return out, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Hold returns the hold with the given ID.
+func (c *Client) Hold(ctx context.Context, id string) (*Hold, error) {
+	out := &Hold{}
+	return out, c.getJSON(ctx, "/holds/"+url.PathEscape(id), out)
+}
+
+// ReleaseHold releases the hold with the given ID, deleting its preserved
+// packets.
+func (c *Client) ReleaseHold(ctx context.Context, id string) error {
+	return c.noContent(ctx, "DELETE", "/holds/"+url.PathEscape(id), nil)
+}
+
+// ReloadConfig makes the server reread its config file.
+func (c *Client) ReloadConfig(ctx context.Context) error {
+	return c.noContent(ctx, "POST", "/admin/reload", nil)
+}
+
+// ReloadCerts makes the server reload its certs from disk.  If pemBytes isn't
+// empty, it's a PEM server certificate and private key the server installs
+// first.
+func (c *Client) ReloadCerts(ctx context.Context, pemBytes []byte) error {
+	return c.noContent(ctx, "POST", "/admin/certs", bytes.NewReader(pemBytes))
+}
+
+// IndexVerification is the result of checking one thread's indexes.
+type IndexVerification struct {
+	Thread      int
+	Verified    int      // Indexes checked.
+	Quarantined []string // Files found corrupt, and quarantined.
+}
+
+// VerifyIndexes makes the server check every index for corruption, which
+// may take a while.
+func (c *Client) VerifyIndexes(ctx context.Context) ([]IndexVerification, error) {
+	resp, err := c.do(ctx, "POST", "/admin/verify", nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out []IndexVerification
+	return out, json.NewDecoder(resp.Body).Decode(&out)
+}
+
+// noContent makes a request to path expecting a 204 No Content response.
+func (c *Client) noContent(ctx context.Context, method, path string, body io.Reader) error {
+	resp, err := c.do(ctx, method, path, nil, body, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
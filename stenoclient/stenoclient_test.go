@@ -0,0 +1,257 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stenoclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) (*Client, func()) {
+	s := httptest.NewServer(h)
+	return New(s.URL+"/", s.Client()), s.Close
+}
+
+func TestQuery(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := fmt.Sprintf("%s %s %s %s %s", r.Method, r.URL, body, r.Header.Get("Steno-Limit-Packets"), r.Header.Get("Authorization")),
+			"POST /query?estimate=true&format=pcapng&var.h=1.2.3.4 host $h 10 Bearer abc"; got != want {
+			t.Errorf("got request %q, want %q", got, want)
+		}
+		w.Header().Set("Trailer", "Steno-Sha256, Steno-Error, Steno-Packets, Steno-Resume")
+		w.Header().Set("Steno-Query-Id", "7")
+		w.Header().Set("Steno-Estimated-Bytes", "1000")
+		w.Header().Set("Steno-Warning", `{"Code":"range_unavailable","Message":"gone"}`)
+		w.Write([]byte("packets"))
+		w.Header().Set("Steno-Sha256", "1234")
+		w.Header().Set("Steno-Error", "disk on fire")
+		w.Header().Set("Steno-Packets", "3")
+		w.Header().Set("Steno-Resume", "1500000000.000000001:2")
+	})
+	defer done()
+	c.Token = "abc"
+	p, err := c.Query(context.Background(), "host $h", &QueryOptions{Format: FormatPcapng, LimitPackets: 10, Vars: map[string]string{"h": "1.2.3.4"}, Estimate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.ID != 7 || p.Warning == nil || p.Warning.Code != "range_unavailable" {
+		t.Errorf("got ID %v, warning %+v", p.ID, p.Warning)
+	}
+	if p.EstimatedBytes != 1000 || p.EstimatedPackets != -1 {
+		t.Errorf("got estimates %v packets, %v bytes", p.EstimatedPackets, p.EstimatedBytes)
+	}
+	if b, err := ioutil.ReadAll(p); err != nil || string(b) != "packets" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	if p.SHA256() != "1234" || p.Err() == nil || p.Err().Error() != "disk on fire" {
+		t.Errorf("got trailers %q, %v", p.SHA256(), p.Err())
+	}
+	if p.Count() != 3 || p.Resume() != "1500000000.000000001:2" {
+		t.Errorf("got count %v, resume %q", p.Count(), p.Resume())
+	}
+}
+
+func TestPivot(t *testing.T) {
+	event := `{"timestamp":"2018-01-01T12:00:00.000000+0000","src_ip":"10.0.0.1","src_port":1,"dest_ip":"10.0.0.2","dest_port":2,"proto":"TCP"}`
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := fmt.Sprintf("%s %s %s", r.Method, r.URL, body), "POST /pivot?format=pcapng&pad=5m0s "+event; got != want {
+			t.Errorf("got request %q, want %q", got, want)
+		}
+		w.Header().Set("Steno-Query", "host 10.0.0.1 and host 10.0.0.2")
+		w.Write([]byte("packets"))
+	})
+	defer done()
+	p, err := c.Pivot(context.Background(), []byte(event), 5*time.Minute, &QueryOptions{Format: FormatPcapng})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Query != "host 10.0.0.1 and host 10.0.0.2" {
+		t.Errorf("got query %q", p.Query)
+	}
+	if b, err := ioutil.ReadAll(p); err != nil || string(b) != "packets" {
+		t.Errorf("got %q, %v", b, err)
+	}
+}
+
+func TestPivotZeek(t *testing.T) {
+	conns := `{"ts":1514808000.25,"id.orig_h":"10.0.0.1","id.orig_p":1,"id.resp_h":"10.0.0.2","id.resp_p":2,"proto":"tcp"}`
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := fmt.Sprintf("%s %s %s", r.Method, r.URL, body), "POST /pivot/zeek "+conns; got != want {
+			t.Errorf("got request %q, want %q", got, want)
+		}
+		w.Write([]byte("packets"))
+	})
+	defer done()
+	p, err := c.PivotZeek(context.Background(), []byte(conns), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if b, err := ioutil.ReadAll(p); err != nil || string(b) != "packets" || p.Query != "" {
+		t.Errorf("got %q, %v, query %q", b, err, p.Query)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"Code":"parse_error","Message":"bad","Position":3,"Suggestion":"host"}`))
+			return
+		}
+		http.Error(w, "no query 3 running", http.StatusNotFound)
+	})
+	defer done()
+	pos := 3
+	_, err := c.Query(context.Background(), "hots 1.2.3.4", nil)
+	if want := (&Error{400, "parse_error", "bad", &pos, "host"}); !reflect.DeepEqual(err, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+	err = c.CancelJob(context.Background(), 3)
+	if want := (&Error{StatusCode: 404, Message: "no query 3 running"}); !reflect.DeepEqual(err, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	canceled := false
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /queries":
+			w.Write([]byte(`[{"ID":1,"Path":"/query","Start":"2018-01-01T00:00:00Z","Duration":"1s","Client":"alice","Query":"port 80","Bytes":24}]`))
+		case "DELETE /queries/1":
+			canceled = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer done()
+	jobs, err := c.Jobs(context.Background())
+	if want := []Job{{1, "/query", start, "1s", "alice", "port 80", 24}}; err != nil || !reflect.DeepEqual(jobs, want) {
+		t.Errorf("got %v, %v; want %v", jobs, err, want)
+	}
+	if err := c.CancelJob(context.Background(), 1); err != nil || !canceled {
+		t.Errorf("cancel: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a\t1\nb\t-2\n"))
+	})
+	defer done()
+	if s, err := c.Stats(context.Background()); err != nil || !reflect.DeepEqual(s, map[string]int64{"a": 1, "b": -2}) {
+		t.Errorf("got %v, %v", s, err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"OK":false,"Checks":[{"Name":"disk","Thread":0,"OK":false,"Message":"full"}]}`))
+	})
+	defer done()
+	zero := 0
+	h, err := c.Ready(context.Background())
+	if want := (&Health{false, []HealthCheck{{"disk", &zero, false, "full"}}}); err != nil || !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v, %v; want %+v", h, err, want)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	created := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	released := false
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /holds":
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != "port 80" || r.URL.Query().Get("reason") != "case 1" {
+				t.Errorf("got hold on %q for %q", body, r.URL.Query().Get("reason"))
+			}
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"ID":"ab","Query":"port 80","Reason":"case 1","Client":"alice","Created":"2018-01-01T00:00:00Z","State":"preserving"}`))
+		case "GET /holds":
+			w.Write([]byte(`[{"ID":"ab","Query":"port 80","Client":"alice","Created":"2018-01-01T00:00:00Z","State":"held","Packets":2,"Bytes":100,"SHA256":"ff"}]`))
+		case "DELETE /holds/ab":
+			released = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer done()
+	h, err := c.PlaceHold(context.Background(), "port 80", "case 1", nil)
+	if want := (&Hold{ID: "ab", Query: "port 80", Reason: "case 1", Client: "alice", Created: created, State: "preserving"}); err != nil || !reflect.DeepEqual(h, want) {
+		t.Errorf("place: got %+v, %v; want %+v", h, err, want)
+	}
+	holds, err := c.Holds(context.Background())
+	if want := []Hold{{ID: "ab", Query: "port 80", Client: "alice", Created: created, State: "held", Packets: 2, Bytes: 100, SHA256: "ff"}}; err != nil || !reflect.DeepEqual(holds, want) {
+		t.Errorf("list: got %+v, %v; want %+v", holds, err, want)
+	}
+	if err := c.ReleaseHold(context.Background(), "ab"); err != nil || !released {
+		t.Errorf("release: %v", err)
+	}
+	if _, err := c.Hold(context.Background(), "cd"); err == nil || err.(*Error).StatusCode != http.StatusNotFound {
+		t.Errorf("missing hold: got %v, want a 404", err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	var calls []string
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path+" "+string(body))
+		switch r.URL.Path {
+		case "/admin/reload", "/admin/certs":
+			w.WriteHeader(http.StatusNoContent)
+		case "/admin/verify":
+			w.Write([]byte(`[{"Thread":0,"Verified":3},{"Thread":1,"Verified":2,"Quarantined":["123"]}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer done()
+	if err := c.ReloadConfig(context.Background()); err != nil {
+		t.Errorf("reload config: %v", err)
+	}
+	if err := c.ReloadCerts(context.Background(), nil); err != nil {
+		t.Errorf("reload certs: %v", err)
+	}
+	if err := c.ReloadCerts(context.Background(), []byte("PEM")); err != nil {
+		t.Errorf("install certs: %v", err)
+	}
+	v, err := c.VerifyIndexes(context.Background())
+	if want := []IndexVerification{{0, 3, nil}, {1, 2, []string{"123"}}}; err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("verify: got %+v, %v; want %+v", v, err, want)
+	}
+	if want := []string{"POST /admin/reload ", "POST /admin/certs ", "POST /admin/certs PEM", "POST /admin/verify "}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %q, want %q", calls, want)
+	}
+}
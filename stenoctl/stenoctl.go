@@ -0,0 +1,262 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// stenoctl manages a stenographer server through its authenticated HTTP API:
+// it lists and cancels running queries, shows disk and retention status,
+// reloads the config and certs, places and releases legal holds, and
+// verifies indexes.  Run it with no arguments for its commands.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+var (
+	serverURL = flag.String("url", "", "The stenographer server, like https://sensor:1234.  Defaults to the one in STENOGRAPHER_CONFIG")
+	certPath  = flag.String("cert_path", "", "The directory holding the client certificate to connect with.  Defaults to the CertPath in STENOGRAPHER_CONFIG")
+	token     = flag.String("token", "", "A bearer token to connect with")
+	timeout   = flag.Duration("timeout", time.Minute, "How long to wait for the server.  verify waits however long it takes")
+	reason    = flag.String("reason", "", "Why packets are held, like a case number, for hold")
+)
+
+const usage = `Usage: stenoctl [flags] COMMAND [ARGS]
+
+Commands:
+  queries          List the queries being served.
+  cancel ID        Cancel the query being served with the given ID.
+  status           Show each packets directory's disk usage and retention.
+  reload           Make the server reread its config file.
+  certs [PEMFILE]  Make the server reload its certs, installing the server
+                   certificate and private key in PEMFILE first, if given.
+  holds            List legal holds.
+  hold QUERY       Place a legal hold on QUERY's packets (see -reason).
+  release ID       Release the hold with the given ID, deleting its packets.
+  verify           Check every index for corruption, quarantining corrupt
+                   files.
+
+Flags:
+`
+
+// defaults returns the server URL and CertPath of the stenographer config at
+// STENOGRAPHER_CONFIG, or /etc/stenographer/config, as stenocurl finds them,
+// or "" if it can't be read.
+func defaults() (url, certPath string) {
+	filename := os.Getenv("STENOGRAPHER_CONFIG")
+	if filename == "" {
+		filename = "/etc/stenographer/config"
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", ""
+	}
+	var c struct {
+		Host        string
+		Port        int
+		CertPath    string
+		ACMEDomains []string
+	}
+	if json.Unmarshal(data, &c) != nil || c.Port == 0 {
+		return "", c.CertPath
+	}
+	host := c.Host
+	if len(c.ACMEDomains) > 0 {
+		host = c.ACMEDomains[0]
+	}
+	return fmt.Sprintf("https://%s:%d", host, c.Port), c.CertPath
+}
+
+// newClient returns a client for the server the flags, or config, name.
+func newClient() (*stenoclient.Client, error) {
+	url, path := defaults()
+	if *serverURL != "" {
+		url = *serverURL
+	}
+	if *certPath != "" {
+		path = *certPath
+	}
+	if url == "" {
+		return nil, fmt.Errorf("no server given:  set -url, or STENOGRAPHER_CONFIG")
+	}
+	c, err := stenoclient.NewFromCertPath(url, path)
+	if err != nil {
+		return nil, err
+	}
+	c.Token = *token
+	return c, nil
+}
+
+// table writes rows of tab-separated columns aligned, the first as a header.
+func table(rows ...string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, row)
+	}
+	w.Flush()
+}
+
+// humanBytes formats n like "1.5G".
+func humanBytes(n float64) string {
+	for _, unit := range []string{"", "K", "M", "G", "T"} {
+		if n < 1024 || unit == "T" {
+			if unit == "" {
+				return fmt.Sprintf("%.0f", n)
+			}
+			return fmt.Sprintf("%.1f%s", n, unit)
+		}
+		n /= 1024
+	}
+	panic("unreachable")
+}
+
+// run runs the command in args.
+func run(ctx context.Context, c *stenoclient.Client, args []string) error {
+	cmd, args := args[0], args[1:]
+	want := map[string]int{"cancel": 1, "hold": 1, "release": 1}[cmd]
+	if cmd == "certs" && len(args) == 1 {
+		want = 1
+	}
+	if len(args) != want {
+		return fmt.Errorf("%s takes %d arguments, got %d", cmd, want, len(args))
+	}
+	switch cmd {
+	case "queries":
+		jobs, err := c.Jobs(ctx)
+		if err != nil {
+			return err
+		}
+		rows := []string{"ID\tPATH\tCLIENT\tDURATION\tBYTES\tQUERY"}
+		for _, j := range jobs {
+			rows = append(rows, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s", j.ID, j.Path, j.Client, j.Duration, humanBytes(float64(j.Bytes)), j.Query))
+		}
+		table(rows...)
+	case "cancel":
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid query ID %q", args[0])
+		}
+		return c.CancelJob(ctx, id)
+	case "status":
+		forecasts, err := c.Forecast(ctx)
+		if err != nil {
+			return err
+		}
+		rows := []string{"DIRECTORY\tTHREADS\tUSED\tUSABLE\tWRITE RATE\tRETAINED\tFORECAST"}
+		for _, f := range forecasts {
+			var threads []string
+			for _, t := range f.Threads {
+				threads = append(threads, strconv.Itoa(t))
+			}
+			rate, forecast := "-", "-"
+			if f.WriteBytesPerSecond > 0 {
+				rate = humanBytes(f.WriteBytesPerSecond) + "/s"
+			}
+			if f.Forecast != "" {
+				forecast = f.Forecast
+			}
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s", f.Dir, strings.Join(threads, ","),
+				humanBytes(float64(f.UsedBytes)), humanBytes(float64(f.UsableBytes)), rate, f.Retained, forecast))
+		}
+		table(rows...)
+	case "reload":
+		return c.ReloadConfig(ctx)
+	case "certs":
+		var pemBytes []byte
+		if len(args) == 1 {
+			var err error
+			if pemBytes, err = ioutil.ReadFile(args[0]); err != nil {
+				return err
+			}
+		}
+		return c.ReloadCerts(ctx, pemBytes)
+	case "holds":
+		holds, err := c.Holds(ctx)
+		if err != nil {
+			return err
+		}
+		rows := []string{"ID\tSTATE\tCREATED\tCLIENT\tPACKETS\tBYTES\tREASON\tQUERY"}
+		for _, h := range holds {
+			state := h.State
+			if h.Err != "" {
+				state += ": " + h.Err
+			}
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s", h.ID, state, h.Created.Format(time.RFC3339), h.Client,
+				h.Packets, humanBytes(float64(h.Bytes)), h.Reason, h.Query))
+		}
+		table(rows...)
+	case "hold":
+		h, err := c.PlaceHold(ctx, args[0], *reason, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println(h.ID)
+	case "release":
+		return c.ReleaseHold(ctx, args[0])
+	case "verify":
+		results, err := c.VerifyIndexes(ctx)
+		if err != nil {
+			return err
+		}
+		rows, corrupt := []string{"THREAD\tVERIFIED\tQUARANTINED"}, 0
+		for _, r := range results {
+			corrupt += len(r.Quarantined)
+			rows = append(rows, fmt.Sprintf("%d\t%d\t%s", r.Thread, r.Verified, strings.Join(r.Quarantined, ",")))
+		}
+		table(rows...)
+		if corrupt > 0 {
+			return fmt.Errorf("quarantined %d corrupt files", corrupt)
+		}
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, err := newClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.Background(), func() {}
+	if flag.Arg(0) != "verify" {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	defer cancel()
+	if err := run(ctx, c, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		cancel()
+		os.Exit(1)
+	}
+}
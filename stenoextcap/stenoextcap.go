@@ -0,0 +1,199 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// stenoextcap is a Wireshark extcap, which makes a stenographer server a
+// capture source:  choose "Stenographer" in Wireshark's capture interfaces,
+// type a query into its options, and the packets it returns stream straight
+// into Wireshark.  Install it in Wireshark's extcap directory (listed in
+// Help > About Wireshark > Folders).
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+// The flags Wireshark calls extcaps with, and this extcap's options.
+var (
+	listInterfaces = flag.Bool("extcap-interfaces", false, "List the interfaces this extcap provides")
+	_              = flag.String("extcap-version", "", "Wireshark's version")
+	iface          = flag.String("extcap-interface", "", "The interface to act on")
+	listDLTs       = flag.Bool("extcap-dlts", false, "List the interface's link types")
+	listConfig     = flag.Bool("extcap-config", false, "List the interface's options")
+	capture        = flag.Bool("capture", false, "Write the query's packets to --fifo")
+	fifo           = flag.String("fifo", "", "The pipe to write packets to")
+	captureFilter  = flag.String("extcap-capture-filter", "", "The capture filter, used as the query if --query isn't set")
+
+	serverURL    = flag.String("url", "", "The stenographer server, like https://sensor:1234")
+	certPath     = flag.String("cert_path", "", "The directory holding the client certificate to query with")
+	token        = flag.String("token", "", "A bearer token to query with")
+	query        = flag.String("query", "", "The stenographer query")
+	limitPackets = flag.Int64("limit_packets", 0, "Stop after this many packets")
+	live         = flag.Bool("live", false, "Stream packets matching the query as they're captured")
+)
+
+// interfaceName is the one interface stenoextcap provides.
+const interfaceName = "stenographer"
+
+// defaults returns the server URL and CertPath of the stenographer config at
+// STENOGRAPHER_CONFIG, or /etc/stenographer/config, as stenocurl finds them,
+// or "" if it can't be read.
+func defaults() (url, certPath string) {
+	filename := os.Getenv("STENOGRAPHER_CONFIG")
+	if filename == "" {
+		filename = "/etc/stenographer/config"
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", ""
+	}
+	var c struct {
+		Host        string
+		Port        int
+		CertPath    string
+		ACMEDomains []string
+	}
+	if json.Unmarshal(data, &c) != nil || c.Port == 0 {
+		return "", c.CertPath
+	}
+	host := c.Host
+	if len(c.ACMEDomains) > 0 {
+		host = c.ACMEDomains[0]
+	}
+	return fmt.Sprintf("https://%s:%d", host, c.Port), c.CertPath
+}
+
+// printConfig lists the options Wireshark shows in the interface's dialog.
+func printConfig() {
+	url, certPath := defaults()
+	withDefault := func(d string) string {
+		if d == "" {
+			return ""
+		}
+		return "{default=" + d + "}"
+	}
+	for _, arg := range []string{
+		"{number=0}{call=--url}{display=Server URL}{type=string}{required=true}" + withDefault(url) + "{tooltip=The stenographer server, like https://sensor:1234}",
+		"{number=1}{call=--cert_path}{display=Certificate directory}{type=string}{required=true}" + withDefault(certPath) + "{tooltip=The directory holding client_cert.pem, client_key.pem and ca_cert.pem}",
+		"{number=2}{call=--token}{display=Token}{type=password}{tooltip=A bearer token to query with, if the server needs one}",
+		"{number=3}{call=--query}{display=Query}{type=string}{tooltip=The stenographer query, like 'host 1.2.3.4 and after 1h ago'.  The capture filter is used if it's empty.}",
+		"{number=4}{call=--limit_packets}{display=Packet limit}{type=long}{range=0,1000000000}{default=0}{tooltip=Stop after this many packets, or 0 for no limit}",
+		"{number=5}{call=--live}{display=Live}{type=boolflag}{tooltip=Keep streaming packets matching the query as they're captured}",
+	} {
+		fmt.Println("arg " + arg)
+	}
+}
+
+// run writes the packets the query returns to the fifo, until they're done,
+// ctx is canceled, or Wireshark stops reading.
+func run(ctx context.Context) error {
+	q := *query
+	if q == "" {
+		q = *captureFilter
+	}
+	if *fifo == "" {
+		return fmt.Errorf("no --fifo to write packets to")
+	}
+	if strings.TrimSpace(q) == "" {
+		return fmt.Errorf("no query given:  set it in the interface's options, or as the capture filter")
+	}
+	c, err := stenoclient.NewFromCertPath(*serverURL, *certPath)
+	if err != nil {
+		return err
+	}
+	c.Token = *token
+	opts := &stenoclient.QueryOptions{Format: stenoclient.FormatPcapng, LimitPackets: *limitPackets}
+	var packets *stenoclient.Packets
+	if *live {
+		packets, err = c.Live(ctx, q, opts)
+	} else {
+		packets, err = c.Query(ctx, q, opts)
+	}
+	if err != nil {
+		return err
+	}
+	defer packets.Close()
+	if w := packets.Warning; w != nil {
+		fmt.Fprintf(os.Stderr, "Results are incomplete: %s\n", w.Message)
+	}
+	out, err := os.OpenFile(*fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), packets); err != nil {
+		if ctx.Err() != nil || isClosedPipe(err) {
+			return nil // Wireshark stopped the capture.
+		}
+		return err
+	}
+	if err := packets.Err(); err != nil {
+		return fmt.Errorf("stenographer failed partway through the query, results are incomplete: %v", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); packets.SHA256() != "" && packets.SHA256() != sum {
+		return fmt.Errorf("checksum mismatch, results are truncated or corrupt")
+	}
+	return nil
+}
+
+// isClosedPipe returns whether err is from writing to a pipe whose reader
+// has gone.
+func isClosedPipe(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EPIPE
+}
+
+func main() {
+	flag.Parse()
+	switch {
+	case *listInterfaces:
+		fmt.Println("extcap {version=1.0}{help=https://github.com/google/stenographer}")
+		fmt.Printf("interface {value=%s}{display=Stenographer query}\n", interfaceName)
+	case *iface != interfaceName:
+		fmt.Fprintf(os.Stderr, "unknown interface %q, want %q\n", *iface, interfaceName)
+		os.Exit(1)
+	case *listDLTs:
+		fmt.Println("dlt {number=1}{name=EN10MB}{display=Ethernet}")
+	case *listConfig:
+		printConfig()
+	case *capture:
+		ctx, cancel := context.WithCancel(context.Background())
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			cancel()
+		}()
+		if err := run(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newCert returns a certificate for cn, signed by parent and parentKey, or
+// a self-signed CA if parent is nil, and its key.
+func newCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testServer serves h over TLS to clients with certificates from the CA in
+// the directory it returns, which holds a client certificate as stenokeys.sh
+// creates them.  The function returned cleans up after it.
+func testServer(t *testing.T, h http.HandlerFunc) (url, certPath string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, caKey := newCert(t, "ca", nil, nil)
+	server, serverKey := newCert(t, "server", ca, caKey)
+	client, clientKey := newCert(t, "client", ca, caKey)
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"ca_cert.pem":     {Type: "CERTIFICATE", Bytes: ca.Raw},
+		"client_cert.pem": {Type: "CERTIFICATE", Bytes: client.Raw},
+		"client_key.pem":  {Type: "EC PRIVATE KEY", Bytes: clientKeyDER},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	s := httptest.NewUnstartedServer(h)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	s.StartTLS()
+	return s.URL, dir, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// setFlags sets the flags Wireshark captures with, returning a function
+// restoring them.
+func setFlags(url, cert, out, q, filter string, isLive bool) func() {
+	old := []string{*serverURL, *certPath, *fifo, *query, *captureFilter, *token}
+	oldLive, oldLimit := *live, *limitPackets
+	*serverURL, *certPath, *fifo, *query, *captureFilter, *token = url, cert, out, q, filter, "abc"
+	*live, *limitPackets = isLive, 10
+	return func() {
+		*serverURL, *certPath, *fifo, *query, *captureFilter, *token = old[0], old[1], old[2], old[3], old[4], old[5]
+		*live, *limitPackets = oldLive, oldLimit
+	}
+}
+
+func TestRun(t *testing.T) {
+	packets := []byte("pcapng packets")
+	sum := sha256.Sum256(packets)
+	var got string
+	url, cert, cleanup := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = fmt.Sprintf("%s %s %s %s %s", r.Method, r.URL, body, r.Header.Get("Steno-Limit-Packets"), r.Header.Get("Authorization"))
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Trailer", "Steno-Sha256, Steno-Error")
+		w.Write(packets)
+		switch {
+		case strings.Contains(string(body), "corrupt"):
+			w.Header().Set("Steno-Sha256", "1234")
+		case strings.Contains(string(body), "failing"):
+			w.Header().Set("Steno-Error", "disk on fire")
+		default:
+			w.Header().Set("Steno-Sha256", hex.EncodeToString(sum[:]))
+		}
+	})
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		desc          string
+		query, filter string
+		live          bool
+		noFifo        bool
+		wantRequest   string
+		wantErr       string
+	}{
+		{desc: "query", query: "port 80", wantRequest: "POST /query?format=pcapng port 80 10 Bearer abc"},
+		{desc: "capture filter", filter: "port 80", wantRequest: "POST /query?format=pcapng port 80 10 Bearer abc"},
+		{desc: "query over capture filter", query: "port 80", filter: "port 443", wantRequest: "POST /query?format=pcapng port 80 10 Bearer abc"},
+		{desc: "live", query: "port 80", live: true, wantRequest: "POST /live?format=pcapng port 80 10 Bearer abc"},
+		{desc: "no query", filter: "  ", wantErr: "no query given"},
+		{desc: "no fifo", query: "port 80", noFifo: true, wantErr: "no --fifo"},
+		{desc: "refused", query: "bad", wantErr: "bad query"},
+		{desc: "corrupt", query: "corrupt", wantErr: "checksum mismatch"},
+		{desc: "failed partway", query: "failing", wantErr: "disk on fire"},
+	} {
+		out := filepath.Join(dir, strings.Replace(test.desc, " ", "_", -1))
+		if err := ioutil.WriteFile(out, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if test.noFifo {
+			out = ""
+		}
+		restore := setFlags(url, cert, out, test.query, test.filter, test.live)
+		got = ""
+		err := run(context.Background())
+		restore()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%v: got error %v, want %q", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got error %v", test.desc, err)
+			continue
+		}
+		if got != test.wantRequest {
+			t.Errorf("%v: got request %q, want %q", test.desc, got, test.wantRequest)
+		}
+		if written, err := ioutil.ReadFile(out); err != nil || !bytes.Equal(written, packets) {
+			t.Errorf("%v: got %q written, %v; want the packets", test.desc, written, err)
+		}
+	}
+
+	// Without the client certificate, there's nothing to query with.
+	restore := setFlags(url, dir, filepath.Join(dir, "query"), "port 80", "", false)
+	defer restore()
+	if err := run(context.Background()); err == nil || !strings.Contains(err.Error(), "client certificate") {
+		t.Errorf("without certificates got %v, want it to need one", err)
+	}
+}
+
+func TestRunStoppedByWireshark(t *testing.T) {
+	// More packets than the pipe holds, so writing them blocks.
+	packets := bytes.Repeat([]byte("packet"), 1<<20)
+	url, cert, cleanup := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(packets)
+	})
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// Wireshark reads a little, then the capture's stopped.
+		f, err := os.Open(out)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.ReadFull(f, make([]byte, 100))
+		f.Close()
+	}()
+	restore := setFlags(url, cert, out, "port 80", "", false)
+	defer restore()
+	if err := run(context.Background()); err != nil {
+		t.Errorf("got %v, want the capture stopped cleanly", err)
+	}
+}
+
+func TestIsClosedPipe(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EPIPE, true},
+		{&os.PathError{Op: "write", Path: "/tmp/wireshark_fifo", Err: syscall.EPIPE}, true},
+		{&os.PathError{Op: "write", Path: "/tmp/wireshark_fifo", Err: syscall.ENOSPC}, false},
+		{errors.New("broken pipe"), false},
+		{io.ErrUnexpectedEOF, false},
+	} {
+		if got := isClosedPipe(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("STENOGRAPHER_CONFIG", os.Getenv("STENOGRAPHER_CONFIG"))
+	for _, test := range []struct {
+		config            string
+		wantURL, wantCert string
+	}{
+		{`{"Host": "127.0.0.1", "Port": 1234, "CertPath": "/etc/stenographer/certs"}`, "https://127.0.0.1:1234", "/etc/stenographer/certs"},
+		// Certificates from ACME are for the domain, not the address.
+		{`{"Host": "0.0.0.0", "Port": 443, "CertPath": "/certs", "ACMEDomains": ["steno.example.com", "other.example.com"]}`, "https://steno.example.com:443", "/certs"},
+		{`{"CertPath": "/certs"}`, "", "/certs"},
+		{`not json`, "", ""},
+		{"", "", ""}, // No config file.
+	} {
+		path := filepath.Join(dir, "missing")
+		if test.config != "" {
+			path = filepath.Join(dir, "config")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Setenv("STENOGRAPHER_CONFIG", path)
+		if url, cert := defaults(); url != test.wantURL || cert != test.wantCert {
+			t.Errorf("%q: got %q, %q; want %q, %q", test.config, url, cert, test.wantURL, test.wantCert)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("STENOGRAPHER_CONFIG", os.Getenv("STENOGRAPHER_CONFIG"))
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(`{"Host": "127.0.0.1", "Port": 1234, "CertPath": "/certs"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("STENOGRAPHER_CONFIG", path)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printConfig()
+	os.Stdout = stdout
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d options, want 6:\n%s", len(lines), out)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, fmt.Sprintf("arg {number=%d}{call=--", i)) {
+			t.Errorf("got option %q, want number %d", line, i)
+		}
+	}
+	for _, want := range []string{"{default=https://127.0.0.1:1234}", "{default=/certs}"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("got options without %q:\n%s", want, out)
+		}
+	}
+}
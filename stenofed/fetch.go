@@ -0,0 +1,205 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/federate"
+	"../federate"
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+// progressInterval is how often fetch reports each sensor's progress.
+const progressInterval = 2 * time.Second
+
+// stringList is a flag which may be given more than once.
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+// readSensorList reads a file listing a sensor per line, as its URL, or a
+// name and then its URL.  Blank lines and lines starting with # are
+// ignored.
+func readSensorList(filename string) ([]SensorConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sensor list: %v", err)
+	}
+	defer f.Close()
+	var out []SensorConfig
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+		case len(fields) == 1:
+			out = append(out, SensorConfig{URL: fields[0]})
+		case len(fields) == 2:
+			out = append(out, SensorConfig{Name: fields[0], URL: fields[1]})
+		default:
+			return nil, fmt.Errorf("%s:%d: want a URL, or a name and a URL", filename, n)
+		}
+	}
+	return out, scanner.Err()
+}
+
+// namedSensors fills in the CertPath of sensors, and names those without one
+// by their host.
+func namedSensors(sensors []SensorConfig, certPath string) ([]SensorConfig, error) {
+	names := map[string]bool{}
+	for i, s := range sensors {
+		if s.Name == "" {
+			u, err := url.Parse(s.URL)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid sensor URL %q", s.URL)
+			}
+			s.Name = u.Host
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("sensor %q given twice", s.Name)
+		}
+		names[s.Name] = true
+		if s.CertPath == "" {
+			s.CertPath = certPath
+		}
+		sensors[i] = s
+	}
+	return sensors, nil
+}
+
+// fetch runs q on every sensor, writing their packets to out merged in time
+// order, as a pcap, or as a pcapng with an interface per sensor.  Each
+// sensor's progress is reported to stderr as it goes, and fetch fails if
+// any sensor does, after writing the packets from those that didn't.
+func fetch(ctx context.Context, f *federate.Federation, q string, opts *stenoclient.QueryOptions, format string, out io.Writer) error {
+	if format != stenoclient.FormatPcap && format != stenoclient.FormatPcapng {
+		return fmt.Errorf("unknown format %q, want %q or %q", format, stenoclient.FormatPcap, stenoclient.FormatPcapng)
+	}
+	// Cancelled once the limit's reached, so sensors stop sending.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := base.Limit{Packets: opts.LimitPackets, Bytes: opts.LimitBytes}
+	results, err := f.Query(ctx, q, &stenoclient.QueryOptions{
+		LanguageVersion: opts.LanguageVersion,
+		Vars:            opts.Vars,
+		Snaplen:         opts.Snaplen,
+		LimitPackets:    opts.LimitPackets,
+		LimitBytes:      opts.LimitBytes,
+	})
+	if err != nil {
+		return err
+	}
+	for name, w := range results.Warnings {
+		fmt.Fprintf(os.Stderr, "Sensor %s warns: %s\n", name, w.Message)
+	}
+	for name, err := range results.Failed() {
+		fmt.Fprintf(os.Stderr, "Sensor %s unavailable, its packets are missing: %v\n", name, err)
+	}
+	done := make(chan struct{})
+	go reportProgress(results, done)
+	if format == stenoclient.FormatPcapng {
+		err = packetsToPcapng(results.Packets, out, limit, f.Sensors)
+	} else {
+		err = base.PacketsToFile(results.Packets, out, limit)
+	}
+	cancel()
+	close(done)
+	printProgress(results)
+	if err != nil {
+		return err
+	}
+	if errs := results.Errors(); len(errs) > 0 {
+		return fmt.Errorf("%d sensors failed partway through, results are incomplete", len(errs))
+	}
+	if len(results.Failed()) > 0 {
+		return fmt.Errorf("%d sensors were unavailable, results are incomplete", len(results.Failed()))
+	}
+	return nil
+}
+
+// reportProgress prints results' progress every progressInterval until done
+// is closed.
+func reportProgress(results *federate.Results, done chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			printProgress(results)
+		}
+	}
+}
+
+// printProgress prints how far each sensor has got to stderr, on one line.
+func printProgress(results *federate.Results) {
+	var msgs []string
+	for _, p := range results.Progress() {
+		state := "running"
+		switch {
+		case p.Err != nil:
+			state = "failed"
+		case p.Done:
+			state = "done"
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s, %d packets, %dKB", p.Sensor, state, p.Packets, p.Bytes>>10))
+	}
+	fmt.Fprintln(os.Stderr, strings.Join(msgs, "; "))
+}
+
+// packetsToPcapng writes packets to out as a pcapng, with an interface named
+// for each sensor, stopping at limit.
+func packetsToPcapng(packets *base.PacketChan, out io.Writer, limit base.Limit, sensors []federate.Sensor) error {
+	defer packets.Discard()
+	iface := func(s federate.Sensor) pcapgo.NgInterface {
+		return pcapgo.NgInterface{Name: s.Name, LinkType: layers.LinkTypeEthernet, SnapLength: 65536}
+	}
+	w, err := pcapgo.NewNgWriterInterface(out, iface(sensors[0]), pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		return err
+	}
+	for _, s := range sensors[1:] {
+		if _, err := w.AddInterface(iface(s)); err != nil {
+			return err
+		}
+	}
+	const packetHeaderSize = 32 // Of an enhanced packet block.
+	for p := range packets.Receive() {
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		if limit.ShouldStopAfter(base.Limit{Bytes: int64(len(p.Data) + packetHeaderSize), Packets: 1}) {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return packets.Err()
+}
@@ -0,0 +1,216 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// stenofed serves stenographer's /query API in front of several
+// stenographer sensors, sending each query to all of them and returning
+// their packets merged into a single pcap.  Given -query, it instead fetches
+// that query's packets once, to stdout, as stenoread does for several
+// sensors.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	//"github.com/google/stenographer/audit"
+	"../audit"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/certs"
+	"../certs"
+	//"github.com/google/stenographer/federate"
+	"../federate"
+	//"github.com/google/stenographer/stenoclient"
+	"../stenoclient"
+	"golang.org/x/net/context"
+)
+
+var (
+	configFilename = flag.String(
+		"config",
+		"/etc/stenographer/stenofed.conf",
+		"File location to read configuration from")
+
+	// Fetching a query's packets once, rather than serving.
+	query = flag.String(
+		"query", "",
+		"If set, write this query's packets from every sensor to stdout and exit, rather than serving")
+	sensorList = flag.String(
+		"sensors", "",
+		"With -query, a file listing the sensors to query, a URL or a name and a URL per line, rather than those in -config")
+	certPath = flag.String(
+		"cert_path", "/etc/stenographer/certs",
+		"With -sensor or -sensors, the directory holding the client certificate to query sensors with")
+	format          = flag.String("format", stenoclient.FormatPcap, "With -query, write packets as pcap or pcapng")
+	limitPackets    = flag.Int64("limit_packets", 0, "With -query, stop after this many packets")
+	limitBytes      = flag.Int64("limit_bytes", 0, "With -query, stop after this many bytes")
+	snaplen         = flag.Int("snaplen", 0, "With -query, only fetch the first this many bytes of each packet")
+	languageVersion = flag.Int("language_version", 0, "With -query, reject query keywords added after this version")
+	sensorURLs      stringList
+
+	// Verbose logging.
+	v = base.V
+)
+
+// Config is stenofed's configuration file, in JSON.
+type Config struct {
+	Port int
+	Host string // Location to listen.
+	// CertPath is a directory holding server_cert.pem and server_key.pem,
+	// which stenofed serves with, and ca_cert.pem, which client certificates
+	// must be signed by, as created by stenokeys.sh for stenographer.
+	CertPath string
+	Sensors  []SensorConfig
+	// AuditLogPath, if set, is a file a line of JSON is appended to for
+	// every query served, like stenographer's audit log.  AuditLogMaxMB
+	// rotates it once it's this large.
+	AuditLogPath  string `json:",omitempty"`
+	AuditLogMaxMB int64  `json:",omitempty"`
+}
+
+// SensorConfig is a stenographer sensor queries are sent to.
+type SensorConfig struct {
+	Name string // Used in logs, warnings and errors.
+	URL  string // Like "https://sensor1.example.com:1234".
+	// CertPath is a directory holding the client_cert.pem and client_key.pem
+	// stenofed authenticates to the sensor with, and the ca_cert.pem the
+	// sensor's certificate is signed by.
+	CertPath string
+	// Token, if set, is sent as a bearer token too.
+	Token string `json:",omitempty"`
+}
+
+// readConfig reads and checks the config file.
+func readConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file %q: %v", filename, err)
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("could not parse config file %q: %v", filename, err)
+	}
+	if len(c.Sensors) == 0 {
+		return nil, fmt.Errorf("no sensors configured")
+	}
+	if c.AuditLogMaxMB < 0 || (c.AuditLogMaxMB != 0 && c.AuditLogPath == "") {
+		return nil, fmt.Errorf("AuditLogMaxMB must be positive, and needs AuditLogPath")
+	}
+	names := map[string]bool{}
+	for _, s := range c.Sensors {
+		if s.Name == "" || s.URL == "" || s.CertPath == "" {
+			return nil, fmt.Errorf("sensors need a Name, URL and CertPath")
+		} else if names[s.Name] {
+			return nil, fmt.Errorf("sensor %q configured twice", s.Name)
+		}
+		names[s.Name] = true
+	}
+	return &c, nil
+}
+
+func init() {
+	flag.Var(&sensorURLs, "sensor", "With -query, the URL of a sensor to query, rather than those in -config; may be given more than once")
+}
+
+// newFederation returns a Federation of sensors.
+func newFederation(sensors []SensorConfig) (*federate.Federation, error) {
+	f := &federate.Federation{}
+	for _, s := range sensors {
+		c, err := stenoclient.NewFromCertPath(s.URL, s.CertPath)
+		if err != nil {
+			return nil, fmt.Errorf("sensor %q: %v", s.Name, err)
+		}
+		c.Token = s.Token
+		f.Sensors = append(f.Sensors, federate.Sensor{Name: s.Name, Client: c})
+		v(1, "federating sensor %q at %v", s.Name, s.URL)
+	}
+	return f, nil
+}
+
+// fetchSensors returns the sensors -query is sent to:  those given by
+// -sensor and -sensors, or else those in -config.
+func fetchSensors() ([]SensorConfig, error) {
+	var sensors []SensorConfig
+	for _, u := range sensorURLs {
+		sensors = append(sensors, SensorConfig{URL: u})
+	}
+	if *sensorList != "" {
+		listed, err := readSensorList(*sensorList)
+		if err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, listed...)
+	}
+	if len(sensors) == 0 {
+		conf, err := readConfig(*configFilename)
+		if err != nil {
+			return nil, err
+		}
+		return conf.Sensors, nil
+	}
+	return namedSensors(sensors, *certPath)
+}
+
+func main() {
+	flag.Parse()
+	if *query != "" {
+		sensors, err := fetchSensors()
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := newFederation(sensors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := fetch(context.Background(), f, *query, &stenoclient.QueryOptions{
+			LimitPackets:    *limitPackets,
+			LimitBytes:      *limitBytes,
+			LanguageVersion: *languageVersion,
+			Snaplen:         *snaplen,
+		}, *format, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	conf, err := readConfig(*configFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := newFederation(conf.Sensors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.AuditLogPath != "" {
+		if f.AuditLog, err = audit.Open(conf.AuditLogPath, conf.AuditLogMaxMB<<20, ""); err != nil {
+			log.Fatal(err)
+		}
+	}
+	tlsConfig, err := certs.ClientVerifyingTLSConfig(filepath.Join(conf.CertPath, "ca_cert.pem"))
+	if err != nil {
+		log.Fatalf("cannot verify client cert: %v", err)
+	}
+	http.Handle("/query", f)
+	server := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", conf.Host, conf.Port),
+		TLSConfig: tlsConfig,
+	}
+	log.Fatal(server.ListenAndServeTLS(
+		filepath.Join(conf.CertPath, "server_cert.pem"),
+		filepath.Join(conf.CertPath, "server_key.pem")))
+}
@@ -18,18 +18,39 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"log/syslog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/config"
+	//"github.com/google/stenographer/blockfile"
+	"./blockfile"
+	//"github.com/google/stenographer/config"
+	"./config"
 	//"github.com/google/stenographer/env"
         "./env"
+	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/indexfile"
+	"./indexfile"
+	//"github.com/google/stenographer/pcapimport"
+	"./pcapimport"
+	//"github.com/google/stenographer/pcapsplit"
+	"./pcapsplit"
+	//"github.com/google/stenographer/reindex"
+	"./reindex"
+	"golang.org/x/net/context"
 
 	_ "net/http/pprof" // server debugging info in /debug/pprof/*
 )
@@ -40,21 +61,280 @@ var (
 		"/etc/stenographer/config",
 		"File location to read configuration from")
 
+	validateConfig = flag.Bool(
+		"validate-config", false,
+		"If true, print the config file's values, with defaults filled in, "+
+			"and every error in it, and exit rather than running stenographer")
+
 	logToSyslog = flag.Bool(
 		"syslog", true, "If true, log to syslog.  Otherwise, log to stderr")
 
+	indexDump = flag.String(
+		"index_dump", "",
+		"If set, print a summary and the keys of this index file to stdout "+
+			"and exit, rather than running stenographer")
+	indexDumpStart = flag.String(
+		"index_dump_start", "", "Hex encoded first key for --index_dump")
+	indexDumpFinish = flag.String(
+		"index_dump_finish", "", "Hex encoded last key for --index_dump, "+
+			"or empty to dump through the end of the index")
+
+	indexExport = flag.String(
+		"index_export", "",
+		"If set, write every key and packet position in this index file to "+
+			"stdout and exit, rather than running stenographer")
+	indexExportFormat = flag.String(
+		"index_export_format", "sqlite", "Format for --index_export: "+
+			"'sqlite' for SQL statements to pipe into sqlite3, or 'csv'")
+	indexExportTimes = flag.Bool(
+		"index_export_times", true, "If true, --index_export reads each "+
+			"packet's capture time from the index's packet file")
+	indexExportPackets = flag.String(
+		"index_export_packets", "", "Directory holding the packet files "+
+			"for --index_export_times.  Defaults to the index's directory, "+
+			"with IDX replaced by PKT")
+
+	reindexPackets = flag.String(
+		"reindex", "",
+		"If set, rebuild the index of this packet file and exit, rather "+
+			"than running stenographer.  Requires --reindex_output")
+	reindexOutput = flag.String(
+		"reindex_output", "", "Where --reindex writes the rebuilt index, "+
+			"replacing any index already there")
+
+	importPcap = flag.String(
+		"import", "",
+		"If set, import the packets in this pcap or pcapng file into a "+
+			"thread's directories from the config file and exit, rather "+
+			"than running stenographer.  '-' reads standard input")
+	importThread = flag.Int(
+		"import_thread", 0, "The thread whose directories --import writes to")
+
+	splitPattern = flag.String(
+		"split", "",
+		"If set, split the pcap on standard input into files named by this "+
+			"pattern, which may hold strftime conversions like tcpdump -G's, "+
+			"and exit, rather than running stenographer")
+	splitSize = flag.Int64(
+		"split_size", 0, "For --split, start a new file before one grows "+
+			"past this many millions of bytes, like tcpdump -C")
+	splitSeconds = flag.Int(
+		"split_seconds", 0, "For --split, start a new file for every this "+
+			"many seconds of capture time, like tcpdump -G")
+
 	// Verbose logging.
 	v = base.V
 )
 
+// settingFlags collects repeated -set flags into config.FlagOverrides.
+type settingFlags []string
+
+func (s *settingFlags) String() string { return strings.Join(*s, " ") }
+
+func (s *settingFlags) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func init() {
+	flag.Var((*settingFlags)(&config.FlagOverrides), "set",
+		"Override a config file setting, like Port=1234 or "+
+			"Threads.0.PacketsDirectory=/data.  May be repeated, and takes "+
+			"precedence over STENOGRAPHER_* environment variables")
+}
+
 const (
 	snapLen = 65536 // Max packet size we return in pcap files to users.
 )
 
+// dumpIndex prints the summary and keys of an index file, for inspecting it
+// offline.
+func dumpIndex(filename, start, finish string) error {
+	startKey, err := hex.DecodeString(start)
+	if err != nil {
+		return fmt.Errorf("bad start key: %v", err)
+	}
+	finishKey, err := hex.DecodeString(finish)
+	if err != nil {
+		return fmt.Errorf("bad finish key: %v", err)
+	}
+	idx, err := indexfile.NewIndexFile(filename, filecache.NewCache(10))
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	s, err := idx.Stats()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "# ", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %s\n", b)
+	idx.Dump(os.Stdout, startKey, finishKey)
+	return nil
+}
+
+// exportIndex writes out the positions in an index file, along with when
+// each packet was captured, for analysis with other tools.
+func exportIndex(filename, format string, withTimes bool, packetDir string) error {
+	idx, err := indexfile.NewIndexFile(filename, filecache.NewCache(10))
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	var w indexfile.ExportWriter
+	switch format {
+	case "sqlite":
+		w, err = indexfile.NewSQLExporter(os.Stdout)
+	case "csv":
+		w, err = indexfile.NewCSVExporter(os.Stdout)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	var timeOf func(string, int64) time.Time
+	if withTimes {
+		if packetDir == "" {
+			packetDir = filepath.Dir(indexfile.BlockfilePathFromIndexPath(filename))
+			if idx.RollupOf() != nil {
+				packetDir = filepath.Dir(packetDir) // Rollups are in a subdirectory.
+			}
+		}
+		times := map[string]map[int64]time.Time{}
+		timeOf = func(file string, pos int64) time.Time {
+			if times[file] == nil {
+				times[file] = packetTimes(filepath.Join(packetDir, file))
+			}
+			return times[file][pos]
+		}
+	}
+	if err := idx.Export(w, timeOf); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// packetTimes returns the capture time of each packet in a blockfile, by
+// position.  If the file can't be read, times are left out.
+func packetTimes(filename string) map[int64]time.Time {
+	times := map[int64]time.Time{}
+	if err := blockfile.ScanPackets(filename, func(pos int64, p *base.Packet) error {
+		times[pos] = p.CaptureInfo.Timestamp
+		return nil
+	}); err != nil {
+		log.Printf("Not exporting packet times from %q: %v", filename, err)
+	}
+	return times
+}
+
+// importFile imports the pcap or pcapng file filename into the directories
+// of thread n in the config file configFilename.
+func importFile(filename, configFilename string, n int) (*pcapimport.Result, error) {
+	conf, err := config.ReadConfigFile(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(conf.Threads) {
+		return nil, fmt.Errorf("no thread %d, config has %d", n, len(conf.Threads))
+	}
+	in := io.Reader(os.Stdin)
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	t := conf.Threads[n]
+	return pcapimport.Import(context.Background(), in, t.PacketsDirectory, t.IndexDirectory)
+}
+
+// checkConfig prints the config in filename, with defaults filled in, and
+// any errors in it.  It returns whether the config is valid.
+func checkConfig(filename string) bool {
+	conf, err := config.ReadConfigFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	b, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	fmt.Printf("%s\n", b)
+	errs := conf.Problems()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	return len(errs) == 0
+}
+
 func main() {
 	flag.Parse()
 
+	if *validateConfig {
+		if !checkConfig(*configFilename) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *indexDump != "" {
+		if err := dumpIndex(*indexDump, *indexDumpStart, *indexDumpFinish); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *indexExport != "" {
+		if err := exportIndex(*indexExport, *indexExportFormat, *indexExportTimes, *indexExportPackets); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *reindexPackets != "" {
+		if *reindexOutput == "" {
+			log.Fatal("--reindex requires --reindex_output")
+		}
+		r, err := reindex.Rebuild(context.Background(), *reindexPackets, *reindexOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Rebuilt %q with %d keys for %d packets\n", *reindexOutput, r.Keys, r.Packets)
+		return
+	}
+	if *splitPattern != "" {
+		names, err := pcapsplit.Split(os.Stdin, *splitPattern, pcapsplit.Options{
+			MaxBytes: *splitSize * 1000000,
+			Interval: time.Duration(*splitSeconds) * time.Second,
+		})
+		for _, name := range names {
+			fmt.Fprintln(os.Stderr, "Wrote", name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *importPcap != "" {
+		r, err := importFile(*importPcap, *configFilename, *importThread)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Imported %d packets into %d files\n", r.Packets, len(r.Files))
+		if r.Truncated > 0 {
+			fmt.Printf("Truncated %d packets too large for a block\n", r.Truncated)
+		}
+		return
+	}
+
 	stenotypeOutput := io.Writer(os.Stderr)
+	logOutput := io.Writer(os.Stderr)
 
 	// Set up syslog logging
 	if *logToSyslog {
@@ -63,6 +343,7 @@ func main() {
 			log.Fatalf("could not set up syslog logging")
 		}
 		log.SetOutput(logwriter)
+		logOutput = logwriter
 		stenotypeOutput = logwriter // for stenotype
 	}
 
@@ -73,6 +354,9 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := base.SetLogFormat(conf.LogFormat, logOutput); err != nil {
+		log.Fatal(err)
+	}
 
 	v(1, "Using config:\n%+v", conf)
 	env, err := env.New(*conf)
@@ -82,8 +366,20 @@ func main() {
 	env.StenotypeOutput = stenotypeOutput
 	defer env.Close()
 
+	env.WatchConfig(*configFilename)
 	go env.RunStenotype()
 
 	env.ExportDebugHandlers(http.DefaultServeMux)
-	log.Fatal(env.Serve())
+	served := make(chan error, 1)
+	go func() { served <- env.Serve() }()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case sig := <-sigs:
+		log.Printf("Got %v, shutting down", sig)
+	}
+	env.Shutdown()
+	log.Printf("Shut down cleanly")
 }
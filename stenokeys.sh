@@ -16,9 +16,52 @@
 
 # This script sets up stenographer keys for client/server auth.
 
-if [[ $# != 2 ]]; then
-  echo "USAGE: $0 <stenouser> <stenogroup>" >&2
+function usage {
+  /bin/cat >&2 <<EOF
+USAGE: $0 [-k rsa|ecdsa|ed25519] [-d days] [-s san]... [rotate] <stenouser> <stenogroup>
+
+Creates a CA, and client and server keys/certs signed by it, in the config's
+CertPath, skipping any that already exist.  'rotate' re-issues the client and
+server keys/certs from the existing CA, which stenographer picks up without
+restarting.
+
+  -k  Key type of new keys:  rsa (4096 bits, the default), ecdsa (P-256) or
+      ed25519.
+  -d  Days new client and server certs are valid for (default 9999).
+  -s  Subject alternative name for the server cert, like DNS:steno.example.com
+      or IP:10.0.0.1.  May be repeated.  The config's Host is always added.
+EOF
   exit 1
+}
+
+KEYTYPE=rsa
+DAYS=9999
+SANS=()
+while getopts "k:d:s:" OPT; do
+  case "$OPT" in
+    k) KEYTYPE="$OPTARG" ;;
+    d) DAYS="$OPTARG" ;;
+    s) SANS+=("$OPTARG") ;;
+    *) usage ;;
+  esac
+done
+shift $((OPTIND-1))
+case "$KEYTYPE" in
+  rsa|ecdsa|ed25519) ;;
+  *) echo "Unknown key type '$KEYTYPE'" >&2; usage ;;
+esac
+if ! [[ "$DAYS" =~ ^[1-9][0-9]*$ ]]; then
+  echo "Invalid days '$DAYS'" >&2
+  usage
+fi
+
+ROTATE=0
+if [[ "$1" == "rotate" ]]; then
+  ROTATE=1
+  shift
+fi
+if [[ $# != 2 ]]; then
+  usage
 fi
 
 set -e
@@ -42,6 +85,15 @@ commonName = $1
 EOF
 }
 
+# genkey writes a new private key of type $KEYTYPE to $1.
+function genkey {
+  case "$KEYTYPE" in
+    rsa) openssl genrsa -out "$1" 4096 2>>errs ;;
+    ecdsa) openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out "$1" 2>>errs ;;
+    ed25519) openssl genpkey -algorithm ed25519 -out "$1" 2>>errs ;;
+  esac
+}
+
 function genca {
   if [ ! -e ca_cert.pem ]; then
     echo "Generating CA state"
@@ -58,7 +110,7 @@ EOF
     if [ ! -e ca/serial ]; then
       echo 1000 > ca/serial
     fi
-    openssl genrsa -out ca_key.pem 4096 2>>errs
+    genkey ca_key.pem
     openssl req -new -x509 -config ${CONFIG} -extensions ca_ext -key ca_key.pem -out ca_cert.pem -days 9999 2>>errs
   else
     echo "Skipping CA state generation, ca_cert.pem already exists"
@@ -75,6 +127,19 @@ function server_common {
   echo "$(getvar .Host)"
 }
 
+# server_sans prints the server cert's subjectAltName:  the config's Host, and
+# any given with -s.
+function server_sans {
+  HOST="$(server_common)"
+  if [[ "$HOST" =~ ^[0-9.]+$ || "$HOST" == *:* ]]; then
+    HOST="IP:$HOST"
+  else
+    HOST="DNS:$HOST"
+  fi
+  local IFS=,
+  echo "${HOST}${SANS[*]:+,${SANS[*]}}"
+}
+
 function client_common {
   echo "$(getvar .Host)_client"
 }
@@ -83,7 +148,7 @@ function gencert {
   TYP="$1"
   CN="$2"
   NAME="${TYP}_${CN}"
-  if [ -e ${TYP}_cert.pem ]; then
+  if [ -e ${TYP}_cert.pem -a $ROTATE == 0 ]; then
     echo "Skipping generation of '${NAME}' key/cert, ${NAME}_cert.pem already exists" >&2
   else
     echo "Generating key/cert for '${1}'"
@@ -98,6 +163,7 @@ extendedKeyUsage = clientAuth
 keyUsage = critical,digitalSignature,keyEncipherment
 basicConstraints = CA:false
 extendedKeyUsage = serverAuth
+subjectAltName = $(server_sans)
 
 [ ca_config ]
 private_key = ca_key.pem
@@ -106,17 +172,23 @@ new_certs_dir = ca
 database = ca/index.txt
 serial = ca/serial
 default_md = default
-default_days = 9999
+default_days = ${DAYS}
 policy = policy_match
+# Rotation re-issues certs with the same subjects.
+unique_subject = no
 
 [ policy_match ]
 organizationName = match
 countryName = match
 commonName = supplied
 EOF
-    openssl genrsa -out ${NAME}_key.pem 4096 2>>errs
-    openssl req -new -config ${CONFIG} -key ${NAME}_key.pem -out ${NAME}.csr -reqexts ${TYP}_ext -days 9999 2>>errs
-    openssl ca -config ${CONFIG} -name ca_config -batch -out ${NAME}_cert.pem -infiles ${NAME}.csr 2>>errs
+    # Keys and certs are written under new names, then renamed over the old
+    # ones, so a running stenographer never reads half-written files.
+    genkey ${NAME}_key.pem.new
+    openssl req -new -config ${CONFIG} -key ${NAME}_key.pem.new -out ${NAME}.csr 2>>errs
+    openssl ca -config ${CONFIG} -name ca_config -extensions ${TYP}_ext -batch -out ${NAME}_cert.pem.new -infiles ${NAME}.csr 2>>errs
+    mv -f ${NAME}_key.pem.new ${NAME}_key.pem
+    mv -f ${NAME}_cert.pem.new ${NAME}_cert.pem
     ln -s -f ${NAME}_key.pem ${TYP}_key.pem
     ln -s -f ${NAME}_cert.pem ${TYP}_cert.pem
   fi
@@ -143,13 +215,19 @@ trap onexit EXIT
 mkdir -p "$(getvar .CertPath)"
 cd "$(getvar .CertPath)"
 
-# If we're upgrading an old instance of steno, without a CA cert, we'll need
-# to kill their existing certs/keys.
-if [ ! -e ca_cert.pem ]; then
-  rm -f *.pem
+if [ $ROTATE == 1 ]; then
+  if [ ! -e ca_key.pem ]; then
+    echo "Can't rotate certs without the CA's key, ca_key.pem" >&2
+    exit 1
+  fi
+else
+  # If we're upgrading an old instance of steno, without a CA cert, we'll need
+  # to kill their existing certs/keys.
+  if [ ! -e ca_cert.pem ]; then
+    rm -f *.pem
+  fi
+  genca
 fi
-
-genca
 gencert client "$(client_common)"
 gencert server "$(server_common)"
 
@@ -19,6 +19,8 @@
 #include <unistd.h>  // close()
 #include <libaio.h>
 
+#include <algorithm>
+#include <sstream>
 #include <string>
 
 #include "util.h"
@@ -44,6 +46,7 @@ class PWrite {
   iocb cb;
   Block block;
   SingleFile* file;
+  int64_t submitted_micros;
 
  private:
   DISALLOW_COPY_AND_ASSIGN(PWrite);
@@ -107,6 +110,7 @@ void SingleFile::Write(io_context_t ctx, Block* b) {
   offset_ += data.size();
   cb->data = reinterpret_cast<void*>(write);
   outstanding_.insert(write);
+  write->submitted_micros = GetCurrentTimeMicros();
   int ret = 1;
   int64_t deadline = GetCurrentTimeMicros() + kNumMicrosPerSecond;
   while (GetCurrentTimeMicros() < deadline || ret > 0) {
@@ -131,7 +135,16 @@ Error SingleFile::Close() {
 
 }  // namespace io
 
-Output::Output(int aiops) : ctx_(NULL), max_ops_(aiops), current_(NULL) {
+std::string WriteStats::String() const {
+  std::stringstream out;
+  out << "writes=" << writes << " written_bytes=" << bytes
+      << " write_p50_us=" << p50_micros << " write_p90_us=" << p90_micros
+      << " write_p99_us=" << p99_micros << " write_max_us=" << max_micros;
+  return out.str();
+}
+
+Output::Output(int aiops)
+    : ctx_(NULL), max_ops_(aiops), current_(NULL), written_(0) {
   CHECK_SUCCESS(SetUp());
 }
 
@@ -160,9 +173,14 @@ Error Output::CheckForCompletedOps(bool block) {
     ret = io_getevents(ctx_, block ? 1 : 0, 4, events, NULL);
   } while (ret == -EINTR);
   RETURN_IF_ERROR(NegErrno(ret), "io_getevents");
+  int64_t now = GetCurrentTimeMicros();
   for (int i = 0; i < ret; i++) {
     auto aio = reinterpret_cast<io::PWrite*>(events[i].obj->data);
     auto file = aio->file;
+    latencies_.push_back(now - aio->submitted_micros);
+    if (long(events[i].res) > 0) {
+      written_ += long(events[i].res);
+    }
     REPLACE_IF_ERROR(result, aio->Done(&events[i]));
     REPLACE_IF_ERROR(result, MaybeCloseFile(file));
   }
@@ -208,6 +226,24 @@ Error Output::Flush() {
   return SUCCESS;
 }
 
+void Output::TakeWriteStats(WriteStats* stats) {
+  *stats = WriteStats();
+  stats->writes = latencies_.size();
+  stats->bytes = written_;
+  if (!latencies_.empty()) {
+    std::sort(latencies_.begin(), latencies_.end());
+    auto percentile = [this](int p) {
+      return latencies_[(latencies_.size() - 1) * p / 100];
+    };
+    stats->p50_micros = percentile(50);
+    stats->p90_micros = percentile(90);
+    stats->p99_micros = percentile(99);
+    stats->max_micros = latencies_.back();
+  }
+  latencies_.clear();
+  written_ = 0;
+}
+
 int Output::Outstanding() {
   int outstanding = 0;
   for (auto file : files_) {
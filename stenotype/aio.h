@@ -20,6 +20,7 @@
 
 #include <set>
 #include <string>
+#include <vector>
 
 #include "packets.h"
 #include "util.h"
@@ -30,6 +31,21 @@ namespace io {
 class SingleFile;  // Internal class, used by Output.
 }  // namespace io
 
+// WriteStats describes the block writes an Output completed over a period.
+struct WriteStats {
+  WriteStats()
+      : writes(0), bytes(0), p50_micros(0), p90_micros(0), p99_micros(0),
+        max_micros(0) {}
+  std::string String() const;
+  int64_t writes;
+  int64_t bytes;
+  // Percentiles of how long writes took from submission to completion.
+  int64_t p50_micros;
+  int64_t p90_micros;
+  int64_t p99_micros;
+  int64_t max_micros;
+};
+
 // Output implements an asynchronous, single-threaded method of writing
 // contiguous data to a file.  At any given time, Output will maintain an
 // ordered circular queue of asynchronous IO operations which it has submitted
@@ -64,6 +80,10 @@ class Output {
   // at least one operation has been completed.
   Error CheckForCompletedOps(bool block);
 
+  // Fill in stats on the writes completed since the last call, and start
+  // collecting them afresh.
+  void TakeWriteStats(WriteStats* stats);
+
  private:
   Error SetUp();
   int Outstanding();
@@ -73,6 +93,8 @@ class Output {
   int max_ops_;
   io::SingleFile* current_;
   std::set<io::SingleFile*> files_;
+  std::vector<int64_t> latencies_;  // of writes completed, in micros.
+  int64_t written_;                 // bytes by writes completed.
 
   DISALLOW_COPY_AND_ASSIGN(Output);
 };
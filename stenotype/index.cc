@@ -14,9 +14,11 @@
 
 #include "index.h"
 
+#include <algorithm>
 #include <memory>
 #include <string>
 
+#include <endian.h>            // htobe64()
 #include <netinet/if_ether.h>  // ethhdr
 #include <netinet/in.h>        // ntohs(), ntohl()
 #include <netinet/tcp.h>       // tcphdr
@@ -46,14 +48,43 @@ namespace st {
 const uint16_t kTypeEthernet = 0;
 const uint32_t kMPLSBottomOfStack = 1 << 8;
 
+// Flags indexed for packets with anomalies worth searching for.
+const uint8_t kFlagIPFragment = 1;
+const uint8_t kFlagBadIPChecksum = 2;
+
+// Width of the packet length ranges indexed together.  Must match
+// LengthBucketBytes in stenographer's indexfile package.
+const uint16_t kLengthBucketBytes = 64;
+
+// Tunnels whose inner IPs are indexed.
+const uint16_t kEthPTransparentEthernet = 0x6558;
+const uint16_t kVXLANPort = 4789;
+const uint16_t kGenevePort = 6081;
+
+// IPv4HeaderChecksumOK returns true if the len-byte IPv4 header starting at
+// start has a valid checksum.
+bool IPv4HeaderChecksumOK(const char* start, size_t len) {
+  uint32_t sum = 0;
+  for (size_t i = 0; i + 1 < len; i += 2) {
+    sum += ntohs(*reinterpret_cast<const uint16_t*>(start + i));
+  }
+  while (sum >> 16) {
+    sum = (sum & 0xFFFF) + (sum >> 16);
+  }
+  return sum == 0xFFFF;
+}
+
 void Index::Process(const Packet& p, int64_t block_offset) {
   packets_++;
+  AddTime(p.timestamp_nsecs);
   int64_t packet_offset = block_offset + p.offset_in_block;
   CHECK(packet_offset < (int64_t(1) << 32));
+  AddLength(p.length > 0xFFFF ? 0xFFFF : p.length, packet_offset);
   const char* start = p.data.data();
   const char* limit = start + p.data.size();
   uint16_t type = kTypeEthernet;
   uint8_t protocol = 0;
+  int vlan_tags = 0;
 
 // We use a goto loop within this switch statement to strip all pre-IP-header
 // layers off of the given packet.
@@ -76,8 +107,13 @@ pre_ip_encapsulation:
       if (start + 4 > limit) {
         return;
       }
-      AddVLAN(ntohs(*reinterpret_cast<const uint16_t*>(start)) & 0x0FFF,
-              packet_offset);
+      uint16_t vlan = ntohs(*reinterpret_cast<const uint16_t*>(start)) & 0x0FFF;
+      AddVLAN(vlan, packet_offset);
+      // With 802.1ad/QinQ stacking, every tag after the outermost one is also
+      // indexed as an inner VLAN, so double-tagged traffic can be told apart.
+      if (vlan_tags++ > 0) {
+        AddInnerVLAN(vlan, packet_offset);
+      }
       type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
       start += 4;
       goto pre_ip_encapsulation;
@@ -85,6 +121,7 @@ pre_ip_encapsulation:
     case ETH_P_MPLS_UC:
     case ETH_P_MPLS_MC: {
       uint32_t mpls_header = 0;
+      uint8_t mpls_depth = 0;
       do {
         // We check for 5 bytes, because we need to parse the first nibble after
         // the MPLS header to figure out the next layer type.
@@ -93,6 +130,12 @@ pre_ip_encapsulation:
         }
         mpls_header = ntohl(*reinterpret_cast<const uint32_t*>(start));
         AddMPLS(mpls_header >> 12, packet_offset);
+        // Depth 1 is the outermost (transport) label.  Stacks deeper than 255
+        // are only indexed by label.
+        if (mpls_depth < 255) {
+          AddMPLSDepth((uint64_t(++mpls_depth) << 32) | (mpls_header >> 12),
+                       packet_offset);
+        }
         start += 4;
       } while (!(mpls_header & kMPLSBottomOfStack));
       // Use the first nibble after the last MPLS layer to determine the
@@ -124,9 +167,17 @@ pre_ip_encapsulation:
       auto ip4 = reinterpret_cast<const struct iphdr*>(start);
       AddIPv4(ntohl(ip4->saddr), packet_offset);
       AddIPv4(ntohl(ip4->daddr), packet_offset);
+      AddDSCP(ip4->tos >> 2, packet_offset);
+      // Any fragment has either the more-fragments bit or an offset set.
+      if (ntohs(ip4->frag_off) & 0x3FFF) {
+        AddFlag(kFlagIPFragment, packet_offset);
+      }
       size_t len = ip4->ihl;
       len *= 4;
       if (len < 20) return;
+      if (start + len <= limit && !IPv4HeaderChecksumOK(start, len)) {
+        AddFlag(kFlagBadIPChecksum, packet_offset);
+      }
       protocol = ip4->protocol;
       start += len;
       break;
@@ -137,6 +188,9 @@ pre_ip_encapsulation:
       }
       auto ip6 = reinterpret_cast<const struct ip6_hdr*>(start);
       protocol = ip6->ip6_ctlun.ip6_un1.ip6_un1_nxt;
+      // The traffic class follows the 4-bit version, and DSCP is its top 6 bits.
+      AddDSCP((ntohl(ip6->ip6_ctlun.ip6_un1.ip6_un1_flow) >> 22) & 0x3F,
+              packet_offset);
       start += sizeof(struct ip6_hdr);
       AddIPv6(leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16),
               packet_offset);
@@ -151,6 +205,7 @@ pre_ip_encapsulation:
             return;
           }
           auto ip6frag = reinterpret_cast<const struct ip6_frag*>(start);
+          AddFlag(kFlagIPFragment, packet_offset);
           if (ntohs(ip6frag->ip6f_offlg) & 0xfff8) {
             // If we're not the first fragment, break out of the loop so we
             // can store the IPs we have but recognize in the protocol switch
@@ -198,6 +253,42 @@ pre_ip_encapsulation:
       auto udp = reinterpret_cast<const struct udphdr*>(start);
       AddPort(ntohs(udp->source), packet_offset);
       AddPort(ntohs(udp->dest), packet_offset);
+      start += sizeof(struct udphdr);
+      if (ntohs(udp->dest) == kVXLANPort) {
+        // VXLAN's 8-byte header is followed by an ethernet frame.
+        ProcessTunnel(kTypeEthernet, start + 8, limit, packet_offset);
+      } else if (ntohs(udp->dest) == kGenevePort && start + 8 <= limit) {
+        // Geneve's 8-byte header is followed by (byte 0 & 0x3F) * 4 bytes of
+        // options, and bytes 2-3 are the inner protocol.
+        uint16_t type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
+        ProcessTunnel(type == kEthPTransparentEthernet ? kTypeEthernet : type,
+                      start + 8 + (start[0] & 0x3F) * 4, limit, packet_offset);
+      }
+      break;
+    }
+    case IPPROTO_GRE: {
+      if (start + 4 > limit) {
+        return;
+      }
+      uint16_t flags = ntohs(*reinterpret_cast<const uint16_t*>(start));
+      uint16_t type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
+      size_t len = 4;
+      // Checksum, key, and sequence number fields are each optional.
+      if (flags & 0x8000) len += 4;
+      if (flags & 0x2000) len += 4;
+      if (flags & 0x1000) len += 4;
+      ProcessTunnel(type == kEthPTransparentEthernet ? kTypeEthernet : type,
+                    start + len, limit, packet_offset);
+      break;
+    }
+    case IPPROTO_ICMP:
+    case IPPROTO_ICMPV6: {
+      // ICMP and ICMPv6 both start with a 1-byte type then a 1-byte code.
+      if (start + 2 > limit) {
+        return;
+      }
+      AddICMPType(start[0], packet_offset);
+      AddICMPCode(start[1], packet_offset);
       break;
     }
     default:
@@ -205,6 +296,48 @@ pre_ip_encapsulation:
   }
 }
 
+void Index::ProcessTunnel(uint16_t type, const char* start,
+                          const char* limit, uint32_t pos) {
+  if (type == kTypeEthernet) {
+    if (start + sizeof(struct ethhdr) > limit) {
+      return;
+    }
+    type = ntohs(reinterpret_cast<const struct ethhdr*>(start)->h_proto);
+    start += sizeof(struct ethhdr);
+    while (type == ETH_P_8021Q || type == ETH_P_8021AD) {
+      if (start + 4 > limit) {
+        return;
+      }
+      type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
+      start += 4;
+    }
+  }
+  switch (type) {
+    case ETH_P_IP: {
+      if (start + sizeof(struct iphdr) > limit) {
+        return;
+      }
+      auto ip4 = reinterpret_cast<const struct iphdr*>(start);
+      AddInnerIPv4(ntohl(ip4->saddr), pos);
+      AddInnerIPv4(ntohl(ip4->daddr), pos);
+      break;
+    }
+    case ETH_P_IPV6: {
+      if (start + sizeof(struct ip6_hdr) > limit) {
+        return;
+      }
+      auto ip6 = reinterpret_cast<const struct ip6_hdr*>(start);
+      AddInnerIPv6(
+          leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16),
+          pos);
+      AddInnerIPv6(
+          leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_dst), 16),
+          pos);
+      break;
+    }
+  }
+}
+
 namespace {
 
 // ValueFromVector returns a leveldb slice to act as the value in an index,
@@ -242,7 +375,7 @@ void WriteToIndex(char first, const char* start, int size,
 // Should be incremented for backwards-incompatible changes.
 const uint16_t kIndexVersionNumberMajor = 2;
 // Should be incremented for backwards-compatible changes.
-const uint16_t kIndexVersionNumberMinor = 0;
+const uint16_t kIndexVersionNumberMinor = 10;
 
 const char kIndexVersion = 0;
 const char kIndexProtocol = 1;
@@ -251,10 +384,125 @@ const char kIndexVLAN = 3;
 const char kIndexIPv4 = 4;
 const char kIndexMPLS = 5;
 const char kIndexIPv6 = 6;
+const char kIndexICMPType = 7;
+const char kIndexICMPCode = 8;
+const char kIndexInnerVLAN = 9;
+const char kIndexMPLSDepth = 10;
+const char kIndexDSCP = 11;
+// Keys are packet lengths rounded down to a multiple of kLengthBucketBytes.
+const char kIndexLength = 12;
+const char kIndexFlag = 13;
+const char kIndexInnerIPv4 = 14;
+const char kIndexInnerIPv6 = 15;
+// Keys are [prefix length][first length/8 bytes of the address], holding the
+// positions of all IPv4 packets in that prefix.
+const char kIndexIPv4Prefix = 16;
+
+// Key (following the version key) whose value is the number of IP shard files
+// written alongside an index.  Only present if IPs are sharded.
+const char kIndexIPShardsKey[2] = {kIndexVersion, 1};
+
+// Key whose value records when the indexed packets were captured:  the first
+// and last packet times as 8-byte microseconds since the epoch, followed by a
+// 4-byte count of packets captured in each minute from the first packet's
+// through the last's.  Counts are left out if packets span more than
+// kMaxTimeHistogramMinutes.  Key 2 is used by stenographer's rollup indexes.
+const char kIndexTimesKey[2] = {kIndexVersion, 3};
+const int64_t kMaxTimeHistogramMinutes = 24 * 60;
+const int64_t kNanosPerMinute = 60LL * 1000 * 1000 * 1000;
+
+void AppendBigEndian64(std::string* out, int64_t val) {
+  uint64_t be = htobe64(static_cast<uint64_t>(val));
+  out->append(reinterpret_cast<const char*>(&be), 8);
+}
+
+void WriteVersion(leveldb::TableBuilder* ss) {
+  // The first entry we write is the version number that defines
+  // the format for this file.
+  char versionKeyBuf[1] = {kIndexVersion};
+  char versionBuf[8];
+  *reinterpret_cast<uint32_t*>(versionBuf) = htonl(kIndexVersionNumberMajor);
+  *reinterpret_cast<uint32_t*>(versionBuf + 4) =
+      htonl(kIndexVersionNumberMinor);
+  ss->Add(leveldb::Slice(versionKeyBuf, 1), leveldb::Slice(versionBuf, 8));
+}
+
+Error FinishTable(leveldb::TableBuilder* ss, leveldb::WritableFile* file) {
+  auto finished = ss->Finish();
+  if (!finished.ok()) {
+    return ERROR("could not finish writing index table: " +
+                 finished.ToString());
+  }
+  auto closed = file->Close();
+  if (!closed.ok()) {
+    return ERROR("could not close index table: " + closed.ToString());
+  }
+  return SUCCESS;
+}
+
+// ShardSuffix is appended to an index file's name to get the name of one of
+// its IP shard files.
+std::string ShardSuffix(int shard) { return ".ip" + std::to_string(shard); }
 
 }  // namespace
 
+void Index::AddTime(int64_t nanos) {
+  if (packets_ == 1 || nanos < first_nanos_) {
+    first_nanos_ = nanos;
+  }
+  if (packets_ == 1 || nanos > last_nanos_) {
+    last_nanos_ = nanos;
+  }
+  minutes_[nanos / kNanosPerMinute]++;
+}
+
+int Index::IPShard(uint8_t first_byte) {
+  return static_cast<int>(first_byte) * ip_shards_ / 256;
+}
+
+void Index::WriteIPv4Prefixes(leveldb::TableBuilder* ss, int shard) {
+  // Must match ipv4PrefixLengths in stenographer's indexfile package.
+  for (int bits : {8, 16, 24}) {
+    std::map<uint32_t, std::vector<uint32_t>> prefixes;
+    for (auto iter : ip4_) {
+      if (shard >= 0 && IPShard(iter.first >> 24) != shard) {
+        continue;
+      }
+      auto& positions = prefixes[iter.first >> (32 - bits)];
+      positions.insert(positions.end(), iter.second.begin(),
+                       iter.second.end());
+    }
+    for (auto& iter : prefixes) {
+      auto& positions = iter.second;
+      std::sort(positions.begin(), positions.end());
+      positions.erase(std::unique(positions.begin(), positions.end()),
+                      positions.end());
+      char buf[4];
+      buf[0] = bits;
+      uint32_t ip = htonl(iter.first << (32 - bits));
+      memcpy(buf + 1, &ip, bits / 8);
+      WriteToIndex(kIndexIPv4Prefix, buf, 1 + bits / 8, positions, ss);
+    }
+  }
+}
+
 Error Index::Flush() {
+  // Shards are written before the main index, so they're guaranteed to exist
+  // once the main index becomes visible to stenographer.
+  for (int shard = 0; ip_shards_ > 1 && shard < ip_shards_; shard++) {
+    leveldb::WritableFile* file = NULL;
+    std::string filename = HiddenFile(dirname_, micros_) + ShardSuffix(shard);
+    auto status = leveldb::Env::Default()->NewWritableFile(filename, &file);
+    if (!status.ok()) {
+      return ERROR("could not open '" + filename + "': " + status.ToString());
+    }
+    std::unique_ptr<leveldb::WritableFile> cleaner(file);
+    RETURN_IF_ERROR(WriteShardTo(file, shard), "writing shard " + filename);
+    std::string unhidden = UnhiddenFile(dirname_, micros_) + ShardSuffix(shard);
+    RETURN_IF_ERROR(Errno(rename(filename.c_str(), unhidden.c_str())),
+                    "rename");
+  }
+
   leveldb::WritableFile* file = NULL;
   std::string filename = HiddenFile(dirname_, micros_);
   auto status = leveldb::Env::Default()->NewWritableFile(filename, &file);
@@ -272,7 +520,11 @@ Error Index::Flush() {
   VLOG(1) << "Stored " << packets_ << " with " << ip4_.size() << " IP4 "
           << ip6_.size() << " IP6 " << proto_.size() << " protos "
           << port_.size() << " ports " << vlan_.size() << " vlan "
-          << mpls_.size() << " mpls";
+          << mpls_.size() << " mpls " << icmp_type_.size() << " icmp types "
+          << icmp_code_.size() << " icmp codes " << inner_vlan_.size()
+          << " inner vlan " << mpls_depth_.size() << " mpls depth "
+          << dscp_.size() << " dscp " << length_.size() << " lengths "
+          << flag_.size() << " flags";
   return SUCCESS;
 }
 
@@ -280,15 +532,27 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
   leveldb::Options options;
   options.compression = leveldb::kNoCompression;
   leveldb::TableBuilder index_ss(options, file);
-
-  // The first entry we write is the version number that defines
-  // the format for this file.
-  char versionKeyBuf[1] = {kIndexVersion};
-  char versionBuf[8];
-  *reinterpret_cast<uint32_t*>(versionBuf) = htonl(kIndexVersionNumberMajor);
-  *reinterpret_cast<uint32_t*>(versionBuf + 4) =
-      htonl(kIndexVersionNumberMinor);
-  index_ss.Add(leveldb::Slice(versionKeyBuf, 1), leveldb::Slice(versionBuf, 8));
+  WriteVersion(&index_ss);
+  if (ip_shards_ > 1) {
+    uint32_t shards = htonl(ip_shards_);
+    index_ss.Add(leveldb::Slice(kIndexIPShardsKey, 2),
+                 leveldb::Slice(reinterpret_cast<const char*>(&shards), 4));
+  }
+  if (packets_ > 0) {
+    std::string times;
+    AppendBigEndian64(&times, first_nanos_ / 1000);
+    AppendBigEndian64(&times, last_nanos_ / 1000);
+    int64_t first_minute = first_nanos_ / kNanosPerMinute;
+    int64_t last_minute = last_nanos_ / kNanosPerMinute;
+    if (last_minute - first_minute < kMaxTimeHistogramMinutes) {
+      for (int64_t m = first_minute; m <= last_minute; m++) {
+        auto found = minutes_.find(m);
+        uint32_t count = htonl(found == minutes_.end() ? 0 : found->second);
+        times.append(reinterpret_cast<const char*>(&count), 4);
+      }
+    }
+    index_ss.Add(leveldb::Slice(kIndexTimesKey, 2), times);
+  }
 
 #define WRITE_TO_INDEX(name, convert, indextype, size)                    \
   do {                                                                    \
@@ -302,26 +566,75 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
   WRITE_TO_INDEX(proto, , kIndexProtocol, 1);
   WRITE_TO_INDEX(port, htons, kIndexPort, 2);
   WRITE_TO_INDEX(vlan, htons, kIndexVLAN, 2);
-  WRITE_TO_INDEX(ip4, htonl, kIndexIPv4, 4);
+  // Sharded IPs are written by WriteShardTo instead.
+  if (ip_shards_ <= 1) {
+    WRITE_TO_INDEX(ip4, htonl, kIndexIPv4, 4);
+  }
   WRITE_TO_INDEX(mpls, htonl, kIndexMPLS, 4);
+  if (ip_shards_ <= 1) {
+    for (auto iter : ip6_) {
+      auto ip6 = iter.first.data();
+      WriteToIndex(kIndexIPv6, ip6, 16, iter.second, &index_ss);
+    }
+  }
+
+  // Index keys must be added in sorted order, so these types come after IPv6.
+  WRITE_TO_INDEX(icmp_type, , kIndexICMPType, 1);
+  WRITE_TO_INDEX(icmp_code, , kIndexICMPCode, 1);
+  WRITE_TO_INDEX(inner_vlan, htons, kIndexInnerVLAN, 2);
+  for (auto iter : mpls_depth_) {
+    // Keys are [depth (1 byte)][label (4 bytes)].
+    char buf[5];
+    buf[0] = iter.first >> 32;
+    *reinterpret_cast<uint32_t*>(buf + 1) = htonl(iter.first & 0xFFFFFFFF);
+    WriteToIndex(kIndexMPLSDepth, buf, 5, iter.second, &index_ss);
+  }
+  WRITE_TO_INDEX(dscp, , kIndexDSCP, 1);
+  WRITE_TO_INDEX(length, htons, kIndexLength, 2);
+  WRITE_TO_INDEX(flag, , kIndexFlag, 1);
+  // Inner IPs aren't sharded, since only tunneled traffic has them.
+  WRITE_TO_INDEX(inner_ip4, htonl, kIndexInnerIPv4, 4);
+  for (auto iter : inner_ip6_) {
+    WriteToIndex(kIndexInnerIPv6, iter.first.data(), 16, iter.second,
+                 &index_ss);
+  }
+  if (ip_prefixes_ && ip_shards_ <= 1) {
+    WriteIPv4Prefixes(&index_ss, -1);
+  }
 
 #undef WRITE_TO_INDEX
 
+  return FinishTable(&index_ss, file);
+}
+
+Error Index::WriteShardTo(leveldb::WritableFile* file, int shard) {
+  leveldb::Options options;
+  options.compression = leveldb::kNoCompression;
+  leveldb::TableBuilder index_ss(options, file);
+  WriteVersion(&index_ss);
+
+  // Shards hold the same IPv4 and IPv6 keys the main index would have, split
+  // up by the first byte of each address.
+  for (auto iter : ip4_) {
+    if (IPShard(iter.first >> 24) != shard) {
+      continue;
+    }
+    auto ip4 = htonl(iter.first);
+    WriteToIndex(kIndexIPv4, reinterpret_cast<const char*>(&ip4), 4,
+                 iter.second, &index_ss);
+  }
   for (auto iter : ip6_) {
     auto ip6 = iter.first.data();
+    if (IPShard(ip6[0]) != shard) {
+      continue;
+    }
     WriteToIndex(kIndexIPv6, ip6, 16, iter.second, &index_ss);
   }
-
-  auto finished = index_ss.Finish();
-  if (!finished.ok()) {
-    return ERROR("could not finish writing index table: " +
-                 finished.ToString());
+  if (ip_prefixes_) {
+    WriteIPv4Prefixes(&index_ss, shard);
   }
-  auto closed = file->Close();
-  if (!closed.ok()) {
-    return ERROR("could not close index table: " + closed.ToString());
-  }
-  return SUCCESS;
+
+  return FinishTable(&index_ss, file);
 }
 
 void Index::AddIPv6(leveldb::Slice ip, uint32_t pos) {
@@ -335,6 +648,17 @@ void Index::AddIPv6(leveldb::Slice ip, uint32_t pos) {
   }
 }
 
+void Index::AddInnerIPv6(leveldb::Slice ip, uint32_t pos) {
+  CHECK(ip.size() == 16);
+  auto finder = inner_ip6_.find(ip);
+  if (finder == inner_ip6_.end()) {
+    ip = ip_pieces_.Store(ip);
+    inner_ip6_[ip].push_back(pos);
+  } else {
+    finder->second.push_back(pos);
+  }
+}
+
 #define ADD_TO_INDEX(name, pos)   \
   do {                            \
     name##_[name].push_back(pos); \
@@ -347,6 +671,27 @@ void Index::AddPort(uint16_t port, uint32_t pos) { ADD_TO_INDEX(port, pos); }
 void Index::AddVLAN(uint16_t vlan, uint32_t pos) { ADD_TO_INDEX(vlan, pos); }
 void Index::AddMPLS(uint32_t mpls, uint32_t pos) { ADD_TO_INDEX(mpls, pos); }
 void Index::AddIPv4(uint32_t ip4, uint32_t pos) { ADD_TO_INDEX(ip4, pos); }
+void Index::AddICMPType(uint8_t icmp_type, uint32_t pos) {
+  ADD_TO_INDEX(icmp_type, pos);
+}
+void Index::AddICMPCode(uint8_t icmp_code, uint32_t pos) {
+  ADD_TO_INDEX(icmp_code, pos);
+}
+void Index::AddInnerVLAN(uint16_t inner_vlan, uint32_t pos) {
+  ADD_TO_INDEX(inner_vlan, pos);
+}
+void Index::AddMPLSDepth(uint64_t mpls_depth, uint32_t pos) {
+  ADD_TO_INDEX(mpls_depth, pos);
+}
+void Index::AddDSCP(uint8_t dscp, uint32_t pos) { ADD_TO_INDEX(dscp, pos); }
+void Index::AddLength(uint16_t length, uint32_t pos) {
+  length -= length % kLengthBucketBytes;
+  ADD_TO_INDEX(length, pos);
+}
+void Index::AddFlag(uint8_t flag, uint32_t pos) { ADD_TO_INDEX(flag, pos); }
+void Index::AddInnerIPv4(uint32_t inner_ip4, uint32_t pos) {
+  ADD_TO_INDEX(inner_ip4, pos);
+}
 
 #undef ADD_TO_INDEX
 
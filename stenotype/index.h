@@ -104,28 +104,66 @@ class SliceSet {
 // write to disk.
 class Index {
  public:
-  explicit Index(const std::string& dirname, int64_t micros)
+  // If ip_shards is greater than 1, IP keys are written to that many separate
+  // shard files, split by address prefix, instead of to the main index.
+  // If ip_prefixes is set, keys for each IPv4 /8, /16, and /24 seen are
+  // written too, so CIDR queries don't have to scan every address.
+  explicit Index(const std::string& dirname, int64_t micros, int ip_shards = 1,
+                 bool ip_prefixes = false)
       : dirname_(dirname),
         micros_(micros),
+        ip_shards_(ip_shards),
+        ip_prefixes_(ip_prefixes),
         packets_(0),
+        first_nanos_(0),
+        last_nanos_(0),
         ip_pieces_(1 << 20) {}  // Start slice set off at 1MB.
   virtual ~Index() {}
 
   void Process(const Packet& p, int64_t block_offset);
   Error Flush();
   Error WriteTo(leveldb::WritableFile* file);
+  Error WriteShardTo(leveldb::WritableFile* file, int shard);
 
  private:
+  int IPShard(uint8_t first_byte);
+  // WriteIPv4Prefixes writes the IPv4 prefix keys for the given shard, or for
+  // all addresses if shard is negative.
+  void WriteIPv4Prefixes(leveldb::TableBuilder* ss, int shard);
+  // AddTime records the capture time of a packet, for the times histogram.
+  void AddTime(int64_t nanos);
   void AddIPv4(uint32_t ip, uint32_t pos);
   void AddIPv6(leveldb::Slice ip, uint32_t pos);
   void AddProtocol(uint8_t proto, uint32_t pos);
   void AddPort(uint16_t port, uint32_t pos);
   void AddVLAN(uint16_t port, uint32_t pos);
   void AddMPLS(uint32_t mpls, uint32_t pos);
+  void AddICMPType(uint8_t icmp_type, uint32_t pos);
+  void AddICMPCode(uint8_t icmp_code, uint32_t pos);
+  void AddInnerVLAN(uint16_t inner_vlan, uint32_t pos);
+  // mpls_depth is the stack depth (1 == outermost) shifted left 32 bits, ORed
+  // with the label.
+  void AddMPLSDepth(uint64_t mpls_depth, uint32_t pos);
+  void AddDSCP(uint8_t dscp, uint32_t pos);
+  // Lengths are indexed in buckets of kLengthBucketBytes, each keyed by the
+  // shortest length in it.  Callers cap lengths at 65535.
+  void AddLength(uint16_t length, uint32_t pos);
+  void AddFlag(uint8_t flag, uint32_t pos);
+  void AddInnerIPv4(uint32_t ip, uint32_t pos);
+  void AddInnerIPv6(leveldb::Slice ip, uint32_t pos);
+  // ProcessTunnel indexes the inner IPs of a GRE/VXLAN/Geneve payload
+  // starting at start, whose first layer is of the given type.
+  void ProcessTunnel(uint16_t type, const char* start, const char* limit,
+                     uint32_t pos);
 
   std::string dirname_;
   int64_t micros_;
+  int ip_shards_;
+  bool ip_prefixes_;
   int64_t packets_;
+  int64_t first_nanos_;
+  int64_t last_nanos_;
+  std::map<int64_t, uint32_t> minutes_;  // Packets captured in each minute.
   SliceSet ip_pieces_;
   std::map<uint32_t, std::vector<uint32_t>> ip4_;
   std::map<leveldb::Slice, std::vector<uint32_t>> ip6_;
@@ -133,6 +171,15 @@ class Index {
   std::map<uint16_t, std::vector<uint32_t>> port_;
   std::map<uint16_t, std::vector<uint32_t>> vlan_;
   std::map<uint32_t, std::vector<uint32_t>> mpls_;
+  std::map<uint8_t, std::vector<uint32_t>> icmp_type_;
+  std::map<uint8_t, std::vector<uint32_t>> icmp_code_;
+  std::map<uint16_t, std::vector<uint32_t>> inner_vlan_;
+  std::map<uint64_t, std::vector<uint32_t>> mpls_depth_;
+  std::map<uint8_t, std::vector<uint32_t>> dscp_;
+  std::map<uint16_t, std::vector<uint32_t>> length_;
+  std::map<uint8_t, std::vector<uint32_t>> flag_;
+  std::map<uint32_t, std::vector<uint32_t>> inner_ip4_;
+  std::map<leveldb::Slice, std::vector<uint32_t>> inner_ip6_;
 
   DISALLOW_COPY_AND_ASSIGN(Index);
 };
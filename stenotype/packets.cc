@@ -15,6 +15,7 @@
 #include "packets.h"
 
 #include <climits>            // USHRT_MAX
+#include <stddef.h>           // offsetof()
 #include <errno.h>            // errno, ENOPROTOOPT
 #include <linux/if_ether.h>   // ETH_P_ALL
 #include <linux/if_packet.h>  // AF_PACKET, sockaddr_ll
@@ -27,7 +28,13 @@
 #include <sys/socket.h>       // socket()
 #include <unistd.h>           // close(), getpid()
 #include <sys/ioctl.h>        // ioctl()
+#ifdef XDP
+#include <linux/bpf.h>        // bpf_attr, bpf_insn, BPF_*
+#include <sys/syscall.h>      // syscall(), __NR_bpf
+#include <time.h>             // clock_gettime()
+#endif
 
+#include <algorithm>
 #include <memory>
 #include <string>
 #include <sstream>
@@ -44,6 +51,49 @@ inline size_t Align(size_t v) {
 
 const int kNoFanout = -1;
 
+// Checksums are stamped into the 8 bytes of padding at the end of each
+// packet's tpacket3_hdr, which the kernel zeroes:  a CRC32C of the packet,
+// then this magic number, so readers can tell checksummed packets from those
+// written by older versions of stenotype.
+const uint32_t kPacketChecksumMagic = 0x31435243;  // "CRC1"
+
+// Crc32c extends crc (as returned by a previous call, or 0) with n more
+// bytes, using the Castagnoli polynomial.
+uint32_t Crc32c(uint32_t crc, const char* data, size_t n) {
+  static const struct Table {
+    Table() {
+      for (uint32_t i = 0; i < 256; i++) {
+        uint32_t c = i;
+        for (int k = 0; k < 8; k++) {
+          c = (c & 1) ? (c >> 1) ^ 0x82F63B78 : c >> 1;
+        }
+        t[i] = c;
+      }
+    }
+    uint32_t t[256];
+  } table;
+  crc = ~crc;
+  for (size_t i = 0; i < n; i++) {
+    crc = table.t[(crc ^ uint8_t(data[i])) & 0xff] ^ (crc >> 8);
+  }
+  return ~crc;
+}
+
+const uint64_t kFNVOffset = 14695981039346656037ULL;
+
+// Fnv64a extends the 64-bit FNV-1a hash h with n more bytes.
+uint64_t Fnv64a(uint64_t h, const char* data, size_t n) {
+  for (size_t i = 0; i < n; i++) {
+    h ^= uint8_t(data[i]);
+    h *= 1099511628211ULL;
+  }
+  return h;
+}
+
+inline uint16_t BigEndian16(const char* data) {
+  return (uint16_t(uint8_t(data[0])) << 8) | uint8_t(data[1]);
+}
+
 }  // namespace
 
 namespace st {
@@ -147,6 +197,142 @@ void Block::MoveToNext() {
   packet_ = reinterpret_cast<struct tpacket3_hdr*>(next);
 }
 
+void Block::StampChecksums() {
+  if (start_ == NULL) {
+    return;
+  }
+  char* next = start_ + block_->hdr.bh1.offset_to_first_pkt;
+  for (uint32_t i = 0; i < block_->hdr.bh1.num_pkts; i++) {
+    struct tpacket3_hdr* pkt = reinterpret_cast<struct tpacket3_hdr*>(next);
+    // The header's tp_next_offset through tp_len, its tp_mac, then the data.
+    uint32_t crc = Crc32c(0, next, offsetof(struct tpacket3_hdr, tp_status));
+    crc = Crc32c(crc, reinterpret_cast<char*>(&pkt->tp_mac),
+                 sizeof(pkt->tp_mac));
+    crc = Crc32c(crc, next + pkt->tp_mac, pkt->tp_snaplen);
+    memcpy(pkt->tp_padding, &crc, sizeof(crc));
+    memcpy(pkt->tp_padding + sizeof(crc), &kPacketChecksumMagic,
+           sizeof(kPacketChecksumMagic));
+    if (pkt->tp_next_offset != 0) {
+      next += pkt->tp_next_offset;
+    } else {
+      next += Align(pkt->tp_snaplen + pkt->tp_mac);
+    }
+  }
+}
+
+// NetworkHash hashes a packet's data from its network layer on, and that
+// layer's length, skipping VLAN tags and the IP fields routers change.
+// Non-IP packets are hashed whole, with their whole length.  This matches
+// networkHash in stenographer's env package, as checked against
+// testdata/network_hash.txt.
+uint64_t NetworkHash(const Packet& p) {
+  const char* data = p.data.data();
+  size_t size = p.data.size();
+  size_t offset = 12;
+  uint16_t ether_type = 0;
+  while (offset + 2 <= size) {
+    ether_type = BigEndian16(data + offset);
+    if (ether_type != 0x8100 && ether_type != 0x88a8) {  // VLAN tags.
+      break;
+    }
+    offset += 4;
+  }
+  const char* l3 = data + size;
+  size_t l3_size = 0;
+  if (offset + 2 <= size) {
+    l3 = data + offset + 2;
+    l3_size = size - offset - 2;
+  }
+  char hdr[40];
+  size_t hdr_size = 0;
+  if (ether_type == 0x0800 && l3_size >= 20) {
+    hdr_size = 20;
+    memcpy(hdr, l3, hdr_size);
+    hdr[8] = hdr[10] = hdr[11] = 0;  // TTL and checksum.
+  } else if (ether_type == 0x86dd && l3_size >= 40) {
+    hdr_size = 40;
+    memcpy(hdr, l3, hdr_size);
+    hdr[7] = 0;  // Hop limit.
+  }
+  uint32_t len = p.length;
+  if (hdr_size > 0) {
+    len -= offset + 2;
+  }
+  char length[4];
+  for (int i = 0; i < 4; i++) {
+    length[i] = char(len >> (24 - 8 * i));
+  }
+  uint64_t h = Fnv64a(kFNVOffset, length, sizeof(length));
+  if (hdr_size == 0) {
+    return Fnv64a(h, data, size);
+  }
+  h = Fnv64a(h, hdr, hdr_size);
+  return Fnv64a(h, l3 + hdr_size, l3_size - hdr_size);
+}
+
+int Block::RemoveDuplicates(Deduplicator* dedup) {
+  if (start_ == NULL) {
+    return 0;
+  }
+  char* next = start_ + block_->hdr.bh1.offset_to_first_pkt;
+  struct tpacket3_hdr* last_kept = NULL;
+  uint32_t kept = 0;
+  int removed = 0;
+  for (uint32_t i = 0; i < block_->hdr.bh1.num_pkts; i++) {
+    struct tpacket3_hdr* pkt = reinterpret_cast<struct tpacket3_hdr*>(next);
+    Packet p;
+    p.data = leveldb::Slice(next + pkt->tp_mac, pkt->tp_snaplen);
+    p.length = pkt->tp_len;
+    p.timestamp_nsecs = pkt->tp_sec * 1000000000LL + pkt->tp_nsec;
+    if (dedup->Duplicate(p)) {
+      removed++;
+    } else {
+      // Link this packet to the last one kept, over any removed between them.
+      if (last_kept == NULL) {
+        block_->hdr.bh1.offset_to_first_pkt = next - start_;
+      } else {
+        last_kept->tp_next_offset = next - reinterpret_cast<char*>(last_kept);
+      }
+      last_kept = pkt;
+      kept++;
+    }
+    if (pkt->tp_next_offset != 0) {
+      next += pkt->tp_next_offset;
+    } else {
+      next += Align(pkt->tp_snaplen + pkt->tp_mac);
+    }
+  }
+  if (removed > 0) {
+    if (last_kept != NULL) {
+      last_kept->tp_next_offset = 0;
+    }
+    block_->hdr.bh1.num_pkts = kept;
+    packet_ = reinterpret_cast<struct tpacket3_hdr*>(
+        start_ + block_->hdr.bh1.offset_to_first_pkt);
+  }
+  return removed;
+}
+
+bool Deduplicator::Duplicate(const Packet& p) {
+  while (!seen_.empty() &&
+         p.timestamp_nsecs - seen_.front().first > window_nsecs_) {
+    auto it = last_seen_.find(seen_.front().second);
+    if (it != last_seen_.end() && it->second == seen_.front().first) {
+      last_seen_.erase(it);
+    }
+    seen_.pop_front();
+  }
+  uint64_t hash = NetworkHash(p);
+  auto it = last_seen_.find(hash);
+  if (it != last_seen_.end() &&
+      p.timestamp_nsecs - it->second <= window_nsecs_) {
+    return true;
+  }
+  last_seen_[hash] = p.timestamp_nsecs;
+  seen_.emplace_back(p.timestamp_nsecs, hash);
+  return false;
+}
+
 int Block::Status() { return block_->hdr.bh1.block_status; }
 int64_t Block::TimeNSecs() {
   return packet_->tp_sec * 1000000000 + packet_->tp_nsec;
@@ -201,6 +387,389 @@ Error TestimonyPackets::NextBlock(Block* b, int poll_millis) {
 Error TestimonyPackets::GetStats(Stats* stats) { return SUCCESS; }
 #endif
 
+#ifdef XDP
+namespace {
+
+// Bpf makes a bpf() syscall.
+int Bpf(int cmd, union bpf_attr* attr) {
+  return syscall(__NR_bpf, cmd, attr, sizeof(*attr));
+}
+
+// UMEM frames are a page each, so packets up to about 4KB can be read.
+const uint32_t kXDPFrameSize = 4096;
+// Frames per socket, and entries in each of its rings.
+const uint32_t kXDPFrames = 4096;
+
+// Offsets of a block's first packet, and of each packet's data from its
+// header, as TPACKET_V3 lays them out.
+const size_t kXDPBlockHeader = TPACKET_ALIGN(sizeof(struct tpacket_block_desc));
+const size_t kXDPPacketHeader = TPACKET_ALIGN(sizeof(struct tpacket3_hdr));
+
+}  // namespace
+
+XDPRedirect::XDPRedirect()
+    : ifindex_(0), map_fd_(-1), prog_fd_(-1), link_fd_(-1), promisc_fd_(-1) {}
+
+XDPRedirect::~XDPRedirect() {
+  for (int fd : {link_fd_, prog_fd_, map_fd_, promisc_fd_}) {
+    if (fd >= 0) {
+      close(fd);
+    }
+  }
+}
+
+Error XDPRedirect::Attach(const std::string& iface, int num_queues,
+                          bool promisc, XDPRedirect** out) {
+  std::unique_ptr<XDPRedirect> r(new XDPRedirect);
+  r->ifindex_ = if_nametoindex(iface.c_str());
+  if (r->ifindex_ == 0) {
+    return Errno();
+  }
+  if (promisc) {
+    // Promiscuous mode set through an AF_PACKET membership lasts as long as
+    // the socket, so it's dropped when stenotype exits.  The socket's bound
+    // to no protocol, so receives nothing.
+    r->promisc_fd_ = socket(AF_PACKET, SOCK_RAW, 0);
+    RETURN_IF_ERROR(Errno(r->promisc_fd_), "promisc socket");
+    struct packet_mreq mreq;
+    memset(&mreq, 0, sizeof(mreq));
+    mreq.mr_ifindex = r->ifindex_;
+    mreq.mr_type = PACKET_MR_PROMISC;
+    RETURN_IF_ERROR(Errno(setsockopt(r->promisc_fd_, SOL_PACKET,
+                                     PACKET_ADD_MEMBERSHIP, &mreq,
+                                     sizeof(mreq))),
+                    "turning on promisc");
+  }
+
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.map_type = BPF_MAP_TYPE_XSKMAP;
+  attr.key_size = sizeof(uint32_t);
+  attr.value_size = sizeof(uint32_t);
+  attr.max_entries = num_queues;
+  r->map_fd_ = Bpf(BPF_MAP_CREATE, &attr);
+  RETURN_IF_ERROR(Errno(r->map_fd_), "creating XSKMAP");
+
+  // return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+  struct bpf_insn prog[] = {
+      {BPF_LDX | BPF_MEM | BPF_W, BPF_REG_2, BPF_REG_1,
+       offsetof(struct xdp_md, rx_queue_index), 0},
+      {BPF_LD | BPF_DW | BPF_IMM, BPF_REG_1, BPF_PSEUDO_MAP_FD, 0,
+       r->map_fd_},
+      {0, 0, 0, 0, 0},
+      {BPF_ALU64 | BPF_MOV | BPF_K, BPF_REG_3, 0, 0, XDP_PASS},
+      {BPF_JMP | BPF_CALL, 0, 0, 0, BPF_FUNC_redirect_map},
+      {BPF_JMP | BPF_EXIT, 0, 0, 0, 0},
+  };
+  char log[4096] = "";
+  memset(&attr, 0, sizeof(attr));
+  attr.prog_type = BPF_PROG_TYPE_XDP;
+  attr.insns = reinterpret_cast<uintptr_t>(prog);
+  attr.insn_cnt = sizeof(prog) / sizeof(prog[0]);
+  attr.license = reinterpret_cast<uintptr_t>("GPL");
+  attr.log_buf = reinterpret_cast<uintptr_t>(log);
+  attr.log_size = sizeof(log);
+  attr.log_level = 1;
+  r->prog_fd_ = Bpf(BPF_PROG_LOAD, &attr);
+  if (r->prog_fd_ < 0) {
+    LOG(ERROR) << "XDP program rejected: " << log;
+  }
+  RETURN_IF_ERROR(Errno(r->prog_fd_), "loading XDP program");
+
+  memset(&attr, 0, sizeof(attr));
+  attr.link_create.prog_fd = r->prog_fd_;
+  attr.link_create.target_ifindex = r->ifindex_;
+  attr.link_create.attach_type = BPF_XDP;
+  r->link_fd_ = Bpf(BPF_LINK_CREATE, &attr);
+  RETURN_IF_ERROR(Errno(r->link_fd_), "attaching XDP program");
+  *out = r.release();
+  return SUCCESS;
+}
+
+Error XDPRedirect::Register(int queue, int fd) {
+  uint32_t key = queue;
+  uint32_t value = fd;
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.map_fd = map_fd_;
+  attr.key = reinterpret_cast<uintptr_t>(&key);
+  attr.value = reinterpret_cast<uintptr_t>(&value);
+  return Errno(Bpf(BPF_MAP_UPDATE_ELEM, &attr));
+}
+
+XDPPackets::XDPPackets()
+    : fd_(-1),
+      umem_(NULL),
+      umem_size_(0),
+      blocks_(NULL),
+      block_size_(0),
+      num_blocks_(0),
+      retire_micros_(0),
+      block_mus_(NULL),
+      offset_(0),
+      filling_(NULL),
+      fill_offset_(0),
+      last_packet_(0),
+      num_packets_(0),
+      first_micros_(0),
+      full_(false),
+      seq_(0),
+      oversized_(0) {
+  memset(&rx_, 0, sizeof(rx_));
+  memset(&fill_, 0, sizeof(fill_));
+}
+
+XDPPackets::~XDPPackets() {
+  for (size_t i = 0; i < num_blocks_; i++) {
+    // Wait for all blocks to be released.
+    block_mus_[i].lock();
+    block_mus_[i].unlock();
+  }
+  delete[] block_mus_;
+  if (blocks_ != NULL) {
+    munmap(blocks_, block_size_ * num_blocks_);
+  }
+  for (Ring* ring : {&rx_, &fill_}) {
+    if (ring->map != NULL) {
+      munmap(ring->map, ring->map_size);
+    }
+  }
+  if (fd_ >= 0) {
+    close(fd_);
+  }
+  if (umem_ != NULL) {
+    munmap(umem_, umem_size_);
+  }
+}
+
+Error XDPPackets::Create(XDPRedirect* redirect, int queue, size_t block_size,
+                         size_t num_blocks, int64_t retire_millis,
+                         Packets** out) {
+  if (block_size % getpagesize() != 0) {
+    return ERROR("block size not divisible by page size");
+  }
+  std::unique_ptr<XDPPackets> x(new XDPPackets);
+  x->block_size_ = block_size;
+  x->num_blocks_ = num_blocks;
+  x->retire_micros_ = retire_millis * kNumMicrosPerMilli;
+  x->offset_ = num_blocks - 1;
+  x->blocks_ = reinterpret_cast<char*>(
+      mmap(NULL, block_size * num_blocks, PROT_READ | PROT_WRITE,
+           MAP_PRIVATE | MAP_ANONYMOUS | MAP_NORESERVE, -1, 0));
+  if (x->blocks_ == MAP_FAILED) {
+    x->blocks_ = NULL;
+    return Errno();
+  }
+  x->block_mus_ = new std::mutex[num_blocks];
+  RETURN_IF_ERROR(x->SetUp(redirect, queue), "AF_XDP setup");
+  *out = x.release();
+  return SUCCESS;
+}
+
+Error XDPPackets::MapRing(Ring* ring, const struct xdp_ring_offset& off,
+                          size_t entries, size_t desc_size, off_t pgoff) {
+  ring->map_size = off.desc + entries * desc_size;
+  ring->map = reinterpret_cast<char*>(
+      mmap(NULL, ring->map_size, PROT_READ | PROT_WRITE,
+           MAP_SHARED | MAP_POPULATE, fd_, pgoff));
+  if (ring->map == MAP_FAILED) {
+    ring->map = NULL;
+    return Errno();
+  }
+  ring->producer = reinterpret_cast<uint32_t*>(ring->map + off.producer);
+  ring->consumer = reinterpret_cast<uint32_t*>(ring->map + off.consumer);
+  ring->descs = ring->map + off.desc;
+  ring->mask = entries - 1;
+  return SUCCESS;
+}
+
+Error XDPPackets::SetUp(XDPRedirect* redirect, int queue) {
+  umem_size_ = size_t(kXDPFrameSize) * kXDPFrames;
+  umem_ = reinterpret_cast<char*>(mmap(NULL, umem_size_, PROT_READ | PROT_WRITE,
+                                       MAP_PRIVATE | MAP_ANONYMOUS, -1, 0));
+  if (umem_ == MAP_FAILED) {
+    umem_ = NULL;
+    return Errno();
+  }
+  fd_ = socket(AF_XDP, SOCK_RAW, 0);
+  RETURN_IF_ERROR(Errno(fd_), "AF_XDP socket");
+
+  struct xdp_umem_reg reg;
+  memset(&reg, 0, sizeof(reg));
+  reg.addr = reinterpret_cast<uintptr_t>(umem_);
+  reg.len = umem_size_;
+  reg.chunk_size = kXDPFrameSize;
+  RETURN_IF_ERROR(
+      Errno(setsockopt(fd_, SOL_XDP, XDP_UMEM_REG, &reg, sizeof(reg))),
+      "registering UMEM");
+  // The completion ring's only used for sending, but must exist.
+  int entries = kXDPFrames;
+  for (int opt : {XDP_UMEM_FILL_RING, XDP_UMEM_COMPLETION_RING, XDP_RX_RING}) {
+    RETURN_IF_ERROR(
+        Errno(setsockopt(fd_, SOL_XDP, opt, &entries, sizeof(entries))),
+        "sizing rings");
+  }
+  struct xdp_mmap_offsets off;
+  socklen_t len = sizeof(off);
+  RETURN_IF_ERROR(
+      Errno(getsockopt(fd_, SOL_XDP, XDP_MMAP_OFFSETS, &off, &len)),
+      "getting ring offsets");
+  RETURN_IF_ERROR(MapRing(&rx_, off.rx, kXDPFrames, sizeof(struct xdp_desc),
+                          XDP_PGOFF_RX_RING),
+                  "mapping RX ring");
+  RETURN_IF_ERROR(MapRing(&fill_, off.fr, kXDPFrames, sizeof(uint64_t),
+                          XDP_UMEM_PGOFF_FILL_RING),
+                  "mapping fill ring");
+
+  // Give the kernel every frame to receive into.
+  uint64_t* addrs = reinterpret_cast<uint64_t*>(fill_.descs);
+  for (uint32_t i = 0; i < kXDPFrames; i++) {
+    addrs[i] = uint64_t(i) * kXDPFrameSize;
+  }
+  __atomic_store_n(fill_.producer, kXDPFrames, __ATOMIC_RELEASE);
+
+  struct sockaddr_xdp sxdp;
+  memset(&sxdp, 0, sizeof(sxdp));
+  sxdp.sxdp_family = AF_XDP;
+  sxdp.sxdp_ifindex = redirect->ifindex();
+  sxdp.sxdp_queue_id = queue;
+  RETURN_IF_ERROR(
+      Errno(::bind(fd_, reinterpret_cast<struct sockaddr*>(&sxdp),
+                   sizeof(sxdp))),
+      "bind");
+  RETURN_IF_ERROR(redirect->Register(queue, fd_), "registering socket");
+  return SUCCESS;
+}
+
+void XDPPackets::StartBlock() {
+  offset_ = (offset_ + 1) % num_blocks_;
+  // Wait for the block's last user to release it.
+  block_mus_[offset_].lock();
+  block_mus_[offset_].unlock();
+  filling_ = blocks_ + offset_ * block_size_;
+  memset(filling_, 0, kXDPBlockHeader);
+  fill_offset_ = kXDPBlockHeader;
+  last_packet_ = 0;
+  num_packets_ = 0;
+  full_ = false;
+}
+
+void XDPPackets::ReadRing() {
+  uint32_t prod = __atomic_load_n(rx_.producer, __ATOMIC_ACQUIRE);
+  uint32_t cons = *rx_.consumer;
+  uint32_t fill = *fill_.producer;
+  struct xdp_desc* descs = reinterpret_cast<struct xdp_desc*>(rx_.descs);
+  uint64_t* addrs = reinterpret_cast<uint64_t*>(fill_.descs);
+  for (; cons != prod; cons++) {
+    const struct xdp_desc& d = descs[cons & rx_.mask];
+    size_t size = Align(kXDPPacketHeader + d.len);
+    if (kXDPBlockHeader + size > block_size_) {
+      oversized_++;
+    } else if (fill_offset_ + size > block_size_) {
+      full_ = true;
+      break;
+    } else {
+      struct timespec now;
+      clock_gettime(CLOCK_REALTIME, &now);
+      struct tpacket3_hdr* h =
+          reinterpret_cast<struct tpacket3_hdr*>(filling_ + fill_offset_);
+      memset(h, 0, kXDPPacketHeader);
+      h->tp_next_offset = size;
+      h->tp_sec = now.tv_sec;
+      h->tp_nsec = now.tv_nsec;
+      h->tp_snaplen = d.len;
+      h->tp_len = d.len;
+      h->tp_status = TP_STATUS_USER;
+      h->tp_mac = kXDPPacketHeader;
+      h->tp_net = kXDPPacketHeader + ETH_HLEN;
+      memcpy(filling_ + fill_offset_ + kXDPPacketHeader, umem_ + d.addr, d.len);
+      if (num_packets_ == 0) {
+        first_micros_ = GetCurrentTimeMicros();
+      }
+      last_packet_ = fill_offset_;
+      fill_offset_ += size;
+      num_packets_++;
+    }
+    // The frame can be received into again.
+    addrs[fill++ & fill_.mask] = d.addr;
+  }
+  __atomic_store_n(fill_.producer, fill, __ATOMIC_RELEASE);
+  __atomic_store_n(rx_.consumer, cons, __ATOMIC_RELEASE);
+}
+
+void XDPPackets::FinishBlock(Block* b) {
+  struct tpacket_block_desc* desc =
+      reinterpret_cast<struct tpacket_block_desc*>(filling_);
+  struct tpacket3_hdr* first =
+      reinterpret_cast<struct tpacket3_hdr*>(filling_ + kXDPBlockHeader);
+  struct tpacket3_hdr* last =
+      reinterpret_cast<struct tpacket3_hdr*>(filling_ + last_packet_);
+  last->tp_next_offset = 0;
+  desc->version = TPACKET_V3;
+  desc->hdr.bh1.num_pkts = num_packets_;
+  desc->hdr.bh1.offset_to_first_pkt = kXDPBlockHeader;
+  desc->hdr.bh1.blk_len = fill_offset_;
+  desc->hdr.bh1.seq_num = ++seq_;
+  desc->hdr.bh1.ts_first_pkt.ts_sec = first->tp_sec;
+  desc->hdr.bh1.ts_first_pkt.ts_nsec = first->tp_nsec;
+  desc->hdr.bh1.ts_last_pkt.ts_sec = last->tp_sec;
+  desc->hdr.bh1.ts_last_pkt.ts_nsec = last->tp_nsec;
+  desc->hdr.bh1.block_status = TP_STATUS_USER;
+  Block local;
+  local.ResetTo(filling_, block_size_, &block_mus_[offset_],
+                &LocalBlock_ReturnToKernel, NULL);
+  local.UpdateStats(&stats_);
+  local.Swap(b);
+  filling_ = NULL;
+}
+
+Error XDPPackets::PollForPacket(int poll_millis) {
+  struct pollfd pfd;
+  pfd.fd = fd_;
+  pfd.events = POLLIN;
+  pfd.revents = 0;
+  return Errno(poll(&pfd, 1, poll_millis));
+}
+
+Error XDPPackets::NextBlock(Block* b, int poll_millis) {
+  int64_t deadline = GetCurrentTimeMicros() + poll_millis * kNumMicrosPerMilli;
+  while (true) {
+    if (filling_ == NULL) {
+      StartBlock();
+    }
+    ReadRing();
+    int64_t now = GetCurrentTimeMicros();
+    int64_t wait = deadline - now;
+    if (num_packets_ > 0) {
+      int64_t retire = first_micros_ + retire_micros_ - now;
+      if (full_ || retire <= 0) {
+        FinishBlock(b);
+        return SUCCESS;
+      }
+      wait = std::min(wait, retire);
+    }
+    if (wait <= 0) {
+      return SUCCESS;
+    }
+    stats_.polls++;
+    RETURN_IF_ERROR(PollForPacket(wait / kNumMicrosPerMilli + 1),
+                    "polling for packet");
+  }
+}
+
+Error XDPPackets::GetStats(Stats* stats) {
+  struct xdp_statistics xstats;
+  socklen_t len = sizeof(xstats);
+  RETURN_IF_ERROR(
+      Errno(getsockopt(fd_, SOL_XDP, XDP_STATISTICS, &xstats, &len)),
+      "getsockopt XDP_STATISTICS");
+  // Unlike PACKET_STATISTICS, these aren't reset when read.
+  stats_.drops = xstats.rx_dropped + xstats.rx_ring_full + oversized_;
+  *stats = stats_;
+  return SUCCESS;
+}
+#endif
+
 PacketsV3::PacketsV3(PacketsV3::State* state) {
   state_.Swap(state);
   offset_ = state_.num_blocks - 1;
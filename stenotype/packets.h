@@ -19,8 +19,11 @@
 #include <linux/if_packet.h>
 #include <sys/socket.h>  // socklen_t
 
+#include <deque>
 #include <memory>
 #include <string>
+#include <unordered_map>
+#include <utility>
 
 #include <leveldb/slice.h>
 
@@ -28,6 +31,10 @@
 #include <testimony.h>
 #endif
 
+#ifdef XDP
+#include <linux/if_xdp.h>
+#endif
+
 #include "util.h"
 
 namespace st {
@@ -52,6 +59,33 @@ struct Stats {
   int64_t drops;
 };
 
+// NetworkHash hashes a packet from its network layer on, leaving out the
+// fields routers change, so copies of it from different taps match.
+uint64_t NetworkHash(const Packet& p);
+
+// Deduplicator spots packets identical to one seen shortly before them, which
+// are usually copies of the same packet from more than one tap or SPAN port.
+// Packets are compared from their network layer on, leaving out the fields
+// routers change (IPv4 TTLs and header checksums, IPv6 hop limits), the same
+// way stenoread's ?dedup compares them.  Packets must be given in time order.
+class Deduplicator {
+ public:
+  explicit Deduplicator(int64_t window_nsecs) : window_nsecs_(window_nsecs) {}
+
+  // Returns true if p is identical to a packet seen up to the window before
+  // it.  Otherwise remembers p and returns false.
+  bool Duplicate(const Packet& p);
+
+ private:
+  int64_t window_nsecs_;
+  // Hash of each packet in the window to when it was last seen.
+  std::unordered_map<uint64_t, int64_t> last_seen_;
+  // Packets in the window in time order, to expire them from last_seen_.
+  std::deque<std::pair<int64_t, uint64_t>> seen_;
+
+  DISALLOW_COPY_AND_ASSIGN(Deduplicator);
+};
+
 // AF_PACKET (TPACKET_V3) gives us packets in memory blocks, where each block
 // contains a linked list of packets in order.  This object wraps an individual
 // block, and allows for things like iterating over all packets inside it, etc.
@@ -73,6 +107,16 @@ class Block {
   // Returns the underlying memory of the entire block.
   leveldb::Slice Data();
 
+  // Stamp each packet in the block with a checksum of its header and data,
+  // so readers can detect and skip packets corrupted on disk.  The block's
+  // memory must be writable.
+  void StampChecksums();
+
+  // Remove packets dedup says are duplicates from the block, unlinking them
+  // from its list of packets.  Returns how many were removed.  Must be called
+  // before Next, and the block's memory must be writable.
+  int RemoveDuplicates(Deduplicator* dedup);
+
   // Reset the block, releasing it back to the kernel.
   void Reset();
 
@@ -80,8 +124,12 @@ class Block {
 
  private:
   friend class PacketsV3;
+  friend class BlockForTest;
 #ifdef TESTIMONY
   friend class TestimonyPackets;
+#endif
+#ifdef XDP
+  friend class XDPPackets;
 #endif
   typedef void (*Releaser)(struct tpacket_block_desc*, void*);
   void UpdateStats(Stats* stats);
@@ -144,6 +192,104 @@ class TestimonyPackets : public Packets {
 
 // PacketsV3 wraps MMAP'd AF_PACKET TPACKET_V3 in a nice, easy(er) to use
 // object.  Not safe for concurrent operation.
+#ifdef XDP
+// XDPRedirect loads an XDP program which redirects each packet an interface
+// receives to the AF_XDP socket registered for the RX queue it arrived on,
+// and attaches it to the interface.  Packets on queues without sockets go up
+// the network stack as usual.  The program's detached when stenotype exits.
+class XDPRedirect {
+ public:
+  // Attach attaches a program to iface which can redirect RX queues up to
+  // (but not including) num_queues, setting promiscuous mode if asked.
+  static Error Attach(const std::string& iface, int num_queues, bool promisc,
+                      XDPRedirect** out);
+  ~XDPRedirect();
+
+  // Register redirects the packets received on queue to the AF_XDP socket fd.
+  Error Register(int queue, int fd);
+  unsigned int ifindex() { return ifindex_; }
+
+ private:
+  XDPRedirect();
+
+  unsigned int ifindex_;
+  int map_fd_;      // XSKMAP of queue to socket.
+  int prog_fd_;     // The XDP program.
+  int link_fd_;     // Attaches prog_fd_ to the interface until closed.
+  int promisc_fd_;  // AF_PACKET socket holding promiscuous mode, if set.
+
+  DISALLOW_COPY_AND_ASSIGN(XDPRedirect);
+};
+
+// XDPPackets reads packets from a single RX queue with an AF_XDP socket,
+// copying them into blocks laid out as TPACKET_V3 would, so they're written
+// and indexed just like AF_PACKET's.  AF_XDP doesn't timestamp packets, so
+// they're stamped as they're read.
+class XDPPackets : public Packets {
+ public:
+  // Create binds an AF_XDP socket to queue on redirect's interface, and
+  // registers it with redirect.  Packets are copied into num_blocks blocks of
+  // block_size bytes, each handed out once it's full or has held packets for
+  // retire_millis.
+  static Error Create(XDPRedirect* redirect, int queue, size_t block_size,
+                      size_t num_blocks, int64_t retire_millis,
+                      Packets** out);
+  virtual ~XDPPackets();
+
+  virtual Error NextBlock(Block* b, int poll_millis);
+  virtual Error GetStats(Stats* stats);
+
+ private:
+  // Ring is a mmap'd AF_XDP ring.
+  struct Ring {
+    uint32_t* producer;
+    uint32_t* consumer;
+    void* descs;
+    uint32_t mask;
+    char* map;
+    size_t map_size;
+  };
+
+  XDPPackets();
+  Error SetUp(XDPRedirect* redirect, int queue);
+  Error MapRing(Ring* ring, const struct xdp_ring_offset& off, size_t entries,
+                size_t desc_size, off_t pgoff);
+  // StartBlock waits for the next block to be released, and starts filling
+  // it.
+  void StartBlock();
+  // ReadRing copies packets from the RX ring into the block being filled,
+  // until either runs out.
+  void ReadRing();
+  // FinishBlock hands the block being filled out in b.
+  void FinishBlock(Block* b);
+  Error PollForPacket(int poll_millis);
+
+  int fd_;
+  char* umem_;
+  size_t umem_size_;
+  Ring rx_;
+  Ring fill_;
+
+  char* blocks_;
+  size_t block_size_;
+  size_t num_blocks_;
+  int64_t retire_micros_;
+  std::mutex* block_mus_;
+  size_t offset_;           // Block being filled.
+  char* filling_;           // Its memory, or NULL if none is being filled.
+  size_t fill_offset_;      // Where its next packet goes.
+  size_t last_packet_;      // Offset of its last packet.
+  uint32_t num_packets_;    // How many packets it has.
+  int64_t first_micros_;    // When its first packet was read.
+  bool full_;               // Whether the next packet doesn't fit.
+  uint32_t seq_;            // Blocks handed out so far.
+  int64_t oversized_;       // Packets dropped for not fitting in a block.
+  Stats stats_;
+
+  DISALLOW_COPY_AND_ASSIGN(XDPPackets);
+};
+#endif
+
 class PacketsV3 : public Packets {
  private:
   // State provides state common to PacketsV3 and PacketsV3::Builder.
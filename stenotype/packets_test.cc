@@ -0,0 +1,180 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for packet deduplication.  Run with the path of
+// testdata/network_hash.txt, whose hashes stenographer's env package is
+// tested against too, so ?dedup and --dedup_window_us agree.
+
+#include <stdio.h>   // fprintf(), stderr
+#include <string.h>  // memset(), memcpy()
+
+#include <fstream>
+#include <sstream>
+#include <string>
+#include <vector>
+
+#include "util.h"
+#include "packets.h"
+
+namespace st {
+
+// BlockForTest points a Block at a block of packets built in memory.
+class BlockForTest {
+ public:
+  static void ResetTo(Block* b, char* data, size_t sz) {
+    b->ResetTo(data, sz, NULL, Release, NULL);
+  }
+
+ private:
+  static void Release(struct tpacket_block_desc* block, void* arg) {}
+};
+
+}  // namespace st
+
+namespace {
+
+int failures = 0;
+
+#define EXPECT(expr)                                                   \
+  if (!(expr)) {                                                       \
+    failures++;                                                        \
+    fprintf(stderr, "%s:%d: EXPECT(%s) failed\n", __FILE__, __LINE__, \
+            #expr);                                                    \
+  }
+
+std::string FromHex(const std::string& hex) {
+  std::string out;
+  for (size_t i = 0; i + 1 < hex.size(); i += 2) {
+    out.push_back(char(strtol(hex.substr(i, 2).c_str(), NULL, 16)));
+  }
+  return out;
+}
+
+st::Packet MakePacket(const std::string& data, int64_t length,
+                      int64_t timestamp_nsecs) {
+  st::Packet p;
+  p.data = leveldb::Slice(data);
+  p.length = length;
+  p.timestamp_nsecs = timestamp_nsecs;
+  p.offset_in_block = 0;
+  return p;
+}
+
+// TestNetworkHashVectors checks NetworkHash against the shared vectors.
+void TestNetworkHashVectors(const char* filename) {
+  std::ifstream in(filename);
+  EXPECT(in.good());
+  std::string line;
+  int vectors = 0;
+  while (std::getline(in, line)) {
+    if (line.empty() || line[0] == '#') {
+      continue;
+    }
+    std::istringstream fields(line);
+    int64_t length;
+    std::string hex;
+    uint64_t want;
+    fields >> length >> hex >> std::hex >> want;
+    EXPECT(!fields.fail());
+    std::string data = FromHex(hex);
+    uint64_t got = st::NetworkHash(MakePacket(data, length, 0));
+    if (got != want) {
+      failures++;
+      fprintf(stderr, "%s: got hash %016llx\n", line.c_str(),
+              (unsigned long long)got);
+    }
+    vectors++;
+  }
+  EXPECT(vectors > 0);
+}
+
+const char kIPv4TCP[] =
+    "000000000002000000000001"
+    "08004500002e123440004006abcd0a0000010a000002"
+    "c9e7005000000001000000005002ffff0000000068656c6c6f21";
+const char kIPv4TCPTagged[] =
+    "00000000000200000000000181000064"
+    "08004500002e123440004006abcd0a0000010a000002"
+    "c9e7005000000001000000005002ffff0000000068656c6c6f21";
+const char kARP[] =
+    "000000000002000000000001"
+    "080600010800060400010000000000010a0000010000000000000a000002";
+const int64_t kMillis = 1000000;
+
+// TestDeduplicator checks that copies are only dropped within the window.
+void TestDeduplicator() {
+  std::string a = FromHex(kIPv4TCP), tagged = FromHex(kIPv4TCPTagged),
+              b = FromHex(kARP);
+  st::Deduplicator dedup(10 * kMillis);
+  EXPECT(!dedup.Duplicate(MakePacket(a, a.size(), 0)));
+  EXPECT(dedup.Duplicate(MakePacket(tagged, tagged.size(), 5 * kMillis)));
+  EXPECT(!dedup.Duplicate(MakePacket(b, b.size(), 6 * kMillis)));
+  // Outside the window of the first, and the copy at 5ms wasn't kept.
+  EXPECT(!dedup.Duplicate(MakePacket(a, a.size(), 20 * kMillis)));
+  EXPECT(dedup.Duplicate(MakePacket(tagged, tagged.size(), 25 * kMillis)));
+  EXPECT(dedup.Duplicate(MakePacket(a, a.size(), 29 * kMillis)));
+  EXPECT(!dedup.Duplicate(MakePacket(b, b.size(), 40 * kMillis)));
+}
+
+// TestRemoveDuplicates checks that duplicates are unlinked from a block.
+void TestRemoveDuplicates() {
+  std::vector<std::string> packets = {FromHex(kIPv4TCP),
+                                      FromHex(kIPv4TCPTagged), FromHex(kARP),
+                                      FromHex(kIPv4TCPTagged)};
+  std::vector<char> mem(1 << 16);
+  memset(mem.data(), 0, mem.size());
+  auto block = reinterpret_cast<struct tpacket_block_desc*>(mem.data());
+  block->hdr.bh1.num_pkts = packets.size();
+  block->hdr.bh1.offset_to_first_pkt = TPACKET_ALIGN(sizeof(*block));
+  size_t offset = block->hdr.bh1.offset_to_first_pkt;
+  const size_t mac = TPACKET_ALIGN(sizeof(struct tpacket3_hdr));
+  for (size_t i = 0; i < packets.size(); i++) {
+    auto pkt = reinterpret_cast<struct tpacket3_hdr*>(mem.data() + offset);
+    pkt->tp_sec = 1;
+    pkt->tp_nsec = i * kMillis;
+    pkt->tp_snaplen = pkt->tp_len = packets[i].size();
+    pkt->tp_mac = mac;
+    memcpy(mem.data() + offset + mac, packets[i].data(), packets[i].size());
+    size_t next = TPACKET_ALIGN(mac + packets[i].size());
+    pkt->tp_next_offset = i + 1 < packets.size() ? next : 0;
+    offset += next;
+  }
+
+  st::Block b;
+  st::BlockForTest::ResetTo(&b, mem.data(), mem.size());
+  st::Deduplicator dedup(10 * kMillis);
+  EXPECT(b.RemoveDuplicates(&dedup) == 2);
+  st::Packet p;
+  EXPECT(b.Next(&p) && p.data.ToString() == packets[0]);
+  EXPECT(b.Next(&p) && p.data.ToString() == packets[2]);
+  EXPECT(!b.Next(&p));
+}
+
+}  // namespace
+
+int main(int argc, char** argv) {
+  if (argc != 2) {
+    fprintf(stderr, "usage: %s testdata/network_hash.txt\n", argv[0]);
+    return 2;
+  }
+  TestNetworkHashVectors(argv[1]);
+  TestDeduplicator();
+  TestRemoveDuplicates();
+  if (failures > 0) {
+    fprintf(stderr, "FAIL: %d failures\n", failures);
+    return 1;
+  }
+  fprintf(stderr, "PASS\n");
+  return 0;
+}
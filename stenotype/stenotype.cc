@@ -69,9 +69,11 @@
 #include <sys/syscall.h>      // syscall(), SYS_gettid
 #include <unistd.h>           // setuid(), setgid(), getpagesize()
 
+#include <algorithm>
 #include <string>
 #include <sstream>
 #include <thread>
+#include <vector>
 
 // Due to some weird interactions with <argp.h>, <string>, and --std=c++0x, this
 // header MUST be included AFTER <string>.
@@ -111,7 +113,25 @@ int flag_index_nicelevel = 0;
 int flag_preallocate_file_mb = 0;
 bool flag_watchdogs = true;
 bool flag_promisc = true;
+int flag_index_ip_shards = 1;
+bool flag_index_ip_prefixes = false;
+bool flag_checksums = true;
+int64_t flag_dedup_window_us = 0;
 std::string flag_testimony;
+bool flag_xdp = false;
+std::vector<int> flag_xdp_queues;
+std::vector<int> flag_thread_cpus;
+
+// ParseIntList parses a comma-separated list of numbers.
+std::vector<int> ParseIntList(const char* arg) {
+  std::vector<int> out;
+  std::stringstream in(arg);
+  std::string n;
+  while (std::getline(in, n, ',')) {
+    out.push_back(atoi(n.c_str()));
+  }
+  return out;
+}
 
 int ParseOptions(int key, char* arg, struct argp_state* state) {
   switch (key) {
@@ -187,6 +207,27 @@ int ParseOptions(int key, char* arg, struct argp_state* state) {
     case 321:
       flag_promisc = false;
       break;
+    case 322:
+      flag_index_ip_shards = atoi(arg);
+      break;
+    case 323:
+      flag_index_ip_prefixes = true;
+      break;
+    case 324:
+      flag_checksums = false;
+      break;
+    case 325:
+      flag_dedup_window_us = atoll(arg);
+      break;
+    case 326:
+      flag_xdp = true;
+      break;
+    case 327:
+      flag_xdp_queues = ParseIntList(arg);
+      break;
+    case 328:
+      flag_thread_cpus = ParseIntList(arg);
+      break;
   }
   return 0;
 }
@@ -229,6 +270,27 @@ void ParseOptions(int argc, char** argv) {
       {"blockage_sec", 319, n, 0, "A block is written at least every N secs"},
       {"blocksize_kb", 320, n, 0, "Size of a block, in KB"},
       {"no_promisc", 321, 0, 0, "Don't set promiscuous mode"},
+      {"index_ip_shards", 322, n, 0,
+       "Split IP index keys across this many files per index, by prefix"},
+      {"index_ip_prefixes", 323, 0, 0,
+       "Also index IPv4 /8, /16 and /24 prefixes, for fast CIDR lookups"},
+      {"no_checksums", 324, 0, 0,
+       "Don't stamp packets with checksums for readers to verify"},
+      {"dedup_window_us", 325, n, 0,
+       "Drop packets identical to one captured up to this many micros before"},
+#ifdef XDP
+      {"xdp", 326, 0, 0,
+       "Read packets with AF_XDP sockets, one per NIC RX queue, instead of "
+       "AF_PACKET"},
+#else
+      {"xdp", 326, 0, 0, "AF_XDP NOT COMPILED INTO THIS BINARY"},
+#endif
+      {"xdp_queues", 327, s, 0,
+       "Comma-separated RX queue each thread reads with --xdp, by default "
+       "thread N reads queue N"},
+      {"thread_cpus", 328, s, 0,
+       "Comma-separated CPU to pin each thread to, by default thread N is "
+       "pinned to CPU N if there's more than one"},
       {0},
   };
   struct argp argp = {options, &ParseOptions};
@@ -438,7 +500,9 @@ void HandleSignalsThread() {
 
 void RunThread(int thread, st::ProducerConsumerQueue* write_index,
                Packets* v3) {
-  if (flag_threads > 1) {
+  if (!flag_thread_cpus.empty()) {
+    LOG_IF_ERROR(SetAffinity(flag_thread_cpus[thread]), "set affinity");
+  } else if (flag_threads > 1) {
     LOG_IF_ERROR(SetAffinity(thread), "set affinity");
   }
   Watchdog dog("Thread " + std::to_string(thread),
@@ -462,7 +526,8 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
       output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
   Index* index = NULL;
   if (flag_index) {
-    index = new Index(index_dirname, micros);
+    index = new Index(index_dirname, micros, flag_index_ip_shards,
+                      flag_index_ip_prefixes);
   } else {
     LOG(ERROR) << "Indexing turned off";
   }
@@ -471,6 +536,9 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
   int64_t lastlog = 0;
   int64_t blocks = 0;
   int64_t block_offset = 0;
+  int64_t duplicates = 0;
+  int64_t bytes = 0;
+  Deduplicator dedup(flag_dedup_window_us * 1000);
   for (int64_t remaining = flag_count; remaining != 0 && run_threads;) {
     CHECK_SUCCESS(output.CheckForCompletedOps(false));
     int64_t current_micros = GetCurrentTimeMicros();
@@ -489,7 +557,8 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
           output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
       if (flag_index) {
         write_index->Put(index);
-        index = new Index(index_dirname, micros);
+        index = new Index(index_dirname, micros, flag_index_ip_shards,
+                          flag_index_ip_prefixes);
       }
     }
     // Read in a new block from AF_PACKET.
@@ -498,10 +567,19 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
     if (b.Empty()) {
       continue;
     }
+    // Testimony shares its blocks read-only, so they can't be deduplicated
+    // or stamped.
+    if (flag_dedup_window_us > 0 && flag_testimony.empty()) {
+      duplicates += b.RemoveDuplicates(&dedup);
+    }
+    if (flag_checksums && flag_testimony.empty()) {
+      b.StampChecksums();
+    }
 
-    // Index all packets if necessary.
-    if (flag_index) {
-      for (; remaining != 0 && b.Next(&p); remaining--) {
+    // Count, and index if necessary, all packets.
+    for (; remaining != 0 && b.Next(&p); remaining--) {
+      bytes += p.length;
+      if (flag_index) {
         index->Process(p, block_offset * flag_blocksize_kb * 1024);
       }
     }
@@ -515,10 +593,15 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
       double duration = (current_micros - start) * 1.0 / kNumMicrosPerSecond;
       Stats stats;
       Error stats_err = v3->GetStats(&stats);
+      // Writes since the last log line, so their latencies are recent.
+      WriteStats writes;
+      output.TakeWriteStats(&writes);
       if (SUCCEEDED(stats_err)) {
         LOG(INFO) << "Thread " << thread << " stats: MB=" << blocks
                   << " secs=" << duration << " MBps=" << (blocks / duration)
-                  << " " << stats.String();
+                  << " " << stats.String() << " duplicates=" << duplicates
+                  << " bytes=" << bytes << " file=" << micros << " "
+                  << writes.String();
       } else {
         LOG(ERROR) << "Unable to get stats: " << *stats_err;
       }
@@ -554,12 +637,21 @@ int Main(int argc, char** argv) {
   CHECK(flag_filesize_mb >= flag_aiops);
   CHECK(flag_blocks >= 16);  // arbitrary lower limit.
   CHECK(flag_threads >= 1);
+  CHECK(flag_index_ip_shards >= 1 && flag_index_ip_shards <= 256);
   CHECK(flag_aiops <= flag_blocks);
   CHECK(flag_dir != "");
   CHECK(flag_blockage_sec <= flag_fileage_sec);
   CHECK(flag_blockage_sec > 0);
   CHECK(flag_fileage_sec % flag_blockage_sec == 0);
   CHECK(flag_blocksize_kb >= 10);
+  CHECK(flag_thread_cpus.empty() || int(flag_thread_cpus.size()) == flag_threads)
+      << "--thread_cpus must list a CPU for each thread";
+  CHECK(flag_xdp_queues.empty() || int(flag_xdp_queues.size()) == flag_threads)
+      << "--xdp_queues must list a queue for each thread";
+  CHECK(!flag_xdp || flag_filter.empty())
+      << "--filter isn't supported with --xdp";
+  CHECK(!flag_xdp || flag_testimony.empty())
+      << "--xdp and --testimony can't both be used";
   CHECK(flag_blocksize_kb * 1024 >= (uint64_t)(getpagesize()));
   CHECK((flag_blocksize_kb * 1024) % (uint64_t)(getpagesize()) == 0);
   if (flag_dir[flag_dir.size() - 1] != '/') {
@@ -571,8 +663,33 @@ int Main(int argc, char** argv) {
   // setuid/setgid and could lose us the ability to do this at a later date.
 
   std::vector<Packets*> sockets;
+#ifdef XDP
+  // Shared by every thread's socket, and left attached until we exit.
+  XDPRedirect* redirect = NULL;
+#endif
   for (int i = 0; i < flag_threads; i++) {
-    if (flag_testimony.empty()) {
+    if (flag_xdp) {
+#ifdef XDP
+      int queue = flag_xdp_queues.empty() ? i : flag_xdp_queues[i];
+      if (redirect == NULL) {
+        LOG(INFO) << "Attaching XDP program for AF_XDP packet reading";
+        int num_queues = flag_threads;
+        for (int q : flag_xdp_queues) {
+          num_queues = std::max(num_queues, q + 1);
+        }
+        CHECK_SUCCESS(XDPRedirect::Attach(flag_iface, num_queues, flag_promisc,
+                                          &redirect));
+      }
+      LOG(INFO) << "Setting up AF_XDP socket on queue " << queue;
+      Packets* x;
+      CHECK_SUCCESS(XDPPackets::Create(
+          redirect, queue, flag_blocksize_kb * 1024, flag_blocks,
+          flag_blockage_sec * kNumMillisPerSecond - 1, &x));
+      sockets.push_back(x);
+#else
+      LOG(FATAL) << "invalid --xdp flag, AF_XDP not compiled in";
+#endif
+    } else if (flag_testimony.empty()) {
       LOG(INFO) << "Setting up AF_PACKET sockets for packet reading";
       int socktype = SOCK_RAW;
       struct tpacket_req3 options;
@@ -0,0 +1,98 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// Archiver keeps the files threads age out, so they can still be queried.
+type Archiver interface {
+	// Archived returns whether the named file of a thread has been archived.
+	Archived(thread int, name string) bool
+	// Archive archives the named file of a thread, given its packet file's
+	// path and its index's, followed by those of the index's IP shards.
+	Archive(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error
+}
+
+var filesDeletedUnarchived = stats.S.Get("archive_files_deleted_unarchived")
+
+// SetArchiver has the thread archive its files with a before they're deleted.
+func (t *Thread) SetArchiver(a Archiver) {
+	t.archiver = a
+}
+
+// ArchiveFiles archives the files that haven't been yet, oldest first, so
+// they're already archived by the time they age out.  Only the writer
+// archives files.
+func (t *Thread) ArchiveFiles(ctx context.Context) {
+	if t.readOnly || t.archiver == nil {
+		return
+	}
+	t.mu.RLock()
+	names := t.getSortedFiles()
+	t.mu.RUnlock()
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		if t.archiver.Archived(t.id, name) {
+			continue
+		}
+		// Keep compression and encryption from replacing the file while it's
+		// uploaded.
+		t.rewriting.Lock()
+		err := t.archiveFile(ctx, name)
+		t.rewriting.Unlock()
+		if err != nil {
+			log.Printf("Thread %v could not archive %q, will retry: %v", t.id, name, err)
+			return
+		}
+	}
+}
+
+// archiveFile archives the named file.
+func (t *Thread) archiveFile(ctx context.Context, name string) error {
+	indexPath := t.getIndexFilePath(name)
+	return t.archiver.Archive(ctx, t.id, name, t.getPacketFilePath(name), append([]string{indexPath}, indexfile.ShardPaths(indexPath)...))
+}
+
+// archiveBeforeDelete archives any of the given files that aren't yet,
+// because ArchiveFiles has fallen behind.  This holds up the thread, but
+// beats losing them.  Files that can't be archived are deleted anyway, since
+// disk space can't wait.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) archiveBeforeDelete(files []string) {
+	if t.archiver == nil {
+		return
+	}
+	for _, name := range files {
+		if t.archiver.Archived(t.id, name) {
+			continue
+		}
+		v(0, "Thread %v archiving %q before deleting it", t.id, name)
+		if err := t.archiveFile(context.Background(), name); err != nil {
+			log.Printf("Thread %v deleting %q without archiving it: %v", t.id, name, err)
+			filesDeletedUnarchived.Increment()
+		}
+	}
+}
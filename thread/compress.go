@@ -0,0 +1,184 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// CompressAge is how old packets must be before the writer compresses their
+// files.  Zero disables compression.  Compressed files already on disk are
+// read regardless.
+var CompressAge time.Duration
+
+// CompressCodec is the name of the blockfile.Codec files are compressed with.
+var CompressCodec = "lz4"
+
+// CompressCPU is the fraction of a CPU compression may use.
+var CompressCPU = 0.25
+
+var (
+	filesCompressed       = stats.S.Get("blockfiles_compressed")
+	compressionBytesSaved = stats.S.Get("blockfile_compression_bytes_saved")
+)
+
+// filesToCompress returns the uncompressed files older than CompressAge,
+// oldest first.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) filesToCompress() []string {
+	var out []string
+	cutoff := time.Now().Add(-CompressAge)
+	for name, bf := range t.files {
+		if bf.Compressed() {
+			continue
+		}
+		micros, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Unix(0, micros*1000).Before(cutoff) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// CompressFiles compresses the files of packets older than CompressAge.
+// Only the writer compresses files; replicas notice they've been replaced
+// the next time they sync.
+func (t *Thread) CompressFiles(ctx context.Context) {
+	if t.readOnly || CompressAge <= 0 {
+		return
+	}
+	codec, err := blockfile.CodecByName(CompressCodec)
+	if err != nil {
+		log.Printf("Thread %v can't compress files: %v", t.id, err)
+		return
+	}
+	t.mu.RLock()
+	files := t.filesToCompress()
+	t.mu.RUnlock()
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := t.compressFile(name, codec); err != nil {
+			log.Printf("Thread %v could not compress %q: %v", t.id, name, err)
+		}
+	}
+}
+
+// compressFile replaces a file with a compressed copy.
+func (t *Thread) compressFile(name string, codec *blockfile.Codec) error {
+	t.rewriting.Lock()
+	defer t.rewriting.Unlock()
+	path := t.getPacketFilePath(name)
+	hidden := filepath.Join(filepath.Dir(path), "."+name+"."+codec.Name)
+	if err := blockfile.CompressFile(path, hidden, codec, CompressCPU); err != nil {
+		os.Remove(hidden)
+		return err
+	}
+	old, replaced, err := t.replaceFiles(name, []string{path}, []string{hidden})
+	if err != nil || replaced == nil {
+		return err
+	}
+	filesCompressed.Increment()
+	compressionBytesSaved.IncrementBy(old.Size() - replaced.Size())
+	v(1, "Thread %v compressed %q from %d to %d bytes", t.id, name, old.Size(), replaced.Size())
+	return nil
+}
+
+// replaceFiles renames rewritten copies of a tracked file's packets or
+// indexes over the originals, in order, and reopens the file.  Replicas
+// notice replaced files by the size of their packets changing, so those
+// should come last.  It returns the original and reopened blockfiles, or
+// nils if the file was deleted while it was being rewritten.
+func (t *Thread) replaceFiles(name string, paths, hidden []string) (old, replaced *blockfile.BlockFile, _ error) {
+	removeHidden := func() {
+		for _, h := range hidden {
+			os.Remove(h)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old = t.files[name]
+	if old == nil {
+		removeHidden()
+		return nil, nil, nil
+	}
+	defer t.lockFiles()()
+	// Closing the original waits for queries reading it, and stops any more,
+	// so nothing can reopen it by name after it's replaced.
+	old.Close()
+	delete(t.files, name)
+	currentFiles.IncrementBy(-1)
+	for i, path := range paths {
+		if err := os.Rename(hidden[i], path); err != nil {
+			removeHidden()
+			t.trackNewFile(name)
+			return nil, nil, err
+		}
+	}
+	if err := t.trackNewFile(name); err != nil {
+		return nil, nil, err
+	}
+	return old, t.files[name], nil
+}
+
+// reopenReplacedFiles reopens any files the writer has replaced with
+// compressed or encrypted copies since this replica opened them.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) reopenReplacedFiles() {
+	var names []string
+	if CompressAge > 0 {
+		names = t.filesToCompress()
+	}
+	if encrypt.Keys != nil {
+		names = append(names, t.filesToEncrypt()...)
+	}
+	for _, name := range names {
+		bf := t.files[name]
+		if bf == nil {
+			continue // Listed twice, and already reopened.
+		}
+		info, err := os.Stat(t.getPacketFilePath(name))
+		if err != nil || info.Size() == bf.Size() {
+			continue
+		}
+		v(1, "Thread %v reopening %q, replaced by writer", t.id, name)
+		bf.Close()
+		delete(t.files, name)
+		currentFiles.IncrementBy(-1)
+		if err := t.trackNewFile(name); err != nil {
+			log.Printf("Thread %v error reopening %q: %v", t.id, name, err)
+		}
+	}
+}
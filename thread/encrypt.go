@@ -0,0 +1,119 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+var filesEncrypted = stats.S.Get("blockfiles_encrypted")
+
+// filesToEncrypt returns the files whose packets or indexes aren't encrypted
+// yet, oldest first.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) filesToEncrypt() []string {
+	var out []string
+	for name, bf := range t.files {
+		if !bf.Encrypted() {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// EncryptFiles encrypts the packets and indexes of all files stenotype has
+// finished writing, if encryption is configured.  Only the writer encrypts
+// files; replicas notice they've been replaced the next time they sync.
+func (t *Thread) EncryptFiles(ctx context.Context) {
+	if t.readOnly || encrypt.Keys == nil {
+		return
+	}
+	t.mu.RLock()
+	files := t.filesToEncrypt()
+	t.mu.RUnlock()
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := t.encryptFile(name); err != nil {
+			log.Printf("Thread %v could not encrypt %q: %v", t.id, name, err)
+		}
+	}
+}
+
+// isEncryptedOnDisk returns whether the named file is encrypted.
+func isEncryptedOnDisk(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return encrypt.IsEncrypted(f)
+}
+
+// encryptFile replaces a file's packets, index, and index shards with
+// encrypted copies, skipping any already encrypted.
+func (t *Thread) encryptFile(name string) error {
+	t.rewriting.Lock()
+	defer t.rewriting.Unlock()
+	index := t.getIndexFilePath(name)
+	// The packets go last, since replicas notice they've changed.
+	paths := append(append(indexfile.ShardPaths(index), index), t.getPacketFilePath(name))
+	var toReplace, hidden []string
+	for i, path := range paths {
+		if encrypted, err := isEncryptedOnDisk(path); err != nil {
+			return err
+		} else if encrypted {
+			continue
+		}
+		chunk := indexfile.EncryptChunkBytes
+		if i == len(paths)-1 {
+			chunk = blockfile.EncryptChunkBytes
+		}
+		h := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".enc")
+		if err := encrypt.EncryptFile(path, h, chunk); err != nil {
+			os.Remove(h)
+			for _, h := range hidden {
+				os.Remove(h)
+			}
+			return err
+		}
+		toReplace, hidden = append(toReplace, path), append(hidden, h)
+	}
+	if len(toReplace) == 0 {
+		return nil
+	}
+	if _, replaced, err := t.replaceFiles(name, toReplace, hidden); err != nil || replaced == nil {
+		return err
+	}
+	filesEncrypted.Increment()
+	v(1, "Thread %v encrypted %q", t.id, name)
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/reindex"
+	"../reindex"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// LivePollInterval is how often Live checks for blocks stenotype has newly
+// written.
+var LivePollInterval = time.Second
+
+var liveBlocksRead = stats.S.Get("live_blocks_read")
+
+// Live sends the packets matching q that stenotype writes from now on, until
+// ctx is done.  Packets are read from the file stenotype is writing as soon
+// as each block of it is, well before the file's indexed, so q is looked up
+// in an index built for each block.  Post-filters aren't applied.
+func (t *Thread) Live(ctx context.Context, q query.Query) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		tail := &liveTail{t: t, q: q}
+		defer tail.close()
+		ticker := time.NewTicker(LivePollInterval)
+		defer ticker.Stop()
+		for {
+			if err := tail.poll(ctx, out); err != nil {
+				out.Close(err)
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				out.Close(ctx.Err())
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// liveTail follows the files a thread's stenotype writes, block by block.
+type liveTail struct {
+	t       *Thread
+	q       query.Query
+	name    string // Of the file being read, without its leading dot.
+	f       *os.File
+	off     int64 // Of the next block to read in f.
+	started bool  // Whether the blocks written before Live was called have been skipped.
+}
+
+// writingFile returns the name, without its leading dot, of the newest file
+// stenotype is writing in dir, if it's newer than after.  Otherwise it
+// returns "".
+func writingFile(dir, after string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	newest, _ := strconv.ParseInt(after, 10, 64)
+	name := ""
+	for _, file := range files {
+		if file.IsDir() || len(file.Name()) < 2 || file.Name()[0] != '.' {
+			continue
+		}
+		if micros, err := strconv.ParseInt(file.Name()[1:], 10, 64); err == nil && micros > newest {
+			newest, name = micros, file.Name()[1:]
+		}
+	}
+	return name, nil
+}
+
+// poll sends the packets matching the query from every block written since
+// the last poll.
+func (l *liveTail) poll(ctx context.Context, out *base.PacketChan) error {
+	for !base.ContextDone(ctx) {
+		if l.f == nil {
+			name, err := writingFile(l.t.packetPath, l.name)
+			if err != nil {
+				return err
+			} else if name == "" {
+				l.started = true // Files started from now on are read whole.
+				return nil
+			}
+			f, err := os.Open(filepath.Join(l.t.packetPath, "."+name))
+			if os.IsNotExist(err) {
+				return nil // It was finished as we found it; try again next poll.
+			} else if err != nil {
+				return err
+			}
+			l.name, l.f, l.off = name, f, 0
+			if !l.started {
+				if l.off, err = blockfile.UnwrittenBlock(f, 0); err != nil {
+					return err
+				}
+				l.started = true
+			}
+		}
+		if err := l.readBlocks(ctx, out); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(l.t.packetPath, "."+l.name)); err == nil {
+			return nil // Still being written.
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		// stenotype renamed the file once it finished writing it, so whatever
+		// blocks are left in it now are all there'll be.
+		if err := l.readBlocks(ctx, out); err != nil {
+			return err
+		}
+		l.f.Close()
+		l.f = nil
+	}
+	return nil
+}
+
+// readBlocks sends the packets matching the query from every block written
+// since the last call.
+func (l *liveTail) readBlocks(ctx context.Context, out *base.PacketChan) error {
+	for !base.ContextDone(ctx) {
+		var positions []int64
+		var packets []*base.Packet
+		next, err := blockfile.ScanBlock(l.f.Name(), l.f, l.off, func(pos int64, p *base.Packet) error {
+			positions = append(positions, pos)
+			packets = append(packets, p)
+			return nil
+		})
+		if err != nil || next == l.off {
+			return err
+		}
+		liveBlocksRead.Increment()
+		l.off = next
+		matches, err := l.match(ctx, positions, packets)
+		if err != nil {
+			return err
+		}
+		for _, p := range matches {
+			select {
+			case out.C <- p:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the packets, found at the given positions, that match the
+// query's index lookups.
+func (l *liveTail) match(ctx context.Context, positions []int64, packets []*base.Packet) ([]*base.Packet, error) {
+	if len(packets) == 0 {
+		return nil, nil
+	}
+	f, err := ioutil.TempFile("", "stenographer_live")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	if err := reindex.WriteIndex(name, positions, packets); err != nil {
+		return nil, err
+	}
+	index, err := indexfile.NewIndexFile(name, l.t.fc)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	lengths := make(map[int64]int, len(positions))
+	for i, pos := range positions {
+		lengths[pos] = packets[i].CaptureInfo.Length
+	}
+	index.SetPacketLengths(func(pos int64) (int, error) { return lengths[pos], nil })
+	found, err := l.q.LookupIn(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	if found.IsAllPositions() {
+		return packets, nil
+	}
+	var out []*base.Packet
+	for i, j := 0, 0; i < len(positions) && j < len(found); {
+		switch {
+		case positions[i] < found[j]:
+			i++
+		case positions[i] > found[j]:
+			j++
+		default:
+			out = append(out, packets[i])
+			i++
+			j++
+		}
+	}
+	return out, nil
+}
+
+// close closes the file being read, if any.
+func (l *liveTail) close() {
+	if l.f != nil {
+		l.f.Close()
+	}
+}
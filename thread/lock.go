@@ -0,0 +1,94 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Several stenographer processes may share a thread's directories (for
+// example over NFS), as long as only one of them is the writer, running
+// stenotype and deleting old files.  The rest are read-only replicas which
+// just serve queries.  Coordination happens with flock(2) on two lock files in
+// the index directory, which are hidden so they're never mistaken for indexes.
+const (
+	// writerLockFile is held exclusively by the writer for its whole lifetime,
+	// so a second writer can't be started by mistake.
+	writerLockFile = ".stenographer.writer"
+	// filesLockFile is held exclusively by the writer while it deletes files,
+	// and shared by replicas while they list and open files, so replicas never
+	// see a packet file whose index is already gone, or vice versa.
+	filesLockFile = ".stenographer.files"
+)
+
+// SetReadOnly makes this thread a read-only replica:  it'll track files the
+// writer creates and deletes, but never delete any itself.
+func (t *Thread) SetReadOnly() {
+	t.readOnly = true
+}
+
+// ClaimWriter makes sure no other stenographer is using this thread's
+// directories as a writer, and stops any others from doing so until this
+// process exits.
+func (t *Thread) ClaimWriter() error {
+	f, err := flockFile(filepath.Join(t.home.IndexDirectory, writerLockFile), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return fmt.Errorf("thread %d could not claim %q as writer (is another stenographer writing to it?): %v", t.id, t.conf.IndexDirectory, err)
+	}
+	t.writerLock = f
+	return nil
+}
+
+// lockFiles takes the files lock, exclusively for the writer and shared for
+// replicas, and returns a function to release it.  Errors are logged, not
+// returned, since failing to lock shouldn't stop a writer from freeing space.
+func (t *Thread) lockFiles() (unlock func()) {
+	how := syscall.LOCK_EX
+	if t.readOnly {
+		how = syscall.LOCK_SH
+	}
+	f, err := flockFile(filepath.Join(t.home.IndexDirectory, filesLockFile), how)
+	if err != nil {
+		v(1, "Thread %v could not lock files: %v", t.id, err)
+		return func() {}
+	}
+	return func() { f.Close() }
+}
+
+// LockFiles takes the files lock, which also stops the writer moving files
+// between directories, and returns a function to release it.
+func (t *Thread) LockFiles() (unlock func()) {
+	return t.lockFiles()
+}
+
+// flockFile opens (creating if necessary) and flocks the given file.  Closing
+// the returned file releases the lock.
+func flockFile(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		// Replicas may not be able to create files on a read-only mount.
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"sync/atomic"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// DefaultIndexLookupConcurrency is IndexLookupConcurrency unless it's set.
+const DefaultIndexLookupConcurrency = 10
+
+// indexLookupConcurrency is accessed atomically, since it may be changed
+// while queries run.
+var indexLookupConcurrency int64 = DefaultIndexLookupConcurrency
+
+// IndexLookupConcurrency returns how many index files each thread looks up a
+// query in at once.
+func IndexLookupConcurrency() int {
+	return int(atomic.LoadInt64(&indexLookupConcurrency))
+}
+
+// SetIndexLookupConcurrency sets IndexLookupConcurrency.
+func SetIndexLookupConcurrency(n int) {
+	atomic.StoreInt64(&indexLookupConcurrency, int64(n))
+}
+
+var indexLookupsInProgress = stats.S.Get("index_lookups_in_progress")
+
+// lookupResult is the outcome of looking up a query in a single file's index.
+type lookupResult struct {
+	pos base.Positions
+	err error
+}
+
+// lookups runs a query against many index files on a pool of workers.
+// Results are handed out in file order, and lookups run at most a few files
+// ahead of the one being consumed, so a slow reader doesn't pile up the
+// positions of every file in memory.
+type lookups struct {
+	results []chan lookupResult
+	window  chan struct{} // Holds a token for each result not yet consumed.
+}
+
+// lookupFiles starts looking up q in files' indexes, using IndexLookupConcurrency
+// workers.  Once ctx is done no new lookups start, lookups in progress stop
+// at the next index key they read, and all remaining results are ctx's error.
+func lookupFiles(ctx context.Context, q query.Query, files []positioner) *lookups {
+	workers := IndexLookupConcurrency()
+	if workers < 1 {
+		workers = 1
+	}
+	l := &lookups{
+		results: make([]chan lookupResult, len(files)),
+		window:  make(chan struct{}, 2*workers),
+	}
+	for i := range l.results {
+		l.results[i] = make(chan lookupResult, 1)
+	}
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				indexLookupsInProgress.Increment()
+				pos, err := files[i].Positions(ctx, q)
+				indexLookupsInProgress.IncrementBy(-1)
+				if err == nil {
+					err = ctx.Err()
+				}
+				l.results[i] <- lookupResult{pos, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range files {
+			select {
+			case l.window <- struct{}{}:
+			case <-ctx.Done():
+				for ; i < len(files); i++ {
+					l.results[i] <- lookupResult{err: ctx.Err()}
+				}
+				return
+			}
+			jobs <- i
+		}
+	}()
+	return l
+}
+
+// result waits for and returns the result for the i'th file.  Results must
+// be consumed in order.
+func (l *lookups) result(i int) lookupResult {
+	r := <-l.results[i]
+	select {
+	case <-l.window:
+	default: // Never dispatched, since ctx was done.
+	}
+	return r
+}
@@ -0,0 +1,377 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/config"
+	"../config"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+)
+
+var (
+	placementChanges = stats.S.Get("thread_placement_changes")
+	filesDrained     = stats.S.Get("thread_files_drained")
+)
+
+// placementProbeBytes is how much the "latency" placement writes to each
+// directory to time it.
+const placementProbeBytes = 1 << 20
+
+// Place points the thread's symlinks, which stenotype writes through, at the
+// directory its Placement prefers.  Stenotype renames each file into place in
+// the directory it created it in, so this must only be called while its
+// stenotype is stopped.
+func (t *Thread) Place() {
+	t.dirMu.Lock()
+	dirs, placement, active := t.dirs, t.placement, t.active
+	t.dirMu.Unlock()
+	if len(dirs) == 1 && dirs[0] == active {
+		return
+	}
+	d := t.chooseDirectory(dirs, placement)
+	if d == active {
+		return
+	}
+	if err := relink(d.PacketsDirectory, t.packetPath); err != nil {
+		log.Printf("Thread %v could not place files in %q: %v", t.id, d.PacketsDirectory, err)
+		return
+	}
+	if err := relink(d.IndexDirectory, t.indexPath); err != nil {
+		// Put the packets back with their indexes.
+		log.Printf("Thread %v could not place files in %q: %v", t.id, d.IndexDirectory, err)
+		if err := relink(active.PacketsDirectory, t.packetPath); err != nil {
+			log.Fatalf("Thread %v could not restore its packets symlink: %v", t.id, err)
+		}
+		return
+	}
+	t.dirMu.Lock()
+	t.active = d
+	t.dirMu.Unlock()
+	placementChanges.Increment()
+	v(0, "Thread %v writing new files to %q and %q", t.id, d.PacketsDirectory, d.IndexDirectory)
+}
+
+// chooseDirectory returns the directory placement prefers:  for "latency"
+// the one whose packets directory writes fastest, and otherwise the one with
+// the most free bytes.  Directories which can't be checked are skipped.
+func (t *Thread) chooseDirectory(dirs []config.ThreadDirectories, placement string) config.ThreadDirectories {
+	best, bestScore := dirs[0], 0.0
+	found := false
+	for _, d := range dirs {
+		var score float64
+		if placement == "latency" {
+			latency, err := probeLatency(d.PacketsDirectory)
+			if err != nil {
+				log.Printf("Thread %v could not time writes to %q: %v", t.id, d.PacketsDirectory, err)
+				continue
+			}
+			v(1, "Thread %v wrote %d bytes to %q in %v", t.id, placementProbeBytes, d.PacketsDirectory, latency)
+			score = -latency.Seconds()
+		} else {
+			free, err := base.PathDiskFreeBytes(d.PacketsDirectory)
+			if err != nil {
+				log.Printf("Thread %v could not get the free disk bytes for %q: %v", t.id, d.PacketsDirectory, err)
+				continue
+			}
+			score = float64(free)
+		}
+		if !found || score > bestScore {
+			best, bestScore, found = d, score, true
+		}
+	}
+	return best
+}
+
+// probeLatency returns how long writing and syncing placementProbeBytes to a
+// file in dir takes.
+func probeLatency(dir string) (time.Duration, error) {
+	f, err := ioutil.TempFile(dir, ".placement")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	start := time.Now()
+	if _, err := f.Write(make([]byte, placementProbeBytes)); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// linksTo returns the paths of the symlinks to d.  Blockfiles find their
+// indexes by replacing PKT with IDX in their paths, so files are read through
+// these rather than d itself.
+//
+// This method should only be called once the t.dirMu has been acquired!
+func (t *Thread) linksTo(d config.ThreadDirectories) (packets, index string) {
+	n := fmt.Sprintf("%d.%d", t.id, t.links[d])
+	base := filepath.Dir(t.packetPath)
+	return filepath.Join(base, packetPrefix+n), filepath.Join(base, indexPrefix+n)
+}
+
+// linkDirectories creates symlinks to any of dirs which don't have them.
+func (t *Thread) linkDirectories(dirs []config.ThreadDirectories) error {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	for _, d := range dirs {
+		if _, ok := t.links[d]; ok {
+			continue
+		}
+		t.links[d] = len(t.links)
+		packets, index := t.linksTo(d)
+		if err := os.Symlink(d.PacketsDirectory, packets); err != nil {
+			delete(t.links, d)
+			return fmt.Errorf("couldn't create symlink for thread %d to directory %q: %v", t.id, d.PacketsDirectory, err)
+		}
+		if err := os.Symlink(d.IndexDirectory, index); err != nil {
+			os.Remove(packets)
+			delete(t.links, d)
+			return fmt.Errorf("couldn't create symlink for index %d to directory %q: %v", t.id, d.IndexDirectory, err)
+		}
+	}
+	return nil
+}
+
+// relink atomically points the symlink link at target.
+func relink(target, link string) error {
+	tmp := filepath.Join(filepath.Dir(link), "."+filepath.Base(link))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// setDirectories changes the directories the thread places files in to
+// conf's.  Any no longer configured are drained:  their files are moved to
+// the others, then they're forgotten.
+func (t *Thread) setDirectories(conf config.ThreadConfig) {
+	dirs := conf.Directories()
+	configured := map[config.ThreadDirectories]bool{}
+	for _, d := range dirs {
+		configured[d] = true
+	}
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	var draining []config.ThreadDirectories
+	for _, d := range t.draining {
+		if !configured[d] {
+			draining = append(draining, d)
+		}
+	}
+	for _, d := range t.dirs {
+		if !configured[d] {
+			log.Printf("Thread %v draining %q and %q, removed from its config", t.id, d.PacketsDirectory, d.IndexDirectory)
+			draining = append(draining, d)
+		}
+	}
+	t.dirs, t.draining, t.placement = dirs, draining, conf.Placement
+}
+
+// isDraining returns whether any directories are being drained.
+func (t *Thread) isDraining() bool {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	return len(t.draining) > 0
+}
+
+// packetDirectories returns the packets directories holding the thread's
+// files.
+func (t *Thread) packetDirectories() []string {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	if len(t.dirs) == 1 && len(t.draining) == 0 {
+		return []string{t.packetPath}
+	}
+	var out []string
+	for _, d := range append(append([]config.ThreadDirectories(nil), t.dirs...), t.draining...) {
+		packets, _ := t.linksTo(d)
+		out = append(out, packets)
+	}
+	return out
+}
+
+// filesInPacketDirectory returns those of files in the packets directory dir.
+func (t *Thread) filesInPacketDirectory(files []string, dir string) []string {
+	var out []string
+	for _, name := range files {
+		if packets, _ := t.fileDirectories(name); packets == dir {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// drainDirectories moves the files out of directories removed from the
+// config into those still in it, forgetting each once it's empty.  Files
+// aren't moved out of the directory stenotype is writing to until it's
+// restarted and placed elsewhere.
+func (t *Thread) drainDirectories() {
+	defer atomic.StoreInt32(&t.drainRunning, 0)
+	for {
+		name, from, dirs, placement, ok := t.nextToDrain()
+		if !ok {
+			return
+		}
+		to := t.chooseDirectory(dirs, placement)
+		if err := t.moveFile(name, from, to); err != nil {
+			// Retried on the next sync, once the files are listed again.
+			log.Printf("Thread %v could not move %q out of %q: %v", t.id, name, from.PacketsDirectory, err)
+			return
+		}
+		filesDrained.Increment()
+		v(1, "Thread %v moved %q from %q to %q", t.id, name, from.PacketsDirectory, to.PacketsDirectory)
+	}
+}
+
+// nextToDrain returns the oldest file in a draining directory, along with
+// the directories it can be moved to, and forgets draining directories
+// which are empty.
+func (t *Thread) nextToDrain() (name string, from config.ThreadDirectories, dirs []config.ThreadDirectories, placement string, ok bool) {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	var draining []config.ThreadDirectories
+	for _, d := range t.draining {
+		if d == t.active {
+			draining = append(draining, d)
+			continue
+		}
+		oldest := ""
+		for n, in := range t.fileDir {
+			if in == d && (oldest == "" || n < oldest) {
+				oldest = n
+			}
+		}
+		if oldest == "" {
+			log.Printf("Thread %v finished draining %q and %q", t.id, d.PacketsDirectory, d.IndexDirectory)
+			continue
+		}
+		draining = append(draining, d)
+		if !ok {
+			name, from, ok = oldest, d, true
+		}
+	}
+	t.draining = draining
+	return name, from, t.dirs, t.placement, ok
+}
+
+// moveFile copies a file's packets, index and index shards from one of the
+// thread's directories to another, then switches the thread to the copy and
+// deletes the original.  The index is moved last, since it's what marks a
+// file as complete.
+func (t *Thread) moveFile(name string, from, to config.ThreadDirectories) error {
+	t.rewriting.Lock()
+	defer t.rewriting.Unlock()
+	index := filepath.Join(from.IndexDirectory, name)
+	src := append(append([]string{filepath.Join(from.PacketsDirectory, name)}, indexfile.ShardPaths(index)...), index)
+	var dst, hidden []string
+	removeHidden := func() {
+		for _, h := range hidden {
+			os.Remove(h)
+		}
+	}
+	for i, path := range src {
+		dir := to.IndexDirectory
+		if i == 0 {
+			dir = to.PacketsDirectory
+		}
+		d := filepath.Join(dir, filepath.Base(path))
+		h := filepath.Join(dir, "."+filepath.Base(path)+".move")
+		hidden = append(hidden, h)
+		if err := copyFile(path, h); err != nil {
+			removeHidden()
+			return err
+		}
+		dst = append(dst, d)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := os.Stat(src[0]); os.IsNotExist(err) {
+		// Deleted while it was being copied.
+		removeHidden()
+		return nil
+	}
+	defer t.lockFiles()()
+	for i := range dst {
+		if err := os.Rename(hidden[i], dst[i]); err != nil {
+			removeHidden()
+			for _, d := range dst[:i] {
+				os.Remove(d)
+			}
+			return err
+		}
+	}
+	t.dirMu.Lock()
+	t.fileDir[name] = to
+	t.dirMu.Unlock()
+	if bf := t.files[name]; bf != nil {
+		// Closing waits for queries reading it, so none are left reading the
+		// original when it's deleted.
+		bf.Close()
+		delete(t.files, name)
+		currentFiles.IncrementBy(-1)
+		if err := t.trackNewFile(name); err != nil {
+			log.Printf("Thread %v error reopening %q after moving it: %v", t.id, name, err)
+		}
+	}
+	for _, path := range src {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Thread %v could not remove %q after moving it: %v", t.id, path, err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dst, syncing it to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %q: %v", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// VerifyIndexesOnOpen makes threads check every new index for corruption
+// before serving queries from it.
+var VerifyIndexesOnOpen = false
+
+// quarantineDir is the subdirectory of the packets and index directories that
+// files with corrupt indexes are moved to.  It's hidden, so its contents are
+// never mistaken for live files.
+const quarantineDir = ".quarantine"
+
+var (
+	quarantinedFiles   = stats.S.Get("quarantined_files")
+	indexFilesVerified = stats.S.Get("index_files_verified")
+)
+
+// quarantineFile stops serving a file whose index is corrupt, and moves its
+// packets and index aside, so queries can't trip over it again and an
+// operator can inspect it (or rebuild its index).  Read-only replicas leave
+// moving the files to the writer, and just ignore them until they're gone.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) quarantineFile(filename string, reason error) {
+	log.Printf("ALERT: thread %d quarantining %q: %v", t.id, filename, reason)
+	quarantinedFiles.Increment()
+	if b := t.files[filename]; b != nil {
+		b.Close()
+		delete(t.files, filename)
+		currentFiles.IncrementBy(-1)
+	}
+	if t.readOnly {
+		t.corrupt[filename] = true
+		return
+	}
+	defer t.lockFiles()()
+	indexPath := t.getIndexFilePath(filename)
+	paths := append([]string{t.getPacketFilePath(filename), indexPath}, indexfile.ShardPaths(indexPath)...)
+	for _, path := range paths {
+		dir := filepath.Join(filepath.Dir(path), quarantineDir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("Thread %v could not create quarantine directory: %v", t.id, err)
+			return
+		}
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			log.Printf("Thread %v could not quarantine %q: %v", t.id, path, err)
+		}
+	}
+}
+
+// quarantineIfTracked quarantines file, unless it's already stopped being
+// served (for example, because it was deleted to free up disk space),
+// returning whether it did.
+func (t *Thread) quarantineIfTracked(file *blockfile.BlockFile, reason error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	filename := filepath.Base(file.Name())
+	if t.files[filename] != file {
+		return false
+	}
+	t.quarantineFile(filename, reason)
+	return true
+}
+
+// VerifyIndexes checks every index this thread serves for corruption, one at
+// a time, quarantining any which are corrupt.  It returns how many indexes
+// it checked, and the names of the files it quarantined.
+func (t *Thread) VerifyIndexes(ctx context.Context) (verified int, quarantined []string) {
+	t.mu.RLock()
+	var files []*blockfile.BlockFile
+	for _, name := range t.getSortedFiles() {
+		files = append(files, t.files[name])
+	}
+	t.mu.RUnlock()
+	for _, file := range files {
+		err := file.VerifyIndex(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		verified++
+		indexFilesVerified.Increment()
+		if indexfile.IsCorrupt(err) {
+			if t.quarantineIfTracked(file, err) {
+				quarantined = append(quarantined, filepath.Base(file.Name()))
+			}
+		} else if err != nil {
+			log.Printf("Thread %v could not verify %q: %v", t.id, file.Name(), err)
+		}
+	}
+	return
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"golang.org/x/net/context"
+)
+
+// DefaultReorderBufferPackets is ReorderBufferPackets unless it's set.
+const DefaultReorderBufferPackets = 1000
+
+// reorderBufferPackets is accessed atomically, since it may be changed while
+// queries run.
+var reorderBufferPackets int64 = DefaultReorderBufferPackets
+
+// ReorderBufferPackets returns how many packets each thread holds back while
+// sorting its packets by time, so those captured slightly out of order, or in
+// files whose times overlap, come out in order.  If 0 or less, packets are
+// sent in the order they're read.
+func ReorderBufferPackets() int {
+	return int(atomic.LoadInt64(&reorderBufferPackets))
+}
+
+// SetReorderBufferPackets sets ReorderBufferPackets.
+func SetReorderBufferPackets(n int) {
+	atomic.StoreInt64(&reorderBufferPackets, int64(n))
+}
+
+var (
+	packetsReordered  = stats.S.Get("packets_reordered")
+	packetsOutOfOrder = stats.S.Get("packets_sent_out_of_order")
+)
+
+// reorderEntry is a packet held in a reorderHeap.  seq keeps packets with the
+// same timestamp in the order they were read.
+type reorderEntry struct {
+	*base.Packet
+	seq int64
+}
+
+// reorderHeap is a min-heap of packets by time.
+type reorderHeap []reorderEntry
+
+func (r reorderHeap) Len() int      { return len(r) }
+func (r reorderHeap) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r reorderHeap) Less(i, j int) bool {
+	if r[i].Timestamp.Equal(r[j].Timestamp) {
+		return r[i].seq < r[j].seq
+	}
+	return r[i].Timestamp.Before(r[j].Timestamp)
+}
+func (r *reorderHeap) Push(x interface{}) { *r = append(*r, x.(reorderEntry)) }
+func (r *reorderHeap) Pop() (x interface{}) {
+	index := len(*r) - 1
+	*r, x = (*r)[:index], (*r)[index]
+	return
+}
+
+// reorderPackets sorts the packets from in by time, holding up to n at once.
+// Packets more than n places out of order are sent late, and counted in the
+// packets_sent_out_of_order stat.
+func reorderPackets(ctx context.Context, in *base.PacketChan, n int) *base.PacketChan {
+	out := base.NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		var h reorderHeap
+		var seq int64
+		var newest, sent time.Time
+		send := func() bool {
+			e := heap.Pop(&h).(reorderEntry)
+			if e.Timestamp.Before(sent) {
+				packetsOutOfOrder.Increment()
+			} else {
+				sent = e.Timestamp
+			}
+			select {
+			case out.C <- e.Packet:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for p := range in.Receive() {
+			if p.Timestamp.Before(newest) {
+				packetsReordered.Increment()
+			} else {
+				newest = p.Timestamp
+			}
+			heap.Push(&h, reorderEntry{p, seq})
+			seq++
+			if h.Len() > n && !send() {
+				out.Close(ctx.Err())
+				return
+			}
+		}
+		for h.Len() > 0 {
+			if !send() {
+				out.Close(ctx.Err())
+				return
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	"golang.org/x/net/context"
+)
+
+// Replicator copies threads' files to a standby stenographer.
+type Replicator interface {
+	// Replicated returns the names of a thread's files the standby has,
+	// oldest first.
+	Replicated(ctx context.Context, thread int) ([]string, error)
+	// Replicate copies the named file of a thread, given its packet file's
+	// path and its index's, followed by those of the index's IP shards.
+	Replicate(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error
+}
+
+// ReplicateFiles copies the files the standby doesn't have yet to it, oldest
+// first, so after an outage it catches up with the files still here.  Files
+// older than the standby's oldest aren't copied, since it's aged them out
+// itself.  Only the writer replicates files.
+func (t *Thread) ReplicateFiles(ctx context.Context, r Replicator) {
+	if t.readOnly {
+		return
+	}
+	have, err := r.Replicated(ctx, t.id)
+	if err != nil {
+		log.Printf("Thread %v could not list replicated files, will retry: %v", t.id, err)
+		return
+	}
+	replicated := map[string]bool{}
+	for _, name := range have {
+		replicated[name] = true
+	}
+	t.mu.RLock()
+	names := t.getSortedFiles()
+	t.mu.RUnlock()
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		if replicated[name] || (len(have) > 0 && name < have[0]) {
+			continue
+		}
+		// Keep compression and encryption from replacing the file while it's
+		// copied.
+		t.rewriting.Lock()
+		indexPath := t.getIndexFilePath(name)
+		err := r.Replicate(ctx, t.id, name, t.getPacketFilePath(name), append([]string{indexPath}, indexfile.ShardPaths(indexPath)...))
+		t.rewriting.Unlock()
+		if err != nil {
+			log.Printf("Thread %v could not replicate %q, will retry: %v", t.id, name, err)
+			return
+		}
+	}
+}
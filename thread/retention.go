@@ -0,0 +1,169 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+)
+
+// retention is a thread's policy for deleting files before the disk fills.
+type retention struct {
+	maxAge time.Duration
+	pinned []*config.Window
+}
+
+func newRetention(conf config.ThreadConfig) (retention, error) {
+	var r retention
+	if conf.MaxAge != "" {
+		d, err := time.ParseDuration(conf.MaxAge)
+		if err != nil {
+			return r, err
+		}
+		r.maxAge = d
+	}
+	for _, s := range conf.PinnedWindows {
+		w, err := config.ParseWindow(s)
+		if err != nil {
+			return r, err
+		}
+		r.pinned = append(r.pinned, w)
+	}
+	return r, nil
+}
+
+// Config returns the thread's configuration, as last set.
+func (t *Thread) Config() config.ThreadConfig {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.conf
+}
+
+// PrepareConfig checks that SetConfig can change the thread to conf, and
+// creates the ExtraDirectories it adds and the thread's links to them, which
+// go unused until then.  Preparing every thread's config before setting any
+// keeps a bad one from leaving only some changed.
+func (t *Thread) PrepareConfig(conf config.ThreadConfig) error {
+	if _, err := newRetention(conf); err != nil {
+		return err
+	}
+	if conf.PacketsDirectory != t.home.PacketsDirectory || conf.IndexDirectory != t.home.IndexDirectory {
+		return fmt.Errorf("thread %d directories can't change while running", t.id)
+	}
+	if err := makeDirs(conf.ExtraDirectories); err != nil {
+		return fmt.Errorf("thread %d: %v", t.id, err)
+	}
+	return t.linkDirectories(conf.ExtraDirectories)
+}
+
+// SetConfig changes how the thread decides which files to delete:  conf's
+// DiskFreePercentage, MaxDirectoryFiles, MaxAge, MaxBytes, MinFreeBytes and
+// PinnedWindows.  It also changes where files are placed, with conf's
+// ExtraDirectories and Placement, which take effect when stenotype next
+// starts.  Its PacketsDirectory and IndexDirectory must be the thread's own.
+// It only fails if PrepareConfig would.
+func (t *Thread) SetConfig(conf config.ThreadConfig) error {
+	if err := t.PrepareConfig(conf); err != nil {
+		return err
+	}
+	r, err := newRetention(conf)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conf.Interface = t.conf.Interface
+	t.conf, t.retention = conf, r
+	t.setDirectories(conf)
+	return nil
+}
+
+// isPinned returns whether files are pinned at the given time, so should
+// only be deleted to keep the disk from filling.
+func (r retention) isPinned(now time.Time) bool {
+	for _, w := range r.pinned {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredFiles returns how many of the given sorted files are older than
+// MaxAge, and so should be deleted.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) expiredFiles(files []string, now time.Time) int {
+	if t.retention.maxAge == 0 {
+		return 0
+	}
+	cutoff := now.Add(-t.retention.maxAge)
+	n := 0
+	for _, name := range files {
+		ts, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || !time.Unix(0, ts*1000 /* micros to nanos */).Before(cutoff) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// overQuotaFiles returns how many of the given sorted files should be deleted
+// to bring the thread's packet files under MaxBytes.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) overQuotaFiles(files []string) int {
+	if t.conf.MaxBytes <= 0 {
+		return 0
+	}
+	var total int64
+	for _, name := range files {
+		total += t.files[name].Size()
+	}
+	n := 0
+	for total > t.conf.MaxBytes && n < len(files) {
+		total -= t.files[files[n]].Size()
+		n++
+	}
+	return n
+}
+
+// applyRetention deletes files older than MaxAge or over MaxBytes, unless
+// files are pinned right now.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) applyRetention(now time.Time) {
+	if t.retention.maxAge == 0 && t.conf.MaxBytes <= 0 {
+		return
+	}
+	if t.retention.isPinned(now) {
+		v(1, "Thread %v files are pinned, skipping age and size retention", t.id)
+		return
+	}
+	files := t.getSortedFiles()
+	n := t.expiredFiles(files, now)
+	if q := t.overQuotaFiles(files); q > n {
+		n = q
+	}
+	if n > 0 {
+		v(1, "Thread %v retention deleting %d of %d files", t.id, n, len(files))
+		t.deleteOldestThreadFiles(n, files)
+	}
+}
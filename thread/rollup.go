@@ -0,0 +1,365 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/encrypt"
+	"../encrypt"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
+	//"github.com/google/stenographer/query"
+	"../query"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// RollupAge is how old data must be before the writer merges its indexes
+// into rollups.  Zero disables writing rollups.  Rollups already on disk are
+// used regardless.
+var RollupAge time.Duration
+
+// RollupPeriod is the length of time covered by each rollup.
+var RollupPeriod = time.Hour
+
+// rollupDir is the subdirectory of the index directory holding rollups.
+const rollupDir = "rollups"
+
+var (
+	rollupsWritten        = stats.S.Get("rollups_written")
+	rollupLookups         = stats.S.Get("rollup_lookups")
+	rollupLookupFallbacks = stats.S.Get("rollup_lookup_fallbacks")
+)
+
+var errRollupClosed = errors.New("rollup closed")
+
+// rollup is an open rollup index, covering many of the thread's files.
+type rollup struct {
+	name  string
+	files []string // Names of the files covered.
+	mu    sync.RWMutex
+	i     *indexfile.IndexFile // nil once closed.
+}
+
+// positions looks up q in the rollup, and splits the result by file.
+func (r *rollup) positions(ctx context.Context, q query.Query) (map[string]base.Positions, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.i == nil {
+		return nil, errRollupClosed
+	}
+	rollupLookups.Increment()
+	if !r.i.HasKeys(q.RequiredIndexes()...) {
+		return nil, nil
+	}
+	pos, err := q.LookupIn(ctx, r.i)
+	if err != nil {
+		return nil, err
+	}
+	return r.i.SplitRollupPositions(pos), nil
+}
+
+func (r *rollup) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.i != nil {
+		r.i.Close()
+		r.i = nil
+	}
+}
+
+// positioner looks up the positions of the packets a query matches in a
+// single file.
+type positioner interface {
+	Positions(ctx context.Context, q query.Query) (base.Positions, error)
+}
+
+// rollupLookup shares a single lookup in a rollup between all the files it
+// covers.
+type rollupLookup struct {
+	t    *Thread
+	r    *rollup
+	once sync.Once
+	pos  map[string]base.Positions
+	err  error
+}
+
+// rollupMember looks up a file's positions in a rollup covering it, falling
+// back to its own index if the rollup can't answer the query.
+type rollupMember struct {
+	l    *rollupLookup
+	file *blockfile.BlockFile
+}
+
+func (m *rollupMember) Positions(ctx context.Context, q query.Query) (base.Positions, error) {
+	l := m.l
+	l.once.Do(func() {
+		ctx, span := tracer.Start(ctx, "rollup_lookup", trace.WithAttributes(attribute.String("rollup", l.r.name)))
+		defer span.End()
+		l.pos, l.err = l.r.positions(ctx, q)
+		if indexfile.IsCorrupt(l.err) {
+			go l.t.dropRollup(l.r, l.err)
+		}
+	})
+	if l.err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rollupLookupFallbacks.Increment()
+		base.VContext(ctx, 2, "rollup %q can't look up %v for %q: %v", l.r.name, q, m.file.Name(), l.err)
+		return m.file.Positions(ctx, q)
+	}
+	if pos, ok := l.pos[filepath.Base(m.file.Name())]; ok {
+		return pos, nil
+	}
+	return base.NoPositions, nil
+}
+
+// positioners returns where to look up each of the given files' positions:
+// a rollup covering the file if there is one, or its own index.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) positioners(names []string) []positioner {
+	out := make([]positioner, len(names))
+	shared := map[*rollup]*rollupLookup{}
+	for i, name := range names {
+		r := t.rollupOf[name]
+		if r == nil {
+			out[i] = t.files[name]
+			continue
+		}
+		l := shared[r]
+		if l == nil {
+			l = &rollupLookup{t: t, r: r}
+			shared[r] = l
+		}
+		out[i] = &rollupMember{l, t.files[name]}
+	}
+	return out
+}
+
+func (t *Thread) getRollupPath(name string) string {
+	return filepath.Join(t.home.IndexDirectory, rollupDir, name)
+}
+
+// syncRollups opens any new rollups, and closes those which no longer cover
+// any tracked files.  The writer deletes those from disk too.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) syncRollups() {
+	defer t.lockFiles()()
+	infos, err := ioutil.ReadDir(filepath.Join(t.home.IndexDirectory, rollupDir))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Thread %v could not list rollups: %v", t.id, err)
+		return
+	}
+	onDisk := map[string]bool{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || name[0] == '.' {
+			continue
+		}
+		onDisk[name] = true
+		if t.rollups[name] != nil {
+			continue
+		}
+		i, err := indexfile.NewIndexFile(t.getRollupPath(name), t.fc)
+		if err == nil && i.RollupOf() == nil {
+			i.Close()
+			err = fmt.Errorf("not a rollup")
+		}
+		if err != nil {
+			log.Printf("Thread %v could not open rollup %q: %v", t.id, name, err)
+			if !t.readOnly {
+				tryToDeleteFile(t.getRollupPath(name))
+			}
+			continue
+		}
+		v(1, "Thread %v new rollup %q of %d files", t.id, name, len(i.RollupOf()))
+		r := &rollup{name: name, files: i.RollupOf(), i: i}
+		t.rollups[name] = r
+		for _, file := range r.files {
+			t.rollupOf[file] = r
+		}
+	}
+	for name, r := range t.rollups {
+		if onDisk[name] && t.coversTrackedFiles(r) {
+			continue
+		}
+		t.removeRollup(r)
+	}
+}
+
+// coversTrackedFiles returns whether any of the files r covers are tracked.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) coversTrackedFiles(r *rollup) bool {
+	for _, file := range r.files {
+		if t.files[file] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRollup stops using a rollup, deleting it if this is the writer.
+//
+// This method should only be called once the t.mu and the files lock have
+// been acquired!
+func (t *Thread) removeRollup(r *rollup) {
+	v(1, "Thread %v removing rollup %q", t.id, r.name)
+	delete(t.rollups, r.name)
+	for _, file := range r.files {
+		if t.rollupOf[file] == r {
+			delete(t.rollupOf, file)
+		}
+	}
+	r.close()
+	if t.readOnly {
+		return
+	}
+	if err := os.Remove(t.getRollupPath(r.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to delete rollup %q: %v", r.name, err)
+	}
+}
+
+// dropRollup removes a corrupt rollup.  Its files are looked up in their own
+// indexes until the writer rolls them up again.
+func (t *Thread) dropRollup(r *rollup, reason error) {
+	log.Printf("Thread %v dropping rollup %q: %v", t.id, r.name, reason)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rollups[r.name] == r {
+		defer t.lockFiles()()
+		t.removeRollup(r)
+	}
+}
+
+// CompactRollups merges the indexes of files older than RollupAge into a
+// rollup per RollupPeriod, so that queries over long time ranges have far
+// fewer indexes to search.  Only the writer writes rollups; new rollups are
+// picked up by the next SyncFiles.
+func (t *Thread) CompactRollups(ctx context.Context) {
+	if t.readOnly || RollupAge <= 0 || RollupPeriod <= 0 {
+		return
+	}
+	dir := filepath.Join(t.home.IndexDirectory, rollupDir)
+	if err := makeDirIfNecessary(dir); err != nil {
+		log.Printf("Thread %v could not create rollup directory: %v", t.id, err)
+		return
+	}
+	removeHiddenFiles(dir) // Left by a previous run dying mid-write.
+	cutoff := time.Now().Add(-RollupAge)
+	periods := map[time.Time][]string{}
+	t.mu.RLock()
+	for name := range t.files {
+		if t.rollupOf[name] != nil {
+			continue
+		}
+		micros, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		period := time.Unix(0, micros*1000).Truncate(RollupPeriod)
+		if period.Add(RollupPeriod).Before(cutoff) {
+			periods[period] = append(periods[period], name)
+		}
+	}
+	t.mu.RUnlock()
+	for _, files := range periods {
+		if ctx.Err() != nil {
+			return
+		}
+		if len(files) < 2 {
+			continue // Nothing to gain.
+		}
+		sort.Strings(files)
+		if err := t.writeRollup(files); err != nil {
+			log.Printf("Thread %v could not roll up %d files from %q: %v", t.id, len(files), files[0], err)
+		}
+	}
+}
+
+// writeRollup writes a rollup of the given files' indexes.  It's written to a
+// hidden file, then renamed into place, so it's never opened partially
+// written.
+func (t *Thread) writeRollup(files []string) error {
+	var indexes []*indexfile.IndexFile
+	defer func() {
+		for _, i := range indexes {
+			i.Close()
+		}
+	}()
+	for _, file := range files {
+		i, err := indexfile.NewIndexFile(t.getIndexFilePath(file), t.fc)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, i)
+	}
+	name := files[0] + "-" + files[len(files)-1]
+	hidden := t.getRollupPath("." + name)
+	if err := indexfile.WriteRollup(hidden, indexes); err != nil {
+		os.Remove(hidden)
+		return err
+	}
+	if encrypt.Keys != nil {
+		plaintext := hidden
+		hidden = t.getRollupPath("." + name + ".enc")
+		err := encrypt.EncryptFile(plaintext, hidden, indexfile.EncryptChunkBytes)
+		os.Remove(plaintext)
+		if err != nil {
+			os.Remove(hidden)
+			return err
+		}
+	}
+	if err := os.Rename(hidden, t.getRollupPath(name)); err != nil {
+		os.Remove(hidden)
+		return err
+	}
+	rollupsWritten.Increment()
+	v(1, "Thread %v rolled up %d files into %q", t.id, len(files), name)
+	return nil
+}
+
+// removeHiddenFiles removes hidden files from dir.
+func removeHiddenFiles(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") && info.Mode().IsRegular() {
+			tryToDeleteFile(filepath.Join(dir, info.Name()))
+		}
+	}
+}
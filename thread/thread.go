@@ -27,23 +27,29 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/stenographer/base"
 	//"github.com/google/stenographer/blockfile"
         "../blockfile"
-	"github.com/google/stenographer/config"
+	//"github.com/google/stenographer/config"
+	"../config"
 	"github.com/google/stenographer/filecache"
 	"github.com/google/stenographer/httputil"
-	"github.com/google/stenographer/indexfile"
+	//"github.com/google/stenographer/indexfile"
+	"../indexfile"
 	//"github.com/google/stenographer/query"
 	"../query"
-	"github.com/google/stenographer/stats"
+	//"github.com/google/stenographer/stats"
+	"../stats"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/net/context"
 )
 
 var (
 	v            = base.V // verbose logging
+	tracer       = otel.Tracer("github.com/google/stenographer/thread")
 	currentFiles = stats.S.Get("current_files")
 	agedFiles    = stats.S.Get("aged_files")
 )
@@ -67,24 +73,77 @@ type Thread struct {
 	mu           sync.RWMutex
 	fileLastSeen time.Time
 	fc           *filecache.Cache
+	aged         int // Number of files aged out since startup.
+	written      int64 // Bytes of files tracked since startup.
+	readOnly     bool     // If true, another process captures and deletes files.
+	writerLock   *os.File // Held if this process is the writer.
+	// corrupt holds files a replica found corrupt, and is waiting for the
+	// writer to quarantine.
+	corrupt map[string]bool
+	// rollups holds the open rollup indexes, by name, and rollupOf the rollup
+	// covering each file.
+	rollups  map[string]*rollup
+	rollupOf map[string]*rollup
+	// rewriting is held while compressing, encrypting or archiving a file, so
+	// only one rewrite of a file happens at once.
+	rewriting sync.Mutex
+	// archiver archives files before they're deleted, if set.
+	archiver Archiver
+	// retention deletes files by age and size, beyond keeping disk free.
+	retention retention
+	// home is the thread's PacketsDirectory and IndexDirectory, which hold
+	// its lock files and rollups wherever its files are placed.
+	home config.ThreadDirectories
+	// dirMu guards where files are placed:  dirs are the configured
+	// directories, active the one the symlinks point stenotype at, draining
+	// those a reload removed which still have files, and fileDir the
+	// directory each file was last found in.  links numbers the symlinks
+	// to each directory, which files are read through.
+	dirMu     sync.Mutex
+	dirs      []config.ThreadDirectories
+	active    config.ThreadDirectories
+	draining  []config.ThreadDirectories
+	fileDir   map[string]config.ThreadDirectories
+	links     map[config.ThreadDirectories]int
+	placement string
+	// drainRunning is set while a goroutine moves files out of draining
+	// directories.
+	drainRunning int32
 }
 
 // Threads creates a set of thread objects based on a set of ThreadConfigs.
 func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache) ([]*Thread, error) {
 	threads := make([]*Thread, len(configs))
 	for i, conf := range configs {
+		r, err := newRetention(conf)
+		if err != nil {
+			return nil, fmt.Errorf("thread %d retention: %v", i, err)
+		}
 		thread := &Thread{
 			id:           i,
 			conf:         conf,
 			indexPath:    filepath.Join(baseDir, indexPrefix+strconv.Itoa(i)),
 			packetPath:   filepath.Join(baseDir, packetPrefix+strconv.Itoa(i)),
 			files:        map[string]*blockfile.BlockFile{},
+			corrupt:      map[string]bool{},
+			rollups:      map[string]*rollup{},
+			rollupOf:     map[string]*rollup{},
 			fileLastSeen: time.Now(),
 			fc:           fc,
+			retention:    r,
+			home:         conf.Directories()[0],
+			dirs:         conf.Directories(),
+			active:       conf.Directories()[0],
+			fileDir:      map[string]config.ThreadDirectories{},
+			links:        map[config.ThreadDirectories]int{},
+			placement:    conf.Placement,
 		}
 		if err := thread.createSymlinks(); err != nil {
 			return nil, err
 		}
+		if err := thread.linkDirectories(thread.dirs); err != nil {
+			return nil, err
+		}
 		threads[i] = thread
 	}
 	return threads, nil
@@ -104,16 +163,13 @@ func makeDirIfNecessary(dir string) error {
 }
 
 func (t *Thread) createSymlinks() error {
-	if err := makeDirIfNecessary(t.conf.PacketsDirectory); err != nil {
-		return fmt.Errorf("thread %v could not create packet directory: %v", t.id, err)
+	if err := makeDirs(t.dirs); err != nil {
+		return fmt.Errorf("thread %v could not create directory: %v", t.id, err)
 	}
 	if err := os.Symlink(t.conf.PacketsDirectory, t.packetPath); err != nil {
 		return fmt.Errorf("couldn't create symlink for thread %d to directory %q: %v",
 			t.id, t.conf.PacketsDirectory, err)
 	}
-	if err := makeDirIfNecessary(t.conf.IndexDirectory); err != nil {
-		return fmt.Errorf("thread %v could not create index directory: %v", t.id, err)
-	}
 	if err := os.Symlink(t.conf.IndexDirectory, t.indexPath); err != nil {
 		return fmt.Errorf("couldn't create symlink for index %d to directory %q: %v",
 			t.id, t.conf.IndexDirectory, err)
@@ -121,21 +177,62 @@ func (t *Thread) createSymlinks() error {
 	return nil
 }
 
+// makeDirs creates any of dirs' directories which don't exist.
+func makeDirs(dirs []config.ThreadDirectories) error {
+	for _, d := range dirs {
+		if err := makeDirIfNecessary(d.PacketsDirectory); err != nil {
+			return err
+		}
+		if err := makeDirIfNecessary(d.IndexDirectory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileDirectories returns the paths of the packet and index directories
+// holding the named file:  those it was found in, or the ones stenotype is
+// writing to.
+func (t *Thread) fileDirectories(filename string) (packets, index string) {
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	d, ok := t.fileDir[filename]
+	if !ok || (len(t.dirs) == 1 && len(t.draining) == 0) {
+		return t.packetPath, t.indexPath
+	}
+	return t.linksTo(d)
+}
+
 func (t *Thread) getPacketFilePath(filename string) string {
-	return filepath.Join(t.packetPath, filename)
+	dir, _ := t.fileDirectories(filename)
+	return filepath.Join(dir, filename)
 }
 
 func (t *Thread) getIndexFilePath(filename string) string {
-	return filepath.Join(t.indexPath, filename)
+	_, dir := t.fileDirectories(filename)
+	return filepath.Join(dir, filename)
 }
 
 func (t *Thread) syncFilesWithDisk() {
 	fido := base.Watchdog(time.Minute*5, "syncing files with disk") // 5 min for initial list of files
 	defer fido.Stop()
+	if t.readOnly {
+		defer t.lockFiles()()
+	}
 	newFilesCnt := 0
-	for _, filename := range t.listPacketFilesOnDisk() {
+	onDisk, moved := t.listPacketFilesOnDisk()
+	for _, filename := range moved {
+		// Moved by the writer from a directory removed from the config.
+		if bf := t.files[filename]; bf != nil {
+			v(1, "Thread %v reopening %q, moved by writer", t.id, filename)
+			bf.Close()
+			delete(t.files, filename)
+			currentFiles.IncrementBy(-1)
+		}
+	}
+	for _, filename := range onDisk {
 		fido.Reset(time.Minute) // 1 minute for opening each new file
-		if t.files[filename] != nil {
+		if t.files[filename] != nil || t.corrupt[filename] {
 			continue
 		}
 		if err := t.trackNewFile(filename); err != nil {
@@ -148,35 +245,107 @@ func (t *Thread) syncFilesWithDisk() {
 	if newFilesCnt > 0 {
 		v(0, "Thread %v found %d new blockfiles", t.id, newFilesCnt)
 	}
+	if t.readOnly {
+		t.untrackFilesDeletedByWriter(onDisk)
+		t.reopenReplacedFiles()
+	}
+}
+
+// untrackFilesDeletedByWriter stops tracking any files that are no longer on
+// disk because the writer deleted them.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) untrackFilesDeletedByWriter(onDisk []string) {
+	exists := map[string]bool{}
+	for _, filename := range onDisk {
+		exists[filename] = true
+	}
+	for filename := range t.corrupt {
+		if !exists[filename] {
+			delete(t.corrupt, filename)
+		}
+	}
+	for filename := range t.files {
+		if !exists[filename] {
+			if err := t.untrackFile(filename); err != nil {
+				log.Printf("Thread %v could not untrack %q: %v", t.id, filename, err)
+			}
+		}
+	}
 }
 
-func (t *Thread) listPacketFilesOnDisk() (out []string) {
+// listPacketFilesOnDisk lists the files in all the thread's directories,
+// noting which each is in.  It also returns those which have moved to another
+// directory since they were last listed.
+func (t *Thread) listPacketFilesOnDisk() (out, moved []string) {
+	t.dirMu.Lock()
+	dirs := append(append([]config.ThreadDirectories(nil), t.dirs...), t.draining...)
+	t.dirMu.Unlock()
 	// Since indexes tend to be written after blockfiles, we list index files,
 	// then translate them back to blockfiles.  This way, we don't get spurious
 	// errors when we find blockfiles that indexes haven't been written for yet.
-	files, err := ioutil.ReadDir(t.indexPath)
-	if err != nil {
-		log.Printf("Thread %v could not read dir %q: %v", t.id, t.indexPath, err)
-		return nil
+	in := map[string][]config.ThreadDirectories{}
+	for _, d := range dirs {
+		dir := d.IndexDirectory
+		if len(dirs) == 1 {
+			dir = t.indexPath
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("Thread %v could not read dir %q: %v", t.id, dir, err)
+			return nil, nil
+		}
+		for _, file := range files {
+			if file.IsDir() || file.Name()[0] == '.' || indexfile.IsShardPath(file.Name()) {
+				continue
+			}
+			name := indexfile.BlockfilePathFromIndexPath(file.Name())
+			if in[name] == nil {
+				out = append(out, name)
+			}
+			in[name] = append(in[name], d)
+		}
 	}
-	for _, file := range files {
-		if file.IsDir() || file.Name()[0] == '.' {
-			continue
+	t.dirMu.Lock()
+	defer t.dirMu.Unlock()
+	fileDir := make(map[string]config.ThreadDirectories, len(out))
+	for _, name := range out {
+		// A file being moved is in both directories; it stays in the one it
+		// was in until the move's done.
+		d := in[name][0]
+		for _, o := range in[name] {
+			if prev, ok := t.fileDir[name]; ok && o == prev {
+				d = o
+			}
 		}
-		out = append(out, indexfile.BlockfilePathFromIndexPath(file.Name()))
+		if prev, ok := t.fileDir[name]; ok && prev != d {
+			moved = append(moved, name)
+		}
+		fileDir[name] = d
 	}
-	return
+	t.fileDir = fileDir
+	return out, moved
 }
 
 // This method should only be called once the t.mu has been acquired!
 func (t *Thread) trackNewFile(filename string) error {
-	filepath := filepath.Join(t.packetPath, filename)
+	filepath := t.getPacketFilePath(filename)
 	bf, err := blockfile.NewBlockFile(filepath, t.fc)
-	if err != nil {
+	if err == nil && VerifyIndexesOnOpen {
+		indexFilesVerified.Increment()
+		if err = bf.VerifyIndex(context.Background()); err != nil {
+			bf.Close()
+		}
+	}
+	if indexfile.IsCorrupt(err) {
+		t.quarantineFile(filename, err)
+		return err
+	} else if err != nil {
 		return fmt.Errorf("could not open blockfile %q: %v", filepath, err)
 	}
 	v(1, "new blockfile %q", filepath)
 	t.files[filename] = bf
+	t.written += bf.Size()
 	currentFiles.Increment()
 	return nil
 }
@@ -187,6 +356,7 @@ func (t *Thread) cleanUpOnLowDiskSpace() {
 	}
 	fido := base.Watchdog(time.Minute, "cleaning up low disk space")
 	defer fido.Stop()
+	t.applyRetention(time.Now())
 	for {
 		fido.Reset(time.Minute)
 		if len(t.files) > t.conf.MaxDirectoryFiles {
@@ -194,13 +364,29 @@ func (t *Thread) cleanUpOnLowDiskSpace() {
 			t.deleteOldestThreadFiles(len(t.files)-t.conf.MaxDirectoryFiles, nil)
 			continue
 		}
-		df, err := base.PathDiskFreePercentage(t.packetPath)
-		if err != nil {
-			log.Printf("Thread %v could not get the free disk percentage for %q: %v", t.id, t.packetPath, err)
-			return
+		low := ""
+		for _, dir := range t.packetDirectories() {
+			df, err := base.PathDiskFreePercentage(dir)
+			if err != nil {
+				log.Printf("Thread %v could not get the free disk percentage for %q: %v", t.id, dir, err)
+				return
+			}
+			var free int64
+			if t.conf.MinFreeBytes > 0 {
+				if free, err = base.PathDiskFreeBytes(dir); err != nil {
+					log.Printf("Thread %v could not get the free disk bytes for %q: %v", t.id, dir, err)
+					return
+				}
+			}
+			if df > t.conf.DiskFreePercentage && free >= t.conf.MinFreeBytes {
+				v(1, "Thread %v disk space is sufficient (packet path=%q): %d%% free > %d%% threshold", t.id, dir, df, t.conf.DiskFreePercentage)
+				continue
+			}
+			v(0, "Thread %v disk usage is high (packet path=%q): %d%% free (threshold %d%%), %d bytes free (threshold %d)", t.id, dir, df, t.conf.DiskFreePercentage, free, t.conf.MinFreeBytes)
+			low = dir
+			break
 		}
-		if df > t.conf.DiskFreePercentage {
-			v(1, "Thread %v disk space is sufficient (packet path=%q): %d%% free > %d%% threshold", t.id, t.packetPath, df, t.conf.DiskFreePercentage)
+		if low == "" {
 			return
 		}
 		// Check if there's still files left on the thread to clean up, if not leave the loop
@@ -208,9 +394,11 @@ func (t *Thread) cleanUpOnLowDiskSpace() {
 			v(1, "Thread %v has no files, nothing to clean up", t.id)
 			return
 		}
-		v(0, "Thread %v disk usage is high (packet path=%q): %d%% free <= %d%% threshold", t.id, t.packetPath, df, t.conf.DiskFreePercentage)
 		// Delete enough files to match newest file size.
-		t.pruneOldestThreadFiles()
+		if !t.pruneOldestThreadFiles(low) {
+			v(1, "Thread %v has no files in %q, nothing to clean up", t.id, low)
+			return
+		}
 		// After deleting files, it may take a while for disk stats to be updated.
 		// We add this sleep so we don't accidentally delete WAY more files than
 		// we need to.
@@ -226,24 +414,29 @@ func tryToDeleteFile(filename string) {
 }
 
 // pruneOldestThreadFiles deletes enough of the oldest files held by this
-// thread to free up bytes >= the size of the newest file.
+// thread in the packets directory dir to free up bytes >= the size of the
+// newest file, returning false if it has none there.
 // It should only exceed the newest size by no more than the size of the last
 // deleted file.
 // It should only be called if the thread has at least one file (should be
 // checked by the caller beforehand).
-func (t *Thread) pruneOldestThreadFiles() {
+func (t *Thread) pruneOldestThreadFiles(dir string) bool {
 	files := t.getSortedFiles()
 	v(2, "pruneOldestThreadFiles - files count %v, t.files count %v", len(files), len(t.files))
 	if len(files) == 0 || len(t.files) == 0 {
-		return
+		return false
 	}
 	firstName := files[len(files)-1]
 	v(3, "pruneOldestThreadFiles - firstName %v", firstName)
 	if len(firstName) == 0 {
-		return
+		return false
 	}
 	firstSize := t.files[firstName].Size()
 	v(3, "pruneOldestThreadFiles - firstSize %v", firstSize)
+	files = t.filesInPacketDirectory(files, dir)
+	if len(files) == 0 {
+		return false
+	}
 	var delSize int64
 	delCnt := 0
 	for delSize <= firstSize && delCnt < len(files) {
@@ -255,6 +448,7 @@ func (t *Thread) pruneOldestThreadFiles() {
 	}
 	v(1, "Thread %v deleting %v files to free up %v bytes.", t.id, delCnt, delSize)
 	t.deleteOldestThreadFiles(delCnt, files)
+	return true
 }
 
 // deleteOldestThreadFiles deletes n of the oldest files held by this thread.
@@ -265,12 +459,33 @@ func (t *Thread) deleteOldestThreadFiles(n int, files []string) {
 	if files == nil {
 		files = t.getSortedFiles()
 	}
+	if n < len(files) {
+		t.archiveBeforeDelete(files[:n])
+	} else {
+		t.archiveBeforeDelete(files)
+	}
+	// Deletes happen in parallel, but must all finish before we release the
+	// files lock so replicas don't see partially deleted files.
+	unlock := t.lockFiles()
+	var wg sync.WaitGroup
+	deleteFile := func(filename string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tryToDeleteFile(filename)
+		}()
+	}
 	for i := 0; i < n && i < len(files); i++ {
 		toDelete := files[i]
 		v(1, "Thread %v removing %q", t.id, toDelete)
-		go tryToDeleteFile(t.getPacketFilePath(toDelete))
-		go tryToDeleteFile(t.getIndexFilePath(toDelete))
+		deleteFile(t.getPacketFilePath(toDelete))
+		deleteFile(t.getIndexFilePath(toDelete))
+		for _, shard := range indexfile.ShardPaths(t.getIndexFilePath(toDelete)) {
+			deleteFile(shard)
+		}
 	}
+	wg.Wait()
+	unlock()
 	for i := 0; i < n && i < len(files); i++ {
 		toDelete := files[i]
 		if err := t.untrackFile(toDelete); err != nil {
@@ -339,6 +554,40 @@ func (t *Thread) OldestFileTimestamp() time.Time {
 	return time.Unix(0, ts*1000 /* micros to nanos */)
 }
 
+// Usage summarizes the blockfiles currently tracked by a thread.
+type Usage struct {
+	Files  int
+	Aged   int // Files deleted to make room since startup.
+	Bytes  int64
+	Oldest time.Time // Creation time of the oldest file.
+	Newest time.Time // Creation time of the newest file.
+	// Written is the bytes of files tracked since startup, including those
+	// found on disk at startup.
+	Written int64
+}
+
+// Usage returns a summary of the files this thread currently tracks.
+func (t *Thread) Usage() Usage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	u := Usage{Files: len(t.files), Aged: t.aged, Written: t.written}
+	for name, bf := range t.files {
+		u.Bytes += bf.Size()
+		ts, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		created := time.Unix(0, ts*1000 /* micros to nanos */)
+		if u.Oldest.IsZero() || created.Before(u.Oldest) {
+			u.Oldest = created
+		}
+		if created.After(u.Newest) {
+			u.Newest = created
+		}
+	}
+	return u
+}
+
 // This method should only be called once the t.mu has been acquired!
 func (t *Thread) untrackFile(filename string) error {
 	v(1, "Thread %v untracking %q", t.id, filename)
@@ -350,6 +599,7 @@ func (t *Thread) untrackFile(filename string) error {
 	v(1, "Thread %v old blockfile %q", t.id, b.Name())
 	b.Close()
 	delete(t.files, filename)
+	t.aged++
 	agedFiles.Increment()
 	currentFiles.IncrementBy(-1)
 	return nil
@@ -363,34 +613,173 @@ func (t *Thread) FileLastSeen() time.Time {
 	return t.fileLastSeen
 }
 
+// IndexStats summarizes the index of the named file, if this thread has it.
+func (t *Thread) IndexStats(name string) (stats *indexfile.Stats, found bool, _ error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	file := t.files[name]
+	if file == nil {
+		return nil, false, nil
+	}
+	stats, err := file.IndexStats()
+	return stats, true, err
+}
+
 const concurrentBlockfileReadsPerThread = 10
 
+// DefaultParallelBlockfileReads is ParallelBlockfileReads unless it's set.
+const DefaultParallelBlockfileReads = 1
+
+// parallelBlockfileReads is accessed atomically, since it may be changed
+// while queries run.
+var parallelBlockfileReads int64 = DefaultParallelBlockfileReads
+
+// ParallelBlockfileReads returns how many of a query's blockfiles each thread
+// reads packets from at once, merging them back into time order.  If 1 or
+// less, files are read one after another.
+func ParallelBlockfileReads() int {
+	return int(atomic.LoadInt64(&parallelBlockfileReads))
+}
+
+// SetParallelBlockfileReads sets ParallelBlockfileReads.
+func SetParallelBlockfileReads(n int) {
+	atomic.StoreInt64(&parallelBlockfileReads, int64(n))
+}
+
+// parallelReadAheadPackets is how many packets each blockfile read in
+// parallel may read ahead of those being sent.
+const parallelReadAheadPackets = 1000
+
 // Lookup looks up packets that match a given query within the files owned by a
-// single stenotype thread.
+// single stenotype thread, sorted by time as far as ReorderBufferPackets
+// allows.
 func (t *Thread) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
 	t.mu.RLock()
-	inputs := make(chan *base.PacketChan, concurrentBlockfileReadsPerThread)
-	out := base.ConcatPacketChans(ctx, inputs)
+	var inputs chan *base.PacketChan
+	var out *base.PacketChan
+	readAhead := 100
+	if parallel := ParallelBlockfileReads(); parallel > 1 {
+		// Files are only read once they're taken to be merged, so exactly
+		// parallel are read at a time.
+		inputs = make(chan *base.PacketChan)
+		out = base.MergeWindowPacketChans(ctx, inputs, parallel)
+		readAhead = parallelReadAheadPackets
+	} else {
+		inputs = make(chan *base.PacketChan, concurrentBlockfileReadsPerThread)
+		out = base.ConcatPacketChans(ctx, inputs)
+	}
 	var files []*blockfile.BlockFile
-	for _, file := range t.getSortedFilesInTimeSpan(q) {
+	names := t.getSortedFilesInTimeSpan(q)
+	for _, file := range names {
 		files = append(files, t.files[file])
 	}
+	sources := t.positioners(names)
 	t.mu.RUnlock()
+	lookups := lookupFiles(ctx, q, sources)
 	go func() {
 		defer func() {
 			close(inputs)
 			<-out.Done()
 		}()
-		for _, file := range files {
-			packets := base.NewPacketChan(100)
+		for i, file := range files {
+			r := lookups.result(i)
+			packets := base.NewPacketChan(readAhead)
 			select {
 			case inputs <- packets:
-				go file.Lookup(ctx, q, packets)
+				if indexfile.IsCorrupt(r.err) {
+					// Skip it rather than fail the whole query.
+					go t.quarantineIfTracked(file, r.err)
+					packets.Close(nil)
+					continue
+				} else if r.err != nil {
+					packets.Close(fmt.Errorf("index lookup failure in %q: %v", file.Name(), r.err))
+					return
+				}
+				go file.ReadPositions(ctx, r.pos, packets)
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
+	if n := ReorderBufferPackets(); n > 0 {
+		return reorderPackets(ctx, out, n)
+	}
+	return out
+}
+
+// FileEstimate is the number of packets a query matches in a single file,
+// according to its index.
+type FileEstimate struct {
+	File string
+	// Packets is -1 if the query matches all packets in the file, since
+	// indexes don't record how many that is.
+	Packets int
+	Bytes   int64 // Size of the file.
+	// EstimatedPackets is Packets, or for files whose packets all match, how
+	// many packets the index recorded (-1 if it didn't).  EstimatedBytes is
+	// roughly how large the matching packets are as a pcap.  See
+	// blockfile.Estimate.
+	EstimatedPackets int
+	EstimatedBytes   int64
+}
+
+// Explain returns how many packets q matches in each file it would read,
+// using only the indexes.
+func (t *Thread) Explain(ctx context.Context, q query.Query) ([]FileEstimate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var files []*blockfile.BlockFile
+	names := t.getSortedFilesInTimeSpan(q)
+	for _, name := range names {
+		files = append(files, t.files[name])
+	}
+	lookups := lookupFiles(ctx, q, t.positioners(names))
+	var out []FileEstimate
+	for i, file := range files {
+		r := lookups.result(i)
+		if indexfile.IsCorrupt(r.err) {
+			go t.quarantineIfTracked(file, r.err)
+			continue
+		} else if r.err != nil {
+			return nil, r.err
+		}
+		pos := r.pos
+		est := FileEstimate{File: file.Name(), Packets: len(pos), Bytes: file.Size()}
+		est.EstimatedPackets, est.EstimatedBytes = file.Estimate(pos)
+		if pos.IsAllPositions() {
+			est.Packets = -1
+		}
+		out = append(out, est)
+	}
+	return out, nil
+}
+
+// SamplePackets returns up to n packets from the newest file this thread
+// tracks, as a sample of recently captured traffic.
+func (t *Thread) SamplePackets(n int) *base.PacketChan {
+	out := base.NewPacketChan(n)
+	t.mu.RLock()
+	files := t.getSortedFiles()
+	if len(files) == 0 {
+		t.mu.RUnlock()
+		out.Close(nil)
+		return out
+	}
+	// AllPackets locks the blockfile before returning, so it can't be closed
+	// out from under us once we release t.mu.
+	in := t.files[files[len(files)-1]].AllPackets()
+	t.mu.RUnlock()
+	go func() {
+		defer in.Discard()
+		for count := 0; count < n; count++ {
+			pkt := <-in.Receive()
+			if pkt == nil {
+				break
+			}
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
 	return out
 }
 
@@ -399,8 +788,14 @@ func (t *Thread) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
 func (t *Thread) SyncFiles() {
 	t.mu.Lock()
 	t.syncFilesWithDisk()
-	t.cleanUpOnLowDiskSpace()
+	if !t.readOnly {
+		t.cleanUpOnLowDiskSpace()
+	}
+	t.syncRollups()
 	t.mu.Unlock()
+	if !t.readOnly && t.isDraining() && atomic.CompareAndSwapInt32(&t.drainRunning, 0, 1) {
+		go t.drainDirectories()
+	}
 }
 
 // ExportDebugHandlers exports a set of HTTP handlers on /debug/t<thread id> for
@@ -465,7 +860,13 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		base.PacketsToFile(file.AllPackets(), w, limit)
+		// Like /query's, so what's sent can be audited.
+		w.Header().Set("Trailer", "Steno-Packets, Steno-Error")
+		count, err := base.PacketsToFileCount(file.AllPackets(), w, limit, base.SnapLen)
+		w.Header().Set("Steno-Packets", strconv.FormatInt(count, 10))
+		if err != nil {
+			w.Header().Set("Steno-Error", err.Error())
+		}
 	})
 	mux.HandleFunc(prefix+"/positions", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, true)
@@ -21,11 +21,23 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/google/stenographer/config"
+	"github.com/google/gopacket"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/blockfile"
+	"../blockfile"
+	//"github.com/google/stenographer/config"
+	"../config"
 	"github.com/google/stenographer/filecache"
+	//"github.com/google/stenographer/query"
+	"../query"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -38,7 +50,7 @@ const (
 
 func createThreads(t *testing.T, tempDir string) []*Thread {
 	var tc = []config.ThreadConfig{
-		{tempDir + pktDir, tempDir + idxDir, 10, 10},
+		{PacketsDirectory: tempDir + pktDir, IndexDirectory: tempDir + idxDir, DiskFreePercentage: 10, MaxDirectoryFiles: 10},
 	}
 	threads, err := Threads(tc, tempDir+baseDir, filecache.NewCache(10))
 	if err != nil {
@@ -177,3 +189,696 @@ func TestExportDebugHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestReplicaTracksWriterDeletes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	writer := createThreads(t, tempDir)[0]
+	if err := writer.ClaimWriter(); err != nil {
+		t.Fatal(err)
+	}
+	defer writer.writerLock.Close()
+	if err := os.MkdirAll(tempDir+"/replica/", 0755); err != nil {
+		t.Fatal(err)
+	}
+	tc := []config.ThreadConfig{{PacketsDirectory: tempDir + pktDir, IndexDirectory: tempDir + idxDir}}
+	replicas, err := Threads(tc, tempDir+"/replica/", filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := replicas[0]
+	if err := replica.ClaimWriter(); err == nil {
+		t.Fatal("second writer claimed thread directories")
+	}
+	replica.SetReadOnly()
+
+	writer.SyncFiles()
+	replica.SyncFiles()
+	if got := replica.Usage().Files; got != 1 {
+		t.Fatalf("replica tracking %d files, want 1", got)
+	}
+	writer.mu.Lock()
+	writer.deleteOldestThreadFiles(1, nil)
+	writer.mu.Unlock()
+	replica.SyncFiles()
+	if got := replica.Usage().Files; got != 0 {
+		t.Fatalf("replica tracking %d files after writer deleted them, want 0", got)
+	}
+}
+
+// copyFileAs copies the test blockfile and its index into the thread
+// directories under the given name.
+func copyFileAs(t *testing.T, tempDir, name string) {
+	for src, dst := range map[string]string{
+		testBlockFile: tempDir + pktDir + name,
+		testIndexFile: tempDir + idxDir + name,
+	} {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := exec.Command("cp", "-f", src, dst).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rmData(t, tempDir)
+	now := time.Now()
+	old := strconv.FormatInt(now.Add(-2*time.Hour).UnixNano()/1000, 10)
+	older := strconv.FormatInt(now.Add(-3*time.Hour).UnixNano()/1000, 10)
+	newest := strconv.FormatInt(now.UnixNano()/1000, 10)
+	for _, name := range []string{older, old, newest} {
+		copyFileAs(t, tempDir, name)
+	}
+	th := createThreads(t, tempDir)[0]
+	th.syncFilesWithDisk()
+	files := func() []string {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		return th.getSortedFiles()
+	}
+
+	// Pinned files aren't deleted, however old.
+	if th.retention, err = newRetention(config.ThreadConfig{MaxAge: "150m", PinnedWindows: []string{"00:00-24:00"}}); err != nil {
+		t.Fatal(err)
+	}
+	th.mu.Lock()
+	th.applyRetention(now)
+	th.mu.Unlock()
+	if got := files(); len(got) != 3 {
+		t.Fatalf("deleted pinned files, left %v", got)
+	}
+
+	th.retention.pinned = nil
+	th.mu.Lock()
+	th.applyRetention(now)
+	th.mu.Unlock()
+	if got, want := files(), []string{old, newest}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after max age got files %v, want %v", got, want)
+	}
+
+	th.mu.Lock()
+	th.conf.MaxBytes = th.files[newest].Size()
+	th.applyRetention(now)
+	th.mu.Unlock()
+	if got, want := files(), []string{newest}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after max bytes got files %v, want %v", got, want)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rmData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	conf := th.Config()
+	conf.MaxAge = "1h"
+	conf.MaxDirectoryFiles = 5
+	if err := th.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if got := th.Config(); got.MaxDirectoryFiles != 5 || th.retention.maxAge != time.Hour {
+		t.Errorf("config not changed: %+v", got)
+	}
+	conf.PacketsDirectory = tempDir
+	if err := th.SetConfig(conf); err == nil {
+		t.Error("changed packets directory")
+	}
+	conf = th.Config()
+	conf.PinnedWindows = []string{"Funday 09:00-17:00"}
+	if err := th.SetConfig(conf); err == nil {
+		t.Error("set invalid pinned window")
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rmData(t, tempDir)
+	extra := config.ThreadDirectories{PacketsDirectory: tempDir + "/threadtest/pkt2/", IndexDirectory: tempDir + "/threadtest/idx2/"}
+	const name = "1500000000000000"
+	for src, dst := range map[string]string{testBlockFile: extra.PacketsDirectory + name, testIndexFile: extra.IndexDirectory + name} {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := exec.Command("cp", "-f", src, dst).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := config.ThreadConfig{PacketsDirectory: tempDir + pktDir, IndexDirectory: tempDir + idxDir, DiskFreePercentage: 10, MaxDirectoryFiles: 10, ExtraDirectories: []config.ThreadDirectories{extra}, Placement: "latency"}
+	threads, err := Threads([]config.ThreadConfig{conf}, tempDir+baseDir, filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := threads[0]
+	th.Place()
+	for link, want := range map[string]string{th.packetPath: th.active.PacketsDirectory, th.indexPath: th.active.IndexDirectory} {
+		if got, err := os.Readlink(link); err != nil || got != want {
+			t.Errorf("%q links to %q (%v), want %q", link, got, err, want)
+		}
+	}
+
+	th.SyncFiles()
+	if got, want := th.getPacketFilePath(name), tempDir+baseDir+"PKT0.1/"+name; got != want {
+		t.Fatalf("packets at %q, want %q", got, want)
+	}
+	// Removing the extra directory moves its files to the others.
+	conf.ExtraDirectories = nil
+	if err := th.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !th.isDraining() {
+		t.Fatal("not draining the removed directory")
+	}
+	// Stenotype restarts, writing to the remaining directory.
+	th.Place()
+	th.drainDirectories()
+	if th.isDraining() {
+		t.Error("still draining after moving every file")
+	}
+	if got, want := th.getPacketFilePath(name), th.packetPath+"/"+name; got != want {
+		t.Errorf("packets at %q after moving, want %q", got, want)
+	}
+	for _, path := range []string{tempDir + pktDir + name, tempDir + idxDir + name} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("not moved: %v", err)
+		}
+	}
+	for _, path := range []string{extra.PacketsDirectory + name, extra.IndexDirectory + name} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%q left behind after moving", path)
+		}
+	}
+	th.SyncFiles()
+	if got := th.Usage().Files; got != 1 {
+		t.Errorf("tracking %d files after moving, want 1", got)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := th.Explain(context.Background(), q); err != nil || len(files) != 1 || files[0].Packets != 4 {
+		t.Errorf("after moving got estimates %+v (%v), want 4 packets in 1 file", files, err)
+	}
+}
+
+func TestPinnedWindows(t *testing.T) {
+	r, err := newRetention(config.ThreadConfig{PinnedWindows: []string{"Mon-Fri 09:00-17:00", "Sat,Sun 22:00-06:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		when   string
+		pinned bool
+	}{
+		{"2024-01-01 09:00", true},  // Monday
+		{"2024-01-01 08:59", false}, // Monday
+		{"2024-01-05 16:59", true},  // Friday
+		{"2024-01-05 17:00", false}, // Friday
+		{"2024-01-06 12:00", false}, // Saturday
+		{"2024-01-06 23:00", true},  // Saturday
+		{"2024-01-07 03:00", true},  // Sunday, from Saturday night
+		{"2024-01-08 03:00", true},  // Monday, from Sunday night
+		{"2024-01-06 03:00", false}, // Saturday, Friday night isn't pinned
+	} {
+		when, err := time.ParseInLocation("2006-01-02 15:04", test.when, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.isPinned(when); got != test.pinned {
+			t.Errorf("%v pinned: got %v want %v", test.when, got, test.pinned)
+		}
+	}
+	for _, bad := range []string{"Mon-Fri", "Funday 09:00-17:00", "09:00-25:00", "09:00-09:00", "Mon 9-17"} {
+		if _, err := newRetention(config.ThreadConfig{PinnedWindows: []string{bad}}); err == nil {
+			t.Errorf("window %q parsed", bad)
+		}
+	}
+}
+
+// fakeArchiver records the files it archives.
+type fakeArchiver map[string][]string
+
+func (f fakeArchiver) Archived(thread int, name string) bool {
+	return f[name] != nil
+}
+
+func (f fakeArchiver) Archive(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error {
+	f[name] = append([]string{packetPath}, indexPaths...)
+	return nil
+}
+
+func TestArchiveBeforeDelete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	archived := fakeArchiver{}
+	th.SetArchiver(archived)
+	th.SyncFiles()
+	th.mu.Lock()
+	th.deleteOldestThreadFiles(1, nil)
+	th.mu.Unlock()
+	want := fakeArchiver{"dhcp": {tempDir + baseDir + "PKT0/dhcp", tempDir + baseDir + "IDX0/dhcp"}}
+	if !reflect.DeepEqual(archived, want) {
+		t.Errorf("got archived %v, want %v", archived, want)
+	}
+	if got := th.Usage().Files; got != 0 {
+		t.Errorf("tracking %d files after deleting them, want 0", got)
+	}
+	// Files already archived aren't archived again.
+	copyData(t, tempDir)
+	th.SyncFiles()
+	archived["dhcp"] = []string{"already"}
+	th.ArchiveFiles(context.Background())
+	th.mu.Lock()
+	th.deleteOldestThreadFiles(1, nil)
+	th.mu.Unlock()
+	if got := archived["dhcp"]; !reflect.DeepEqual(got, []string{"already"}) {
+		t.Errorf("archived again as %v", got)
+	}
+}
+
+// fakeReplicator records the files it replicates, and has the files in have.
+type fakeReplicator struct {
+	have       []string
+	replicated map[string][]string
+}
+
+func (f *fakeReplicator) Replicated(ctx context.Context, thread int) ([]string, error) {
+	return f.have, nil
+}
+
+func (f *fakeReplicator) Replicate(ctx context.Context, thread int, name, packetPath string, indexPaths []string) error {
+	f.replicated[name] = append([]string{packetPath}, indexPaths...)
+	return nil
+}
+
+func TestReplicateFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	for _, test := range []struct {
+		have []string
+		want map[string][]string
+	}{
+		{nil, map[string][]string{"dhcp": {tempDir + baseDir + "PKT0/dhcp", tempDir + baseDir + "IDX0/dhcp"}}},
+		{[]string{"dhcp"}, map[string][]string{}},
+		// The standby aged out files older than its oldest.
+		{[]string{"e"}, map[string][]string{}},
+	} {
+		r := &fakeReplicator{have: test.have, replicated: map[string][]string{}}
+		th.ReplicateFiles(context.Background(), r)
+		if !reflect.DeepEqual(r.replicated, test.want) {
+			t.Errorf("standby with %v: got replicated %v, want %v", test.have, r.replicated, test.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	// Files are only looked up by time if they have timestamp names.
+	for _, dir := range []string{pktDir, idxDir} {
+		if err := os.Rename(tempDir+dir+"dhcp", tempDir+dir+"1500000000000000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"port 67", 4},
+		{"port 12345", 0},
+		{"after 2000-01-01T00:00:00Z", -1},
+	} {
+		q, err := query.NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := th.Explain(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Packets != test.want {
+			t.Errorf("query %q got estimates %+v, want %d packets in 1 file", test.query, files, test.want)
+		}
+	}
+}
+
+func TestLookupFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	var files []*blockfile.BlockFile
+	for _, name := range th.getSortedFiles() {
+		files = append(files, th.files[name])
+	}
+	sources := th.positioners(th.getSortedFiles())
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetIndexLookupConcurrency(IndexLookupConcurrency())
+	for _, workers := range []int{1, 2, 10} {
+		SetIndexLookupConcurrency(workers)
+		l := lookupFiles(context.Background(), q, sources)
+		for i, file := range files {
+			r := l.result(i)
+			want, err := file.Positions(context.Background(), q)
+			if r.err != nil || err != nil {
+				t.Fatalf("lookup in %q failed: %v %v", file.Name(), r.err, err)
+			}
+			if !reflect.DeepEqual(r.pos, want) {
+				t.Errorf("%d workers got %v in %q, want %v", workers, r.pos, file.Name(), want)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l := lookupFiles(ctx, q, sources)
+	for i := range files {
+		if r := l.result(i); r.err == nil {
+			t.Errorf("canceled lookup in file %d succeeded", i)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	// Damage the index's only data block.
+	data, err := ioutil.ReadFile(tempDir + idxDir + "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 0xFF
+	if err := ioutil.WriteFile(tempDir+idxDir+"dhcp", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	th := createThreads(t, tempDir)[0]
+	before := quarantinedFiles.Value()
+	th.SyncFiles()
+	if got := th.Usage().Files; got != 0 {
+		t.Errorf("tracking %d files with corrupt indexes, want 0", got)
+	}
+	if got := quarantinedFiles.Value() - before; got != 1 {
+		t.Errorf("quarantined %d files, want 1", got)
+	}
+	for _, dir := range []string{pktDir, idxDir} {
+		if _, err := os.Stat(tempDir + dir + "dhcp"); !os.IsNotExist(err) {
+			t.Errorf("%s still in %s: %v", "dhcp", dir, err)
+		}
+		if _, err := os.Stat(tempDir + dir + quarantineDir + "/dhcp"); err != nil {
+			t.Errorf("dhcp not quarantined in %s: %v", dir, err)
+		}
+	}
+}
+
+func TestRollups(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rmData(t, tempDir)
+	for _, dir := range []string{pktDir, idxDir} {
+		if err := os.MkdirAll(tempDir+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files created at 01:00, 02:00, and 03:00 on a long gone day.
+	for src, dst := range map[string]string{"dhcp": "3600000000", "mpls": "7200000000", "vlan": "10800000000"} {
+		for from, to := range map[string]string{"../testdata/PKT0/": pktDir, "../testdata/IDX0/": idxDir} {
+			if err := exec.Command("cp", from+src, tempDir+to+dst).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	queries := []string{
+		"port 67",
+		"udp or vlan 1",
+		"port 67 and before 1970-01-01T01:30:00Z",
+		"after 1970-01-01T01:30:00Z",
+	}
+	want := map[string][]FileEstimate{}
+	for _, s := range queries {
+		q, err := query.NewQuery(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want[s], err = th.Explain(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(age, period time.Duration) { RollupAge, RollupPeriod = age, period }(RollupAge, RollupPeriod)
+	RollupAge, RollupPeriod = time.Hour, 24*time.Hour
+	th.CompactRollups(context.Background())
+	th.SyncFiles()
+	if len(th.rollups) != 1 || len(th.rollupOf) != 3 {
+		t.Fatalf("got rollups %v covering %d files, want 1 covering 3", th.rollups, len(th.rollupOf))
+	}
+	lookups, fallbacks := rollupLookups.Value(), rollupLookupFallbacks.Value()
+	for _, s := range queries {
+		q, _ := query.NewQuery(s)
+		got, err := th.Explain(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want[s]) {
+			t.Errorf("query %q with rollups got %+v, want %+v", s, got, want[s])
+		}
+	}
+	if got := rollupLookups.Value() - lookups; got != int64(len(queries)) {
+		t.Errorf("got %d rollup lookups, want %d", got, len(queries))
+	}
+	if rollupLookupFallbacks.Value() == fallbacks {
+		t.Errorf("queries for part of a rollup's time range didn't fall back to file indexes")
+	}
+
+	th.mu.Lock()
+	th.deleteOldestThreadFiles(3, nil)
+	th.mu.Unlock()
+	th.SyncFiles()
+	if files, _ := ioutil.ReadDir(tempDir + idxDir + rollupDir); len(th.rollups) != 0 || len(files) != 0 {
+		t.Errorf("rollup of deleted files not removed: %v, %d on disk", th.rollups, len(files))
+	}
+}
+
+func TestParallelBlockfileReads(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rmData(t, tempDir)
+	for _, dir := range []string{pktDir, idxDir} {
+		if err := os.MkdirAll(tempDir+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for src, dst := range map[string]string{"dhcp": "3600000000", "mpls": "7200000000", "vlan": "10800000000"} {
+		for from, to := range map[string]string{"../testdata/PKT0/": pktDir, "../testdata/IDX0/": idxDir} {
+			if err := exec.Command("cp", from+src, tempDir+to+dst).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	defer SetParallelBlockfileReads(ParallelBlockfileReads())
+	defer SetReorderBufferPackets(ReorderBufferPackets())
+	SetReorderBufferPackets(0)
+	for _, s := range []string{"udp or vlan 1", "after 1970-01-01T00:00:00Z"} {
+		q, err := query.NewQuery(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [2][]time.Time
+		for i, reads := range []int{1, 3} {
+			SetParallelBlockfileReads(reads)
+			c := th.Lookup(context.Background(), q)
+			for p := range c.Receive() {
+				got[i] = append(got[i], p.Timestamp)
+			}
+			if err := c.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The test files overlap in time, so merging all three at once
+		// reorders their packets.
+		count := map[time.Time]int{}
+		for _, ts := range got[0] {
+			count[ts]++
+		}
+		for i, ts := range got[1] {
+			count[ts]--
+			if i > 0 && ts.Before(got[1][i-1]) {
+				t.Errorf("query %q: parallel reads returned packet %d out of order", s, i)
+			}
+		}
+		for ts, n := range count {
+			if n != 0 {
+				t.Errorf("query %q: parallel reads returned packet at %v %d more times than sequential reads", s, ts, -n)
+			}
+		}
+		if len(got[0]) == 0 {
+			t.Errorf("query %q: no packets", s)
+		}
+	}
+}
+
+func TestReorderPackets(t *testing.T) {
+	for _, test := range []struct {
+		in, want   []int64
+		n          int
+		outOfOrder int64
+	}{
+		{[]int64{3, 4, 5, 1}, []int64{1, 3, 4, 5}, 3, 0},
+		{[]int64{3, 4, 5, 1}, []int64{3, 4, 1, 5}, 1, 1},
+		{[]int64{2, 1, 1, 3}, []int64{1, 1, 2, 3}, 2, 0},
+	} {
+		in := base.NewPacketChan(len(test.in))
+		for i, sec := range test.in {
+			in.Send(&base.Packet{Data: []byte{byte(i)}, CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(sec, 0)}})
+		}
+		in.Close(nil)
+		before := packetsOutOfOrder.Value()
+		out := reorderPackets(context.Background(), in, test.n)
+		var got []int64
+		var order []byte
+		for p := range out.Receive() {
+			got, order = append(got, p.Timestamp.Unix()), append(order, p.Data[0])
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("reordering %v with %d buffered got %v, want %v", test.in, test.n, got, test.want)
+		}
+		if n := packetsOutOfOrder.Value() - before; n != test.outOfOrder {
+			t.Errorf("reordering %v with %d buffered sent %d out of order, want %d", test.in, test.n, n, test.outOfOrder)
+		}
+		if test.in[1] == test.in[2] && order[0] != 1 {
+			t.Errorf("packets with equal timestamps reordered: %v", order)
+		}
+	}
+}
+
+func TestLive(t *testing.T) {
+	defer func(d time.Duration) { LivePollInterval = d }(LivePollInterval)
+	LivePollInterval = 10 * time.Millisecond
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err := blockfile.NewBlockFile(th.getPacketFilePath("dhcp"), th.fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+	positions, err := bf.Positions(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(tempDir + pktDir + "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first block is written when the second live query starts.
+	const written = 1 << 20
+	wantLate := 0
+	for _, pos := range positions {
+		if pos >= written {
+			wantLate++
+		}
+	}
+	if wantLate == 0 {
+		t.Fatalf("no packets match %v after the first block", q)
+	}
+	collect := func(live *base.PacketChan) chan int {
+		count := make(chan int, 1)
+		go func() {
+			n := 0
+			for range live.Receive() {
+				n++
+			}
+			count <- n
+		}()
+		return count
+	}
+
+	// stenotype writes a hidden, preallocated file, and renames it once done.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	early := collect(th.Live(ctx, q))
+	time.Sleep(50 * time.Millisecond)
+	writing := tempDir + pktDir + ".1500000000000000"
+	partial := make([]byte, len(data))
+	copy(partial, data[:written])
+	if err := ioutil.WriteFile(writing, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	late := collect(th.Live(ctx, q))
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(writing, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(writing, tempDir+pktDir+"1500000000000000"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if got := <-early; got != len(positions) {
+		t.Errorf("live query started before the file got %d packets, want %d", got, len(positions))
+	}
+	if got := <-late; got != wantLate {
+		t.Errorf("live query started partway through the file got %d packets, want %d", got, wantLate)
+	}
+}
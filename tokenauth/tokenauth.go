@@ -0,0 +1,157 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tokenauth authenticates clients that can't use client certificates
+// by bearer tokens:  static tokens from the config, or OpenID Connect ID
+// tokens from a configured issuer.
+package tokenauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/stenographer/base"
+	//"github.com/google/stenographer/config"
+	"../config"
+	"golang.org/x/net/context"
+)
+
+var v = base.V // verbose logging
+
+// ErrInvalidToken is returned for tokens that don't authenticate anyone.
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// discoveryTimeout limits how long fetching the OIDC issuer's configuration
+// and keys may take.
+const discoveryTimeout = 10 * time.Second
+
+// Identity is who a token was issued to.
+type Identity struct {
+	Subject string
+	Groups  []string
+}
+
+// Authenticator checks bearer tokens.
+type Authenticator struct {
+	static   map[[sha256.Size]byte]Identity
+	issuer   string
+	clientID string
+
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier // Set once the issuer's been discovered.
+}
+
+// New returns an Authenticator accepting the given static tokens, and ID
+// tokens from issuer issued to clientID, if issuer isn't empty.  The issuer
+// is only contacted once the first token needs checking against it, so it
+// being down doesn't stop stenographer from starting.
+func New(tokens []config.APIToken, issuer, clientID string) (*Authenticator, error) {
+	a := &Authenticator{
+		static:   map[[sha256.Size]byte]Identity{},
+		issuer:   issuer,
+		clientID: clientID,
+	}
+	for _, t := range tokens {
+		b, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("API token %q has invalid SHA256 %q", t.Subject, t.SHA256)
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], b)
+		a.static[sum] = Identity{Subject: t.Subject, Groups: t.Groups}
+	}
+	return a, nil
+}
+
+// oidcVerifier returns the verifier for the issuer's ID tokens, discovering
+// the issuer's configuration if that hasn't been done yet.
+func (a *Authenticator) oidcVerifier() (*oidc.IDTokenVerifier, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.verifier != nil {
+		return a.verifier, nil
+	}
+	v(1, "discovering OIDC issuer %q", a.issuer)
+	// The provider fetches the issuer's keys with this context for as long as
+	// it's used, so it mustn't be canceled.
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: discoveryTimeout})
+	provider, err := oidc.NewProvider(ctx, a.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC issuer %q: %v", a.issuer, err)
+	}
+	a.verifier = provider.Verifier(&oidc.Config{ClientID: a.clientID})
+	return a.verifier, nil
+}
+
+// Authenticate returns who a bearer token was issued to.
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	// Looking tokens up by their hash keeps the comparison from leaking how
+	// much of a token's right.
+	if id, ok := a.static[sha256.Sum256([]byte(token))]; ok {
+		return id, nil
+	}
+	if a.issuer == "" || strings.Count(token, ".") != 2 {
+		return Identity{}, ErrInvalidToken
+	}
+	verifier, err := a.oidcVerifier()
+	if err != nil {
+		return Identity{}, err
+	}
+	idToken, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%v: %v", ErrInvalidToken, err)
+	}
+	var claims struct {
+		Groups []string `json:"groups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, fmt.Errorf("%v: %v", ErrInvalidToken, err)
+	}
+	if idToken.Subject == "" {
+		return Identity{}, fmt.Errorf("%v: no subject", ErrInvalidToken)
+	}
+	return Identity{Subject: idToken.Subject, Groups: claims.Groups}, nil
+}
+
+// BearerToken returns the token in an Authorization header value, like
+// "Bearer abc", if there is one.
+func BearerToken(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity its request was
+// authenticated as.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity ctx's request was authenticated as by a
+// bearer token, if it was.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/config"
+	"../config"
+	"golang.org/x/net/context"
+)
+
+func TestStaticTokens(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	a, err := New([]config.APIToken{{Subject: "splunk", Groups: []string{"soc"}, SHA256: hex.EncodeToString(sum[:])}}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.Authenticate(context.Background(), "s3cret"); err != nil || !reflect.DeepEqual(id, Identity{"splunk", []string{"soc"}}) {
+		t.Errorf("got %v, %v; want splunk", id, err)
+	}
+	if _, err := a.Authenticate(context.Background(), "s3cre"); err != ErrInvalidToken {
+		t.Errorf("got %v for wrong token, want ErrInvalidToken", err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for _, test := range []struct {
+		header, want string
+		ok           bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer abc ", "abc", true},
+		{"Basic abc", "", false},
+		{"Bearer ", "", false},
+		{"", "", false},
+	} {
+		if got, ok := BearerToken(test.header); got != test.want || ok != test.ok {
+			t.Errorf("%q: got %q, %v; want %q, %v", test.header, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// issuer is a fake OIDC issuer, signing ID tokens with key.
+type issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newIssuer(t *testing.T) *issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &issuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                iss.URL,
+			"jwks_uri":                              iss.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	iss.Server = httptest.NewServer(mux)
+	return iss
+}
+
+// token returns an ID token with the given claims, on top of the standard
+// ones for the "stenographer" client.
+func (iss *issuer) token(t *testing.T, claims map[string]interface{}) string {
+	all := map[string]interface{}{
+		"iss": iss.URL,
+		"aud": "stenographer",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, err := json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDC(t *testing.T) {
+	iss := newIssuer(t)
+	defer iss.Close()
+	a, err := New(nil, iss.URL, "stenographer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id, err := a.Authenticate(ctx, iss.token(t, map[string]interface{}{"sub": "alice", "groups": []string{"soc"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Identity{"alice", []string{"soc"}}); !reflect.DeepEqual(id, want) {
+		t.Errorf("got %v, want %v", id, want)
+	}
+	for desc, claims := range map[string]map[string]interface{}{
+		"wrong audience": {"sub": "alice", "aud": "someone-else"},
+		"expired":        {"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()},
+		"no subject":     {},
+	} {
+		if _, err := a.Authenticate(ctx, iss.token(t, claims)); err == nil {
+			t.Errorf("%s token authenticated", desc)
+		}
+	}
+	// Tokens signed by anyone else are rejected.
+	other := newIssuer(t)
+	defer other.Close()
+	other.URL = iss.URL
+	if _, err := a.Authenticate(ctx, other.token(t, map[string]interface{}{"sub": "mallory"})); err == nil {
+		t.Errorf("forged token authenticated")
+	}
+}
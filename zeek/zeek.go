@@ -0,0 +1,251 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zeek translates Zeek conn.log entries into stenographer queries
+// for the packets of the connections they describe.
+package zeek
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conn is the part of a conn.log entry identifying its connection.
+type Conn struct {
+	Start        time.Time // The entry's ts.
+	Duration     time.Duration
+	OrigH, RespH string
+	OrigP, RespP int    // The ICMP type and code, for ICMP.
+	Proto        string // "tcp", "udp" or "icmp".
+}
+
+// jsonConn is a conn.log entry as Zeek logs it in JSON.  Its ts is seconds
+// since the epoch, or an ISO 8601 string if Zeek's configured to log those.
+type jsonConn struct {
+	TS       json.RawMessage `json:"ts"`
+	OrigH    string          `json:"id.orig_h"`
+	OrigP    int             `json:"id.orig_p"`
+	RespH    string          `json:"id.resp_h"`
+	RespP    int             `json:"id.resp_p"`
+	Proto    string          `json:"proto"`
+	Duration *float64        `json:"duration"`
+}
+
+// epoch returns the time secs seconds after the epoch.
+func epoch(secs float64) time.Time {
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC()
+}
+
+// seconds returns a duration of secs seconds.
+func seconds(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+func (j jsonConn) conn() (Conn, error) {
+	c := Conn{OrigH: j.OrigH, OrigP: j.OrigP, RespH: j.RespH, RespP: j.RespP, Proto: j.Proto}
+	var secs float64
+	var iso string
+	if err := json.Unmarshal(j.TS, &secs); err == nil {
+		c.Start = epoch(secs)
+	} else if err := json.Unmarshal(j.TS, &iso); err == nil {
+		if c.Start, err = time.Parse(time.RFC3339Nano, iso); err != nil {
+			return Conn{}, fmt.Errorf("invalid ts %q", iso)
+		}
+	} else {
+		return Conn{}, fmt.Errorf("invalid ts %s", j.TS)
+	}
+	if j.Duration != nil {
+		c.Duration = seconds(*j.Duration)
+	}
+	return c, nil
+}
+
+// ParseConns reads conn.log entries, either in Zeek's tab-separated format
+// with its #fields header, or in its JSON format, one object per line (or
+// all in an array).
+func ParseConns(data []byte) ([]Conn, error) {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+		return nil, nil
+	case data[0] == '[':
+		var entries []jsonConn
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid conn.log JSON: %v", err)
+		}
+		var conns []Conn
+		for i, j := range entries {
+			c, err := j.conn()
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i+1, err)
+			}
+			conns = append(conns, c)
+		}
+		return conns, nil
+	case data[0] == '{':
+		var conns []Conn
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for i := 1; dec.More(); i++ {
+			var j jsonConn
+			if err := dec.Decode(&j); err != nil {
+				return nil, fmt.Errorf("invalid conn.log JSON: %v", err)
+			}
+			c, err := j.conn()
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i, err)
+			}
+			conns = append(conns, c)
+		}
+		return conns, nil
+	}
+	return parseTSV(data)
+}
+
+// parseTSV reads conn.log entries in Zeek's tab-separated format.
+func parseTSV(data []byte) ([]Conn, error) {
+	var fields map[string]int
+	var conns []Conn
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "#fields\t") {
+			fields = map[string]int{}
+			for i, name := range strings.Split(text, "\t")[1:] {
+				fields[name] = i
+			}
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if fields == nil {
+			return nil, fmt.Errorf("line %d: no #fields header before the entries", line)
+		}
+		values := strings.Split(text, "\t")
+		get := func(name string) string {
+			if i, ok := fields[name]; ok && i < len(values) && values[i] != "-" {
+				return values[i]
+			}
+			return ""
+		}
+		c, err := tsvConn(get)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		conns = append(conns, c)
+	}
+	return conns, scanner.Err()
+}
+
+// tsvConn returns the Conn whose fields get returns.
+func tsvConn(get func(name string) string) (Conn, error) {
+	c := Conn{OrigH: get("id.orig_h"), RespH: get("id.resp_h"), Proto: get("proto")}
+	ts, err := strconv.ParseFloat(get("ts"), 64)
+	if err != nil {
+		return Conn{}, fmt.Errorf("invalid ts %q", get("ts"))
+	}
+	c.Start = epoch(ts)
+	for _, port := range []struct {
+		name string
+		out  *int
+	}{{"id.orig_p", &c.OrigP}, {"id.resp_p", &c.RespP}} {
+		if s := get(port.name); s != "" {
+			if *port.out, err = strconv.Atoi(s); err != nil {
+				return Conn{}, fmt.Errorf("invalid %s %q", port.name, s)
+			}
+		}
+	}
+	if s := get("duration"); s != "" {
+		d, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Conn{}, fmt.Errorf("invalid duration %q", s)
+		}
+		c.Duration = seconds(d)
+	}
+	return c, nil
+}
+
+// Query returns a query for the packets of c's connection, in both
+// directions, from pad before it started until pad after it ended.
+func (c Conn) Query(pad time.Duration) (string, error) {
+	orig, resp := net.ParseIP(c.OrigH), net.ParseIP(c.RespH)
+	if orig == nil || resp == nil {
+		return "", fmt.Errorf("invalid addresses %q and %q", c.OrigH, c.RespH)
+	}
+	parts := []string{"host " + c.OrigH}
+	if !orig.Equal(resp) {
+		parts = append(parts, "host "+c.RespH)
+	}
+	switch c.Proto {
+	case "tcp", "udp":
+		for _, port := range []int{c.OrigP, c.RespP} {
+			if port <= 0 || port > 65535 {
+				return "", fmt.Errorf("invalid port %d", port)
+			}
+		}
+		parts = append(parts, c.Proto, fmt.Sprintf("port %d", c.OrigP))
+		if c.RespP != c.OrigP {
+			parts = append(parts, fmt.Sprintf("port %d", c.RespP))
+		}
+	case "icmp":
+		// Zeek logs ICMPv6 connections as "icmp" too.
+		if orig.To4() == nil {
+			parts = append(parts, "icmp6")
+		} else {
+			parts = append(parts, "icmp")
+		}
+	default:
+		return "", fmt.Errorf("unknown proto %q", c.Proto)
+	}
+	// Times are whole seconds in queries, so the window is widened to them.
+	start := c.Start.Add(-pad).Truncate(time.Second)
+	end := c.Start.Add(c.Duration + pad)
+	if !end.Equal(end.Truncate(time.Second)) {
+		end = end.Truncate(time.Second).Add(time.Second)
+	}
+	parts = append(parts, fmt.Sprintf("between %s and %s", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)))
+	return strings.Join(parts, " and "), nil
+}
+
+// Query returns a query for the packets of all the conns' connections, from
+// pad before each started until pad after it ended.
+func Query(conns []Conn, pad time.Duration) (string, error) {
+	if len(conns) == 0 {
+		return "", fmt.Errorf("no conn.log entries")
+	}
+	var parts []string
+	seen := map[string]bool{}
+	for i, c := range conns {
+		q, err := c.Query(pad)
+		if err != nil {
+			return "", fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		if !seen[q] {
+			seen[q] = true
+			parts = append(parts, "("+q+")")
+		}
+	}
+	if len(parts) == 1 {
+		return strings.TrimSuffix(strings.TrimPrefix(parts[0], "("), ")"), nil
+	}
+	return strings.Join(parts, " or "), nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zeek
+
+import (
+	"testing"
+	"time"
+
+	//"github.com/google/stenographer/query"
+	"../query"
+)
+
+const (
+	tcpQuery  = "host 10.0.0.1 and host 10.0.0.2 and tcp and port 51000 and port 443 and between 2018-01-01T11:59:00Z and 2018-01-01T12:01:03Z"
+	icmpQuery = "host 2001:db8::1 and host 2001:db8::2 and icmp6 and between 2018-01-01T11:59:00Z and 2018-01-01T12:01:00Z"
+)
+
+func TestQuery(t *testing.T) {
+	for _, test := range []struct {
+		name, log, want string
+	}{
+		{"tsv", "#separator \\x09\n#path\tconn\n#fields\tts\tuid\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\tproto\tservice\tduration\n#types\ttime\tstring\taddr\tport\taddr\tport\tenum\tstring\tinterval\n" +
+			"1514808000.250000\tCx\t10.0.0.1\t51000\t10.0.0.2\t443\ttcp\tssl\t2.500000\n" +
+			"1514808000.000000\tCy\t2001:db8::1\t128\t2001:db8::2\t129\ticmp\t-\t-\n",
+			"(" + tcpQuery + ") or (" + icmpQuery + ")"},
+		{"ndjson", `{"ts":1514808000.25,"uid":"Cx","id.orig_h":"10.0.0.1","id.orig_p":51000,"id.resp_h":"10.0.0.2","id.resp_p":443,"proto":"tcp","duration":2.5}
+{"ts":"2018-01-01T12:00:00.250000Z","uid":"Cx","id.orig_h":"10.0.0.1","id.orig_p":51000,"id.resp_h":"10.0.0.2","id.resp_p":443,"proto":"tcp","duration":2.5}`,
+			tcpQuery},
+		{"array", `[{"ts":1514808000,"id.orig_h":"2001:db8::1","id.orig_p":128,"id.resp_h":"2001:db8::2","id.resp_p":129,"proto":"icmp"}]`,
+			icmpQuery},
+	} {
+		conns, err := ParseConns([]byte(test.log))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got, err := Query(conns, time.Minute)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v; want %q", test.name, got, err, test.want)
+			continue
+		}
+		if _, err := query.NewQuery(got); err != nil {
+			t.Errorf("%s: %q doesn't parse: %v", test.name, got, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, log := range []string{
+		"1514808000.0\tCx\t10.0.0.1\t1\t10.0.0.2\t2\ttcp\n",
+		"#fields\tts\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\tproto\nnow\t10.0.0.1\t1\t10.0.0.2\t2\ttcp\n",
+		`{"ts":true,"id.orig_h":"10.0.0.1","id.orig_p":1,"id.resp_h":"10.0.0.2","id.resp_p":2,"proto":"tcp"}`,
+		`[{"ts":1514808000`,
+	} {
+		if conns, err := ParseConns([]byte(log)); err == nil {
+			t.Errorf("%q: got %+v, want an error", log, conns)
+		}
+	}
+	for _, log := range []string{
+		"",
+		`{"ts":1514808000,"id.orig_h":"host","id.orig_p":1,"id.resp_h":"10.0.0.2","id.resp_p":2,"proto":"tcp"}`,
+		`{"ts":1514808000,"id.orig_h":"10.0.0.1","id.orig_p":1,"id.resp_h":"10.0.0.2","id.resp_p":2,"proto":"sctp"}`,
+		`{"ts":1514808000,"id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2","proto":"udp"}`,
+	} {
+		conns, err := ParseConns([]byte(log))
+		if err != nil {
+			t.Errorf("%q: %v", log, err)
+			continue
+		}
+		if q, err := Query(conns, time.Minute); err == nil {
+			t.Errorf("%q: got %q, want an error", log, q)
+		}
+	}
+}